@@ -0,0 +1,720 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// a DynamoDB client that sends requests for the managed table through the Library and everything else straight to
+// DynamoDB (see Client)
+type managedClient struct {
+	dynamodbiface.DynamoDBAPI
+	library *Library
+}
+
+// Client returns a DynamoDB client that implements dynamodbiface.DynamoDBAPI, so that applications using
+// higher-level mappers (e.g., guregu/dynamo) can route their requests through the Library without rewriting their
+// data access code.
+//
+// Requests for the managed table made with GetItem, PutItem, UpdateItem, DeleteItem, BatchGetItem, BatchWriteItem,
+// Scan, Query, and TransactWriteItems (with or without a context, and including ScanPages, QueryPages, and
+// BatchGetItemPages) are handled by the corresponding Library methods; batches that mix the managed table with others
+// are split between the Library and DynamoDB, while such transactions are rejected. Requests for any other table, and
+// all other operations, go straight to DynamoDB.
+//
+// The *Request variants (e.g., GetItemRequest) cannot be handled by the Library: for the managed table, they return a
+// request that fails with an *UnsupportedInputError when sent.
+//
+// In strict mode (see WithStrictMode), PartiQL statements and TransactGetItems requests on the managed table, which
+// would bypass snapshots, are rejected with an *UnsupportedInputError instead.
+//
+// Contexts are passed on to the Library's *WithContext methods, but request options are not supported: they are ignored
+// for the managed table.
+//
+// It fails with ErrStorageNotClient if the Library uses a Storage that does not implement dynamodbiface.DynamoDBAPI
+// (see WithStorage): requests for other tables, and other operations, would have nowhere to go.
+func (c *Library) Client() (dynamodbiface.DynamoDBAPI, error) {
+	api, ok := c.svc.(dynamodbiface.DynamoDBAPI)
+	if !ok {
+		return nil, ErrStorageNotClient
+	}
+
+	return &managedClient{DynamoDBAPI: api, library: c}, nil
+}
+
+func (m *managedClient) isManaged(table *string) bool {
+	return aws.StringValue(table) == m.library.tableName
+}
+
+func (m *managedClient) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.GetItem(input)
+	}
+
+	return m.library.GetItem(input)
+}
+
+func (m *managedClient) GetItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	opts ...request.Option,
+) (*dynamodb.GetItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.GetItemWithContext(ctx, input, opts...)
+	}
+
+	return m.library.GetItemWithContext(ctx, input)
+}
+
+func (m *managedClient) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.PutItem(input)
+	}
+
+	return m.library.PutItem(input)
+}
+
+func (m *managedClient) PutItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.PutItemInput,
+	opts ...request.Option,
+) (*dynamodb.PutItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.PutItemWithContext(ctx, input, opts...)
+	}
+
+	return m.library.PutItemWithContext(ctx, input)
+}
+
+func (m *managedClient) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.UpdateItem(input)
+	}
+
+	return m.library.UpdateItem(input)
+}
+
+func (m *managedClient) UpdateItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.UpdateItemInput,
+	opts ...request.Option,
+) (*dynamodb.UpdateItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.UpdateItemWithContext(ctx, input, opts...)
+	}
+
+	return m.library.UpdateItemWithContext(ctx, input)
+}
+
+func (m *managedClient) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.DeleteItem(input)
+	}
+
+	return m.library.DeleteItem(input)
+}
+
+func (m *managedClient) DeleteItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.DeleteItemInput,
+	opts ...request.Option,
+) (*dynamodb.DeleteItemOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.DeleteItemWithContext(ctx, input, opts...)
+	}
+
+	return m.library.DeleteItemWithContext(ctx, input)
+}
+
+func (m *managedClient) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.Scan(input)
+	}
+
+	return m.library.Scan(input)
+}
+
+func (m *managedClient) ScanWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	opts ...request.Option,
+) (*dynamodb.ScanOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.ScanWithContext(ctx, input, opts...)
+	}
+
+	return m.library.ScanWithContext(ctx, input)
+}
+
+func (m *managedClient) ScanPages(input *dynamodb.ScanInput, fn func(*dynamodb.ScanOutput, bool) bool) error {
+	return m.ScanPagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (m *managedClient) ScanPagesWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	fn func(*dynamodb.ScanOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.ScanPagesWithContext(ctx, input, fn, opts...)
+	}
+
+	// don't change the caller's input while following LastEvaluatedKey
+	inputCopy := *input
+	for {
+		out, err := m.ScanWithContext(ctx, &inputCopy)
+		if err != nil {
+			return err
+		}
+
+		lastPage := len(out.LastEvaluatedKey) == 0
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		inputCopy.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+func (m *managedClient) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return m.BatchGetItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) BatchGetItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchGetItemInput,
+	opts ...request.Option,
+) (*dynamodb.BatchGetItemOutput, error) {
+	managed, ok := input.RequestItems[m.library.tableName]
+	if !ok {
+		return m.DynamoDBAPI.BatchGetItemWithContext(ctx, input, opts...)
+	}
+	if len(input.RequestItems) == 1 {
+		return m.library.BatchGetItemWithContext(ctx, input)
+	}
+
+	// split the batch between the Library and DynamoDB...
+	others := *input
+	others.RequestItems = make(map[string]*dynamodb.KeysAndAttributes, len(input.RequestItems)-1)
+	for table, keys := range input.RequestItems {
+		if table != m.library.tableName {
+			others.RequestItems[table] = keys
+		}
+	}
+	out, err := m.DynamoDBAPI.BatchGetItemWithContext(ctx, &others, opts...)
+	if err != nil {
+		return nil, err
+	}
+	managedOut, err := m.library.BatchGetItemWithContext(ctx, &dynamodb.BatchGetItemInput{
+		RequestItems:           map[string]*dynamodb.KeysAndAttributes{m.library.tableName: managed},
+		ReturnConsumedCapacity: input.ReturnConsumedCapacity,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ...and put the results back together
+	if out.Responses == nil {
+		out.Responses = make(map[string][]map[string]*dynamodb.AttributeValue, 0)
+	}
+	for table, items := range managedOut.Responses {
+		out.Responses[table] = items
+	}
+	if out.UnprocessedKeys == nil {
+		out.UnprocessedKeys = make(map[string]*dynamodb.KeysAndAttributes, 0)
+	}
+	for table, keys := range managedOut.UnprocessedKeys {
+		out.UnprocessedKeys[table] = keys
+	}
+	out.ConsumedCapacity = append(out.ConsumedCapacity, managedOut.ConsumedCapacity...)
+
+	return out, nil
+}
+
+func (m *managedClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return m.BatchWriteItemWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) BatchWriteItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchWriteItemInput,
+	opts ...request.Option,
+) (*dynamodb.BatchWriteItemOutput, error) {
+	managed, ok := input.RequestItems[m.library.tableName]
+	if !ok {
+		return m.DynamoDBAPI.BatchWriteItemWithContext(ctx, input, opts...)
+	}
+	if len(input.RequestItems) == 1 {
+		return m.library.BatchWriteItemWithContext(ctx, input)
+	}
+
+	// split the batch between the Library and DynamoDB...
+	others := *input
+	others.RequestItems = make(map[string][]*dynamodb.WriteRequest, len(input.RequestItems)-1)
+	for table, requests := range input.RequestItems {
+		if table != m.library.tableName {
+			others.RequestItems[table] = requests
+		}
+	}
+	out, err := m.DynamoDBAPI.BatchWriteItemWithContext(ctx, &others, opts...)
+	if err != nil {
+		return nil, err
+	}
+	managedOut, err := m.library.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+		RequestItems:                map[string][]*dynamodb.WriteRequest{m.library.tableName: managed},
+		ReturnConsumedCapacity:      input.ReturnConsumedCapacity,
+		ReturnItemCollectionMetrics: input.ReturnItemCollectionMetrics,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ...and put the results back together
+	if out.UnprocessedItems == nil {
+		out.UnprocessedItems = make(map[string][]*dynamodb.WriteRequest, 0)
+	}
+	for table, requests := range managedOut.UnprocessedItems {
+		out.UnprocessedItems[table] = requests
+	}
+	if out.ItemCollectionMetrics == nil {
+		out.ItemCollectionMetrics = make(map[string][]*dynamodb.ItemCollectionMetrics, 0)
+	}
+	for table, metrics := range managedOut.ItemCollectionMetrics {
+		out.ItemCollectionMetrics[table] = metrics
+	}
+	out.ConsumedCapacity = append(out.ConsumedCapacity, managedOut.ConsumedCapacity...)
+
+	return out, nil
+}
+
+func (m *managedClient) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.Query(input)
+	}
+
+	return m.library.Query(input)
+}
+
+func (m *managedClient) QueryWithContext(
+	ctx aws.Context,
+	input *dynamodb.QueryInput,
+	opts ...request.Option,
+) (*dynamodb.QueryOutput, error) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.QueryWithContext(ctx, input, opts...)
+	}
+
+	return m.library.QueryWithContext(ctx, input)
+}
+
+func (m *managedClient) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	return m.QueryPagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (m *managedClient) QueryPagesWithContext(
+	ctx aws.Context,
+	input *dynamodb.QueryInput,
+	fn func(*dynamodb.QueryOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.QueryPagesWithContext(ctx, input, fn, opts...)
+	}
+
+	// don't change the caller's input while following LastEvaluatedKey
+	inputCopy := *input
+	for {
+		out, err := m.QueryWithContext(ctx, &inputCopy)
+		if err != nil {
+			return err
+		}
+
+		lastPage := len(out.LastEvaluatedKey) == 0
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		inputCopy.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// count the items of a transaction that belong to the managed table
+func (m *managedClient) managedTransactItems(items []*dynamodb.TransactWriteItem) int {
+	managed := 0
+	for _, item := range items {
+		switch {
+		case item.ConditionCheck != nil && m.isManaged(item.ConditionCheck.TableName),
+			item.Delete != nil && m.isManaged(item.Delete.TableName),
+			item.Put != nil && m.isManaged(item.Put.TableName),
+			item.Update != nil && m.isManaged(item.Update.TableName):
+			managed++
+		}
+	}
+
+	return managed
+}
+
+func (m *managedClient) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	return m.TransactWriteItemsWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) TransactWriteItemsWithContext(
+	ctx aws.Context,
+	input *dynamodb.TransactWriteItemsInput,
+	opts ...request.Option,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	managed := m.managedTransactItems(input.TransactItems)
+	if managed == 0 {
+		return m.DynamoDBAPI.TransactWriteItemsWithContext(ctx, input, opts...)
+	}
+	// a transaction cannot be split
+	if managed < len(input.TransactItems) {
+		return nil, &UnsupportedInputError{
+			Operation:      "TransactWriteItems",
+			Feature:        "TransactItems",
+			Reason:         "mixing the managed table (" + m.library.tableName + ") with others",
+			multipleTables: true,
+		}
+	}
+
+	return m.library.TransactWriteItemsWithContext(ctx, input)
+}
+
+// in strict mode, reject PartiQL statements on the managed table: they would read and write the items as they are
+// stored, bypassing snapshots altogether
+func (m *managedClient) checkStatements(operation string, statements ...*string) error {
+	if !m.library.strict {
+		return nil
+	}
+
+	for _, statement := range statements {
+		if m.library.isManagedStatement(statement) {
+			return &UnsupportedInputError{
+				Operation: operation,
+				Feature:   "Statement",
+				Reason:    "it refers to the managed table (" + m.library.tableName + "), bypassing snapshots",
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *managedClient) ExecuteStatement(
+	input *dynamodb.ExecuteStatementInput,
+) (*dynamodb.ExecuteStatementOutput, error) {
+	return m.ExecuteStatementWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) ExecuteStatementWithContext(
+	ctx aws.Context,
+	input *dynamodb.ExecuteStatementInput,
+	opts ...request.Option,
+) (*dynamodb.ExecuteStatementOutput, error) {
+	err := m.checkStatements("ExecuteStatement", input.Statement)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.DynamoDBAPI.ExecuteStatementWithContext(ctx, input, opts...)
+}
+
+func (m *managedClient) BatchExecuteStatement(
+	input *dynamodb.BatchExecuteStatementInput,
+) (*dynamodb.BatchExecuteStatementOutput, error) {
+	return m.BatchExecuteStatementWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) BatchExecuteStatementWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchExecuteStatementInput,
+	opts ...request.Option,
+) (*dynamodb.BatchExecuteStatementOutput, error) {
+	statements := make([]*string, 0, len(input.Statements))
+	for _, statement := range input.Statements {
+		statements = append(statements, statement.Statement)
+	}
+	err := m.checkStatements("BatchExecuteStatement", statements...)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.DynamoDBAPI.BatchExecuteStatementWithContext(ctx, input, opts...)
+}
+
+func (m *managedClient) ExecuteTransaction(
+	input *dynamodb.ExecuteTransactionInput,
+) (*dynamodb.ExecuteTransactionOutput, error) {
+	return m.ExecuteTransactionWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) ExecuteTransactionWithContext(
+	ctx aws.Context,
+	input *dynamodb.ExecuteTransactionInput,
+	opts ...request.Option,
+) (*dynamodb.ExecuteTransactionOutput, error) {
+	statements := make([]*string, 0, len(input.TransactStatements))
+	for _, statement := range input.TransactStatements {
+		statements = append(statements, statement.Statement)
+	}
+	err := m.checkStatements("ExecuteTransaction", statements...)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.DynamoDBAPI.ExecuteTransactionWithContext(ctx, input, opts...)
+}
+
+func (m *managedClient) TransactGetItems(
+	input *dynamodb.TransactGetItemsInput,
+) (*dynamodb.TransactGetItemsOutput, error) {
+	return m.TransactGetItemsWithContext(aws.BackgroundContext(), input)
+}
+
+func (m *managedClient) TransactGetItemsWithContext(
+	ctx aws.Context,
+	input *dynamodb.TransactGetItemsInput,
+	opts ...request.Option,
+) (*dynamodb.TransactGetItemsOutput, error) {
+	if m.library.strict {
+		for _, item := range input.TransactItems {
+			if item.Get != nil && m.isManaged(item.Get.TableName) {
+				return nil, &UnsupportedInputError{
+					Operation: "TransactGetItems",
+					Feature:   "TransactItems",
+					Reason:    "reading the managed table (" + m.library.tableName + ") would bypass snapshots",
+				}
+			}
+		}
+	}
+
+	return m.DynamoDBAPI.TransactGetItemsWithContext(ctx, input, opts...)
+}
+
+func (m *managedClient) BatchGetItemPages(
+	input *dynamodb.BatchGetItemInput,
+	fn func(*dynamodb.BatchGetItemOutput, bool) bool,
+) error {
+	return m.BatchGetItemPagesWithContext(aws.BackgroundContext(), input, fn)
+}
+
+func (m *managedClient) BatchGetItemPagesWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchGetItemInput,
+	fn func(*dynamodb.BatchGetItemOutput, bool) bool,
+	opts ...request.Option,
+) error {
+	if _, ok := input.RequestItems[m.library.tableName]; !ok {
+		return m.DynamoDBAPI.BatchGetItemPagesWithContext(ctx, input, fn, opts...)
+	}
+
+	// don't change the caller's input while following UnprocessedKeys
+	inputCopy := *input
+	for {
+		out, err := m.BatchGetItemWithContext(ctx, &inputCopy, opts...)
+		if err != nil {
+			return err
+		}
+
+		lastPage := len(out.UnprocessedKeys) == 0
+		if !fn(out, lastPage) || lastPage {
+			return nil
+		}
+		inputCopy.RequestItems = out.UnprocessedKeys
+	}
+}
+
+// the *Request methods build requests that are sent straight to DynamoDB when the caller sends them, bypassing the
+// Library altogether; for the managed table, return a request that fails with err as soon as it is sent instead
+func failedRequest(operation string, output interface{}, err error) *request.Request {
+	return &request.Request{
+		Operation: &request.Operation{Name: operation},
+		Data:      output,
+		Error:     err,
+	}
+}
+
+func (m *managedClient) unsupportedRequest(operation string, output interface{}) *request.Request {
+	return failedRequest(operation, output, &UnsupportedInputError{
+		Operation: operation + "Request",
+		Feature:   "TableName",
+		Reason:    "requests for the managed table (" + m.library.tableName + ") must be made with " + operation,
+	})
+}
+
+func (m *managedClient) GetItemRequest(input *dynamodb.GetItemInput) (*request.Request, *dynamodb.GetItemOutput) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.GetItemRequest(input)
+	}
+
+	out := &dynamodb.GetItemOutput{}
+	return m.unsupportedRequest("GetItem", out), out
+}
+
+func (m *managedClient) PutItemRequest(input *dynamodb.PutItemInput) (*request.Request, *dynamodb.PutItemOutput) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.PutItemRequest(input)
+	}
+
+	out := &dynamodb.PutItemOutput{}
+	return m.unsupportedRequest("PutItem", out), out
+}
+
+func (m *managedClient) UpdateItemRequest(
+	input *dynamodb.UpdateItemInput,
+) (*request.Request, *dynamodb.UpdateItemOutput) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.UpdateItemRequest(input)
+	}
+
+	out := &dynamodb.UpdateItemOutput{}
+	return m.unsupportedRequest("UpdateItem", out), out
+}
+
+func (m *managedClient) DeleteItemRequest(
+	input *dynamodb.DeleteItemInput,
+) (*request.Request, *dynamodb.DeleteItemOutput) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.DeleteItemRequest(input)
+	}
+
+	out := &dynamodb.DeleteItemOutput{}
+	return m.unsupportedRequest("DeleteItem", out), out
+}
+
+func (m *managedClient) ScanRequest(input *dynamodb.ScanInput) (*request.Request, *dynamodb.ScanOutput) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.ScanRequest(input)
+	}
+
+	out := &dynamodb.ScanOutput{}
+	return m.unsupportedRequest("Scan", out), out
+}
+
+func (m *managedClient) QueryRequest(input *dynamodb.QueryInput) (*request.Request, *dynamodb.QueryOutput) {
+	if !m.isManaged(input.TableName) {
+		return m.DynamoDBAPI.QueryRequest(input)
+	}
+
+	out := &dynamodb.QueryOutput{}
+	return m.unsupportedRequest("Query", out), out
+}
+
+func (m *managedClient) BatchGetItemRequest(
+	input *dynamodb.BatchGetItemInput,
+) (*request.Request, *dynamodb.BatchGetItemOutput) {
+	if _, ok := input.RequestItems[m.library.tableName]; !ok {
+		return m.DynamoDBAPI.BatchGetItemRequest(input)
+	}
+
+	out := &dynamodb.BatchGetItemOutput{}
+	return m.unsupportedRequest("BatchGetItem", out), out
+}
+
+func (m *managedClient) BatchWriteItemRequest(
+	input *dynamodb.BatchWriteItemInput,
+) (*request.Request, *dynamodb.BatchWriteItemOutput) {
+	if _, ok := input.RequestItems[m.library.tableName]; !ok {
+		return m.DynamoDBAPI.BatchWriteItemRequest(input)
+	}
+
+	out := &dynamodb.BatchWriteItemOutput{}
+	return m.unsupportedRequest("BatchWriteItem", out), out
+}
+
+func (m *managedClient) TransactWriteItemsRequest(
+	input *dynamodb.TransactWriteItemsInput,
+) (*request.Request, *dynamodb.TransactWriteItemsOutput) {
+	if m.managedTransactItems(input.TransactItems) == 0 {
+		return m.DynamoDBAPI.TransactWriteItemsRequest(input)
+	}
+
+	out := &dynamodb.TransactWriteItemsOutput{}
+	return m.unsupportedRequest("TransactWriteItems", out), out
+}
+
+func (m *managedClient) TransactGetItemsRequest(
+	input *dynamodb.TransactGetItemsInput,
+) (*request.Request, *dynamodb.TransactGetItemsOutput) {
+	if m.library.strict {
+		for _, item := range input.TransactItems {
+			if item.Get != nil && m.isManaged(item.Get.TableName) {
+				out := &dynamodb.TransactGetItemsOutput{}
+				return failedRequest("TransactGetItems", out, &UnsupportedInputError{
+					Operation: "TransactGetItemsRequest",
+					Feature:   "TransactItems",
+					Reason:    "reading the managed table (" + m.library.tableName + ") would bypass snapshots",
+				}), out
+			}
+		}
+	}
+
+	return m.DynamoDBAPI.TransactGetItemsRequest(input)
+}
+
+func (m *managedClient) ExecuteStatementRequest(
+	input *dynamodb.ExecuteStatementInput,
+) (*request.Request, *dynamodb.ExecuteStatementOutput) {
+	err := m.checkStatements("ExecuteStatementRequest", input.Statement)
+	if err != nil {
+		out := &dynamodb.ExecuteStatementOutput{}
+		return failedRequest("ExecuteStatement", out, err), out
+	}
+
+	return m.DynamoDBAPI.ExecuteStatementRequest(input)
+}
+
+func (m *managedClient) BatchExecuteStatementRequest(
+	input *dynamodb.BatchExecuteStatementInput,
+) (*request.Request, *dynamodb.BatchExecuteStatementOutput) {
+	statements := make([]*string, 0, len(input.Statements))
+	for _, statement := range input.Statements {
+		statements = append(statements, statement.Statement)
+	}
+	err := m.checkStatements("BatchExecuteStatementRequest", statements...)
+	if err != nil {
+		out := &dynamodb.BatchExecuteStatementOutput{}
+		return failedRequest("BatchExecuteStatement", out, err), out
+	}
+
+	return m.DynamoDBAPI.BatchExecuteStatementRequest(input)
+}
+
+func (m *managedClient) ExecuteTransactionRequest(
+	input *dynamodb.ExecuteTransactionInput,
+) (*request.Request, *dynamodb.ExecuteTransactionOutput) {
+	statements := make([]*string, 0, len(input.TransactStatements))
+	for _, statement := range input.TransactStatements {
+		statements = append(statements, statement.Statement)
+	}
+	err := m.checkStatements("ExecuteTransactionRequest", statements...)
+	if err != nil {
+		out := &dynamodb.ExecuteTransactionOutput{}
+		return failedRequest("ExecuteTransaction", out, err), out
+	}
+
+	return m.DynamoDBAPI.ExecuteTransactionRequest(input)
+}
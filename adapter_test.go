@@ -0,0 +1,120 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+func TestLibrary_Client(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		client, err := library.Client()
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		table := aws.String(getTableName(schema))
+
+		// write one version of the item before the snapshot and another one after it
+		for i, value := range []string{"before", "after"} {
+			_, err := client.PutItem(&dynamodb.PutItemInput{
+				TableName: table,
+				Item:      getAttributeValueForItem(schema, value),
+			})
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if i == 0 {
+				library.Snapshot("1")
+			}
+		}
+
+		// both versions are read through the Library
+		out, err := client.GetItemWithContext(aws.BackgroundContext(), &dynamodb.GetItemInput{
+			TableName: table,
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if *out.Item[valueField].S != "after" {
+			t.Error("expected after, got", *out.Item[valueField].S)
+		}
+		pages := 0
+		err = client.ScanPages(&dynamodb.ScanInput{TableName: table}, func(page *dynamodb.ScanOutput, last bool) bool {
+			pages++
+			if len(page.Items) != 1 {
+				t.Error("expected 1 item in the active snapshot, got", len(page.Items))
+			}
+			return true
+		})
+		if err != nil || pages != 1 {
+			t.Error("expected a single page and no errors, got", pages, err)
+		}
+
+		queried, err := client.Query(&dynamodb.QueryInput{
+			TableName:                 table,
+			KeyConditionExpression:    aws.String(partitionKey + " = :pk"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": getAttributeValueForKey(schema)[partitionKey]},
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if len(queried.Items) != 1 || *queried.Items[0][valueField].S != fmtValueTag("after") {
+			t.Error("expected a single item from the active snapshot, got", queried.Items)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+// a DynamoDB client that is never called
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+}
+
+func TestManagedClient_requests(t *testing.T) {
+	library := &Library{tableName: "movies"}
+	if _, err := library.Client(); err != ErrStorageNotClient {
+		t.Error("expected ErrStorageNotClient without a DynamoDB client, got", err)
+	}
+
+	library.svc = &fakeDynamoDB{}
+	client, err := library.Client()
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+
+	req, _ := client.GetItemRequest(&dynamodb.GetItemInput{TableName: aws.String("movies")})
+	var unsupported *UnsupportedInputError
+	if err := req.Send(); !errors.As(err, &unsupported) {
+		t.Error("expected an *UnsupportedInputError, got", err)
+	}
+	req, _ = client.BatchWriteItemRequest(&dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]*dynamodb.WriteRequest{"movies": nil},
+	})
+	if err := req.Send(); !errors.As(err, &unsupported) {
+		t.Error("expected an *UnsupportedInputError, got", err)
+	}
+}
@@ -0,0 +1,808 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/marcoalmeida/ddblibrarian/retry"
+)
+
+const (
+	// maximum number of requests DynamoDB accepts on a single BatchWriteItem call
+	maxBatchWriteSize = 25
+	// maximum size, in bytes, of a BatchWriteItem request; large items, in particular binary ones (which are base64
+	// encoded on the wire), can exceed it well before maxBatchWriteSize is reached
+	maxBatchWriteBytes = 16 * 1024 * 1024
+	// room left in every BatchWriteItem request for the table name and the JSON around the requests
+	batchWriteOverhead = 1024
+	// maximum number of keys DynamoDB accepts on a single BatchGetItem call
+	maxBatchGetSize = 100
+)
+
+// the error of a bulk write that failed part way, along with what it did and did not write
+type batchWriteError struct {
+	err error
+	// number of requests written before giving up
+	written int
+	// keys of the items in the batches that failed, without the snapshot
+	keys []map[string]*dynamodb.AttributeValue
+}
+
+func (e *batchWriteError) Error() string {
+	return e.err.Error()
+}
+
+func (e *batchWriteError) Unwrap() error {
+	return e.err
+}
+
+// write requests to the managed table as they are, i.e., without adding snapshot IDs, in batches of at most
+// maxBatchWriteSize requests and maxBatchWriteBytes (see splitWriteRequests), written up to concurrency() at a time;
+// throttled requests and unprocessed items are retried with exponential backoff. While the table is being migrated in
+// compatibility mode, the copies of the items in the old key encoding are deleted too (see oldEncodingDeletes). It
+// returns the write capacity consumed, and a *batchWriteError if any batch failed.
+func (c *Library) writeRequests(ctx aws.Context, requests []*dynamodb.WriteRequest) (float64, error) {
+	before, after := c.oldEncodingDeletes(requests)
+	if len(before) == 0 && len(after) == 0 {
+		return c.writeRequestBatches(ctx, requests)
+	}
+
+	consumed, err := c.writeRequestBatches(ctx, before)
+	if err != nil {
+		return consumed, &batchWriteError{err: err, keys: c.writeRequestKeys(requests)}
+	}
+	units, err := c.writeRequestBatches(ctx, requests)
+	consumed += units
+	if err != nil {
+		return consumed, err
+	}
+	units, err = c.writeRequestBatches(ctx, after)
+	consumed += units
+	if err != nil {
+		return consumed, &batchWriteError{
+			err:     wrapError("failed to delete the items in the old key encoding", err),
+			written: len(requests),
+		}
+	}
+
+	return consumed, nil
+}
+
+// write requests in batches, as writeRequests does, without looking for copies in the old key encoding
+func (c *Library) writeRequestBatches(ctx aws.Context, requests []*dynamodb.WriteRequest) (float64, error) {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var consumed float64
+	var written int
+	var failure *batchWriteError
+
+	ctx, cancel := c.bulkContext(ctx)
+	defer cancel()
+
+	slots := make(chan struct{}, c.concurrency())
+	for _, batch := range splitWriteRequests(requests) {
+		slots <- struct{}{}
+		mutex.Lock()
+		failed := failure != nil
+		mutex.Unlock()
+		if failed {
+			<-slots
+			break
+		}
+
+		wg.Add(1)
+		go func(batch []*dynamodb.WriteRequest) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			units, err := c.writeBatch(ctx, batch)
+			mutex.Lock()
+			defer mutex.Unlock()
+			consumed += units
+			if err == nil {
+				written += len(batch)
+				return
+			}
+			if failure == nil {
+				failure = &batchWriteError{err: err}
+			}
+			failure.keys = append(failure.keys, c.writeRequestKeys(batch)...)
+		}(batch)
+	}
+	wg.Wait()
+
+	if failure != nil {
+		failure.written = written
+		return consumed, failure
+	}
+
+	return consumed, nil
+}
+
+// split requests into batches that fit a single BatchWriteItem call, i.e., with at most maxBatchWriteSize requests and
+// maxBatchWriteBytes once serialized. A request too large to fit any batch gets one of its own, and DynamoDB rejects
+// it with a ValidationException.
+func splitWriteRequests(requests []*dynamodb.WriteRequest) [][]*dynamodb.WriteRequest {
+	var batches [][]*dynamodb.WriteRequest
+
+	start, size := 0, batchWriteOverhead
+	for i, r := range requests {
+		n := writeRequestSize(r)
+		if i > start && (i-start == maxBatchWriteSize || size+n > maxBatchWriteBytes) {
+			batches = append(batches, requests[start:i])
+			start, size = i, batchWriteOverhead
+		}
+		size += n
+	}
+	if start < len(requests) {
+		batches = append(batches, requests[start:])
+	}
+
+	return batches
+}
+
+// return the size of r once serialized for a BatchWriteItem request
+func writeRequestSize(r *dynamodb.WriteRequest) int {
+	// same as the wire format, which is also the format of dumps
+	var encoded []byte
+	var err error
+	if r.PutRequest != nil {
+		encoded, err = json.Marshal(dumpedItem{Item: toJSONItem(r.PutRequest.Item)})
+	} else if r.DeleteRequest != nil {
+		encoded, err = json.Marshal(dumpedItem{Item: toJSONItem(r.DeleteRequest.Key)})
+	}
+	if err != nil {
+		// cannot be serialized anyway, so let DynamoDB reject it on a batch of its own
+		return maxBatchWriteBytes
+	}
+
+	// {"PutRequest":...} or {"DeleteRequest":...}, and a comma
+	return len(encoded) + len(`{"DeleteRequest":},`)
+}
+
+// return the keys of the items written, or deleted, by requests, without the snapshot
+func (c *Library) writeRequestKeys(requests []*dynamodb.WriteRequest) []map[string]*dynamodb.AttributeValue {
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(requests))
+	for _, r := range requests {
+		var key map[string]*dynamodb.AttributeValue
+		if r.PutRequest != nil {
+			key = c.primaryKey(r.PutRequest.Item)
+		} else {
+			key = c.primaryKey(r.DeleteRequest.Key)
+		}
+		pk := *key[c.partitionKey]
+		c.removeSnapshotFromPartitionKey(&pk)
+		key[c.partitionKey] = &pk
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// write a single batch of requests, retrying throttled requests and unprocessed items, and return the write
+// capacity consumed
+func (c *Library) writeBatch(ctx aws.Context, batch []*dynamodb.WriteRequest) (float64, error) {
+	var consumed float64
+
+	// hold on while the job is paused (see Job)
+	if err := jobFromContext(ctx).wait(ctx); err != nil {
+		return 0, err
+	}
+
+	pending := map[string][]*dynamodb.WriteRequest{c.tableName: batch}
+	for attempt := 0; len(pending) > 0; attempt++ {
+		// throttled requests, and unprocessed items, are retried as retry.DefaultPolicy says
+		if attempt > retry.DefaultPolicy().MaxRetries {
+			return consumed, errors.New("giving up on unprocessed items after too many retries")
+		}
+		time.Sleep(retry.DefaultPolicy().Delay(attempt))
+
+		output, err := c.storage(ctx).BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems:           pending,
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if err != nil {
+			if retry.IsThrottling(err) {
+				continue
+			}
+			return consumed, err
+		}
+		consumed += c.consumedCapacity(output.ConsumedCapacity)
+		pending = output.UnprocessedItems
+	}
+
+	return consumed, nil
+}
+
+// GetItems reads the items with the given primary keys, as GetItem would, starting from snapshot and falling back to
+// the snapshots it was taken on top of (an empty snapshot refers to the active one). Keys are read in batches of at
+// most 100, retrying throttled requests and unprocessed keys with exponential backoff. The items returned are in the
+// same order as keys, with a nil placeholder for each key that does not exist.
+//
+// Overhead: 1+N read units per batch of 100 keys, in the worst case, where N is the number of existing snapshots
+func (c *Library) GetItems(
+	keys []map[string]*dynamodb.AttributeValue,
+	snapshot string,
+) ([]map[string]*dynamodb.AttributeValue, error) {
+	return c.GetItemsWithContext(aws.BackgroundContext(), keys, snapshot)
+}
+
+// GetItemsWithContext is the same as GetItems with the addition of the ability to pass a context, which is passed on
+// to every request made to the table.
+func (c *Library) GetItemsWithContext(
+	ctx aws.Context,
+	keys []map[string]*dynamodb.AttributeValue,
+	snapshot string,
+) ([]map[string]*dynamodb.AttributeValue, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	startFrom := c.activeSnapshotID(meta)
+	if snapshot != "" {
+		startFrom, err = meta.getSnapshotID(snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// maybe the items were created before any snapshots were created
+	items, _, err := c.findItems(ctx, keys, append(meta.GetChronologicalSnapshotIDs(startFrom), ""), nil)
+	return items, err
+}
+
+// BatchGetAll is the same as BatchGetItem, except that it takes any number of keys: they are read in batches of at
+// most 100, retrying throttled requests and unprocessed keys with exponential backoff, and the responses are merged
+// into a single output, with no unprocessed keys left. Each key is read from the active snapshot or, if the item was
+// not written to it, from the most recent snapshot it falls back to that has it. Keys that appear more than once are
+// read only once.
+//
+// ProjectionExpression, AttributesToGet, and ConsistentRead are honored; the primary key is always part of the items
+// returned, as it is needed to tell which keys are still missing.
+//
+// Overhead: 1+N read units per batch of 100 keys, in the worst case, where N is the number of existing snapshots
+func (c *Library) BatchGetAll(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return c.BatchGetAllWithContext(aws.BackgroundContext(), input)
+}
+
+// BatchGetAllWithContext is the same as BatchGetAll with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) BatchGetAllWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchGetItemInput,
+) (*dynamodb.BatchGetItemOutput, error) {
+	if len(input.RequestItems) > 1 {
+		return nil, &UnsupportedInputError{
+			Operation:      "BatchGetAll",
+			Feature:        "RequestItems",
+			Reason:         "retrieving data from multiple tables",
+			multipleTables: true,
+		}
+	}
+
+	keysAndAttributes, ok := input.RequestItems[c.tableName]
+	if !ok || keysAndAttributes == nil {
+		// there is a single table (or none at all)
+		mismatch := &TableMismatchError{Managed: c.tableName}
+		for table := range input.RequestItems {
+			mismatch.Table = table
+		}
+		return nil, mismatch
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.batchGetConsistency(input))
+	if err != nil {
+		return nil, err
+	}
+
+	// default to fetching data from the active/current snapshot (could be latest, a rollback, or a pin)
+	startFrom := c.activeSnapshotID(meta)
+	items, _, err := c.findItems(ctx, keysAndAttributes.Keys, append(meta.GetChronologicalSnapshotIDs(startFrom), ""),
+		c.withPrimaryKeyProjection(keysAndAttributes))
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make([]map[string]*dynamodb.AttributeValue, 0, len(items))
+	returned := make(map[string]bool, len(items))
+	for _, item := range items {
+		if item == nil {
+			continue
+		}
+		s, _ := c.keyString(item)
+		if returned[s] {
+			continue
+		}
+		returned[s] = true
+		responses = append(responses, item)
+	}
+
+	return &dynamodb.BatchGetItemOutput{
+		Responses:       map[string][]map[string]*dynamodb.AttributeValue{c.tableName: responses},
+		UnprocessedKeys: map[string]*dynamodb.KeysAndAttributes{},
+	}, nil
+}
+
+// return a copy of keysAndAttributes that also projects the primary key, if it projects anything at all, so the items
+// read can be matched against the keys requested; key attributes that are already projected are not projected again,
+// as DynamoDB rejects duplicate attributes and overlapping paths
+func (c *Library) withPrimaryKeyProjection(keysAndAttributes *dynamodb.KeysAndAttributes) *dynamodb.KeysAndAttributes {
+	request := *keysAndAttributes
+	keyAttributes := []string{c.partitionKey}
+	if c.rangeKey != "" {
+		keyAttributes = append(keyAttributes, c.rangeKey)
+	}
+
+	if request.AttributesToGet != nil {
+		projected := make(map[string]bool, len(request.AttributesToGet))
+		for _, attribute := range request.AttributesToGet {
+			projected[aws.StringValue(attribute)] = true
+		}
+		attributes := make([]*string, 0, len(keyAttributes)+len(request.AttributesToGet))
+		for _, attribute := range keyAttributes {
+			if !projected[attribute] {
+				attributes = append(attributes, aws.String(attribute))
+			}
+		}
+		request.AttributesToGet = append(attributes, request.AttributesToGet...)
+	}
+	if request.ProjectionExpression != nil {
+		names := make(map[string]*string, len(request.ExpressionAttributeNames)+len(keyAttributes))
+		for k, v := range request.ExpressionAttributeNames {
+			names[k] = v
+		}
+		projection := aws.StringValue(request.ProjectionExpression)
+		projected := projectedAttributes(projection, names)
+		for i, attribute := range keyAttributes {
+			if projected[attribute] {
+				continue
+			}
+			placeholder := fmt.Sprintf("#ddblibrarianKey%d", i)
+			names[placeholder] = aws.String(attribute)
+			projection += ", " + placeholder
+		}
+		request.ProjectionExpression = aws.String(projection)
+		request.ExpressionAttributeNames = names
+	}
+
+	return &request
+}
+
+// return the top-level attributes of the paths in a projection expression, with names resolved
+func projectedAttributes(projection string, names map[string]*string) map[string]bool {
+	attributes := make(map[string]bool)
+	for _, path := range strings.Split(projection, ",") {
+		attribute := strings.TrimSpace(path)
+		if i := strings.IndexAny(attribute, ".["); i >= 0 {
+			attribute = strings.TrimSpace(attribute[:i])
+		}
+		if name, ok := names[attribute]; ok && strings.HasPrefix(attribute, "#") {
+			attribute = aws.StringValue(name)
+		}
+		attributes[attribute] = true
+	}
+
+	return attributes
+}
+
+// PutItems writes items to the active snapshot, as PutItem would, in batches of at most 25, up to WithMaxConcurrency
+// batches at a time; throttled requests and unprocessed items are retried with exponential backoff. When several
+// items have the same primary key, only the last one is written, so the outcome is the same as writing them in order.
+// The items themselves are not modified.
+//
+// Overhead: 1RU
+func (c *Library) PutItems(items []map[string]*dynamodb.AttributeValue) error {
+	return c.PutItemsWithContext(aws.BackgroundContext(), items)
+}
+
+// PutItemsWithContext is the same as PutItems with the addition of the ability to pass a context, which is passed on
+// to every request made to the table.
+func (c *Library) PutItemsWithContext(ctx aws.Context, items []map[string]*dynamodb.AttributeValue) error {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	id, err := meta.getWritableSnapshotID("PutItems", snapshotCurrent)
+	if err != nil {
+		return err
+	}
+
+	// DynamoDB rejects the same key twice in a single batch, and batches may be written in any order
+	last := make(map[string]int, len(items))
+	for i, item := range items {
+		if _, ok := item[c.partitionKey]; !ok {
+			return errors.New("missing partition key: " + c.partitionKey)
+		}
+		s, err := c.keyString(item)
+		if err != nil {
+			return err
+		}
+		last[s] = i
+	}
+	unique := make([]map[string]*dynamodb.AttributeValue, 0, len(last))
+	for i, item := range items {
+		s, _ := c.keyString(item)
+		if last[s] == i {
+			unique = append(unique, item)
+		}
+	}
+
+	_, err = c.putItemsWithSnapshotID(ctx, "PutItems", unique, id)
+	return err
+}
+
+// BatchWriteItemToSnapshots writes requests to several snapshots as a single logical operation, e.g., to delete a
+// key from one snapshot and write a corrected copy to another: requests maps each snapshot (Baseline for the data
+// written before any snapshots) to the put and delete requests to apply to it. Every snapshot is checked to exist, and
+// every request to be valid, before anything is written; then the requests of each snapshot are written, in the
+// order of the snapshot names, in batches of at most 25, as PutItemsToSnapshot would. Deletes apply to the snapshot
+// itself, without falling back to older ones. The requests themselves are not modified.
+//
+// Writing stops at the first snapshot that fails, with a *SnapshotWriteError telling what was and was not written.
+//
+// Cost: 1WU per request
+func (c *Library) BatchWriteItemToSnapshots(requests map[string][]*dynamodb.WriteRequest) error {
+	return c.BatchWriteItemToSnapshotsWithContext(aws.BackgroundContext(), requests)
+}
+
+// BatchWriteItemToSnapshotsWithContext is the same as BatchWriteItemToSnapshots with the addition of the ability to
+// pass a context, which is passed on to every request made to the table.
+func (c *Library) BatchWriteItemToSnapshotsWithContext(
+	ctx aws.Context,
+	requests map[string][]*dynamodb.WriteRequest,
+) error {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	snapshots := make([]string, 0, len(requests))
+	for snapshot := range requests {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Strings(snapshots)
+
+	// resolve everything up front, so that a mistake does not leave the operation half done
+	encoded := make(map[string][]*dynamodb.WriteRequest, len(requests))
+	for _, snapshot := range snapshots {
+		id, err := meta.getWritableSnapshotID("BatchWriteItemToSnapshots", snapshot)
+		if err != nil {
+			return err
+		}
+		encoded[snapshot], err = c.writeRequestsWithSnapshotID(ctx, requests[snapshot], id)
+		if err != nil {
+			return wrapError("invalid requests for snapshot '"+snapshot+"'", err)
+		}
+	}
+
+	written := make(map[string]int, len(snapshots))
+	for i, snapshot := range snapshots {
+		_, err := c.writeRequests(ctx, encoded[snapshot])
+		if err == nil {
+			written[snapshot] = len(encoded[snapshot])
+			continue
+		}
+
+		failure := &SnapshotWriteError{Snapshot: snapshot, Written: written, Pending: snapshots[i+1:], Err: err}
+		if batchErr, ok := err.(*batchWriteError); ok {
+			written[snapshot] = batchErr.written
+			failure.FailedKeys = batchErr.keys
+			failure.Err = batchErr.err
+		}
+		return failure
+	}
+
+	return nil
+}
+
+// return copies of requests with the snapshot ID added to every key, and every item tagged (see tagItem), refusing
+// requests without a partition key and keys that appear more than once, which DynamoDB rejects within a batch and
+// would otherwise be written in no particular order
+func (c *Library) writeRequestsWithSnapshotID(
+	ctx aws.Context,
+	requests []*dynamodb.WriteRequest,
+	snapshotID string,
+) ([]*dynamodb.WriteRequest, error) {
+	encoded := make([]*dynamodb.WriteRequest, 0, len(requests))
+	seen := make(map[string]bool, len(requests))
+	for _, r := range requests {
+		var item map[string]*dynamodb.AttributeValue
+		switch {
+		case r.PutRequest != nil && r.DeleteRequest == nil:
+			item = r.PutRequest.Item
+		case r.DeleteRequest != nil && r.PutRequest == nil:
+			item = r.DeleteRequest.Key
+		default:
+			return nil, errors.New("expected either a PutRequest or a DeleteRequest")
+		}
+		if _, ok := item[c.partitionKey]; !ok {
+			return nil, errors.New("missing partition key: " + c.partitionKey)
+		}
+		s, err := c.keyString(item)
+		if err != nil {
+			return nil, err
+		}
+		if seen[s] {
+			return nil, errors.New("the same key is written more than once: " + s)
+		}
+		seen[s] = true
+
+		key := c.keyWithSnapshot(c.primaryKey(item), snapshotID)
+		if err := c.checkNotMetaRow("BatchWriteItemToSnapshots", key); err != nil {
+			return nil, err
+		}
+
+		if r.DeleteRequest != nil {
+			encoded = append(encoded, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}})
+			continue
+		}
+		itemCopy := c.keyWithSnapshot(item, snapshotID)
+		if _, err := c.overflowItem(ctx, "BatchWriteItemToSnapshots", itemCopy); err != nil {
+			return nil, err
+		}
+		c.tagItem(itemCopy, snapshotID)
+		encoded = append(encoded, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: itemCopy}})
+	}
+
+	return encoded, nil
+}
+
+// DeleteItems deletes the items with the given primary keys, as DeleteItem would: from the active snapshot or, if an
+// item was not written to it, from the most recent snapshot it falls back to that has it. Keys that do not exist, or
+// appear more than once, are ignored. Keys are looked up in batches of at most 100, and deleted in batches of at most
+// 25, up to WithMaxConcurrency batches at a time.
+//
+// Overhead: 1+N read units per batch of 100 keys, in the worst case, where N is the number of existing snapshots
+func (c *Library) DeleteItems(keys []map[string]*dynamodb.AttributeValue) error {
+	return c.DeleteItemsWithContext(aws.BackgroundContext(), keys)
+}
+
+// DeleteItemsWithContext is the same as DeleteItems with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) DeleteItemsWithContext(ctx aws.Context, keys []map[string]*dynamodb.AttributeValue) error {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	// default to deleting from the active/current snapshot (could be latest, a rollback, or a pin)
+	startFrom := c.activeSnapshotID(meta)
+	items, foundIn, err := c.findItems(ctx, keys, append(meta.GetChronologicalSnapshotIDs(startFrom), ""), nil)
+	if err != nil {
+		return err
+	}
+
+	requests := make([]*dynamodb.WriteRequest, 0, len(keys))
+	deleted := make(map[string]bool, len(keys))
+	for i, item := range items {
+		if item == nil {
+			continue
+		}
+		s, _ := c.keyString(item)
+		if deleted[s] {
+			continue
+		}
+		deleted[s] = true
+		if err := meta.checkUnlocked("DeleteItems", foundIn[i]); err != nil {
+			return err
+		}
+		requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
+			Key: c.keyWithSnapshot(c.primaryKey(item), foundIn[i]),
+		}})
+	}
+
+	_, err = c.writeRequests(ctx, requests)
+	return err
+}
+
+// look for the items with the given keys in each of the snapshots in chain, in order, until all of them are found,
+// and return them in the same order as keys, along with the ID of the snapshot each one was found in; missing items
+// are nil. The projection and consistency of request, if not nil, are used for every batch.
+func (c *Library) findItems(
+	ctx aws.Context,
+	keys []map[string]*dynamodb.AttributeValue,
+	chain []string,
+	request *dynamodb.KeysAndAttributes,
+) ([]map[string]*dynamodb.AttributeValue, []string, error) {
+	// the same key may be requested more than once, but DynamoDB rejects duplicates in a single batch
+	positions := make(map[string][]int, len(keys))
+	pending := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for i, key := range keys {
+		s, err := c.keyString(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := positions[s]; !ok {
+			pending = append(pending, key)
+		}
+		positions[s] = append(positions[s], i)
+	}
+
+	items := make([]map[string]*dynamodb.AttributeValue, len(keys))
+	foundIn := make([]string, len(keys))
+	for _, id := range chain {
+		if len(pending) == 0 {
+			break
+		}
+
+		found, err := c.getKeysWithSnapshotID(ctx, pending, id, request)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// look for the keys still missing on the next snapshot
+		missing := make([]map[string]*dynamodb.AttributeValue, 0, len(pending))
+		for _, key := range pending {
+			s, _ := c.keyString(key)
+			item, ok := found[s]
+			if !ok {
+				missing = append(missing, key)
+				continue
+			}
+			for _, i := range positions[s] {
+				items[i] = item
+				foundIn[i] = id
+			}
+		}
+		pending = missing
+	}
+
+	return items, foundIn, nil
+}
+
+// read the items with the given (distinct) keys from a single snapshot, in batches of at most maxBatchGetSize, and
+// return them indexed by keyString; the projection and consistency of request, if not nil, are used for every batch
+func (c *Library) getKeysWithSnapshotID(
+	ctx aws.Context,
+	keys []map[string]*dynamodb.AttributeValue,
+	id string,
+	request *dynamodb.KeysAndAttributes,
+) (map[string]map[string]*dynamodb.AttributeValue, error) {
+	found := make(map[string]map[string]*dynamodb.AttributeValue, len(keys))
+	for start := 0; start < len(keys); start += maxBatchGetSize {
+		end := start + maxBatchGetSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batch := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+		for _, key := range keys[start:end] {
+			// the metadata row is never returned, whatever the key
+			stored := c.keyWithSnapshot(c.primaryKey(key), id)
+			if !c.isMetaRowKey(stored) {
+				batch = append(batch, stored)
+			}
+		}
+		if len(batch) == 0 {
+			continue
+		}
+
+		keysAndAttributes := &dynamodb.KeysAndAttributes{ConsistentRead: aws.Bool(c.consistentRead)}
+		if request != nil {
+			keysAndAttributes = &dynamodb.KeysAndAttributes{
+				AttributesToGet:          request.AttributesToGet,
+				ConsistentRead:           aws.Bool(c.isConsistentRead(request.ConsistentRead)),
+				ExpressionAttributeNames: request.ExpressionAttributeNames,
+				ProjectionExpression:     request.ProjectionExpression,
+			}
+		}
+		keysAndAttributes.Keys = batch
+		pending := map[string]*dynamodb.KeysAndAttributes{c.tableName: keysAndAttributes}
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt > retry.DefaultPolicy().MaxRetries {
+				return nil, errors.New("giving up on unprocessed keys after too many retries")
+			}
+			time.Sleep(retry.DefaultPolicy().Delay(attempt))
+
+			output, err := c.storage(ctx).BatchGetItem(&dynamodb.BatchGetItemInput{RequestItems: pending})
+			if err != nil {
+				if retry.IsThrottling(err) {
+					continue
+				}
+				return nil, err
+			}
+
+			for _, item := range output.Responses[c.tableName] {
+				c.removeSnapshotFromPartitionKey(item[c.partitionKey])
+				if err := c.readItem(ctx, item); err != nil {
+					return nil, err
+				}
+				s, err := c.keyString(item)
+				if err != nil {
+					return nil, err
+				}
+				found[s] = item
+			}
+			pending = output.UnprocessedKeys
+		}
+	}
+
+	return found, nil
+}
+
+// return a copy of an item's primary key
+func (c *Library) primaryKey(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{c.partitionKey: item[c.partitionKey]}
+	if c.rangeKey != "" {
+		key[c.rangeKey] = item[c.rangeKey]
+	}
+
+	return key
+}
+
+// return the ExpressionAttributeValue used to exclude the metadata row from a scan
+func (c *Library) metaPartitionKeyValue() *dynamodb.AttributeValue {
+	if c.partitionKeyType == "S" {
+		return &dynamodb.AttributeValue{S: aws.String(ddbPartitionKey)}
+	}
+
+	return &dynamodb.AttributeValue{N: aws.String(ddbPartitionKey)}
+}
+
+// return the filter that excludes the metadata row (see isMetaRowKey) from a scan, adding the value it compares against
+// to values
+func (c *Library) metaRowFilter(values map[string]*dynamodb.AttributeValue) string {
+	values[":metaPK"] = c.metaPartitionKeyValue()
+
+	return fmt.Sprintf("%s <> :metaPK", c.partitionKey)
+}
+
+// return the input of a scan of every item in the table, i.e., everything but the metadata row
+func (c *Library) tableScanInput() *dynamodb.ScanInput {
+	input := &dynamodb.ScanInput{TableName: aws.String(c.tableName)}
+	values := make(map[string]*dynamodb.AttributeValue, 1)
+	if filter := c.metaRowFilter(values); filter != "" {
+		input.FilterExpression = aws.String(filter)
+		input.ExpressionAttributeValues = values
+	}
+
+	return input
+}
+
+// join the non-empty filters with AND, each one in parentheses so that the operators of one (e.g., OR) do not bind
+// to the others, or return nil if there are none
+func joinFilters(filters ...string) *string {
+	nonEmpty := make([]string, 0, len(filters))
+	for _, f := range filters {
+		if f != "" {
+			nonEmpty = append(nonEmpty, f)
+		}
+	}
+	switch len(nonEmpty) {
+	case 0:
+		return nil
+	case 1:
+		return aws.String(nonEmpty[0])
+	}
+
+	return aws.String("(" + strings.Join(nonEmpty, ") AND (") + ")")
+}
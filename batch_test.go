@@ -0,0 +1,118 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestSplitWriteRequests(t *testing.T) {
+	put := func(id int, size int) *dynamodb.WriteRequest {
+		return &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: map[string]*dynamodb.AttributeValue{
+			"id":   {N: aws.String(strconv.Itoa(id))},
+			"data": {B: []byte(strings.Repeat("x", size))},
+		}}}
+	}
+	del := func(id int) *dynamodb.WriteRequest {
+		return &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: map[string]*dynamodb.AttributeValue{
+			"id": {N: aws.String(strconv.Itoa(id))},
+		}}}
+	}
+
+	// small items are split by count
+	var small []*dynamodb.WriteRequest
+	for i := 0; i < 60; i++ {
+		if i%2 == 0 {
+			small = append(small, put(i, 10))
+		} else {
+			small = append(small, del(i))
+		}
+	}
+	batches := splitWriteRequests(small)
+	if len(batches) != 3 || len(batches[0]) != 25 || len(batches[1]) != 25 || len(batches[2]) != 10 {
+		t.Error("expected batches of 25, 25, and 10 requests, got", len(batches))
+	}
+
+	// 1MB of binary data takes ~1.4MB once base64 encoded, so only 11 of them fit in 16MB
+	var large []*dynamodb.WriteRequest
+	for i := 0; i < 40; i++ {
+		large = append(large, put(i, 1024*1024))
+	}
+	batches = splitWriteRequests(large)
+	total := 0
+	for _, batch := range batches {
+		size := batchWriteOverhead
+		for _, r := range batch {
+			size += writeRequestSize(r)
+		}
+		if len(batch) > maxBatchWriteSize || size > maxBatchWriteBytes {
+			t.Error("expected every batch to fit a single request, got", len(batch), "requests and", size, "bytes")
+		}
+		total += len(batch)
+	}
+	if total != len(large) || len(batches) != 4 {
+		t.Error("expected", len(large), "requests in 4 batches, got", total, "in", len(batches))
+	}
+
+	// a request too large for any batch gets one of its own
+	batches = splitWriteRequests([]*dynamodb.WriteRequest{put(0, 10), put(1, maxBatchWriteBytes), put(2, 10)})
+	if len(batches) != 3 {
+		t.Error("expected 3 batches, got", len(batches))
+	}
+
+	if len(splitWriteRequests(nil)) != 0 {
+		t.Error("expected no batches for no requests")
+	}
+}
+
+func TestLibrary_withPrimaryKeyProjection(t *testing.T) {
+	library := &Library{partitionKey: "id", rangeKey: "sort"}
+
+	// keys already projected are not projected again
+	request := library.withPrimaryKeyProjection(&dynamodb.KeysAndAttributes{
+		AttributesToGet: aws.StringSlice([]string{"data", "id"}),
+	})
+	if attributes := aws.StringValueSlice(request.AttributesToGet); strings.Join(attributes, ",") != "sort,data,id" {
+		t.Error("expected the range key added once, got", attributes)
+	}
+	request = library.withPrimaryKeyProjection(&dynamodb.KeysAndAttributes{
+		ProjectionExpression:     aws.String("#s, data.nested[0]"),
+		ExpressionAttributeNames: map[string]*string{"#s": aws.String("sort")},
+	})
+	projection := aws.StringValue(request.ProjectionExpression)
+	if projection != "#s, data.nested[0], #ddblibrarianKey0" {
+		t.Error("expected the partition key added once, got", projection)
+	}
+	if name := aws.StringValue(request.ExpressionAttributeNames["#ddblibrarianKey0"]); name != "id" {
+		t.Error("expected the partition key named, got", name)
+	}
+
+	// nothing projected, everything read
+	request = library.withPrimaryKeyProjection(&dynamodb.KeysAndAttributes{})
+	if request.AttributesToGet != nil || request.ProjectionExpression != nil {
+		t.Error("expected no projection, got", request)
+	}
+}
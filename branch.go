@@ -0,0 +1,112 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// SnapshotNode is a snapshot in the tree of snapshots of a table (see SnapshotTree).
+type SnapshotNode struct {
+	Name string
+	// internal ID (see SnapshotIDMap)
+	ID string
+	// snapshots taken on top of this one, most recent first
+	Children []*SnapshotNode
+}
+
+// SnapshotTree returns the snapshots of the table as a tree, in which each snapshot is a child of the one it was taken
+// on top of: the latest one at the time or, if it branches off an older one (see RequireActiveEqualsLatest), the one
+// that was active. The roots were taken on top of the data written before any snapshots, most recent first. Without
+// branches, there is a single root with a single chain of descendants.
+//
+// Cost: 1RU
+func (c *Library) SnapshotTree() ([]*SnapshotNode, error) {
+	return c.SnapshotTreeWithContext(aws.BackgroundContext())
+}
+
+// SnapshotTreeWithContext is the same as SnapshotTree with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) SnapshotTreeWithContext(ctx aws.Context) ([]*SnapshotNode, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[string]*SnapshotNode, len(meta.snapshots))
+	for name, id := range meta.snapshotIDMap() {
+		nodes[id] = &SnapshotNode{Name: name, ID: id, Children: make([]*SnapshotNode, 0)}
+	}
+
+	// children are added in chronological order, most recent first
+	roots := make([]*SnapshotNode, 0)
+	parents := meta.parentIDs()
+	for _, id := range meta.chronologicalSnapshotIDs {
+		node, ok := nodes[id]
+		if !ok {
+			continue
+		}
+		parent, ok := nodes[parents[id]]
+		if !ok {
+			roots = append(roots, node)
+			continue
+		}
+		parent.Children = append(parent.Children, node)
+	}
+
+	return roots, nil
+}
+
+// SnapshotParent returns the name of the snapshot the given one was taken on top of (see SnapshotTree), or an empty
+// string if it was taken on top of the data written before any snapshots.
+//
+// Cost: 1RU
+func (c *Library) SnapshotParent(snapshot string) (string, error) {
+	return c.SnapshotParentWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// SnapshotParentWithContext is the same as SnapshotParent with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) SnapshotParentWithContext(ctx aws.Context, snapshot string) (string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", errors.New("the data written before any snapshots has no parent")
+	}
+
+	parent := meta.parentIDs()[id]
+	for name, id := range meta.snapshotIDMap() {
+		if id == parent {
+			return name, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,69 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+)
+
+func TestLibrary_SnapshotTree(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// a <- b, and c branches off a
+		library.Snapshot("a")
+		library.Snapshot("b")
+		library.Rollback("a")
+		err := library.Snapshot("c", RequireActiveEqualsLatest(false))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		roots, err := library.SnapshotTree()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if len(roots) != 1 || roots[0].Name != "a" {
+			t.Error("expected a single root, a, got", roots)
+		} else {
+			children := roots[0].Children
+			if len(children) != 2 || children[0].Name != "c" || children[1].Name != "b" {
+				t.Error("expected a to have children c and b, got", children)
+			}
+		}
+
+		for snapshot, expected := range map[string]string{"a": "", "b": "a", "c": "a"} {
+			parent, err := library.SnapshotParent(snapshot)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if parent != expected {
+				t.Error("expected the parent of", snapshot, "to be", expected, "got", parent)
+			}
+		}
+
+		_, err = library.SnapshotParent("nope")
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// make sure that writing, or deleting, items items would not obviously overwhelm the table (see WithCapacityCheck);
+// each item is assumed to take a single write capacity unit, so the estimate is a lower bound
+func (c *Library) checkCapacity(ctx aws.Context, operation string, items int64) error {
+	if c.capacityLimit <= 0 || items == 0 {
+		return nil
+	}
+
+	capacity, estimate, err := c.estimateWriteTime(ctx, items)
+	if err != nil {
+		return err
+	}
+	if capacity == 0 || estimate <= c.capacityLimit {
+		return nil
+	}
+	e := &CapacityError{
+		Operation:     operation,
+		Items:         items,
+		WriteCapacity: capacity,
+		Estimate:      estimate,
+		Limit:         c.capacityLimit,
+	}
+	if c.capacityWarn != nil {
+		c.capacityWarn(e)
+		return nil
+	}
+
+	return e
+}
+
+// return the lowest write capacity provisioned on the table (see lowestWriteCapacity), and how long writing, or
+// deleting, items would take at that capacity, at best; both are 0 if the table is in on-demand mode
+func (c *Library) estimateWriteTime(ctx aws.Context, items int64) (int64, time.Duration, error) {
+	out, err := c.storage(ctx).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(c.tableName)})
+	if err != nil {
+		return 0, 0, wrapError("failed to describe the table", err)
+	}
+	capacity := lowestWriteCapacity(out.Table)
+	if capacity == 0 {
+		return 0, 0, nil
+	}
+
+	return capacity, time.Duration(items) * time.Second / time.Duration(capacity), nil
+}
+
+// return the lowest write capacity provisioned on the table or any of its global secondary indexes, which every
+// write may have to go through, or 0 if the table is in on-demand mode
+func lowestWriteCapacity(table *dynamodb.TableDescription) int64 {
+	if table.BillingModeSummary != nil &&
+		aws.StringValue(table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest {
+		return 0
+	}
+
+	capacity := int64(0)
+	if table.ProvisionedThroughput != nil {
+		capacity = aws.Int64Value(table.ProvisionedThroughput.WriteCapacityUnits)
+	}
+	for _, index := range table.GlobalSecondaryIndexes {
+		if index.ProvisionedThroughput == nil {
+			continue
+		}
+		wcu := aws.Int64Value(index.ProvisionedThroughput.WriteCapacityUnits)
+		if wcu > 0 && (capacity == 0 || wcu < capacity) {
+			capacity = wcu
+		}
+	}
+
+	return capacity
+}
@@ -0,0 +1,89 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a Storage that only describes a table with the given description
+type describedStorage struct {
+	*dynamodb.DynamoDB
+	table *dynamodb.TableDescription
+}
+
+func (s *describedStorage) DescribeTableWithContext(
+	ctx aws.Context,
+	input *dynamodb.DescribeTableInput,
+	opts ...request.Option,
+) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: s.table}, nil
+}
+
+func TestLibrary_checkCapacity(t *testing.T) {
+	provisioned := &dynamodb.TableDescription{
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{WriteCapacityUnits: aws.Int64(100)},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndexDescription{{
+			ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{WriteCapacityUnits: aws.Int64(10)},
+		}},
+	}
+	onDemand := &dynamodb.TableDescription{
+		BillingModeSummary:    &dynamodb.BillingModeSummary{BillingMode: aws.String(dynamodb.BillingModePayPerRequest)},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughputDescription{WriteCapacityUnits: aws.Int64(0)},
+	}
+
+	library := &Library{svc: &describedStorage{table: provisioned}}
+	WithCapacityCheck(time.Minute, nil)(library)
+	// the index only takes 10 writes per second
+	err := library.checkCapacity(aws.BackgroundContext(), "Restore", 600)
+	if err != nil {
+		t.Error("expected no error, got", err)
+	}
+	err = library.checkCapacity(aws.BackgroundContext(), "Restore", 601)
+	e, ok := err.(*CapacityError)
+	if !ok {
+		t.Fatal("expected a *CapacityError, got", err)
+	}
+	if e.Operation != "Restore" || e.Items != 601 || e.WriteCapacity != 10 || e.Estimate != 60100*time.Millisecond {
+		t.Error("unexpected error:", e)
+	}
+
+	// warn and go ahead
+	warnings := make([]*CapacityError, 0)
+	WithCapacityCheck(time.Minute, func(e *CapacityError) { warnings = append(warnings, e) })(library)
+	err = library.checkCapacity(aws.BackgroundContext(), "Restore", 601)
+	if err != nil || len(warnings) != 1 {
+		t.Error("expected a single warning, got", err, warnings)
+	}
+
+	// on-demand tables scale on their own
+	library = &Library{svc: &describedStorage{table: onDemand}}
+	WithCapacityCheck(time.Minute, nil)(library)
+	err = library.checkCapacity(aws.BackgroundContext(), "DestroySnapshot", 1000000)
+	if err != nil {
+		t.Error("expected no error, got", err)
+	}
+}
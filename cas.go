@@ -0,0 +1,278 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// GetItemWithVersion is the same as GetItem, with a strongly consistent read, also returning the version of the item
+// found, or nil if there is none, to compare-and-swap it with PutItemIfUnchangedSince. It requires
+// WithVersionAttribute, and reads the version attribute whatever input projects.
+//
+// Overhead: 1+N read units, where N is the number of existing snapshots, in the worst case
+func (c *Library) GetItemWithVersion(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, *ItemVersion, error) {
+	return c.GetItemWithVersionWithContext(aws.BackgroundContext(), input)
+}
+
+// GetItemWithVersionWithContext is the same as GetItemWithVersion with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) GetItemWithVersionWithContext(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+) (*dynamodb.GetItemOutput, *ItemVersion, error) {
+	if !c.versionAttribute {
+		return nil, nil, errors.New("item versions require the version attribute (see WithVersionAttribute)")
+	}
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta, err := c.loadMetaFor(ctx, true, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	request := *c.withVersionProjection(input)
+	request.ConsistentRead = aws.Bool(true)
+	var output *dynamodb.GetItemOutput
+	for _, id := range append(meta.GetChronologicalSnapshotIDs(c.activeSnapshotID(meta)), "") {
+		out, version, err := c.getVersionedItemWithSnapshotID(ctx, &request, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		output = out
+		if out.Item == nil {
+			continue
+		}
+
+		name, err := snapshotNameOrBaseline(meta, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		itemVersion := &ItemVersion{Snapshot: name, ID: id, Item: out.Item}
+		if version != nil && version.M != nil {
+			itemVersion.WrittenAt, err = timeFromAttributeValue(version.M[versionAttributeWrittenAt])
+			if err != nil {
+				return nil, nil, err
+			}
+			if token, ok := version.M[versionAttributeToken]; ok {
+				itemVersion.Token = aws.StringValue(token.S)
+			}
+		}
+
+		return out, itemVersion, nil
+	}
+
+	return output, nil, nil
+}
+
+// PutItemIfUnchangedSince puts input.Item, just like PutItem, only if the item has not changed since version was read
+// (see GetItemWithVersion): compare-and-swap on the version attribute every item is stamped with (see
+// WithVersionAttribute). If version is nil, the item must not exist. It is the building block of safe
+// read-modify-write flows: unlike a ConditionExpression, which only sees the item in the snapshot being written to,
+// the condition is checked on the snapshot the version lives in, and on every snapshot taken after it, which must not
+// hold a newer one.
+//
+// It fails with an *ItemChangedError if the item changed, and requires WithVersionAttribute. input cannot have a
+// condition of its own, and its ReturnValues are only honored if no snapshots were taken after the one version was
+// written to.
+//
+// Overhead: none, or 2WU per snapshot taken after the one version was written to (the writes become a transaction)
+func (c *Library) PutItemIfUnchangedSince(
+	input *dynamodb.PutItemInput,
+	version *ItemVersion,
+) (*dynamodb.PutItemOutput, error) {
+	return c.PutItemIfUnchangedSinceWithContext(aws.BackgroundContext(), input, version)
+}
+
+// PutItemIfUnchangedSinceWithContext is the same as PutItemIfUnchangedSince with the addition of the ability to pass
+// a context, which is passed on to every request made to the table.
+func (c *Library) PutItemIfUnchangedSinceWithContext(
+	ctx aws.Context,
+	input *dynamodb.PutItemInput,
+	version *ItemVersion,
+) (*dynamodb.PutItemOutput, error) {
+	if !c.versionAttribute {
+		return nil, errors.New("compare-and-swap requires the version attribute (see WithVersionAttribute)")
+	}
+	if input.ConditionExpression != nil || len(input.Expected) > 0 {
+		return nil, errors.New("compare-and-swap cannot be combined with a condition of its own")
+	}
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMetaFor(ctx, true, false)
+	if err != nil {
+		return nil, err
+	}
+	writeID, err := meta.getWritableSnapshotID("PutItemIfUnchangedSince", snapshotCurrent)
+	if err != nil {
+		return nil, wrapError("failed to get snapshot ID", err)
+	}
+	key := c.primaryKey(input.Item)
+
+	// the snapshot the version was written to
+	versionID := ""
+	if version != nil {
+		versionID, err = meta.getSnapshotID(version.Snapshot)
+		if err != nil {
+			// destroyed along with the version
+			return nil, &ItemChangedError{Key: key, Err: err}
+		}
+	}
+
+	// none of the snapshots from the one being written to, down to the one the version lives in, may hold a newer
+	// version (none at all if there was no version)
+	var put *dynamodb.ConditionCheck
+	checks := make([]*dynamodb.TransactWriteItem, 0)
+	found := false
+	for _, id := range append(meta.GetChronologicalSnapshotIDs(writeID), "") {
+		check := &dynamodb.ConditionCheck{
+			TableName:                aws.String(c.tableName),
+			Key:                      c.keyWithSnapshot(key, id),
+			ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+			ExpressionAttributeNames: map[string]*string{"#pk": aws.String(c.partitionKey)},
+		}
+		found = version != nil && id == versionID
+		if found {
+			c.versionCondition(check, version)
+		}
+		if id == writeID {
+			put = check
+		} else {
+			checks = append(checks, &dynamodb.TransactWriteItem{ConditionCheck: check})
+		}
+		if found {
+			break
+		}
+	}
+	// e.g., read while browsing another branch
+	if version != nil && !found {
+		err = errors.New("the version is not visible from the snapshot being written to")
+		return nil, &ItemChangedError{Key: key, Err: err}
+	}
+
+	item := c.keyWithSnapshot(input.Item, writeID)
+	if err := c.checkNotMetaRow("PutItemIfUnchangedSince", item); err != nil {
+		return nil, err
+	}
+	if _, err := c.overflowItem(ctx, "PutItemIfUnchangedSince", item); err != nil {
+		return nil, err
+	}
+	c.tagItem(item, writeID)
+	if len(checks) == 0 {
+		output, err := c.storage(ctx).PutItem(&dynamodb.PutItemInput{
+			TableName:                 input.TableName,
+			Item:                      item,
+			ConditionExpression:       put.ConditionExpression,
+			ExpressionAttributeNames:  put.ExpressionAttributeNames,
+			ExpressionAttributeValues: put.ExpressionAttributeValues,
+			ReturnConsumedCapacity:    input.ReturnConsumedCapacity,
+			ReturnValues:              input.ReturnValues,
+		})
+		if isConditionalCheckFailure(err) {
+			return nil, &ItemChangedError{Key: key, Err: err}
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.normalizeWriteOutput(output.Attributes, output.ItemCollectionMetrics)
+
+		return output, nil
+	}
+
+	_, err = c.storage(ctx).TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: append(checks, &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			TableName:                 input.TableName,
+			Item:                      item,
+			ConditionExpression:       put.ConditionExpression,
+			ExpressionAttributeNames:  put.ExpressionAttributeNames,
+			ExpressionAttributeValues: put.ExpressionAttributeValues,
+		}}),
+	})
+	if isConditionalTransactionFailure(err) {
+		return nil, &ItemChangedError{Key: key, Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// make check hold iff the item is still at version: the write that stamped it with the same token, or, for items
+// stamped before there were tokens, the same time and still no token
+func (c *Library) versionCondition(check *dynamodb.ConditionCheck, version *ItemVersion) {
+	check.ExpressionAttributeNames["#version"] = aws.String(versionAttribute)
+	if version.Token != "" {
+		check.ExpressionAttributeNames["#token"] = aws.String(versionAttributeToken)
+		check.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":token": {S: aws.String(version.Token)}}
+		check.ConditionExpression = aws.String("#version.#token = :token")
+		return
+	}
+	if version.WrittenAt.IsZero() {
+		check.ConditionExpression = aws.String("attribute_exists(#pk) AND attribute_not_exists(#version)")
+		return
+	}
+
+	check.ExpressionAttributeNames["#writtenAt"] = aws.String(versionAttributeWrittenAt)
+	check.ExpressionAttributeNames["#token"] = aws.String(versionAttributeToken)
+	check.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+		":writtenAt": timeToAttributeValue(version.WrittenAt),
+	}
+	check.ConditionExpression = aws.String("#version.#writtenAt = :writtenAt AND attribute_not_exists(#version.#token)")
+}
+
+// return a copy of input that also projects the version attribute, if it projects anything at all: without it, the
+// version read would look like one written before the attribute was enabled, and no compare-and-swap would succeed
+func (c *Library) withVersionProjection(input *dynamodb.GetItemInput) *dynamodb.GetItemInput {
+	request := *input
+	if request.AttributesToGet != nil {
+		projected := false
+		for _, attribute := range request.AttributesToGet {
+			projected = projected || aws.StringValue(attribute) == versionAttribute
+		}
+		if !projected {
+			request.AttributesToGet = append([]*string{aws.String(versionAttribute)}, request.AttributesToGet...)
+		}
+	}
+	if request.ProjectionExpression != nil {
+		names := make(map[string]*string, len(request.ExpressionAttributeNames)+1)
+		for k, v := range request.ExpressionAttributeNames {
+			names[k] = v
+		}
+		projection := aws.StringValue(request.ProjectionExpression)
+		if !projectedAttributes(projection, names)[versionAttribute] {
+			names["#ddblibrarianVersion"] = aws.String(versionAttribute)
+			request.ProjectionExpression = aws.String(projection + ", #ddblibrarianVersion")
+			request.ExpressionAttributeNames = names
+		}
+	}
+
+	return &request
+}
@@ -0,0 +1,165 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_PutItemIfUnchangedSince(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)}
+		versioned := newClient(schema, t, WithVersionAttribute(), WithClock(clock))
+
+		_, _, err := library.GetItemWithVersion(&dynamodb.GetItemInput{Key: getAttributeValueForKey(schema)})
+		if err == nil {
+			t.Error("expected an error without the version attribute")
+		}
+
+		read := func() *ItemVersion {
+			input := &dynamodb.GetItemInput{Key: getAttributeValueForKey(schema)}
+			_, version, err := versioned.GetItemWithVersion(input)
+			if err != nil {
+				t.Fatal("expected no errors, got", err)
+			}
+			return version
+		}
+		write := func(valueTag string, version *ItemVersion, changed bool) {
+			clock.Advance(time.Second)
+			input := &dynamodb.PutItemInput{Item: getAttributeValueForItem(schema, valueTag)}
+			_, err := versioned.PutItemIfUnchangedSince(input, version)
+			if _, ok := err.(*ItemChangedError); changed && !ok {
+				t.Error("expected an *ItemChangedError writing", valueTag, "got", err)
+			}
+			if !changed && err != nil {
+				t.Error("expected no errors writing", valueTag, "got", err)
+			}
+		}
+
+		// nothing there yet
+		if version := read(); version != nil {
+			t.Fatal("expected no version, got", version)
+		}
+		write("baseline", nil, false)
+		write("baseline again", nil, true)
+		baseline := read()
+		if baseline == nil || baseline.Snapshot != Baseline || !baseline.WrittenAt.Equal(clock.Now()) {
+			t.Fatal("expected the version written to the baseline at", clock.Now(), "got", baseline)
+		}
+
+		// the version lives in an older snapshot than the one being written to
+		versioned.Snapshot("1")
+		write("1", baseline, false)
+		write("1 again", baseline, true)
+
+		first := read()
+		if first == nil || first.Snapshot != "1" {
+			t.Fatal("expected the version written to snapshot 1, got", first)
+		}
+		write("1 updated", first, false)
+		write("1 updated again", first, true)
+
+		// two writes at the same time are still two versions
+		updated := read()
+		clock.Advance(-time.Second)
+		write("1 updated at the same time", updated, false)
+		clock.Advance(-time.Second)
+		write("1 updated at the same time again", updated, true)
+		clock.Advance(-time.Second)
+		write("1 updated", read(), false)
+
+		out, err := versioned.GetItem(&dynamodb.GetItemInput{Key: getAttributeValueForKey(schema)})
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if v := aws.StringValue(out.Item[valueField].S); v != fmtValueTag("1 updated") {
+			t.Error("expected", fmtValueTag("1 updated"), "got", v)
+		}
+
+		versioned.Close()
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_withVersionProjection(t *testing.T) {
+	library := &Library{partitionKey: "year", partitionKeyType: "N"}
+
+	input := &dynamodb.GetItemInput{AttributesToGet: []*string{aws.String("title")}}
+	if request := library.withVersionProjection(input); len(request.AttributesToGet) != 2 ||
+		aws.StringValue(request.AttributesToGet[0]) != versionAttribute || len(input.AttributesToGet) != 1 {
+		t.Error("expected the version attribute to be projected on a copy, got", request.AttributesToGet)
+	}
+
+	input = &dynamodb.GetItemInput{
+		ProjectionExpression:     aws.String("#t, info.rating"),
+		ExpressionAttributeNames: map[string]*string{"#t": aws.String("title")},
+	}
+	request := library.withVersionProjection(input)
+	if aws.StringValue(request.ProjectionExpression) != "#t, info.rating, #ddblibrarianVersion" ||
+		aws.StringValue(request.ExpressionAttributeNames["#ddblibrarianVersion"]) != versionAttribute ||
+		len(input.ExpressionAttributeNames) != 1 {
+		t.Error("expected the version attribute to be projected on a copy, got", request)
+	}
+
+	// projected already, or everything is
+	input = &dynamodb.GetItemInput{ProjectionExpression: aws.String("title, ddblibrarian_version.token")}
+	if request := library.withVersionProjection(input); request.ExpressionAttributeNames != nil ||
+		aws.StringValue(request.ProjectionExpression) != "title, ddblibrarian_version.token" {
+		t.Error("expected the projection to be left as it is, got", request)
+	}
+	if request := library.withVersionProjection(&dynamodb.GetItemInput{}); request.ProjectionExpression != nil ||
+		request.AttributesToGet != nil {
+		t.Error("expected no projection, got", request)
+	}
+}
+
+func TestLibrary_versionCondition(t *testing.T) {
+	library := &Library{partitionKey: "year", partitionKeyType: "N"}
+	written := time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		version   *ItemVersion
+		condition string
+	}{
+		{&ItemVersion{}, "attribute_exists(#pk) AND attribute_not_exists(#version)"},
+		{
+			&ItemVersion{WrittenAt: written},
+			"#version.#writtenAt = :writtenAt AND attribute_not_exists(#version.#token)",
+		},
+		// the time does not tell apart two writes made at once
+		{&ItemVersion{WrittenAt: written, Token: "abc"}, "#version.#token = :token"},
+	} {
+		check := &dynamodb.ConditionCheck{ExpressionAttributeNames: map[string]*string{"#pk": aws.String("year")}}
+		library.versionCondition(check, test.version)
+		if aws.StringValue(check.ConditionExpression) != test.condition {
+			t.Error("expected", test.condition, "for", test.version, "got", aws.StringValue(check.ConditionExpression))
+		}
+	}
+
+	if a, b := newVersionToken(), newVersionToken(); a == b || len(a) != 32 {
+		t.Error("expected two different tokens, got", a, "and", b)
+	}
+}
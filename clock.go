@@ -0,0 +1,117 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// field of a snapshot's info that holds the time it was taken
+const snapshotInfoCreated = "created"
+
+// Clock tells the time whenever the Library needs it, e.g., to record when a snapshot was taken or to check whether
+// a browsing session has expired. See WithClock.
+type Clock interface {
+	Now() time.Time
+}
+
+// the wall clock, used unless WithClock says otherwise
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// timestamps are stored as RFC 3339 strings, in UTC, so that they are readable straight from the table
+func timeToAttributeValue(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(t.UTC().Format(time.RFC3339Nano))}
+}
+
+func timeFromAttributeValue(av *dynamodb.AttributeValue) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, aws.StringValue(av.S))
+	if err != nil {
+		return time.Time{}, wrapError("invalid timestamp", err)
+	}
+
+	return t, nil
+}
+
+// SnapshotCreationTime returns when snapshot was taken, according to the Library's Clock, or the zero time if it
+// was taken before creation times were recorded.
+//
+// Cost: 1RU
+func (c *Library) SnapshotCreationTime(snapshot string) (time.Time, error) {
+	return c.SnapshotCreationTimeWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// SnapshotCreationTimeWithContext is the same as SnapshotCreationTime with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) SnapshotCreationTimeWithContext(ctx aws.Context, snapshot string) (time.Time, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if _, err := meta.getSnapshotID(snapshot); err != nil {
+		return time.Time{}, err
+	}
+
+	av := meta.getSnapshotInfo(snapshot, snapshotInfoCreated)
+	if av == nil {
+		return time.Time{}, nil
+	}
+
+	return timeFromAttributeValue(av)
+}
+
+// BrowseFor sets snapshot as the active snapshot for the session currently handled by Library, just like Browse,
+// for at most ttl: once it expires (according to the Library's Clock) the session goes back to the snapshot set in
+// the table's metadata, as if StopBrowsing had been called.
+//
+// Cost: 1RU
+func (c *Library) BrowseFor(snapshot string, ttl time.Duration) error {
+	return c.BrowseForWithContext(aws.BackgroundContext(), snapshot, ttl)
+}
+
+// BrowseForWithContext is the same as BrowseFor with the addition of the ability to pass a context, which is passed on
+// to every request made to the table.
+func (c *Library) BrowseForWithContext(ctx aws.Context, snapshot string, ttl time.Duration) error {
+	err := c.BrowseWithContext(ctx, snapshot)
+	if err != nil {
+		return err
+	}
+
+	c.browseUntil = c.clock.Now().Add(ttl)
+
+	return nil
+}
+
+// isBrowsing returns true if the session is browsing some snapshot, ending it first if it has expired
+func (c *Library) isBrowsing() bool {
+	if c.browsing && !c.browseUntil.IsZero() && !c.clock.Now().Before(c.browseUntil) {
+		c.StopBrowsing()
+	}
+
+	return c.browsing
+}
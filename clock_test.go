@@ -0,0 +1,123 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a Clock that only moves when told to
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func (f *fakeClock) Advance(d time.Duration) {
+	f.now = f.now.Add(d)
+}
+
+func TestTimeAttributeValue(t *testing.T) {
+	now := time.Date(2017, 11, 5, 10, 30, 0, 123, time.FixedZone("WET", 3600))
+
+	decoded, err := timeFromAttributeValue(timeToAttributeValue(now))
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if !decoded.Equal(now) {
+		t.Error("expected", now, "got", decoded)
+	}
+
+	_, err = timeFromAttributeValue(&dynamodb.AttributeValue{S: aws.String("yesterday")})
+	if err == nil {
+		t.Error("expected an error parsing an invalid timestamp")
+	}
+}
+
+func TestLibrary_SnapshotCreationTime(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		_, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)}
+		library := newClient(schema, t, WithClock(clock))
+
+		// the first snapshot creates the snapshot info, the second one adds to it
+		for _, snapshot := range []string{"first", "second"} {
+			err := library.Snapshot(snapshot)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			created, err := library.SnapshotCreationTime(snapshot)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if !created.Equal(clock.now) {
+				t.Error("expected", clock.now, "got", created)
+			}
+			clock.Advance(time.Hour)
+		}
+
+		_, err := library.SnapshotCreationTime("nope")
+		if err == nil {
+			t.Error("expected an error for a non-existent snapshot")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_BrowseFor(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		_, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)}
+		library := newClient(schema, t, WithClock(clock))
+
+		library.Snapshot("1")
+		library.Snapshot("2")
+
+		err := library.BrowseFor("1", time.Minute)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		clock.Advance(59 * time.Second)
+		if !library.isBrowsing() {
+			t.Error("expected to still be browsing")
+		}
+		clock.Advance(time.Second)
+		if library.isBrowsing() {
+			t.Error("expected the browsing session to have expired")
+		}
+
+		// Browse never expires
+		library.Browse("1")
+		clock.Advance(24 * time.Hour)
+		if !library.isBrowsing() {
+			t.Error("expected to still be browsing")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const s3Scheme = "s3://"
+
+// split s3://bucket/key into its bucket and key
+func parseS3Location(location string) (string, string, error) {
+	path := strings.TrimPrefix(location, s3Scheme)
+	parts := strings.SplitN(path, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid S3 location, expected s3://bucket/key: " + location)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// openForReading returns a reader for location, which can be a local file, an S3 object (s3://bucket/key), or - for
+// the standard input
+func openForReading(location string, p client.ConfigProvider) (io.ReadCloser, error) {
+	if location == "-" {
+		return os.Stdin, nil
+	}
+
+	if !strings.HasPrefix(location, s3Scheme) {
+		return os.Open(location)
+	}
+
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := s3.New(p).GetObject(&s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+// writeTo calls fn with a writer for location, which can be a local file, an S3 object (s3://bucket/key), or - for
+// the standard output; S3 objects are streamed, so dumps never need to fit in memory or on local disk
+func writeTo(location string, p client.ConfigProvider, fn func(w io.Writer) error) error {
+	if location == "-" {
+		return fn(os.Stdout)
+	}
+
+	if !strings.HasPrefix(location, s3Scheme) {
+		f, err := os.Create(location)
+		if err != nil {
+			return err
+		}
+		err = fn(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	uploaded := make(chan error, 1)
+	go func() {
+		_, err := s3manager.NewUploader(p).Upload(&s3manager.UploadInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+			Body:   reader,
+		})
+		// unblock the writer if the upload fails half way
+		reader.CloseWithError(err)
+		uploaded <- err
+	}()
+
+	err = fn(writer)
+	writer.CloseWithError(err)
+	if uploadErr := <-uploaded; err == nil {
+		err = uploadErr
+	}
+
+	return err
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
-	"fmt"
+	"io"
 	"log"
+	"os"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/cmd/internal/output"
 )
 
 type appConfig struct {
@@ -19,30 +23,104 @@ type appConfig struct {
 	rangeKey         string
 	rangeKeyType     string
 	list             bool
+	idMap            bool
+	jobs             bool
 	snapshot         string
+	description      string
 	rollback         string
+	dryRun           bool
+	confirm          bool
+	migrateKeys      bool
+	noTrailingZeros  bool
+	dump             string
+	load             string
+	fromSnapshot     string
+	intoSnapshot     string
+	segments         int
+	verifyChecksums  bool
+	gc               bool
+	destroy          string
+	force            bool
+	maxWriteTime     time.Duration
+	warnWriteTime    bool
+	auditReport      string
+	pin              string
+	unpin            string
+	scheduleRollback string
+	rollbackAt       string
+	cancelRollback   bool
+	runScheduled     bool
+	interval         time.Duration
+	output           string
 }
 
+// the snapshot name the library resolves to the active snapshot
+const activeSnapshot = "current"
+
 // make sure all required flags were passed and are valid
 func checkFlags(app *appConfig) {
 	if app.table == "" {
 		log.Fatal("Please tell me which DynamoDB table to use")
 	}
 
-	if app.partitionKey == "" {
-		log.Fatal("The partition key is required")
-	}
-
-	if app.partitionKeyType == "" {
+	if app.partitionKey != "" && app.partitionKeyType == "" {
 		log.Fatal("The partition key type (S or N) is required")
 	}
 
 	if app.snapshot != "" && app.rollback != "" {
 		log.Fatal("These are mutually exclusive options: snapshot, rollback")
 	}
+
+	if app.noTrailingZeros && !app.migrateKeys {
+		log.Fatal("Nothing to migrate: -no-trailing-zeros only applies to -migrate-key-encoding")
+	}
+
+	if app.dryRun && app.confirm {
+		log.Fatal("These are mutually exclusive options: dry-run, confirm")
+	}
+
+	if app.dryRun && app.rollback == "" && !app.gc && app.destroy == "" {
+		log.Fatal("Nothing to dry run: -dry-run only applies to -rollback, -gc, or -destroy")
+	}
+
+	if app.confirm && app.rollback == "" && !app.gc && app.destroy == "" && app.scheduleRollback == "" {
+		log.Fatal("Nothing to confirm: -confirm only applies to -rollback, -gc, -destroy, or -schedule-rollback")
+	}
+
+	if app.rollback != "" && !app.dryRun && !app.confirm {
+		log.Fatal("A rollback affects all clients: use -dry-run to see what would change, or -confirm to proceed")
+	}
+
+	if app.gc && !app.dryRun && !app.confirm {
+		log.Fatal("Garbage collection destroys snapshots: use -dry-run to see which ones, or -confirm to proceed")
+	}
+
+	if app.scheduleRollback != "" && app.rollbackAt == "" {
+		log.Fatal("Please tell me when to roll back (-at)")
+	}
+
+	if app.scheduleRollback != "" && !app.confirm {
+		log.Fatal("A rollback affects all clients: use -confirm to schedule it")
+	}
+
+	if app.scheduleRollback != "" && app.cancelRollback {
+		log.Fatal("These are mutually exclusive options: schedule-rollback, cancel-scheduled-rollback")
+	}
+
+	if app.destroy != "" && !app.dryRun && !app.confirm {
+		log.Fatal("Destroying a snapshot deletes all of its items: use -dry-run to count them, or -confirm to proceed")
+	}
+
+	if app.pin != "" && app.unpin != "" {
+		log.Fatal("These are mutually exclusive options: pin, unpin")
+	}
+
+	if app.dump != "" && app.load != "" {
+		log.Fatal("These are mutually exclusive options: dump, load")
+	}
 }
 
-func connect(app *appConfig) *ddblibrarian.Library {
+func connect(app *appConfig) (*ddblibrarian.Library, *session.Session) {
 	ddbSession, err := session.NewSession(&aws.Config{
 		Region:     aws.String(app.region),
 		Endpoint:   aws.String(app.endpoint),
@@ -52,34 +130,212 @@ func connect(app *appConfig) *ddblibrarian.Library {
 		log.Fatal(err.Error())
 	}
 
-	client, err := ddblibrarian.New(
-		app.table,
-		app.partitionKey,
-		app.partitionKeyType,
-		app.rangeKey,
-		app.rangeKeyType,
-		ddbSession,
-	)
+	opts := make([]ddblibrarian.Option, 0)
+	if app.verifyChecksums {
+		opts = append(opts, ddblibrarian.WithChecksums())
+	}
+	// refuse to delete more items than the table can take within maxWriteTime, or just warn about it
+	if app.maxWriteTime > 0 {
+		var warn func(*ddblibrarian.CapacityError)
+		if app.warnWriteTime {
+			warn = func(e *ddblibrarian.CapacityError) { log.Println("Warning:", e.Error()) }
+		}
+		opts = append(opts, ddblibrarian.WithCapacityCheck(app.maxWriteTime, warn))
+	}
+	// rewrite the whole audit trail after each bulk operation, in case a later one fails and exits
+	if app.auditReport != "" {
+		reports := make([]operationReport, 0)
+		opts = append(opts, ddblibrarian.WithOperationReports(func(report *ddblibrarian.OperationReport) {
+			reports = append(reports, newOperationReport(report))
+			err := writeTo(app.auditReport, ddbSession, func(w io.Writer) error {
+				encoder := json.NewEncoder(w)
+				for _, r := range reports {
+					if err := encoder.Encode(r); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Println("Failed to write the audit report:", err.Error())
+			}
+		}))
+	}
+
+	// without a partition key, read the key schema from the table itself
+	var client *ddblibrarian.Library
+	if app.partitionKey == "" {
+		client, err = ddblibrarian.NewFromTable(app.table, ddbSession, opts...)
+	} else {
+		client, err = ddblibrarian.NewWithOptions(
+			app.table,
+			app.partitionKey,
+			app.partitionKeyType,
+			app.rangeKey,
+			app.rangeKeyType,
+			ddbSession,
+			opts...,
+		)
+	}
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	return client
+	return client, ddbSession
 }
 
-func executeActions(library *ddblibrarian.Library, app *appConfig) {
-	if app.rollback != "" {
+func executeActions(library *ddblibrarian.Library, ddbSession *session.Session, app *appConfig) *report {
+	r := &report{}
+
+	if app.migrateKeys {
+		opts := make([]ddblibrarian.MigrationOption, 0)
+		if app.noTrailingZeros {
+			opts = append(opts, ddblibrarian.KeysWithoutTrailingZeros())
+		}
+		migrated, err := library.MigrateKeyEncoding(opts...)
+		if err != nil {
+			log.Fatal("Failed to migrate the key encoding:", err.Error())
+		}
+		r.Migrated = &migrated
+	}
+
+	if app.rollback != "" && app.dryRun {
+		plan, err := library.PlanRollback(app.rollback)
+		if err != nil {
+			log.Fatal("Failed to plan the rollback to snapshot", app.rollback, ":", err.Error())
+		}
+		r.RollbackPlan = newRollbackPlan(plan)
+	}
+
+	if app.rollback != "" && !app.dryRun {
 		err := library.Rollback(app.rollback)
 		if err != nil {
 			log.Fatal("Failed to rollback to snapshot", app.rollback, ":", err.Error())
 		}
+		r.RolledBack = app.rollback
 	}
 
 	if app.snapshot != "" {
-		err := library.Snapshot(app.snapshot)
+		err := library.Snapshot(app.snapshot, ddblibrarian.SnapshotDescription(app.description))
 		if err != nil {
 			log.Fatal("Failed to create snapshot:", err.Error())
 		}
+		r.Created = app.snapshot
+	}
+
+	if app.dump != "" {
+		var dumped int64
+		err := writeTo(app.dump, ddbSession, func(w io.Writer) error {
+			var err error
+			dumped, err = library.DumpSnapshot(w, app.fromSnapshot, &ddblibrarian.BulkOptions{Segments: app.segments})
+			return err
+		})
+		if err != nil {
+			log.Fatal("Failed to dump snapshot:", err.Error())
+		}
+		r.Dumped = &dumped
+	}
+
+	if app.load != "" {
+		dump, err := openForReading(app.load, ddbSession)
+		if err != nil {
+			log.Fatal("Failed to open dump:", err.Error())
+		}
+		loaded, err := library.LoadSnapshot(dump, app.intoSnapshot, nil)
+		dump.Close()
+		if err != nil {
+			log.Fatal("Failed to load dump:", err.Error())
+		}
+		r.Loaded = &loaded
+	}
+
+	if app.verifyChecksums {
+		checksums, err := library.VerifyChecksums(app.fromSnapshot)
+		if err != nil {
+			log.Fatal("Failed to verify checksums:", err.Error())
+		}
+		r.Checksums = newChecksumReport(checksums)
+	}
+
+	if app.gc && app.dryRun {
+		unreachable, err := library.UnreachableSnapshots()
+		if err != nil {
+			log.Fatal("Failed to find unreachable snapshots:", err.Error())
+		}
+		r.Unreachable = &unreachable
+	}
+
+	if app.gc && !app.dryRun {
+		destroyed, err := library.CollectGarbage()
+		if err != nil {
+			log.Fatal("Failed to collect garbage:", err.Error())
+		}
+		r.Destroyed = &destroyed
+	}
+
+	if app.destroy != "" && app.dryRun {
+		opts := make([]ddblibrarian.DestroyOption, 0)
+		if app.force {
+			opts = append(opts, ddblibrarian.ForceDestroy())
+		}
+		plan, err := library.PlanDestroySnapshot(app.destroy, opts...)
+		if err != nil {
+			log.Fatal("Failed to plan destroying snapshot", app.destroy, ":", err.Error())
+		}
+		r.DestroyPlan = newDestroyPlan(plan)
+	}
+
+	if app.destroy != "" && !app.dryRun {
+		opts := make([]ddblibrarian.DestroyOption, 0)
+		if app.force {
+			opts = append(opts, ddblibrarian.ForceDestroy())
+		}
+		err := library.DestroySnapshot(app.destroy, opts...)
+		if err != nil {
+			log.Fatal("Failed to destroy snapshot", app.destroy, ":", err.Error())
+		}
+		// -gc may have destroyed others already
+		destroyed := []string{app.destroy}
+		if r.Destroyed != nil {
+			destroyed = append(*r.Destroyed, app.destroy)
+		}
+		r.Destroyed = &destroyed
+	}
+
+	if app.scheduleRollback != "" {
+		at, err := time.Parse(time.RFC3339, app.rollbackAt)
+		if err != nil {
+			log.Fatal("Invalid time to roll back at:", err.Error())
+		}
+		err = library.ScheduleRollback(app.scheduleRollback, at)
+		if err != nil {
+			log.Fatal("Failed to schedule the rollback to snapshot", app.scheduleRollback, ":", err.Error())
+		}
+		r.Scheduled = &scheduledRollback{Snapshot: app.scheduleRollback, At: at}
+	}
+
+	if app.cancelRollback {
+		err := library.CancelScheduledRollback()
+		if err != nil {
+			log.Fatal("Failed to cancel the scheduled rollback:", err.Error())
+		}
+		r.CancelledRollback = true
+	}
+
+	if app.pin != "" {
+		err := library.PinClient(app.pin, app.fromSnapshot)
+		if err != nil {
+			log.Fatal("Failed to pin clients", app.pin, ":", err.Error())
+		}
+		r.Pinned = app.pin
+	}
+
+	if app.unpin != "" {
+		err := library.UnpinClient(app.unpin)
+		if err != nil {
+			log.Fatal("Failed to unpin clients", app.unpin, ":", err.Error())
+		}
+		r.Unpinned = app.unpin
 	}
 
 	// this can be combined with other options; leaving it in the end
@@ -89,10 +345,52 @@ func executeActions(library *ddblibrarian.Library, app *appConfig) {
 		if err != nil {
 			log.Fatal("Failed to enumerate snapshots:", err.Error())
 		}
+		r.Snapshots = newSnapshotInfos(snapshots)
+
+		pins, err := library.ClientPins()
+		if err != nil {
+			log.Fatal("Failed to enumerate pinned clients:", err.Error())
+		}
+		r.Pins = pins
 
-		fmt.Println("Existing snapshots:")
-		for _, s := range snapshots {
-			fmt.Println(s)
+		scheduled, err := library.GetScheduledRollback()
+		if err != nil {
+			log.Fatal("Failed to find the scheduled rollback:", err.Error())
+		}
+		if scheduled != nil {
+			r.Scheduled = &scheduledRollback{Snapshot: scheduled.Snapshot, At: scheduled.At}
+		}
+	}
+
+	if app.idMap {
+		ids, _, err := library.SnapshotIDMap()
+		if err != nil {
+			log.Fatal("Failed to map snapshots to their IDs:", err.Error())
+		}
+		r.SnapshotIDs = ids
+	}
+
+	if app.jobs {
+		jobs, err := library.ListJobs()
+		if err != nil {
+			log.Fatal("Failed to enumerate jobs:", err.Error())
+		}
+		r.Jobs = newJobInfos(jobs)
+	}
+
+	return r
+}
+
+// run the scheduled rollback, if any, as soon as it is due, forever
+func runScheduledRollbacks(library *ddblibrarian.Library, interval time.Duration) {
+	for range time.Tick(interval) {
+		scheduled, err := library.RunScheduledRollback()
+		if err != nil {
+			log.Println("Failed to run the scheduled rollback:", err.Error())
+			continue
+		}
+		if scheduled != nil {
+			log.Println("Rolled back to snapshot", scheduled.Snapshot, "as scheduled for", scheduled.At)
 		}
 	}
 }
@@ -103,18 +401,123 @@ func main() {
 	flag.StringVar(&app.region, "region", "us-east-1", "AWS region the table lives in")
 	flag.StringVar(&app.endpoint, "endpoint", "", "Entry point for the DynamoDB region")
 	flag.StringVar(&app.table, "table", "", "Name of the DynamoDB table")
-	flag.StringVar(&app.partitionKey, "partition-key", "", "Partition key")
+	flag.StringVar(&app.partitionKey, "partition-key", "", "Partition key (read from the table if not given)")
 	flag.StringVar(&app.partitionKeyType, "partition-key-type", "", "Type of partition key (S or N)")
 	flag.StringVar(&app.rangeKey, "range-key", "", "range key")
 	flag.StringVar(&app.rangeKeyType, "range-key-type", "", "Type of range key (S or N)")
 	flag.StringVar(&app.snapshot, "snapshot", "", "Take a snapshot")
-	flag.StringVar(&app.rollback, "rollback", "", "Rollback to an existing snapshot")
+	flag.StringVar(&app.description, "description", "", "Describe the snapshot taken with -snapshot")
+	flag.StringVar(&app.rollback, "rollback", "", "Rollback to an existing snapshot (requires -dry-run or -confirm)")
+	flag.BoolVar(
+		&app.dryRun,
+		"dry-run",
+		false,
+		"Show what a rollback, -gc, or -destroy would change without changing anything",
+	)
+	flag.BoolVar(&app.confirm, "confirm", false, "Confirm a rollback, -gc, -destroy, or -schedule-rollback")
 	flag.BoolVar(&app.list, "list", false, "Lit existing snapshots")
+	flag.BoolVar(&app.idMap, "id-map", false, "Show the internal ID of every snapshot (the prefix of its keys)")
+	flag.BoolVar(
+		&app.jobs,
+		"jobs",
+		false,
+		"List the bulk operations saved in the table, running or recently over, and how they went",
+	)
+	flag.BoolVar(
+		&app.migrateKeys,
+		"migrate-key-encoding",
+		false,
+		"Convert numeric partition keys to the order-preserving encoding",
+	)
+	flag.BoolVar(
+		&app.noTrailingZeros,
+		"no-trailing-zeros",
+		false,
+		"Tell -migrate-key-encoding that no key written to a snapshot ends in 0",
+	)
+	flag.StringVar(
+		&app.dump,
+		"dump",
+		"",
+		"Dump the items written to a snapshot to a local file, s3://bucket/key, or - for stdout",
+	)
+	flag.StringVar(&app.load, "load", "", "Load a dump from a local file, s3://bucket/key, or - for stdin")
+	flag.StringVar(
+		&app.fromSnapshot,
+		"from-snapshot",
+		activeSnapshot,
+		"Snapshot to dump, without the items it inherits from older ones (defaults to the active one)",
+	)
+	flag.StringVar(&app.intoSnapshot, "into-snapshot", activeSnapshot, "Snapshot to load into (defaults to the active one)")
+	flag.IntVar(&app.segments, "segments", 1, "Number of segments to scan in parallel when dumping")
+	flag.BoolVar(
+		&app.verifyChecksums,
+		"verify-checksums",
+		false,
+		"Verify the checksums of every item of a snapshot (see -from-snapshot)",
+	)
+	flag.BoolVar(&app.gc, "gc", false, "Destroy snapshots no branch can reach anymore (requires -dry-run or -confirm)")
+	flag.StringVar(&app.destroy, "destroy", "", "Destroy a snapshot and its items (requires -dry-run or -confirm)")
+	flag.BoolVar(
+		&app.force,
+		"force",
+		false,
+		"Allow -destroy, and its -dry-run, to destroy the active or the latest snapshot",
+	)
+	flag.DurationVar(
+		&app.maxWriteTime,
+		"max-write-time",
+		10*time.Minute,
+		"Refuse to -destroy a snapshot if deleting its items would take longer at the table's write capacity "+
+			"(see -warn-max-write-time; 0 disables the check)",
+	)
+	flag.BoolVar(
+		&app.warnWriteTime,
+		"warn-max-write-time",
+		false,
+		"Only warn, instead of refusing, when -destroy would take longer than -max-write-time",
+	)
+	flag.StringVar(
+		&app.auditReport,
+		"audit-report",
+		"",
+		"Write a JSON report of every -destroy, -gc, -dump, and -load to a local file or s3://bucket/key",
+	)
+	flag.StringVar(&app.pin, "pin", "", "Pin clients with this client ID to a snapshot (see -from-snapshot)")
+	flag.StringVar(&app.unpin, "unpin", "", "Unpin clients with this client ID")
+	flag.StringVar(&app.scheduleRollback, "schedule-rollback", "", "Schedule a rollback to a snapshot (requires -at)")
+	flag.StringVar(&app.rollbackAt, "at", "", "When to run a scheduled rollback (RFC 3339, e.g., 2017-10-01T03:00:00Z)")
+	flag.BoolVar(&app.cancelRollback, "cancel-scheduled-rollback", false, "Cancel the scheduled rollback")
+	flag.BoolVar(
+		&app.runScheduled,
+		"run-scheduled-rollbacks",
+		false,
+		"Keep running, rolling back as scheduled (see -schedule-rollback)",
+	)
+	flag.DurationVar(&app.interval, "interval", time.Minute, "How often to check for scheduled rollbacks to run")
+	flag.StringVar(&app.output, "output", output.Table, "Output format (table or json)")
 
 	flag.Parse()
 
 	checkFlags(app)
 
-	library := connect(app)
-	executeActions(library, app)
+	// keep the results apart from a dump written to stdout
+	out := os.Stdout
+	if app.dump == "-" {
+		out = os.Stderr
+	}
+	printer, err := output.New(app.output, out)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	library, ddbSession := connect(app)
+	err = printer.Print(executeActions(library, ddbSession, app))
+	if err != nil {
+		log.Fatal("Failed to print the results:", err.Error())
+	}
+
+	if app.runScheduled {
+		runScheduledRollbacks(library, app.interval)
+	}
 }
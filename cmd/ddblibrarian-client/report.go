@@ -0,0 +1,337 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/cmd/internal/output"
+)
+
+// what a rollback would change
+type rollbackPlan struct {
+	Snapshot    string   `json:"snapshot"`
+	ChangedKeys int64    `json:"changed_keys"`
+	Sample      []string `json:"sample"`
+}
+
+func newRollbackPlan(plan *ddblibrarian.RollbackPlan) *rollbackPlan {
+	p := &rollbackPlan{
+		Snapshot:    plan.Snapshot,
+		ChangedKeys: plan.ChangedKeys,
+		Sample:      make([]string, 0, len(plan.Sample)),
+	}
+	for _, key := range plan.Sample {
+		p.Sample = append(p.Sample, output.FormatKey(key))
+	}
+
+	return p
+}
+
+// what destroying a snapshot would delete
+type destroyPlan struct {
+	Snapshot      string   `json:"snapshot"`
+	Items         int64    `json:"items"`
+	Sample        []string `json:"sample"`
+	WriteUnits    int64    `json:"write_units"`
+	WriteCapacity int64    `json:"write_capacity"`
+	Estimate      string   `json:"estimate"`
+}
+
+func newDestroyPlan(plan *ddblibrarian.DestroyPlan) *destroyPlan {
+	p := &destroyPlan{
+		Snapshot:      plan.Snapshot,
+		Items:         plan.Items,
+		Sample:        make([]string, 0, len(plan.Sample)),
+		WriteUnits:    plan.WriteUnits,
+		WriteCapacity: plan.WriteCapacity,
+		Estimate:      plan.Estimate.String(),
+	}
+	for _, key := range plan.Sample {
+		p.Sample = append(p.Sample, output.FormatKey(key))
+	}
+
+	return p
+}
+
+// items whose checksums were verified
+type checksumReport struct {
+	Snapshot string   `json:"snapshot"`
+	Checked  int64    `json:"checked"`
+	Missing  int64    `json:"missing"`
+	Corrupt  []string `json:"corrupt"`
+}
+
+func newChecksumReport(checksums *ddblibrarian.ChecksumReport) *checksumReport {
+	r := &checksumReport{
+		Snapshot: checksums.Snapshot,
+		Checked:  checksums.Checked,
+		Missing:  checksums.Missing,
+		Corrupt:  make([]string, 0, len(checksums.Corrupt)),
+	}
+	for _, key := range checksums.Corrupt {
+		r.Corrupt = append(r.Corrupt, output.FormatKey(key))
+	}
+
+	return r
+}
+
+// an existing snapshot
+type snapshotInfo struct {
+	Name        string    `json:"name"`
+	ID          string    `json:"id"`
+	Created     time.Time `json:"created"`
+	Description string    `json:"description,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	Locked      bool      `json:"locked,omitempty"`
+	Current     bool      `json:"current,omitempty"`
+	Latest      bool      `json:"latest,omitempty"`
+}
+
+func newSnapshotInfos(snapshots []ddblibrarian.SnapshotInfo) *[]snapshotInfo {
+	infos := make([]snapshotInfo, 0, len(snapshots))
+	for _, s := range snapshots {
+		infos = append(infos, snapshotInfo(s))
+	}
+
+	return &infos
+}
+
+// how a bulk operation went, for the audit trail
+type operationReport struct {
+	Operation        string                     `json:"operation"`
+	Snapshot         string                     `json:"snapshot,omitempty"`
+	Started          time.Time                  `json:"started"`
+	DurationSeconds  float64                    `json:"duration_seconds"`
+	Items            int64                      `json:"items"`
+	ConsumedCapacity float64                    `json:"consumed_capacity"`
+	FailedKeys       []string                   `json:"failed_keys,omitempty"`
+	Checkpoint       *ddblibrarian.ScanProgress `json:"checkpoint,omitempty"`
+	Error            string                     `json:"error,omitempty"`
+}
+
+func newOperationReport(report *ddblibrarian.OperationReport) operationReport {
+	r := operationReport{
+		Operation:        report.Operation,
+		Snapshot:         report.Snapshot,
+		Started:          report.Started,
+		DurationSeconds:  report.Duration.Seconds(),
+		Items:            report.Items,
+		ConsumedCapacity: report.ConsumedCapacity,
+		Checkpoint:       report.Checkpoint,
+		Error:            report.Error,
+	}
+	for _, key := range report.FailedKeys {
+		r.FailedKeys = append(r.FailedKeys, output.FormatKey(key))
+	}
+
+	return r
+}
+
+// a bulk operation saved in the table's metadata
+type jobInfo struct {
+	ID               string     `json:"id"`
+	Operation        string     `json:"operation"`
+	Snapshot         string     `json:"snapshot,omitempty"`
+	State            string     `json:"state"`
+	Started          time.Time  `json:"started"`
+	Updated          *time.Time `json:"updated,omitempty"`
+	Finished         *time.Time `json:"finished,omitempty"`
+	Items            int64      `json:"items"`
+	ConsumedCapacity float64    `json:"consumed_capacity"`
+	Error            string     `json:"error,omitempty"`
+}
+
+func newJobInfos(jobs []ddblibrarian.JobStatus) *[]jobInfo {
+	infos := make([]jobInfo, 0, len(jobs))
+	for _, job := range jobs {
+		info := jobInfo{
+			ID:               job.ID,
+			Operation:        job.Operation,
+			Snapshot:         job.Snapshot,
+			State:            string(job.State),
+			Started:          job.Started,
+			Items:            job.Items,
+			ConsumedCapacity: job.ConsumedCapacity,
+		}
+		if !job.Updated.IsZero() {
+			updated := job.Updated
+			info.Updated = &updated
+		}
+		if !job.Finished.IsZero() {
+			finished := job.Finished
+			info.Finished = &finished
+		}
+		if job.Err != nil {
+			info.Error = job.Err.Error()
+		}
+		infos = append(infos, info)
+	}
+
+	return &infos
+}
+
+// a rollback to run in the future
+type scheduledRollback struct {
+	Snapshot string    `json:"snapshot"`
+	At       time.Time `json:"at"`
+}
+
+// the results of all actions taken on a single run, printed once they're all done
+type report struct {
+	Migrated          *int64             `json:"migrated,omitempty"`
+	RollbackPlan      *rollbackPlan      `json:"rollback_plan,omitempty"`
+	RolledBack        string             `json:"rolled_back,omitempty"`
+	Created           string             `json:"created,omitempty"`
+	Dumped            *int64             `json:"dumped,omitempty"`
+	Loaded            *int64             `json:"loaded,omitempty"`
+	Checksums         *checksumReport    `json:"checksums,omitempty"`
+	Unreachable       *[]string          `json:"unreachable,omitempty"`
+	Destroyed         *[]string          `json:"destroyed,omitempty"`
+	DestroyPlan       *destroyPlan       `json:"destroy_plan,omitempty"`
+	Scheduled         *scheduledRollback `json:"scheduled_rollback,omitempty"`
+	CancelledRollback bool               `json:"cancelled_rollback,omitempty"`
+	Pinned            string             `json:"pinned,omitempty"`
+	Unpinned          string             `json:"unpinned,omitempty"`
+	Snapshots         *[]snapshotInfo    `json:"snapshots,omitempty"`
+	Pins              map[string]string  `json:"pins,omitempty"`
+	SnapshotIDs       map[string]string  `json:"snapshot_ids,omitempty"`
+	Jobs              *[]jobInfo         `json:"jobs,omitempty"`
+}
+
+func (r *report) Header() []string {
+	return nil
+}
+
+func (r *report) Rows() [][]string {
+	rows := make([][]string, 0)
+
+	if r.Migrated != nil {
+		rows = append(rows, []string{"migrated items", strconv.FormatInt(*r.Migrated, 10)})
+	}
+	if r.RollbackPlan != nil {
+		rows = append(rows, []string{"rollback to", r.RollbackPlan.Snapshot})
+		rows = append(rows, []string{"changed keys", strconv.FormatInt(r.RollbackPlan.ChangedKeys, 10)})
+		for _, key := range r.RollbackPlan.Sample {
+			rows = append(rows, []string{"changed key", key})
+		}
+	}
+	if r.RolledBack != "" {
+		rows = append(rows, []string{"rolled back to", r.RolledBack})
+	}
+	if r.Created != "" {
+		rows = append(rows, []string{"created snapshot", r.Created})
+	}
+	if r.Dumped != nil {
+		rows = append(rows, []string{"dumped items", strconv.FormatInt(*r.Dumped, 10)})
+	}
+	if r.Loaded != nil {
+		rows = append(rows, []string{"loaded items", strconv.FormatInt(*r.Loaded, 10)})
+	}
+	if r.Checksums != nil {
+		rows = append(rows, []string{"verified snapshot", r.Checksums.Snapshot})
+		rows = append(rows, []string{"checked items", strconv.FormatInt(r.Checksums.Checked, 10)})
+		rows = append(rows, []string{"items without checksum", strconv.FormatInt(r.Checksums.Missing, 10)})
+		for _, key := range r.Checksums.Corrupt {
+			rows = append(rows, []string{"corrupt item", key})
+		}
+	}
+	if r.Unreachable != nil {
+		for _, s := range *r.Unreachable {
+			rows = append(rows, []string{"unreachable snapshot", s})
+		}
+	}
+	if r.Destroyed != nil {
+		for _, s := range *r.Destroyed {
+			rows = append(rows, []string{"destroyed snapshot", s})
+		}
+	}
+	if r.DestroyPlan != nil {
+		rows = append(rows, []string{"destroy", r.DestroyPlan.Snapshot})
+		rows = append(rows, []string{"items to delete", strconv.FormatInt(r.DestroyPlan.Items, 10)})
+		for _, key := range r.DestroyPlan.Sample {
+			rows = append(rows, []string{"item to delete", key})
+		}
+		rows = append(rows, []string{"write units", strconv.FormatInt(r.DestroyPlan.WriteUnits, 10)})
+		if r.DestroyPlan.WriteCapacity > 0 {
+			rows = append(rows, []string{"estimated time", r.DestroyPlan.Estimate + " at " +
+				strconv.FormatInt(r.DestroyPlan.WriteCapacity, 10) + " WCU"})
+		}
+	}
+	if r.CancelledRollback {
+		rows = append(rows, []string{"cancelled scheduled rollback", "yes"})
+	}
+	if r.Pinned != "" {
+		rows = append(rows, []string{"pinned clients", r.Pinned})
+	}
+	if r.Unpinned != "" {
+		rows = append(rows, []string{"unpinned clients", r.Unpinned})
+	}
+	if r.Snapshots != nil {
+		for _, s := range *r.Snapshots {
+			description := s.Name + " (id " + s.ID
+			if !s.Created.IsZero() {
+				description += ", created " + s.Created.Format(time.RFC3339)
+			}
+			if s.Description != "" {
+				description += ", " + strconv.Quote(s.Description)
+			}
+			if s.Locked {
+				description += ", locked"
+			}
+			if s.Current {
+				description += ", current"
+			}
+			if s.Latest {
+				description += ", latest"
+			}
+			rows = append(rows, []string{"snapshot", description + ")"})
+		}
+	}
+	if r.Scheduled != nil {
+		rows = append(rows, []string{"scheduled rollback to", r.Scheduled.Snapshot})
+		rows = append(rows, []string{"scheduled rollback at", r.Scheduled.At.Format(time.RFC3339)})
+	}
+	if r.Pins != nil {
+		clientIDs := make([]string, 0, len(r.Pins))
+		for clientID := range r.Pins {
+			clientIDs = append(clientIDs, clientID)
+		}
+		sort.Strings(clientIDs)
+		for _, clientID := range clientIDs {
+			rows = append(rows, []string{"client " + clientID, "pinned to " + r.Pins[clientID]})
+		}
+	}
+	if r.SnapshotIDs != nil {
+		names := make([]string, 0, len(r.SnapshotIDs))
+		for name := range r.SnapshotIDs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			rows = append(rows, []string{"snapshot " + name, "id " + r.SnapshotIDs[name]})
+		}
+	}
+	if r.Jobs != nil {
+		for _, job := range *r.Jobs {
+			description := job.Operation
+			if job.Snapshot != "" {
+				description += " " + job.Snapshot
+			}
+			description += " (" + job.State + ", started " + job.Started.Format(time.RFC3339)
+			if job.Finished != nil {
+				description += ", finished " + job.Finished.Format(time.RFC3339)
+			} else if job.Updated != nil {
+				description += ", updated " + job.Updated.Format(time.RFC3339)
+			}
+			description += ", " + strconv.FormatInt(job.Items, 10) + " items"
+			if job.Error != "" {
+				description += ", " + strconv.Quote(job.Error)
+			}
+			rows = append(rows, []string{"job " + job.ID, description + ")"})
+		}
+	}
+
+	return rows
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/cmd/internal/output"
+	"github.com/marcoalmeida/ddblibrarian/ratelimit"
+	"github.com/marcoalmeida/ddblibrarian/retry"
+)
+
+const (
+	// the snapshot name the library resolves to the active snapshot
+	activeSnapshot = "current"
+	// maximum number of keys DynamoDB accepts on a single BatchGetItem call
+	batchGetSize = 100
+	// maximum number of differing keys included in the report
+	sampleSize = 10
+)
+
+type appConfig struct {
+	srcRegion        string
+	dstRegion        string
+	srcTable         string
+	dstTable         string
+	partitionKey     string
+	partitionKeyType string
+	rangeKey         string
+	rangeKeyType     string
+	snapshot         string
+	fromSnapshot     string
+	segments         int
+	maxRCU           float64
+	maxRCUPercent    float64
+	checkpointFile   string
+	checkpointEvery  time.Duration
+	resume           bool
+	output           string
+}
+
+// everything needed to resume an interrupted diff
+type checkpoint struct {
+	// 0 while looking up the items of the source on the destination, 1 for the other way around
+	Pass int `json:"pass"`
+	// how far the scan of the current pass has gone
+	Progress *ddblibrarian.ScanProgress `json:"progress"`
+	// differences found so far
+	Report *diffReport `json:"report"`
+
+	file      string
+	lastSaved time.Time
+}
+
+// write the checkpoint to a temporary file and rename it so that an interruption never leaves a broken checkpoint
+func (c *checkpoint) save() {
+	data, err := json.Marshal(c)
+	if err != nil {
+		log.Fatal("Failed to encode checkpoint: ", err.Error())
+	}
+
+	err = ioutil.WriteFile(c.file+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(c.file+".tmp", c.file)
+	}
+	if err != nil {
+		log.Fatal("Failed to save checkpoint: ", err.Error())
+	}
+
+	c.lastSaved = time.Now()
+}
+
+// start a new diff, or load the checkpoint of an interrupted one
+func loadCheckpoint(app *appConfig) *checkpoint {
+	cp := &checkpoint{
+		Report: &diffReport{
+			Source:      app.srcTable,
+			Destination: app.dstTable,
+			Snapshot:    app.snapshot,
+			Sample:      make([]difference, 0),
+		},
+		file:      app.checkpointFile,
+		lastSaved: time.Now(),
+	}
+	if !app.resume {
+		return cp
+	}
+
+	data, err := ioutil.ReadFile(app.checkpointFile)
+	if err != nil {
+		log.Fatal("Failed to read checkpoint: ", err.Error())
+	}
+	err = json.Unmarshal(data, cp)
+	if err != nil {
+		log.Fatal("Failed to parse checkpoint: ", err.Error())
+	}
+
+	if cp.Report.Source != app.srcTable || cp.Report.Destination != app.dstTable || cp.Report.Snapshot != app.snapshot {
+		log.Fatal("The checkpoint is for a different diff: ", cp.Report.Source, " -> ", cp.Report.Destination,
+			" (snapshot ", cp.Report.Snapshot, ")")
+	}
+	log.Println("Resuming from pass", cp.Pass, "of", app.checkpointFile)
+
+	return cp
+}
+
+// one of the tables being compared
+type table struct {
+	name    string
+	library *ddblibrarian.Library
+	limiter *ratelimit.Limiter
+}
+
+// a key that is not the same on both tables
+type difference struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+}
+
+// the result of comparing both tables
+type diffReport struct {
+	Source            string       `json:"source"`
+	Destination       string       `json:"destination"`
+	Snapshot          string       `json:"snapshot"`
+	OnlyInSource      int64        `json:"only_in_source"`
+	OnlyInDestination int64        `json:"only_in_destination"`
+	Different         int64        `json:"different"`
+	Sample            []difference `json:"sample"`
+}
+
+func (r *diffReport) Header() []string {
+	return nil
+}
+
+func (r *diffReport) Rows() [][]string {
+	rows := [][]string{
+		{"source", r.Source},
+		{"destination", r.Destination},
+		{"snapshot", r.Snapshot},
+		{"only in source", strconv.FormatInt(r.OnlyInSource, 10)},
+		{"only in destination", strconv.FormatInt(r.OnlyInDestination, 10)},
+		{"different", strconv.FormatInt(r.Different, 10)},
+	}
+	for _, d := range r.Sample {
+		rows = append(rows, []string{d.Reason, d.Key})
+	}
+
+	return rows
+}
+
+func (r *diffReport) add(key string, reason string) {
+	if len(r.Sample) < sampleSize {
+		r.Sample = append(r.Sample, difference{Key: key, Reason: reason})
+	}
+}
+
+func checkFlags(app *appConfig) {
+	if app.fromSnapshot != "" {
+		if app.srcTable == "" || app.dstTable != "" {
+			log.Fatal("Comparing snapshots takes a single (source) table")
+		}
+		if app.resume {
+			log.Fatal("Comparing snapshots cannot be resumed")
+		}
+	} else if app.srcTable == "" || app.dstTable == "" {
+		log.Fatal("Both source and destination tables are mandatory")
+	}
+
+	if app.partitionKey == "" {
+		log.Fatal("The partition key is required")
+	}
+
+	if app.partitionKeyType == "" {
+		log.Fatal("The partition key type (S or N) is required")
+	}
+
+	if app.maxRCU > 0 && app.maxRCUPercent > 0 {
+		log.Fatal("These are mutually exclusive options: max-rcu, max-rcu-percent")
+	}
+
+	if app.maxRCUPercent > 100 {
+		log.Fatal("The percentage of provisioned read capacity cannot be over 100")
+	}
+}
+
+// return the limiter for a table, if reads are to be limited at all
+func newLimiter(name string, ddbSession *session.Session, app *appConfig) *ratelimit.Limiter {
+	if app.maxRCU > 0 {
+		return ratelimit.New(app.maxRCU)
+	}
+
+	if app.maxRCUPercent > 0 {
+		out, err := dynamodb.New(ddbSession).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(name)})
+		if err != nil {
+			log.Fatal("Failed to describe table ", name, ": ", err.Error())
+		}
+		provisioned := aws.Int64Value(out.Table.ProvisionedThroughput.ReadCapacityUnits)
+		if provisioned == 0 {
+			log.Fatal("Table ", name, " has no provisioned read capacity (on-demand?), use -max-rcu instead")
+		}
+		return ratelimit.New(float64(provisioned) * app.maxRCUPercent / 100)
+	}
+
+	return nil
+}
+
+func connect(name string, region string, app *appConfig) *table {
+	ddbSession, err := session.NewSession(&aws.Config{
+		Region:     aws.String(region),
+		MaxRetries: aws.Int(3),
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	library, err := ddblibrarian.New(
+		name,
+		app.partitionKey,
+		app.partitionKeyType,
+		app.rangeKey,
+		app.rangeKeyType,
+		ddbSession,
+	)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return &table{name: name, library: library, limiter: newLimiter(name, ddbSession, app)}
+}
+
+func primaryKey(item map[string]*dynamodb.AttributeValue, app *appConfig) map[string]*dynamodb.AttributeValue {
+	key := map[string]*dynamodb.AttributeValue{app.partitionKey: item[app.partitionKey]}
+	if app.rangeKey != "" {
+		key[app.rangeKey] = item[app.rangeKey]
+	}
+
+	return key
+}
+
+// read the items of t with the same keys as items, indexed by their (formatted) key
+func lookup(
+	t *table,
+	items []map[string]*dynamodb.AttributeValue,
+	app *appConfig,
+) map[string]map[string]*dynamodb.AttributeValue {
+	found := make(map[string]map[string]*dynamodb.AttributeValue, len(items))
+
+	for start := 0; start < len(items); start += batchGetSize {
+		end := start + batchGetSize
+		if end > len(items) {
+			end = len(items)
+		}
+
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, end-start)
+		for _, item := range items[start:end] {
+			keys = append(keys, primaryKey(item, app))
+		}
+		pending := &dynamodb.KeysAndAttributes{Keys: keys, ConsistentRead: aws.Bool(true)}
+
+		// throttled requests, and unprocessed keys, are retried as retry.DefaultPolicy says
+		policy := retry.DefaultPolicy()
+		for attempt := 0; pending != nil && len(pending.Keys) > 0; attempt++ {
+			if attempt > policy.MaxRetries {
+				log.Fatal("Giving up on unprocessed keys of ", t.name, " after too many retries")
+			}
+			time.Sleep(policy.Delay(attempt))
+
+			var out *dynamodb.BatchGetItemOutput
+			err := policy.Do(func() error {
+				var err error
+				t.limiter.Wait()
+				out, err = t.library.BatchGetItemFromSnapshot(&dynamodb.BatchGetItemInput{
+					RequestItems:           map[string]*dynamodb.KeysAndAttributes{t.name: pending},
+					ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+				}, app.snapshot)
+				return err
+			})
+			if err != nil {
+				log.Fatal("Failed to read from ", t.name, ": ", err.Error())
+			}
+			for _, consumed := range out.ConsumedCapacity {
+				t.limiter.Consume(aws.Float64Value(consumed.CapacityUnits))
+			}
+
+			for _, item := range out.Responses[t.name] {
+				found[output.FormatKey(primaryKey(item, app))] = item
+			}
+			pending = out.UnprocessedKeys[t.name]
+		}
+	}
+
+	return found
+}
+
+// read every item of from and look it up on to, calling fn with both versions (the one from to may be nil);
+// checkpoints are saved periodically
+func compare(
+	from *table,
+	to *table,
+	app *appConfig,
+	cp *checkpoint,
+	fn func(key string, item map[string]*dynamodb.AttributeValue, other map[string]*dynamodb.AttributeValue),
+) {
+	// pages are looked up by up to one worker per segment at a time, while the mutex only guards fn and the checkpoint
+	var pending sync.WaitGroup
+	var mutex sync.Mutex
+	workers := make(chan struct{}, app.segments)
+
+	opts := &ddblibrarian.BulkOptions{
+		Segments:    app.segments,
+		ReadLimiter: from.limiter,
+		Resume:      cp.Progress,
+		OnProgress: func(progress *ddblibrarian.ScanProgress) error {
+			if time.Since(cp.lastSaved) >= app.checkpointEvery {
+				// the checkpoint must not get ahead of the pages still being looked up
+				pending.Wait()
+				mutex.Lock()
+				cp.Progress = progress
+				cp.save()
+				mutex.Unlock()
+			}
+			return nil
+		},
+	}
+
+	err := from.library.ScanAllFromSnapshotFunc(
+		&dynamodb.ScanInput{TableName: aws.String(from.name), ConsistentRead: aws.Bool(true)},
+		app.snapshot,
+		opts,
+		func(items []map[string]*dynamodb.AttributeValue) error {
+			workers <- struct{}{}
+			pending.Add(1)
+			go func() {
+				defer pending.Done()
+				defer func() { <-workers }()
+
+				found := lookup(to, items, app)
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, item := range items {
+					key := output.FormatKey(primaryKey(item, app))
+					fn(key, item, found[key])
+				}
+			}()
+			return nil
+		},
+	)
+	if err != nil {
+		log.Fatal("Failed to read from ", from.name, ": ", err.Error())
+	}
+	pending.Wait()
+}
+
+func diff(src *table, dst *table, app *appConfig) *diffReport {
+	cp := loadCheckpoint(app)
+	report := cp.Report
+
+	// items missing from, or different on, the destination...
+	if cp.Pass == 0 {
+		compare(src, dst, app, cp, func(key string, item, other map[string]*dynamodb.AttributeValue) {
+			switch {
+			case other == nil:
+				report.OnlyInSource++
+				report.add(key, "only in source")
+			case !reflect.DeepEqual(item, other):
+				report.Different++
+				report.add(key, "different")
+			}
+		})
+		cp.Pass = 1
+		cp.Progress = nil
+		cp.save()
+	}
+	// ...and the ones missing from the source (differences were already found in the first pass)
+	compare(dst, src, app, cp, func(key string, item, other map[string]*dynamodb.AttributeValue) {
+		if other == nil {
+			report.OnlyInDestination++
+			report.add(key, "only in destination")
+		}
+	})
+
+	// nothing left to resume
+	err := os.Remove(app.checkpointFile)
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to remove checkpoint:", err.Error())
+	}
+
+	return report
+}
+
+// compare two snapshots of the same table
+func diffSnapshots(t *table, app *appConfig) *diffReport {
+	d, err := t.library.DiffSnapshots(app.fromSnapshot, app.snapshot)
+	if err != nil {
+		log.Fatal("Failed to compare snapshots of ", t.name, ": ", err.Error())
+	}
+
+	report := &diffReport{
+		Source:            t.name + " (" + app.fromSnapshot + ")",
+		Destination:       t.name + " (" + app.snapshot + ")",
+		Snapshot:          app.snapshot,
+		OnlyInSource:      int64(len(d.Removed)),
+		OnlyInDestination: int64(len(d.Added)),
+		Different:         int64(len(d.Modified)),
+		Sample:            make([]difference, 0),
+	}
+	for _, item := range d.Removed {
+		report.add(output.FormatKey(primaryKey(item, app)), "only in source")
+	}
+	for _, item := range d.Added {
+		report.add(output.FormatKey(primaryKey(item, app)), "only in destination")
+	}
+	for _, change := range d.Modified {
+		report.add(output.FormatKey(change.Key), "different")
+	}
+
+	return report
+}
+
+func main() {
+	app := &appConfig{}
+
+	flag.StringVar(&app.srcRegion, "source-region", "us-east-1", "AWS region of the source table")
+	flag.StringVar(&app.dstRegion, "destination-region", "us-east-1", "AWS region of the destination table")
+	flag.StringVar(&app.srcTable, "source", "", "Source DynamoDB table")
+	flag.StringVar(&app.dstTable, "destination", "", "Destination DynamoDB table")
+	flag.StringVar(&app.partitionKey, "partition-key", "", "Partition key")
+	flag.StringVar(&app.partitionKeyType, "partition-key-type", "", "Type of partition key (S or N)")
+	flag.StringVar(&app.rangeKey, "range-key", "", "range key")
+	flag.StringVar(&app.rangeKeyType, "range-key-type", "", "Type of range key (S or N)")
+	flag.StringVar(&app.snapshot, "snapshot", activeSnapshot, "Snapshot to compare (defaults to the active one)")
+	flag.StringVar(
+		&app.fromSnapshot,
+		"from-snapshot",
+		"",
+		"Compare this snapshot of the source table with -snapshot, instead of comparing two tables",
+	)
+	flag.IntVar(&app.segments, "segments", 1, "Number of segments to scan in parallel")
+	flag.Float64Var(&app.maxRCU, "max-rcu", 0, "Maximum read capacity units per second to consume on each table")
+	flag.Float64Var(
+		&app.maxRCUPercent,
+		"max-rcu-percent",
+		0,
+		"Maximum percentage of each table's provisioned read capacity to consume",
+	)
+	flag.StringVar(&app.checkpointFile, "checkpoint", "ddblibrarian-diff.checkpoint", "Where to save checkpoints")
+	flag.DurationVar(&app.checkpointEvery, "checkpoint-interval", 30*time.Second, "How often to save checkpoints")
+	flag.BoolVar(&app.resume, "resume", false, "Resume an interrupted diff from its checkpoint")
+	flag.StringVar(&app.output, "output", output.Table, "Output format (table or json)")
+
+	flag.Parse()
+	checkFlags(app)
+	printer, err := output.New(app.output, os.Stdout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	src := connect(app.srcTable, app.srcRegion, app)
+	var report *diffReport
+	if app.fromSnapshot != "" {
+		report = diffSnapshots(src, app)
+	} else {
+		report = diff(src, connect(app.dstTable, app.dstRegion, app), app)
+	}
+	err = printer.Print(report)
+	if err != nil {
+		log.Fatal("Failed to print the report:", err.Error())
+	}
+}
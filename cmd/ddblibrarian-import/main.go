@@ -4,18 +4,22 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 
 	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/cmd/internal/output"
+	"github.com/marcoalmeida/ddblibrarian/retry"
 )
 
 const (
@@ -23,9 +27,16 @@ const (
 	batchSize         int = 25
 )
 
+// set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
 type appConfig struct {
 	srcRegion        string
 	dstRegion        string
+	srcProfile       string
+	dstProfile       string
+	srcRoleArn       string
+	dstRoleArn       string
 	srcTable         string
 	dstTable         string
 	partitionKey     string
@@ -35,6 +46,23 @@ type appConfig struct {
 	snapshot         string
 	maxRetries       int
 	showFailed       bool
+	output           string
+}
+
+// summary of a clone, printed once all items have been written
+type cloneSummary struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Snapshot    string `json:"snapshot,omitempty"`
+	Items       int64  `json:"items"`
+}
+
+func (s *cloneSummary) Header() []string {
+	return []string{"SOURCE", "DESTINATION", "SNAPSHOT", "ITEMS"}
+}
+
+func (s *cloneSummary) Rows() [][]string {
+	return [][]string{{s.Source, s.Destination, s.Snapshot, strconv.FormatInt(s.Items, 10)}}
 }
 
 func checkFlags(app *appConfig) {
@@ -51,23 +79,32 @@ func checkFlags(app *appConfig) {
 	}
 }
 
-func connect(app *appConfig) (*dynamodb.DynamoDB, *ddblibrarian.Library) {
-	srcSession, err := session.NewSession(&aws.Config{
-		Region:     aws.String(app.srcRegion),
-		MaxRetries: aws.Int(3),
+// create a session for region with the credentials of a named profile (if any) and, optionally, assume a role with
+// them; the source and destination tables are often on different accounts
+func newSession(region string, profile string, roleArn string) *session.Session {
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config: aws.Config{
+			Region:     aws.String(region),
+			MaxRetries: aws.Int(3),
+		},
+		Profile:           profile,
+		SharedConfigState: session.SharedConfigEnable,
 	})
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
-	dstSession, err := session.NewSession(&aws.Config{
-		Region:     aws.String(app.dstRegion),
-		MaxRetries: aws.Int(3),
-	})
-	if err != nil {
-		log.Fatal(err.Error())
+	if roleArn == "" {
+		return sess
 	}
 
+	return sess.Copy(&aws.Config{Credentials: stscreds.NewCredentials(sess, roleArn)})
+}
+
+func connect(app *appConfig) (*dynamodb.DynamoDB, *ddblibrarian.Library) {
+	srcSession := newSession(app.srcRegion, app.srcProfile, app.srcRoleArn)
+	dstSession := newSession(app.dstRegion, app.dstProfile, app.dstRoleArn)
+
 	librarian, err := ddblibrarian.New(
 		app.dstTable,
 		app.partitionKey,
@@ -80,7 +117,18 @@ func connect(app *appConfig) (*dynamodb.DynamoDB, *ddblibrarian.Library) {
 		log.Fatal(err.Error())
 	}
 
-	return dynamodb.New(srcSession), librarian
+	return dynamodb.New(srcSession, aws.NewConfig().WithMaxRetries(app.maxRetries)), librarian
+}
+
+// retry throttled requests up to maxRetries times, logging every retry
+func retryPolicy(operation string, maxRetries int) retry.Policy {
+	policy := retry.DefaultPolicy()
+	policy.MaxRetries = maxRetries
+	policy.OnRetry = func(_ int, wait time.Duration, _ error) {
+		log.Printf("%s: backing off for %s\n", operation, wait)
+	}
+
+	return policy
 }
 
 func writeBatch(
@@ -88,32 +136,12 @@ func writeBatch(
 	library *ddblibrarian.Library,
 	maxRetries int,
 ) error {
-	var err error
-
-	for i := 0; i < maxRetries; i++ {
-		_, err = library.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+	return retryPolicy("BatchWriteItem", maxRetries).Do(func() error {
+		_, err := library.BatchWriteItem(&dynamodb.BatchWriteItemInput{
 			RequestItems: batch,
 		})
-		if err != nil {
-			if aerr, ok := err.(awserr.Error); ok {
-				if aerr.Code() == dynamodb.ErrCodeProvisionedThroughputExceededException {
-					wait := math.Pow(2, float64(i)) * 100
-					log.Printf("BatchWriteItem: backing off for %f milliseconds\n", wait)
-					time.Sleep(time.Duration(wait) * time.Millisecond)
-					continue
-				}
-			} else {
-				// there's no point on retrying
-				return err
-			}
-		} else {
-			// the write succeeded, nothing else to do here
-			return nil
-		}
-	}
-
-	// if we've made it this far, all attempts have failed
-	return err
+		return err
+	})
 }
 
 func writeItems(
@@ -121,23 +149,25 @@ func writeItems(
 	lastEvaluatedKey map[string]*dynamodb.AttributeValue,
 	library *ddblibrarian.Library,
 	app *appConfig,
+	summary *cloneSummary,
 ) {
 	var err error = nil
 	requests := make(map[string][]*dynamodb.WriteRequest, 0)
 
 	// create groups of 25 items -- max batch size
 	for i, item := range items {
-		if (i%batchSize) == 0 && i > 0 {
+		requests[app.dstTable] = append(requests[app.dstTable], &dynamodb.WriteRequest{
+			PutRequest: &dynamodb.PutRequest{
+				Item: item,
+			}})
+
+		if len(requests[app.dstTable]) == batchSize || i == len(items)-1 {
 			err = writeBatch(requests, library, app.maxRetries)
 			if err != nil {
 				break
 			}
+			atomic.AddInt64(&summary.Items, int64(len(requests[app.dstTable])))
 			requests = make(map[string][]*dynamodb.WriteRequest, 0)
-		} else {
-			requests[app.dstTable] = append(requests[app.dstTable], &dynamodb.WriteRequest{
-				PutRequest: &dynamodb.PutRequest{
-					Item: item,
-				}})
 		}
 	}
 
@@ -156,7 +186,10 @@ func writeItems(
 	}
 }
 
-func clone(srcTable *dynamodb.DynamoDB, library *ddblibrarian.Library, app *appConfig) {
+func clone(srcTable *dynamodb.DynamoDB, library *ddblibrarian.Library, app *appConfig) *cloneSummary {
+	var wg sync.WaitGroup
+	summary := &cloneSummary{Source: app.srcTable, Destination: app.dstTable, Snapshot: app.snapshot}
+
 	if app.snapshot != "" {
 		err := library.Snapshot(app.snapshot)
 		if err != nil {
@@ -164,43 +197,44 @@ func clone(srcTable *dynamodb.DynamoDB, library *ddblibrarian.Library, app *appC
 		}
 	}
 
-	lastEvaluatedKey := make(map[string]*dynamodb.AttributeValue, 0)
-	for {
-		input := &dynamodb.ScanInput{
-			TableName:      aws.String(app.srcTable),
-			ConsistentRead: aws.Bool(true),
-		}
-		// include the last key we received (if any) to resume scanning
-		if len(lastEvaluatedKey) > 0 {
-			input.ExclusiveStartKey = lastEvaluatedKey
-		}
+	// the source is not managed by a library, so the client takes care of the pagination loop (and of retrying
+	// throttled requests, up to -max-retries times)
+	input := &dynamodb.ScanInput{
+		TableName:      aws.String(app.srcTable),
+		ConsistentRead: aws.Bool(true),
+	}
+	err := srcTable.ScanPages(input, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		wg.Add(1)
+		go func(items []map[string]*dynamodb.AttributeValue, key map[string]*dynamodb.AttributeValue) {
+			defer wg.Done()
+			writeItems(items, key, library, app, summary)
+		}(page.Items, page.LastEvaluatedKey)
+		return true
+	})
+	if err != nil {
+		log.Fatalln("Scan: failed after", app.maxRetries, "retries:", err)
+	}
 
-		for i := 0; i < app.maxRetries; i++ {
-			result, err := srcTable.Scan(input)
-			if err != nil {
-				if aerr, ok := err.(awserr.Error); ok {
-					if aerr.Code() == dynamodb.ErrCodeProvisionedThroughputExceededException {
-						wait := math.Pow(2, float64(i)) * 100
-						log.Printf("Scan: backing off for %f milliseconds\n", wait)
-						time.Sleep(time.Duration(wait) * time.Millisecond)
-						continue
-					}
-				} else {
-					// there's no point on retrying
-					log.Fatalln("Scan: failed after", app.maxRetries, ":", err)
-				}
-			} else {
-				lastEvaluatedKey = result.LastEvaluatedKey
-				go writeItems(result.Items, lastEvaluatedKey, library, app)
-				// the API call succeeded, we can break the retry loop
-				break
-			}
-		}
+	wg.Wait()
+	recordLineage(library, app, summary)
+	return summary
+}
 
-		// we're done
-		if len(lastEvaluatedKey) == 0 {
-			return
-		}
+// record where the data of the destination snapshot came from
+func recordLineage(library *ddblibrarian.Library, app *appConfig, summary *cloneSummary) {
+	if app.snapshot == "" {
+		return
+	}
+
+	err := library.SetSnapshotLineage(app.snapshot, &ddblibrarian.Lineage{
+		SourceTable:  app.srcTable,
+		SourceRegion: app.srcRegion,
+		Timestamp:    time.Now(),
+		Items:        summary.Items,
+		ToolVersion:  "ddblibrarian-import " + version,
+	})
+	if err != nil {
+		log.Fatal("Failed to record the lineage of snapshot ", app.snapshot, ": ", err.Error())
 	}
 }
 
@@ -215,7 +249,8 @@ func prettyPrintKey(item map[string]*dynamodb.AttributeValue, prefix string, app
 	format := "%s: %s=%s, %s=%s\n"
 
 	out := os.Stdout
-	if isError {
+	// keep stdout for the summary when it's meant to be parsed
+	if isError || app.output == output.JSON {
 		out = os.Stderr
 	}
 
@@ -235,6 +270,15 @@ func main() {
 	// TODO: accept LastEvaluatedKey as a parameter to allow resuming
 	flag.StringVar(&app.srcRegion, "source-region", "us-east-1", "AWS region of the source table")
 	flag.StringVar(&app.dstRegion, "destination-region", "us-east-1", "AWS region of the destination table")
+	flag.StringVar(&app.srcProfile, "source-profile", "", "Shared credentials profile to read the source table with")
+	flag.StringVar(
+		&app.dstProfile,
+		"destination-profile",
+		"",
+		"Shared credentials profile to write the destination table with",
+	)
+	flag.StringVar(&app.srcRoleArn, "source-role-arn", "", "IAM role to assume to read the source table")
+	flag.StringVar(&app.dstRoleArn, "destination-role-arn", "", "IAM role to assume to write the destination table")
 	flag.StringVar(&app.srcTable, "source", "", "Source DynamoDB table")
 	flag.StringVar(&app.dstTable, "destination", "", "Destination DynamoDB table")
 	flag.StringVar(&app.partitionKey, "partition-key", "", "Partition key")
@@ -249,9 +293,18 @@ func main() {
 		"Maximum number of retries (with exponential backoff)",
 	)
 	flag.BoolVar(&app.showFailed, "show-failed", false, "Print each individual key on failed writes")
+	flag.StringVar(&app.output, "output", output.Table, "Output format (table or json)")
 
 	flag.Parse()
 	checkFlags(app)
+	printer, err := output.New(app.output, os.Stdout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
 	srcTable, librarian := connect(app)
-	clone(srcTable, librarian, app)
+	err = printer.Print(clone(srcTable, librarian, app))
+	if err != nil {
+		log.Fatal("Failed to print the summary:", err.Error())
+	}
 }
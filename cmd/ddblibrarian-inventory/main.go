@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/cmd/internal/output"
+)
+
+type appConfig struct {
+	region        string
+	tables        string
+	tag           string
+	metadataTable string
+	managedOnly   bool
+	check         bool
+	maxAge        time.Duration
+	output        string
+}
+
+// the inventory of every table, along with when it was taken, so that the ages of the snapshots can be reported, and
+// why it could not be taken of the tables it failed for
+type inventoryReport struct {
+	Tables []*ddblibrarian.TableInventory `json:"tables"`
+	Failed map[string]string              `json:"failed,omitempty"`
+	Time   time.Time                      `json:"time"`
+}
+
+func (r *inventoryReport) Header() []string {
+	return []string{"TABLE", "MANAGED", "SNAPSHOTS", "OLDEST", "NEWEST", "IDS LEFT", "STALE"}
+}
+
+func (r *inventoryReport) Rows() [][]string {
+	rows := make([][]string, 0, len(r.Tables))
+	for _, t := range r.Tables {
+		rows = append(rows, []string{
+			t.Table,
+			strconv.FormatBool(t.Managed),
+			strconv.Itoa(t.Snapshots),
+			r.age(t.Oldest),
+			r.age(t.Newest),
+			strconv.Itoa(t.IDsLeft),
+			strconv.FormatBool(t.Stale),
+		})
+	}
+
+	return rows
+}
+
+// how long before the report a snapshot was taken, or "-" if unknown
+func (r *inventoryReport) age(created time.Time) string {
+	if created.IsZero() {
+		return "-"
+	}
+
+	return r.Time.Sub(created).Truncate(time.Second).String()
+}
+
+func checkFlags(app *appConfig) {
+	if app.tables != "" && app.tag != "" {
+		log.Fatal("These are mutually exclusive options: tables, tag")
+	}
+
+	if app.tag != "" && !strings.Contains(app.tag, "=") {
+		log.Fatal("The tag must be given as key=value")
+	}
+
+	if app.maxAge < 0 {
+		log.Fatal("The maximum snapshot age cannot be negative")
+	}
+}
+
+// flag the tables whose policy sets no maximum snapshot age as stale according to the one given on the command line,
+// and log every stale table; return the number of stale tables
+func checkStaleness(report *inventoryReport, app *appConfig) int {
+	stale := 0
+	for _, t := range report.Tables {
+		if t.MaxSnapshotAge == 0 {
+			t.Stale = t.IsStale(report.Time, app.maxAge)
+		}
+		if !t.Stale {
+			continue
+		}
+
+		stale++
+		if t.Newest.IsZero() {
+			log.Println("Table", t.Table, "is stale: the age of its newest snapshot is unknown")
+		} else {
+			log.Println("Table", t.Table, "is stale: its newest snapshot was taken", report.age(t.Newest), "ago")
+		}
+	}
+
+	return stale
+}
+
+// return the tables to take the inventory of: the ones given, or all the tables of the region, optionally only those
+// tagged with app.tag
+func listTables(svc *dynamodb.DynamoDB, app *appConfig) []string {
+	if app.tables != "" {
+		return strings.Split(app.tables, ",")
+	}
+
+	tables := make([]string, 0)
+	err := svc.ListTablesPages(&dynamodb.ListTablesInput{}, func(out *dynamodb.ListTablesOutput, last bool) bool {
+		for _, name := range out.TableNames {
+			tables = append(tables, aws.StringValue(name))
+		}
+		return true
+	})
+	if err != nil {
+		log.Fatal("Failed to list tables: ", err.Error())
+	}
+	if app.tag == "" {
+		return tables
+	}
+
+	tagged := make([]string, 0, len(tables))
+	for _, table := range tables {
+		if hasTag(svc, table, app.tag) {
+			tagged = append(tagged, table)
+		}
+	}
+
+	return tagged
+}
+
+// return true if table is tagged with tag, given as key=value
+func hasTag(svc *dynamodb.DynamoDB, table string, tag string) bool {
+	kv := strings.SplitN(tag, "=", 2)
+	out, err := svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err != nil {
+		log.Fatal("Failed to describe table ", table, ": ", err.Error())
+	}
+
+	input := &dynamodb.ListTagsOfResourceInput{ResourceArn: out.Table.TableArn}
+	for {
+		tags, err := svc.ListTagsOfResource(input)
+		if err != nil {
+			log.Fatal("Failed to list the tags of table ", table, ": ", err.Error())
+		}
+		for _, t := range tags.Tags {
+			if aws.StringValue(t.Key) == kv[0] && aws.StringValue(t.Value) == kv[1] {
+				return true
+			}
+		}
+		if tags.NextToken == nil {
+			return false
+		}
+		input.NextToken = tags.NextToken
+	}
+}
+
+func main() {
+	app := &appConfig{}
+
+	flag.StringVar(&app.region, "region", "us-east-1", "AWS region of the tables")
+	flag.StringVar(&app.tables, "tables", "", "Comma-separated tables to take the inventory of (defaults to all)")
+	flag.StringVar(&app.tag, "tag", "", "Only take the inventory of the tables tagged with key=value")
+	flag.StringVar(&app.metadataTable, "metadata-table", "", "Table the metadata is stored in, if not the tables")
+	flag.BoolVar(&app.managedOnly, "managed-only", false, "Only report tables that have snapshots")
+	flag.BoolVar(&app.check, "check", false, "Only report stale tables, and exit with status 1 if there are any")
+	flag.DurationVar(
+		&app.maxAge,
+		"max-snapshot-age",
+		0,
+		"How old the newest snapshot of a table whose policy sets no maximum can get before the table is stale",
+	)
+	flag.StringVar(&app.output, "output", output.Table, "Output format (table or json)")
+
+	flag.Parse()
+	checkFlags(app)
+	printer, err := output.New(app.output, os.Stdout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	ddbSession, err := session.NewSession(&aws.Config{
+		Region:     aws.String(app.region),
+		MaxRetries: aws.Int(3),
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	opts := make([]ddblibrarian.Option, 0)
+	if app.metadataTable != "" {
+		opts = append(opts, ddblibrarian.WithMetadataTable(app.metadataTable))
+	}
+	inventories, err := ddblibrarian.InventoryTables(listTables(dynamodb.New(ddbSession), app), ddbSession, opts...)
+	if err != nil {
+		log.Fatal("Failed to take the inventory: ", err.Error())
+	}
+
+	report := &inventoryReport{
+		Tables: make([]*ddblibrarian.TableInventory, 0, len(inventories)),
+		Failed: make(map[string]string),
+		Time:   time.Now(),
+	}
+	for _, inventory := range inventories {
+		if inventory.Err != nil {
+			log.Println("Failed to take the inventory of table", inventory.Table, ":", inventory.Err.Error())
+			report.Failed[inventory.Table] = inventory.Err.Error()
+			continue
+		}
+		if app.managedOnly && !inventory.Managed {
+			continue
+		}
+		report.Tables = append(report.Tables, inventory)
+	}
+
+	stale := checkStaleness(report, app)
+	if app.check {
+		tables := make([]*ddblibrarian.TableInventory, 0, stale)
+		for _, t := range report.Tables {
+			if t.Stale {
+				tables = append(tables, t)
+			}
+		}
+		report.Tables = tables
+	}
+
+	err = printer.Print(report)
+	if err != nil {
+		log.Fatal("Failed to print the report:", err.Error())
+	}
+
+	if (app.check && stale > 0) || len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
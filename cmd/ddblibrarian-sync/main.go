@@ -0,0 +1,198 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/cmd/internal/output"
+)
+
+// the snapshot name the library resolves to the active snapshot
+const activeSnapshot = "current"
+
+type appConfig struct {
+	srcRegion          string
+	dstRegion          string
+	srcTable           string
+	dstTable           string
+	partitionKey       string
+	partitionKeyType   string
+	rangeKey           string
+	rangeKeyType       string
+	snapshot           string
+	conflictPolicy     string
+	timestampAttribute string
+	dryRun             bool
+	output             string
+}
+
+// summary of a sync, printed once both tables have been reconciled
+type syncSummary struct {
+	Source        string `json:"source"`
+	Destination   string `json:"destination"`
+	Snapshot      string `json:"snapshot"`
+	ToDestination int    `json:"copied_to_destination"`
+	ToSource      int    `json:"copied_to_source"`
+	Conflicts     int64  `json:"conflicts"`
+	DryRun        bool   `json:"dry_run"`
+}
+
+func (s *syncSummary) Header() []string {
+	return []string{"SOURCE", "DESTINATION", "SNAPSHOT", "TO DESTINATION", "TO SOURCE", "CONFLICTS", "DRY RUN"}
+}
+
+func (s *syncSummary) Rows() [][]string {
+	return [][]string{{
+		s.Source,
+		s.Destination,
+		s.Snapshot,
+		strconv.Itoa(s.ToDestination),
+		strconv.Itoa(s.ToSource),
+		strconv.FormatInt(s.Conflicts, 10),
+		strconv.FormatBool(s.DryRun),
+	}}
+}
+
+func checkFlags(app *appConfig) {
+	if app.srcTable == "" || app.dstTable == "" {
+		log.Fatal("Both source and destination tables are mandatory")
+	}
+
+	if app.partitionKey == "" {
+		log.Fatal("The partition key is required")
+	}
+
+	if app.partitionKeyType == "" {
+		log.Fatal("The partition key type (S or N) is required")
+	}
+
+	switch app.conflictPolicy {
+	case sourceWins:
+	case newestWins:
+		if app.timestampAttribute == "" {
+			log.Fatal("The newest-wins policy requires a timestamp attribute")
+		}
+	default:
+		log.Fatal("Unknown conflict policy (expected newest-wins or source-wins): ", app.conflictPolicy)
+	}
+}
+
+func connect(table string, region string, app *appConfig) *ddblibrarian.Library {
+	ddbSession, err := session.NewSession(&aws.Config{
+		Region:     aws.String(region),
+		MaxRetries: aws.Int(3),
+	})
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	library, err := ddblibrarian.New(
+		table,
+		app.partitionKey,
+		app.partitionKeyType,
+		app.rangeKey,
+		app.rangeKeyType,
+		ddbSession,
+	)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return library
+}
+
+// read the items readers see in the snapshot being synced, i.e., including the ones it falls back to, indexed by their
+// primary key
+//
+// There is no way to tell an item that was deleted from one table from one that was never copied to it, so a key
+// missing on either side is always copied over: deletes are resurrected by the next sync.
+func readAll(library *ddblibrarian.Library, table string, app *appConfig) map[string]map[string]*dynamodb.AttributeValue {
+	merged, err := library.ScanMerged(app.snapshot)
+	if err != nil {
+		log.Fatal("Failed to read table ", table, ": ", err.Error())
+	}
+
+	items := make(map[string]map[string]*dynamodb.AttributeValue, len(merged))
+	for _, item := range merged {
+		items[keyOf(item, app.partitionKey, app.rangeKey)] = item
+	}
+
+	return items
+}
+
+func sync(src *ddblibrarian.Library, dst *ddblibrarian.Library, app *appConfig) *syncSummary {
+	p := reconcile(
+		readAll(src, app.srcTable, app),
+		readAll(dst, app.dstTable, app),
+		app.conflictPolicy,
+		app.timestampAttribute,
+	)
+
+	summary := &syncSummary{
+		Source:        app.srcTable,
+		Destination:   app.dstTable,
+		Snapshot:      app.snapshot,
+		ToDestination: len(p.toDestination),
+		ToSource:      len(p.toSource),
+		Conflicts:     p.conflicts,
+		DryRun:        app.dryRun,
+	}
+	if app.dryRun {
+		return summary
+	}
+
+	err := dst.PutItemsToSnapshot(p.toDestination, app.snapshot)
+	if err != nil {
+		log.Fatal("Failed to write to ", app.dstTable, ": ", err.Error())
+	}
+	err = src.PutItemsToSnapshot(p.toSource, app.snapshot)
+	if err != nil {
+		log.Fatal("Failed to write to ", app.srcTable, ": ", err.Error())
+	}
+
+	return summary
+}
+
+func main() {
+	app := &appConfig{}
+
+	flag.StringVar(&app.srcRegion, "source-region", "us-east-1", "AWS region of the source table")
+	flag.StringVar(&app.dstRegion, "destination-region", "us-east-1", "AWS region of the destination table")
+	flag.StringVar(&app.srcTable, "source", "", "Source DynamoDB table")
+	flag.StringVar(&app.dstTable, "destination", "", "Destination DynamoDB table")
+	flag.StringVar(&app.partitionKey, "partition-key", "", "Partition key")
+	flag.StringVar(&app.partitionKeyType, "partition-key-type", "", "Type of partition key (S or N)")
+	flag.StringVar(&app.rangeKey, "range-key", "", "range key")
+	flag.StringVar(&app.rangeKeyType, "range-key-type", "", "Type of range key (S or N)")
+	flag.StringVar(&app.snapshot, "snapshot", activeSnapshot, "Snapshot to sync on both tables (defaults to the active one)")
+	flag.StringVar(&app.conflictPolicy, "conflict", sourceWins, "Conflict policy (newest-wins or source-wins)")
+	flag.StringVar(
+		&app.timestampAttribute,
+		"timestamp-attribute",
+		"",
+		"Attribute holding the last modification time of an item (required by newest-wins)",
+	)
+	flag.BoolVar(&app.dryRun, "dry-run", false, "Show what would be copied without writing anything")
+	flag.StringVar(&app.output, "output", output.Table, "Output format (table or json)")
+
+	flag.Parse()
+	checkFlags(app)
+	printer, err := output.New(app.output, os.Stdout)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	src := connect(app.srcTable, app.srcRegion, app)
+	dst := connect(app.dstTable, app.dstRegion, app)
+	err = printer.Print(sync(src, dst, app))
+	if err != nil {
+		log.Fatal("Failed to print the summary:", err.Error())
+	}
+}
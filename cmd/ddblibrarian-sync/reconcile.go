@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// conflict policies, i.e., what to do with an item that exists on both tables with different values
+const (
+	// keep the item with the most recent timestamp attribute
+	newestWins = "newest-wins"
+	// always keep the item from the source table
+	sourceWins = "source-wins"
+)
+
+// items to write to each table so that both end up with the same data
+type plan struct {
+	toDestination []map[string]*dynamodb.AttributeValue
+	toSource      []map[string]*dynamodb.AttributeValue
+	// number of items that existed on both tables with different values
+	conflicts int64
+}
+
+// return a string that uniquely identifies an item's primary key
+func keyOf(item map[string]*dynamodb.AttributeValue, partitionKey string, rangeKey string) string {
+	format := func(v *dynamodb.AttributeValue) string {
+		if v == nil {
+			return ""
+		}
+		switch {
+		case v.S != nil:
+			return "S:" + *v.S
+		case v.N != nil:
+			return "N:" + *v.N
+		default:
+			return fmt.Sprintf("B:%x", v.B)
+		}
+	}
+
+	key := format(item[partitionKey])
+	if rangeKey != "" {
+		key += "\x00" + format(item[rangeKey])
+	}
+
+	return key
+}
+
+// compare the timestamp attribute of two items: -1 if a is older than b, 0 if they're the same, 1 if a is newer;
+// numbers are compared as such, strings lexicographically (e.g., ISO 8601 dates), and a missing timestamp is
+// older than any other
+func compareTimestamps(a, b map[string]*dynamodb.AttributeValue, attribute string) int {
+	ta, okA := a[attribute]
+	tb, okB := b[attribute]
+	switch {
+	case !okA && !okB:
+		return 0
+	case !okA:
+		return -1
+	case !okB:
+		return 1
+	}
+
+	if ta.N != nil && tb.N != nil {
+		fa, _, errA := big.ParseFloat(*ta.N, 10, 256, big.ToNearestEven)
+		fb, _, errB := big.ParseFloat(*tb.N, 10, 256, big.ToNearestEven)
+		if errA == nil && errB == nil {
+			return fa.Cmp(fb)
+		}
+	}
+
+	sa, sb := aws.StringValue(ta.S), aws.StringValue(tb.S)
+	if ta.N != nil {
+		sa = *ta.N
+	}
+	if tb.N != nil {
+		sb = *tb.N
+	}
+	switch {
+	case sa < sb:
+		return -1
+	case sa > sb:
+		return 1
+	}
+
+	return 0
+}
+
+// reconcile compares the items of both tables (indexed by keyOf) and returns what needs to be written to each one:
+// items missing from one of them are copied from the other, and items that differ are resolved according to policy
+func reconcile(
+	source map[string]map[string]*dynamodb.AttributeValue,
+	destination map[string]map[string]*dynamodb.AttributeValue,
+	policy string,
+	timestampAttribute string,
+) *plan {
+	p := &plan{
+		toDestination: make([]map[string]*dynamodb.AttributeValue, 0),
+		toSource:      make([]map[string]*dynamodb.AttributeValue, 0),
+	}
+
+	for k, srcItem := range source {
+		dstItem, ok := destination[k]
+		if !ok {
+			p.toDestination = append(p.toDestination, srcItem)
+			continue
+		}
+		if reflect.DeepEqual(srcItem, dstItem) {
+			continue
+		}
+
+		p.conflicts++
+		// ties go to the source
+		if policy == newestWins && compareTimestamps(srcItem, dstItem, timestampAttribute) < 0 {
+			p.toSource = append(p.toSource, dstItem)
+		} else {
+			p.toDestination = append(p.toDestination, srcItem)
+		}
+	}
+
+	for k, dstItem := range destination {
+		if _, ok := source[k]; !ok {
+			p.toSource = append(p.toSource, dstItem)
+		}
+	}
+
+	return p
+}
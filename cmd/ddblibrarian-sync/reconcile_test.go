@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func item(key string, value string, updated string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id":      {S: aws.String(key)},
+		"value":   {S: aws.String(value)},
+		"updated": {N: aws.String(updated)},
+	}
+}
+
+func index(items ...map[string]*dynamodb.AttributeValue) map[string]map[string]*dynamodb.AttributeValue {
+	m := make(map[string]map[string]*dynamodb.AttributeValue, 0)
+	for _, i := range items {
+		m[keyOf(i, "id", "")] = i
+	}
+	return m
+}
+
+func TestReconcile(t *testing.T) {
+	source := index(
+		item("same", "a", "1"),
+		item("only-source", "a", "1"),
+		item("newer-on-source", "b", "20"),
+		item("newer-on-destination", "a", "3"),
+	)
+	destination := index(
+		item("same", "a", "1"),
+		item("only-destination", "a", "1"),
+		item("newer-on-source", "a", "3"),
+		item("newer-on-destination", "b", "20"),
+	)
+
+	p := reconcile(source, destination, newestWins, "updated")
+	if p.conflicts != 2 {
+		t.Error("expected 2 conflicts, got", p.conflicts)
+	}
+	if len(p.toDestination) != 2 || len(p.toSource) != 2 {
+		t.Error("expected 2 items to each table, got", len(p.toDestination), len(p.toSource))
+	}
+	for _, i := range p.toSource {
+		if *i["id"].S == "newer-on-source" {
+			t.Error("expected the newest item to win")
+		}
+	}
+
+	p = reconcile(source, destination, sourceWins, "")
+	if len(p.toDestination) != 3 || len(p.toSource) != 1 {
+		t.Error("expected 3 items to the destination and 1 to the source, got",
+			len(p.toDestination), len(p.toSource))
+	}
+}
+
+func TestCompareTimestamps(t *testing.T) {
+	cases := []struct {
+		a, b     *dynamodb.AttributeValue
+		expected int
+	}{
+		{&dynamodb.AttributeValue{N: aws.String("9")}, &dynamodb.AttributeValue{N: aws.String("10")}, -1},
+		{&dynamodb.AttributeValue{N: aws.String("1e3")}, &dynamodb.AttributeValue{N: aws.String("1000")}, 0},
+		{&dynamodb.AttributeValue{S: aws.String("2017-10-02")}, &dynamodb.AttributeValue{S: aws.String("2017-10-01")}, 1},
+		{nil, &dynamodb.AttributeValue{N: aws.String("1")}, -1},
+	}
+
+	for _, c := range cases {
+		a := map[string]*dynamodb.AttributeValue{}
+		b := map[string]*dynamodb.AttributeValue{}
+		if c.a != nil {
+			a["t"] = c.a
+		}
+		if c.b != nil {
+			b["t"] = c.b
+		}
+		if r := compareTimestamps(a, b, "t"); r != c.expected {
+			t.Error("expected", c.expected, "got", r, "for", c.a, c.b)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Package output renders the results of the command line tools either as human readable tables or as JSON, so that
+// they can be used from scripts and dashboards without scraping free-form text.
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// Table aligns the results in columns, one row per line
+	Table = "table"
+	// JSON encodes the results as a single JSON document
+	JSON = "json"
+)
+
+// Tabular is implemented by results that can be rendered as a table.
+type Tabular interface {
+	// Header returns the name of each column; may be nil
+	Header() []string
+	// Rows returns the cells of each row, in the same order as Header
+	Rows() [][]string
+}
+
+// Printer writes results to w in one of the supported formats.
+type Printer struct {
+	format string
+	w      io.Writer
+}
+
+// New returns a Printer for format, which must be either Table or JSON.
+func New(format string, w io.Writer) (*Printer, error) {
+	switch format {
+	case Table, JSON:
+		return &Printer{format: format, w: w}, nil
+	default:
+		return nil, errors.New("unsupported output format (expected " + Table + " or " + JSON + "): " + format)
+	}
+}
+
+// Print writes v to the Printer's writer. As JSON, v is encoded as is; as a table, v must implement Tabular (anything
+// else is printed with its default format).
+func (p *Printer) Print(v interface{}) error {
+	if p.format == JSON {
+		encoder := json.NewEncoder(p.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	t, ok := v.(Tabular)
+	if !ok {
+		_, err := fmt.Fprintln(p.w, v)
+		return err
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	if header := t.Header(); len(header) > 0 {
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+	}
+	for _, row := range t.Rows() {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// FormatKey formats the primary key of an item as "name=value[, name=value]", with the attributes sorted by name.
+func FormatKey(key map[string]*dynamodb.AttributeValue) string {
+	names := make([]string, 0, len(key))
+	for name := range key {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		v := key[name]
+		switch {
+		case v.S != nil:
+			parts = append(parts, name+"="+*v.S)
+		case v.N != nil:
+			parts = append(parts, name+"="+*v.N)
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%x", name, v.B))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
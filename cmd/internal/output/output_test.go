@@ -0,0 +1,62 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+type report struct {
+	Table string `json:"table"`
+	Items int    `json:"items"`
+}
+
+func (r report) Header() []string {
+	return []string{"TABLE", "ITEMS"}
+}
+
+func (r report) Rows() [][]string {
+	return [][]string{{r.Table, "42"}}
+}
+
+func TestPrinter(t *testing.T) {
+	r := report{Table: "movies", Items: 42}
+
+	cases := map[string]string{
+		Table: "TABLE   ITEMS\nmovies  42\n",
+		JSON:  "{\n  \"table\": \"movies\",\n  \"items\": 42\n}\n",
+	}
+	for format, expected := range cases {
+		var buf bytes.Buffer
+		p, err := New(format, &buf)
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		err = p.Print(r)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if buf.String() != expected {
+			t.Errorf("format %s: expected %q, got %q", format, expected, buf.String())
+		}
+	}
+
+	_, err := New("yaml", &bytes.Buffer{})
+	if err == nil {
+		t.Error("expected an error for an unsupported format")
+	}
+}
+
+func TestFormatKey(t *testing.T) {
+	key := map[string]*dynamodb.AttributeValue{
+		"year":  {N: aws.String("1999")},
+		"title": {S: aws.String("The Matrix")},
+	}
+
+	expected := "title=The Matrix, year=1999"
+	if FormatKey(key) != expected {
+		t.Error("expected", expected, "got", FormatKey(key))
+	}
+}
@@ -0,0 +1,238 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/klauspost/compress/zstd"
+)
+
+// attribute, added to items with compressed attributes, that maps the name of each of them to how it was compressed
+// and what it was compressed to: "<codec>:<original type>:<digest>" (see compressionDigest), e.g., "gzip:S:4b6f..."
+const compressionAttribute = "ddblibrarian_compressed"
+
+// CompressionCodec is how WithCompression compresses attributes (see WithCompressionCodec).
+type CompressionCodec string
+
+const (
+	// CompressGzip compresses attributes with gzip, the default
+	CompressGzip CompressionCodec = "gzip"
+	// CompressZstd compresses attributes with Zstandard, which is faster than gzip and usually compresses better
+	CompressZstd CompressionCodec = "zstd"
+)
+
+// a Zstandard encoder and decoder, created the first time they are needed and shared by every Library: both are
+// safe for concurrent use
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// compress the designated attributes of an item (see WithCompression) that are at least as large as the threshold,
+// returning a function that restores the item to its original state
+func (c *Library) compressItem(item map[string]*dynamodb.AttributeValue) func() {
+	if len(c.compressedAttributes) == 0 {
+		return func() {}
+	}
+
+	marker := make(map[string]*dynamodb.AttributeValue, 0)
+	originals := make(map[string]*dynamodb.AttributeValue, 0)
+	for name := range c.compressedAttributes {
+		v, ok := item[name]
+		if !ok {
+			continue
+		}
+
+		var raw []byte
+		var dataType string
+		switch {
+		case v.S != nil:
+			raw, dataType = []byte(*v.S), "S"
+		case v.B != nil:
+			raw, dataType = v.B, "B"
+		default:
+			continue
+		}
+		if len(raw) < c.compressionThreshold {
+			continue
+		}
+
+		// not worth it if it does not get any smaller
+		compressed, err := compressBytes(c.compressionCodec, raw)
+		if err != nil || len(compressed) >= len(raw) {
+			continue
+		}
+
+		originals[name] = v
+		item[name] = &dynamodb.AttributeValue{B: compressed}
+		marker[name] = &dynamodb.AttributeValue{
+			S: aws.String(string(c.compressionCodec) + ":" + dataType + ":" + compressionDigest(compressed)),
+		}
+	}
+	if len(marker) == 0 {
+		return func() {}
+	}
+
+	originalMarker, ok := item[compressionAttribute]
+	item[compressionAttribute] = &dynamodb.AttributeValue{M: marker}
+
+	return func() {
+		for name, v := range originals {
+			item[name] = v
+		}
+		if ok {
+			item[compressionAttribute] = originalMarker
+		} else {
+			delete(item, compressionAttribute)
+		}
+	}
+}
+
+// return what the compression marker records of a compressed value, for an attribute overwritten since it was
+// compressed (e.g., by UpdateItem, which neither compresses nor updates the marker) not to be mistaken for it
+func compressionDigest(compressed []byte) string {
+	sum := sha256.Sum256(compressed)
+	return hex.EncodeToString(sum[:8])
+}
+
+// decompress the attributes listed by the compression marker of an item read from the table, if it has one;
+// attributes that have since been overwritten are left as they are
+func decompressItem(item map[string]*dynamodb.AttributeValue) error {
+	marker, ok := item[compressionAttribute]
+	if !ok {
+		return nil
+	}
+	delete(item, compressionAttribute)
+
+	for name, codec := range marker.M {
+		parts := strings.SplitN(aws.StringValue(codec.S), ":", 3)
+		if len(parts) != 3 {
+			return errors.New("malformed compression marker for attribute " + name + ": " + aws.StringValue(codec.S))
+		}
+
+		v, ok := item[name]
+		if !ok || v.B == nil || compressionDigest(v.B) != parts[2] {
+			continue
+		}
+
+		raw, err := decompressBytes(CompressionCodec(parts[0]), v.B)
+		if err != nil {
+			return wrapError("failed to decompress attribute "+name, err)
+		}
+
+		if parts[1] == "S" {
+			item[name] = &dynamodb.AttributeValue{S: aws.String(string(raw))}
+		} else {
+			item[name] = &dynamodb.AttributeValue{B: raw}
+		}
+	}
+
+	return nil
+}
+
+// return an error if codec is not one of the supported compression codecs
+func checkCompressionCodec(codec CompressionCodec) error {
+	switch codec {
+	case CompressGzip, CompressZstd:
+		return nil
+	}
+
+	return errors.New("unsupported compression codec: " + string(codec))
+}
+
+func compressBytes(codec CompressionCodec, raw []byte) ([]byte, error) {
+	switch codec {
+	case CompressGzip:
+		return gzipBytes(raw)
+	case CompressZstd:
+		err := initZstd()
+		if err != nil {
+			return nil, err
+		}
+		return zstdEncoder.EncodeAll(raw, nil), nil
+	}
+
+	return nil, checkCompressionCodec(codec)
+}
+
+func decompressBytes(codec CompressionCodec, compressed []byte) ([]byte, error) {
+	switch codec {
+	case CompressGzip:
+		return gunzipBytes(compressed)
+	case CompressZstd:
+		err := initZstd()
+		if err != nil {
+			return nil, err
+		}
+		return zstdDecoder.DecodeAll(compressed, nil)
+	}
+
+	return nil, checkCompressionCodec(codec)
+}
+
+func initZstd() error {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr == nil {
+			zstdDecoder, zstdErr = zstd.NewReader(nil)
+		}
+	})
+
+	return zstdErr
+}
+
+func gzipBytes(raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func gunzipBytes(compressed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
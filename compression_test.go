@@ -0,0 +1,154 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_compressItem(t *testing.T) {
+	for _, codec := range []CompressionCodec{CompressGzip, CompressZstd} {
+		library := &Library{
+			compressionThreshold: 100,
+			compressedAttributes: map[string]bool{"plot": true, "poster": true, "title": true},
+			compressionCodec:     codec,
+		}
+		item := map[string]*dynamodb.AttributeValue{
+			"year":   {N: aws.String("1999")},
+			"title":  {S: aws.String("The Matrix")},
+			"plot":   {S: aws.String(strings.Repeat("Neo takes the red pill. ", 100))},
+			"poster": {B: []byte(strings.Repeat("\x89PNG", 100))},
+		}
+		original := make(map[string]*dynamodb.AttributeValue, len(item))
+		for k, v := range item {
+			original[k] = v
+		}
+
+		restore := library.compressItem(item)
+		// small and undesignated attributes are left alone
+		if item["title"] != original["title"] || item["year"] != original["year"] {
+			t.Error("expected title and year to be left alone, got", item["title"], item["year"])
+		}
+		for _, name := range []string{"plot", "poster"} {
+			if item[name].B == nil || len(item[name].B) >= 2400 {
+				t.Error("expected", name, "to be compressed with", codec, "got", len(item[name].B), "bytes")
+			}
+		}
+		if len(item[compressionAttribute].M) != 2 {
+			t.Error("expected 2 compressed attributes in the marker, got", item[compressionAttribute])
+		}
+
+		// read it back
+		read := make(map[string]*dynamodb.AttributeValue, len(item))
+		for k, v := range item {
+			read[k] = v
+		}
+		err := decompressItem(read)
+		if err != nil || !reflect.DeepEqual(read, original) {
+			t.Error("expected", original, "got", read)
+		}
+
+		restore()
+		if !reflect.DeepEqual(item, original) {
+			t.Error("expected the item to be restored, got", item)
+		}
+	}
+}
+
+func TestDecompressItem_overwritten(t *testing.T) {
+	// e.g., an UpdateItem replaced the compressed values after they were written, one of them with another value
+	// compressed with gzip
+	compressed, err := gzipBytes([]byte("Neo takes the blue pill"))
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	item := map[string]*dynamodb.AttributeValue{
+		"plot":   {S: aws.String("short")},
+		"poster": {B: compressed},
+		compressionAttribute: {M: map[string]*dynamodb.AttributeValue{
+			"plot":   {S: aws.String("gzip:S:" + compressionDigest([]byte("the original plot")))},
+			"poster": {S: aws.String("gzip:B:" + compressionDigest([]byte("the original poster")))},
+		}},
+	}
+
+	err = decompressItem(item)
+	if err != nil || *item["plot"].S != "short" || !reflect.DeepEqual(item["poster"].B, compressed) {
+		t.Error("expected overwritten values to be left alone, got", item, err)
+	}
+	if _, ok := item[compressionAttribute]; ok {
+		t.Error("expected the marker to be removed")
+	}
+
+	// a value that is still the one compressed must decompress
+	corrupt := []byte("not gzip")
+	item = map[string]*dynamodb.AttributeValue{
+		"poster": {B: corrupt},
+		compressionAttribute: {M: map[string]*dynamodb.AttributeValue{
+			"poster": {S: aws.String("gzip:B:" + compressionDigest(corrupt))},
+		}},
+	}
+	if err := decompressItem(item); err == nil {
+		t.Error("expected an error for a value that does not decompress")
+	}
+	item = map[string]*dynamodb.AttributeValue{
+		"poster": {B: corrupt},
+		compressionAttribute: {M: map[string]*dynamodb.AttributeValue{
+			"poster": {S: aws.String("gzip:B")},
+		}},
+	}
+	if err := decompressItem(item); err == nil {
+		t.Error("expected an error for a malformed marker")
+	}
+}
+
+func TestLibrary_Compression(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		compressing := newClient(schema, t, WithCompression(100, valueField))
+
+		item := getAttributeValueForItem(schema, strings.Repeat("x", 1000))
+		_, err := compressing.PutItem(&dynamodb.PutItemInput{TableName: aws.String(getTableName(schema)), Item: item})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if *item[valueField].S != strings.Repeat("x", 1000) {
+			t.Error("expected the caller's item to be left untouched")
+		}
+
+		// any client decompresses it
+		out, err := library.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if !reflect.DeepEqual(out.Item, item) {
+			t.Error("expected", item, "got", out.Item)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"sync"
+)
+
+// maximum number of requests made in parallel by operations that would otherwise make them one at a time, e.g.,
+// probing snapshots (so as not to read more than needed) or writing batches
+func (c *Library) concurrency() int {
+	if c.maxConcurrency < 1 {
+		return 1
+	}
+
+	return c.maxConcurrency
+}
+
+// maximum number of goroutines working on a bulk operation with n independent parts, e.g., the segments of a scan;
+// all of them unless configured otherwise
+func (c *Library) bulkConcurrency(n int) int {
+	if c.maxConcurrency < 1 || c.maxConcurrency > n {
+		return n
+	}
+
+	return c.maxConcurrency
+}
+
+// call fn for 0 <= i < n, up to concurrency() at a time, and return the first i (in order) for which fn found
+// what it was looking for, or -1 if none did; an error stops the probe iff no earlier i found something
+func (c *Library) probe(n int, fn func(i int) (bool, error)) (int, error) {
+	window := c.concurrency()
+
+	found := make([]bool, n)
+	errs := make([]error, n)
+	for start := 0; start < n; start += window {
+		end := start + window
+		if end > n {
+			end = n
+		}
+
+		if end-start == 1 {
+			found[start], errs[start] = fn(start)
+		} else {
+			var wg sync.WaitGroup
+			for i := start; i < end; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					found[i], errs[i] = fn(i)
+				}(i)
+			}
+			wg.Wait()
+		}
+
+		for i := start; i < end; i++ {
+			if errs[i] != nil {
+				return -1, errs[i]
+			}
+			if found[i] {
+				return i, nil
+			}
+		}
+	}
+
+	return -1, nil
+}
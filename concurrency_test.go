@@ -0,0 +1,99 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestLibrary_probe(t *testing.T) {
+	for _, maxConcurrency := range []int{0, 1, 3, 10} {
+		c := &Library{maxConcurrency: maxConcurrency}
+
+		var mutex sync.Mutex
+		running, peak := 0, 0
+		found, err := c.probe(7, func(i int) (bool, error) {
+			mutex.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			mutex.Unlock()
+			defer func() {
+				mutex.Lock()
+				running--
+				mutex.Unlock()
+			}()
+
+			// the earliest match wins, no matter which one finishes first
+			return i == 2 || i == 5, nil
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if found != 2 {
+			t.Error("expected index 2, got", found)
+		}
+		if peak > c.concurrency() {
+			t.Error("expected at most", c.concurrency(), "probes at a time, got", peak)
+		}
+	}
+
+	c := &Library{maxConcurrency: 4}
+	found, err := c.probe(3, func(i int) (bool, error) { return false, nil })
+	if err != nil || found != -1 {
+		t.Error("expected nothing to be found, got", found, err)
+	}
+
+	// errors after a match don't matter
+	failed := errors.New("failed")
+	found, err = c.probe(3, func(i int) (bool, error) {
+		if i == 0 {
+			return true, nil
+		}
+		return false, failed
+	})
+	if err != nil || found != 0 {
+		t.Error("expected index 0, got", found, err)
+	}
+	_, err = c.probe(3, func(i int) (bool, error) { return i == 2, failed })
+	if err != failed {
+		t.Error("expected", failed, "got", err)
+	}
+}
+
+func TestLibrary_bulkConcurrency(t *testing.T) {
+	tests := []struct {
+		maxConcurrency, n, expected int
+	}{
+		{0, 8, 8},
+		{2, 8, 2},
+		{16, 8, 8},
+	}
+	for _, test := range tests {
+		c := &Library{maxConcurrency: test.maxConcurrency}
+		if got := c.bulkConcurrency(test.n); got != test.expected {
+			t.Error("expected", test.expected, "got", got)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ContextStorage is the context-aware counterpart of Storage. Storage backends that implement it, like
+// *dynamodb.DynamoDB, get the context passed to the Library's *WithContext methods with every request, so that
+// deadlines and cancellation apply to the requests themselves; with any other backend, the context is only checked
+// before each request is made.
+type ContextStorage interface {
+	GetItemWithContext(aws.Context, *dynamodb.GetItemInput, ...request.Option) (*dynamodb.GetItemOutput, error)
+	PutItemWithContext(aws.Context, *dynamodb.PutItemInput, ...request.Option) (*dynamodb.PutItemOutput, error)
+	UpdateItemWithContext(
+		aws.Context,
+		*dynamodb.UpdateItemInput,
+		...request.Option,
+	) (*dynamodb.UpdateItemOutput, error)
+	DeleteItemWithContext(
+		aws.Context,
+		*dynamodb.DeleteItemInput,
+		...request.Option,
+	) (*dynamodb.DeleteItemOutput, error)
+	BatchGetItemWithContext(
+		aws.Context,
+		*dynamodb.BatchGetItemInput,
+		...request.Option,
+	) (*dynamodb.BatchGetItemOutput, error)
+	BatchWriteItemWithContext(
+		aws.Context,
+		*dynamodb.BatchWriteItemInput,
+		...request.Option,
+	) (*dynamodb.BatchWriteItemOutput, error)
+	ScanWithContext(aws.Context, *dynamodb.ScanInput, ...request.Option) (*dynamodb.ScanOutput, error)
+	QueryWithContext(aws.Context, *dynamodb.QueryInput, ...request.Option) (*dynamodb.QueryOutput, error)
+	TransactWriteItemsWithContext(
+		aws.Context,
+		*dynamodb.TransactWriteItemsInput,
+		...request.Option,
+	) (*dynamodb.TransactWriteItemsOutput, error)
+	DescribeTableWithContext(
+		aws.Context,
+		*dynamodb.DescribeTableInput,
+		...request.Option,
+	) (*dynamodb.DescribeTableOutput, error)
+	UpdateTableWithContext(
+		aws.Context,
+		*dynamodb.UpdateTableInput,
+		...request.Option,
+	) (*dynamodb.UpdateTableOutput, error)
+}
+
+var _ ContextStorage = (*dynamodb.DynamoDB)(nil)
+
+// contextStorage makes every request to the underlying Storage with the given context, bounded by timeout (if not
+// zero)
+type contextStorage struct {
+	svc     Storage
+	ctx     aws.Context
+	timeout time.Duration
+}
+
+// return the Library's storage, making every request with ctx, within the operation timeout (see WithTimeouts)
+func (c *Library) storage(ctx aws.Context) Storage {
+	return c.regionStorage(ctx, c.timeouts.Operation)
+}
+
+// return the Library's storage for requests on the table's metadata, made with ctx within the metadata timeout; they
+// never fail over to the secondary region (see WithReadFailover), since writes are routed by the metadata
+func (c *Library) metaStorage(ctx aws.Context) Storage {
+	return &contextStorage{svc: c.svc, ctx: ctx, timeout: c.timeouts.Metadata}
+}
+
+// return a context bounded by the bulk timeout (see WithTimeouts), if there is one, and the function to release it
+func (c *Library) bulkContext(ctx aws.Context) (aws.Context, context.CancelFunc) {
+	if c.timeouts.Bulk == 0 {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, c.timeouts.Bulk)
+}
+
+// return the underlying storage if it supports contexts, along with the context to make the next request with and
+// the function to release it or, if it doesn't, whether ctx is already done
+func (s *contextStorage) withContext() (ContextStorage, aws.Context, context.CancelFunc, error) {
+	svc, ok := s.svc.(ContextStorage)
+	if !ok {
+		return nil, s.ctx, func() {}, s.ctx.Err()
+	}
+	if s.timeout == 0 {
+		return svc, s.ctx, func() {}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.timeout)
+	return svc, ctx, cancel, nil
+}
+
+func (s *contextStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.GetItemWithContext(ctx, input)
+	}
+
+	return s.svc.GetItem(input)
+}
+
+func (s *contextStorage) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.PutItemWithContext(ctx, input)
+	}
+
+	return s.svc.PutItem(input)
+}
+
+func (s *contextStorage) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.UpdateItemWithContext(ctx, input)
+	}
+
+	return s.svc.UpdateItem(input)
+}
+
+func (s *contextStorage) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.DeleteItemWithContext(ctx, input)
+	}
+
+	return s.svc.DeleteItem(input)
+}
+
+func (s *contextStorage) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.BatchGetItemWithContext(ctx, input)
+	}
+
+	return s.svc.BatchGetItem(input)
+}
+
+func (s *contextStorage) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.BatchWriteItemWithContext(ctx, input)
+	}
+
+	return s.svc.BatchWriteItem(input)
+}
+
+func (s *contextStorage) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.ScanWithContext(ctx, input)
+	}
+
+	return s.svc.Scan(input)
+}
+
+func (s *contextStorage) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.QueryWithContext(ctx, input)
+	}
+
+	return s.svc.Query(input)
+}
+
+func (s *contextStorage) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.TransactWriteItemsWithContext(ctx, input)
+	}
+
+	return s.svc.TransactWriteItems(input)
+}
+
+func (s *contextStorage) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.DescribeTableWithContext(ctx, input)
+	}
+
+	return s.svc.DescribeTable(input)
+}
+
+func (s *contextStorage) UpdateTable(input *dynamodb.UpdateTableInput) (*dynamodb.UpdateTableOutput, error) {
+	svc, ctx, cancel, err := s.withContext()
+	if err != nil {
+		return nil, err
+	}
+	defer cancel()
+	if svc != nil {
+		return svc.UpdateTableWithContext(ctx, input)
+	}
+
+	return s.svc.UpdateTable(input)
+}
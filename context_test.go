@@ -0,0 +1,127 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// a Storage whose reads never complete, until their context is done
+type hangingStorage struct {
+	*dynamodb.DynamoDB
+}
+
+func (s *hangingStorage) GetItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	opts ...request.Option,
+) (*dynamodb.GetItemOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestContextStorage(t *testing.T) {
+	// a Storage that does not support contexts only gets requests while the context is not done
+	storage := &countingStorage{}
+	library := &Library{svc: storage}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := library.storage(ctx).GetItem(&dynamodb.GetItemInput{})
+	if err != context.Canceled {
+		t.Error("expected", context.Canceled, "got", err)
+	}
+	_, err = library.storage(ctx).PutItem(&dynamodb.PutItemInput{})
+	if err != context.Canceled {
+		t.Error("expected", context.Canceled, "got", err)
+	}
+	if storage.reads != 0 || storage.writes != 0 {
+		t.Error("expected no requests, got", storage.reads, storage.writes)
+	}
+}
+
+func TestLibrary_WithTimeouts(t *testing.T) {
+	library := &Library{svc: &hangingStorage{}}
+	WithTimeouts(Timeouts{Metadata: 10 * time.Millisecond, Operation: 20 * time.Millisecond})(library)
+
+	for _, svc := range []Storage{library.metaStorage(context.Background()), library.storage(context.Background())} {
+		_, err := svc.GetItem(&dynamodb.GetItemInput{})
+		if err != context.DeadlineExceeded {
+			t.Error("expected", context.DeadlineExceeded, "got", err)
+		}
+	}
+
+	// a bulk operation as a whole
+	ctx, cancel := library.bulkContext(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("expected no deadline without a bulk timeout")
+	}
+	cancel()
+	library.timeouts.Bulk = time.Minute
+	ctx, cancel = library.bulkContext(context.Background())
+	defer cancel()
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Error("expected a deadline within a minute, got", deadline)
+	}
+}
+
+func TestLibrary_WithContext(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		_, err := library.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+			TableName: table,
+			Item:      getAttributeValueForItem(schema, "context"),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		// nothing is read, from any snapshot, once the context is done
+		library.Snapshot("1")
+		cancel()
+		_, err = library.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+			TableName: table,
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err == nil {
+			t.Error("expected an error with a canceled context")
+		}
+		err = library.SnapshotWithContext(ctx, "2")
+		if err == nil {
+			t.Error("expected an error with a canceled context")
+		}
+		snapshots, _ := library.ListSnapshots()
+		if len(snapshots) != 1 {
+			t.Error("expected a single snapshot, got", snapshots)
+		}
+
+		teardown(schema, t)
+	}
+}
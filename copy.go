@@ -0,0 +1,163 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// CopySnapshotTo writes all items of snapshot to dst, which manages another table, possibly on another account or
+// region: items are written to the active snapshot of dst, as PutItems would, or to the one named with
+// CopyIntoSnapshot. Items that already exist there are replaced. As with ScanFromSnapshot, an empty snapshot means
+// items from all snapshots.
+//
+// The snapshot is read as with ScanAllFromSnapshotFunc, one page at a time, possibly in parallel (see BulkOptions),
+// and every page is written to dst before the next one is read. The checkpoints passed to opts.OnProgress can thus be
+// used to resume a copy that was interrupted, with opts.Resume. opts.ReadLimiter limits the capacity consumed on the
+// source table, and opts.WriteLimiter the one consumed on dst; opts.Progress is told the capacity consumed on both.
+//
+// It returns the number of items written.
+//
+// Cost: a full table scan (unless the snapshot index is enabled) + 1WU per item on dst
+func (c *Library) CopySnapshotTo(
+	dst *Library,
+	snapshot string,
+	opts *BulkOptions,
+	copyOpts ...CopyOption,
+) (int64, error) {
+	return c.CopySnapshotToWithContext(aws.BackgroundContext(), dst, snapshot, opts, copyOpts...)
+}
+
+// CopySnapshotToWithContext is the same as CopySnapshotTo with the addition of the ability to pass a context, which is
+// passed on to every request made to both tables.
+func (c *Library) CopySnapshotToWithContext(
+	ctx aws.Context,
+	dst *Library,
+	snapshot string,
+	opts *BulkOptions,
+	copyOpts ...CopyOption,
+) (int64, error) {
+	var count int64
+
+	err := c.runJob(ctx, "CopySnapshotTo", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		count, err = c.copySnapshotTo(ctx, dst, snapshot, opts, newCopyOptions(copyOpts), reporter)
+		return err
+	})
+
+	return count, err
+}
+
+func (c *Library) copySnapshotTo(
+	ctx aws.Context,
+	dst *Library,
+	snapshot string,
+	opts *BulkOptions,
+	options *copyOptions,
+	reporter *operationReporter,
+) (int64, error) {
+	var count int64
+
+	if dst == nil {
+		return 0, errors.New("no library to copy to")
+	}
+	dstID, err := dst.copyDestinationID(ctx, options)
+	if err != nil {
+		return 0, err
+	}
+
+	// keep track of the checkpoints, without changing the caller's options
+	original := opts
+	var reported BulkOptions
+	if original != nil {
+		reported = *original
+	}
+	reported.OnProgress = func(progress *ScanProgress) error {
+		reporter.checkpoint(progress)
+		return original.onProgress(progress)
+	}
+	// the progress of the scan, along with the capacity consumed writing to dst
+	var written float64
+	if fn := original.progressFunc(); fn != nil {
+		reported.Progress = func(progress Progress) {
+			progress.ConsumedCapacity += written
+			fn(progress)
+		}
+	}
+	opts = &reported
+
+	limiter := opts.writeLimiter()
+	err = c.ScanAllFromSnapshotFuncWithContext(
+		ctx,
+		&dynamodb.ScanInput{TableName: &c.tableName},
+		snapshot,
+		opts,
+		func(items []map[string]*dynamodb.AttributeValue) error {
+			if len(items) == 0 {
+				return nil
+			}
+			reporter.read(int64(len(items)))
+
+			limiter.Wait()
+			consumed, err := dst.putItemsWithSnapshotID(ctx, "CopySnapshotTo", items, dstID)
+			limiter.Consume(consumed)
+			written += consumed
+			reporter.written(len(items), consumed, err)
+			if err != nil {
+				return wrapError("failed to write to "+dst.tableName, err)
+			}
+			count += int64(len(items))
+			return nil
+		},
+	)
+
+	return count, err
+}
+
+// return the ID of the snapshot a copy writes to, taking it first if CopyIntoSnapshot names one that does not exist
+func (c *Library) copyDestinationID(ctx aws.Context, options *copyOptions) (string, error) {
+	meta, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	if options.snapshot == "" {
+		return meta.getWritableSnapshotID("CopySnapshotTo", snapshotCurrent)
+	}
+
+	if _, err := meta.getSnapshotID(options.snapshot); err != nil {
+		if _, ok := err.(*SnapshotNotFoundError); !ok {
+			return "", err
+		}
+		err = c.SnapshotWithContext(ctx, options.snapshot, options.snapshotOptions...)
+		if err != nil {
+			return "", err
+		}
+		meta, err = c.fetchMeta(ctx, true)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return meta.getWritableSnapshotID("CopySnapshotTo", options.snapshot)
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/marcoalmeida/ddblibrarian/ratelimit"
+)
+
+func TestLibrary_CopySnapshotTo(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		nItems := 10
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		putItems(library, schema, nItems, t)
+
+		// any other Library does, even one managing the same table
+		dst, err := library.WithTable(
+			getTableName(schema), partitionKey, partitionKeyType[schema], rangeKey[schema], rangeKeyType[schema])
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+
+		var checkpoints int
+		opts := &BulkOptions{
+			Segments:     2,
+			WriteLimiter: ratelimit.New(1000),
+			OnProgress: func(*ScanProgress) error {
+				checkpoints++
+				return nil
+			},
+		}
+		n, err := library.CopySnapshotTo(dst, "snap", opts, CopyIntoSnapshot("copy"))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if n != int64(nItems) || checkpoints == 0 {
+			t.Error("expected", nItems, "items and some checkpoints, got", n, checkpoints)
+		}
+		active, _ := dst.ActiveSnapshotName()
+		if active != "copy" {
+			t.Error("expected the new snapshot to be the active one, got", active)
+		}
+		copied, _ := dst.ScanAllFromSnapshot(
+			&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "copy", nil)
+		if len(copied) != nItems {
+			t.Error("expected", nItems, "items on the copy, got", len(copied))
+		}
+
+		// the snapshot is only taken once, so that an interrupted copy can be resumed into it
+		n, err = library.CopySnapshotTo(dst, "snap", nil, CopyIntoSnapshot("copy"))
+		if err != nil || n != int64(nItems) {
+			t.Error("expected", nItems, "items and no errors, got", n, err)
+		}
+		snapshots, _ := dst.ListSnapshots()
+		if len(snapshots) != 2 {
+			t.Error("expected 2 snapshots, got", snapshots)
+		}
+
+		// stopping at a checkpoint
+		stop := errors.New("stop")
+		_, err = library.CopySnapshotTo(dst, "snap", &BulkOptions{
+			OnProgress: func(*ScanProgress) error {
+				return stop
+			},
+		})
+		if !errors.Is(err, stop) {
+			t.Error("expected the copy to stop, got", err)
+		}
+
+		_, err = library.CopySnapshotTo(nil, "snap", nil)
+		if err == nil {
+			t.Error("expected an error without a destination")
+		}
+		_, err = library.CopySnapshotTo(dst, "nope", nil)
+		if err == nil {
+			t.Error("expected an error for a missing snapshot")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -28,8 +28,8 @@ package ddblibrarian
 import (
 	"errors"
 	"fmt"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/client"
@@ -40,19 +40,103 @@ const snapshotDelimiter = "."
 
 // Represents one instance of ddblibrarian for a given DynamoDB table.
 type Library struct {
-	svc              *dynamodb.DynamoDB
+	svc              Storage
 	tableName        string
 	partitionKey     string
 	partitionKeyType string
 	rangeKey         string
 	rangeKeyType     string
-	currentSnapshot  string
+	// the key encoding of the table and the one it is being migrated to, as last read from the metadata, which may
+	// happen on another goroutine (see WithMetadataPolling); guarded by keyMutex (see keyEncodings)
+	keyEncoding  string
+	keyMigration string
+	keyMutex     sync.RWMutex
+	awsConfig    []*aws.Config
+	// used to create the Library, kept to derive other instances from it (see WithTable)
+	provider client.ConfigProvider
+	opts     []Option
+	// maintain a GSI over the snapshot ID of each item (see index.go)
+	snapshotIndex bool
+	// whether the snapshot index is ready to be used, and when it was last found not to be (see ensureSnapshotIndex)
+	snapshotIndexMutex   sync.Mutex
+	snapshotIndexReady   bool
+	snapshotIndexChecked time.Time
+	currentSnapshot      string
 	// flag a Browse action;
 	// we can't use currentSnapshot="" to flag it because an empty string
 	// denotes pre-snapshot data, which we may want to roll back to
 	browsing bool
-	// cache
-	// cache.set(key, value), cache.get(key), cache.invalidate(key), cache.ttl(X)
+	// when the browsing session expires (see BrowseFor); the zero time means never
+	browseUntil time.Time
+	// browsing states saved by PushBrowse, the most recent last
+	browseStack []browseState
+	// follow the snapshot clients with this ID are pinned to, if any (see WithClientID)
+	clientID string
+	// tells the time (see WithClock)
+	clock Clock
+	// keep the table's metadata in memory instead of reading it on every call (see WithMetadataCache)
+	metaCache bool
+	metaMutex sync.Mutex
+	meta      *config
+	// how long the cached metadata is kept, and when it was read (see WithMetadataCacheTTL); 0 means for ever
+	metaTTL     time.Duration
+	metaFetched time.Time
+	// always read the metadata with strongly consistent reads (see WithConsistentMetadata)
+	consistentMeta bool
+	// store the metadata in this table instead of a row of the managed one (see WithMetadataTable)
+	metaTable string
+	// read from another region while the table's region is failing (see WithReadFailover)
+	failover *readFailover
+	// drop the cached metadata as soon as it changes (see streams.go)
+	streamInvalidation bool
+	listener           *streamListener
+	// maximum number of requests made in parallel by a single operation (see WithMaxConcurrency); 0 means the default
+	maxConcurrency int
+	// use strongly consistent reads unless the caller asks otherwise (see WithConsistentReads)
+	consistentRead bool
+	// attributes to compress when at least compressionThreshold bytes long (see WithCompression)
+	compressedAttributes map[string]bool
+	compressionThreshold int
+	compressionCodec     CompressionCodec
+	// where large attributes are stored instead of the table (see WithOverflow)
+	overflow *overflowConfig
+	// suffix added to every partition key (see WithWriteSharding)
+	shard          ShardFunc
+	shardDelimiter string
+	// how snapshot IDs are added to string partition keys (see WithKeyCodec)
+	codec KeyCodec
+	// write with the new key encoding while the table is being migrated (see WithKeyEncodingCompatibility)
+	keyCompatibility bool
+	keyOrder         KeyEncodingOrder
+	// write a checksum with every item and verify it on reads (see WithChecksums)
+	checksums bool
+	// items without a checksum fail to be read too (see WithRequiredChecksums)
+	requireChecksums bool
+	// reject inputs the Library cannot handle faithfully (see WithStrictMode)
+	strict bool
+	// try once more when losing a race to change the metadata (see WithConflictRetry)
+	conflictRetry bool
+	// how long to wait on the table (see WithTimeouts)
+	timeouts Timeouts
+	// longest a bulk write may take at the table's write capacity, and what to do otherwise (see WithCapacityCheck)
+	capacityLimit time.Duration
+	capacityWarn  func(*CapacityError)
+	// called once every bulk operation is over (see WithOperationReports)
+	reportFunc ReportFunc
+	// stamp every item written with the name of its snapshot and when (see WithVersionAttribute)
+	versionAttribute bool
+	namesMutex       sync.Mutex
+	snapshotNames    map[string]string
+	// bulk operations running (see Jobs)
+	jobsMutex sync.Mutex
+	jobs      []*Job
+	// save every bulk operation in the metadata, at most once every jobSaveInterval (see WithPersistentJobs)
+	persistJobs     bool
+	jobSaveInterval time.Duration
+	// called whenever the snapshots change (see OnSnapshot), noticed by reading the metadata every metaPolling, if
+	// not 0 (see WithMetadataPolling)
+	hooks       snapshotHooks
+	metaPolling time.Duration
 }
 
 // New creates a new Library instance for the specified table.
@@ -64,7 +148,11 @@ type Library struct {
 // The value of partitionKeyType and rangeKeyType and must be either "N" or "S".
 //
 // Every Library instance includes a DynamoDB client. It is created using the session for AWS services p, and,
-// optionally, additional configuration details as provided by cfg.
+// optionally, additional configuration details as provided by cfg, unless another Storage is given (see
+// WithStorage).
+//
+// Inputs passed to the Library that leave TableName empty are filled in with the managed table; naming any other
+// table is an error (*TableMismatchError).
 func New(
 	table string,
 	partitionKey string,
@@ -73,37 +161,473 @@ func New(
 	rangeKeyType string,
 	p client.ConfigProvider,
 	cfg ...*aws.Config,
+) (*Library, error) {
+	return NewWithOptions(table, partitionKey, partitionKeyType, rangeKey, rangeKeyType, p, WithAWSConfig(cfg...))
+}
+
+// NewWithOptions creates a new Library instance for the specified table, just like New, and configures it with
+// opts.
+func NewWithOptions(
+	table string,
+	partitionKey string,
+	partitionKeyType string,
+	rangeKey string,
+	rangeKeyType string,
+	p client.ConfigProvider,
+	opts ...Option,
+) (*Library, error) {
+	return newLibrary(table, partitionKey, partitionKeyType, rangeKey, rangeKeyType, p, nil, opts)
+}
+
+// NewFromTable creates a new Library instance for the specified table, just like NewWithOptions, but reads the
+// primary key schema (names and types) from the table itself, with a single DescribeTable call made through the
+// Storage the Library is going to use.
+//
+// Cost: 1 DescribeTable call
+func NewFromTable(table string, p client.ConfigProvider, opts ...Option) (*Library, error) {
+	// the key schema is not known yet, but the options tell which Storage to describe the table with
+	probe := &Library{}
+	for _, opt := range opts {
+		opt(probe)
+	}
+	svc := probe.svc
+	if svc == nil {
+		svc = dynamodb.New(p, probe.awsConfig...)
+	}
+
+	output, err := svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err != nil {
+		return nil, wrapError("failed to describe table", err)
+	}
+	partitionKey, partitionKeyType, rangeKey, rangeKeyType, err := describeKeySchema(output.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLibrary(table, partitionKey, partitionKeyType, rangeKey, rangeKeyType, p, svc, opts)
+}
+
+// return the name and type of the partition key and of the range key (empty strings if there is none) of a table
+func describeKeySchema(table *dynamodb.TableDescription) (string, string, string, string, error) {
+	types := make(map[string]string, len(table.AttributeDefinitions))
+	for _, definition := range table.AttributeDefinitions {
+		types[aws.StringValue(definition.AttributeName)] = aws.StringValue(definition.AttributeType)
+	}
+
+	var partitionKey, rangeKey string
+	for _, key := range table.KeySchema {
+		switch aws.StringValue(key.KeyType) {
+		case dynamodb.KeyTypeHash:
+			partitionKey = aws.StringValue(key.AttributeName)
+		case dynamodb.KeyTypeRange:
+			rangeKey = aws.StringValue(key.AttributeName)
+		}
+	}
+	if partitionKey == "" {
+		return "", "", "", "", errors.New("the table has no partition key")
+	}
+
+	return partitionKey, types[partitionKey], rangeKey, types[rangeKey], nil
+}
+
+// WithTable creates a new Library instance for another table, with its own primary key schema (see New), that shares
+// the DynamoDB client (or Storage) of c and is configured with the same options, followed by opts. This avoids creating
+// a new session and client for each table an application manages.
+//
+// As the client is shared, any additional AWS configuration (WithAWSConfig) in opts is only used to follow the
+// table's stream (see WithStreamInvalidation). Either Library can be closed without affecting the other.
+func (c *Library) WithTable(
+	table string,
+	partitionKey string,
+	partitionKeyType string,
+	rangeKey string,
+	rangeKeyType string,
+	opts ...Option,
+) (*Library, error) {
+	all := make([]Option, 0, len(c.opts)+len(opts))
+	all = append(all, c.opts...)
+	all = append(all, opts...)
+
+	return newLibrary(table, partitionKey, partitionKeyType, rangeKey, rangeKeyType, c.provider, c.svc, all)
+}
+
+// create a Library that uses svc as its storage, or the one given in opts, or a new DynamoDB client if neither is
+func newLibrary(
+	table string,
+	partitionKey string,
+	partitionKeyType string,
+	rangeKey string,
+	rangeKeyType string,
+	p client.ConfigProvider,
+	svc Storage,
+	opts []Option,
 ) (*Library, error) {
 	if partitionKeyType != "S" && partitionKeyType != "N" {
 		return nil, errors.New("invalid key (partition or range) type: must be one of 'N' or 'S'")
 	}
 
-	return &Library{
+	library := &Library{
 		tableName:        table,
 		partitionKey:     partitionKey,
 		partitionKeyType: partitionKeyType,
 		rangeKey:         rangeKey,
 		rangeKeyType:     rangeKeyType,
+		keyEncoding:      keyEncodingLegacy,
+		compressionCodec: CompressGzip,
 		browsing:         false,
-		svc:              dynamodb.New(p, cfg...),
-	}, nil
+		clock:            systemClock{},
+		provider:         p,
+		opts:             opts,
+	}
+	for _, opt := range opts {
+		opt(library)
+	}
+	if library.compressedAttributes[partitionKey] || library.compressedAttributes[rangeKey] {
+		return nil, errors.New("the primary key cannot be compressed")
+	}
+	err := checkCompressionCodec(library.compressionCodec)
+	if err != nil {
+		return nil, err
+	}
+	if library.overflow != nil {
+		if p == nil {
+			return nil, errors.New("overflowing attributes to S3 needs an AWS session")
+		}
+		if library.overflow.bucket == "" {
+			return nil, errors.New("no bucket to overflow attributes to")
+		}
+		if library.overflow.attributes[partitionKey] || library.overflow.attributes[rangeKey] {
+			return nil, errors.New("the primary key cannot overflow to S3")
+		}
+		library.overflow.uploader = newObjectUploader(p)
+		library.overflow.reader = newObjectReader(p)
+		library.overflow.sweeper = newObjectSweeper(p)
+	}
+	if library.codec != (KeyCodec{}) {
+		if partitionKeyType != "S" {
+			return nil, errors.New("key codecs are only supported on string partition keys")
+		}
+		if library.codec.IDWidth < 0 {
+			return nil, errors.New("invalid key codec: the snapshot ID width cannot be negative")
+		}
+		if library.codec.Suffix && library.codec.IDWidth == 0 {
+			return nil, errors.New("invalid key codec: adding the snapshot ID after the key requires fixed-width IDs")
+		}
+	}
+	if library.shard != nil {
+		if partitionKeyType != "S" {
+			return nil, errors.New("write sharding is only supported on string partition keys")
+		}
+		if library.shardDelimiter == "" || library.shardDelimiter == library.keyDelimiter() {
+			return nil, errors.New("invalid shard delimiter: must be non-empty and different from " +
+				library.keyDelimiter())
+		}
+	}
+	if svc != nil {
+		library.svc = svc
+	}
+	if library.svc == nil {
+		library.svc = dynamodb.New(p, library.awsConfig...)
+	}
+
+	if library.streamInvalidation {
+		err := library.startStreamListener(p)
+		if err != nil {
+			return nil, wrapError("failed to start listening to the table's stream", err)
+		}
+	}
+	if library.metaPolling > 0 {
+		library.startMetadataPolling(library.metaPolling)
+	}
+
+	return library, nil
+}
+
+// Close releases the resources held by the Library, i.e., stops listening to the table's stream and polling the
+// metadata. The Library must not be used afterwards.
+func (c *Library) Close() {
+	if c.listener != nil {
+		c.listener.stop()
+		c.listener = nil
+	}
+	c.stopMetadataPolling()
+}
+
+// loadMeta returns the table's metadata, either from the cache (see WithMetadataCache) or straight from the table,
+// read with the Library's default consistency
+func (c *Library) loadMeta(ctx aws.Context) (*config, error) {
+	return c.loadMetaFor(ctx, c.consistentRead, false)
+}
+
+// loadMetaWithConsistency returns the table's metadata for a read just like loadMeta, reading it with a strongly
+// consistent read iff consistent is true; the cache is always filled with a strongly consistent read
+func (c *Library) loadMetaWithConsistency(ctx aws.Context, consistent bool) (*config, error) {
+	return c.loadMetaFor(ctx, consistent, true)
+}
+
+// return the table's metadata, as loadMetaWithConsistency does; only the metadata for a read may come from the
+// secondary region, if it isn't cached while reads are failed over (see WithReadFailover), in which case it isn't
+// cached either, so that writes are never routed by it
+func (c *Library) loadMetaFor(ctx aws.Context, consistent bool, read bool) (*config, error) {
+	secondary := read && c.ReadsFailedOver()
+	if !c.metaCache {
+		if secondary {
+			return c.fetchSecondaryMeta(ctx, consistent || c.consistentMeta)
+		}
+		return c.fetchMeta(ctx, consistent || c.consistentMeta)
+	}
+
+	meta, calls, err := c.cachedMeta(ctx, secondary)
+	// the hooks may well use the Library, and thus the cache
+	runHooks(calls)
+
+	return meta, err
+}
+
+// return the cached metadata, reading it first if there is none, from the secondary region if secondary is true,
+// along with the hooks to call for the changes that read revealed
+func (c *Library) cachedMeta(ctx aws.Context, secondary bool) (*config, []hookCall, error) {
+	c.metaMutex.Lock()
+	defer c.metaMutex.Unlock()
+
+	if c.meta != nil && c.metaTTL > 0 && !c.clock.Now().Before(c.metaFetched.Add(c.metaTTL)) {
+		c.meta = nil
+	}
+	if c.meta != nil {
+		return c.meta, nil, nil
+	}
+	if secondary {
+		meta, err := c.fetchSecondaryMeta(ctx, true)
+		return meta, nil, err
+	}
+
+	meta, calls, err := c.readMeta(ctx, true)
+	if err != nil {
+		return nil, calls, err
+	}
+	c.meta = meta
+	c.metaFetched = c.clock.Now()
+
+	return meta, calls, nil
+}
+
+// fetchMeta reads the table's metadata and keeps track of the key encoding it uses; operations that change the
+// metadata always use it, with a strongly consistent read (and then invalidate the cache), so they never work with
+// stale data
+func (c *Library) fetchMeta(ctx aws.Context, consistent bool) (*config, error) {
+	meta, calls, err := c.readMeta(ctx, consistent)
+	runHooks(calls)
+
+	return meta, err
+}
+
+// read the table's metadata as fetchMeta does, and return it along with the hooks to call for the changes made by
+// other clients, which is left to the caller so that they are never called with metaMutex held
+func (c *Library) readMeta(ctx aws.Context, consistent bool) (*config, []hookCall, error) {
+	meta, err := newMeta(
+		c.metaStorage(ctx),
+		c.metaTableName(),
+		c.metaKey(),
+		c.partitionKey,
+		c.partitionKeyType,
+		c.rangeKey,
+		c.rangeKeyType,
+		consistent,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = c.checkKeyCodec(meta)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.setKeyEncodings(meta.keyEncoding, meta.keyEncodingMigration)
+	if c.versionAttribute {
+		c.rememberSnapshotNames(meta)
+	}
+	// eventually consistent reads may go back in time
+	if !consistent {
+		return meta, nil, nil
+	}
+
+	return meta, c.observeMeta(meta), nil
+}
+
+// fetchSecondaryMeta reads the table's metadata as fetchMeta does, from the secondary region if reads are failed over
+// (see WithReadFailover); what it finds there may be out of date, so the Library keeps track of nothing
+func (c *Library) fetchSecondaryMeta(ctx aws.Context, consistent bool) (*config, error) {
+	meta, err := newMeta(
+		c.regionStorage(ctx, c.timeouts.Metadata),
+		c.metaTableName(),
+		c.metaKey(),
+		c.partitionKey,
+		c.partitionKeyType,
+		c.rangeKey,
+		c.rangeKeyType,
+		consistent,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkKeyCodec(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// return whether a read should be strongly consistent: as requested by the caller, if they did, or the Library's
+// default otherwise
+func (c *Library) isConsistentRead(requested *bool) bool {
+	if requested != nil {
+		return *requested
+	}
+
+	return c.consistentRead
+}
+
+// drop the cached metadata, if any, so that the next call reads it from the table
+func (c *Library) invalidateMeta() {
+	c.metaMutex.Lock()
+	defer c.metaMutex.Unlock()
+
+	c.meta = nil
+}
+
+// Invalidate drops the table's metadata cached by the Library (see WithMetadataCache), if any, so that the next call
+// reads it again, e.g., to see right away a rollback made by another client.
+func (c *Library) Invalidate() {
+	c.invalidateMeta()
 }
 
 // Snapshot starts a new snapshot and sets it as the active one.
 //
 // The snapshot will be used to store a point in time copy of each individual item written to it while it is active.
+// The time it was taken is recorded as well (see SnapshotCreationTime), along with an optional description (see
+// SnapshotDescription). A table allows for 99 snapshots at a time, unless SetSnapshotIDLength allows for more; once
+// they are all taken, it fails with a *SnapshotLimitError.
+//
+// By default, the active snapshot must be the latest one, i.e., no rollback can be in effect. opts can relax this, to
+// branch off an older snapshot, or add further preconditions (see SnapshotOption).
+//
+// Cost: 1RU + 1WU (+ 1 DescribeTable call with RequireTableActive)
+func (c *Library) Snapshot(snapshot string, opts ...SnapshotOption) error {
+	return c.SnapshotWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// SnapshotWithContext is the same as Snapshot with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) SnapshotWithContext(ctx aws.Context, snapshot string, opts ...SnapshotOption) error {
+	preconditions := newSnapshotOptions(opts)
+	if preconditions.tenant != "" {
+		err := c.checkTenant(preconditions.tenant)
+		if err != nil {
+			return err
+		}
+	}
+	if preconditions.requireTableActive {
+		err := c.checkTableActive(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	defer c.invalidateMeta()
+	err := c.retryOnConflict(func() error {
+		meta, err := c.fetchMeta(ctx, true)
+		if err != nil {
+			return wrapError("failed to create metadata client", err)
+		}
+
+		err = c.checkSnapshotPolicy(meta, snapshot)
+		if err != nil {
+			return err
+		}
+		_, err = meta.snapshot(snapshot, c.clock.Now(), preconditions.details(),
+			!preconditions.requireActiveEqualsLatest, preconditions.keepCurrent)
+		if isConditionalCheckFailure(err) {
+			return c.concurrentMetadataChange(ctx, "Snapshot", meta)
+		}
+		if _, ok := err.(*SnapshotLimitError); ok {
+			return err
+		}
+		if err != nil {
+			return wrapError("failed to create snapshot", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c.notifySnapshot(snapshot)
+	return nil
+}
+
+// maximum number of digits of snapshot IDs: numeric partition keys only have 3 digits left for them (see
+// numericKeyWidth), and each digit is taken from the length left for string partition keys
+const (
+	maxNumericSnapshotIDLength = 38 - numericKeyWidth
+	maxSnapshotIDLength        = 9
+)
+
+// SetSnapshotIDLength records in the table's metadata the maximum number of digits of snapshot IDs, 2 by default,
+// which allows for 10^length - 1 snapshots at a time. It can only grow, since existing snapshots may already use every
+// digit it allows for, up to 3 digits for tables with a numeric partition key, or 9 otherwise. Each digit is taken
+// from the length left for partition keys. Clients that cache the metadata (see WithMetadataCache) only see it once
+// their cache is dropped.
 //
 // Cost: 1RU + 1WU
-func (c *Library) Snapshot(snapshot string) error {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+func (c *Library) SetSnapshotIDLength(length int) error {
+	return c.SetSnapshotIDLengthWithContext(aws.BackgroundContext(), length)
+}
+
+// SetSnapshotIDLengthWithContext is the same as SetSnapshotIDLength with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) SetSnapshotIDLengthWithContext(ctx aws.Context, length int) error {
+	limit := maxSnapshotIDLength
+	if c.partitionKeyType == "N" {
+		limit = maxNumericSnapshotIDLength
+	}
+	if length > limit {
+		return errors.New(fmt.Sprintf("snapshot IDs cannot be longer than %d digits", limit))
+	}
+	if c.partitionKeyType == "S" && c.codec.IDWidth > 0 && length > c.codec.IDWidth {
+		return errors.New(fmt.Sprintf("snapshot IDs cannot be longer than the key codec's width, %d digits",
+			c.codec.IDWidth))
+	}
+
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
 	if err != nil {
-		return errors.New("failed to create metadata client: " + err.Error())
+		return err
+	}
+	if length < meta.snapshotIDLength {
+		return errors.New(fmt.Sprintf("snapshot IDs are already up to %d digits long, which cannot be reduced",
+			meta.snapshotIDLength))
+	}
+
+	err = meta.setSnapshotIDLength(length)
+	if isConditionalCheckFailure(err) {
+		return errors.New("snapshot IDs were made longer concurrently")
 	}
 
-	// TODO: naming restrictions
-	_, err = meta.snapshot(snapshot)
+	return err
+}
+
+// make sure the table is ACTIVE, i.e., not being created, updated, or deleted
+func (c *Library) checkTableActive(ctx aws.Context) error {
+	output, err := c.storage(ctx).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(c.tableName)})
 	if err != nil {
-		return errors.New("failed to create snapshot: " + err.Error())
+		return wrapError("failed to describe table", err)
+	}
+
+	status := aws.StringValue(output.Table.TableStatus)
+	if status != dynamodb.TableStatusActive {
+		return errors.New("table " + c.tableName + " is not active: " + status)
 	}
 
 	return nil
@@ -115,7 +639,13 @@ func (c *Library) Snapshot(snapshot string) error {
 //
 // Cost: 1RU
 func (c *Library) Browse(snapshot string) error {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.BrowseWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// BrowseWithContext is the same as Browse with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) BrowseWithContext(ctx aws.Context, snapshot string) error {
+	meta, err := c.loadMeta(ctx)
 	if err != nil {
 		return err
 	}
@@ -127,6 +657,36 @@ func (c *Library) Browse(snapshot string) error {
 
 	c.browsing = true
 	c.currentSnapshot = current
+	c.browseUntil = time.Time{}
+
+	return nil
+}
+
+// BrowseByID is like Browse, but takes the internal ID of the snapshot (see SnapshotIDMap), e.g., as seen in the
+// table's raw contents, instead of its name. An empty ID refers to the data written before any snapshots.
+//
+// Cost: 1RU
+func (c *Library) BrowseByID(id string) error {
+	return c.BrowseByIDWithContext(aws.BackgroundContext(), id)
+}
+
+// BrowseByIDWithContext is the same as BrowseByID with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) BrowseByIDWithContext(ctx aws.Context, id string) error {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	// make sure it exists
+	_, err = meta.getSnapshotName(id)
+	if err != nil {
+		return err
+	}
+
+	c.browsing = true
+	c.currentSnapshot = id
+	c.browseUntil = time.Time{}
 
 	return nil
 }
@@ -140,20 +700,197 @@ func (c *Library) Browse(snapshot string) error {
 func (c *Library) StopBrowsing() {
 	c.browsing = false
 	c.currentSnapshot = ""
+	c.browseUntil = time.Time{}
 }
 
-// Rollback sets snapshot as the active snapshot.
+// browseState is what PushBrowse saves of a session's browsing state for PopBrowse to put back
+type browseState struct {
+	browsing bool
+	snapshot string
+	// name of the snapshot, as IDs are reused once destroyed
+	name  string
+	until time.Time
+}
+
+// PushBrowse browses snapshot, just like Browse, after saving the session's current browsing state (whether it is
+// browsing some snapshot, and until when) for the next call to PopBrowse to go back to. Calls can be nested, e.g., to
+// inspect an older snapshot inside a function without disturbing whatever its caller was browsing.
 //
-// This operation will affect all clients, both new and already established connections.
+// The state is not saved if browsing snapshot fails.
 //
-// Cost: 1RU + 1WU
-func (c *Library) Rollback(snapshot string) error {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+// Cost: 1RU, 2RU if already browsing
+func (c *Library) PushBrowse(snapshot string) error {
+	return c.PushBrowseWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// PushBrowseWithContext is the same as PushBrowse with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) PushBrowseWithContext(ctx aws.Context, snapshot string) error {
+	// an expired session is saved as not browsing
+	c.isBrowsing()
+	saved := browseState{browsing: c.browsing, snapshot: c.currentSnapshot, until: c.browseUntil}
+	if saved.browsing {
+		meta, err := c.loadMeta(ctx)
+		if err != nil {
+			return err
+		}
+		saved.name, err = meta.getSnapshotName(saved.snapshot)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := c.BrowseWithContext(ctx, snapshot)
 	if err != nil {
 		return err
 	}
 
-	_, err = meta.rollback(snapshot)
+	c.browseStack = append(c.browseStack, saved)
+
+	return nil
+}
+
+// PopBrowse puts back the browsing state saved by the matching call to PushBrowse, whatever happened to it since,
+// e.g., a StopBrowsing. A saved BrowseFor session keeps its original expiration time. It returns ErrBrowseStackEmpty if
+// there is no such call.
+//
+// If the saved snapshot has been destroyed since, the session stops browsing instead and the returned error matches
+// ErrSnapshotNotFound; the state is popped either way.
+//
+// Cost: 0, 1RU if the saved state is browsing a snapshot
+func (c *Library) PopBrowse() error {
+	return c.PopBrowseWithContext(aws.BackgroundContext())
+}
+
+// PopBrowseWithContext is the same as PopBrowse with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) PopBrowseWithContext(ctx aws.Context) error {
+	if len(c.browseStack) == 0 {
+		return ErrBrowseStackEmpty
+	}
+
+	saved := c.browseStack[len(c.browseStack)-1]
+	c.browseStack = c.browseStack[:len(c.browseStack)-1]
+
+	// the ID may since have been reused by some other snapshot
+	if saved.browsing {
+		meta, err := c.loadMeta(ctx)
+		if err != nil {
+			return err
+		}
+		name, err := meta.getSnapshotName(saved.snapshot)
+		if err != nil || name != saved.name {
+			c.StopBrowsing()
+			return &SnapshotNotFoundError{Snapshot: saved.name}
+		}
+	}
+
+	c.browsing = saved.browsing
+	c.currentSnapshot = saved.snapshot
+	c.browseUntil = saved.until
+
+	return nil
+}
+
+// IsBrowsing returns whether the session currently handled by Library is browsing a snapshot (see Browse and
+// BrowseFor).
+//
+// Cost: 0
+func (c *Library) IsBrowsing() bool {
+	return c.isBrowsing()
+}
+
+// CurrentSnapshot returns the name of the snapshot the Library reads from and writes to: the one it is browsing, if
+// any, or the one its client ID is pinned to (see PinClient), or the table's active snapshot otherwise (see
+// ActiveSnapshotName). Before any snapshots are taken, or after rolling back to the data written before them, it is
+// Baseline.
+//
+// Cost: 1RU
+func (c *Library) CurrentSnapshot() (string, error) {
+	return c.CurrentSnapshotWithContext(aws.BackgroundContext())
+}
+
+// CurrentSnapshotWithContext is the same as CurrentSnapshot with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) CurrentSnapshotWithContext(ctx aws.Context) (string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return snapshotNameOrBaseline(meta, c.activeSnapshotID(meta))
+}
+
+// ActiveSnapshotName returns the name of the table's active snapshot, i.e., the latest one, or the one it was rolled
+// back to, which every client uses unless browsing or pinned to another one. Before any snapshots are taken, or after
+// rolling back to the data written before them, it is Baseline.
+//
+// Cost: 1RU
+func (c *Library) ActiveSnapshotName() (string, error) {
+	return c.ActiveSnapshotNameWithContext(aws.BackgroundContext())
+}
+
+// ActiveSnapshotNameWithContext is the same as ActiveSnapshotName with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) ActiveSnapshotNameWithContext(ctx aws.Context) (string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return snapshotNameOrBaseline(meta, meta.getCurrentSnapshotID())
+}
+
+// return the name of the snapshot with the given ID, or Baseline for the data written before any snapshots
+func snapshotNameOrBaseline(meta *config, id string) (string, error) {
+	if id == "" {
+		return Baseline, nil
+	}
+
+	return meta.getSnapshotName(id)
+}
+
+// Rollback sets snapshot as the active snapshot.
+//
+// This operation will affect all clients, both new and already established connections. Since it changes the data
+// every tenant sees, a snapshot taken for a single tenant (see SnapshotTenant) cannot be rolled back to: restore it
+// instead (see Restore and RestoreTenant).
+//
+// Cost: 1RU + 1WU
+func (c *Library) Rollback(snapshot string) error {
+	return c.RollbackWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// RollbackWithContext is the same as Rollback with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) RollbackWithContext(ctx aws.Context, snapshot string) error {
+	defer c.invalidateMeta()
+	var name string
+	err := c.retryOnConflict(func() error {
+		meta, err := c.fetchMeta(ctx, true)
+		if err != nil {
+			return err
+		}
+
+		err = c.checkRollbackPolicy(meta, "Rollback")
+		if err != nil {
+			return err
+		}
+		err = checkRollbackTenant(meta, snapshot)
+		if err != nil {
+			return err
+		}
+		id, err := meta.rollback(snapshot)
+		if isConditionalCheckFailure(err) {
+			return c.concurrentMetadataChange(ctx, "Rollback", meta)
+		}
+		if err != nil {
+			return err
+		}
+
+		name, err = snapshotNameOrBaseline(meta, id)
+		return err
+	})
 	if err != nil {
 		return err
 	}
@@ -161,18 +898,340 @@ func (c *Library) Rollback(snapshot string) error {
 	// if we were browsing some snapshot, we're not anymore
 	c.StopBrowsing()
 
+	c.notifyRollback(name)
 	return nil
 }
 
-func (c *Library) DestroySnapshot(snapshot string) {
-	// TODO: remove the snapshot from the cache
+// DestroySnapshot removes snapshot from the table's metadata and deletes all items written to it. Its ID becomes
+// available for new snapshots once they are all gone. Reading from the snapshots taken on top of it falls back to the
+// one it was taken on top of instead.
+//
+// The active snapshot cannot be destroyed, nor the latest one, unless ForceDestroy is given: the active snapshot then
+// becomes the one it was taken on top of (i.e., what reading from it would fall back to), and the latest snapshot the
+// most recent one left.
+//
+// The metadata is updated first, moving the active and latest snapshots off it, so that nothing reads from, or
+// writes to, the snapshot while its items are deleted. The table is then gone over again until no items are left,
+// as clients that have not noticed yet may still write to it, and only then is its ID released. It fails if a
+// snapshot is taken, or a rollback happens, before the metadata is updated; if it fails after that, resuming the job
+// (see ResumeJob) or CollectGarbage deletes the items left. With WithCapacityCheck, the items are counted first, and
+// it fails with a *CapacityError before deleting any if that would obviously overwhelm the table. With
+// DestroyProgress, progress is reported as the items are deleted.
+//
+// Cost: 2RU + 2WU + 2 full table scans + 1WU per deleted item (+ another full table scan and 1 DescribeTable call
+// with WithCapacityCheck)
+func (c *Library) DestroySnapshot(snapshot string, opts ...DestroyOption) error {
+	return c.DestroySnapshotWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// DestroySnapshotWithContext is the same as DestroySnapshot with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) DestroySnapshotWithContext(ctx aws.Context, snapshot string, opts ...DestroyOption) error {
+	options := newDestroyOptions(opts)
+	params := &jobParams{force: options.force}
+	destroy := func(ctx aws.Context, reporter *operationReporter) error {
+		return c.destroySnapshot(ctx, snapshot, options, reporter)
+	}
+
+	return c.runJob(ctx, "DestroySnapshot", snapshot, params, destroy)
+}
+
+// StartDestroySnapshot is the same as DestroySnapshot, except that it runs in the background and returns right away,
+// with the Job to follow, pause, resume, or cancel it; Job.Wait returns the error DestroySnapshot would have.
+func (c *Library) StartDestroySnapshot(snapshot string, opts ...DestroyOption) *Job {
+	return c.StartDestroySnapshotWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// StartDestroySnapshotWithContext is the same as StartDestroySnapshot with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) StartDestroySnapshotWithContext(ctx aws.Context, snapshot string, opts ...DestroyOption) *Job {
+	options := newDestroyOptions(opts)
+	params := &jobParams{force: options.force}
+	destroy := func(ctx aws.Context, reporter *operationReporter) error {
+		return c.destroySnapshot(ctx, snapshot, options, reporter)
+	}
+
+	return c.startJob(ctx, "DestroySnapshot", snapshot, params, destroy)
+}
+
+func (c *Library) destroySnapshot(
+	ctx aws.Context,
+	snapshot string,
+	options *destroyOptions,
+	reporter *operationReporter,
+) error {
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return err
+	}
+
+	// a job resumed after the metadata was updated only has the items left to delete
+	if job := jobFromContext(ctx); job != nil {
+		if id, ok := job.snapshotID(snapshot); ok && meta.destroyingIDs[id] {
+			return c.sweepDestroyedSnapshots(ctx, meta, map[string]bool{id: true}, options.resume, reporter)
+		}
+	}
+	snapshot, err = c.jobSnapshot(ctx, meta, snapshot)
+	if err != nil {
+		return err
+	}
+	id, name, err := c.checkDestroySnapshot(meta, snapshot, options)
+	if err != nil {
+		return err
+	}
+
+	// the table's item count is only a rough estimate of how many items the snapshot has
+	reporter.progress = c.newProgressTracker(ctx, options.progress, c.capacityLimit == 0)
+	if c.capacityLimit > 0 {
+		count, err := c.countWithSnapshotID(ctx, id)
+		if err != nil {
+			return wrapError("failed to count items", err)
+		}
+		err = c.checkCapacity(ctx, "DestroySnapshot", count)
+		if err != nil {
+			return err
+		}
+		reporter.expect(count)
+	}
+
+	// nothing reads from, or writes to, the snapshot once the active and latest snapshots have been moved off it, and
+	// its ID is not reused until its items are gone
+	err = meta.destroySnapshots([]string{name}, options.force)
+	if err != nil {
+		return wrapError("failed to update the metadata", err)
+	}
+
+	// we can't keep browsing a snapshot that no longer exists
+	if c.currentSnapshot == id {
+		c.StopBrowsing()
+	}
+	c.notifyDestroy(meta, []string{name})
+
+	return c.sweepDestroyedSnapshots(ctx, meta, map[string]bool{id: true}, options.resume, reporter)
 }
 
-// ListSnapshots returns a (chronological sorted) list of all existing snapshots.
+// make sure snapshot can be destroyed with the given options, returning its ID and its name (the special names, e.g.,
+// "latest", are not in the metadata)
+func (c *Library) checkDestroySnapshot(meta *config, snapshot string, options *destroyOptions) (string, string, error) {
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return "", "", err
+	}
+	if id == "" {
+		return "", "", errors.New("cannot destroy the data written before any snapshots")
+	}
+	name, err := meta.getSnapshotName(id)
+	if err != nil {
+		return "", "", err
+	}
+	if !options.force && (id == meta.latestSnapshotID || id == meta.getCurrentSnapshotID()) {
+		return "", "", errors.New("cannot destroy the latest or the active snapshot without ForceDestroy: " + name)
+	}
+	err = c.checkRetentionPolicy(meta, "DestroySnapshot", name)
+	if err != nil {
+		return "", "", err
+	}
+
+	return id, name, nil
+}
+
+// maximum number of keys included in a DestroyPlan
+const destroyPlanSampleSize = 10
+
+// DestroyPlan describes what destroying some snapshot would delete, without deleting anything.
+type DestroyPlan struct {
+	// the snapshot the plan is for
+	Snapshot string
+	// number of items written to the snapshot, i.e., that would be deleted
+	Items int64
+	// primary key (with no snapshot) of some of those items
+	Sample []map[string]*dynamodb.AttributeValue
+	// write capacity units deleting the items would consume, at least
+	WriteUnits int64
+	// lowest write capacity units provisioned on the table, or any of its global secondary indexes; 0 in on-demand
+	// mode
+	WriteCapacity int64
+	// how long deleting the items would take at that capacity, at best; 0 in on-demand mode
+	Estimate time.Duration
+}
+
+// PlanDestroySnapshot computes the effect of calling DestroySnapshot(snapshot, opts...): it fails the same way if the
+// snapshot cannot be destroyed, and otherwise counts the items that would be deleted and estimates how long that
+// would take at the table's write capacity, each item taking a single write unit. The table is not modified.
+//
+// Cost: 1RU + a full table scan + 1 DescribeTable call
+func (c *Library) PlanDestroySnapshot(snapshot string, opts ...DestroyOption) (*DestroyPlan, error) {
+	return c.PlanDestroySnapshotWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// PlanDestroySnapshotWithContext is the same as PlanDestroySnapshot with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) PlanDestroySnapshotWithContext(
+	ctx aws.Context,
+	snapshot string,
+	opts ...DestroyOption,
+) (*DestroyPlan, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, name, err := c.checkDestroySnapshot(meta, snapshot, newDestroyOptions(opts))
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &DestroyPlan{
+		Snapshot: name,
+		Sample:   make([]map[string]*dynamodb.AttributeValue, 0),
+	}
+	input := &dynamodb.ScanInput{TableName: aws.String(c.tableName)}
+	for {
+		out, err := c.scanWithSnapshotID(ctx, input, id)
+		if err != nil {
+			return nil, err
+		}
+		plan.Items += int64(len(out.Items))
+		for i := 0; i < len(out.Items) && len(plan.Sample) < destroyPlanSampleSize; i++ {
+			plan.Sample = append(plan.Sample, c.primaryKey(out.Items[i]))
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	plan.WriteUnits = plan.Items
+	plan.WriteCapacity, plan.Estimate, err = c.estimateWriteTime(ctx, plan.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	return plan, nil
+}
+
+// SnapshotInfo describes an existing snapshot (see ListSnapshots).
+type SnapshotInfo struct {
+	Name string
+	// internal ID (see SnapshotIDMap)
+	ID string
+	// when the snapshot was taken, according to the Clock of the Library that took it; zero if it was taken before
+	// creation times were recorded
+	Created time.Time
+	// the description it was taken with, if any (see SnapshotDescription)
+	Description string
+	// the tenant it was taken for, if any (see SnapshotTenant)
+	Tenant string
+	// writes that would change it are refused (see LockSnapshot)
+	Locked bool
+	// writes go to the current snapshot, which is the latest one unless a rollback is in effect
+	Current bool
+	Latest  bool
+}
+
+// ListSnapshots returns all existing snapshots, most recent first. Snapshots that branch off older ones (see
+// RequireActiveEqualsLatest) are listed by the time they were taken as well: SnapshotTree shows how they relate.
 //
 // Cost: 1RU
-func (c *Library) ListSnapshots() ([]string, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+func (c *Library) ListSnapshots() ([]SnapshotInfo, error) {
+	return c.ListSnapshotsWithContext(aws.BackgroundContext())
+}
+
+// ListSnapshotsWithContext is the same as ListSnapshots with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) ListSnapshotsWithContext(ctx aws.Context) ([]SnapshotInfo, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]SnapshotInfo, 0, len(meta.chronologicalSnapshotIDs))
+	for _, id := range meta.listSnapshots() {
+		name, err := meta.getSnapshotName(id)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := describeSnapshot(meta, name, id)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, *info)
+	}
+
+	return snapshots, nil
+}
+
+// DescribeSnapshot returns what ListSnapshots does about a single snapshot.
+//
+// Cost: 1RU
+func (c *Library) DescribeSnapshot(snapshot string) (*SnapshotInfo, error) {
+	return c.DescribeSnapshotWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// DescribeSnapshotWithContext is the same as DescribeSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) DescribeSnapshotWithContext(ctx aws.Context, snapshot string) (*SnapshotInfo, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := meta.snapshots[snapshot]; !ok {
+		return nil, &SnapshotNotFoundError{Snapshot: snapshot}
+	}
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return describeSnapshot(meta, snapshot, id)
+}
+
+// return everything recorded about the snapshot with the given name and ID
+func describeSnapshot(meta *config, name string, id string) (*SnapshotInfo, error) {
+	info := &SnapshotInfo{
+		Name:    name,
+		ID:      id,
+		Current: id == meta.getCurrentSnapshotID(),
+		Latest:  id == meta.latestSnapshotID,
+	}
+
+	if av := meta.getSnapshotInfo(name, snapshotInfoCreated); av != nil {
+		created, err := timeFromAttributeValue(av)
+		if err != nil {
+			return nil, err
+		}
+		info.Created = created
+	}
+	if av := meta.getSnapshotInfo(name, snapshotInfoDescription); av != nil {
+		info.Description = aws.StringValue(av.S)
+	}
+	if av := meta.getSnapshotInfo(name, snapshotInfoTenant); av != nil {
+		info.Tenant = aws.StringValue(av.S)
+	}
+	info.Locked = meta.isSnapshotLocked(name)
+
+	return info, nil
+}
+
+// ListSnapshotIDs returns the internal IDs of all existing snapshots, most recent first.
+//
+// Deprecated: use ListSnapshots, which also returns their names.
+//
+// Cost: 1RU
+func (c *Library) ListSnapshotIDs() ([]string, error) {
+	return c.ListSnapshotIDsWithContext(aws.BackgroundContext())
+}
+
+// ListSnapshotIDsWithContext is the same as ListSnapshotIDs with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+//
+// Deprecated: use ListSnapshotsWithContext, which also returns their names.
+func (c *Library) ListSnapshotIDsWithContext(ctx aws.Context) ([]string, error) {
+	meta, err := c.loadMeta(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -180,31 +1239,122 @@ func (c *Library) ListSnapshots() ([]string, error) {
 	return meta.listSnapshots(), nil
 }
 
+// SnapshotIDMap returns the internal ID of every existing snapshot, by name, and the name of every ID. Items are
+// stored with the ID of their snapshot prepended to the partition key (e.g., "7.<key>"), so this maps what is seen
+// when looking at the table's raw contents back to snapshot names.
+//
+// Cost: 1RU
+func (c *Library) SnapshotIDMap() (byName map[string]string, byID map[string]string, err error) {
+	return c.SnapshotIDMapWithContext(aws.BackgroundContext())
+}
+
+// SnapshotIDMapWithContext is the same as SnapshotIDMap with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) SnapshotIDMapWithContext(
+	ctx aws.Context,
+) (byName map[string]string, byID map[string]string, err error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName = meta.snapshotIDMap()
+	byID = make(map[string]string, len(byName))
+	for name, id := range byName {
+		byID[id] = name
+	}
+
+	return byName, byID, nil
+}
+
+// GetSnapshotNameByID returns the name of the snapshot with the given internal ID (see SnapshotIDMap), e.g., to
+// find out which snapshot an item seen in the table's raw contents belongs to. An empty ID refers to the data written
+// before any snapshots, which has no name either.
+//
+// Cost: 1RU
+func (c *Library) GetSnapshotNameByID(id string) (string, error) {
+	return c.GetSnapshotNameByIDWithContext(aws.BackgroundContext(), id)
+}
+
+// GetSnapshotNameByIDWithContext is the same as GetSnapshotNameByID with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) GetSnapshotNameByIDWithContext(ctx aws.Context, id string) (string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return meta.getSnapshotName(id)
+}
+
 // PutItem calls the PutItem API operation for input. The data is written to the active snapshot.
 //
 // Overhead: 1RU
 func (c *Library) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	return c.PutItemWithContext(aws.BackgroundContext(), input)
+}
+
+// PutItemWithContext is the same as PutItem with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
 	var snapshotID string
 	var err error
 
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	err = c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkCondition("PutItem", input.ConditionExpression, input.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, wrapError("failed to create snapshots client", err)
+	}
+
+	snapshotID, err = meta.getWritableSnapshotID("PutItem", snapshotCurrent)
 	if err != nil {
-		return nil, errors.New("failed to create snapshots client: " + err.Error())
+		return nil, wrapError("failed to get snapshot ID", err)
 	}
 
-	snapshotID, err = meta.getSnapshotID(snapshotCurrent)
+	restoreOverflow, err := c.overflowItem(ctx, "PutItem", input.Item)
 	if err != nil {
-		return nil, errors.New("failed to get snapshot ID: " + err.Error())
+		return nil, err
 	}
+	defer restoreOverflow()
 
 	// save the key as the user passed it and add the snapshot ID
 	originalKey := c.addSnapshotToPartitionKey(snapshotID, input.Item[c.partitionKey])
-	// update DDB
-	output, err := c.svc.PutItem(input)
-	// restore the original key
+	untag := c.tagItem(input.Item, snapshotID)
+	// the condition compares the partition key against values that need the snapshot too
+	condition, values, expected := input.ConditionExpression, input.ExpressionAttributeValues, input.Expected
+	input.ConditionExpression, _, input.ExpressionAttributeValues = c.rewriteCondition(condition, nil,
+		input.ExpressionAttributeNames, values, snapshotID)
+	input.Expected = c.rewriteExpected(expected, snapshotID)
+	err = c.checkNotMetaRow("PutItem", input.Item)
+	// if the table is being migrated, the item may not have been converted yet, and the condition has to see it
+	if err == nil {
+		err = c.convertOldEncodingCopies(ctx, []map[string]*dynamodb.AttributeValue{input.Item})
+	}
+	var output *dynamodb.PutItemOutput
+	if err == nil {
+		// update DDB
+		output, err = c.storage(ctx).PutItem(input)
+	}
+	// restore the original item and condition
 	c.restorePartitionKey(originalKey, input.Item[c.partitionKey])
+	untag()
+	input.ConditionExpression, input.ExpressionAttributeValues, input.Expected = condition, values, expected
 
-	return output, err
+	if err != nil {
+		c.normalizeConditionFailure(err)
+		return nil, err
+	}
+	c.normalizeWriteOutput(output.Attributes, output.ItemCollectionMetrics)
+
+	return output, nil
 }
 
 // BatchWriteItem wraps the BatchWriteItem API operation for Amazon DynamoDB
@@ -217,124 +1367,312 @@ func (c *Library) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput
 //
 // Overhead: 1RU
 func (c *Library) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	return c.BatchWriteItemWithContext(aws.BackgroundContext(), input)
+}
+
+// BatchWriteItemWithContext is the same as BatchWriteItem with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) BatchWriteItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchWriteItemInput,
+) (*dynamodb.BatchWriteItemOutput, error) {
 	var snapshotID string
 	var err error
 
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	meta, err := c.loadMeta(ctx)
 	if err != nil {
-		return nil, errors.New("failed to create snapshots client: " + err.Error())
+		return nil, wrapError("failed to create snapshots client", err)
 	}
 
 	// make sure we're only writing to the managed table
 	if len(input.RequestItems) > 1 {
-		return nil, errors.New("BatchWriteItem does not support writing data to multiple tables")
+		return nil, &UnsupportedInputError{
+			Operation:      "BatchWriteItem",
+			Feature:        "RequestItems",
+			Reason:         "writing data to multiple tables",
+			multipleTables: true,
+		}
 	}
 
 	requests, ok := input.RequestItems[c.tableName]
 	if !ok {
-		return nil, errors.New("BathWriteItem can only write items to the managed table: " + c.tableName)
+		// there is a single table (or none at all)
+		mismatch := &TableMismatchError{Managed: c.tableName}
+		for table := range input.RequestItems {
+			mismatch.Table = table
+		}
+		return nil, mismatch
 	}
 
-	snapshotID, err = meta.getSnapshotID(snapshotCurrent)
+	snapshotID, err = meta.getWritableSnapshotID("BatchWriteItem", snapshotCurrent)
 	if err != nil {
-		return nil, errors.New("failed to get snapshot ID: " + err.Error())
+		return nil, wrapError("failed to get snapshot ID", err)
+	}
+
+	// add the snapshot ID to each request, keeping the keys as the user passed them
+	untag := make([]func(), 0)
+	for _, r := range requests {
+		if r.PutRequest == nil {
+			continue
+		}
+		restore, err := c.overflowItem(ctx, "BatchWriteItem", r.PutRequest.Item)
+		if err != nil {
+			for _, f := range untag {
+				f()
+			}
+			return nil, err
+		}
+		untag = append(untag, restore)
 	}
-
-	// add the snapshot ID to each request
 	for _, r := range requests {
+		var pk *dynamodb.AttributeValue
 		if r.DeleteRequest != nil {
-			c.addSnapshotToPartitionKey(snapshotID, r.DeleteRequest.Key[c.partitionKey])
+			pk = r.DeleteRequest.Key[c.partitionKey]
 		}
 		if r.PutRequest != nil {
-			c.addSnapshotToPartitionKey(snapshotID, r.PutRequest.Item[c.partitionKey])
+			pk = r.PutRequest.Item[c.partitionKey]
+			untag = append(untag, c.tagItem(r.PutRequest.Item, snapshotID))
+		}
+		if pk != nil {
+			originalKey := c.addSnapshotToPartitionKey(snapshotID, pk)
+			untag = append(untag, func() { c.restorePartitionKey(originalKey, pk) })
 		}
 	}
-	// update DDB
-	output, err := c.svc.BatchWriteItem(input)
-	// remove the snapshot ID info from the PK of requests that were not processed
-	unprocessed, ok := output.UnprocessedItems[c.tableName]
-	if ok {
-		for _, r := range unprocessed {
-			if r.DeleteRequest != nil {
-				c.removeSnapshotFromPartitionKey(r.DeleteRequest.Key[c.partitionKey])
-			}
-			if r.PutRequest != nil {
-				c.removeSnapshotFromPartitionKey(r.PutRequest.Item[c.partitionKey])
+	for _, key := range c.writeRequestKeys(requests) {
+		if err = c.checkNotMetaRow("BatchWriteItem", key); err != nil {
+			break
+		}
+	}
+	// while the table is being migrated in compatibility mode, the copies in the old key encoding of the items deleted
+	// go first, and those of the items put once they have been written (see oldEncodingDeletes)
+	if err == nil {
+		before, _ := c.oldEncodingDeletes(requests)
+		_, err = c.writeRequests(ctx, before)
+	}
+	var output *dynamodb.BatchWriteItemOutput
+	if err == nil {
+		// update DDB
+		output, err = c.storage(ctx).BatchWriteItem(input)
+	}
+	if encoding, _ := c.keyEncodings(); err == nil && c.writeKeyEncoding() != encoding {
+		unprocessed := make(map[string]bool, 0)
+		for _, key := range c.writeRequestKeys(output.UnprocessedItems[c.tableName]) {
+			s, _ := c.keyString(key)
+			unprocessed[s] = true
+		}
+		processed := make([]*dynamodb.WriteRequest, 0, len(requests))
+		for i, key := range c.writeRequestKeys(requests) {
+			if s, _ := c.keyString(key); !unprocessed[s] {
+				processed = append(processed, requests[i])
 			}
 		}
+		_, after := c.oldEncodingDeletes(processed)
+		_, err = c.writeRequests(ctx, after)
+	}
+	for _, f := range untag {
+		f()
+	}
+	if output != nil {
+		c.normalizeBatchWriteOutput(output)
 	}
 
 	return output, err
 }
 
+// remove the snapshot ID from every key in the output of BatchWriteItem, i.e., the requests that were not processed
+// and the item collection metrics, so callers never see encoded keys
+func (c *Library) normalizeBatchWriteOutput(output *dynamodb.BatchWriteItemOutput) {
+	for _, r := range output.UnprocessedItems[c.tableName] {
+		if r.DeleteRequest != nil {
+			c.removeSnapshotFromKey(r.DeleteRequest.Key)
+		}
+		if r.PutRequest != nil {
+			c.removeSnapshotFromKey(r.PutRequest.Item)
+			// these are the items as they were sent, compressed by compressItem
+			_ = c.untagItem(r.PutRequest.Item)
+		}
+	}
+
+	for _, metrics := range output.ItemCollectionMetrics[c.tableName] {
+		c.removeSnapshotFromKey(metrics.ItemCollectionKey)
+	}
+}
+
+// remove the snapshot ID from the keys in the output of a write of a single item, i.e., the item returned (see
+// ReturnValues) and the key of its item collection (see ReturnItemCollectionMetrics), so callers never see encoded keys
+func (c *Library) normalizeWriteOutput(
+	attributes map[string]*dynamodb.AttributeValue,
+	metrics *dynamodb.ItemCollectionMetrics,
+) {
+	c.removeSnapshotFromKey(attributes)
+	// the write went through either way: an attribute that fails to decompress is returned as it is stored
+	_ = c.untagItem(attributes)
+	if metrics != nil {
+		c.removeSnapshotFromKey(metrics.ItemCollectionKey)
+	}
+}
+
+// remove the snapshot ID from the keys of the items returned along with a failed condition (see
+// ReturnValuesOnConditionCheckFailure), be it the condition of a single write or of any write of a transaction
+func (c *Library) normalizeConditionFailure(err error) {
+	var failed *dynamodb.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		c.removeSnapshotFromKey(failed.Item)
+		// the error is about the condition, not the item: an attribute that fails to decompress is returned as it is
+		// stored
+		_ = c.untagItem(failed.Item)
+	}
+
+	var canceled *dynamodb.TransactionCanceledException
+	if errors.As(err, &canceled) {
+		for _, reason := range canceled.CancellationReasons {
+			c.removeSnapshotFromKey(reason.Item)
+			_ = c.untagItem(reason.Item)
+		}
+	}
+}
+
 // UpdateItem calls the UpdateItem API operation for input. The data is written to the active
 // snapshot.
 //
 // Overhead: 1RU
 func (c *Library) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	return c.UpdateItemWithContext(aws.BackgroundContext(), input)
+}
+
+// UpdateItemWithContext is the same as UpdateItem with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) UpdateItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.UpdateItemInput,
+) (*dynamodb.UpdateItemOutput, error) {
 	var snapshotID string
 	var err error
 
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	err = c.resolveTable(&input.TableName)
 	if err != nil {
-		return nil, errors.New("Failed to create snapshots client: " + err.Error())
+		return nil, err
+	}
+	err = c.checkCondition("UpdateItem", input.ConditionExpression, input.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkUpdateChecksum("UpdateItem")
+	if err != nil {
+		return nil, err
+	}
+	err = checkOverflowUpdate("UpdateItem", input.UpdateExpression, input.ExpressionAttributeNames,
+		input.AttributeUpdates)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, wrapError("Failed to create snapshots client", err)
 	}
 
-	snapshotID, err = meta.getSnapshotID(snapshotCurrent)
+	snapshotID, err = meta.getWritableSnapshotID("UpdateItem", snapshotCurrent)
 	if err != nil {
-		return nil, errors.New("Failed to get snapshot ID: " + err.Error())
+		return nil, wrapError("Failed to get snapshot ID", err)
 	}
 
 	// save the key as the user passed it and add the snapshot ID
 	originalKey := c.addSnapshotToPartitionKey(snapshotID, input.Key[c.partitionKey])
-	// update the table
-	output, err := c.svc.UpdateItem(input)
+	// the condition compares the partition key against values that need the snapshot too
+	inputCopy := *input
+	inputCopy.ConditionExpression, inputCopy.UpdateExpression, inputCopy.ExpressionAttributeValues =
+		c.rewriteCondition(input.ConditionExpression, input.UpdateExpression, input.ExpressionAttributeNames,
+			input.ExpressionAttributeValues, snapshotID)
+	inputCopy.Expected = c.rewriteExpected(input.Expected, snapshotID)
+	err = c.checkNotMetaRow("UpdateItem", input.Key)
+	// the update applies to the item even if the table is being migrated and it has not been converted yet
+	if err == nil {
+		err = c.convertOldEncodingCopies(ctx, []map[string]*dynamodb.AttributeValue{input.Key})
+	}
+	var output *dynamodb.UpdateItemOutput
+	if err == nil {
+		// update the table
+		output, err = c.storage(ctx).UpdateItem(c.tagUpdate(&inputCopy, snapshotID))
+	}
 	// restore the original PK value
 	c.restorePartitionKey(originalKey, input.Key[c.partitionKey])
 
-	return output, err
+	if err != nil {
+		c.normalizeConditionFailure(err)
+		return nil, err
+	}
+	c.normalizeWriteOutput(output.Attributes, output.ItemCollectionMetrics)
+
+	return output, nil
 }
 
 // GetItem calls the GetItem API operation on input.
 //
 // It will start by trying to get the item input from the active snapshot. If the item is not found, GetItem will
-// try to get it from all previous snapshots, one at a time, in chronological order, until it is found.
+// try to get it from all previous snapshots, one at a time, in chronological order, until it is found. With
+// WithMaxConcurrency, several snapshots are tried at a time, which is faster but may read more than needed.
 //
 // Overhead: (1+N) RU (worst case, where N is the number of snapshots)
 func (c *Library) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.GetItemWithContext(aws.BackgroundContext(), input)
+}
+
+// GetItemWithContext is the same as GetItem with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	err := c.resolveTable(&input.TableName)
 	if err != nil {
 		return nil, err
 	}
 
-	// default to fetching data from the active/current snapshot (could be latest or a rollback)
-	startFrom := meta.getCurrentSnapshotID()
-	// override in case we're browsing some specific snapshot
-	if c.browsing {
-		startFrom = c.currentSnapshot
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
 	}
 
-	snapshotIDs := meta.GetChronologicalSnapshotIDs(startFrom)
+	// default to fetching data from the active/current snapshot (could be latest, a rollback, or a pin)
+	startFrom := c.activeSnapshotID(meta)
 
-	for _, id := range snapshotIDs {
-		item, err := c.getItemWithSnapshotID(input, id)
-		if err != nil {
-			return nil, err
-		}
-		if item.Item != nil {
-			return item, nil
-		}
+	// maybe the item was created before any snapshots were created
+	snapshotIDs := append(meta.GetChronologicalSnapshotIDs(startFrom), "")
+
+	outputs := make([]*dynamodb.GetItemOutput, len(snapshotIDs))
+	found, err := c.probe(len(snapshotIDs), func(i int) (bool, error) {
+		out, err := c.getItemWithSnapshotID(ctx, input, snapshotIDs[i])
+		outputs[i] = out
+		return err == nil && out.Item != nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == -1 {
+		return outputs[len(outputs)-1], nil
 	}
 
-	// maybe the item was created before any snapshots were created
-	return c.getItemWithSnapshotID(input, "")
+	return outputs[found], nil
 }
 
 // GetItemFromSnapshot calls the GetItem API operation on input. The item will be read (if it exists) from snapshot.
 //
 // Overhead: 1RU
 func (c *Library) GetItemFromSnapshot(input *dynamodb.GetItemInput, snapshot string) (*dynamodb.GetItemOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.GetItemFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// GetItemFromSnapshotWithContext is the same as GetItemFromSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) GetItemFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	snapshot string,
+) (*dynamodb.GetItemOutput, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
 	if err != nil {
 		return nil, err
 	}
@@ -344,19 +1682,53 @@ func (c *Library) GetItemFromSnapshot(input *dynamodb.GetItemInput, snapshot str
 		return nil, err
 	}
 
-	return c.getItemWithSnapshotID(input, id)
+	return c.getItemWithSnapshotID(ctx, input, id)
 }
 
-func (c *Library) getItemWithSnapshotID(input *dynamodb.GetItemInput, id string) (*dynamodb.GetItemOutput, error) {
-	// save the key as the user passed it and add the snapshot ID before calling GetItem
-	originalKey := c.addSnapshotToPartitionKey(id, input.Key[c.partitionKey])
-	//
-	item, err := c.svc.GetItem(input)
-	// restore the PK value
-	c.restorePartitionKey(originalKey, input.Key[c.partitionKey])
+func (c *Library) getItemWithSnapshotID(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	id string,
+) (*dynamodb.GetItemOutput, error) {
+	item, _, err := c.getVersionedItemWithSnapshotID(ctx, input, id)
+	return item, err
+}
+
+// same as getItemWithSnapshotID, also returning the version attribute of the item found, if any (see
+// WithVersionAttribute)
+func (c *Library) getVersionedItemWithSnapshotID(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	id string,
+) (*dynamodb.GetItemOutput, *dynamodb.AttributeValue, error) {
+	// every probe is made with the same consistency, without changing the caller's input (probes may run in
+	// parallel, see WithMaxConcurrency)
+	request := *input
+	request.ConsistentRead = aws.Bool(c.isConsistentRead(input.ConsistentRead))
+	request.Key = make(map[string]*dynamodb.AttributeValue, len(input.Key))
+	for k, v := range input.Key {
+		request.Key[k] = v
+	}
+	pk := *input.Key[c.partitionKey]
+	request.Key[c.partitionKey] = &pk
+	// keep the key as the user passed it and add the snapshot ID before calling GetItem
+	originalKey := c.addSnapshotToPartitionKey(id, &pk)
+	// while the table is being migrated to another encoding, the item may be stored with either one
+	keys := c.migrationPartitionKeys(id, originalKey)
+	if len(keys) > 0 {
+		pk.SetN(keys[0])
+	}
+	if c.isMetaRowKey(request.Key) {
+		return &dynamodb.GetItemOutput{}, nil, nil
+	}
+	item, err := c.storage(ctx).GetItem(&request)
+	if err == nil && item.Item == nil && len(keys) > 1 {
+		pk.SetN(keys[1])
+		item, err = c.storage(ctx).GetItem(&request)
+	}
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// remove the id information from the PK (if an item for the snapshot was found)
@@ -364,8 +1736,12 @@ func (c *Library) getItemWithSnapshotID(input *dynamodb.GetItemInput, id string)
 	if ok {
 		c.restorePartitionKey(originalKey, item.Item[c.partitionKey])
 	}
+	version := item.Item[versionAttribute]
+	if err := c.readItem(ctx, item.Item); err != nil {
+		return nil, nil, err
+	}
 
-	return item, err
+	return item, version, err
 }
 
 // BatchGetItem wraps the BatchGetItem API operation for Amazon DynamoDB
@@ -381,22 +1757,27 @@ func (c *Library) getItemWithSnapshotID(input *dynamodb.GetItemInput, id string)
 //
 // Overhead: 1RU
 func (c *Library) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.BatchGetItemWithContext(aws.BackgroundContext(), input)
+}
+
+// BatchGetItemWithContext is the same as BatchGetItem with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) BatchGetItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchGetItemInput,
+) (*dynamodb.BatchGetItemOutput, error) {
+	meta, err := c.loadMetaWithConsistency(ctx, c.batchGetConsistency(input))
 	if err != nil {
 		return nil, err
 	}
 
-	// default to fetching data from the active/current snapshot (could be latest or a rollback)
-	startFrom := meta.getCurrentSnapshotID()
-	// override in case we're browsing some specific snapshot
-	if c.browsing {
-		startFrom = c.currentSnapshot
-	}
+	// default to fetching data from the active/current snapshot (could be latest, a rollback, or a pin)
+	startFrom := c.activeSnapshotID(meta)
 
 	snapshotIDs := meta.GetChronologicalSnapshotIDs(startFrom)
 
 	for _, id := range snapshotIDs {
-		output, err := c.batchGetItemWithSnapshotID(input, id)
+		output, err := c.batchGetItemWithSnapshotID(ctx, input, id)
 		if err != nil {
 			return nil, err
 		}
@@ -406,7 +1787,7 @@ func (c *Library) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.Bat
 	}
 
 	// maybe the item was created before any snapshots were created
-	return c.batchGetItemWithSnapshotID(input, "")
+	return c.batchGetItemWithSnapshotID(ctx, input, "")
 }
 
 // BatchGetItemFromSnapshot retrieves the attributes of one or more items from a specific snapshot.
@@ -416,7 +1797,17 @@ func (c *Library) BatchGetItemFromSnapshot(
 	input *dynamodb.BatchGetItemInput,
 	snapshot string,
 ) (*dynamodb.BatchGetItemOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.BatchGetItemFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// BatchGetItemFromSnapshotWithContext is the same as BatchGetItemFromSnapshot with the addition of the ability to pass
+// a context, which is passed on to every request made to the table.
+func (c *Library) BatchGetItemFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.BatchGetItemInput,
+	snapshot string,
+) (*dynamodb.BatchGetItemOutput, error) {
+	meta, err := c.loadMetaWithConsistency(ctx, c.batchGetConsistency(input))
 	if err != nil {
 		return nil, err
 	}
@@ -426,28 +1817,76 @@ func (c *Library) BatchGetItemFromSnapshot(
 		return nil, err
 	}
 
-	return c.batchGetItemWithSnapshotID(input, id)
+	return c.batchGetItemWithSnapshotID(ctx, input, id)
+}
+
+// return whether a BatchGetItem on the managed table should be strongly consistent
+func (c *Library) batchGetConsistency(input *dynamodb.BatchGetItemInput) bool {
+	keysAndAttributes, ok := input.RequestItems[c.tableName]
+	if !ok || keysAndAttributes == nil {
+		return c.consistentRead
+	}
+
+	return c.isConsistentRead(keysAndAttributes.ConsistentRead)
 }
 
 func (c *Library) batchGetItemWithSnapshotID(
+	ctx aws.Context,
 	input *dynamodb.BatchGetItemInput,
 	id string,
 ) (*dynamodb.BatchGetItemOutput, error) {
 	if len(input.RequestItems) > 1 {
-		return nil, errors.New("BatchGetItem does not support retrieving data from multiple tables")
+		return nil, &UnsupportedInputError{
+			Operation:      "BatchGetItem",
+			Feature:        "RequestItems",
+			Reason:         "retrieving data from multiple tables",
+			multipleTables: true,
+		}
 	}
 
 	keysAndAttributes, ok := input.RequestItems[c.tableName]
 	if !ok {
-		return nil, errors.New("BathGetItem can only retrieve items from the managed table: " + c.tableName)
+		// there is a single table (or none at all)
+		mismatch := &TableMismatchError{Managed: c.tableName}
+		for table := range input.RequestItems {
+			mismatch.Table = table
+		}
+		return nil, mismatch
 	}
 
-	// add the snapshot ID
+	// every probe is made with the same consistency, without changing the caller's input
+	request := *input
+	requestKeys := *keysAndAttributes
+	requestKeys.ConsistentRead = aws.Bool(c.isConsistentRead(keysAndAttributes.ConsistentRead))
+	request.RequestItems = map[string]*dynamodb.KeysAndAttributes{c.tableName: &requestKeys}
+	// add the snapshot ID, leaving out the key of the metadata row
+	requestKeys.Keys = make([]map[string]*dynamodb.AttributeValue, 0, len(keysAndAttributes.Keys))
+	// while the table is being migrated to another encoding, the items may be stored with either one: the partition
+	// key of each of the keys requested in the other one
+	others := make([]string, 0)
 	for _, k := range keysAndAttributes.Keys {
-		c.addSnapshotToPartitionKey(id, k[c.partitionKey])
+		originalKey := c.addSnapshotToPartitionKey(id, k[c.partitionKey])
+		keys := c.migrationPartitionKeys(id, originalKey)
+		if len(keys) > 1 {
+			k[c.partitionKey].SetN(keys[0])
+		}
+		if c.isMetaRowKey(k) {
+			continue
+		}
+		requestKeys.Keys = append(requestKeys.Keys, k)
+		if len(keys) > 1 {
+			others = append(others, keys[1])
+		}
 	}
 	// retrieve items
-	output, err := c.svc.BatchGetItem(input)
+	output := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]*dynamodb.AttributeValue{}}
+	var err error
+	if len(requestKeys.Keys) > 0 {
+		output, err = c.storage(ctx).BatchGetItem(&request)
+	}
+	if err == nil && len(others) > 0 {
+		output, err = c.batchGetOtherEncoding(ctx, &request, others, output)
+	}
 	// restore the PK value to the variable we received
 	for _, k := range keysAndAttributes.Keys {
 		c.removeSnapshotFromPartitionKey(k[c.partitionKey])
@@ -462,6 +1901,9 @@ func (c *Library) batchGetItemWithSnapshotID(
 	if ok {
 		for _, k := range attrs {
 			c.removeSnapshotFromPartitionKey(k[c.partitionKey])
+			if err := c.readItem(ctx, k); err != nil {
+				return nil, err
+			}
 		}
 	}
 	// remove the snapshot id from keys that have not been processed
@@ -488,117 +1930,345 @@ func (c *Library) batchGetItemWithSnapshotID(
 //
 // Overhead: 1RU
 func (c *Library) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.ScanWithContext(aws.BackgroundContext(), input)
+}
+
+// ScanWithContext is the same as Scan with the addition of the ability to pass a context, which is passed on to every
+// request made to the table.
+func (c *Library) ScanWithContext(ctx aws.Context, input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	err := c.resolveTable(&input.TableName)
 	if err != nil {
 		return nil, err
 	}
 
-	// default to fetching data from the active/current snapshot (could be latest or a rollback)
-	currentSnapshotID := meta.getCurrentSnapshotID()
-	// override in case we're browsing some specific snapshot
-	if c.browsing {
-		currentSnapshotID = c.currentSnapshot
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
 	}
 
-	return c.scanWithSnapshotID(input, currentSnapshotID)
+	// default to fetching data from the active/current snapshot (could be latest, a rollback, or a pin)
+	currentSnapshotID := c.activeSnapshotID(meta)
+
+	return c.scanWithSnapshotID(ctx, input, currentSnapshotID)
 }
 
 // ScanFromSnapshot returns one or more items by accessing every item in a table or a secondary index and filtering the
 // ones on the specified snapshot.
 //
-// If snapshot is an empty string, items from all available snapshots will be returned.
+// Baseline only returns the items written before any snapshots were taken (see ScanFromBaseline). For backwards
+// compatibility, an empty snapshot returns the items of every snapshot, like ScanAllVersions, which new code should
+// call instead.
 //
-// If input includes the partition key in ExpressionAttributeValues, it *must* be named ":pk".
+// Values compared against the partition key in FilterExpression, either directly or through an alias defined in
+// ExpressionAttributeNames, have the snapshot added to them: with a comparator, IN, BETWEEN, or begins_with. A value
+// also used for other attributes keeps the original value there. For backwards compatibility, a value named ":pk" is
+// always assumed to refer to the partition key. On tables with write sharding (see WithWriteSharding) the partition
+// key can only be compared for equality (=, <>, and IN).
 //
 // Warning: this operation will read the whole table and filter out items that do not match the specified snapshot
-// before returning the data.
+// before returning the data, unless the snapshot index is enabled (see WithSnapshotIndex).
 //
 // Overhead: 1RU
 func (c *Library) ScanFromSnapshot(input *dynamodb.ScanInput, snapshot string) (*dynamodb.ScanOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.ScanFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// ScanFromSnapshotWithContext is the same as ScanFromSnapshot with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) ScanFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+) (*dynamodb.ScanOutput, error) {
+	err := c.resolveTable(&input.TableName)
 	if err != nil {
 		return nil, err
 	}
 
-	id, err := meta.getSnapshotID(snapshot)
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := meta.getScanSnapshotID(snapshot)
 	if err != nil {
 		return nil, err
 	}
 
-	return c.scanWithSnapshotID(input, id)
+	return c.scanWithSnapshotID(ctx, input, id)
 }
 
-func (c *Library) scanWithSnapshotID(input *dynamodb.ScanInput, id string) (*dynamodb.ScanOutput, error) {
+func (c *Library) scanWithSnapshotID(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	id string,
+) (*dynamodb.ScanOutput, error) {
+	out, _, err := c.scanWithSnapshotIDs(ctx, input, id)
+	return out, err
+}
+
+// scan the items of the snapshot with the given ID, as scanWithSnapshotID does, also returning the ID of the snapshot
+// each item was written to
+func (c *Library) scanWithSnapshotIDs(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	id string,
+) (*dynamodb.ScanOutput, []string, error) {
+	out, err := c.scanStoredWithSnapshotID(ctx, input, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// remove the snapshot id from keys that have not been processed
+	ids := make([]string, len(out.Items))
+	for i, item := range out.Items {
+		ids[i] = c.removeSnapshotFromPartitionKey(item[c.partitionKey])
+		if err := c.readItem(ctx, item); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return out, ids, nil
+}
+
+// scan the items of the snapshot with the given ID as scanWithSnapshotID does, querying the snapshot index if it can,
+// but return them as they are stored, i.e., with the snapshot in the partition key and the attributes the Library
+// reserves
+func (c *Library) scanStoredWithSnapshotID(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	id string,
+) (*dynamodb.ScanOutput, error) {
+	err := c.checkFilter("Scan", input.FilterExpression, input.ExpressionAttributeNames, input.ScanFilter)
+	if err != nil {
+		return nil, err
+	}
+
 	// don't destroy the user provided input (unlike other cases, undoing changes here is tricky so we just make
-	// a copy)
+	// a copy, including the map of values we're about to change)
 	inputCopy := *input
-	// make sure the map is not nil before assigning a new value
-	if inputCopy.ExpressionAttributeValues == nil {
-		inputCopy.ExpressionAttributeValues = make(map[string]*dynamodb.AttributeValue, 0)
-	} else {
-		// add the snapshot ID to the partition key
-		_, ok := inputCopy.ExpressionAttributeValues[":pk"]
-		if ok {
-			c.addSnapshotToPartitionKey(id, inputCopy.ExpressionAttributeValues[":pk"])
-		}
+	// secondary indexes don't support strongly consistent reads, only use the default on the table itself
+	if input.IndexName == nil {
+		inputCopy.ConsistentRead = aws.Bool(c.isConsistentRead(input.ConsistentRead))
 	}
-	// we always need to filter out the row used to store our metadata
-	if c.partitionKeyType == "S" {
-		inputCopy.ExpressionAttributeValues[":metaPK"] = &dynamodb.AttributeValue{
-			S: aws.String(ddbPartitionKey),
+	// add the snapshot ID to every value compared against the partition key
+	placeholders := []string{legacyPartitionKeyPlaceholder}
+	values := input.ExpressionAttributeValues
+	if input.FilterExpression != nil {
+		if c.shard != nil || c.codec.Suffix {
+			err := checkShardedFilter(*input.FilterExpression, c.partitionKey, input.ExpressionAttributeNames)
+			if err != nil {
+				return nil, err
+			}
 		}
-	} else {
-		inputCopy.ExpressionAttributeValues[":metaPK"] = &dynamodb.AttributeValue{
-			N: aws.String(ddbPartitionKey),
+		placeholders = append(
+			placeholders,
+			partitionKeyPlaceholders(*input.FilterExpression, c.partitionKey, input.ExpressionAttributeNames)...,
+		)
+		var filter string
+		filter, values = isolatePlaceholders(*input.FilterExpression, placeholders, c.partitionKey,
+			input.ExpressionAttributeNames, values)
+		inputCopy.FilterExpression = aws.String(filter)
+	}
+	valuesID := id
+	if id == allSnapshotsID {
+		valuesID = ""
+	}
+	inputCopy.ExpressionAttributeValues = c.addSnapshotToValues(values, placeholders, valuesID)
+	// we always need to filter out the row used to store our metadata, unless it's stored elsewhere
+	filters := []string{
+		aws.StringValue(inputCopy.FilterExpression),
+		c.metaRowFilter(inputCopy.ExpressionAttributeValues),
+	}
+	// the items written before any snapshots have no prefix to filter on: they are told apart once read, which a count
+	// does not allow, so the partition key is read instead
+	countBaseline := id == "" && aws.StringValue(input.Select) == dynamodb.SelectCount
+	if countBaseline {
+		inputCopy.Select = aws.String(dynamodb.SelectSpecificAttributes)
+		inputCopy.ProjectionExpression = aws.String(baselineKeyPlaceholder)
+		inputCopy.ExpressionAttributeNames = make(map[string]*string, len(input.ExpressionAttributeNames)+1)
+		for k, v := range input.ExpressionAttributeNames {
+			inputCopy.ExpressionAttributeNames[k] = v
 		}
+		inputCopy.ExpressionAttributeNames[baselineKeyPlaceholder] = aws.String(c.partitionKey)
 	}
-	filterStr := fmt.Sprintf("%s <> :metaPK", c.partitionKey)
-	// if no snapshot was specified, there's no need for further filtering
-	if id != "" {
-		// different data types require different approaches to filtering
-		if c.partitionKeyType == "S" {
-			inputCopy.ExpressionAttributeValues[":prefix"] = &dynamodb.AttributeValue{
-				S: aws.String(getSnapshotPrefix(id)),
+	// if all snapshots were requested, there's no need for further filtering
+	if id != "" && id != allSnapshotsID {
+		// a page read from the snapshot index ends on a key of the index, which a scan of the table cannot start from,
+		// and vice versa: every page is read the same way the first one was, whether the index is ready by now or not
+		_, fromIndex := input.ExclusiveStartKey[snapshotAttribute]
+		if fromIndex {
+			if !c.snapshotIndex || !canQuerySnapshotIndex(&inputCopy) {
+				return nil, &UnsupportedInputError{
+					Operation: "ScanFromSnapshot",
+					Feature:   "ExclusiveStartKey",
+					Reason:    "it was read from the snapshot index, which this scan cannot query",
+				}
 			}
-			filterStr += fmt.Sprintf(" AND begins_with(%s, :prefix)", c.partitionKey)
-		} else {
-			idInt, err := strconv.ParseInt(id, 10, 64)
+			return c.querySnapshotIndex(ctx, input, id)
+		}
+		// a query on the snapshot index is a lot cheaper than filtering a scan of the whole table
+		if len(input.ExclusiveStartKey) == 0 && canQuerySnapshotIndex(&inputCopy) {
+			ready, err := c.ensureSnapshotIndex(ctx)
 			if err != nil {
-				return nil, errors.New("failed to convert snapshot ID to integer: " + err.Error())
-			}
-			inputCopy.ExpressionAttributeValues[":currentID"] = &dynamodb.AttributeValue{
-				N: aws.String(id),
+				return nil, wrapError("failed to set up the snapshot index", err)
 			}
-			inputCopy.ExpressionAttributeValues[":nextID"] = &dynamodb.AttributeValue{
-				N: aws.String(strconv.Itoa(int(idInt + 1))),
+			if ready {
+				return c.querySnapshotIndex(ctx, input, id)
 			}
-			filterStr += fmt.Sprintf(
-				" AND %s >= :currentID AND %s < :nextID",
-				c.partitionKey,
-				c.partitionKey,
-			)
 		}
+
+		snapshotFilter, err := c.snapshotKeyFilter(id, inputCopy.ExpressionAttributeValues)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, snapshotFilter)
 	}
 
-	// make sure the FilterExpression has been initialized and is ready for us to concatenate the rule that
-	// filters a snapshot
-	if input.FilterExpression == nil {
-		inputCopy.FilterExpression = aws.String(filterStr)
-	} else {
-		inputCopy.FilterExpression = aws.String(*inputCopy.FilterExpression + " AND " + filterStr)
+	inputCopy.FilterExpression = joinFilters(filters...)
+	if len(inputCopy.ExpressionAttributeValues) == 0 {
+		inputCopy.ExpressionAttributeValues = nil
 	}
 
-	out, err := c.svc.Scan(&inputCopy)
+	out, err := c.storage(ctx).Scan(&inputCopy)
 	if err != nil {
 		return nil, err
 	}
 
-	// remove the snapshot id from keys that have not been processed
-	for _, item := range out.Items {
-		c.removeSnapshotFromPartitionKey(item[c.partitionKey])
+	if id == "" {
+		out.Items = c.baselineItems(out.Items)
+		out.Count = aws.Int64(int64(len(out.Items)))
+	}
+	if countBaseline {
+		out.Items = nil
 	}
 
-	return out, err
+	return out, nil
+}
+
+// ScanFromBaseline is the same as ScanFromSnapshot(input, Baseline): it only returns the items written before any
+// snapshots were taken.
+//
+// Overhead: 1RU
+func (c *Library) ScanFromBaseline(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return c.ScanFromSnapshotWithContext(aws.BackgroundContext(), input, Baseline)
+}
+
+// ScanFromBaselineWithContext is the same as ScanFromBaseline with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) ScanFromBaselineWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+) (*dynamodb.ScanOutput, error) {
+	return c.ScanFromSnapshotWithContext(ctx, input, Baseline)
+}
+
+// ScanAllVersions returns one or more items by accessing every item in a table or a secondary index, regardless of
+// the snapshot it was written to: every version of every key, with the snapshot removed from the partition key. Along
+// with the output, it returns the same items as versions, in the same order, each with the snapshot it was written
+// to; the name is empty for items left behind by a snapshot that no longer exists (see CollectGarbage).
+//
+// Overhead: 1RU
+func (c *Library) ScanAllVersions(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, []ItemVersion, error) {
+	return c.ScanAllVersionsWithContext(aws.BackgroundContext(), input)
+}
+
+// ScanAllVersionsWithContext is the same as ScanAllVersions with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) ScanAllVersionsWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+) (*dynamodb.ScanOutput, []ItemVersion, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, ids, err := c.scanWithSnapshotIDs(ctx, input, allSnapshotsID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versions := make([]ItemVersion, len(out.Items))
+	for i, item := range out.Items {
+		// a snapshot that no longer exists has no name
+		name, _ := snapshotNameOrBaseline(meta, ids[i])
+		versions[i] = ItemVersion{Snapshot: name, ID: ids[i], Item: item}
+	}
+
+	return out, versions, nil
+}
+
+// placeholder for the partition key when only it is read
+const baselineKeyPlaceholder = "#baselinePK"
+
+// return the items (still with the snapshot in the partition key) written before any snapshots were taken
+func (c *Library) baselineItems(items []map[string]*dynamodb.AttributeValue) []map[string]*dynamodb.AttributeValue {
+	baseline := make([]map[string]*dynamodb.AttributeValue, 0, len(items))
+	for _, item := range items {
+		pk := item[c.partitionKey]
+		value := aws.StringValue(pk.S)
+		if c.partitionKeyType == "N" {
+			value = aws.StringValue(pk.N)
+		}
+
+		if id, _ := c.decodePartitionKey(value); id == "" {
+			baseline = append(baseline, item)
+		}
+	}
+
+	return baseline
+}
+
+// CountItems returns the number of items written to snapshot.
+//
+// If snapshot is an empty string, items from all available snapshots will be counted; Baseline only counts the items
+// written before any snapshots were taken.
+//
+// Cost: a full table scan, or a query on the snapshot index if it is enabled (see WithSnapshotIndex)
+func (c *Library) CountItems(snapshot string) (int64, error) {
+	return c.CountItemsWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// CountItemsWithContext is the same as CountItems with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) CountItemsWithContext(ctx aws.Context, snapshot string) (int64, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := meta.getScanSnapshotID(snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.countWithSnapshotID(ctx, id)
+}
+
+func (c *Library) countWithSnapshotID(ctx aws.Context, id string) (int64, error) {
+	var count int64
+
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(c.tableName),
+		Select:    aws.String(dynamodb.SelectCount),
+	}
+	for {
+		out, err := c.scanWithSnapshotID(ctx, input, id)
+		if err != nil {
+			return count, err
+		}
+		count += aws.Int64Value(out.Count)
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return count, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
 }
 
 // DeleteItem calls the DeleteItem API operation on input.
@@ -608,25 +2278,48 @@ func (c *Library) scanWithSnapshotID(input *dynamodb.ScanInput, id string) (*dyn
 //
 // Overhead: (1+N) RU (worst case, where N is the number of snapshots)
 func (c *Library) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	return c.DeleteItemWithContext(aws.BackgroundContext(), input)
+}
+
+// DeleteItemWithContext is the same as DeleteItem with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) DeleteItemWithContext(
+	ctx aws.Context,
+	input *dynamodb.DeleteItemInput,
+) (*dynamodb.DeleteItemOutput, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkCondition("DeleteItem", input.ConditionExpression, input.ExpressionAttributeNames)
 	if err != nil {
 		return nil, err
 	}
 
-	// default to fetching data from the active/current snapshot (could be latest or a rollback)
-	startFrom := meta.getCurrentSnapshotID()
-	// override in case we're browsing some specific snapshot
-	if c.browsing {
-		startFrom = c.currentSnapshot
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
 	}
 
+	// default to fetching data from the active/current snapshot (could be latest, a rollback, or a pin)
+	startFrom := c.activeSnapshotID(meta)
+
 	snapshotIDs := meta.GetChronologicalSnapshotIDs(startFrom)
 
 	// we need this to know whether or not something was deleted (and therefore stop and return)
 	// or nothing was found (and we need to try the previous snapshot)
 	input.ReturnValues = aws.String("ALL_OLD")
-	for _, id := range snapshotIDs {
-		output, err := c.deleteItemWithSnapshotID(input, id)
+	for i, id := range snapshotIDs {
+		// writes to a locked snapshot are refused even if there is nothing to delete, just like any other write
+		if i == 0 {
+			err = meta.checkUnlocked("DeleteItem", id)
+		} else {
+			err = c.checkDeleteUnlocked(ctx, meta, "DeleteItem", input.Key, id)
+		}
+		if err != nil {
+			return nil, err
+		}
+		output, err := c.deleteItemWithSnapshotID(ctx, "DeleteItem", input, id)
 		if err == nil {
 			if output.Attributes != nil {
 				return output, nil
@@ -635,20 +2328,42 @@ func (c *Library) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteI
 	}
 
 	// maybe the item was created before any snapshots existed
-	return c.deleteItemWithSnapshotID(input, "")
+	return c.deleteItemWithSnapshotID(ctx, "DeleteItem", input, "")
 }
 
 // DeleteItemFromSnapshot calls the DeleteItem API operation on input. The item will be deleted (if it exists) from
 // snapshot.
 //
 // Overhead: 1RU
-func (c *Library) DeleteItemFromSnapshot(input *dynamodb.DeleteItemInput, snapshot string) (*dynamodb.DeleteItemOutput, error) {
-	meta, err := newMeta(c.svc, c.tableName, c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+func (c *Library) DeleteItemFromSnapshot(
+	input *dynamodb.DeleteItemInput,
+	snapshot string,
+) (*dynamodb.DeleteItemOutput, error) {
+	return c.DeleteItemFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// DeleteItemFromSnapshotWithContext is the same as DeleteItemFromSnapshot with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) DeleteItemFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.DeleteItemInput,
+	snapshot string,
+) (*dynamodb.DeleteItemOutput, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkCondition("DeleteItem", input.ConditionExpression, input.ExpressionAttributeNames)
 	if err != nil {
 		return nil, err
 	}
 
-	id, err := meta.getSnapshotID(snapshot)
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := meta.getWritableSnapshotID("DeleteItem", snapshot)
 	if err != nil {
 		return nil, err
 	}
@@ -657,18 +2372,41 @@ func (c *Library) DeleteItemFromSnapshot(input *dynamodb.DeleteItemInput, snapsh
 	// or nothing was found (and we need to try the previous snapshot)
 	input.ReturnValues = aws.String("ALL_OLD")
 
-	return c.deleteItemWithSnapshotID(input, id)
+	return c.deleteItemWithSnapshotID(ctx, "DeleteItem", input, id)
 }
 
-func (c *Library) deleteItemWithSnapshotID(input *dynamodb.DeleteItemInput, id string) (*dynamodb.DeleteItemOutput, error) {
+func (c *Library) deleteItemWithSnapshotID(
+	ctx aws.Context,
+	operation string,
+	input *dynamodb.DeleteItemInput,
+	id string,
+) (*dynamodb.DeleteItemOutput, error) {
 	// save the key as the user passed it and add the snapshot ID before calling DeleteItem
 	originalKey := c.addSnapshotToPartitionKey(id, input.Key[c.partitionKey])
-	//
-	output, err := c.svc.DeleteItem(input)
+	// the condition compares the partition key against values that need the snapshot too
+	inputCopy := *input
+	inputCopy.ConditionExpression, _, inputCopy.ExpressionAttributeValues = c.rewriteCondition(
+		input.ConditionExpression, nil, input.ExpressionAttributeNames, input.ExpressionAttributeValues, id)
+	inputCopy.Expected = c.rewriteExpected(input.Expected, id)
+	err := c.checkNotMetaRow(operation, input.Key)
+	// nothing is to be left in the old encoding if the table is being migrated, for it would be converted back
+	if err == nil {
+		err = c.convertOldEncodingCopies(ctx, []map[string]*dynamodb.AttributeValue{input.Key})
+	}
+	var output *dynamodb.DeleteItemOutput
+	if err == nil {
+		output, err = c.storage(ctx).DeleteItem(&inputCopy)
+	}
 	// restore the PK value
 	c.restorePartitionKey(originalKey, input.Key[c.partitionKey])
 
-	return output, err
+	if err != nil {
+		c.normalizeConditionFailure(err)
+		return nil, err
+	}
+	c.normalizeWriteOutput(output.Attributes, output.ItemCollectionMetrics)
+
+	return output, nil
 }
 
 // add a snapshot ID to the partition key of a given attribute
@@ -681,13 +2419,12 @@ func (c *Library) addSnapshotToPartitionKey(snapshotID string, pk *dynamodb.Attr
 		originalKey = *pk.N
 	}
 
-	// just skip it if there's no snapshot ID
-	if snapshotID == "" {
+	// create the new partition key which include the snapshot and update the attribute;
+	// just skip it if there's nothing to add, i.e., no snapshot ID and no write sharding
+	snapshotKey := c.encodePartitionKey(snapshotID, originalKey)
+	if snapshotKey == originalKey {
 		return originalKey
 	}
-
-	// create the new partition key which include the snapshot and update the attribute
-	snapshotKey := fmt.Sprintf("%s%s", getSnapshotPrefix(snapshotID), originalKey)
 	if c.partitionKeyType == "S" {
 		pk.SetS(snapshotKey)
 	} else {
@@ -706,8 +2443,8 @@ func (c *Library) restorePartitionKey(original string, pk *dynamodb.AttributeVal
 	}
 }
 
-// remove the snapshot ID from a partition key by finding the delimiter and removing everything to its left
-func (c *Library) removeSnapshotFromPartitionKey(pk *dynamodb.AttributeValue) {
+// remove the snapshot ID from a partition key (if it has one), returning it
+func (c *Library) removeSnapshotFromPartitionKey(pk *dynamodb.AttributeValue) string {
 	var keyWithSnapshot *string
 
 	if c.partitionKeyType == "S" {
@@ -716,17 +2453,22 @@ func (c *Library) removeSnapshotFromPartitionKey(pk *dynamodb.AttributeValue) {
 		keyWithSnapshot = pk.N
 	}
 
-	i := strings.Index(*keyWithSnapshot, snapshotDelimiter)
-	if i != -1 {
-		key := (*keyWithSnapshot)[i+1:]
+	id, key := c.decodePartitionKey(*keyWithSnapshot)
+	if key != *keyWithSnapshot {
 		if c.partitionKeyType == "S" {
 			pk.SetS(key)
 		} else {
 			pk.SetN(key)
 		}
 	}
+
+	return id
 }
 
-func getSnapshotPrefix(snapshotID string) string {
-	return fmt.Sprintf("%s%s", snapshotID, snapshotDelimiter)
+// remove the snapshot ID from the partition key of a key or item, if it has one
+func (c *Library) removeSnapshotFromKey(key map[string]*dynamodb.AttributeValue) {
+	pk, ok := key[c.partitionKey]
+	if ok && pk != nil {
+		c.removeSnapshotFromPartitionKey(pk)
+	}
 }
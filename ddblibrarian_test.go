@@ -21,25 +21,32 @@
 package ddblibrarian
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/marcoalmeida/ddblibrarian/localtest"
 )
 
 const (
 	ddbTableName = "dynamodb-librarian"
 	ddbRegion    = "local"
-	ddbEndpoint  = "http://localhost:8000"
 )
 
-var ddbService *dynamodb.DynamoDB
-var ddbSession *session.Session
+// the DynamoDB Local instances the integration tests run against (see localtest.FromEnv)
+var (
+	testPoolOnce sync.Once
+	testPool     *localtest.Pool
+	testPoolErr  error
+)
 
 // we always need to test things on 4 different schemas: (simple or composite indexes) x (string or number)
 // the following set of constants allows us to index the common parameters by the schema being tested
@@ -230,21 +237,29 @@ func getPartitionKeyValue(schema int, attr map[string]*dynamodb.AttributeValue)
 	}
 }
 
-func setupTest(schema int, t *testing.T) (*Library, func(test int, t *testing.T)) {
-	t.Log("setting up schema", schema, "on table", getTableName(schema))
-	var err error
-
-	ddbSession, err = session.NewSession(&aws.Config{
-		Region:     aws.String(ddbRegion),
-		Endpoint:   aws.String(ddbEndpoint),
-		MaxRetries: aws.Int(1),
+// return a session of the DynamoDB Local instance t runs against, which t holds on to until it is done: every test
+// creates the same tables (see localtest.Pool.Session)
+func testSession(t *testing.T) *session.Session {
+	testPoolOnce.Do(func() {
+		testPool, testPoolErr = localtest.FromEnv(ddbRegion)
 	})
-	if err != nil {
-		t.Error(err)
+	if testPoolErr != nil {
+		t.Fatal(testPoolErr)
 	}
 
-	ddbService = dynamodb.New(ddbSession)
-	_, err = ddbService.CreateTable(&dynamodb.CreateTableInput{
+	return testPool.Session(t)
+}
+
+// return a client of the DynamoDB Local instance t runs against (see testSession)
+func testService(t *testing.T) *dynamodb.DynamoDB {
+	return dynamodb.New(testSession(t))
+}
+
+func setupTest(schema int, t *testing.T) (*Library, func(test int, t *testing.T)) {
+	ddbSession, ddbService := testSession(t), testService(t)
+	t.Log("setting up schema", schema, "on table", getTableName(schema))
+
+	_, err := ddbService.CreateTable(&dynamodb.CreateTableInput{
 		TableName:             aws.String(getTableName(schema)),
 		KeySchema:             keySchema[schema],
 		AttributeDefinitions:  attributeDefinitions[schema],
@@ -461,8 +476,22 @@ func TestLibrary_Snapshot(t *testing.T) {
 			}
 		}
 		err := library.Snapshot("too-much")
+		if e, ok := err.(*SnapshotLimitError); !ok || e.Limit != 99 {
+			t.Error("Expected snapshot to fail with a *SnapshotLimitError: more than 99, got", err)
+		}
+
+		// longer IDs allow for more
+		err = library.SetSnapshotIDLength(1)
 		if err == nil {
-			t.Error("Expected snapshot to fail: more than 99")
+			t.Error("Expected an error making IDs shorter")
+		}
+		err = library.SetSnapshotIDLength(3)
+		if err != nil {
+			t.Error("Expected no errors, got", err)
+		}
+		err = library.Snapshot("too-much")
+		if err != nil {
+			t.Error("Expected no errors, got", err)
 		}
 
 		teardown(schema, t)
@@ -506,11 +535,9 @@ func TestBrowse(t *testing.T) {
 		library, teardown := setupTest(schema, t)
 
 		// there should be no snapshots yet
-		if library.currentSnapshot != "" {
-			t.Error(
-				"Expected empty ID querying the current snapshot",
-				"got ID", library.currentSnapshot,
-			)
+		current, err := library.CurrentSnapshot()
+		if err != nil || current != Baseline {
+			t.Error("Expected the baseline as the current snapshot, got", current, err)
 		}
 
 		// take a couple of snapshots
@@ -521,12 +548,21 @@ func TestBrowse(t *testing.T) {
 			}
 		}
 		library.Browse("snap1")
-		// expect some ID
-		if library.currentSnapshot == "" {
-			t.Error(
-				"Expected some ID querying the current snapshot",
-				"got and empty string",
-			)
+		if !library.IsBrowsing() {
+			t.Error("Expected to be browsing")
+		}
+		// the table's active snapshot does not change
+		current, err = library.CurrentSnapshot()
+		if err != nil || current != "snap1" {
+			t.Error("Expected snap1 as the current snapshot, got", current, err)
+		}
+		active, err := library.ActiveSnapshotName()
+		if err != nil || active != "snap2" {
+			t.Error("Expected snap2 as the active snapshot, got", active, err)
+		}
+		library.StopBrowsing()
+		if library.IsBrowsing() {
+			t.Error("Expected not to be browsing")
 		}
 
 		teardown(schema, t)
@@ -556,6 +592,126 @@ func TestSnapshot(t *testing.T) {
 	}
 }
 
+func TestSnapshotPreconditions(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		get := func() string {
+			out, err := library.GetItem(&dynamodb.GetItemInput{
+				TableName: aws.String(getTableName(schema)),
+				Key:       getAttributeValueForKey(schema),
+			})
+			if err != nil || out.Item == nil {
+				t.Error("expected an item, got", out, err)
+				return ""
+			}
+			return *out.Item[valueField].S
+		}
+		put := func(tag string) {
+			_, err := library.PutItem(&dynamodb.PutItemInput{
+				TableName: aws.String(getTableName(schema)),
+				Item:      getAttributeValueForItem(schema, tag),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		library.Snapshot("1")
+		put("1")
+		library.Snapshot("2", RequireTableActive())
+		put("2")
+		library.Rollback("1")
+
+		err := library.Snapshot("3")
+		if err == nil {
+			t.Error("expected an error when taking a snapshot while rolled back")
+		}
+		err = library.Snapshot("3", RequireActiveEqualsLatest(false))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		// the new snapshot sees the data of the one it branches off, not the data of the snapshots taken after it
+		if got := get(); got != fmtValueTag("1") {
+			t.Error("expected", fmtValueTag("1"), "got", got)
+		}
+		put("3")
+		if got := get(); got != fmtValueTag("3") {
+			t.Error("expected", fmtValueTag("3"), "got", got)
+		}
+
+		library.Rollback("2")
+		if got := get(); got != fmtValueTag("2") {
+			t.Error("expected", fmtValueTag("2"), "got", got)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestConfig_getNextAvailableID(t *testing.T) {
+	meta := &config{snapshots: make(map[string]*dynamodb.AttributeValue, 0), snapshotIDLength: 1}
+	for i := 1; i < 10; i++ {
+		id, err := meta.getNextAvailableID()
+		if err != nil || id != strconv.Itoa(i) {
+			t.Error("expected", i, "got", id, err)
+		}
+		meta.snapshots[id] = &dynamodb.AttributeValue{S: aws.String(id)}
+	}
+
+	_, err := meta.getNextAvailableID()
+	if e, ok := err.(*SnapshotLimitError); !ok || e.Limit != 9 || e.IDLength != 1 {
+		t.Error("expected a *SnapshotLimitError, got", err)
+	}
+
+	// destroyed snapshots free their IDs once their items are gone
+	delete(meta.snapshots, "4")
+	meta.destroyingIDs = map[string]bool{"4": true}
+	_, err = meta.getNextAvailableID()
+	if _, ok := err.(*SnapshotLimitError); !ok {
+		t.Error("expected a *SnapshotLimitError while 4 is being destroyed, got", err)
+	}
+	delete(meta.destroyingIDs, "4")
+	id, err := meta.getNextAvailableID()
+	if err != nil || id != "4" {
+		t.Error("expected 4, got", id, err)
+	}
+}
+
+func TestConfig_GetChronologicalSnapshotIDs(t *testing.T) {
+	// 1 <- 2 <- 3, and 4 branches off 1, 5 off 4, and 6 off the data written before any snapshots
+	meta := &config{
+		snapshots: map[string]*dynamodb.AttributeValue{
+			"a": {S: aws.String("1")},
+			"b": {S: aws.String("2")},
+			"c": {S: aws.String("3")},
+			"d": {S: aws.String("4")},
+			"e": {S: aws.String("5")},
+			"f": {S: aws.String("6")},
+		},
+		chronologicalSnapshotIDs: []string{"6", "5", "4", "3", "2", "1"},
+		snapshotInfo: map[string]*dynamodb.AttributeValue{
+			"d": {M: map[string]*dynamodb.AttributeValue{snapshotInfoParent: parentAttributeValue("1")}},
+			"e": {M: map[string]*dynamodb.AttributeValue{snapshotInfoParent: parentAttributeValue("4")}},
+			"f": {M: map[string]*dynamodb.AttributeValue{snapshotInfoParent: parentAttributeValue("")}},
+		},
+	}
+
+	tests := map[string][]string{
+		"3": {"3", "2", "1"},
+		"4": {"4", "1"},
+		"5": {"5", "4", "1"},
+		"6": {"6"},
+		"":  {},
+	}
+	for first, expected := range tests {
+		got := meta.GetChronologicalSnapshotIDs(first)
+		if !reflect.DeepEqual(got, expected) {
+			t.Error("expected", expected, "starting from", first, "got", got)
+		}
+	}
+}
+
 func TestLibrary_ListSnapshots(t *testing.T) {
 	for _, schema := range possibleSchemas {
 		library, teardown := setupTest(schema, t)
@@ -586,6 +742,322 @@ func TestLibrary_ListSnapshots(t *testing.T) {
 		if len(existingIDs) != len(snapshots) {
 			t.Error("Expected", len(snapshots), "snapshot IDs, got", existingIDs)
 		}
+		// most recent first, with the latest one being written to
+		for i, info := range existingIDs {
+			name := snapshots[len(snapshots)-1-i]
+			if info.Name != name || info.ID == "" || info.Created.IsZero() || info.Latest != (i == 0) ||
+				info.Current != (i == 0) {
+				t.Error("unexpected information about", name, "got", info)
+			}
+		}
+
+		library.Rollback("first")
+		existingIDs, _ = library.ListSnapshots()
+		if len(existingIDs) != len(snapshots) || !existingIDs[2].Current || existingIDs[0].Current {
+			t.Error("expected the first snapshot to be the current one, got", existingIDs)
+		}
+		ids, _ := library.ListSnapshotIDs()
+		for i, info := range existingIDs {
+			if i >= len(ids) || ids[i] != info.ID {
+				t.Error("expected the deprecated list to have the same IDs, got", ids)
+			}
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_DescribeSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		library.Snapshot("plain")
+		err := library.Snapshot("backup1", SnapshotDescription("before the schema migration"))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		info, err := library.DescribeSnapshot("backup1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if info == nil || info.Name != "backup1" || info.Description != "before the schema migration" ||
+			info.Created.IsZero() || !info.Current || !info.Latest {
+			t.Error("unexpected description of backup1, got", info)
+		}
+		info, err = library.DescribeSnapshot("plain")
+		if err != nil || info.Description != "" || info.Latest {
+			t.Error("expected no description, got", info, err)
+		}
+
+		snapshots, _ := library.ListSnapshots()
+		if len(snapshots) != 2 || snapshots[0].Description != "before the schema migration" {
+			t.Error("expected ListSnapshots to include the description, got", snapshots)
+		}
+
+		_, err = library.DescribeSnapshot("nope")
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+		_, err = library.DescribeSnapshot(snapshotLatest)
+		if err == nil {
+			t.Error("expected an error for a special snapshot name")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_SnapshotIDMap(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		for _, s := range []string{"first", "second"} {
+			err := library.Snapshot(s)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		byName, byID, err := library.SnapshotIDMap()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(byName) != 2 || len(byID) != 2 {
+			t.Error("expected 2 snapshots, got", byName, byID)
+		}
+		// the IDs are the ones items are stored with
+		snapshots, _ := library.ListSnapshots()
+		for _, s := range snapshots {
+			if byName[s.Name] != s.ID || byID[s.ID] != s.Name {
+				t.Error("expected", s.Name, "to map to", s.ID, "got", byName[s.Name], byID[s.ID])
+			}
+		}
+		// most recent first
+		if len(snapshots) > 0 && snapshots[0].Name != "second" {
+			t.Error("expected the second snapshot first, got", snapshots)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_BrowseByID(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		// one version of the item in each snapshot
+		for _, s := range []string{"first", "second"} {
+			library.Snapshot(s)
+			library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: getAttributeValueForItem(schema, s)})
+		}
+
+		byName, _, _ := library.SnapshotIDMap()
+		name, err := library.GetSnapshotNameByID(byName["first"])
+		if err != nil || name != "first" {
+			t.Error("expected first, got", name, err)
+		}
+		_, err = library.GetSnapshotNameByID("99")
+		if err == nil {
+			t.Error("expected an error for an ID that does not exist")
+		}
+
+		err = library.BrowseByID(byName["first"])
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		out, err := library.GetItem(&dynamodb.GetItemInput{TableName: table, Key: getAttributeValueForKey(schema)})
+		if err != nil || *out.Item[valueField].S != fmtValueTag("first") {
+			t.Error("expected the version of the first snapshot, got", out, err)
+		}
+		library.StopBrowsing()
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_PushBrowse(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+		get := func() string {
+			out, err := library.GetItem(&dynamodb.GetItemInput{TableName: table, Key: getAttributeValueForKey(schema)})
+			if err != nil || out.Item == nil {
+				t.Error("expected no errors, got", out, err)
+				return ""
+			}
+			return *out.Item[valueField].S
+		}
+
+		// one version of the item in each snapshot
+		for _, s := range []string{"first", "second", "third"} {
+			library.Snapshot(s)
+			library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: getAttributeValueForItem(schema, s)})
+		}
+
+		err := library.PushBrowse("first")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if v := get(); v != fmtValueTag("first") {
+			t.Error("expected the version of the first snapshot, got", v)
+		}
+		err = library.PushBrowse("second")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if v := get(); v != fmtValueTag("second") {
+			t.Error("expected the version of the second snapshot, got", v)
+		}
+
+		// popping goes back to the previous state regardless of what happened in between
+		library.StopBrowsing()
+		err = library.PopBrowse()
+		if err != nil || !library.IsBrowsing() {
+			t.Error("expected to be browsing again, got", err)
+		}
+		if v := get(); v != fmtValueTag("first") {
+			t.Error("expected the version of the first snapshot, got", v)
+		}
+		err = library.PopBrowse()
+		if err != nil || library.IsBrowsing() {
+			t.Error("expected to no longer be browsing, got", err)
+		}
+		if v := get(); v != fmtValueTag("third") {
+			t.Error("expected the version of the third snapshot, got", v)
+		}
+
+		// nothing is saved when browsing fails
+		err = library.PushBrowse("nope")
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+		err = library.PopBrowse()
+		if !errors.Is(err, ErrBrowseStackEmpty) {
+			t.Error("expected ErrBrowseStackEmpty, got", err)
+		}
+
+		// a saved snapshot destroyed since, whose ID a new snapshot takes over, is not browsed again
+		library.PushBrowse("first")
+		library.PushBrowse("second")
+		err = library.DestroySnapshot("first")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		library.Snapshot("fourth")
+		err = library.PopBrowse()
+		if !errors.Is(err, ErrSnapshotNotFound) || library.IsBrowsing() {
+			t.Error("expected ErrSnapshotNotFound and to no longer be browsing, got", err)
+		}
+		err = library.PopBrowse()
+		if err != nil || library.IsBrowsing() {
+			t.Error("expected to no longer be browsing, got", err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_DestroySnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+		get := func() string {
+			out, err := library.GetItem(&dynamodb.GetItemInput{TableName: table, Key: getAttributeValueForKey(schema)})
+			if err != nil || out.Item == nil {
+				t.Error("expected no errors, got", out, err)
+				return ""
+			}
+			return *out.Item[valueField].S
+		}
+
+		// one version of the item in each snapshot
+		for _, s := range []string{"first", "second", "third"} {
+			library.Snapshot(s)
+			library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: getAttributeValueForItem(schema, s)})
+		}
+
+		err := library.DestroySnapshot("third")
+		if err == nil {
+			t.Error("expected an error destroying the active snapshot without forcing it")
+		}
+		err = library.DestroySnapshot("")
+		if err == nil {
+			t.Error("expected an error destroying the data written before any snapshots")
+		}
+
+		err = library.DestroySnapshot("second")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		// most recent first
+		snapshots, _ := library.ListSnapshots()
+		if len(snapshots) != 2 || snapshots[0].Name != "third" || snapshots[1].Name != "first" {
+			t.Error("expected [third first], got", snapshots)
+		}
+		_, err = library.GetItemFromSnapshot(&dynamodb.GetItemInput{
+			TableName: table,
+			Key:       getAttributeValueForKey(schema),
+		}, "second")
+		if err == nil {
+			t.Error("expected an error reading from a destroyed snapshot")
+		}
+		if v := get(); v != fmtValueTag("third") {
+			t.Error("expected the version of the third snapshot, got", v)
+		}
+
+		// the active snapshot goes back to the one it was taken on top of
+		err = library.DestroySnapshot("third", ForceDestroy())
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if v := get(); v != fmtValueTag("first") {
+			t.Error("expected the version of the first snapshot, got", v)
+		}
+		out, err := library.Scan(&dynamodb.ScanInput{TableName: table})
+		if err != nil || len(out.Items) != 1 {
+			t.Error("expected a single item left, got", out, err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_PlanDestroySnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 3, t)
+		library.Snapshot("first")
+		nItems := 15
+		putItems(library, schema, nItems, t)
+		library.Snapshot("second")
+
+		_, err := library.PlanDestroySnapshot("second")
+		if err == nil {
+			t.Error("expected an error planning to destroy the active snapshot without forcing it")
+		}
+
+		plan, err := library.PlanDestroySnapshot("first")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if plan.Snapshot != "first" || plan.Items != int64(nItems) || plan.WriteUnits != int64(nItems) {
+			t.Error("expected", nItems, "items to delete from first, got", plan)
+		}
+		if len(plan.Sample) != destroyPlanSampleSize {
+			t.Error("expected", destroyPlanSampleSize, "sample keys, got", plan.Sample)
+		}
+		if plan.WriteCapacity > 0 && plan.Estimate <= 0 {
+			t.Error("expected an estimate at", plan.WriteCapacity, "WCU, got", plan.Estimate)
+		}
+
+		// nothing was deleted
+		count, err := library.CountItems("first")
+		if err != nil || count != int64(nItems) {
+			t.Error("expected", nItems, "items left on first, got", count, err)
+		}
 
 		teardown(schema, t)
 	}
@@ -661,6 +1133,148 @@ func TestLibrary_GetItem(t *testing.T) {
 	}
 }
 
+func TestLibrary_ConsistentReads(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		consistent := newClient(schema, t, WithConsistentReads())
+
+		// an item written to the first of two snapshots can only be found by probing past the active one
+		library.Snapshot("1")
+		library.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      getAttributeValueForItem(schema, "consistent"),
+		})
+		library.Snapshot("2")
+
+		for _, requested := range []*bool{nil, aws.Bool(true), aws.Bool(false)} {
+			input := &dynamodb.GetItemInput{
+				TableName:      aws.String(getTableName(schema)),
+				Key:            getAttributeValueForKey(schema),
+				ConsistentRead: requested,
+			}
+			out, err := consistent.GetItem(input)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			} else if out.Item == nil || *out.Item[valueField].S != "consistent" {
+				t.Error("expected the item written to snapshot 1, got", out.Item)
+			}
+			// the caller's input is left untouched
+			if input.ConsistentRead != requested {
+				t.Error("expected ConsistentRead to be", requested, "got", input.ConsistentRead)
+			}
+		}
+
+		// the default applies to scans as well
+		out, err := consistent.ScanFromSnapshot(&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if len(out.Items) != 1 {
+			t.Error("expected 1 item, got", len(out.Items))
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_WithTable(t *testing.T) {
+	library, teardown := setupTest(SIMPLE_S, t)
+	_, otherTeardown := setupTest(COMPOSITE_N, t)
+
+	other, err := library.WithTable(
+		getTableName(COMPOSITE_N),
+		partitionKey,
+		partitionKeyType[COMPOSITE_N],
+		rangeKey[COMPOSITE_N],
+		rangeKeyType[COMPOSITE_N],
+		WithConsistentReads(),
+	)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if other.svc != library.svc {
+		t.Error("expected the DynamoDB client to be shared")
+	}
+	if !other.consistentRead || library.consistentRead {
+		t.Error("expected the additional options to only apply to the new Library")
+	}
+
+	// each Library manages its own table
+	other.Snapshot("other")
+	snapshots, _ := library.ListSnapshots()
+	if len(snapshots) != 0 {
+		t.Error("expected no snapshots on", getTableName(SIMPLE_S), "got", snapshots)
+	}
+	snapshots, _ = other.ListSnapshots()
+	if len(snapshots) != 1 {
+		t.Error("expected 1 snapshot on", getTableName(COMPOSITE_N), "got", snapshots)
+	}
+
+	_, err = library.WithTable("nope", partitionKey, "B", "", "")
+	if err == nil {
+		t.Error("expected an error for an invalid key type")
+	}
+
+	otherTeardown(COMPOSITE_N, t)
+	teardown(SIMPLE_S, t)
+}
+
+func TestNewFromTable(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		_, teardown := setupTest(schema, t)
+
+		library, err := NewFromTable(getTableName(schema), testSession(t))
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if library.partitionKey != partitionKey || library.partitionKeyType != partitionKeyType[schema] ||
+			library.rangeKey != rangeKey[schema] || library.rangeKeyType != rangeKeyType[schema] {
+			t.Error("unexpected key schema:", library.partitionKey, library.partitionKeyType, library.rangeKey,
+				library.rangeKeyType)
+		}
+
+		teardown(schema, t)
+	}
+
+	_, err := NewFromTable("doesnotexist", testSession(t))
+	if err == nil {
+		t.Error("expected an error for a table that does not exist")
+	}
+}
+
+func TestDescribeKeySchema(t *testing.T) {
+	table := &dynamodb.TableDescription{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("title"), AttributeType: aws.String("S")},
+			{AttributeName: aws.String("year"), AttributeType: aws.String("N")},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("year"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String("title"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+	}
+	pk, pkType, rk, rkType, err := describeKeySchema(table)
+	if err != nil || pk != "year" || pkType != "N" || rk != "title" || rkType != "S" {
+		t.Error("expected year (N) and title (S), got", pk, pkType, rk, rkType, err)
+	}
+
+	table.KeySchema = table.KeySchema[1:]
+	_, _, _, _, err = describeKeySchema(table)
+	if err == nil {
+		t.Error("expected an error without a partition key")
+	}
+}
+
+func TestLibrary_isConsistentRead(t *testing.T) {
+	for _, library := range []*Library{{}, {consistentRead: true}} {
+		if library.isConsistentRead(nil) != library.consistentRead {
+			t.Error("expected the default,", library.consistentRead)
+		}
+		if !library.isConsistentRead(aws.Bool(true)) || library.isConsistentRead(aws.Bool(false)) {
+			t.Error("expected the caller's preference to win over the default")
+		}
+	}
+}
+
 func TestBatchGetItem(t *testing.T) {
 	for _, schema := range possibleSchemas {
 		library, teardown := setupTest(schema, t)
@@ -806,6 +1420,282 @@ func TestBatchGetItem(t *testing.T) {
 	}
 }
 
+func TestLibrary_GetItems(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		keyWithPK := func(pk string) map[string]*dynamodb.AttributeValue {
+			key := getAttributeValueForKey(schema)
+			if partitionKeyType[schema] == "S" {
+				key[partitionKey] = &dynamodb.AttributeValue{S: aws.String(pk)}
+			} else {
+				key[partitionKey] = &dynamodb.AttributeValue{N: aws.String(pk)}
+			}
+			return key
+		}
+		put := func(pk string, valueTag string) {
+			item := keyWithPK(pk)
+			item[valueField] = &dynamodb.AttributeValue{S: aws.String(fmtValueTag(valueTag))}
+			_, err := library.PutItem(&dynamodb.PutItemInput{TableName: aws.String(getTableName(schema)), Item: item})
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+
+		library.Snapshot("1")
+		put("1", "1")
+		library.Snapshot("2")
+		put("2", "2")
+
+		keys := []map[string]*dynamodb.AttributeValue{keyWithPK("2"), keyWithPK("3"), keyWithPK("1"), keyWithPK("2")}
+		items, err := library.GetItems(keys, "")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		expected := []string{fmtValueTag("2"), "", fmtValueTag("1"), fmtValueTag("2")}
+		if len(items) != len(expected) {
+			t.Fatal("expected", len(expected), "items, got", len(items))
+		}
+		for i, item := range items {
+			switch {
+			case expected[i] == "" && item != nil:
+				t.Error("expected a nil placeholder at", i, "got", item)
+			case expected[i] != "" && (item == nil || aws.StringValue(item[valueField].S) != expected[i]):
+				t.Error("expected", expected[i], "at", i, "got", item)
+			case item != nil && aws.StringValue(getPartitionKeyValue(schema, item)) !=
+				aws.StringValue(getPartitionKeyValue(schema, keys[i])):
+				t.Error("expected the partition key without the snapshot, got", item)
+			}
+		}
+
+		// the second item did not exist yet
+		items, err = library.GetItems(keys, "1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(items) != len(keys) || items[0] != nil || items[1] != nil || items[2] == nil || items[3] != nil {
+			t.Error("expected only the first item on snapshot 1, got", items)
+		}
+
+		_, err = library.GetItems(keys, "does-not-exist")
+		if err == nil {
+			t.Error("expected error reading from a snapshot that does not exist")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_BatchGetAll(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// more than a single batch, half of it written before the snapshot
+		nItems := 150
+		putItems(library, schema, nItems/2, t)
+		library.Snapshot("1")
+		putItems(library, schema, nItems, t)
+
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, nItems+2)
+		for i := 0; i < nItems+1; i++ {
+			key := getAttributeValueForKey(schema)
+			if partitionKeyType[schema] == "S" {
+				key[partitionKey].SetS(strconv.Itoa(i))
+			} else {
+				key[partitionKey].SetN(strconv.Itoa(i))
+			}
+			keys = append(keys, key)
+		}
+		// a key that appears twice, and one that does not exist
+		keys = append(keys, keys[0])
+
+		out, err := library.BatchGetAll(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{
+				getTableName(schema): {
+					Keys:                     keys,
+					ProjectionExpression:     aws.String("#v"),
+					ExpressionAttributeNames: map[string]*string{"#v": aws.String(valueField)},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if len(out.UnprocessedKeys) != 0 {
+			t.Error("expected no unprocessed keys, got", out.UnprocessedKeys)
+		}
+		items := out.Responses[getTableName(schema)]
+		if len(items) != nItems {
+			t.Error("expected", nItems, "items, got", len(items))
+		}
+		seen := make(map[string]bool, len(items))
+		for _, item := range items {
+			pk := aws.StringValue(getPartitionKeyValue(schema, item))
+			if seen[pk] {
+				t.Error("expected each item once, got", pk, "twice")
+			}
+			seen[pk] = true
+			if item[valueField] == nil {
+				t.Error("expected the projected attribute, got", item)
+			}
+		}
+		if seen[strconv.Itoa(nItems)] {
+			t.Error("expected no item for a key that does not exist")
+		}
+
+		_, err = library.BatchGetAll(&dynamodb.BatchGetItemInput{
+			RequestItems: map[string]*dynamodb.KeysAndAttributes{"doesnotexist": {Keys: keys}},
+		})
+		if err == nil {
+			t.Error("expected error reading from a table that is not managed")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_PutItemsDeleteItems(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		key := func(i int) map[string]*dynamodb.AttributeValue {
+			k := getAttributeValueForKey(schema)
+			if partitionKeyType[schema] == "S" {
+				k[partitionKey].SetS(strconv.Itoa(i))
+			} else {
+				k[partitionKey].SetN(strconv.Itoa(i))
+			}
+			return k
+		}
+
+		// more than a single batch, with the first key written twice
+		nItems := 60
+		items := make([]map[string]*dynamodb.AttributeValue, 0, nItems+1)
+		keys := make([]map[string]*dynamodb.AttributeValue, 0, nItems)
+		for i := 0; i < nItems; i++ {
+			item := key(i)
+			item[valueField] = &dynamodb.AttributeValue{S: aws.String(fmtValueTag(strconv.Itoa(i)))}
+			items = append(items, item)
+			keys = append(keys, key(i))
+		}
+		first := key(0)
+		first[valueField] = &dynamodb.AttributeValue{S: aws.String(fmtValueTag("last"))}
+		items = append(items, first)
+
+		err := library.PutItems(items)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		got, err := library.GetItems(keys, "")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		for i, item := range got {
+			expected := fmtValueTag(strconv.Itoa(i))
+			if i == 0 {
+				expected = fmtValueTag("last")
+			}
+			if item == nil || aws.StringValue(item[valueField].S) != expected {
+				t.Error("expected", expected, "got", item)
+			}
+		}
+
+		// items written before the snapshot are deleted from where they are; missing and repeated keys are ignored
+		library.Snapshot("1")
+		err = library.DeleteItems(append(keys[:nItems/2:nItems/2], key(1000), key(0)))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		got, err = library.GetItems(keys, "")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		for i, item := range got {
+			if (i < nItems/2) != (item == nil) {
+				t.Error("unexpected item", i, "after deleting the first half:", item)
+			}
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_BatchWriteItemToSnapshots(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 2, t)
+		library.Snapshot("1")
+		library.Snapshot("2")
+
+		key := func(i int) map[string]*dynamodb.AttributeValue {
+			k := getAttributeValueForKey(schema)
+			if partitionKeyType[schema] == "S" {
+				k[partitionKey].SetS(strconv.Itoa(i))
+			} else {
+				k[partitionKey].SetN(strconv.Itoa(i))
+			}
+			return k
+		}
+		corrected := key(0)
+		corrected[valueField] = &dynamodb.AttributeValue{S: aws.String(fmtValueTag("corrected"))}
+
+		// move the first item from the baseline to snapshot 1, and delete the second one
+		err := library.BatchWriteItemToSnapshots(map[string][]*dynamodb.WriteRequest{
+			Baseline: {
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: key(0)}},
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: key(1)}},
+			},
+			"1": {{PutRequest: &dynamodb.PutRequest{Item: corrected}}},
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if aws.StringValue(getPartitionKeyValue(schema, corrected)) != "0" {
+			t.Error("expected the request to be left untouched, got", corrected)
+		}
+
+		baseline, err := library.GetItems([]map[string]*dynamodb.AttributeValue{key(0), key(1)}, Baseline)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(baseline) != 2 || baseline[0] != nil || baseline[1] != nil {
+			t.Error("expected both items deleted from the baseline, got", baseline)
+		}
+		items, err := library.GetItems([]map[string]*dynamodb.AttributeValue{key(0)}, "2")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(items) != 1 || items[0] == nil || aws.StringValue(items[0][valueField].S) != fmtValueTag("corrected") {
+			t.Error("expected the corrected item through snapshot 1, got", items)
+		}
+
+		// nothing is written if any snapshot does not exist, or a key is written twice
+		err = library.BatchWriteItemToSnapshots(map[string][]*dynamodb.WriteRequest{
+			"2":              {{DeleteRequest: &dynamodb.DeleteRequest{Key: key(0)}}},
+			"does-not-exist": {{DeleteRequest: &dynamodb.DeleteRequest{Key: key(0)}}},
+		})
+		if err == nil {
+			t.Error("expected error writing to a snapshot that does not exist")
+		}
+		err = library.BatchWriteItemToSnapshots(map[string][]*dynamodb.WriteRequest{
+			"1": {
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: key(0)}},
+				{PutRequest: &dynamodb.PutRequest{Item: corrected}},
+			},
+		})
+		if err == nil {
+			t.Error("expected error writing the same key twice to a snapshot")
+		}
+		items, err = library.GetItems([]map[string]*dynamodb.AttributeValue{key(0)}, "2")
+		if err != nil || len(items) != 1 || items[0] == nil {
+			t.Error("expected the item to be left alone, got", items, err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
 func TestLibrary_BatchWriteItem(t *testing.T) {
 	for _, schema := range possibleSchemas {
 		library, teardown := setupTest(schema, t)
@@ -863,6 +1753,11 @@ func TestLibrary_BatchWriteItem(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
+		// the caller's keys are left untouched
+		item := input.RequestItems[getTableName(schema)][0].PutRequest.Item
+		if *getPartitionKeyValue(schema, item) != *getPartitionKeyValue(schema, getAttributeValueForKey(schema)) {
+			t.Error("expected the partition key to be left untouched, got", item[partitionKey])
+		}
 		// read it and make sure it's the same
 		inputGet := &dynamodb.GetItemInput{
 			TableName: aws.String(getTableName(schema)),
@@ -905,6 +1800,90 @@ func TestLibrary_BatchWriteItem(t *testing.T) {
 	}
 }
 
+func TestLibrary_normalizeBatchWriteOutput(t *testing.T) {
+	library := &Library{tableName: "movies", partitionKey: "title", partitionKeyType: "S", keyEncoding: keyEncodingLegacy}
+	output := &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]*dynamodb.WriteRequest{
+			"movies": {
+				{DeleteRequest: &dynamodb.DeleteRequest{Key: map[string]*dynamodb.AttributeValue{
+					"title": {S: aws.String("2.Alien")},
+				}}},
+				{PutRequest: &dynamodb.PutRequest{Item: map[string]*dynamodb.AttributeValue{
+					"title":           {S: aws.String("2.Heat")},
+					checksumAttribute: {S: aws.String("sha256:00")},
+				}}},
+			},
+		},
+		ItemCollectionMetrics: map[string][]*dynamodb.ItemCollectionMetrics{
+			"movies": {{ItemCollectionKey: map[string]*dynamodb.AttributeValue{"title": {S: aws.String("2.Ran")}}}},
+		},
+	}
+
+	library.normalizeBatchWriteOutput(output)
+	unprocessed := output.UnprocessedItems["movies"]
+	if key := *unprocessed[0].DeleteRequest.Key["title"].S; key != "Alien" {
+		t.Error("expected Alien, got", key)
+	}
+	if key := *unprocessed[1].PutRequest.Item["title"].S; key != "Heat" {
+		t.Error("expected Heat, got", key)
+	}
+	if _, ok := unprocessed[1].PutRequest.Item[checksumAttribute]; ok {
+		t.Error("expected reserved attributes to be removed")
+	}
+	if key := *output.ItemCollectionMetrics["movies"][0].ItemCollectionKey["title"].S; key != "Ran" {
+		t.Error("expected Ran, got", key)
+	}
+}
+
+func TestLibrary_normalizeWriteOutput(t *testing.T) {
+	library := &Library{tableName: "movies", partitionKey: "title", partitionKeyType: "S", keyEncoding: keyEncodingLegacy}
+	attributes := map[string]*dynamodb.AttributeValue{
+		"title":           {S: aws.String("2.Alien")},
+		checksumAttribute: {S: aws.String("sha256:00")},
+	}
+	metrics := &dynamodb.ItemCollectionMetrics{
+		ItemCollectionKey: map[string]*dynamodb.AttributeValue{"title": {S: aws.String("2.Alien")}},
+	}
+
+	library.normalizeWriteOutput(attributes, metrics)
+	if key := *attributes["title"].S; key != "Alien" {
+		t.Error("expected Alien, got", key)
+	}
+	if _, ok := attributes[checksumAttribute]; ok {
+		t.Error("expected reserved attributes to be removed")
+	}
+	if key := *metrics.ItemCollectionKey["title"].S; key != "Alien" {
+		t.Error("expected Alien, got", key)
+	}
+	// nothing returned
+	library.normalizeWriteOutput(nil, nil)
+}
+
+func TestLibrary_normalizeConditionFailure(t *testing.T) {
+	library := &Library{tableName: "movies", partitionKey: "title", partitionKeyType: "S", keyEncoding: keyEncodingLegacy}
+	failed := &dynamodb.ConditionalCheckFailedException{
+		Item: map[string]*dynamodb.AttributeValue{"title": {S: aws.String("2.Heat")}},
+	}
+	library.normalizeConditionFailure(wrapError("failed to put item", failed))
+	if key := *failed.Item["title"].S; key != "Heat" {
+		t.Error("expected Heat, got", key)
+	}
+
+	canceled := &dynamodb.TransactionCanceledException{
+		CancellationReasons: []*dynamodb.CancellationReason{
+			{Code: aws.String("None")},
+			{
+				Code: aws.String("ConditionalCheckFailed"),
+				Item: map[string]*dynamodb.AttributeValue{"title": {S: aws.String("2.Ran")}},
+			},
+		},
+	}
+	library.normalizeConditionFailure(canceled)
+	if key := *canceled.CancellationReasons[1].Item["title"].S; key != "Ran" {
+		t.Error("expected Ran, got", key)
+	}
+}
+
 func TestLibrary_UpdateItem(t *testing.T) {
 	for _, schema := range possibleSchemas {
 		library, teardown := setupTest(schema, t)
@@ -1016,6 +1995,66 @@ func TestLibrary_DeleteItem(t *testing.T) {
 	}
 }
 
+func TestLibrary_ConditionalWrites(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		library.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      getAttributeValueForItem(schema, "original"),
+		})
+		library.Snapshot("1")
+
+		// the value compared against the partition key gets the snapshot too
+		names := map[string]*string{"#pk": aws.String(partitionKey), "#v": aws.String(valueField)}
+		pk := getAttributeValueForKey(schema)[partitionKey]
+		input := &dynamodb.PutItemInput{
+			TableName:                 aws.String(getTableName(schema)),
+			Item:                      getAttributeValueForItem(schema, "first"),
+			ConditionExpression:       aws.String("attribute_not_exists(#pk) OR #pk = :pk"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": pk},
+		}
+		for i := 0; i < 2; i++ {
+			_, err := library.PutItem(input)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+		// the caller's input is left untouched
+		if !reflect.DeepEqual(input.ExpressionAttributeValues[":pk"], getAttributeValueForKey(schema)[partitionKey]) {
+			t.Error("expected the original value, got", input.ExpressionAttributeValues[":pk"])
+		}
+
+		update := &dynamodb.UpdateItemInput{
+			TableName:                 aws.String(getTableName(schema)),
+			Key:                       getAttributeValueForKey(schema),
+			UpdateExpression:          aws.String("SET #v = :v"),
+			ConditionExpression:       aws.String("#pk = :pk"),
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": pk, ":v": {S: aws.String("updated")}},
+		}
+		_, err := library.UpdateItem(update)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		del := &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(getTableName(schema)),
+			Key:                       getAttributeValueForKey(schema),
+			ConditionExpression:       aws.String("#pk <> :pk"),
+			ExpressionAttributeNames:  map[string]*string{"#pk": aws.String(partitionKey)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": pk},
+		}
+		_, err = library.DeleteItem(del)
+		if !isConditionalCheckFailure(err) {
+			t.Error("expected the condition to fail, got", err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
 func TestLibrary_Scan(t *testing.T) {
 	for _, schema := range possibleSchemas {
 		library, teardown := setupTest(schema, t)
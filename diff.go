@@ -0,0 +1,145 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SnapshotDiff is what changed in the logical view of a table (see ScanMerged) from one snapshot to another (see
+// DiffSnapshots). Items are listed in the order of their primary keys (as JSON), with the snapshot removed from the
+// partition key.
+type SnapshotDiff struct {
+	// items only found in the second snapshot, as found there
+	Added []map[string]*dynamodb.AttributeValue
+	// items only found in the first snapshot, as found there
+	Removed []map[string]*dynamodb.AttributeValue
+	// items found in both snapshots, with different attributes; always empty with DiffKeysOnly
+	Modified []ItemChange
+}
+
+// ItemChange is an item that differs between two snapshots (see DiffSnapshots).
+type ItemChange struct {
+	Key    map[string]*dynamodb.AttributeValue
+	Before map[string]*dynamodb.AttributeValue
+	After  map[string]*dynamodb.AttributeValue
+}
+
+// DiffSnapshots compares the logical views of the table as of snapshots a and b, i.e., the items GetItem would
+// return while browsing each of them, and returns the items added, removed, and modified from a to b. Baseline
+// refers to the data written before any snapshots. With DiffKeysOnly, only the keys of the items added and removed
+// are returned, and items found in both are not compared.
+//
+// Every version of every item involved is kept in memory while the table is scanned, just like ScanMerged.
+//
+// Cost: a full table scan
+func (c *Library) DiffSnapshots(a string, b string, opts ...DiffOption) (*SnapshotDiff, error) {
+	return c.DiffSnapshotsWithContext(aws.BackgroundContext(), a, b, opts...)
+}
+
+// DiffSnapshotsWithContext is the same as DiffSnapshots with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) DiffSnapshotsWithContext(
+	ctx aws.Context,
+	a string,
+	b string,
+	opts ...DiffOption,
+) (*SnapshotDiff, error) {
+	options := newDiffOptions(opts)
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	chains := make([][]string, 0, 2)
+	relevant := make(map[string]bool, 0)
+	for _, snapshot := range []string{a, b} {
+		id, err := meta.getSnapshotID(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		// maybe the items were created before any snapshots were created
+		chain := append(meta.GetChronologicalSnapshotIDs(id), "")
+		for _, id := range chain {
+			relevant[id] = true
+		}
+		chains = append(chains, chain)
+	}
+
+	versions, err := c.scanVersions(ctx, relevant)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(versions))
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	diff := &SnapshotDiff{
+		Added:    make([]map[string]*dynamodb.AttributeValue, 0),
+		Removed:  make([]map[string]*dynamodb.AttributeValue, 0),
+		Modified: make([]ItemChange, 0),
+	}
+	for _, k := range keys {
+		before := visibleVersion(versions[k], chains[0])
+		after := visibleVersion(versions[k], chains[1])
+		// values stored in S3 are named after their content, so comparing the pointers is enough
+		switch {
+		case before == nil && after == nil:
+		case before == nil:
+			after, err = options.item(ctx, c, after)
+			diff.Added = append(diff.Added, after)
+		case after == nil:
+			before, err = options.item(ctx, c, before)
+			diff.Removed = append(diff.Removed, before)
+		case !options.keysOnly && !reflect.DeepEqual(before, after):
+			if err = c.loadOverflow(ctx, before); err == nil {
+				err = c.loadOverflow(ctx, after)
+			}
+			diff.Modified = append(diff.Modified, ItemChange{Key: c.primaryKey(after), Before: before, After: after})
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return diff, nil
+}
+
+// return item as it is to be listed in a diff: in full, with the values stored in S3 fetched back (scanVersions
+// leaves them as pointers), or only its primary key
+func (o *diffOptions) item(
+	ctx aws.Context,
+	c *Library,
+	item map[string]*dynamodb.AttributeValue,
+) (map[string]*dynamodb.AttributeValue, error) {
+	if o.keysOnly {
+		return c.primaryKey(item), nil
+	}
+
+	return item, c.loadOverflow(ctx, item)
+}
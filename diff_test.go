@@ -0,0 +1,107 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_DiffSnapshots(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		put := func(pk string, valueTag string) {
+			item := getAttributeValueForItem(schema, valueTag)
+			if partitionKeyType[schema] == "S" {
+				item[partitionKey].SetS(pk)
+			} else {
+				item[partitionKey].SetN(pk)
+			}
+			_, err := library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: item})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		keys := func(items []map[string]*dynamodb.AttributeValue) []string {
+			pks := make([]string, 0, len(items))
+			for _, item := range items {
+				pks = append(pks, *getPartitionKeyValue(schema, item))
+			}
+			return pks
+		}
+
+		// keys 0-4 on the baseline; 0 changed and 5 added on the first snapshot
+		putItems(library, schema, 5, t)
+		library.Snapshot("first")
+		put("0", "first")
+		put("5", "first")
+
+		d, err := library.DiffSnapshots(Baseline, "first")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if pks := keys(d.Added); len(pks) != 1 || pks[0] != "5" {
+			t.Error("expected key 5 to be added, got", pks)
+		}
+		if len(d.Removed) != 0 {
+			t.Error("expected no items removed, got", keys(d.Removed))
+		}
+		if len(d.Modified) != 1 {
+			t.Fatal("expected 1 item modified, got", len(d.Modified))
+		}
+		change := d.Modified[0]
+		if pk := *getPartitionKeyValue(schema, change.Key); pk != "0" {
+			t.Error("expected key 0 to be modified, got", pk)
+		}
+		if v := aws.StringValue(change.Before[valueField].S); v != fmtValueTag("") {
+			t.Error("expected", fmtValueTag(""), "before, got", v)
+		}
+		if v := aws.StringValue(change.After[valueField].S); v != fmtValueTag("first") {
+			t.Error("expected", fmtValueTag("first"), "after, got", v)
+		}
+
+		// the other way around, with keys only
+		d, err = library.DiffSnapshots("first", Baseline, DiffKeysOnly())
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if pks := keys(d.Removed); len(pks) != 1 || pks[0] != "5" {
+			t.Error("expected key 5 to be removed, got", pks)
+		}
+		if _, ok := d.Removed[0][valueField]; ok {
+			t.Error("expected only the primary key of removed items")
+		}
+		if len(d.Added) != 0 || len(d.Modified) != 0 {
+			t.Error("expected nothing added or modified, got", keys(d.Added), len(d.Modified))
+		}
+
+		_, err = library.DiffSnapshots("first", "does-not-exist")
+		if err == nil {
+			t.Error("expected error comparing a snapshot that does not exist")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,431 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// largest line (i.e., item) we accept when loading a dump; DynamoDB items are limited to 400KB, which can take a few
+// times more once encoded as JSON
+const maxDumpLineSize = 4 * 1024 * 1024
+
+// one line of a dump, in the same format DynamoDB uses for its own exports to S3, i.e., {"Item": {...}}
+type dumpedItem struct {
+	Item map[string]*jsonAttributeValue `json:"Item"`
+}
+
+// the JSON representation of an AttributeValue; L, M, and B are pointers so that empty lists, maps, and binary
+// values are preserved
+type jsonAttributeValue struct {
+	B    *[]byte                         `json:"B,omitempty"`
+	BOOL *bool                           `json:"BOOL,omitempty"`
+	BS   [][]byte                        `json:"BS,omitempty"`
+	L    *[]*jsonAttributeValue          `json:"L,omitempty"`
+	M    *map[string]*jsonAttributeValue `json:"M,omitempty"`
+	N    *string                         `json:"N,omitempty"`
+	NS   []*string                       `json:"NS,omitempty"`
+	NULL *bool                           `json:"NULL,omitempty"`
+	S    *string                         `json:"S,omitempty"`
+	SS   []*string                       `json:"SS,omitempty"`
+}
+
+func toJSONAttributeValue(av *dynamodb.AttributeValue) *jsonAttributeValue {
+	if av == nil {
+		return nil
+	}
+
+	v := &jsonAttributeValue{
+		BOOL: av.BOOL,
+		BS:   av.BS,
+		N:    av.N,
+		NS:   av.NS,
+		NULL: av.NULL,
+		S:    av.S,
+		SS:   av.SS,
+	}
+	if av.B != nil {
+		b := av.B
+		v.B = &b
+	}
+	if av.L != nil {
+		l := make([]*jsonAttributeValue, len(av.L))
+		for i, e := range av.L {
+			l[i] = toJSONAttributeValue(e)
+		}
+		v.L = &l
+	}
+	if av.M != nil {
+		m := toJSONItem(av.M)
+		v.M = &m
+	}
+
+	return v
+}
+
+func toJSONItem(item map[string]*dynamodb.AttributeValue) map[string]*jsonAttributeValue {
+	m := make(map[string]*jsonAttributeValue, len(item))
+	for k, v := range item {
+		m[k] = toJSONAttributeValue(v)
+	}
+
+	return m
+}
+
+func fromJSONAttributeValue(v *jsonAttributeValue) *dynamodb.AttributeValue {
+	if v == nil {
+		return nil
+	}
+
+	av := &dynamodb.AttributeValue{
+		BOOL: v.BOOL,
+		BS:   v.BS,
+		N:    v.N,
+		NS:   v.NS,
+		NULL: v.NULL,
+		S:    v.S,
+		SS:   v.SS,
+	}
+	if v.B != nil {
+		av.B = *v.B
+	}
+	if v.L != nil {
+		av.L = make([]*dynamodb.AttributeValue, len(*v.L))
+		for i, e := range *v.L {
+			av.L[i] = fromJSONAttributeValue(e)
+		}
+	}
+	if v.M != nil {
+		av.M = fromJSONItem(*v.M)
+	}
+
+	return av
+}
+
+func fromJSONItem(item map[string]*jsonAttributeValue) map[string]*dynamodb.AttributeValue {
+	m := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		m[k] = fromJSONAttributeValue(v)
+	}
+
+	return m
+}
+
+// DumpSnapshot writes all items of snapshot to w, one JSON object per line, in the same format DynamoDB uses for its
+// own exports to S3 (i.e., {"Item": {...}}). The snapshot is removed from the partition key of every item, so a dump
+// can be loaded into any snapshot, or even into a table not managed by ddblibrarian. As with ScanFromSnapshot, an
+// empty snapshot means items from all snapshots.
+//
+// Only the items written to snapshot itself are included, not the ones it inherits from older snapshots, i.e., a dump
+// is not what clients see when reading from snapshot (see ScanMerged). It returns the number of items written.
+//
+// Cost: a full table scan (unless the snapshot index is enabled)
+func (c *Library) DumpSnapshot(w io.Writer, snapshot string, opts *BulkOptions) (int64, error) {
+	return c.DumpSnapshotWithContext(aws.BackgroundContext(), w, snapshot, opts)
+}
+
+// DumpSnapshotWithContext is the same as DumpSnapshot with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) DumpSnapshotWithContext(
+	ctx aws.Context,
+	w io.Writer,
+	snapshot string,
+	opts *BulkOptions,
+) (int64, error) {
+	var count int64
+
+	err := c.runJob(ctx, "DumpSnapshot", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		count, err = c.dumpSnapshot(ctx, w, snapshot, opts, reporter)
+		return err
+	})
+
+	return count, err
+}
+
+// StartDumpSnapshot is the same as DumpSnapshot, except that it runs in the background and returns right away, with
+// the Job to follow, pause, resume, or cancel it: the number of items written is in its Status once it is over. w
+// must not be used until then.
+func (c *Library) StartDumpSnapshot(w io.Writer, snapshot string, opts *BulkOptions) *Job {
+	return c.StartDumpSnapshotWithContext(aws.BackgroundContext(), w, snapshot, opts)
+}
+
+// StartDumpSnapshotWithContext is the same as StartDumpSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) StartDumpSnapshotWithContext(
+	ctx aws.Context,
+	w io.Writer,
+	snapshot string,
+	opts *BulkOptions,
+) *Job {
+	return c.startJob(ctx, "DumpSnapshot", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		_, err := c.dumpSnapshot(ctx, w, snapshot, opts, reporter)
+		return err
+	})
+}
+
+func (c *Library) dumpSnapshot(
+	ctx aws.Context,
+	w io.Writer,
+	snapshot string,
+	opts *BulkOptions,
+	reporter *operationReporter,
+) (int64, error) {
+	var count int64
+
+	// keep track of the checkpoints, without changing the caller's options
+	original := opts
+	var reported BulkOptions
+	if original != nil {
+		reported = *original
+	}
+	reported.OnProgress = func(progress *ScanProgress) error {
+		reporter.checkpoint(progress)
+		return original.onProgress(progress)
+	}
+	opts = &reported
+
+	encoder := json.NewEncoder(w)
+	err := c.ScanAllFromSnapshotFuncWithContext(
+		ctx,
+		&dynamodb.ScanInput{TableName: &c.tableName},
+		snapshot,
+		opts,
+		func(items []map[string]*dynamodb.AttributeValue) error {
+			for _, item := range items {
+				err := encoder.Encode(dumpedItem{Item: toJSONItem(item)})
+				if err != nil {
+					return wrapError("failed to write item", err)
+				}
+				count++
+				reporter.read(1)
+			}
+			return nil
+		},
+	)
+
+	return count, err
+}
+
+// LoadSnapshot reads items from r, in the format written by DumpSnapshot, and writes them to snapshot. Items that
+// already exist in snapshot are replaced. When the dump has the same key more than once, e.g., a dump of all
+// snapshots, the last one read is kept. Of opts, only Progress is used.
+//
+// It returns the number of items written.
+//
+// Cost: 1RU + 1WU per item
+func (c *Library) LoadSnapshot(r io.Reader, snapshot string, opts *BulkOptions) (int64, error) {
+	return c.LoadSnapshotWithContext(aws.BackgroundContext(), r, snapshot, opts)
+}
+
+// LoadSnapshotWithContext is the same as LoadSnapshot with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) LoadSnapshotWithContext(
+	ctx aws.Context,
+	r io.Reader,
+	snapshot string,
+	opts *BulkOptions,
+) (int64, error) {
+	var count int64
+	err := c.runJob(ctx, "LoadSnapshot", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		count, err = c.loadSnapshot(ctx, r, snapshot, opts, reporter)
+		return err
+	})
+
+	return count, err
+}
+
+// StartLoadSnapshot is the same as LoadSnapshot, except that it runs in the background and returns right away, with
+// the Job to follow, pause, resume, or cancel it: the number of items written is in its Status. r must not be used
+// until it is over.
+func (c *Library) StartLoadSnapshot(r io.Reader, snapshot string, opts *BulkOptions) *Job {
+	return c.StartLoadSnapshotWithContext(aws.BackgroundContext(), r, snapshot, opts)
+}
+
+// StartLoadSnapshotWithContext is the same as StartLoadSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) StartLoadSnapshotWithContext(
+	ctx aws.Context,
+	r io.Reader,
+	snapshot string,
+	opts *BulkOptions,
+) *Job {
+	return c.startJob(ctx, "LoadSnapshot", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		_, err := c.loadSnapshot(ctx, r, snapshot, opts, reporter)
+		return err
+	})
+}
+
+func (c *Library) loadSnapshot(
+	ctx aws.Context,
+	r io.Reader,
+	snapshot string,
+	opts *BulkOptions,
+	reporter *operationReporter,
+) (int64, error) {
+	var count int64
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := meta.getWritableSnapshotID("LoadSnapshot", snapshot)
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxDumpLineSize)
+
+	items := make([]map[string]*dynamodb.AttributeValue, 0, maxBatchWriteSize)
+	// DynamoDB rejects the same key twice in a single batch
+	positions := make(map[string]int, maxBatchWriteSize)
+	// the size of a dump is not known in advance
+	tracker := c.newProgressTracker(ctx, opts.progressFunc(), false)
+	flush := func() error {
+		if len(items) == 0 {
+			return nil
+		}
+		consumed, err := c.putItemsWithSnapshotID(ctx, "LoadSnapshot", items, id)
+		reporter.written(len(items), consumed, err)
+		if err != nil {
+			return err
+		}
+		count += int64(len(items))
+		tracker.add(int64(len(items)), consumed, c.primaryKey(items[len(items)-1]))
+		items = items[:0]
+		positions = make(map[string]int, maxBatchWriteSize)
+		return nil
+	}
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var dumped dumpedItem
+		err := json.Unmarshal(scanner.Bytes(), &dumped)
+		if err != nil {
+			return count, wrapError("failed to parse line "+strconv.Itoa(line), err)
+		}
+		item := fromJSONItem(dumped.Item)
+		if _, ok := item[c.partitionKey]; !ok {
+			return count, errors.New("missing partition key on line " + strconv.Itoa(line))
+		}
+		key, err := c.keyString(item)
+		if err != nil {
+			return count, err
+		}
+		// batches are written in order, so replacing the earlier one keeps the last
+		if i, ok := positions[key]; ok {
+			items[i] = item
+			continue
+		}
+		positions[key] = len(items)
+		items = append(items, item)
+
+		if len(items) == maxBatchWriteSize {
+			err = flush()
+			if err != nil {
+				return count, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return count, wrapError("failed to read dump", err)
+	}
+
+	return count, flush()
+}
+
+// PutItemsToSnapshot writes items to snapshot, in batches of at most 25, replacing the ones that already exist.
+// The items themselves are not modified.
+//
+// Overhead: 1RU
+func (c *Library) PutItemsToSnapshot(items []map[string]*dynamodb.AttributeValue, snapshot string) error {
+	return c.PutItemsToSnapshotWithContext(aws.BackgroundContext(), items, snapshot)
+}
+
+// PutItemsToSnapshotWithContext is the same as PutItemsToSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) PutItemsToSnapshotWithContext(
+	ctx aws.Context,
+	items []map[string]*dynamodb.AttributeValue,
+	snapshot string,
+) error {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return err
+	}
+
+	id, err := meta.getWritableSnapshotID("PutItemsToSnapshot", snapshot)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.putItemsWithSnapshotID(ctx, "PutItemsToSnapshot", items, id)
+	return err
+}
+
+// write copies of items, with the snapshot ID added to the partition key, to the managed table, returning the write
+// capacity consumed
+func (c *Library) putItemsWithSnapshotID(
+	ctx aws.Context,
+	operation string,
+	items []map[string]*dynamodb.AttributeValue,
+	snapshotID string,
+) (float64, error) {
+	requests := make([]*dynamodb.WriteRequest, 0, len(items))
+	for _, item := range items {
+		pk, ok := item[c.partitionKey]
+		if !ok {
+			return 0, errors.New("missing partition key: " + c.partitionKey)
+		}
+
+		itemCopy := make(map[string]*dynamodb.AttributeValue, len(item))
+		for k, v := range item {
+			itemCopy[k] = v
+		}
+		pkCopy := *pk
+		c.addSnapshotToPartitionKey(snapshotID, &pkCopy)
+		itemCopy[c.partitionKey] = &pkCopy
+		if err := c.checkNotMetaRow(operation, itemCopy); err != nil {
+			return 0, err
+		}
+		if _, err := c.overflowItem(ctx, operation, itemCopy); err != nil {
+			return 0, err
+		}
+		c.tagItem(itemCopy, snapshotID)
+
+		requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: itemCopy}})
+	}
+
+	return c.writeRequests(ctx, requests)
+}
@@ -0,0 +1,131 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestJSONAttributeValue(t *testing.T) {
+	item := map[string]*dynamodb.AttributeValue{
+		"s":     {S: aws.String("some data")},
+		"n":     {N: aws.String("1999")},
+		"b":     {B: []byte{0, 1, 2}},
+		"empty": {B: []byte{}},
+		"bool":  {BOOL: aws.Bool(false)},
+		"null":  {NULL: aws.Bool(true)},
+		"ss":    {SS: []*string{aws.String("a"), aws.String("b")}},
+		"ns":    {NS: []*string{aws.String("1"), aws.String("2")}},
+		"bs":    {BS: [][]byte{{1}, {2}}},
+		"l":     {L: []*dynamodb.AttributeValue{{S: aws.String("x")}, {L: []*dynamodb.AttributeValue{}}}},
+		"m":     {M: map[string]*dynamodb.AttributeValue{"nested": {M: map[string]*dynamodb.AttributeValue{}}}},
+	}
+
+	encoded, err := json.Marshal(dumpedItem{Item: toJSONItem(item)})
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !strings.HasPrefix(string(encoded), `{"Item":{`) {
+		t.Error("unexpected format:", string(encoded))
+	}
+
+	var decoded dumpedItem
+	err = json.Unmarshal(encoded, &decoded)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !reflect.DeepEqual(fromJSONItem(decoded.Item), item) {
+		t.Error("expected", item, "got", fromJSONItem(decoded.Item))
+	}
+}
+
+func TestLibrary_DumpSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		nItems := 10
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		putItems(library, schema, nItems, t)
+
+		var buf bytes.Buffer
+		n, err := library.DumpSnapshot(&buf, "snap", &BulkOptions{Segments: 2})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if n != int64(nItems) || strings.Count(buf.String(), "\n") != nItems {
+			t.Error("expected", nItems, "items, got", n)
+		}
+
+		// load it all into a new snapshot and make sure we get the same items back
+		err = library.Snapshot("copy")
+		if err != nil {
+			t.Error(err)
+		}
+		n, err = library.LoadSnapshot(&buf, "copy", nil)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if n != int64(nItems) {
+			t.Error("expected", nItems, "items, got", n)
+		}
+
+		original, _ := library.ScanAllFromSnapshot(
+			&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "snap", nil)
+		copied, _ := library.ScanAllFromSnapshot(
+			&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "copy", nil)
+		if len(original) != len(copied) {
+			t.Error("expected", len(original), "items on the copy, got", len(copied))
+		}
+
+		// a dump of all snapshots has every key twice, once per snapshot
+		buf.Reset()
+		_, err = library.DumpSnapshot(&buf, "", nil)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		err = library.Snapshot("merged")
+		if err != nil {
+			t.Error(err)
+		}
+		n, err = library.LoadSnapshot(&buf, "merged", nil)
+		if err != nil || n != int64(nItems) {
+			t.Error("expected", nItems, "items, got", n, err)
+		}
+
+		// garbage
+		_, err = library.LoadSnapshot(strings.NewReader("not json\n"), "copy", nil)
+		if err == nil {
+			t.Error("expected an error when loading an invalid dump")
+		}
+
+		teardown(schema, t)
+	}
+}
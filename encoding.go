@@ -0,0 +1,910 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// supported ways of adding a snapshot ID to the partition key; the one in use is recorded in the table's metadata,
+// along with the first snapshot for tables with a numeric partition key (see config.snapshot)
+const (
+	// snapshot ID and key joined by the delimiter, e.g., "7.1234", for both strings and numbers;
+	// numbers encoded this way are not order-preserving (7.2 > 7.10) and may collide (7.1234 == 7.12340)
+	keyEncodingLegacy = "legacy"
+	// strings are encoded as in keyEncodingLegacy; numbers are zero-padded to numericKeyWidth digits and appended to
+	// the snapshot ID, i.e., 7 * 10^35 + 1234, which preserves the order of the keys within a snapshot and gives each
+	// snapshot the range [ID * 10^35, (ID + 1) * 10^35), whatever the number of digits of its ID
+	keyEncodingPadded = "padded"
+	// maximum number of digits of a numeric partition key when using keyEncodingPadded;
+	// together with the snapshot ID this fits the 38 digits of precision DynamoDB offers
+	numericKeyWidth = 35
+)
+
+// add a snapshot ID to the (string representation of) a partition key, along with its shard suffix if the table
+// uses write sharding
+func (c *Library) encodePartitionKey(snapshotID string, key string) string {
+	key = c.shardPartitionKey(key)
+	if snapshotID == "" {
+		return key
+	}
+
+	if c.partitionKeyType == "N" {
+		return encodeNumericKey(c.writeKeyEncoding(), snapshotID, key)
+	}
+
+	id := c.encodeSnapshotID(snapshotID)
+	if c.codec.Suffix {
+		return key + c.keyDelimiter() + id
+	}
+
+	return id + c.keyDelimiter() + key
+}
+
+// split a partition key into the snapshot ID (empty string if there is none) and the key itself; what comes before
+// the delimiter is only taken for a snapshot ID if it looks like one (see isEncodedSnapshotID), since the items written
+// before any snapshots are stored as they are
+func (c *Library) decodePartitionKey(value string) (string, string) {
+	if c.partitionKeyType == "N" {
+		// while the table is being migrated, keys may use either encoding
+		for _, encoding := range c.readKeyEncodings() {
+			if snapshotID, key, ok := decodeNumericKey(encoding, value); ok {
+				return snapshotID, key
+			}
+		}
+
+		return "", value
+	}
+
+	delimiter := c.keyDelimiter()
+	if c.codec.Suffix {
+		i := strings.LastIndex(value, delimiter)
+		if i == -1 || !c.isEncodedSnapshotID(value[i+len(delimiter):]) {
+			return "", c.unshardPartitionKey(value)
+		}
+
+		return c.decodeSnapshotID(value[i+len(delimiter):]), c.unshardPartitionKey(value[:i])
+	}
+
+	i := strings.Index(value, delimiter)
+	if i == -1 || !c.isEncodedSnapshotID(value[:i]) {
+		return "", c.unshardPartitionKey(value)
+	}
+
+	return c.decodeSnapshotID(value[:i]), c.unshardPartitionKey(value[i+len(delimiter):])
+}
+
+// split a partition key into the snapshot ID and the key itself, as decodePartitionKey does, except that the ID has to
+// be a snapshot that exists according to known (see snapshotIDLookup): the keys of the items written before any
+// snapshots may still look like they start with one, e.g., "42.answer"
+func (c *Library) decodeKnownPartitionKey(known func(id string) bool, value string) (string, string) {
+	id, key := c.decodePartitionKey(value)
+	if id == "" || known(id) {
+		return id, key
+	}
+	if c.partitionKeyType == "N" {
+		return "", value
+	}
+
+	return "", c.unshardPartitionKey(value)
+}
+
+// return a function that tells whether a snapshot ID is in use, for decodeKnownPartitionKey, reading the metadata again
+// the first time it comes across one it does not know of, in case the snapshot was taken after a long scan started;
+// if that fails, the ID is assumed to be in use. Not safe for concurrent use.
+func (c *Library) snapshotIDLookup(ctx aws.Context) (func(id string) bool, error) {
+	meta, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	known := meta.snapshotIDSet()
+	unknown := make(map[string]bool, 0)
+	return func(id string) bool {
+		if known[id] || unknown[id] {
+			return known[id]
+		}
+		meta, err := c.fetchMeta(ctx, true)
+		if err != nil {
+			return true
+		}
+		known = meta.snapshotIDSet()
+		if !known[id] {
+			unknown[id] = true
+		}
+		return known[id]
+	}, nil
+}
+
+// return true if s could be a snapshot ID as encodeSnapshotID adds it to a string partition key: digits, as many as
+// the codec's IDWidth if it has one, with no leading zeros otherwise
+func (c *Library) isEncodedSnapshotID(s string) bool {
+	if c.codec.IDWidth > 0 {
+		return len(s) == c.codec.IDWidth && isSnapshotID(strings.TrimLeft(s, "0"))
+	}
+
+	return isSnapshotID(s)
+}
+
+// return true if s could be a snapshot ID, i.e., a positive integer with no leading zeros (see getNextAvailableID)
+func isSnapshotID(s string) bool {
+	if s == "" || s[0] == '0' {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// add a snapshot ID to a numeric partition key using the given encoding
+func encodeNumericKey(encoding string, snapshotID string, key string) string {
+	if encoding == keyEncodingPadded {
+		// keys that are not non-negative integers will not make a valid number and DynamoDB will reject them
+		return fmt.Sprintf("%s%0*s", snapshotID, numericKeyWidth, key)
+	}
+
+	return snapshotID + snapshotDelimiter + key
+}
+
+// split a numeric partition key encoded with the given encoding into the snapshot ID and the key itself; false if it
+// was not encoded that way, e.g., because it has no snapshot ID
+func decodeNumericKey(encoding string, value string) (string, string, bool) {
+	if encoding == keyEncodingPadded {
+		digits, ok := integerDigits(value)
+		if !ok || len(digits) <= numericKeyWidth {
+			return "", "", false
+		}
+		key := strings.TrimLeft(digits[len(digits)-numericKeyWidth:], "0")
+		if key == "" {
+			key = "0"
+		}
+
+		return digits[:len(digits)-numericKeyWidth], key, true
+	}
+
+	i := strings.Index(value, snapshotDelimiter)
+	if i == -1 || !isSnapshotID(value[:i]) {
+		return "", "", false
+	}
+
+	return value[:i], value[i+len(snapshotDelimiter):], true
+}
+
+// return the key encoding of the table and the one it is being migrated to, if any, as last read from the metadata
+func (c *Library) keyEncodings() (string, string) {
+	c.keyMutex.RLock()
+	defer c.keyMutex.RUnlock()
+
+	return c.keyEncoding, c.keyMigration
+}
+
+// record the key encoding of the table and the one it is being migrated to, if any
+func (c *Library) setKeyEncodings(encoding string, migration string) {
+	c.keyMutex.Lock()
+	defer c.keyMutex.Unlock()
+
+	c.keyEncoding = encoding
+	c.keyMigration = migration
+}
+
+// return the encoding numeric keys are written with: the one the table is being migrated to in compatibility mode
+// (see WithKeyEncodingCompatibility), the table's own otherwise
+func (c *Library) writeKeyEncoding() string {
+	encoding, migration := c.keyEncodings()
+	if c.keyCompatibility && migration != "" {
+		return migration
+	}
+
+	return encoding
+}
+
+// return the encodings numeric keys may use, in the order to try them: both while the table is being migrated, the
+// old one first unless configured otherwise (see WithKeyEncodingCompatibility)
+func (c *Library) readKeyEncodings() []string {
+	encoding, migration := c.keyEncodings()
+	if migration == "" || migration == encoding {
+		return []string{encoding}
+	}
+	if c.keyCompatibility && c.keyOrder == NewEncodingFirst {
+		return []string{migration, encoding}
+	}
+
+	return []string{encoding, migration}
+}
+
+// fields of a KeyCodec recorded in the metadata
+const (
+	keyCodecDelimiter = "delimiter"
+	keyCodecIDWidth   = "id_width"
+	keyCodecSuffix    = "suffix"
+)
+
+// return the attribute value a key codec is recorded as in the metadata
+func (k KeyCodec) toAttributeValue() *dynamodb.AttributeValue {
+	codec := map[string]*dynamodb.AttributeValue{
+		keyCodecIDWidth: {N: aws.String(strconv.Itoa(k.IDWidth))},
+		keyCodecSuffix:  {BOOL: aws.Bool(k.Suffix)},
+	}
+	// DynamoDB does not allow empty strings
+	if k.Delimiter != "" {
+		codec[keyCodecDelimiter] = &dynamodb.AttributeValue{S: aws.String(k.Delimiter)}
+	}
+
+	return &dynamodb.AttributeValue{M: codec}
+}
+
+// return the key codec recorded in the metadata as av (see KeyCodec.toAttributeValue)
+func keyCodecFromAttributeValue(av *dynamodb.AttributeValue) (KeyCodec, error) {
+	codec := KeyCodec{}
+	if av.M == nil || av.M[keyCodecIDWidth] == nil {
+		return codec, errors.New("malformed key codec")
+	}
+
+	width, err := strconv.Atoi(aws.StringValue(av.M[keyCodecIDWidth].N))
+	if err != nil {
+		return codec, wrapError("malformed snapshot ID width", err)
+	}
+	codec.IDWidth = width
+	if v, ok := av.M[keyCodecSuffix]; ok {
+		codec.Suffix = aws.BoolValue(v.BOOL)
+	}
+	if v, ok := av.M[keyCodecDelimiter]; ok {
+		codec.Delimiter = aws.StringValue(v.S)
+	}
+
+	return codec, nil
+}
+
+// make sure the Library adds snapshot IDs to string partition keys the way the table's are, as recorded along with
+// its first snapshot, and that its fixed-width IDs, if any, are wide enough for the table's snapshot IDs; meta is
+// left with the Library's codec, to be recorded with the first snapshot if none is yet
+func (c *Library) checkKeyCodec(meta *config) error {
+	if c.partitionKeyType != "S" {
+		return nil
+	}
+	if meta.hasKeyCodec && meta.keyCodec != c.codec {
+		return errors.New(fmt.Sprintf(
+			"the table's keys are encoded with another key codec (%+v), not %+v (see WithKeyCodec)",
+			meta.keyCodec,
+			c.codec,
+		))
+	}
+	if c.codec.IDWidth > 0 && c.codec.IDWidth < meta.snapshotIDLength {
+		return errors.New(fmt.Sprintf(
+			"the key codec's snapshot ID width (%d) is smaller than the table's snapshot IDs (up to %d digits)",
+			c.codec.IDWidth,
+			meta.snapshotIDLength,
+		))
+	}
+	meta.keyCodec = c.codec
+
+	return nil
+}
+
+// return the delimiter between the snapshot ID and the key (see KeyCodec)
+func (c *Library) keyDelimiter() string {
+	if c.codec.Delimiter == "" {
+		return snapshotDelimiter
+	}
+
+	return c.codec.Delimiter
+}
+
+// return a snapshot ID as it is added to a string partition key, zero-padded if the codec uses fixed-width IDs
+func (c *Library) encodeSnapshotID(snapshotID string) string {
+	if c.codec.IDWidth == 0 {
+		return snapshotID
+	}
+
+	return fmt.Sprintf("%0*s", c.codec.IDWidth, snapshotID)
+}
+
+// return a snapshot ID as recorded in the metadata, i.e., without the padding encodeSnapshotID adds
+func (c *Library) decodeSnapshotID(id string) string {
+	if c.codec.IDWidth == 0 {
+		return id
+	}
+
+	trimmed := strings.TrimLeft(id, "0")
+	if trimmed == "" && id != "" {
+		return "0"
+	}
+
+	return trimmed
+}
+
+// add the shard suffix to a partition key if the table uses write sharding (see WithWriteSharding); the snapshot is
+// always added in front of it, so every shard of a key stays within the same snapshot
+func (c *Library) shardPartitionKey(key string) string {
+	if c.shard == nil {
+		return key
+	}
+
+	return key + c.shardDelimiter + c.shard(key)
+}
+
+// remove the shard suffix from a partition key (if it has one)
+func (c *Library) unshardPartitionKey(key string) string {
+	if c.shard == nil {
+		return key
+	}
+
+	i := strings.LastIndex(key, c.shardDelimiter)
+	if i == -1 {
+		return key
+	}
+
+	return key[:i]
+}
+
+// return the filter expression (and the values it needs) that matches the partition keys of a given snapshot
+func (c *Library) snapshotKeyFilter(snapshotID string, values map[string]*dynamodb.AttributeValue) (string, error) {
+	// different data types require different approaches to filtering
+	if c.partitionKeyType == "S" {
+		// the delimiter is never part of a key and the snapshot ID has a fixed width, so this only matches the end
+		if c.codec.Suffix {
+			values[":suffix"] = &dynamodb.AttributeValue{
+				S: aws.String(c.keyDelimiter() + c.encodeSnapshotID(snapshotID)),
+			}
+			return fmt.Sprintf("contains(%s, :suffix)", c.partitionKey), nil
+		}
+
+		values[":prefix"] = &dynamodb.AttributeValue{
+			S: aws.String(c.encodeSnapshotID(snapshotID) + c.keyDelimiter()),
+		}
+		return fmt.Sprintf("begins_with(%s, :prefix)", c.partitionKey), nil
+	}
+
+	idInt, err := strconv.ParseInt(snapshotID, 10, 64)
+	if err != nil {
+		return "", wrapError("failed to convert snapshot ID to integer", err)
+	}
+	currentID := snapshotID
+	nextID := strconv.Itoa(int(idInt + 1))
+	encoding, migration := c.keyEncodings()
+	if encoding == keyEncodingPadded {
+		currentID += strings.Repeat("0", numericKeyWidth)
+		nextID += strings.Repeat("0", numericKeyWidth)
+	}
+	values[":currentID"] = &dynamodb.AttributeValue{N: aws.String(currentID)}
+	values[":nextID"] = &dynamodb.AttributeValue{N: aws.String(nextID)}
+	filter := fmt.Sprintf("%s >= :currentID AND %s < :nextID", c.partitionKey, c.partitionKey)
+
+	// while the table is being migrated, the keys already converted use the new encoding
+	if migration == keyEncodingPadded && encoding != keyEncodingPadded {
+		padding := strings.Repeat("0", numericKeyWidth)
+		values[":migratedCurrentID"] = &dynamodb.AttributeValue{N: aws.String(currentID + padding)}
+		values[":migratedNextID"] = &dynamodb.AttributeValue{N: aws.String(nextID + padding)}
+		filter = fmt.Sprintf("((%s) OR (%s >= :migratedCurrentID AND %s < :migratedNextID))", filter, c.partitionKey,
+			c.partitionKey)
+	}
+
+	return filter, nil
+}
+
+// return the partition keys an item of a given snapshot may be stored under while the table is being migrated to
+// another encoding (see MigrateKeyEncoding), in the order to look for it; nil if there is only one
+func (c *Library) migrationPartitionKeys(snapshotID string, key string) []string {
+	encodings := c.readKeyEncodings()
+	if c.partitionKeyType != "N" || snapshotID == "" || len(encodings) == 1 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(encodings))
+	for _, encoding := range encodings {
+		keys = append(keys, encodeNumericKey(encoding, snapshotID, key))
+	}
+
+	return keys
+}
+
+// query the partition selected by the key condition of a Query, the value of which is pk, under each of the partition
+// keys it may have while the table is being migrated to another encoding (see migrationPartitionKeys): a page is read
+// from the one ExclusiveStartKey is in, and the page that exhausts the first one is returned along with the first
+// page of the second one
+func (c *Library) queryPartitions(
+	ctx aws.Context,
+	input *dynamodb.QueryInput,
+	pk *dynamodb.AttributeValue,
+	partitions []string,
+) (*dynamodb.QueryOutput, error) {
+	if len(partitions) < 2 {
+		return c.storage(ctx).Query(input)
+	}
+
+	first := 0
+	if start, ok := input.ExclusiveStartKey[c.partitionKey]; ok && aws.StringValue(start.N) == partitions[1] {
+		first = 1
+	}
+	pk.SetN(partitions[first])
+	out, err := c.storage(ctx).Query(input)
+	if err != nil || first == 1 || len(out.LastEvaluatedKey) > 0 {
+		return out, err
+	}
+
+	next := *input
+	next.ExclusiveStartKey = nil
+	pk.SetN(partitions[1])
+	more, err := c.storage(ctx).Query(&next)
+	if err != nil {
+		return nil, err
+	}
+	out.Items = append(out.Items, more.Items...)
+	out.Count = aws.Int64(aws.Int64Value(out.Count) + aws.Int64Value(more.Count))
+	out.ScannedCount = aws.Int64(aws.Int64Value(out.ScannedCount) + aws.Int64Value(more.ScannedCount))
+	out.LastEvaluatedKey = more.LastEvaluatedKey
+
+	return out, nil
+}
+
+// look for the items of a BatchGetItem request that were neither found nor left unprocessed under the partition keys
+// they have in the other encoding while the table is being migrated (see migrationPartitionKeys), one for each of the
+// keys requested, adding them to its output
+func (c *Library) batchGetOtherEncoding(
+	ctx aws.Context,
+	request *dynamodb.BatchGetItemInput,
+	others []string,
+	output *dynamodb.BatchGetItemOutput,
+) (*dynamodb.BatchGetItemOutput, error) {
+	seen := make([]map[string]*dynamodb.AttributeValue, 0)
+	seen = append(seen, output.Responses[c.tableName]...)
+	if unprocessed, ok := output.UnprocessedKeys[c.tableName]; ok && unprocessed != nil {
+		seen = append(seen, unprocessed.Keys...)
+	}
+	done := make(map[string]bool, len(seen))
+	for _, item := range seen {
+		k, err := c.keyString(item)
+		if err != nil {
+			return nil, err
+		}
+		done[k] = true
+	}
+
+	requested := request.RequestItems[c.tableName]
+	keys := make([]map[string]*dynamodb.AttributeValue, 0)
+	for i, key := range requested.Keys {
+		k, err := c.keyString(key)
+		if err != nil {
+			return nil, err
+		}
+		if done[k] {
+			continue
+		}
+		other := c.primaryKey(key)
+		other[c.partitionKey] = &dynamodb.AttributeValue{N: aws.String(others[i])}
+		keys = append(keys, other)
+	}
+	if len(keys) == 0 {
+		return output, nil
+	}
+
+	next := *request
+	nextKeys := *requested
+	nextKeys.Keys = keys
+	next.RequestItems = map[string]*dynamodb.KeysAndAttributes{c.tableName: &nextKeys}
+	more, err := c.storage(ctx).BatchGetItem(&next)
+	if err != nil {
+		return nil, err
+	}
+
+	if output.Responses == nil {
+		output.Responses = make(map[string][]map[string]*dynamodb.AttributeValue, 0)
+	}
+	output.Responses[c.tableName] = append(output.Responses[c.tableName], more.Responses[c.tableName]...)
+	if unprocessed, ok := more.UnprocessedKeys[c.tableName]; ok && unprocessed != nil && len(unprocessed.Keys) > 0 {
+		if output.UnprocessedKeys == nil {
+			output.UnprocessedKeys = make(map[string]*dynamodb.KeysAndAttributes, 0)
+		}
+		if output.UnprocessedKeys[c.tableName] == nil {
+			output.UnprocessedKeys[c.tableName] = unprocessed
+		} else {
+			output.UnprocessedKeys[c.tableName].Keys = append(output.UnprocessedKeys[c.tableName].Keys,
+				unprocessed.Keys...)
+		}
+	}
+	output.ConsumedCapacity = append(output.ConsumedCapacity, more.ConsumedCapacity...)
+
+	return output, nil
+}
+
+// return a copy of a primary key written with the new encoding while the table is being migrated in compatibility
+// mode (see WithKeyEncodingCompatibility), with the partition key in the old one; false if there is no such copy
+func (c *Library) oldEncodingKey(key map[string]*dynamodb.AttributeValue) (map[string]*dynamodb.AttributeValue, bool) {
+	encoding, migration := c.keyEncodings()
+	if c.partitionKeyType != "N" || c.writeKeyEncoding() == encoding {
+		return nil, false
+	}
+	pk, ok := key[c.partitionKey]
+	if !ok || pk == nil {
+		return nil, false
+	}
+	snapshotID, k, ok := decodeNumericKey(migration, aws.StringValue(pk.N))
+	if !ok {
+		return nil, false
+	}
+
+	old := c.primaryKey(key)
+	old[c.partitionKey] = &dynamodb.AttributeValue{N: aws.String(encodeNumericKey(encoding, snapshotID, k))}
+	return old, true
+}
+
+// convert the items with the given keys, written with the new encoding while the table is being migrated in
+// compatibility mode, that are still stored with the old one, so that a write sees the item it expects to
+func (c *Library) convertOldEncodingCopies(ctx aws.Context, keys []map[string]*dynamodb.AttributeValue) error {
+	for _, key := range keys {
+		old, ok := c.oldEncodingKey(key)
+		if !ok {
+			continue
+		}
+		out, err := c.storage(ctx).GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(c.tableName),
+			Key:            old,
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return wrapError("failed to read the item in the old key encoding", err)
+		}
+		if out.Item == nil {
+			continue
+		}
+		_, err = c.convertItemKey(ctx, out.Item, key[c.partitionKey])
+		if err != nil {
+			return wrapError("failed to convert the item to the new key encoding", err)
+		}
+	}
+
+	return nil
+}
+
+// return the requests that delete the copies in the old encoding of the items requests write with the new one while
+// the table is being migrated in compatibility mode: those of deletes are to be sent before the requests, so that
+// nothing is left to be converted back, and those of puts after, so that the item is never missing
+func (c *Library) oldEncodingDeletes(
+	requests []*dynamodb.WriteRequest,
+) ([]*dynamodb.WriteRequest, []*dynamodb.WriteRequest) {
+	before := make([]*dynamodb.WriteRequest, 0)
+	after := make([]*dynamodb.WriteRequest, 0)
+	for _, r := range requests {
+		if r.DeleteRequest != nil {
+			if old, ok := c.oldEncodingKey(r.DeleteRequest.Key); ok {
+				before = append(before, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: old}})
+			}
+		}
+		if r.PutRequest != nil {
+			if old, ok := c.oldEncodingKey(r.PutRequest.Item); ok {
+				after = append(after, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: old}})
+			}
+		}
+	}
+
+	return before, after
+}
+
+// move an item to another partition key in a single transaction, which only goes through if the item is still there
+// as it was read and nothing has been written to the new key meanwhile, e.g., by a client in compatibility mode (see
+// WithKeyEncodingCompatibility), in which case whatever is left under the old key is out of date and deleted instead;
+// an item changed since it was read is read again and moved as it is then; returns the write capacity consumed
+func (c *Library) convertItemKey(
+	ctx aws.Context,
+	item map[string]*dynamodb.AttributeValue,
+	pk *dynamodb.AttributeValue,
+) (float64, error) {
+	var consumed float64
+	for {
+		converted := make(map[string]*dynamodb.AttributeValue, len(item))
+		for k, v := range item {
+			converted[k] = v
+		}
+		converted[c.partitionKey] = pk
+		condition, names, values := c.unchangedItemCondition(item)
+
+		out, err := c.storage(ctx).TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Delete: &dynamodb.Delete{
+					TableName:                 aws.String(c.tableName),
+					Key:                       c.primaryKey(item),
+					ConditionExpression:       aws.String(condition),
+					ExpressionAttributeNames:  names,
+					ExpressionAttributeValues: values,
+				}},
+				{Put: &dynamodb.Put{
+					TableName:                aws.String(c.tableName),
+					Item:                     converted,
+					ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+					ExpressionAttributeNames: map[string]*string{"#pk": aws.String(c.partitionKey)},
+				}},
+			},
+			ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+		})
+		if err == nil {
+			return consumed + c.consumedCapacity(out.ConsumedCapacity), nil
+		}
+		if !isConditionalTransactionFailure(err) {
+			return consumed, err
+		}
+
+		if canceled := err.(*dynamodb.TransactionCanceledException); len(canceled.CancellationReasons) > 1 &&
+			aws.StringValue(canceled.CancellationReasons[1].Code) == "ConditionalCheckFailed" {
+			deleted, err := c.storage(ctx).DeleteItem(&dynamodb.DeleteItemInput{
+				TableName:              aws.String(c.tableName),
+				Key:                    c.primaryKey(item),
+				ReturnConsumedCapacity: aws.String(dynamodb.ReturnConsumedCapacityTotal),
+			})
+			if err != nil {
+				return consumed, err
+			}
+
+			return consumed + c.consumedCapacity([]*dynamodb.ConsumedCapacity{deleted.ConsumedCapacity}), nil
+		}
+
+		// the item changed (or is gone) since it was read
+		current, err := c.storage(ctx).GetItem(&dynamodb.GetItemInput{
+			TableName:      aws.String(c.tableName),
+			Key:            c.primaryKey(item),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return consumed, err
+		}
+		if current.Item == nil {
+			return consumed, nil
+		}
+		item = current.Item
+	}
+}
+
+// return a condition expression, along with its names and values, that only holds if an item has every attribute it
+// has, other than the partition key, with the same value
+func (c *Library) unchangedItemCondition(
+	item map[string]*dynamodb.AttributeValue,
+) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	attributes := make([]string, 0, len(item))
+	for k := range item {
+		if k != c.partitionKey {
+			attributes = append(attributes, k)
+		}
+	}
+	sort.Strings(attributes)
+
+	conditions := []string{"attribute_exists(#pk)"}
+	names := map[string]*string{"#pk": aws.String(c.partitionKey)}
+	values := make(map[string]*dynamodb.AttributeValue, len(attributes))
+	for i, attribute := range attributes {
+		name := fmt.Sprintf("#attribute%d", i)
+		value := fmt.Sprintf(":attribute%d", i)
+		names[name] = aws.String(attribute)
+		values[value] = item[attribute]
+		conditions = append(conditions, name+" = "+value)
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+
+	return strings.Join(conditions, " AND "), names, values
+}
+
+// return the digits of a DynamoDB number if it is a non-negative integer (it may use scientific notation)
+func integerDigits(value string) (string, bool) {
+	f, _, err := big.ParseFloat(value, 10, 256, big.ToNearestEven)
+	if err != nil || f.Sign() < 0 || !f.IsInt() {
+		return "", false
+	}
+
+	i, _ := f.Int(nil)
+	return i.String(), true
+}
+
+// MigrateKeyEncoding converts all items written to snapshots of a table with a numeric partition key from the
+// legacy encoding ("<snapshot ID>.<key>") to one that preserves the order of the keys within each snapshot and
+// allows for keys of up to 35 digits. Items written before any snapshot was taken are not affected. Tables whose first
+// snapshot was taken by a version of the Library that records the encoding already use the new one.
+//
+// The migration is recorded in the table's metadata as soon as it starts: until it is over, every client reads keys
+// in both encodings, which costs GetItem an extra 1RU for items not found in the first one it tries. Each item is
+// moved to its new key in a transaction that does not go through if something was written to the new key meanwhile,
+// and once the whole table has been converted it is scanned again to verify that nothing is left in the old encoding
+// (converting whatever was written meanwhile), after which the new encoding is recorded and used by all clients.
+// Clients that write to the table while it runs should use WithKeyEncodingCompatibility; others keep writing with
+// the old encoding, which could make scans return the same item twice. It runs as a Job, which ResumeJob can carry on
+// from the last page of items it converted, and it is safe to run it again if it fails. The items of locked snapshots
+// (see LockSnapshot) are converted too: only their keys change, not what the snapshots hold.
+//
+// DynamoDB drops the trailing zeros of the numbers it stores, so the legacy encoding stores key 10 of snapshot 7 as
+// 7.1, just like key 1. Unless told otherwise with KeysWithoutTrailingZeros, the migration cannot tell which key such
+// an item was written with, and fails on the first one it finds rather than move it to what may be the wrong key.
+//
+// Cost: 1RU + 2WU + 2 full table scans + 4WU per converted item
+func (c *Library) MigrateKeyEncoding(opts ...MigrationOption) (int64, error) {
+	return c.MigrateKeyEncodingWithContext(aws.BackgroundContext(), opts...)
+}
+
+// MigrateKeyEncodingWithContext is the same as MigrateKeyEncoding with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) MigrateKeyEncodingWithContext(ctx aws.Context, opts ...MigrationOption) (int64, error) {
+	options := newMigrationOptions(opts)
+	params := &jobParams{noTrailingZeros: options.noTrailingZeros}
+
+	var migrated int64
+	err := c.runJob(ctx, "MigrateKeyEncoding", "", params, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		migrated, err = c.migrateKeyEncoding(ctx, options, reporter)
+		return err
+	})
+
+	return migrated, err
+}
+
+// StartMigrateKeyEncoding is the same as MigrateKeyEncoding, except that it runs in the background and returns right
+// away, with the Job to follow, pause, resume, or cancel it; Job.Wait returns the error MigrateKeyEncoding would have,
+// and the number of items converted is the job's Items.
+func (c *Library) StartMigrateKeyEncoding(opts ...MigrationOption) *Job {
+	return c.StartMigrateKeyEncodingWithContext(aws.BackgroundContext(), opts...)
+}
+
+// StartMigrateKeyEncodingWithContext is the same as StartMigrateKeyEncoding with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) StartMigrateKeyEncodingWithContext(ctx aws.Context, opts ...MigrationOption) *Job {
+	options := newMigrationOptions(opts)
+	params := &jobParams{noTrailingZeros: options.noTrailingZeros}
+
+	return c.startJob(ctx, "MigrateKeyEncoding", "", params, func(ctx aws.Context, reporter *operationReporter) error {
+		_, err := c.migrateKeyEncoding(ctx, options, reporter)
+		return err
+	})
+}
+
+// number of times the table is scanned again for items left in the legacy encoding before MigrateKeyEncoding gives
+// up, e.g., because clients keep writing them
+const keyEncodingVerifications = 3
+
+// convert the table to keyEncodingPadded, carrying on from where options.resume left off, if not nil
+func (c *Library) migrateKeyEncoding(
+	ctx aws.Context,
+	options *migrationOptions,
+	reporter *operationReporter,
+) (int64, error) {
+	if c.partitionKeyType != "N" {
+		return 0, errors.New("only tables with numeric partition keys need to be migrated")
+	}
+
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return 0, err
+	}
+
+	if meta.keyEncoding == keyEncodingPadded {
+		return 0, nil
+	}
+	// every client reads keys in both encodings from now on
+	if meta.keyEncodingMigration != keyEncodingPadded {
+		err = meta.startKeyEncodingMigration(keyEncodingPadded)
+		if err != nil {
+			return 0, wrapError("failed to record the migration", err)
+		}
+	}
+	c.setKeyEncodings(meta.keyEncoding, keyEncodingPadded)
+
+	migrated, err := c.convertLegacyKeys(ctx, options.resume, options.noTrailingZeros, reporter)
+	if err != nil {
+		return migrated, err
+	}
+	// verify that nothing is left in the legacy encoding, e.g., written by clients that had not noticed the migration
+	for verification := 1; ; verification++ {
+		left, err := c.convertLegacyKeys(ctx, nil, options.noTrailingZeros, reporter)
+		migrated += left
+		if err != nil {
+			return migrated, err
+		}
+		if left == 0 {
+			break
+		}
+		if verification == keyEncodingVerifications {
+			return migrated, errors.New("items are still being written in the legacy encoding: " +
+				strconv.FormatInt(left, 10) + " found by the last verification")
+		}
+	}
+
+	err = meta.setKeyEncoding(keyEncodingPadded)
+	if err != nil {
+		return migrated, wrapError("failed to record the new key encoding", err)
+	}
+	c.setKeyEncodings(keyEncodingPadded, "")
+
+	return migrated, nil
+}
+
+// scan the table, carrying on from where resume left off, if not nil, and convert every item written to a snapshot
+// in the legacy encoding to keyEncodingPadded, returning how many were converted; unless noTrailingZeros, it fails on
+// the first such item, whose key may have lost its trailing zeros (see MigrateKeyEncoding)
+func (c *Library) convertLegacyKeys(
+	ctx aws.Context,
+	resume *ScanProgress,
+	noTrailingZeros bool,
+	reporter *operationReporter,
+) (int64, error) {
+	var converted int64
+
+	input := c.tableScanInput()
+	if resume != nil {
+		input.ExclusiveStartKey = resume.LastKeys[0]
+	}
+	for {
+		if err := jobFromContext(ctx).wait(ctx); err != nil {
+			return converted, err
+		}
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return converted, err
+		}
+
+		var consumed float64
+		count := 0
+		for _, item := range out.Items {
+			// only items with a snapshot ID need to be converted
+			snapshotID, key, ok := decodeNumericKey(keyEncodingLegacy, *item[c.partitionKey].N)
+			if !ok {
+				continue
+			}
+			if !noTrailingZeros {
+				err = errors.New(fmt.Sprintf("cannot tell whether key %s of snapshot ID %s was written as %s, or "+
+					"with trailing zeros the legacy encoding dropped (e.g., %s0), use KeysWithoutTrailingZeros if no "+
+					"key written to a snapshot ends in 0", key, snapshotID, key, key))
+				break
+			}
+
+			var units float64
+			units, err = c.convertItemKey(ctx, item, &dynamodb.AttributeValue{
+				N: aws.String(encodeNumericKey(keyEncodingPadded, snapshotID, key)),
+			})
+			consumed += units
+			if err != nil {
+				break
+			}
+			count++
+		}
+		reporter.written(count, consumed, err)
+		if err != nil {
+			return converted, wrapError("failed to convert items", err)
+		}
+		converted += int64(count)
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return converted, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+		progress := newScanProgress(1)
+		progress.LastKeys[0] = out.LastEvaluatedKey
+		reporter.checkpoint(progress)
+	}
+}
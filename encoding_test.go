@@ -0,0 +1,588 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_encodeDecodePartitionKey(t *testing.T) {
+	libraries := []*Library{
+		{partitionKeyType: "S", keyEncoding: keyEncodingLegacy},
+		{partitionKeyType: "S", keyEncoding: keyEncodingPadded},
+		{partitionKeyType: "N", keyEncoding: keyEncodingLegacy},
+		{partitionKeyType: "N", keyEncoding: keyEncodingPadded},
+	}
+
+	for _, library := range libraries {
+		for _, id := range []string{"", "1", "7", "42"} {
+			for _, key := range []string{"0", "1234", "12340", "99999999999999999999999999999999999"} {
+				encoded := library.encodePartitionKey(id, key)
+				decodedID, decodedKey := library.decodePartitionKey(encoded)
+				if decodedID != id || decodedKey != key {
+					t.Error(
+						library.partitionKeyType, library.keyEncoding,
+						"expected", id, key,
+						"got", decodedID, decodedKey,
+					)
+				}
+			}
+		}
+	}
+}
+
+func TestLibrary_paddedNumericKeys(t *testing.T) {
+	library := &Library{partitionKeyType: "N", keyEncoding: keyEncodingPadded}
+
+	// keys that would collide using the legacy encoding don't
+	if library.encodePartitionKey("7", "1234") == library.encodePartitionKey("7", "12340") {
+		t.Error("expected different encodings for 1234 and 12340")
+	}
+
+	// scientific notation is understood
+	id, key := library.decodePartitionKey("7E+35")
+	if id != "7" || key != "0" {
+		t.Error("expected snapshot 7 and key 0, got", id, key)
+	}
+
+	// every key of a snapshot falls within [ID * 10^35, (ID + 1) * 10^35)
+	encoded := library.encodePartitionKey("7", strings.Repeat("9", numericKeyWidth))
+	if len(encoded) != numericKeyWidth+1 || encoded[0] != '7' {
+		t.Error("expected a number in snapshot 7, got", encoded)
+	}
+}
+
+func TestLibrary_keyCodec(t *testing.T) {
+	codecs := []KeyCodec{
+		{},
+		{Delimiter: "|"},
+		{Delimiter: "::", IDWidth: 6},
+		{Delimiter: "|", IDWidth: 6, Suffix: true},
+	}
+
+	for _, codec := range codecs {
+		library := &Library{partitionKey: "title", partitionKeyType: "S", keyEncoding: keyEncodingLegacy, codec: codec}
+		for _, id := range []string{"", "1", "42"} {
+			for _, key := range []string{"a", "movie.1999", "v1.2.3"} {
+				encoded := library.encodePartitionKey(id, key)
+				decodedID, decodedKey := library.decodePartitionKey(encoded)
+				if decodedID != id || decodedKey != key {
+					t.Error(codec, "expected", id, key, "got", decodedID, decodedKey)
+				}
+			}
+		}
+	}
+
+	// the default is backwards compatible
+	library := &Library{partitionKey: "title", partitionKeyType: "S", keyEncoding: keyEncodingLegacy}
+	if encoded := library.encodePartitionKey("7", "movie.1999"); encoded != "7.movie.1999" {
+		t.Error("expected 7.movie.1999, got", encoded)
+	}
+
+	// fixed-width IDs, before or after the key
+	library.codec = KeyCodec{Delimiter: "|", IDWidth: 4}
+	if encoded := library.encodePartitionKey("7", "abc"); encoded != "0007|abc" {
+		t.Error("expected 0007|abc, got", encoded)
+	}
+	library.codec.Suffix = true
+	if encoded := library.encodePartitionKey("7", "abc"); encoded != "abc|0007" {
+		t.Error("expected abc|0007, got", encoded)
+	}
+
+	// snapshots are found by their suffix
+	values := make(map[string]*dynamodb.AttributeValue, 0)
+	filter, err := library.snapshotKeyFilter("7", values)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if filter != "contains(title, :suffix)" || aws.StringValue(values[":suffix"].S) != "|0007" {
+		t.Error("expected a filter on the suffix |0007, got", filter, values)
+	}
+}
+
+func TestLibrary_checkKeyCodec(t *testing.T) {
+	codec := KeyCodec{Delimiter: "|", IDWidth: 4, Suffix: true}
+	recorded, err := keyCodecFromAttributeValue(codec.toAttributeValue())
+	if err != nil || recorded != codec {
+		t.Error("expected", codec, "got", recorded, err)
+	}
+	recorded, err = keyCodecFromAttributeValue(KeyCodec{}.toAttributeValue())
+	if err != nil || recorded != (KeyCodec{}) {
+		t.Error("expected the default codec, got", recorded, err)
+	}
+
+	// a table with no codec recorded yet takes the Library's
+	library := &Library{partitionKeyType: "S", codec: codec}
+	meta := &config{snapshotIDLength: defaultSnapshotIDLength}
+	if err := library.checkKeyCodec(meta); err != nil || meta.keyCodec != codec {
+		t.Error("expected the Library's codec, got", meta.keyCodec, err)
+	}
+
+	// once recorded, every client must use it
+	meta = &config{snapshotIDLength: defaultSnapshotIDLength, keyCodec: KeyCodec{}, hasKeyCodec: true}
+	if err := library.checkKeyCodec(meta); err == nil {
+		t.Error("expected an error for another codec")
+	}
+	library.codec = KeyCodec{}
+	if err := library.checkKeyCodec(meta); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+
+	// fixed-width IDs must fit every snapshot ID
+	library.codec = KeyCodec{IDWidth: 3}
+	meta = &config{snapshotIDLength: 4}
+	if err := library.checkKeyCodec(meta); err == nil {
+		t.Error("expected an error for IDs wider than the codec's")
+	}
+}
+
+func TestLibrary_decodeKnownPartitionKey(t *testing.T) {
+	library := &Library{partitionKey: "title", partitionKeyType: "S", keyEncoding: keyEncodingLegacy}
+	known := func(id string) bool { return id == "7" }
+
+	// only snapshots that exist are taken for one, the rest is part of a key written before any snapshots
+	for value, expected := range map[string][2]string{
+		"7.acme.1": {"7", "acme.1"},
+		"acme.1":   {"", "acme.1"},
+		"42.acme":  {"", "42.acme"},
+		"07.acme":  {"", "07.acme"},
+	} {
+		id, key := library.decodeKnownPartitionKey(known, value)
+		if id != expected[0] || key != expected[1] {
+			t.Error("expected", expected, "for", value, "got", id, key)
+		}
+	}
+
+	// fixed-width IDs have to be as wide as the codec says
+	library.codec = KeyCodec{Delimiter: "|", IDWidth: 4}
+	if id, key := library.decodePartitionKey("007|abc"); id != "" || key != "007|abc" {
+		t.Error("expected no snapshot in 007|abc, got", id, key)
+	}
+	if id, key := library.decodePartitionKey("0007|abc"); id != "7" || key != "abc" {
+		t.Error("expected snapshot 7 and key abc, got", id, key)
+	}
+}
+
+func TestLibrary_writeSharding(t *testing.T) {
+	library := &Library{
+		partitionKeyType: "S",
+		keyEncoding:      keyEncodingLegacy,
+		shardDelimiter:   "#",
+		shard: func(key string) string {
+			return strconv.Itoa(len(key) % 4)
+		},
+	}
+
+	for _, id := range []string{"", "1", "42"} {
+		for _, key := range []string{"a", "movie-1999", "key#with#delimiters"} {
+			encoded := library.encodePartitionKey(id, key)
+			if !strings.HasSuffix(encoded, "#"+library.shard(key)) {
+				t.Error("expected the shard suffix at the end of", encoded)
+			}
+			decodedID, decodedKey := library.decodePartitionKey(encoded)
+			if decodedID != id || decodedKey != key {
+				t.Error("expected", id, key, "got", decodedID, decodedKey)
+			}
+		}
+	}
+
+	// the caller's value is left untouched once the request has been made
+	pk := &dynamodb.AttributeValue{S: aws.String("abc")}
+	original := library.addSnapshotToPartitionKey("", pk)
+	if *pk.S != "abc#3" {
+		t.Error("expected abc#3, got", *pk.S)
+	}
+	library.restorePartitionKey(original, pk)
+	if *pk.S != "abc" {
+		t.Error("expected abc, got", *pk.S)
+	}
+
+	// the order of sharded keys means nothing
+	err := checkShardedFilter("partition_key = :a AND :b <> partition_key", "partition_key", nil)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	err = checkShardedFilter("partition_key IN (:a, :b)", "partition_key", nil)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	err = checkShardedFilter("begins_with(partition_key, :a)", "partition_key", nil)
+	if err == nil {
+		t.Error("expected an error matching the prefix of sharded keys")
+	}
+	err = checkShardedFilter("#pk > :a", "partition_key", map[string]*string{"#pk": aws.String("partition_key")})
+	if err == nil {
+		t.Error("expected an error comparing the order of sharded keys")
+	}
+}
+
+func TestConfig_snapshotKeyEncoding(t *testing.T) {
+	for _, pkType := range []string{"S", "N"} {
+		storage := &recordingStorage{}
+		meta := &config{
+			svc:              storage,
+			partitionKeyType: pkType,
+			keyEncoding:      keyEncodingLegacy,
+			snapshots:        make(map[string]*dynamodb.AttributeValue, 0),
+			snapshotInfo:     make(map[string]*dynamodb.AttributeValue, 0),
+		}
+
+		// numeric keys are padded from the first snapshot on
+		_, err := meta.snapshot("first", time.Now(), nil, false, false)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		recorded := storage.update.ExpressionAttributeValues[":encoding"]
+		if pkType == "N" && (meta.keyEncoding != keyEncodingPadded || recorded == nil ||
+			aws.StringValue(recorded.S) != keyEncodingPadded) {
+			t.Error("expected the padded encoding to be recorded, got", meta.keyEncoding, recorded)
+		}
+		if pkType == "S" && (meta.keyEncoding != keyEncodingLegacy || recorded != nil) {
+			t.Error("expected the encoding of string keys to be left as it is, got", meta.keyEncoding, recorded)
+		}
+		// so is the key codec of string keys
+		codec := storage.update.ExpressionAttributeValues[":codec"]
+		if (pkType == "S") != (codec != nil) || meta.hasKeyCodec != (pkType == "S") {
+			t.Error("expected the key codec recorded for string keys only, got", codec)
+		}
+
+		// tables that already have snapshots keep their encoding until migrated
+		meta.keyEncoding = keyEncodingLegacy
+		meta.latestSnapshotID, meta.currentSnapshotID = "1", "1"
+		_, err = meta.snapshot("second", time.Now(), nil, false, false)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if meta.keyEncoding != keyEncodingLegacy || storage.update.ExpressionAttributeValues[":encoding"] != nil {
+			t.Error("expected the legacy encoding to be kept, got", meta.keyEncoding)
+		}
+		if storage.update.ExpressionAttributeValues[":codec"] != nil {
+			t.Error("expected the key codec to be recorded only once")
+		}
+	}
+}
+
+func TestLibrary_keyEncodingMigration(t *testing.T) {
+	library := &Library{partitionKey: "year", partitionKeyType: "N", keyEncoding: keyEncodingLegacy}
+	padded := "7" + strings.Repeat("0", numericKeyWidth-4) + "1234"
+
+	// before the migration, converted keys mean nothing
+	if id, key := library.decodePartitionKey(padded); id != "" || key != padded {
+		t.Error("expected no snapshot, got", id, key)
+	}
+	if keys := library.migrationPartitionKeys("7", "1234"); keys != nil {
+		t.Error("expected a single key, got", keys)
+	}
+
+	// while it runs, keys are understood in both encodings
+	library.keyMigration = keyEncodingPadded
+	for _, value := range []string{"7.1234", padded} {
+		if id, key := library.decodePartitionKey(value); id != "7" || key != "1234" {
+			t.Error("expected snapshot 7 and key 1234 for", value, "got", id, key)
+		}
+	}
+	if id, key := library.decodePartitionKey("1234"); id != "" || key != "1234" {
+		t.Error("expected no snapshot, got", id, key)
+	}
+	if keys := library.migrationPartitionKeys("7", "1234"); !reflect.DeepEqual(keys, []string{"7.1234", padded}) {
+		t.Error("expected the legacy key, then", padded, "got", keys)
+	}
+
+	// and scans match the range of a snapshot in both
+	values := make(map[string]*dynamodb.AttributeValue, 0)
+	filter, err := library.snapshotKeyFilter("7", values)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	expected := "((year >= :currentID AND year < :nextID) OR (year >= :migratedCurrentID AND year < :migratedNextID))"
+	if filter != expected {
+		t.Error("expected", expected, "got", filter)
+	}
+	if aws.StringValue(values[":migratedNextID"].N) != "8"+strings.Repeat("0", numericKeyWidth) {
+		t.Error("expected the range of snapshot 7 in the new encoding, got", values)
+	}
+
+	// once it is over, only the new encoding is used
+	library.keyEncoding, library.keyMigration = keyEncodingPadded, ""
+	if keys := library.migrationPartitionKeys("7", "1234"); keys != nil {
+		t.Error("expected a single key, got", keys)
+	}
+	if id, key := library.decodePartitionKey("7.1234"); id != "" || key != "7.1234" {
+		t.Error("expected no snapshot, got", id, key)
+	}
+
+	// DynamoDB stores key 10 of snapshot 7 as 7.1, which cannot be told apart from key 1, so it is not moved unless
+	// no key ends in 0
+	library.keyEncoding = keyEncodingLegacy
+	storage := &legacyItemsStorage{items: []map[string]*dynamodb.AttributeValue{
+		{"year": {N: aws.String("7.1234")}},
+		{"year": {N: aws.String("7.1")}},
+	}}
+	library.svc = storage
+	converted, err := library.convertLegacyKeys(aws.BackgroundContext(), nil, false, nil)
+	if err == nil || !strings.Contains(err.Error(), "KeysWithoutTrailingZeros") || converted != 0 {
+		t.Error("expected an error for the first item, got", converted, err)
+	}
+	if len(storage.transactions) != 0 {
+		t.Error("expected no items to be moved, got", storage.transactions)
+	}
+	converted, err = library.convertLegacyKeys(aws.BackgroundContext(), nil, true, nil)
+	if err != nil || converted != 2 {
+		t.Error("expected both items to be converted, got", converted, err)
+	}
+	for i, key := range []string{"1234", "1"} {
+		put := storage.transactions[i].TransactItems[1].Put.Item
+		if expected := encodeNumericKey(keyEncodingPadded, "7", key); aws.StringValue(put["year"].N) != expected {
+			t.Error("expected", expected, "got", put["year"])
+		}
+	}
+}
+
+// legacyItemsStorage serves a single page of items to scans, and keeps the transactions made
+type legacyItemsStorage struct {
+	Storage
+	items        []map[string]*dynamodb.AttributeValue
+	transactions []*dynamodb.TransactWriteItemsInput
+}
+
+func (s *legacyItemsStorage) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return &dynamodb.ScanOutput{Items: s.items}, nil
+}
+
+func (s *legacyItemsStorage) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	s.transactions = append(s.transactions, input)
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func TestLibrary_keyEncodingCompatibility(t *testing.T) {
+	library := &Library{
+		partitionKey:     "year",
+		partitionKeyType: "N",
+		keyEncoding:      keyEncodingLegacy,
+		keyMigration:     keyEncodingPadded,
+	}
+	padded := "7" + strings.Repeat("0", numericKeyWidth-4) + "1234"
+	newKey := map[string]*dynamodb.AttributeValue{"year": {N: aws.String(padded)}}
+
+	// without it, keys are written with the old encoding until the migration is over
+	if key := library.encodePartitionKey("7", "1234"); key != "7.1234" {
+		t.Error("expected 7.1234, got", key)
+	}
+	if _, ok := library.oldEncodingKey(newKey); ok {
+		t.Error("expected no copy in the old encoding")
+	}
+
+	// with it, they are written with the new one, and read from the new one first unless configured otherwise
+	WithKeyEncodingCompatibility(NewEncodingFirst)(library)
+	if key := library.encodePartitionKey("7", "1234"); key != padded {
+		t.Error("expected", padded, "got", key)
+	}
+	if keys := library.migrationPartitionKeys("7", "1234"); !reflect.DeepEqual(keys, []string{padded, "7.1234"}) {
+		t.Error("expected", padded, "then the legacy key, got", keys)
+	}
+	WithKeyEncodingCompatibility(OldEncodingFirst)(library)
+	if keys := library.migrationPartitionKeys("7", "1234"); !reflect.DeepEqual(keys, []string{"7.1234", padded}) {
+		t.Error("expected the legacy key, then", padded, "got", keys)
+	}
+	for _, value := range []string{"7.1234", padded} {
+		if id, key := library.decodePartitionKey(value); id != "7" || key != "1234" {
+			t.Error("expected snapshot 7 and key 1234 for", value, "got", id, key)
+		}
+	}
+
+	// the copies in the old encoding are deleted before deletes and after puts
+	old, ok := library.oldEncodingKey(newKey)
+	if !ok || aws.StringValue(old["year"].N) != "7.1234" {
+		t.Error("expected the legacy key, got", old)
+	}
+	if _, ok := library.oldEncodingKey(map[string]*dynamodb.AttributeValue{"year": {N: aws.String("7.1234")}}); ok {
+		t.Error("expected no copy of a key in the old encoding")
+	}
+	before, after := library.oldEncodingDeletes([]*dynamodb.WriteRequest{
+		{DeleteRequest: &dynamodb.DeleteRequest{Key: newKey}},
+		{PutRequest: &dynamodb.PutRequest{Item: map[string]*dynamodb.AttributeValue{
+			"year": {N: aws.String("8" + strings.Repeat("0", numericKeyWidth-4) + "1234")},
+		}}},
+	})
+	if len(before) != 1 || aws.StringValue(before[0].DeleteRequest.Key["year"].N) != "7.1234" {
+		t.Error("expected the delete of 7.1234 first, got", before)
+	}
+	if len(after) != 1 || aws.StringValue(after[0].DeleteRequest.Key["year"].N) != "8.1234" {
+		t.Error("expected the delete of 8.1234 last, got", after)
+	}
+
+	// nothing changes once the migration is over
+	library.keyEncoding, library.keyMigration = keyEncodingPadded, ""
+	if _, ok := library.oldEncodingKey(newKey); ok {
+		t.Error("expected no copy in the old encoding")
+	}
+	if keys := library.migrationPartitionKeys("7", "1234"); keys != nil {
+		t.Error("expected a single key, got", keys)
+	}
+}
+
+// keyedStorage serves the items it has, keyed on a numeric partition key, to queries on the partition key and batch
+// gets
+type keyedStorage struct {
+	Storage
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (s *keyedStorage) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+	if item, ok := s.items[aws.StringValue(input.ExpressionAttributeValues[":year"].N)]; ok {
+		items = append(items, item)
+	}
+
+	return &dynamodb.QueryOutput{Items: items, Count: aws.Int64(int64(len(items)))}, nil
+}
+
+func (s *keyedStorage) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+	for table, request := range input.RequestItems {
+		for _, key := range request.Keys {
+			if item, ok := s.items[aws.StringValue(key["year"].N)]; ok {
+				items = append(items, map[string]*dynamodb.AttributeValue{"year": {N: item["year"].N}})
+			}
+		}
+		responses := map[string][]map[string]*dynamodb.AttributeValue{table: items}
+		return &dynamodb.BatchGetItemOutput{Responses: responses}, nil
+	}
+
+	return &dynamodb.BatchGetItemOutput{}, nil
+}
+
+func TestLibrary_keyEncodingMigrationReads(t *testing.T) {
+	padded := "7" + strings.Repeat("0", numericKeyWidth-4) + "2001"
+	library := &Library{
+		tableName:        "movies",
+		partitionKey:     "year",
+		partitionKeyType: "N",
+		keyEncoding:      keyEncodingLegacy,
+		keyMigration:     keyEncodingPadded,
+		svc: &keyedStorage{items: map[string]map[string]*dynamodb.AttributeValue{
+			// one item already converted, one not yet
+			"7.1999": {"year": {N: aws.String("7.1999")}},
+			padded:   {"year": {N: aws.String(padded)}},
+		}},
+	}
+
+	for _, year := range []string{"1999", "2001"} {
+		out, err := library.queryWithSnapshotID(aws.BackgroundContext(), &dynamodb.QueryInput{
+			TableName:                 aws.String("movies"),
+			KeyConditionExpression:    aws.String("year = :year"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":year": {N: aws.String(year)}},
+		}, "7")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if len(out.Items) != 1 || aws.StringValue(out.Items[0]["year"].N) != year {
+			t.Error("expected to find", year, "got", out.Items)
+		}
+	}
+
+	out, err := library.batchGetItemWithSnapshotID(aws.BackgroundContext(), &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]*dynamodb.KeysAndAttributes{"movies": {Keys: []map[string]*dynamodb.AttributeValue{
+			{"year": {N: aws.String("1999")}},
+			{"year": {N: aws.String("2001")}},
+			{"year": {N: aws.String("2003")}},
+		}}},
+	}, "7")
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	found := make([]string, 0)
+	for _, item := range out.Responses["movies"] {
+		found = append(found, aws.StringValue(item["year"].N))
+	}
+	if !reflect.DeepEqual(found, []string{"1999", "2001"}) {
+		t.Error("expected to find 1999 and 2001, got", found)
+	}
+}
+
+// changingItemStorage fails the first transaction made through it as if the item had changed since it was read, and
+// serves the changed item, keeping the transactions made
+type changingItemStorage struct {
+	Storage
+	changed      map[string]*dynamodb.AttributeValue
+	transactions []*dynamodb.TransactWriteItemsInput
+}
+
+func (s *changingItemStorage) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	s.transactions = append(s.transactions, input)
+	if len(s.transactions) == 1 {
+		return nil, &dynamodb.TransactionCanceledException{CancellationReasons: []*dynamodb.CancellationReason{
+			{Code: aws.String("ConditionalCheckFailed")},
+			{Code: aws.String("None")},
+		}}
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func (s *changingItemStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: s.changed}, nil
+}
+
+func TestLibrary_convertItemKey(t *testing.T) {
+	storage := &changingItemStorage{changed: map[string]*dynamodb.AttributeValue{
+		"year":  {N: aws.String("7.1999")},
+		"title": {S: aws.String("The Matrix Reloaded")},
+	}}
+	library := &Library{tableName: "movies", partitionKey: "year", partitionKeyType: "N", svc: storage}
+	item := map[string]*dynamodb.AttributeValue{
+		"year":  {N: aws.String("7.1999")},
+		"title": {S: aws.String("The Matrix")},
+	}
+
+	padded := "7" + strings.Repeat("0", numericKeyWidth-4) + "1999"
+	_, err := library.convertItemKey(aws.BackgroundContext(), item, &dynamodb.AttributeValue{N: aws.String(padded)})
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if len(storage.transactions) != 2 {
+		t.Fatal("expected the item to be read again and moved, got", len(storage.transactions), "transactions")
+	}
+
+	// the old key is only deleted if the item is still as it was read
+	for i, title := range []string{"The Matrix", "The Matrix Reloaded"} {
+		deleted := storage.transactions[i].TransactItems[0].Delete
+		if aws.StringValue(deleted.ConditionExpression) != "attribute_exists(#pk) AND #attribute0 = :attribute0" ||
+			aws.StringValue(deleted.ExpressionAttributeValues[":attribute0"].S) != title {
+			t.Error("expected the delete to require the title", title, "got", deleted)
+		}
+	}
+	put := storage.transactions[1].TransactItems[1].Put.Item
+	if aws.StringValue(put["title"].S) != "The Matrix Reloaded" || aws.StringValue(put["year"].N) != padded {
+		t.Error("expected the changed item under", padded, "got", put)
+	}
+}
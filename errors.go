@@ -0,0 +1,375 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Errors that the errors returned by the Library can be matched against with errors.Is, e.g.,
+// errors.Is(err, ErrSnapshotNotFound); the error types below, which errors.As can extract, tell the details.
+var (
+	// a snapshot, or snapshot ID, does not exist (see SnapshotNotFoundError)
+	ErrSnapshotNotFound = errors.New("snapshot does not exist")
+	// a snapshot with the same name already exists (see SnapshotExistsError)
+	ErrSnapshotExists = errors.New("snapshot already exists")
+	// every snapshot ID the table allows for is in use (see SnapshotLimitError)
+	ErrSnapshotLimitReached = errors.New("no snapshot IDs left")
+	// an input refers to more than one table, one of them the managed table (see UnsupportedInputError)
+	ErrMultipleTables = errors.New("input refers to multiple tables")
+	// an input names a table other than the one managed by the Library (see TableMismatchError)
+	ErrNotManagedTable = errors.New("table is not managed by the Library")
+	// a write would change a snapshot that is locked (see SnapshotLockedError)
+	ErrSnapshotLocked = errors.New("snapshot is locked")
+	// PopBrowse was called without a matching PushBrowse
+	ErrBrowseStackEmpty = errors.New("no browsing state to go back to")
+	// Client was called on a Library whose Storage is not a full DynamoDB client (see WithStorage)
+	ErrStorageNotClient = errors.New("storage does not implement dynamodbiface.DynamoDBAPI")
+)
+
+// SnapshotNotFoundError is returned when a snapshot, referred to either by name or by ID, does not exist.
+type SnapshotNotFoundError struct {
+	// name of the snapshot, if referred to by name
+	Snapshot string
+	// ID of the snapshot, if referred to by ID
+	ID string
+}
+
+func (e *SnapshotNotFoundError) Error() string {
+	if e.Snapshot == "" && e.ID != "" {
+		return "snapshot ID '" + e.ID + "' does not exist"
+	}
+
+	return "snapshot '" + e.Snapshot + "' does not exist"
+}
+
+func (e *SnapshotNotFoundError) Is(target error) bool {
+	return target == ErrSnapshotNotFound
+}
+
+// SnapshotExistsError is returned when taking a snapshot with the name of one that already exists.
+type SnapshotExistsError struct {
+	Snapshot string
+}
+
+func (e *SnapshotExistsError) Error() string {
+	return "snapshot already exists: " + e.Snapshot
+}
+
+func (e *SnapshotExistsError) Is(target error) bool {
+	return target == ErrSnapshotExists
+}
+
+// TableMismatchError is returned when an input names a table other than the one managed by the Library. Operating on
+// it would silently bypass snapshots altogether.
+type TableMismatchError struct {
+	// table named by the input
+	Table string
+	// table managed by the Library
+	Managed string
+}
+
+func (e *TableMismatchError) Error() string {
+	return "expected the managed table " + e.Managed + ", got " + e.Table
+}
+
+func (e *TableMismatchError) Is(target error) bool {
+	return target == ErrNotManagedTable
+}
+
+// UnsupportedInputError is returned when an input uses a feature that the Library cannot handle faithfully, e.g.,
+// because it would bypass snapshots or never match the keys as they are stored. Some are always rejected (e.g.,
+// batches on multiple tables), others only in strict mode (see WithStrictMode).
+type UnsupportedInputError struct {
+	// operation the input was passed to, e.g., "PutItem"
+	Operation string
+	// field of the input, or construct, that is not supported, e.g., "ConditionExpression"
+	Feature string
+	// why it is not supported
+	Reason string
+	// the input refers to the managed table along with others
+	multipleTables bool
+}
+
+func (e *UnsupportedInputError) Error() string {
+	return e.Operation + ": " + e.Feature + " is not supported: " + e.Reason
+}
+
+func (e *UnsupportedInputError) Is(target error) bool {
+	return target == ErrMultipleTables && e.multipleTables
+}
+
+// ConcurrentMetadataChangeError is returned when an operation that changes the table's metadata (e.g., Snapshot or
+// Rollback) loses a race with another client that changed it first. It tells the snapshots the operation expected to
+// find, as latest and current (see Rollback), and the ones actually found right after the conflict; an empty ID
+// means no snapshot, i.e., the data written before any snapshots were taken. See WithConflictRetry.
+type ConcurrentMetadataChangeError struct {
+	// operation that failed, e.g., "Snapshot"
+	Operation         string
+	ExpectedLatestID  string
+	ExpectedCurrentID string
+	ActualLatestID    string
+	ActualCurrentID   string
+}
+
+func (e *ConcurrentMetadataChangeError) Error() string {
+	return e.Operation + ": the metadata was changed concurrently: expected latest snapshot '" + e.ExpectedLatestID +
+		"' and current '" + e.ExpectedCurrentID + "', found latest '" + e.ActualLatestID + "' and current '" +
+		e.ActualCurrentID + "'"
+}
+
+// CapacityError is returned when an operation would write, or delete, more items than the table's provisioned write
+// capacity can absorb within the limit allowed (see WithCapacityCheck).
+type CapacityError struct {
+	// operation that was refused, e.g., "Restore"
+	Operation string
+	// number of items it would write, or delete
+	Items int64
+	// lowest write capacity units provisioned on the table, or any of its global secondary indexes
+	WriteCapacity int64
+	// how long writing all the items would take at that capacity, at best
+	Estimate time.Duration
+	Limit    time.Duration
+}
+
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("%s: writing %d items at %d WCU would take at least %s, more than the %s allowed",
+		e.Operation, e.Items, e.WriteCapacity, e.Estimate, e.Limit)
+}
+
+// PolicyViolationError is returned when an operation would break the snapshot policy recorded in the table's
+// metadata (see SetSnapshotPolicy).
+type PolicyViolationError struct {
+	// operation that was refused, e.g., "Snapshot"
+	Operation string
+	// field of SnapshotPolicy that refused it, e.g., "MaxSnapshots"
+	Rule   string
+	Reason string
+}
+
+func (e *PolicyViolationError) Error() string {
+	return e.Operation + ": refused by the snapshot policy (" + e.Rule + "): " + e.Reason
+}
+
+// SnapshotLimitError is returned by Snapshot when every snapshot ID the table allows for is in use. Destroying
+// snapshots frees their IDs; SetSnapshotIDLength allows for more.
+type SnapshotLimitError struct {
+	// number of snapshots the table allows for
+	Limit int
+	// maximum number of digits of snapshot IDs
+	IDLength int
+}
+
+func (e *SnapshotLimitError) Error() string {
+	return fmt.Sprintf("no snapshot IDs left: all %d IDs of up to %d digits are in use", e.Limit, e.IDLength)
+}
+
+func (e *SnapshotLimitError) Is(target error) bool {
+	return target == ErrSnapshotLimitReached
+}
+
+// SnapshotWriteError is returned when BatchWriteItemToSnapshots fails to write the requests of a snapshot. The
+// snapshots before it, in Written, were written in full, and the ones after it, in Pending, were not written at all.
+type SnapshotWriteError struct {
+	// snapshot whose requests failed to be written
+	Snapshot string
+	// number of requests written to each snapshot, including the one that failed
+	Written map[string]int
+	// keys of the requests of the snapshot that failed which were not written, or may not have been
+	FailedKeys []map[string]*dynamodb.AttributeValue
+	// snapshots whose requests were not sent at all
+	Pending []string
+	Err     error
+}
+
+func (e *SnapshotWriteError) Error() string {
+	return fmt.Sprintf("failed to write %d requests to snapshot '%s': %s", len(e.FailedKeys), e.Snapshot, e.Err)
+}
+
+func (e *SnapshotWriteError) Unwrap() error {
+	return e.Err
+}
+
+// GroupError is returned when an operation on a Group fails on one of its tables. The tables before it were undone,
+// unless that failed too, and the ones after it were not changed at all.
+type GroupError struct {
+	// operation that failed, e.g., "Snapshot"
+	Operation string
+	// table the operation failed on
+	Table string
+	Err   error
+	// tables the operation had succeeded on, and was undone on
+	Undone []string
+	// tables the operation had succeeded on, but failed to be undone on, and why
+	UndoFailed map[string]error
+	// tables the operation was not attempted on
+	Skipped []string
+}
+
+func (e *GroupError) Error() string {
+	msg := e.Operation + " failed on table " + e.Table + ": " + e.Err.Error()
+	if len(e.UndoFailed) > 0 {
+		tables := make([]string, 0, len(e.UndoFailed))
+		for table := range e.UndoFailed {
+			tables = append(tables, table)
+		}
+		sort.Strings(tables)
+		msg += " (and could not be undone on " + strings.Join(tables, ", ") + ")"
+	}
+
+	return msg
+}
+
+func (e *GroupError) Unwrap() error {
+	return e.Err
+}
+
+// SnapshotLockedError is returned when a write would change a snapshot that is locked (see LockSnapshot), e.g., while
+// it is the current one after a rollback to it.
+type SnapshotLockedError struct {
+	// operation that was refused, e.g., "PutItem"
+	Operation string
+	Snapshot  string
+}
+
+func (e *SnapshotLockedError) Error() string {
+	return e.Operation + ": snapshot '" + e.Snapshot + "' is locked"
+}
+
+func (e *SnapshotLockedError) Is(target error) bool {
+	return target == ErrSnapshotLocked
+}
+
+// ItemChangedError is returned by PutItemIfUnchangedSince when the item was written to, or deleted, after the version
+// the caller read, i.e., the write would have overwritten a version the caller has not seen.
+type ItemChangedError struct {
+	// primary key of the item, without the snapshot
+	Key map[string]*dynamodb.AttributeValue
+	Err error
+}
+
+func (e *ItemChangedError) Error() string {
+	return "the item changed since it was read: " + e.Err.Error()
+}
+
+func (e *ItemChangedError) Unwrap() error {
+	return e.Err
+}
+
+// an error with some context added to it, e.g., what the Library was doing when DynamoDB returned it; the error
+// itself, which may be an awserr.Error, is still available to errors.Is and errors.As
+type wrappedError struct {
+	context string
+	err     error
+}
+
+func (e *wrappedError) Error() string {
+	return e.context + ": " + e.err.Error()
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+// add context to an error, e.g., wrapError("failed to read the metadata", err)
+func wrapError(context string, err error) error {
+	return &wrappedError{context: context, err: err}
+}
+
+// return true if err means the condition of a conditional write did not hold
+func isConditionalCheckFailure(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// return true if err means a transaction was canceled because the conditions of some of its writes did not hold, and
+// for no other reason
+func isConditionalTransactionFailure(err error) bool {
+	canceled, ok := err.(*dynamodb.TransactionCanceledException)
+	if !ok {
+		return false
+	}
+
+	failed := false
+	for _, reason := range canceled.CancellationReasons {
+		switch aws.StringValue(reason.Code) {
+		case "", "None":
+		case "ConditionalCheckFailed":
+			failed = true
+		default:
+			return false
+		}
+	}
+
+	return failed
+}
+
+// build the error for an operation that failed to change the metadata because someone else changed it first, meta
+// being what the operation expected to find
+func (c *Library) concurrentMetadataChange(ctx aws.Context, operation string, meta *config) error {
+	e := &ConcurrentMetadataChangeError{
+		Operation:         operation,
+		ExpectedLatestID:  meta.latestSnapshotID,
+		ExpectedCurrentID: meta.getCurrentSnapshotID(),
+	}
+
+	actual, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return errors.New(e.Error() + " (failed to read the metadata again: " + err.Error() + ")")
+	}
+	e.ActualLatestID = actual.latestSnapshotID
+	e.ActualCurrentID = actual.getCurrentSnapshotID()
+
+	return e
+}
+
+// run fn, which changes the table's metadata, once more if it loses a race with another client and retries are
+// enabled (see WithConflictRetry); fn must read the metadata again every time it runs
+func (c *Library) retryOnConflict(fn func() error) error {
+	err := fn()
+	if _, ok := err.(*ConcurrentMetadataChangeError); ok && c.conflictRetry {
+		err = fn()
+	}
+
+	return err
+}
+
+// fill in the name of the managed table if table is empty, or make sure it is the managed table otherwise
+func (c *Library) resolveTable(table **string) error {
+	if aws.StringValue(*table) == "" {
+		*table = aws.String(c.tableName)
+		return nil
+	}
+
+	if **table != c.tableName {
+		return &TableMismatchError{Table: **table, Managed: c.tableName}
+	}
+
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_resolveTable(t *testing.T) {
+	library := &Library{tableName: "movies"}
+
+	for _, table := range []*string{nil, aws.String(""), aws.String("movies")} {
+		err := library.resolveTable(&table)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if aws.StringValue(table) != "movies" {
+			t.Error("expected movies, got", aws.StringValue(table))
+		}
+	}
+
+	table := aws.String("series")
+	err := library.resolveTable(&table)
+	mismatch, ok := err.(*TableMismatchError)
+	if !ok {
+		t.Fatal("expected a *TableMismatchError, got", err)
+	}
+	if mismatch.Table != "series" || mismatch.Managed != "movies" || *table != "series" {
+		t.Error("expected series instead of movies, got", mismatch, *table)
+	}
+}
+
+// racingStorage runs race right before the first update, e.g., to change the metadata behind the Library's back
+type racingStorage struct {
+	Storage
+	race func()
+}
+
+func (s *racingStorage) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	if s.race != nil {
+		race := s.race
+		s.race = nil
+		race()
+	}
+
+	return s.Storage.UpdateItem(input)
+}
+
+func TestLibrary_ConcurrentMetadataChange(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		library.Snapshot("1")
+
+		storage := &racingStorage{Storage: library.svc, race: func() { library.Snapshot("2") }}
+		racing := newClient(schema, t, WithStorage(storage))
+		err := racing.Snapshot("3")
+		e, ok := err.(*ConcurrentMetadataChangeError)
+		if !ok {
+			t.Error("expected a *ConcurrentMetadataChangeError, got", err)
+		} else {
+			ids, _, _ := library.SnapshotIDMap()
+			if e.Operation != "Snapshot" || e.ExpectedLatestID != ids["1"] || e.ActualLatestID != ids["2"] ||
+				e.ActualCurrentID != ids["2"] {
+				t.Error("expected to lose the race to snapshot 2, got", e)
+			}
+		}
+
+		storage.race = func() { library.Rollback("1") }
+		err = racing.Rollback("2")
+		if _, ok := err.(*ConcurrentMetadataChangeError); !ok {
+			t.Error("expected a *ConcurrentMetadataChangeError, got", err)
+		}
+
+		// the retry sees the concurrent change
+		library.Rollback("2")
+		storage = &racingStorage{Storage: library.svc, race: func() { library.Snapshot("4") }}
+		retrying := newClient(schema, t, WithStorage(storage), WithConflictRetry())
+		err = retrying.Snapshot("5")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		snapshots, _ := library.ListSnapshots()
+		if len(snapshots) != 4 {
+			t.Error("expected 4 snapshots, got", snapshots)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestIsConditionalTransactionFailure(t *testing.T) {
+	canceled := func(codes ...string) error {
+		e := &dynamodb.TransactionCanceledException{}
+		for _, code := range codes {
+			e.CancellationReasons = append(e.CancellationReasons, &dynamodb.CancellationReason{Code: aws.String(code)})
+		}
+		return e
+	}
+
+	if !isConditionalTransactionFailure(canceled("None", "ConditionalCheckFailed")) {
+		t.Error("expected a failed condition")
+	}
+	if isConditionalTransactionFailure(canceled("ConditionalCheckFailed", "TransactionConflict")) {
+		t.Error("expected a conflict not to count as a failed condition")
+	}
+	if isConditionalTransactionFailure(canceled("None")) {
+		t.Error("expected no failed condition")
+	}
+}
+
+func TestErrors_Is(t *testing.T) {
+	for _, test := range []struct {
+		err    error
+		target error
+	}{
+		{&SnapshotNotFoundError{Snapshot: "a"}, ErrSnapshotNotFound},
+		{&SnapshotNotFoundError{ID: "1"}, ErrSnapshotNotFound},
+		{&SnapshotExistsError{Snapshot: "a"}, ErrSnapshotExists},
+		{&SnapshotLimitError{Limit: 99, IDLength: 2}, ErrSnapshotLimitReached},
+		{&UnsupportedInputError{Operation: "BatchWriteItem", multipleTables: true}, ErrMultipleTables},
+		{&TableMismatchError{Table: "other", Managed: "movies"}, ErrNotManagedTable},
+		{&SnapshotLockedError{Operation: "PutItem", Snapshot: "a"}, ErrSnapshotLocked},
+		// wrapping keeps them recognizable
+		{wrapError("failed to get snapshot ID", &SnapshotNotFoundError{Snapshot: "a"}), ErrSnapshotNotFound},
+		{&SnapshotWriteError{Snapshot: "a", Err: &batchWriteError{err: &SnapshotNotFoundError{}}}, ErrSnapshotNotFound},
+	} {
+		if !errors.Is(test.err, test.target) {
+			t.Error("expected", test.err, "to be", test.target)
+		}
+	}
+
+	if errors.Is(&UnsupportedInputError{Operation: "Scan", Feature: "Segment"}, ErrMultipleTables) {
+		t.Error("expected other unsupported inputs not to be ErrMultipleTables")
+	}
+	if errors.Is(&SnapshotNotFoundError{Snapshot: "a"}, ErrSnapshotExists) {
+		t.Error("expected a missing snapshot not to be ErrSnapshotExists")
+	}
+	if e := (&SnapshotNotFoundError{ID: "1"}); e.Error() != "snapshot ID '1' does not exist" {
+		t.Error("expected the ID in the message, got", e.Error())
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	err := wrapError("failed to read the metadata", throttled)
+
+	if err.Error() != "failed to read the metadata: "+throttled.Error() {
+		t.Error("expected the context before the error, got", err.Error())
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeProvisionedThroughputExceededException {
+		t.Error("expected the AWS error to be found, got", err)
+	}
+}
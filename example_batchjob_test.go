@@ -24,6 +24,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -31,6 +32,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 
 	"github.com/marcoalmeida/ddblibrarian"
+	"github.com/marcoalmeida/ddblibrarian/localtest"
 )
 
 const (
@@ -40,9 +42,19 @@ const (
 	partitionKeyType = "N"
 	rangeKeyType     = "S"
 	region           = "us-west-2"
-	endpoint         = "http://localhost:8000"
 )
 
+// return the DynamoDB Local instance the examples run against, the same the tests run against (see
+// localtest.FromEnv), or the first one of them
+func exampleEndpoint() string {
+	pool, err := localtest.FromEnv(region)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return pool.Endpoint()
+}
+
 var dataSets []string = []string{"example_batchjob_moviedata_1.json", "example_batchjob_moviedata_2.json"}
 
 type movieInfo struct {
@@ -67,7 +79,7 @@ type movie struct {
 func setup() error {
 	ddbSession, err := session.NewSession(&aws.Config{
 		Region:     aws.String(region),
-		Endpoint:   aws.String(endpoint),
+		Endpoint:   aws.String(exampleEndpoint()),
 		MaxRetries: aws.Int(1),
 	})
 
@@ -110,7 +122,7 @@ func setup() error {
 func teardown() error {
 	ddbSession, err := session.NewSession(&aws.Config{
 		Region:     aws.String(region),
-		Endpoint:   aws.String(endpoint),
+		Endpoint:   aws.String(exampleEndpoint()),
 		MaxRetries: aws.Int(1),
 	})
 
@@ -130,7 +142,7 @@ func teardown() error {
 func connect() (*ddblibrarian.Library, error) {
 	ddbSession, err := session.NewSession(&aws.Config{
 		Region:     aws.String(region),
-		Endpoint:   aws.String(endpoint),
+		Endpoint:   aws.String(exampleEndpoint()),
 		MaxRetries: aws.Int(1),
 	})
 
@@ -0,0 +1,89 @@
+//go:build dynamodblocal
+// +build dynamodblocal
+
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian_test
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+
+	"github.com/marcoalmeida/ddblibrarian"
+)
+
+// Dump a snapshot and load it back into a new one. A dump has the same format as each part of an export, and the
+// snapshot ID is not part of it, so it can be loaded into any snapshot, or any table.
+func ExampleLibrary_DumpSnapshot() {
+	library, teardown := newExampleLibrary("ExampleDump")
+	defer teardown()
+
+	library.Snapshot("2017-10-01")
+	putMovie(library, "2012", "The Avengers", "8.1")
+	putMovie(library, "2012", "Skyfall", "7.8")
+
+	var dump bytes.Buffer
+	dumped, err := library.DumpSnapshot(&dump, "2017-10-01", nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("dumped", dumped, "items")
+
+	library.Snapshot("2017-10-02")
+	putMovie(library, "2012", "The Avengers", "5.5")
+
+	loaded, err := library.LoadSnapshot(&dump, "2017-10-02", nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("loaded", loaded, "items")
+	fmt.Println("The Avengers:", getRating(library, "2012", "The Avengers"))
+
+	// Output:
+	// dumped 2 items
+	// loaded 2 items
+	// The Avengers: 8.1
+}
+
+// Archive a snapshot to S3 before destroying it, and bring it back later on as a new snapshot. DynamoDB Local has no
+// S3 to write to, so this example is only compiled.
+func ExampleLibrary_ExportSnapshot() {
+	library, teardown := newExampleLibrary("ExampleExport")
+	defer teardown()
+
+	manifest, err := library.ExportSnapshot("2017-10-01", "archive", "movies/2017-10-01", ddblibrarian.ExportJSONGzip)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("exported", manifest.Items, "items in", len(manifest.Parts), "parts")
+
+	err = library.DestroySnapshot("2017-10-01")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	imported, err := library.ImportSnapshot("s3://archive/movies/2017-10-01", "2017-10-01-restored")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("imported", imported, "items")
+}
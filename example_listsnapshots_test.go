@@ -38,7 +38,7 @@ func ExampleLibrary_ListSnapshots() {
 	// Create a new session for the DynamoDB client
 	s, err := session.NewSession(&aws.Config{
 		Region:     aws.String("us-east-1"),
-		Endpoint:   aws.String("http://localhost:8000"),
+		Endpoint:   aws.String(exampleEndpoint()),
 		MaxRetries: aws.Int(3),
 	})
 	if err != nil {
@@ -58,7 +58,7 @@ func ExampleLibrary_ListSnapshots() {
 	}
 
 	for _, s := range snapshots {
-		fmt.Println(s)
+		fmt.Println(s.Name, s.Created)
 	}
 
 	// Output:
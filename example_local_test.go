@@ -0,0 +1,115 @@
+//go:build dynamodblocal
+// +build dynamodblocal
+
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian_test
+
+import (
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+
+	"github.com/marcoalmeida/ddblibrarian"
+)
+
+// The examples in files with the dynamodblocal build tag run against DynamoDB Local, at exampleEndpoint, so that the
+// behavior they document is checked by go test -tags dynamodblocal. Each one works on a table of its own, with the
+// same schema as the Movies table.
+
+// create a table for an example, and return a Library for it along with a function that deletes the table
+func newExampleLibrary(table string) (*ddblibrarian.Library, func()) {
+	s, err := session.NewSession(&aws.Config{
+		Region:     aws.String(region),
+		Endpoint:   aws.String(exampleEndpoint()),
+		MaxRetries: aws.Int(1),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	svc := dynamodb.New(s)
+	_, err = svc.CreateTable(&dynamodb.CreateTableInput{
+		TableName: aws.String(table),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(partitionKey), KeyType: aws.String(dynamodb.KeyTypeHash)},
+			{AttributeName: aws.String(rangeKey), KeyType: aws.String(dynamodb.KeyTypeRange)},
+		},
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(partitionKey), AttributeType: aws.String(partitionKeyType)},
+			{AttributeName: aws.String(rangeKey), AttributeType: aws.String(rangeKeyType)},
+		},
+		ProvisionedThroughput: &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(100),
+			WriteCapacityUnits: aws.Int64(100),
+		},
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	err = svc.WaitUntilTableExists(&dynamodb.DescribeTableInput{TableName: aws.String(table)})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	library, err := ddblibrarian.New(table, partitionKey, partitionKeyType, rangeKey, rangeKeyType, s)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	return library, func() {
+		svc.DeleteTable(&dynamodb.DeleteTableInput{TableName: aws.String(table)})
+	}
+}
+
+// write a movie, and its rating, to the active snapshot
+func putMovie(library *ddblibrarian.Library, year string, title string, rating string) {
+	_, err := library.PutItem(&dynamodb.PutItemInput{
+		Item: map[string]*dynamodb.AttributeValue{
+			partitionKey: {N: aws.String(year)},
+			rangeKey:     {S: aws.String(title)},
+			"rating":     {N: aws.String(rating)},
+		},
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// return the rating of a movie, as seen from the active snapshot
+func getRating(library *ddblibrarian.Library, year string, title string) string {
+	out, err := library.GetItem(&dynamodb.GetItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			partitionKey: {N: aws.String(year)},
+			rangeKey:     {S: aws.String(title)},
+		},
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if out.Item == nil {
+		return "none"
+	}
+
+	return aws.StringValue(out.Item["rating"].N)
+}
@@ -0,0 +1,70 @@
+//go:build dynamodblocal
+// +build dynamodblocal
+
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Query the movies of a year from two snapshots. Unlike GetItem, QueryFromSnapshot does not fall back to older
+// snapshots: it only finds the items written to the snapshot queried.
+func ExampleLibrary_QueryFromSnapshot() {
+	library, teardown := newExampleLibrary("ExampleQuery")
+	defer teardown()
+
+	library.Snapshot("2017-10-01")
+	putMovie(library, "2012", "The Avengers", "8.1")
+	putMovie(library, "2012", "Skyfall", "7.8")
+
+	library.Snapshot("2017-10-02")
+	putMovie(library, "2012", "The Avengers", "8.2")
+
+	for _, snapshot := range []string{"2017-10-01", "2017-10-02"} {
+		out, err := library.QueryFromSnapshot(&dynamodb.QueryInput{
+			KeyConditionExpression: aws.String("#year = :year"),
+			ExpressionAttributeNames: map[string]*string{
+				"#year": aws.String(partitionKey),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":year": {N: aws.String("2012")},
+			},
+		}, snapshot)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		for _, item := range out.Items {
+			fmt.Println(snapshot, aws.StringValue(item[rangeKey].S), aws.StringValue(item["rating"].N))
+		}
+	}
+
+	// Output:
+	// 2017-10-01 Skyfall 7.8
+	// 2017-10-01 The Avengers 8.1
+	// 2017-10-02 The Avengers 8.2
+}
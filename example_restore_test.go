@@ -0,0 +1,80 @@
+//go:build dynamodblocal
+// +build dynamodblocal
+
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian_test
+
+import (
+	"fmt"
+	"log"
+)
+
+// Undo the changes made since a snapshot was taken. Unlike Rollback, which only changes which snapshot is active,
+// Restore writes the items of the older snapshot to the active one.
+func ExampleLibrary_Restore() {
+	library, teardown := newExampleLibrary("ExampleRestore")
+	defer teardown()
+
+	library.Snapshot("2017-10-01")
+	putMovie(library, "2012", "The Avengers", "8.1")
+
+	library.Snapshot("2017-10-02")
+	putMovie(library, "2012", "The Avengers", "5.5")
+	putMovie(library, "2012", "Skyfall", "7.8")
+	fmt.Println("before:", getRating(library, "2012", "The Avengers"), getRating(library, "2012", "Skyfall"))
+
+	err := library.Restore("2017-10-01")
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("after:", getRating(library, "2012", "The Avengers"), getRating(library, "2012", "Skyfall"))
+
+	// Output:
+	// before: 5.5 7.8
+	// after: 8.1 none
+}
+
+// Run a restore in the background, as a Job, and wait for it to finish.
+func ExampleLibrary_StartRestore() {
+	library, teardown := newExampleLibrary("ExampleStartRestore")
+	defer teardown()
+
+	library.Snapshot("2017-10-01")
+	putMovie(library, "2012", "The Avengers", "8.1")
+
+	library.Snapshot("2017-10-02")
+	putMovie(library, "2012", "The Avengers", "5.5")
+
+	job := library.StartRestore("2017-10-01")
+	err := job.Wait()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	status := job.Status()
+	fmt.Println(status.Operation, status.Snapshot, status.State, status.Items)
+	fmt.Println("The Avengers:", getRating(library, "2012", "The Avengers"))
+
+	// Output:
+	// Restore 2017-10-01 succeeded 1
+	// The Avengers: 8.1
+}
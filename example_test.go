@@ -38,7 +38,7 @@ func ExampleNew() {
 	// Create a new session for the DynamoDB client
 	s, err := session.NewSession(&aws.Config{
 		Region:     aws.String("us-east-1"),
-		Endpoint:   aws.String("http://localhost:8000"),
+		Endpoint:   aws.String(exampleEndpoint()),
 		MaxRetries: aws.Int(3),
 	})
 	if err != nil {
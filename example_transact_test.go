@@ -0,0 +1,71 @@
+//go:build dynamodblocal
+// +build dynamodblocal
+
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian_test
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Write two movies at once, or none at all, to the active snapshot.
+func ExampleLibrary_TransactWriteItems() {
+	library, teardown := newExampleLibrary("ExampleTransact")
+	defer teardown()
+
+	library.Snapshot("2017-10-01")
+	putMovie(library, "2012", "Skyfall", "7.8")
+
+	put := func(title string, rating string) *dynamodb.TransactWriteItem {
+		return &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+			Item: map[string]*dynamodb.AttributeValue{
+				partitionKey: {N: aws.String("2012")},
+				rangeKey:     {S: aws.String(title)},
+				"rating":     {N: aws.String(rating)},
+			},
+			ConditionExpression:      aws.String("attribute_not_exists(#title)"),
+			ExpressionAttributeNames: map[string]*string{"#title": aws.String(rangeKey)},
+		}}
+	}
+
+	// Skyfall already exists, so neither movie is written
+	_, err := library.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{put("The Avengers", "8.1"), put("Skyfall", "5.5")},
+	})
+	fmt.Println("canceled:", err != nil)
+	fmt.Println(getRating(library, "2012", "The Avengers"), getRating(library, "2012", "Skyfall"))
+
+	_, err = library.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{put("The Avengers", "8.1"), put("Brave", "7.2")},
+	})
+	fmt.Println("canceled:", err != nil)
+	fmt.Println(getRating(library, "2012", "The Avengers"), getRating(library, "2012", "Brave"))
+
+	// Output:
+	// canceled: true
+	// none 7.8
+	// canceled: false
+	// 8.1 7.2
+}
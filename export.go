@@ -0,0 +1,459 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// name of the object, under the export's prefix, that describes a complete export
+	exportManifestName = "manifest.json"
+	s3Scheme           = "s3://"
+)
+
+// ExportFormat is how the items of an export are written to S3.
+type ExportFormat int
+
+const (
+	// ExportJSON writes newline-delimited JSON, in the format written by DumpSnapshot.
+	ExportJSON ExportFormat = iota
+	// ExportJSONGzip is the same as ExportJSON, compressed with gzip.
+	ExportJSONGzip
+)
+
+func (f ExportFormat) extension() (string, error) {
+	switch f {
+	case ExportJSON:
+		return ".json", nil
+	case ExportJSONGzip:
+		return ".json.gz", nil
+	default:
+		return "", errors.New("unknown export format " + strconv.Itoa(int(f)))
+	}
+}
+
+// ExportManifest describes a complete export. It is written, as JSON, to the manifest.json object under the export's
+// prefix once every part has been uploaded, so an export without one is incomplete.
+type ExportManifest struct {
+	Table      string       `json:"table"`
+	Snapshot   string       `json:"snapshot"`
+	Gzip       bool         `json:"gzip"`
+	ExportedAt time.Time    `json:"exported_at"`
+	Items      int64        `json:"items"`
+	Parts      []ExportPart `json:"parts"`
+}
+
+// ExportPart is one of the objects an export is made of.
+type ExportPart struct {
+	Key   string `json:"key"`
+	Items int64  `json:"items"`
+}
+
+// the subset of s3manager.Uploader used to export snapshots
+type objectUploader interface {
+	UploadWithContext(
+		ctx aws.Context,
+		input *s3manager.UploadInput,
+		opts ...func(*s3manager.Uploader),
+	) (*s3manager.UploadOutput, error)
+}
+
+// the subset of s3.S3 used to import snapshots
+type objectReader interface {
+	GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error)
+}
+
+// replaced in tests
+var (
+	newObjectUploader = func(p client.ConfigProvider) objectUploader {
+		return s3manager.NewUploader(p)
+	}
+	newObjectReader = func(p client.ConfigProvider) objectReader {
+		return s3.New(p)
+	}
+)
+
+// ExportSnapshot archives snapshot to S3, e.g., before destroying it. Unlike DumpSnapshot, the export holds what
+// readers of snapshot see, as ScanMerged returns it: the items written to it along with the ones it falls back to.
+// Items are written, without the snapshot ID, in the format of DumpSnapshot (gzip'ed if format is ExportJSONGzip),
+// spread over prefix/part-NNNNN.json[.gz] in bucket, and each part is streamed to S3 (see ExportParts). Every part can
+// be loaded back with LoadSnapshot. Once all parts have been uploaded, an ExportManifest is written to
+// prefix/manifest.json and returned. Snapshot cannot be empty: it is the one snapshot to export (Baseline for the data
+// written before any snapshots), and the manifest records its name even if it was given as an alias such as latest.
+//
+// Every version of every item involved is kept in memory while the table is scanned. The library must have been
+// created with New, as the AWS session is needed to reach S3.
+//
+// Cost: a full table scan
+func (c *Library) ExportSnapshot(
+	snapshot string,
+	bucket string,
+	prefix string,
+	format ExportFormat,
+	opts ...ExportOption,
+) (*ExportManifest, error) {
+	return c.ExportSnapshotWithContext(aws.BackgroundContext(), snapshot, bucket, prefix, format, opts...)
+}
+
+// ExportSnapshotWithContext is the same as ExportSnapshot with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) ExportSnapshotWithContext(
+	ctx aws.Context,
+	snapshot string,
+	bucket string,
+	prefix string,
+	format ExportFormat,
+	opts ...ExportOption,
+) (*ExportManifest, error) {
+	var manifest *ExportManifest
+
+	err := c.runJob(ctx, "ExportSnapshot", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		manifest, err = c.exportSnapshot(ctx, snapshot, bucket, prefix, format, newExportOptions(opts), reporter)
+		return err
+	})
+
+	return manifest, err
+}
+
+func (c *Library) exportSnapshot(
+	ctx aws.Context,
+	snapshot string,
+	bucket string,
+	prefix string,
+	format ExportFormat,
+	options *exportOptions,
+	reporter *operationReporter,
+) (*ExportManifest, error) {
+	extension, err := format.extension()
+	if err != nil {
+		return nil, err
+	}
+	if bucket == "" {
+		return nil, errors.New("no bucket to export to")
+	}
+	// a scan of all snapshots reads the same key once per snapshot, which could not be imported back as a single one
+	if snapshot == "" {
+		return nil, errors.New("no snapshot to export, use Baseline for the data written before any snapshots")
+	}
+	if c.provider == nil {
+		return nil, errors.New("cannot export without an AWS session, the library must be created with New")
+	}
+	uploader := newObjectUploader(c.provider)
+
+	// the manifest records the snapshot itself, not an alias (e.g., latest) that may point elsewhere by now
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	name := Baseline
+	if id != "" {
+		name, err = meta.getSnapshotName(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	manifest := &ExportManifest{
+		Table:      c.tableName,
+		Snapshot:   name,
+		Gzip:       format == ExportJSONGzip,
+		ExportedAt: c.clock.Now(),
+		Parts:      make([]ExportPart, options.parts),
+	}
+
+	// every part is streamed to its own upload while the snapshot is scanned
+	writers := make([]*exportPartWriter, options.parts)
+	uploaded := make(chan error, options.parts)
+	for i := range writers {
+		key := path.Join(prefix, fmt.Sprintf("part-%05d%s", i, extension))
+		manifest.Parts[i].Key = key
+
+		r, w := io.Pipe()
+		writers[i] = newExportPartWriter(w, format)
+		go func(key string, r *io.PipeReader) {
+			_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+				Bucket: aws.String(bucket),
+				Key:    aws.String(key),
+				Body:   r,
+			})
+			// a failed upload must not leave the scan blocked on the pipe
+			_ = r.CloseWithError(err)
+			uploaded <- err
+		}(key, r)
+	}
+
+	// the export holds what readers of the snapshot see, including the items it falls back to, so that it can be
+	// brought back as it was whatever happens to the snapshots it was taken on top of
+	items, err := c.ScanMergedWithContext(ctx, name)
+	if err == nil {
+		for i, item := range items {
+			part := i % options.parts
+			err = writers[part].encoder.Encode(dumpedItem{Item: toJSONItem(item)})
+			if err != nil {
+				err = wrapError("failed to write item", err)
+				break
+			}
+			manifest.Parts[part].Items++
+			manifest.Items++
+			reporter.read(1)
+		}
+	}
+
+	// end every part, and fail the uploads if the scan did not finish so that incomplete parts are not stored
+	for _, w := range writers {
+		closeErr := w.close(err)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	for range writers {
+		uploadErr := <-uploaded
+		if err == nil && uploadErr != nil {
+			err = wrapError("failed to export snapshot", uploadErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(path.Join(prefix, exportManifestName)),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		return nil, wrapError("failed to upload the export manifest", err)
+	}
+
+	return manifest, nil
+}
+
+// the write end of one part of an export
+type exportPartWriter struct {
+	pipe    *io.PipeWriter
+	gzip    *gzip.Writer
+	encoder *json.Encoder
+}
+
+func newExportPartWriter(pipe *io.PipeWriter, format ExportFormat) *exportPartWriter {
+	w := &exportPartWriter{pipe: pipe}
+
+	var out io.Writer = pipe
+	if format == ExportJSONGzip {
+		w.gzip = gzip.NewWriter(pipe)
+		out = w.gzip
+	}
+	w.encoder = json.NewEncoder(out)
+
+	return w
+}
+
+// close ends the part, or aborts its upload with err
+func (w *exportPartWriter) close(err error) error {
+	if err == nil && w.gzip != nil {
+		err = w.gzip.Close()
+		if err != nil {
+			_ = w.pipe.CloseWithError(err)
+			return err
+		}
+	}
+
+	return w.pipe.CloseWithError(err)
+}
+
+// ImportSnapshot is the counterpart to ExportSnapshot: it reads the export at location, s3://bucket/prefix, takes a
+// new snapshot, as Snapshot would with opts, and writes every item of the export to it, in batches, retrying throttled
+// requests and unprocessed items with exponential backoff. This makes it possible to bring back an archived snapshot,
+// e.g., to browse it or restore from it.
+//
+// The new snapshot branches off the data written before any snapshots, not the snapshots taken since, so it only
+// shows what was exported: live data is only visible from it for keys that are not in the export and were written to
+// Baseline after it. Unlike Snapshot, it does not become the active one: the active snapshot is left as it was in the
+// same metadata update, as if rolled back to right away, so live data is neither read from nor written to the
+// archive. Taking another snapshot then branches off the active one (see RequireActiveEqualsLatest).
+//
+// Exports without a manifest (i.e., incomplete ones) are rejected before the snapshot is taken. If writing the items
+// fails, the snapshot is destroyed, so that the import can be tried again under the same name.
+//
+// It returns the number of items written.
+//
+// Cost: 1RU + 1WU per item
+func (c *Library) ImportSnapshot(location string, snapshot string, opts ...SnapshotOption) (int64, error) {
+	return c.ImportSnapshotWithContext(aws.BackgroundContext(), location, snapshot, opts...)
+}
+
+// ImportSnapshotWithContext is the same as ImportSnapshot with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) ImportSnapshotWithContext(
+	ctx aws.Context,
+	location string,
+	snapshot string,
+	opts ...SnapshotOption,
+) (int64, error) {
+	var count int64
+
+	err := c.runJob(ctx, "ImportSnapshot", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		count, err = c.importSnapshot(ctx, location, snapshot, opts, reporter)
+		return err
+	})
+
+	return count, err
+}
+
+func (c *Library) importSnapshot(
+	ctx aws.Context,
+	location string,
+	snapshot string,
+	opts []SnapshotOption,
+	reporter *operationReporter,
+) (int64, error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return 0, err
+	}
+	if c.provider == nil {
+		return 0, errors.New("cannot import without an AWS session, the library must be created with New")
+	}
+	reader := newObjectReader(c.provider)
+
+	body, err := getObject(ctx, reader, bucket, path.Join(prefix, exportManifestName))
+	if err != nil {
+		return 0, wrapError("failed to read the export manifest", err)
+	}
+	var manifest ExportManifest
+	err = json.NewDecoder(body).Decode(&manifest)
+	_ = body.Close()
+	if err != nil {
+		return 0, wrapError("failed to parse the export manifest", err)
+	}
+
+	// the archive is only brought back to be read from: whatever is active stays so, and the archive does not fall
+	// back to it either
+	archive := func(o *snapshotOptions) {
+		o.keepCurrent = true
+		o.offBaseline = true
+	}
+	err = c.SnapshotWithContext(ctx, snapshot, append(opts, archive)...)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, part := range manifest.Parts {
+		n, err := c.importPart(ctx, reader, bucket, part.Key, manifest.Gzip, snapshot, reporter)
+		count += n
+		if err != nil {
+			err = wrapError("failed to import "+part.Key, err)
+			// a half imported snapshot would be taken for the archive, and the name could not be imported again; it
+			// is destroyed even if the import was canceled
+			destroyErr := c.DestroySnapshotWithContext(aws.BackgroundContext(), snapshot, ForceDestroy())
+			if destroyErr != nil {
+				return count, wrapError(err.Error()+", and failed to destroy the incomplete snapshot", destroyErr)
+			}
+			return count, err
+		}
+	}
+
+	return count, nil
+}
+
+// load one part of an export into snapshot
+func (c *Library) importPart(
+	ctx aws.Context,
+	reader objectReader,
+	bucket string,
+	key string,
+	gzipped bool,
+	snapshot string,
+	reporter *operationReporter,
+) (int64, error) {
+	body, err := getObject(ctx, reader, bucket, key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	var r io.Reader = body
+	if gzipped {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	return c.loadSnapshot(ctx, r, snapshot, nil, reporter)
+}
+
+func getObject(ctx aws.Context, reader objectReader, bucket string, key string) (io.ReadCloser, error) {
+	output, err := reader.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+// split s3://bucket/prefix into its bucket and prefix, which may be empty
+func parseS3Location(location string) (string, string, error) {
+	if !strings.HasPrefix(location, s3Scheme) {
+		return "", "", errors.New("invalid S3 location, expected s3://bucket/prefix: " + location)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(location, s3Scheme), "/", 2)
+	if parts[0] == "" {
+		return "", "", errors.New("invalid S3 location, expected s3://bucket/prefix: " + location)
+	}
+	if len(parts) == 1 {
+		return parts[0], "", nil
+	}
+
+	return parts[0], strings.TrimSuffix(parts[1], "/"), nil
+}
@@ -0,0 +1,366 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// keeps every object uploaded in memory, to read back
+type fakeS3 struct {
+	sync.Mutex
+	objects map[string][]byte
+	// when objects were uploaded, if not long ago
+	modified map[string]time.Time
+	fail     error
+}
+
+func (f *fakeS3) UploadWithContext(
+	ctx aws.Context,
+	input *s3manager.UploadInput,
+	opts ...func(*s3manager.Uploader),
+) (*s3manager.UploadOutput, error) {
+	if f.fail != nil {
+		return nil, f.fail
+	}
+	body, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	f.objects[*input.Bucket+"/"+*input.Key] = body
+
+	return &s3manager.UploadOutput{}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(
+	ctx aws.Context,
+	input *s3.GetObjectInput,
+	opts ...request.Option,
+) (*s3.GetObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	body, ok := f.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, errors.New("no such key: " + *input.Key)
+	}
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(body))}, nil
+}
+
+func (f *fakeS3) ListObjectsV2PagesWithContext(
+	ctx aws.Context,
+	input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool,
+	opts ...request.Option,
+) error {
+	f.Lock()
+	defer f.Unlock()
+	page := &s3.ListObjectsV2Output{}
+	for name := range f.objects {
+		bucket := aws.StringValue(input.Bucket) + "/"
+		if !strings.HasPrefix(name, bucket+aws.StringValue(input.Prefix)) {
+			continue
+		}
+		modified := f.modified[name]
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:          aws.String(strings.TrimPrefix(name, bucket)),
+			LastModified: &modified,
+		})
+	}
+	fn(page, true)
+
+	return nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(
+	ctx aws.Context,
+	input *s3.DeleteObjectInput,
+	opts ...request.Option,
+) (*s3.DeleteObjectOutput, error) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.objects, *input.Bucket+"/"+*input.Key)
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// tests that use a fakeS3 replace the clients of the whole package
+var fakeS3Mutex sync.Mutex
+
+// make the library use a fakeS3 until restore is called, holding on to the DynamoDB Local instance t runs against
+// first (see testSession), since no other test may use a fakeS3 meanwhile
+func useFakeS3(t *testing.T) (f *fakeS3, restore func()) {
+	testSession(t)
+	fakeS3Mutex.Lock()
+	f = &fakeS3{objects: make(map[string][]byte)}
+	originalUploader, originalReader, originalSweeper := newObjectUploader, newObjectReader, newObjectSweeper
+	newObjectUploader = func(client.ConfigProvider) objectUploader {
+		return f
+	}
+	newObjectReader = func(client.ConfigProvider) objectReader {
+		return f
+	}
+	newObjectSweeper = func(client.ConfigProvider) objectSweeper {
+		return f
+	}
+
+	return f, func() {
+		newObjectUploader, newObjectReader, newObjectSweeper = originalUploader, originalReader, originalSweeper
+		fakeS3Mutex.Unlock()
+	}
+}
+
+func TestParseS3Location(t *testing.T) {
+	tests := []struct {
+		location string
+		bucket   string
+		prefix   string
+		valid    bool
+	}{
+		{"s3://archive/exports/snap", "archive", "exports/snap", true},
+		{"s3://archive/exports/snap/", "archive", "exports/snap", true},
+		{"s3://archive", "archive", "", true},
+		{"s3://archive/", "archive", "", true},
+		{"s3://", "", "", false},
+		{"archive/exports", "", "", false},
+	}
+
+	for _, test := range tests {
+		bucket, prefix, err := parseS3Location(test.location)
+		if (err == nil) != test.valid {
+			t.Error("unexpected error for", test.location, err)
+		}
+		if bucket != test.bucket || prefix != test.prefix {
+			t.Error("expected", test.bucket, test.prefix, "for", test.location, "got", bucket, prefix)
+		}
+	}
+}
+
+func TestLibrary_ExportSnapshot(t *testing.T) {
+	fake, restore := useFakeS3(t)
+	defer restore()
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// the items the snapshot falls back to are exported along with its own
+		nItems := 10
+		putItems(library, schema, nItems, t)
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		putItems(library, schema, nItems/2, t)
+
+		manifest, err := library.ExportSnapshot("snap", "archive", "exports/snap", ExportJSONGzip, ExportParts(3))
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if manifest.Items != int64(nItems) || len(manifest.Parts) != 3 || !manifest.Gzip {
+			t.Error("unexpected manifest", manifest)
+		}
+		if manifest.Parts[0].Key != "exports/snap/part-00000.json.gz" {
+			t.Error("unexpected key", manifest.Parts[0].Key)
+		}
+
+		var stored ExportManifest
+		err = json.Unmarshal(fake.objects["archive/exports/snap/manifest.json"], &stored)
+		if err != nil || stored.Items != manifest.Items {
+			t.Error("expected the manifest to be uploaded, got", stored, err)
+		}
+
+		// aliases are resolved, and there must be a single snapshot to export
+		latest, err := library.ExportSnapshot("latest", "archive", "exports/latest", ExportJSON)
+		if err != nil || latest.Snapshot != "snap" {
+			t.Error("expected the manifest to record the snapshot latest points to, got", latest, err)
+		}
+		if _, err := library.ExportSnapshot("", "archive", "exports/all", ExportJSON); err == nil {
+			t.Error("expected an error exporting all snapshots at once")
+		}
+
+		// every part can be loaded back on its own
+		err = library.Snapshot("copy")
+		if err != nil {
+			t.Error(err)
+		}
+		var loaded int64
+		for _, part := range manifest.Parts {
+			r, err := gzip.NewReader(bytes.NewReader(fake.objects["archive/"+part.Key]))
+			if err != nil {
+				t.Fatal("expected a gzip'ed part, got", err)
+			}
+			n, err := library.LoadSnapshot(r, "copy", nil)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if n != part.Items {
+				t.Error("expected", part.Items, "items in", part.Key, "got", n)
+			}
+			loaded += n
+		}
+		if loaded != int64(nItems) {
+			t.Error("expected", nItems, "items, got", loaded)
+		}
+
+		// no manifest if a part cannot be uploaded
+		fake.fail = errors.New("access denied")
+		_, err = library.ExportSnapshot("snap", "broken", "", ExportJSON)
+		if err == nil {
+			t.Error("expected an error when the upload fails")
+		}
+		if _, ok := fake.objects["broken/manifest.json"]; ok {
+			t.Error("expected no manifest for a failed export")
+		}
+		fake.fail = nil
+
+		teardown(schema, t)
+	}
+}
+
+func TestConfig_snapshotKeepCurrent(t *testing.T) {
+	storage := &recordingStorage{}
+	meta := &config{
+		svc:               storage,
+		partitionKeyType:  "N",
+		keyEncoding:       keyEncodingPadded,
+		snapshots:         map[string]*dynamodb.AttributeValue{"live": {S: aws.String("1")}},
+		snapshotInfo:      make(map[string]*dynamodb.AttributeValue, 0),
+		latestSnapshotID:  "1",
+		currentSnapshotID: "1",
+	}
+
+	if _, err := meta.snapshot("archive", time.Now(), nil, false, true); err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if strings.Contains(aws.StringValue(storage.update.UpdateExpression), "#currentID") {
+		t.Error("expected the current snapshot to be left alone, got", aws.StringValue(storage.update.UpdateExpression))
+	}
+	condition := aws.StringValue(storage.update.ConditionExpression)
+	if !strings.Contains(condition, "#currentID=:previousCurrentID") {
+		t.Error("expected the current snapshot not to change concurrently, got", condition)
+	}
+
+	// nor does it matter that another one was kept before
+	meta.latestSnapshotID = "2"
+	if _, err := meta.snapshot("another", time.Now(), nil, false, true); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+
+	// an archive only falls back to the data written before any snapshots
+	options := newSnapshotOptions([]SnapshotOption{func(o *snapshotOptions) { o.offBaseline = true }})
+	id, err := meta.snapshot("archived", time.Now(), options.details(), false, true)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if chain := meta.GetChronologicalSnapshotIDs(id); len(chain) != 1 || chain[0] != id {
+		t.Error("expected the archive not to fall back to any snapshots, got", chain)
+	}
+}
+
+func TestLibrary_ImportSnapshot(t *testing.T) {
+	fake, restore := useFakeS3(t)
+	defer restore()
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		nItems := 10
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		putItems(library, schema, nItems, t)
+
+		_, err = library.ExportSnapshot("snap", "archive", "exports/snap", ExportJSONGzip, ExportParts(2))
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+
+		n, err := library.ImportSnapshot("s3://archive/exports/snap", "imported")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if n != int64(nItems) {
+			t.Error("expected", nItems, "items, got", n)
+		}
+		// the archive is brought back to be read from, live data is still written to and read from where it was
+		active, _ := library.ActiveSnapshotName()
+		if active != "snap" {
+			t.Error("expected the active snapshot to be left as it was, got", active)
+		}
+		imported, _ := library.ScanAllFromSnapshot(
+			&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "imported", nil)
+		if len(imported) != nItems {
+			t.Error("expected", nItems, "items on the imported snapshot, got", len(imported))
+		}
+		// nor does it fall back to the snapshots written to since
+		putItems(library, schema, 2*nItems, t)
+		merged, err := library.ScanMerged("imported")
+		if err != nil || len(merged) != nItems {
+			t.Error("expected", nItems, "items visible from the imported snapshot, got", len(merged), err)
+		}
+
+		// incomplete exports are rejected before taking a snapshot
+		_, err = library.ImportSnapshot("s3://archive/nothing/here", "missing")
+		if err == nil {
+			t.Error("expected an error when the export has no manifest")
+		}
+		if _, err := library.SnapshotCreationTime("missing"); err == nil {
+			t.Error("expected no snapshot to be taken for an incomplete export")
+		}
+
+		// an import that fails part way leaves nothing behind, and can be tried again
+		broken, _ := json.Marshal(&ExportManifest{Parts: []ExportPart{{Key: "exports/broken/part-00000.json"}}})
+		fake.Lock()
+		fake.objects["archive/exports/broken/manifest.json"] = broken
+		fake.Unlock()
+		_, err = library.ImportSnapshot("s3://archive/exports/broken", "broken")
+		if err == nil {
+			t.Error("expected an error when a part is missing")
+		}
+		if _, err := library.SnapshotCreationTime("broken"); err == nil {
+			t.Error("expected the incomplete snapshot to be destroyed")
+		}
+		if n, err := library.ImportSnapshot("s3://archive/exports/snap", "broken"); err != nil || n != int64(nItems) {
+			t.Error("expected the import to be tried again, got", n, err)
+		}
+
+		teardown(schema, t)
+	}
+}
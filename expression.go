@@ -0,0 +1,438 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// the placeholder ScanFromSnapshot has always assumed to hold the partition key; still honored for backwards
+// compatibility
+const legacyPartitionKeyPlaceholder = ":pk"
+
+var comparators = map[string]bool{
+	"=":  true,
+	"<>": true,
+	"<":  true,
+	"<=": true,
+	">":  true,
+	">=": true,
+}
+
+// split a condition, filter, or key condition expression into tokens: attribute names (which may include document
+// paths), #name and :value placeholders, comparators, parenthesis, and commas
+func tokenizeExpression(expr string) []string {
+	tokens := make([]string, 0)
+	runes := []rune(expr)
+
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_.[]#:", r)
+	}
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '<' || r == '>' || r == '=':
+			j := i + 1
+			if j < len(runes) && (runes[j] == '=' || (r == '<' && runes[j] == '>')) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		case isWordRune(r):
+			j := i + 1
+			for j < len(runes) && isWordRune(runes[j]) {
+				j++
+			}
+			tokens = append(tokens, string(runes[i:j]))
+			i = j
+		default:
+			// anything else is not relevant to us, keep it as a token of its own
+			tokens = append(tokens, string(r))
+			i++
+		}
+	}
+
+	return tokens
+}
+
+// return true if token refers to attribute, either directly or through an alias defined in names
+func isAttributeReference(token string, attribute string, names map[string]*string) bool {
+	if strings.HasPrefix(token, "#") {
+		name, ok := names[token]
+		return ok && name != nil && *name == attribute
+	}
+
+	return token == attribute
+}
+
+func isValuePlaceholder(token string) bool {
+	return strings.HasPrefix(token, ":") && len(token) > 1
+}
+
+// partitionKeyPlaceholders returns the value placeholders (e.g., ":v1") that expr compares against the partition
+// key; the partition key may be referenced directly or through an alias defined in names (e.g., "#y" -> "year")
+func partitionKeyPlaceholders(expr string, partitionKey string, names map[string]*string) []string {
+	placeholders := make([]string, 0)
+	seen := make(map[string]bool, 0)
+
+	for _, comparison := range valueComparisons(tokenizeExpression(expr), partitionKey, names) {
+		for _, placeholder := range comparison.placeholders {
+			if !seen[placeholder] {
+				seen[placeholder] = true
+				placeholders = append(placeholders, placeholder)
+			}
+		}
+	}
+
+	return placeholders
+}
+
+// a comparison between an attribute and one or more value placeholders, as found in a tokenized expression
+type comparison struct {
+	// a comparator, IN, BETWEEN, or begins_with
+	operator     string
+	placeholders []string
+	// the position of the attribute and of each placeholder in the tokens
+	attribute int
+	values    []int
+}
+
+// return every comparison in tokens between attribute and value placeholders, in the order they appear:
+//
+//	<attribute> <comparator> :value (or the other way around)
+//	<attribute> IN (:value1, :value2, ...)
+//	<attribute> BETWEEN :value1 AND :value2
+//	begins_with(<attribute>, :value)
+func valueComparisons(tokens []string, attribute string, names map[string]*string) []comparison {
+	comparisons := make([]comparison, 0)
+
+	for i, token := range tokens {
+		if !isAttributeReference(token, attribute, names) {
+			continue
+		}
+
+		switch {
+		case i+2 < len(tokens) && comparators[tokens[i+1]] && isValuePlaceholder(tokens[i+2]):
+			comparisons = append(comparisons, comparison{tokens[i+1], []string{tokens[i+2]}, i, []int{i + 2}})
+		case i >= 2 && comparators[tokens[i-1]] && isValuePlaceholder(tokens[i-2]):
+			comparisons = append(comparisons, comparison{tokens[i-1], []string{tokens[i-2]}, i, []int{i - 2}})
+		case i+4 < len(tokens) && strings.EqualFold(tokens[i+1], "BETWEEN") && isValuePlaceholder(tokens[i+2]) &&
+			strings.EqualFold(tokens[i+3], "AND") && isValuePlaceholder(tokens[i+4]):
+			comparisons = append(comparisons, comparison{"BETWEEN", []string{tokens[i+2], tokens[i+4]}, i,
+				[]int{i + 2, i + 4}})
+		case i >= 2 && i+3 < len(tokens) && tokens[i-2] == "begins_with" && tokens[i-1] == "(" &&
+			tokens[i+1] == "," && isValuePlaceholder(tokens[i+2]) && tokens[i+3] == ")":
+			comparisons = append(comparisons, comparison{"begins_with", []string{tokens[i+2]}, i, []int{i + 2}})
+		case i+3 < len(tokens) && strings.EqualFold(tokens[i+1], "IN") && tokens[i+2] == "(":
+			in := comparison{operator: "IN", attribute: i}
+			for j := i + 3; j+1 < len(tokens) && isValuePlaceholder(tokens[j]); j += 2 {
+				in.placeholders = append(in.placeholders, tokens[j])
+				in.values = append(in.values, j)
+				if tokens[j+1] == ")" {
+					comparisons = append(comparisons, in)
+					break
+				}
+				if tokens[j+1] != "," {
+					break
+				}
+			}
+		}
+	}
+
+	return comparisons
+}
+
+// make sure a filter expression can be evaluated on sharded partition keys (see WithWriteSharding), or keys followed
+// by the snapshot ID (see KeyCodec): the suffix makes them equal, or not, to the same values as before, but breaks the
+// order between them (and their prefixes)
+func checkShardedFilter(expr string, partitionKey string, names map[string]*string) error {
+	for _, comparison := range valueComparisons(tokenizeExpression(expr), partitionKey, names) {
+		if comparison.operator != "=" && comparison.operator != "<>" && comparison.operator != "IN" {
+			return errors.New("only =, <>, and IN are supported on partition keys with a suffix: " + partitionKey +
+				" " + comparison.operator + " " + strings.Join(comparison.placeholders, ", "))
+		}
+	}
+
+	return nil
+}
+
+// keyConditionPartitionKeyPlaceholder returns the value placeholder the key condition expression expr uses to
+// select the partition key.
+//
+// Only equality is supported on the partition key: once the snapshot is added to the value, any other comparison
+// (including begins_with, which DynamoDB does not allow on a partition key either) would cross snapshot boundaries.
+func keyConditionPartitionKeyPlaceholder(expr string, partitionKey string, names map[string]*string) (string, error) {
+	placeholder := ""
+	tokens := tokenizeExpression(expr)
+
+	for i, token := range tokens {
+		if !isAttributeReference(token, partitionKey, names) {
+			continue
+		}
+
+		var candidate string
+		switch {
+		case i >= 2 && strings.EqualFold(tokens[i-2], "begins_with") && tokens[i-1] == "(":
+			return "", errors.New("begins_with is not supported on the partition key: " + partitionKey)
+		case i+2 < len(tokens) && tokens[i+1] == "=" && isValuePlaceholder(tokens[i+2]):
+			candidate = tokens[i+2]
+		case i >= 2 && tokens[i-1] == "=" && isValuePlaceholder(tokens[i-2]):
+			candidate = tokens[i-2]
+		default:
+			return "", errors.New("only equality conditions are supported on the partition key: " + partitionKey)
+		}
+
+		if placeholder != "" && placeholder != candidate {
+			return "", errors.New("the partition key can only be compared against a single value: " + partitionKey)
+		}
+		placeholder = candidate
+	}
+
+	if placeholder == "" {
+		return "", errors.New("key condition does not include an equality condition on the partition key: " +
+			partitionKey)
+	}
+
+	return placeholder, nil
+}
+
+// return a copy of values where each of placeholders has the snapshot added to it;
+// the original AttributeValues are left untouched
+func (c *Library) addSnapshotToValues(
+	values map[string]*dynamodb.AttributeValue,
+	placeholders []string,
+	snapshotID string,
+) map[string]*dynamodb.AttributeValue {
+	valuesCopy := make(map[string]*dynamodb.AttributeValue, len(values))
+	for k, v := range values {
+		valuesCopy[k] = v
+	}
+
+	for _, p := range placeholders {
+		v, ok := valuesCopy[p]
+		if ok {
+			pk := *v
+			c.addSnapshotToPartitionKey(snapshotID, &pk)
+			valuesCopy[p] = &pk
+		}
+	}
+
+	return valuesCopy
+}
+
+// isolatePlaceholders returns a copy of expr and values where each of placeholders is only used to compare against
+// the partition key: any other use of it is switched to a new placeholder with the same value, which is left untouched
+// when the snapshot is added to the original one. expr and values are returned as they are if there is nothing to
+// switch.
+func isolatePlaceholders(
+	expr string,
+	placeholders []string,
+	partitionKey string,
+	names map[string]*string,
+	values map[string]*dynamodb.AttributeValue,
+) (string, map[string]*dynamodb.AttributeValue) {
+	tokens := tokenizeExpression(expr)
+
+	compared := make(map[int]bool, 0)
+	for _, comparison := range valueComparisons(tokens, partitionKey, names) {
+		for _, position := range comparison.values {
+			compared[position] = true
+		}
+	}
+	isolated := make(map[string]bool, len(placeholders))
+	for _, p := range placeholders {
+		isolated[p] = true
+	}
+
+	var valuesCopy map[string]*dynamodb.AttributeValue
+	replacements := make(map[string]string, 0)
+	for i, token := range tokens {
+		v, ok := values[token]
+		if !ok || !isolated[token] || compared[i] {
+			continue
+		}
+
+		if valuesCopy == nil {
+			valuesCopy = make(map[string]*dynamodb.AttributeValue, len(values)+1)
+			for k, v := range values {
+				valuesCopy[k] = v
+			}
+		}
+		replacement, ok := replacements[token]
+		if !ok {
+			for n := 0; ; n++ {
+				replacement = fmt.Sprintf(":ddblibrarianValue%d", n)
+				if _, exists := valuesCopy[replacement]; !exists {
+					break
+				}
+			}
+			replacements[token] = replacement
+			valuesCopy[replacement] = v
+		}
+		tokens[i] = replacement
+	}
+
+	if valuesCopy == nil {
+		return expr, values
+	}
+
+	return strings.Join(tokens, " "), valuesCopy
+}
+
+// rewriteCondition returns a copy of a condition expression, of the update expression that comes with it (if any),
+// and of their ExpressionAttributeValues, where the values the condition compares against the partition key have the
+// snapshot added to them, so that they match the keys as they are stored. Any other use of their placeholders is
+// switched to a copy of the value first (see isolatePlaceholders). Everything is returned as it is if the condition
+// does not compare the partition key against any values.
+func (c *Library) rewriteCondition(
+	condition *string,
+	update *string,
+	names map[string]*string,
+	values map[string]*dynamodb.AttributeValue,
+	snapshotID string,
+) (*string, *string, map[string]*dynamodb.AttributeValue) {
+	if condition == nil {
+		return condition, update, values
+	}
+	placeholders := partitionKeyPlaceholders(*condition, c.partitionKey, names)
+	if len(placeholders) == 0 {
+		return condition, update, values
+	}
+
+	expr, values := isolatePlaceholders(*condition, placeholders, c.partitionKey, names, values)
+	condition = aws.String(expr)
+	if update != nil {
+		expr, values = isolatePlaceholders(*update, placeholders, c.partitionKey, names, values)
+		update = aws.String(expr)
+	}
+
+	return condition, update, c.addSnapshotToValues(values, placeholders, snapshotID)
+}
+
+// rewriteExpected returns a copy of the legacy Expected parameter where the values the partition key is compared
+// against have the snapshot added to them; it is returned as it is if there are none
+func (c *Library) rewriteExpected(
+	expected map[string]*dynamodb.ExpectedAttributeValue,
+	snapshotID string,
+) map[string]*dynamodb.ExpectedAttributeValue {
+	e := expected[c.partitionKey]
+	if e == nil || (e.Value == nil && len(e.AttributeValueList) == 0) {
+		return expected
+	}
+
+	expectedCopy := make(map[string]*dynamodb.ExpectedAttributeValue, len(expected))
+	for k, v := range expected {
+		expectedCopy[k] = v
+	}
+	eCopy := *e
+	if e.Value != nil {
+		pk := *e.Value
+		c.addSnapshotToPartitionKey(snapshotID, &pk)
+		eCopy.Value = &pk
+	}
+	if len(e.AttributeValueList) > 0 {
+		eCopy.AttributeValueList = make([]*dynamodb.AttributeValue, len(e.AttributeValueList))
+		for i, v := range e.AttributeValueList {
+			pk := *v
+			c.addSnapshotToPartitionKey(snapshotID, &pk)
+			eCopy.AttributeValueList[i] = &pk
+		}
+	}
+	expectedCopy[c.partitionKey] = &eCopy
+
+	return expectedCopy
+}
+
+// rewriteKeyCondition returns a copy of the ExpressionAttributeValues of a key condition expression where the value
+// the partition key is compared against has the snapshot added to it
+func (c *Library) rewriteKeyCondition(
+	expr string,
+	names map[string]*string,
+	values map[string]*dynamodb.AttributeValue,
+	snapshotID string,
+) (map[string]*dynamodb.AttributeValue, error) {
+	placeholder, err := keyConditionPartitionKeyPlaceholder(expr, c.partitionKey, names)
+	if err != nil {
+		return nil, err
+	}
+
+	_, ok := values[placeholder]
+	if !ok {
+		return nil, errors.New("missing value for placeholder " + placeholder)
+	}
+
+	return c.addSnapshotToValues(values, []string{placeholder}, snapshotID), nil
+}
+
+// return true if expr refers to attribute, either directly or through an alias defined in names
+func referencesAttribute(expr string, attribute string, names map[string]*string) bool {
+	for _, token := range tokenizeExpression(expr) {
+		if isAttributeReference(token, attribute, names) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// return true if expr refers to attribute in any way other than checking whether it exists (attribute_exists and
+// attribute_not_exists) or, if comparisons is true, comparing it against value placeholders (see
+// valueComparisons)
+func hasUnsupportedReference(expr string, attribute string, names map[string]*string, comparisons bool) bool {
+	tokens := tokenizeExpression(expr)
+	compared := make(map[int]bool, 0)
+	if comparisons {
+		for _, comparison := range valueComparisons(tokens, attribute, names) {
+			compared[comparison.attribute] = true
+		}
+	}
+
+	for i, token := range tokens {
+		if !isAttributeReference(token, attribute, names) {
+			continue
+		}
+
+		// attribute_exists(<attribute>) or attribute_not_exists(<attribute>)
+		if i >= 2 && i+1 < len(tokens) && tokens[i-1] == "(" && tokens[i+1] == ")" &&
+			(tokens[i-2] == "attribute_exists" || tokens[i-2] == "attribute_not_exists") {
+			continue
+		}
+		if compared[i] {
+			continue
+		}
+
+		return true
+	}
+
+	return false
+}
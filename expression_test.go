@@ -0,0 +1,314 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestTokenizeExpression(t *testing.T) {
+	expected := []string{"(", "#y", ">=", ":start", ")", "AND", "info.rating", "<>", ":r", "AND", "size", "(", "a", ")",
+		"<", ":s"}
+	tokens := tokenizeExpression("(#y>=:start) AND info.rating <> :r AND size(a)<:s")
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Error("expected", expected, "got", tokens)
+	}
+}
+
+func TestPartitionKeyPlaceholders(t *testing.T) {
+	names := map[string]*string{
+		"#y": aws.String("year"),
+		"#t": aws.String("title"),
+	}
+
+	cases := []struct {
+		expr     string
+		expected []string
+	}{
+		{"year = :y", []string{":y"}},
+		{":y = year", []string{":y"}},
+		{"#y = :y", []string{":y"}},
+		{"#y <> :a AND #t = :b", []string{":a"}},
+		{"#y >= :a AND year < :b AND #y > :a", []string{":a", ":b"}},
+		{"#y IN (:a, :b) AND #t IN (:c)", []string{":a", ":b"}},
+		{"year between :a and :b", []string{":a", ":b"}},
+		{"begins_with(#y, :a) AND begins_with(#t, :b)", []string{":a"}},
+		{"year IN (:a, title)", []string{}},
+		{"year BETWEEN :a AND title", []string{}},
+		{"#t = :b", []string{}},
+		{"yearly = :y", []string{}},
+		{"info.year = :y", []string{}},
+		{"#x = :y", []string{}},
+		{"", []string{}},
+	}
+
+	for _, c := range cases {
+		p := partitionKeyPlaceholders(c.expr, "year", names)
+		if !reflect.DeepEqual(p, c.expected) {
+			t.Error("expression:", c.expr, "expected", c.expected, "got", p)
+		}
+	}
+
+	// no aliases at all
+	p := partitionKeyPlaceholders("#y = :y", "year", nil)
+	if len(p) != 0 {
+		t.Error("expected no placeholders without ExpressionAttributeNames, got", p)
+	}
+}
+
+func TestKeyConditionPartitionKeyPlaceholder(t *testing.T) {
+	names := map[string]*string{
+		"#y": aws.String("year"),
+		"#t": aws.String("title"),
+	}
+
+	valid := map[string]string{
+		"year = :y":                            ":y",
+		":y = year":                            ":y",
+		"#y = :year":                           ":year",
+		"#y=:y AND #t = :t":                    ":y",
+		"#t = :t AND year = :y":                ":y",
+		"#y = :y AND begins_with(#t, :prefix)": ":y",
+		"(#y = :y) AND (#t BETWEEN :from AND :to)":  ":y",
+		"#y = :y AND #t >= :t":                      ":y",
+		"year = :y AND title = :t AND year = :y":    ":y",
+		"year = :y AND begins_with ( title , :t )":  ":y",
+		"year = :y AND #t < :t":                     ":y",
+		"#y = :y AND begins_with(#t, :t) AND #y=:y": ":y",
+	}
+	for expr, expected := range valid {
+		p, err := keyConditionPartitionKeyPlaceholder(expr, "year", names)
+		if err != nil {
+			t.Error("expression:", expr, "expected no errors, got", err)
+		}
+		if p != expected {
+			t.Error("expression:", expr, "expected", expected, "got", p)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"#t = :t",
+		"begins_with(#y, :y)",
+		"begins_with(year, :y)",
+		"#y > :y",
+		"#y BETWEEN :a AND :b",
+		"year = :a AND year = :b",
+		"#x = :y",
+		"#y = #t",
+	}
+	for _, expr := range invalid {
+		_, err := keyConditionPartitionKeyPlaceholder(expr, "year", names)
+		if err == nil {
+			t.Error("expression:", expr, "expected an error")
+		}
+	}
+}
+
+func TestLibrary_rewriteKeyCondition(t *testing.T) {
+	for _, pkType := range []string{"S", "N"} {
+		library := &Library{partitionKey: "year", partitionKeyType: pkType}
+		value := func(v string) *dynamodb.AttributeValue {
+			if pkType == "S" {
+				return &dynamodb.AttributeValue{S: aws.String(v)}
+			}
+			return &dynamodb.AttributeValue{N: aws.String(v)}
+		}
+
+		names := map[string]*string{"#y": aws.String("year"), "#t": aws.String("title")}
+		values := map[string]*dynamodb.AttributeValue{
+			":y": value("1999"),
+			":t": {S: aws.String("The Matrix")},
+		}
+
+		rewritten, err := library.rewriteKeyCondition("#y = :y AND #t = :t", names, values, "7")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+			continue
+		}
+		// only the partition key has changed
+		if !reflect.DeepEqual(rewritten[":y"], value("7.1999")) {
+			t.Error("expected", value("7.1999"), "got", rewritten[":y"])
+		}
+		if rewritten[":t"] != values[":t"] {
+			t.Error("expected the range key value to be left untouched, got", rewritten[":t"])
+		}
+		// the caller's values are never modified
+		if !reflect.DeepEqual(values[":y"], value("1999")) {
+			t.Error("expected the original value to be left untouched, got", values[":y"])
+		}
+
+		// no snapshot, no changes
+		rewritten, err = library.rewriteKeyCondition("year = :y", nil, values, "")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if !reflect.DeepEqual(rewritten[":y"], value("1999")) {
+			t.Error("expected", value("1999"), "got", rewritten[":y"])
+		}
+
+		// placeholder without a value
+		_, err = library.rewriteKeyCondition("year = :nope", nil, values, "7")
+		if err == nil {
+			t.Error("expected an error for a missing value")
+		}
+
+		// unsupported pattern
+		_, err = library.rewriteKeyCondition("begins_with(#y, :y)", names, values, "7")
+		if err == nil {
+			t.Error("expected an error for begins_with on the partition key")
+		}
+	}
+}
+
+func TestHasUnsupportedReference(t *testing.T) {
+	names := map[string]*string{"#y": aws.String("year")}
+
+	cases := []struct {
+		expr        string
+		comparisons bool
+		expected    bool
+	}{
+		{"attribute_exists(year)", false, false},
+		{"attribute_not_exists(#y)", false, false},
+		{"attribute_exists(title) AND title = :t", false, false},
+		{"year = :y", false, true},
+		{"year = :y", true, false},
+		{":y <= #y", true, false},
+		{"begins_with(year, :y)", true, false},
+		{"begins_with(year, :y)", false, true},
+		{"#y IN (:a, :b) AND #y BETWEEN :c AND :d", true, false},
+		{"year IN (:a, title)", true, true},
+		{"contains(year, :y)", true, true},
+		{"size(#y) > :s", true, true},
+		{"year = title", true, true},
+		{"", true, false},
+	}
+
+	for _, c := range cases {
+		unsupported := hasUnsupportedReference(c.expr, "year", names, c.comparisons)
+		if unsupported != c.expected {
+			t.Error("expression:", c.expr, "comparisons:", c.comparisons, "expected", c.expected, "got", unsupported)
+		}
+	}
+}
+
+func TestIsolatePlaceholders(t *testing.T) {
+	names := map[string]*string{"#y": aws.String("year")}
+	values := map[string]*dynamodb.AttributeValue{
+		":y":                  {S: aws.String("1999")},
+		":t":                  {S: aws.String("The Matrix")},
+		":ddblibrarianValue0": {S: aws.String("taken")},
+	}
+
+	// nothing to isolate
+	for _, expr := range []string{"#y = :y AND title = :t", "#y IN (:y, :t)", "title = :t"} {
+		isolated, isolatedValues := isolatePlaceholders(expr, []string{":y"}, "year", names, values)
+		if isolated != expr {
+			t.Error("expected", expr, "got", isolated)
+		}
+		if !reflect.DeepEqual(isolatedValues, values) {
+			t.Error("expression:", expr, "expected the values to be left untouched, got", isolatedValues)
+		}
+	}
+
+	// the same placeholder compared against the partition key and another attribute
+	expr := "#y = :y AND (title = :y OR begins_with(info.plot, :y))"
+	isolated, isolatedValues := isolatePlaceholders(expr, []string{":y"}, "year", names, values)
+	expected := "#y = :y AND ( title = :ddblibrarianValue1 OR begins_with ( info.plot , :ddblibrarianValue1 ) )"
+	if isolated != expected {
+		t.Error("expected", expected, "got", isolated)
+	}
+	if isolatedValues[":ddblibrarianValue1"] != values[":y"] || isolatedValues[":y"] != values[":y"] {
+		t.Error("expected both placeholders to hold the original value, got", isolatedValues)
+	}
+	if len(values) != 3 {
+		t.Error("expected the original values to be left untouched, got", values)
+	}
+}
+
+func TestLibrary_rewriteCondition(t *testing.T) {
+	library := &Library{partitionKey: "year", partitionKeyType: "S"}
+	names := map[string]*string{"#y": aws.String("year")}
+	values := map[string]*dynamodb.AttributeValue{
+		":y": {S: aws.String("1999")},
+		":t": {S: aws.String("The Matrix")},
+	}
+
+	// only checks whether the partition key exists
+	condition := aws.String("attribute_not_exists(#y)")
+	rewritten, update, rewrittenValues := library.rewriteCondition(condition, nil, names, values, "7")
+	if rewritten != condition || update != nil || !reflect.DeepEqual(rewrittenValues, values) {
+		t.Error("expected the condition to be left untouched, got", *rewritten, rewrittenValues)
+	}
+
+	// the placeholder compared against the partition key is also used by the update
+	condition = aws.String("#y = :y AND title <> :t")
+	rewritten, update, rewrittenValues = library.rewriteCondition(condition, aws.String("SET info.original = :y"),
+		names, values, "7")
+	if *rewritten != "#y = :y AND title <> :t" {
+		t.Error("expected the condition to be left as it is, got", *rewritten)
+	}
+	if *update != "SET info.original = :ddblibrarianValue0" {
+		t.Error("expected the update to use a copy of the value, got", *update)
+	}
+	if aws.StringValue(rewrittenValues[":y"].S) != "7.1999" {
+		t.Error("expected the snapshot to be added to the value, got", rewrittenValues[":y"])
+	}
+	if rewrittenValues[":ddblibrarianValue0"] != values[":y"] || rewrittenValues[":t"] != values[":t"] {
+		t.Error("expected the other values to be left untouched, got", rewrittenValues)
+	}
+	if aws.StringValue(values[":y"].S) != "1999" {
+		t.Error("expected the original value to be left untouched, got", values[":y"])
+	}
+}
+
+func TestLibrary_rewriteExpected(t *testing.T) {
+	library := &Library{partitionKey: "year", partitionKeyType: "N"}
+	expected := map[string]*dynamodb.ExpectedAttributeValue{
+		"year": {
+			ComparisonOperator: aws.String("IN"),
+			AttributeValueList: []*dynamodb.AttributeValue{{N: aws.String("1999")}},
+		},
+		"title": {Value: &dynamodb.AttributeValue{S: aws.String("The Matrix")}},
+	}
+
+	rewritten := library.rewriteExpected(expected, "7")
+	if aws.StringValue(rewritten["year"].AttributeValueList[0].N) != "7.1999" {
+		t.Error("expected the snapshot to be added to the value, got", rewritten["year"])
+	}
+	if rewritten["title"] != expected["title"] {
+		t.Error("expected the other attributes to be left untouched, got", rewritten["title"])
+	}
+	if aws.StringValue(expected["year"].AttributeValueList[0].N) != "1999" {
+		t.Error("expected the original value to be left untouched, got", expected["year"])
+	}
+
+	// only checks whether the partition key exists
+	expected = map[string]*dynamodb.ExpectedAttributeValue{"year": {Exists: aws.Bool(false)}}
+	if rewritten := library.rewriteExpected(expected, "7"); !reflect.DeepEqual(rewritten, expected) {
+		t.Error("expected Expected to be left untouched, got", rewritten)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// FailoverPolicy tells when reads fail over to the secondary region (see WithReadFailover), and when they go back to
+// the primary one. Zero values take the defaults.
+type FailoverPolicy struct {
+	// consecutive reads that fail in the primary region, e.g., with a 5xx status or no response at all, before reads
+	// fail over; 5 by default
+	Threshold int
+	// how often the table is described in the primary region, once failed over, to tell whether it has recovered; 30
+	// seconds by default
+	CheckInterval time.Duration
+}
+
+const (
+	defaultFailoverThreshold     = 5
+	defaultFailoverCheckInterval = 30 * time.Second
+)
+
+// the health of the primary region, shared by every request made by the Library (see WithReadFailover)
+type readFailover struct {
+	secondary Storage
+	policy    FailoverPolicy
+	mutex     sync.Mutex
+	// consecutive reads that failed in the primary region
+	failures   int
+	failedOver bool
+	// when the primary region was last checked, once failed over
+	checked time.Time
+}
+
+// ReadsFailedOver returns whether reads are currently made in the secondary region (see WithReadFailover).
+//
+// Cost: 0
+func (c *Library) ReadsFailedOver() bool {
+	if c.failover == nil {
+		return false
+	}
+	c.failover.mutex.Lock()
+	defer c.failover.mutex.Unlock()
+
+	return c.failover.failedOver
+}
+
+// return a Storage that makes every request with ctx, within timeout (if not zero), reading from the secondary region
+// instead of the table's while it is failing (see WithReadFailover)
+func (c *Library) regionStorage(ctx aws.Context, timeout time.Duration) Storage {
+	primary := &contextStorage{svc: c.svc, ctx: ctx, timeout: timeout}
+	if c.failover == nil {
+		return primary
+	}
+
+	return &failoverStorage{
+		Storage:   primary,
+		secondary: &contextStorage{svc: c.failover.secondary, ctx: ctx, timeout: timeout},
+		failover:  c.failover,
+		clock:     c.clock,
+		tableName: c.tableName,
+	}
+}
+
+// failoverStorage sends reads (GetItem, BatchGetItem, Query, and Scan) to the secondary region while the primary one
+// is failing, and everything else to the primary region
+type failoverStorage struct {
+	Storage
+	secondary Storage
+	failover  *readFailover
+	clock     Clock
+	tableName string
+}
+
+func (s *failoverStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	var output *dynamodb.GetItemOutput
+	err := s.read(func(svc Storage) error {
+		var err error
+		output, err = svc.GetItem(input)
+		return err
+	})
+
+	return output, err
+}
+
+func (s *failoverStorage) BatchGetItem(input *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	var output *dynamodb.BatchGetItemOutput
+	err := s.read(func(svc Storage) error {
+		var err error
+		output, err = svc.BatchGetItem(input)
+		return err
+	})
+
+	return output, err
+}
+
+func (s *failoverStorage) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	var output *dynamodb.QueryOutput
+	err := s.read(func(svc Storage) error {
+		var err error
+		output, err = svc.Query(input)
+		return err
+	})
+
+	return output, err
+}
+
+func (s *failoverStorage) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	var output *dynamodb.ScanOutput
+	err := s.read(func(svc Storage) error {
+		var err error
+		output, err = svc.Scan(input)
+		return err
+	})
+
+	return output, err
+}
+
+// make a read in the primary region, unless it is failing, keeping track of its health; the read that makes it
+// fail over is made again in the secondary region
+func (s *failoverStorage) read(fn func(Storage) error) error {
+	if s.useSecondary() {
+		return fn(s.secondary)
+	}
+
+	err := fn(s.Storage)
+	if !s.recordPrimary(err) {
+		return err
+	}
+
+	return fn(s.secondary)
+}
+
+// return whether reads go to the secondary region, checking whether the primary one has recovered every so often
+func (s *failoverStorage) useSecondary() bool {
+	f := s.failover
+	f.mutex.Lock()
+	if !f.failedOver {
+		f.mutex.Unlock()
+		return false
+	}
+	interval := f.policy.CheckInterval
+	if interval == 0 {
+		interval = defaultFailoverCheckInterval
+	}
+	now := s.clock.Now()
+	if now.Before(f.checked.Add(interval)) {
+		f.mutex.Unlock()
+		return true
+	}
+	// only one read checks at a time: the others keep using the secondary region meanwhile
+	f.checked = now
+	f.mutex.Unlock()
+
+	out, err := s.Storage.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(s.tableName)})
+	if err != nil || aws.StringValue(out.Table.TableStatus) != dynamodb.TableStatusActive {
+		return true
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.failedOver = false
+	f.failures = 0
+
+	return false
+}
+
+// keep track of the outcome of a read in the primary region, and return whether it made reads fail over
+func (s *failoverStorage) recordPrimary(err error) bool {
+	f := s.failover
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !isRegionFailure(err) {
+		// the region answered, whether the request succeeded or not
+		f.failures = 0
+		return false
+	}
+	f.failures++
+	threshold := f.policy.Threshold
+	if threshold == 0 {
+		threshold = defaultFailoverThreshold
+	}
+	if f.failures < threshold || f.failedOver {
+		return false
+	}
+	f.failedOver = true
+	f.checked = s.clock.Now()
+
+	return true
+}
+
+// return true if err means the region could not serve a request, as opposed to the request being wrong or the caller
+// giving up on it
+func isRegionFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var failure awserr.RequestFailure
+	if errors.As(err, &failure) && failure.StatusCode() >= 500 {
+		return true
+	}
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+	switch aerr.Code() {
+	case request.ErrCodeRequestError, request.ErrCodeResponseTimeout, dynamodb.ErrCodeInternalServerError,
+		"ServiceUnavailable":
+		return true
+	}
+
+	return false
+}
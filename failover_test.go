@@ -0,0 +1,160 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// outageStorage answers reads with err, if any, and counts the requests made to it
+type outageStorage struct {
+	Storage
+	err       error
+	status    string
+	reads     int
+	describes int
+}
+
+func (s *outageStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	s.reads++
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (s *outageStorage) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	s.describes++
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{TableStatus: aws.String(s.status)}}, nil
+}
+
+func TestLibrary_ReadFailover(t *testing.T) {
+	outage := awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeInternalServerError, "", nil), 500, "")
+	primary := &outageStorage{err: outage, status: dynamodb.TableStatusActive}
+	secondary := &outageStorage{}
+	clock := &fakeClock{now: time.Now()}
+	library := &Library{svc: primary, tableName: "movies", clock: clock}
+	WithReadFailover(secondary, FailoverPolicy{Threshold: 2, CheckInterval: time.Minute})(library)
+	svc := library.storage(context.Background())
+	input := &dynamodb.GetItemInput{}
+
+	// a single failure is not enough
+	if _, err := svc.GetItem(input); err == nil {
+		t.Error("expected the read to fail")
+	}
+	if library.ReadsFailedOver() {
+		t.Error("expected reads not to fail over yet")
+	}
+	// the second one is made again in the secondary region
+	if _, err := svc.GetItem(input); err != nil {
+		t.Error("expected the read to fail over, got", err)
+	}
+	if !library.ReadsFailedOver() || secondary.reads != 1 {
+		t.Error("expected reads to fail over")
+	}
+	// and so are the ones after it, until the primary region is checked again
+	svc.GetItem(input)
+	if primary.reads != 2 || secondary.reads != 2 || primary.describes != 0 {
+		t.Error("expected the read to be made in the secondary region, got", primary.reads, secondary.reads)
+	}
+
+	// still failing
+	clock.Advance(time.Minute)
+	svc.GetItem(input)
+	if primary.describes != 1 || !library.ReadsFailedOver() {
+		t.Error("expected the primary region to be checked, and reads to stay in the secondary one")
+	}
+
+	// recovered
+	primary.err = nil
+	clock.Advance(time.Minute)
+	if _, err := svc.GetItem(input); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if library.ReadsFailedOver() || primary.reads != 3 {
+		t.Error("expected reads to go back to the primary region")
+	}
+}
+
+func TestLibrary_ReadFailover_metadata(t *testing.T) {
+	outage := awserr.NewRequestFailure(awserr.New(dynamodb.ErrCodeInternalServerError, "", nil), 500, "")
+	primary := &outageStorage{err: outage, status: dynamodb.TableStatusActive}
+	secondary := &outageStorage{}
+	library := &Library{svc: primary, tableName: "movies", partitionKey: "year", partitionKeyType: "N",
+		clock: &fakeClock{now: time.Now()}, metaCache: true}
+	WithReadFailover(secondary, FailoverPolicy{Threshold: 1, CheckInterval: time.Minute})(library)
+	library.storage(context.Background()).GetItem(&dynamodb.GetItemInput{})
+	if !library.ReadsFailedOver() {
+		t.Fatal("expected reads to fail over")
+	}
+	reads := secondary.reads
+
+	// reads may use the metadata in the secondary region, which is not cached
+	if _, err := library.loadMetaWithConsistency(context.Background(), true); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if secondary.reads != reads+1 || library.meta != nil {
+		t.Error("expected the metadata to be read from the secondary region, and not cached")
+	}
+
+	// writes never do
+	if _, err := library.loadMeta(context.Background()); err == nil {
+		t.Error("expected the metadata to be read from the primary region")
+	}
+	if secondary.reads != reads+1 {
+		t.Error("expected no reads from the secondary region, got", secondary.reads-reads-1)
+	}
+}
+
+func TestIsRegionFailure(t *testing.T) {
+	for _, err := range []error{
+		awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "", nil), 503, ""),
+		awserr.New(request.ErrCodeRequestError, "send request failed", nil),
+		wrapError("failed to get item", awserr.New(dynamodb.ErrCodeInternalServerError, "", nil)),
+	} {
+		if !isRegionFailure(err) {
+			t.Error("expected a region failure:", err)
+		}
+	}
+	for _, err := range []error{
+		nil,
+		errors.New("failed"),
+		awserr.NewRequestFailure(awserr.New("ValidationException", "", nil), 400, ""),
+		awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil),
+	} {
+		if isRegionFailure(err) {
+			t.Error("expected no region failure:", err)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// number of times the table is gone over again, once the items of destroyed snapshots have been deleted, to delete
+// the ones written to them meanwhile (e.g., by clients that had not noticed yet) before giving up
+const destroySweeps = 3
+
+// UnreachableSnapshots returns the snapshots, most recent first, that can no longer be reached from the head of any
+// branch: the latest snapshot, the current one (see Rollback), the ones clients are pinned to (see PinClient), the
+// target of the scheduled rollback (see ScheduleRollback), and any given in keep. A snapshot is reachable from a
+// head if it is the head or one of its ancestors (see SnapshotTree), i.e., if reading from the head may fall back to
+// it. Snapshots become unreachable when a new one branches off an older one (see RequireActiveEqualsLatest), leaving
+// the snapshots taken after the branch point behind. See CollectGarbage.
+//
+// Cost: 1RU
+func (c *Library) UnreachableSnapshots(keep ...string) ([]string, error) {
+	return c.UnreachableSnapshotsWithContext(aws.BackgroundContext(), keep...)
+}
+
+// UnreachableSnapshotsWithContext is the same as UnreachableSnapshots with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) UnreachableSnapshotsWithContext(ctx aws.Context, keep ...string) ([]string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return unreachableSnapshots(meta, keep)
+}
+
+// CollectGarbage destroys the snapshots that can no longer be reached from the head of any branch (see
+// UnreachableSnapshots), removing them from the table's metadata and deleting all of their items, and returns their
+// names. Their IDs become available for new snapshots once the items are gone (see DestroySnapshot).
+//
+// It also deletes the items left by destroys that failed part way, so it is safe to run it again if it fails. It fails
+// if a snapshot is taken, or a rollback happens, before the metadata is updated.
+//
+// Cost: 2RU + 2WU + 2 full table scans + 1WU per deleted item
+func (c *Library) CollectGarbage(keep ...string) ([]string, error) {
+	return c.CollectGarbageWithContext(aws.BackgroundContext(), keep...)
+}
+
+// CollectGarbageWithContext is the same as CollectGarbage with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) CollectGarbageWithContext(ctx aws.Context, keep ...string) ([]string, error) {
+	var destroyed []string
+	params := &jobParams{keep: keep}
+	err := c.runJob(ctx, "CollectGarbage", "", params, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		destroyed, err = c.collectGarbage(ctx, keep, reporter)
+		return err
+	})
+
+	return destroyed, err
+}
+
+func (c *Library) collectGarbage(ctx aws.Context, keep []string, reporter *operationReporter) ([]string, error) {
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	unreachable, err := unreachableSnapshots(meta, keep)
+	if err != nil {
+		return nil, err
+	}
+	// leave the snapshots the policy still retains for a later run
+	expired := make([]string, 0, len(unreachable))
+	for _, snapshot := range unreachable {
+		err := c.checkRetentionPolicy(meta, "CollectGarbage", snapshot)
+		if _, retained := err.(*PolicyViolationError); retained {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		expired = append(expired, snapshot)
+	}
+	unreachable = expired
+
+	// the items of snapshots destroyed before, by a run that failed part way, are deleted along with the new ones
+	ids := make(map[string]bool, len(unreachable)+len(meta.destroyingIDs))
+	for id := range meta.destroyingIDs {
+		ids[id] = true
+	}
+	if len(unreachable) > 0 {
+		for _, snapshot := range unreachable {
+			id, err := meta.getSnapshotID(snapshot)
+			if err != nil {
+				return nil, err
+			}
+			ids[id] = true
+		}
+
+		err = meta.destroySnapshots(unreachable, false)
+		if err != nil {
+			return nil, wrapError("failed to update the metadata", err)
+		}
+
+		// we can't keep browsing a snapshot that no longer exists
+		if ids[c.currentSnapshot] {
+			c.StopBrowsing()
+		}
+		c.notifyDestroy(meta, unreachable)
+	}
+	if len(ids) == 0 {
+		return unreachable, nil
+	}
+
+	err = c.sweepDestroyedSnapshots(ctx, meta, ids, nil, reporter)
+	if err != nil {
+		return nil, err
+	}
+
+	return unreachable, nil
+}
+
+// delete every item of the given destroyed snapshots (by ID), carrying on from resume, if not nil, and go over the
+// table again until no items are left, at which point their IDs become available again
+func (c *Library) sweepDestroyedSnapshots(
+	ctx aws.Context,
+	meta *config,
+	ids map[string]bool,
+	resume *ScanProgress,
+	reporter *operationReporter,
+) error {
+	deleted, err := c.deleteSnapshotItems(ctx, ids, resume, reporter)
+	for sweep := 0; err == nil && deleted > 0; sweep++ {
+		if sweep == destroySweeps {
+			return errors.New("items are still being written to the destroyed snapshots: " +
+				strconv.FormatInt(deleted, 10) + " found by the last sweep")
+		}
+		deleted, err = c.deleteSnapshotItems(ctx, ids, nil, reporter)
+	}
+	if err != nil {
+		return wrapError("failed to delete items", err)
+	}
+
+	released := make([]string, 0, len(ids))
+	for id := range ids {
+		released = append(released, id)
+	}
+	sort.Strings(released)
+	err = meta.forgetDestroyedIDs(released)
+	if err != nil {
+		return wrapError("failed to release the IDs of the destroyed snapshots", err)
+	}
+
+	return nil
+}
+
+// return the names of the snapshots, most recent first, that are neither a head (latest, current, pinned, the target
+// of a scheduled rollback, or any of keep) nor an ancestor of one
+func unreachableSnapshots(meta *config, keep []string) ([]string, error) {
+	heads := []string{meta.latestSnapshotID, meta.getCurrentSnapshotID()}
+	for _, snapshot := range keep {
+		id, err := meta.getSnapshotID(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		heads = append(heads, id)
+	}
+	// a scheduled rollback needs its snapshot to still exist when it runs
+	if snapshot, _, ok, err := meta.getScheduledRollback(); err == nil && ok {
+		id, err := meta.getSnapshotID(snapshot)
+		if err == nil {
+			heads = append(heads, id)
+		}
+	}
+	// clients pinned to a snapshot still need it
+	for clientID := range meta.browsePins {
+		if id, ok := meta.getBrowsePin(clientID); ok {
+			heads = append(heads, id)
+		}
+	}
+
+	// walk up from every head; the data written before any snapshots is the empty ID and has no parent
+	parents := meta.parentIDs()
+	reachable := make(map[string]bool, len(meta.chronologicalSnapshotIDs))
+	for _, id := range heads {
+		for id != "" && !reachable[id] {
+			reachable[id] = true
+			id = parents[id]
+		}
+	}
+
+	names := make(map[string]string, len(meta.snapshots))
+	for name, id := range meta.snapshotIDMap() {
+		names[id] = name
+	}
+	unreachable := make([]string, 0)
+	for _, id := range meta.chronologicalSnapshotIDs {
+		if !reachable[id] {
+			unreachable = append(unreachable, names[id])
+		}
+	}
+
+	return unreachable, nil
+}
+
+// delete every item written to any of the given snapshots (by ID), carrying on from resume, if not nil, as last
+// reported to the checkpoints of reporter, and return the number of items deleted
+func (c *Library) deleteSnapshotItems(
+	ctx aws.Context,
+	ids map[string]bool,
+	resume *ScanProgress,
+	reporter *operationReporter,
+) (int64, error) {
+	var deleted int64
+	input := c.tableScanInput()
+	if resume != nil {
+		input.ExclusiveStartKey = resume.LastKeys[0]
+	}
+	for {
+		if err := jobFromContext(ctx).wait(ctx); err != nil {
+			return deleted, err
+		}
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return deleted, err
+		}
+
+		requests := make([]*dynamodb.WriteRequest, 0)
+		for _, item := range out.Items {
+			pk := item[c.partitionKey]
+			value := aws.StringValue(pk.S)
+			if c.partitionKeyType == "N" {
+				value = aws.StringValue(pk.N)
+			}
+
+			id, _ := c.decodePartitionKey(value)
+			if !ids[id] {
+				continue
+			}
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: c.primaryKey(item)},
+			})
+		}
+
+		consumed, err := c.writeRequests(ctx, requests)
+		reporter.written(len(requests), consumed, err)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int64(len(requests))
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return deleted, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+		progress := newScanProgress(1)
+		progress.LastKeys[0] = out.LastEvaluatedKey
+		reporter.checkpoint(progress)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestUnreachableSnapshots(t *testing.T) {
+	// 1 <- 2 <- 3, and 4 branches off 1 (the latest), 5 off 2
+	meta := &config{
+		snapshots: map[string]*dynamodb.AttributeValue{
+			"a": {S: aws.String("1")},
+			"b": {S: aws.String("2")},
+			"c": {S: aws.String("3")},
+			"d": {S: aws.String("4")},
+			"e": {S: aws.String("5")},
+		},
+		chronologicalSnapshotIDs: []string{"5", "4", "3", "2", "1"},
+		snapshotInfo: map[string]*dynamodb.AttributeValue{
+			"d": {M: map[string]*dynamodb.AttributeValue{snapshotInfoParent: parentAttributeValue("1")}},
+			"e": {M: map[string]*dynamodb.AttributeValue{snapshotInfoParent: parentAttributeValue("2")}},
+		},
+		latestSnapshotID:  "4",
+		currentSnapshotID: "4",
+	}
+
+	tests := []struct {
+		keep     []string
+		expected []string
+	}{
+		{nil, []string{"e", "c", "b"}},
+		{[]string{"e"}, []string{"c"}},
+		{[]string{"c", "e"}, []string{}},
+	}
+	for _, test := range tests {
+		got, err := unreachableSnapshots(meta, test.keep)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Error("expected", test.expected, "keeping", test.keep, "got", got)
+		}
+	}
+
+	// rolling back makes the current snapshot a head
+	meta.currentSnapshotID = "3"
+	got, _ := unreachableSnapshots(meta, nil)
+	if !reflect.DeepEqual(got, []string{"e"}) {
+		t.Error("expected [e], got", got)
+	}
+
+	// so does the snapshot clients are pinned to
+	meta.browsePins = map[string]*dynamodb.AttributeValue{"workers": {S: aws.String("5")}}
+	got, _ = unreachableSnapshots(meta, nil)
+	if len(got) != 0 {
+		t.Error("expected no unreachable snapshots, got", got)
+	}
+	meta.browsePins = nil
+
+	_, err := unreachableSnapshots(meta, []string{"z"})
+	if err == nil {
+		t.Error("expected an error keeping a snapshot that does not exist")
+	}
+}
+
+func TestLibrary_CollectGarbage(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+		put := func(value string) {
+			_, err := library.PutItem(&dynamodb.PutItemInput{
+				TableName: table,
+				Item:      getAttributeValueForItem(schema, value),
+			})
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+
+		// 1 <- 2, then 3 branches off 1 leaving 2 behind
+		library.Snapshot("1")
+		put("1")
+		library.Snapshot("2")
+		put("2")
+		library.Rollback("1")
+		err := library.Snapshot("3", RequireActiveEqualsLatest(false))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		put("3")
+
+		unreachable, err := library.UnreachableSnapshots()
+		if err != nil || !reflect.DeepEqual(unreachable, []string{"2"}) {
+			t.Error("expected [2], got", unreachable, err)
+		}
+
+		destroyed, err := library.CollectGarbage()
+		if err != nil || !reflect.DeepEqual(destroyed, []string{"2"}) {
+			t.Error("expected [2], got", destroyed, err)
+		}
+		byName, _, _ := library.SnapshotIDMap()
+		if _, ok := byName["2"]; ok || len(byName) != 2 {
+			t.Error("expected snapshot 2 to be destroyed, got", byName)
+		}
+
+		// nothing is left of it, and the remaining snapshots are untouched
+		out, err := library.Scan(&dynamodb.ScanInput{TableName: table})
+		if err != nil || len(out.Items) != 1 || *out.Items[0][valueField].S != fmtValueTag("3") {
+			t.Error("expected the item of snapshot 3, got", out, err)
+		}
+		destroyed, err = library.CollectGarbage()
+		if err != nil || len(destroyed) != 0 {
+			t.Error("expected nothing else to collect, got", destroyed, err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+// recordingStorage keeps the last update made through it instead of sending it anywhere
+type recordingStorage struct {
+	Storage
+	update *dynamodb.UpdateItemInput
+}
+
+func (s *recordingStorage) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	s.update = input
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestConfig_destroySnapshots(t *testing.T) {
+	// 1 <- 2 <- 3, and 4 branches off 2 and is both the latest and the current snapshot
+	storage := &recordingStorage{}
+	meta := &config{
+		svc: storage,
+		snapshots: map[string]*dynamodb.AttributeValue{
+			"a": {S: aws.String("1")},
+			"b": {S: aws.String("2")},
+			"c": {S: aws.String("3")},
+			"d": {S: aws.String("4")},
+		},
+		chronologicalSnapshotIDs: []string{"4", "3", "2", "1"},
+		snapshotInfo: map[string]*dynamodb.AttributeValue{
+			"d": {M: map[string]*dynamodb.AttributeValue{snapshotInfoParent: parentAttributeValue("2")}},
+		},
+		hasSnapshotInfo:   true,
+		latestSnapshotID:  "4",
+		currentSnapshotID: "4",
+	}
+
+	err := meta.destroySnapshots([]string{"d"}, false)
+	if err == nil {
+		t.Error("expected an error destroying the latest snapshot without forcing it")
+	}
+
+	// both 3 and 4 now fall back to 1
+	err = meta.destroySnapshots([]string{"b"}, false)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if !reflect.DeepEqual(meta.parentIDs(), map[string]string{"4": "1", "3": "1", "1": ""}) {
+		t.Error("expected 3 and 4 to be taken on top of 1, got", meta.parentIDs())
+	}
+	if !reflect.DeepEqual(meta.GetChronologicalSnapshotIDs(snapshotCurrent), []string{"4", "1"}) {
+		t.Error("expected [4 1], got", meta.GetChronologicalSnapshotIDs(snapshotCurrent))
+	}
+	// DynamoDB rejects names that are not used
+	expressions := *storage.update.UpdateExpression + " " + *storage.update.ConditionExpression
+	for name := range storage.update.ExpressionAttributeNames {
+		if !strings.Contains(expressions, name) {
+			t.Error("expected", name, "to be used, got", expressions)
+		}
+	}
+
+	// forcing it moves the latest and current snapshots
+	err = meta.destroySnapshots([]string{"d"}, true)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if meta.latestSnapshotID != "3" || meta.getCurrentSnapshotID() != "1" {
+		t.Error("expected the latest snapshot to be 3 and the current one 1, got", meta.latestSnapshotID,
+			meta.getCurrentSnapshotID())
+	}
+
+	// their IDs stay reserved until their items are gone
+	if !meta.destroyingIDs["2"] || !meta.destroyingIDs["4"] {
+		t.Error("expected 2 and 4 to be reserved, got", meta.destroyingIDs)
+	}
+	if !strings.Contains(*storage.update.UpdateExpression, "ADD #destroying :destroying") {
+		t.Error("expected the IDs to be recorded in the metadata, got", *storage.update.UpdateExpression)
+	}
+	err = meta.forgetDestroyedIDs([]string{"2", "4"})
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if len(meta.destroyingIDs) != 0 || *storage.update.UpdateExpression != "DELETE #destroying :destroying" {
+		t.Error("expected the IDs to be released, got", meta.destroyingIDs, *storage.update.UpdateExpression)
+	}
+}
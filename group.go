@@ -0,0 +1,207 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// Group manages several tables as a whole, e.g., all the tables of a service, each through its own Library:
+// snapshots are taken with the same name on every table, and rollbacks and browsing switch all of them to the same
+// snapshot.
+//
+// There is no way of changing the metadata of several tables at once, so the tables are changed one at a time, in the
+// order they were added to the group. As soon as one of them fails, the tables already changed are brought back to
+// where they were, and a *GroupError reports what happened on each table.
+type Group struct {
+	tables    []string
+	libraries map[string]*Library
+}
+
+// NewGroup creates a Group of the tables managed by libraries, e.g., created with WithTable. Each table can only be
+// part of the group once.
+func NewGroup(libraries ...*Library) (*Group, error) {
+	g := &Group{
+		tables:    make([]string, 0, len(libraries)),
+		libraries: make(map[string]*Library, len(libraries)),
+	}
+	for _, library := range libraries {
+		if _, ok := g.libraries[library.tableName]; ok {
+			return nil, errors.New("table " + library.tableName + " is already part of the group")
+		}
+		g.tables = append(g.tables, library.tableName)
+		g.libraries[library.tableName] = library
+	}
+
+	return g, nil
+}
+
+// Tables returns the names of the tables in the group, in the order they were added.
+func (g *Group) Tables() []string {
+	tables := make([]string, len(g.tables))
+	copy(tables, g.tables)
+
+	return tables
+}
+
+// Library returns the Library that manages table, or nil if the table is not part of the group.
+func (g *Group) Library(table string) *Library {
+	return g.libraries[table]
+}
+
+// Snapshot takes snapshot on every table of the group (see Library.Snapshot). If it fails on any of them, the
+// snapshot is destroyed on the tables it had already been taken on (see ForceDestroy), which makes the snapshots they
+// were taken on top of active again.
+//
+// Cost: the cost of Snapshot on every table (+ the cost of DestroySnapshot on every table already snapshotted, if it
+// fails)
+func (g *Group) Snapshot(snapshot string, opts ...SnapshotOption) error {
+	return g.SnapshotWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// SnapshotWithContext is the same as Snapshot with the addition of the ability to pass a context, which is passed on
+// to every request made to the tables.
+func (g *Group) SnapshotWithContext(ctx aws.Context, snapshot string, opts ...SnapshotOption) error {
+	return g.apply(
+		"Snapshot",
+		func(c *Library) error {
+			return c.SnapshotWithContext(ctx, snapshot, opts...)
+		},
+		func(c *Library) error {
+			return c.DestroySnapshotWithContext(ctx, snapshot, ForceDestroy())
+		},
+	)
+}
+
+// Rollback sets snapshot as the active snapshot of every table of the group (see Library.Rollback). If it fails on
+// any of them, the tables already rolled back are rolled back again to the snapshot that was active before.
+//
+// Cost: 1RU per table + the cost of Rollback on every table (+ the cost of Rollback on every table already rolled
+// back, if it fails)
+func (g *Group) Rollback(snapshot string) error {
+	return g.RollbackWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// RollbackWithContext is the same as Rollback with the addition of the ability to pass a context, which is passed on
+// to every request made to the tables.
+func (g *Group) RollbackWithContext(ctx aws.Context, snapshot string) error {
+	// table -> snapshot to go back to if any of the tables fails
+	previous := make(map[string]string, len(g.tables))
+	for _, table := range g.tables {
+		meta, err := g.libraries[table].fetchMeta(ctx, true)
+		if err != nil {
+			return &GroupError{Operation: "Rollback", Table: table, Err: err, Skipped: g.tables}
+		}
+		previous[table], err = meta.getSnapshotName(meta.getCurrentSnapshotID())
+		if err != nil {
+			return &GroupError{Operation: "Rollback", Table: table, Err: err, Skipped: g.tables}
+		}
+	}
+
+	return g.apply(
+		"Rollback",
+		func(c *Library) error {
+			return c.RollbackWithContext(ctx, snapshot)
+		},
+		func(c *Library) error {
+			return c.RollbackWithContext(ctx, previous[c.tableName])
+		},
+	)
+}
+
+// Browse sets snapshot as the active snapshot for the session currently handled by the Library of every table of the
+// group (see Library.Browse). If it fails on any of them, the tables already browsing it go back to what they were
+// browsing before, if anything.
+//
+// Cost: 1RU per table
+func (g *Group) Browse(snapshot string) error {
+	return g.BrowseWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// BrowseWithContext is the same as Browse with the addition of the ability to pass a context, which is passed on to
+// every request made to the tables.
+func (g *Group) BrowseWithContext(ctx aws.Context, snapshot string) error {
+	// browsing only affects the session, and can be restored as it was
+	type session struct {
+		browsing bool
+		current  string
+	}
+	previous := make(map[string]session, len(g.tables))
+	for _, table := range g.tables {
+		c := g.libraries[table]
+		previous[table] = session{browsing: c.browsing, current: c.currentSnapshot}
+	}
+
+	return g.apply(
+		"Browse",
+		func(c *Library) error {
+			return c.BrowseWithContext(ctx, snapshot)
+		},
+		func(c *Library) error {
+			c.browsing, c.currentSnapshot = previous[c.tableName].browsing, previous[c.tableName].current
+			return nil
+		},
+	)
+}
+
+// StopBrowsing reverts the active snapshot of every table of the group to the one set in its metadata (see
+// Library.StopBrowsing).
+//
+// Cost: 0
+func (g *Group) StopBrowsing() {
+	for _, table := range g.tables {
+		g.libraries[table].StopBrowsing()
+	}
+}
+
+// run op on every table, in order, until it fails on one of them, in which case undo is run on the tables it had
+// already succeeded on, most recent first
+func (g *Group) apply(operation string, op func(*Library) error, undo func(*Library) error) error {
+	for i, table := range g.tables {
+		err := op(g.libraries[table])
+		if err == nil {
+			continue
+		}
+
+		groupErr := &GroupError{
+			Operation:  operation,
+			Table:      table,
+			Err:        err,
+			Undone:     make([]string, 0, i),
+			UndoFailed: make(map[string]error, 0),
+			Skipped:    g.tables[i+1:],
+		}
+		for j := i - 1; j >= 0; j-- {
+			done := g.tables[j]
+			if err := undo(g.libraries[done]); err != nil {
+				groupErr.UndoFailed[done] = err
+				continue
+			}
+			groupErr.Undone = append(groupErr.Undone, done)
+		}
+
+		return groupErr
+	}
+
+	return nil
+}
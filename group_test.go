@@ -0,0 +1,153 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewGroup(t *testing.T) {
+	movies := &Library{tableName: "movies"}
+	series := &Library{tableName: "series"}
+
+	group, err := NewGroup(movies, series)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !reflect.DeepEqual(group.Tables(), []string{"movies", "series"}) {
+		t.Error("expected movies and series, got", group.Tables())
+	}
+	if group.Library("series") != series || group.Library("books") != nil {
+		t.Error("expected the library of each table")
+	}
+
+	_, err = NewGroup(movies, &Library{tableName: "movies"})
+	if err == nil {
+		t.Error("expected an error adding the same table twice")
+	}
+}
+
+func TestGroup_apply(t *testing.T) {
+	group, _ := NewGroup(&Library{tableName: "a"}, &Library{tableName: "b"}, &Library{tableName: "c"},
+		&Library{tableName: "d"})
+	failure := errors.New("failed")
+
+	// it fails on c: b is undone, then a, which fails to be, and d is left alone
+	undone := make([]string, 0)
+	err := group.apply(
+		"Snapshot",
+		func(c *Library) error {
+			if c.tableName == "c" {
+				return failure
+			}
+			return nil
+		},
+		func(c *Library) error {
+			undone = append(undone, c.tableName)
+			if c.tableName == "a" {
+				return failure
+			}
+			return nil
+		},
+	)
+	groupErr, ok := err.(*GroupError)
+	if !ok {
+		t.Fatal("expected a *GroupError, got", err)
+	}
+	if groupErr.Table != "c" || !errors.Is(err, failure) {
+		t.Error("expected the operation to fail on c, got", groupErr)
+	}
+	if !reflect.DeepEqual(undone, []string{"b", "a"}) {
+		t.Error("expected b and a to be undone, most recent first, got", undone)
+	}
+	if !reflect.DeepEqual(groupErr.Undone, []string{"b"}) || groupErr.UndoFailed["a"] != failure {
+		t.Error("expected b to be undone and a to fail, got", groupErr.Undone, groupErr.UndoFailed)
+	}
+	if !reflect.DeepEqual(groupErr.Skipped, []string{"d"}) {
+		t.Error("expected d to be skipped, got", groupErr.Skipped)
+	}
+
+	err = group.apply("Snapshot", func(*Library) error { return nil }, nil)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	libraries := make([]*Library, 0, len(possibleSchemas))
+	teardowns := make([]func(int, *testing.T), 0, len(possibleSchemas))
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		libraries = append(libraries, library)
+		teardowns = append(teardowns, teardown)
+	}
+	group, err := NewGroup(libraries...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = group.Snapshot("first")
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	// the snapshot already exists on the last table: it is taken and then destroyed on all the others
+	last := libraries[len(libraries)-1]
+	err = last.Snapshot("second")
+	if err != nil {
+		t.Error(err)
+	}
+	err = group.Snapshot("second")
+	if !errors.Is(err, ErrSnapshotExists) {
+		t.Error("expected the snapshot to exist on the last table, got", err)
+	}
+	for _, library := range libraries[:len(libraries)-1] {
+		snapshots, _ := library.ListSnapshots()
+		if len(snapshots) != 1 || snapshots[0].Name != "first" {
+			t.Error("expected only the first snapshot on", library.tableName, "got", snapshots)
+		}
+	}
+
+	// all tables are rolled back, or none
+	err = group.Rollback("second")
+	if !errors.Is(err, ErrSnapshotNotFound) {
+		t.Error("expected the snapshot not to exist on the first table, got", err)
+	}
+	err = group.Rollback(Baseline)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	err = group.Browse("first")
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	for _, library := range libraries {
+		if !library.IsBrowsing() {
+			t.Error("expected", library.tableName, "to be browsing")
+		}
+	}
+	group.StopBrowsing()
+
+	for i, schema := range possibleSchemas {
+		teardowns[i](schema, t)
+	}
+}
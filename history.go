@@ -0,0 +1,256 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ItemVersion is the version of an item written to a single snapshot (see ListItemVersions, GetItemWithVersion, and
+// ScanAllVersions).
+type ItemVersion struct {
+	// name of the snapshot the version was written to; Baseline for the data written before any snapshots
+	Snapshot string
+	// internal ID of the snapshot (see SnapshotIDMap); empty for Baseline
+	ID   string
+	Item map[string]*dynamodb.AttributeValue
+	// when the version was written, as stamped by WithVersionAttribute; only set by GetItemWithVersion, and zero for
+	// versions written before the version attribute was enabled
+	WrittenAt time.Time
+	// the random token WithVersionAttribute stamps every write with, which PutItemIfUnchangedSince compares; only set
+	// by GetItemWithVersion
+	Token string
+}
+
+// ListItemVersions returns every version of the item with the given primary key, oldest first: the one written before
+// any snapshots were taken, if any, followed by the one written to each snapshot, in the order they were taken.
+// Snapshots the item was not written to are left out, and so are deletions, which leave nothing behind. Unlike
+// GetItem, every snapshot is read, whichever branch it is on (see SnapshotTree).
+//
+// All snapshots are read at once, unless limited by WithMaxConcurrency.
+//
+// Cost: 1RU + 1RU per existing snapshot, plus one for the data written before any snapshots
+func (c *Library) ListItemVersions(key map[string]*dynamodb.AttributeValue) ([]ItemVersion, error) {
+	return c.ListItemVersionsWithContext(aws.BackgroundContext(), key)
+}
+
+// ListItemVersionsWithContext is the same as ListItemVersions with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) ListItemVersionsWithContext(
+	ctx aws.Context,
+	key map[string]*dynamodb.AttributeValue,
+) ([]ItemVersion, error) {
+	if _, ok := key[c.partitionKey]; !ok {
+		return nil, errors.New("missing partition key: " + c.partitionKey)
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// oldest first, starting with the data written before any snapshots
+	ids := []string{""}
+	for i := len(meta.chronologicalSnapshotIDs) - 1; i >= 0; i-- {
+		ids = append(ids, meta.chronologicalSnapshotIDs[i])
+	}
+
+	input := &dynamodb.GetItemInput{TableName: aws.String(c.tableName), Key: c.primaryKey(key)}
+	outputs, err := c.getItemFromSnapshotIDs(ctx, input, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]ItemVersion, 0)
+	for i, id := range ids {
+		if outputs[i].Item == nil {
+			continue
+		}
+
+		name := Baseline
+		if id != "" {
+			name, err = meta.getSnapshotName(id)
+			if err != nil {
+				return nil, err
+			}
+		}
+		versions = append(versions, ItemVersion{Snapshot: name, ID: id, Item: outputs[i].Item})
+	}
+
+	return versions, nil
+}
+
+// GetItemFromAllSnapshots reads the item selected by input from every snapshot, whichever branch it is on, and from
+// the data written before any snapshots, and returns the outputs by snapshot name (Baseline for the data written
+// before any snapshots), e.g., to follow how an item evolved. Like GetItemFromSnapshot, each snapshot is read on its
+// own, without falling back to older ones: the output for a snapshot the item was not written to has no Item.
+//
+// All snapshots are read at once, unless limited by WithMaxConcurrency.
+//
+// Cost: 1RU + 1RU per existing snapshot, plus one for the data written before any snapshots
+func (c *Library) GetItemFromAllSnapshots(input *dynamodb.GetItemInput) (map[string]*dynamodb.GetItemOutput, error) {
+	return c.GetItemFromAllSnapshotsWithContext(aws.BackgroundContext(), input)
+}
+
+// GetItemFromAllSnapshotsWithContext is the same as GetItemFromAllSnapshots with the addition of the ability to pass
+// a context, which is passed on to every request made to the table.
+func (c *Library) GetItemFromAllSnapshotsWithContext(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+) (map[string]*dynamodb.GetItemOutput, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := input.Key[c.partitionKey]; !ok {
+		return nil, errors.New("missing partition key: " + c.partitionKey)
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := append([]string{""}, meta.chronologicalSnapshotIDs...)
+	outputs, err := c.getItemFromSnapshotIDs(ctx, input, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*dynamodb.GetItemOutput, len(ids))
+	byName[Baseline] = outputs[0]
+	for i, id := range ids[1:] {
+		name, err := meta.getSnapshotName(id)
+		if err != nil {
+			return nil, err
+		}
+		byName[name] = outputs[i+1]
+	}
+
+	return byName, nil
+}
+
+// read the item selected by input from each of the given snapshots (by ID) on its own, all of them at once unless
+// limited by WithMaxConcurrency, and return the outputs in the same order as ids
+func (c *Library) getItemFromSnapshotIDs(
+	ctx aws.Context,
+	input *dynamodb.GetItemInput,
+	ids []string,
+) ([]*dynamodb.GetItemOutput, error) {
+	var wg sync.WaitGroup
+
+	outputs := make([]*dynamodb.GetItemOutput, len(ids))
+	errs := make([]error, len(ids))
+	slots := make(chan struct{}, c.bulkConcurrency(len(ids)))
+	for i := range ids {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			outputs[i], errs[i] = c.getItemWithSnapshotID(ctx, input, ids[i])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return outputs, nil
+}
+
+// PurgeItem deletes the item with the given primary key from every snapshot, whichever branch it is on, and from the
+// data written before any snapshots, e.g., to erase someone's data for good: unlike DeleteItem, no older version is
+// left behind to fall back to. It returns, by snapshot name (Baseline for the data written before any snapshots),
+// whether a copy of the item was deleted from it.
+//
+// Snapshots taken while it runs are not purged. If it fails part way, the result tells which snapshots were purged
+// already, and it is safe to call it again. Nothing is purged if a locked snapshot holds a copy of the item (see
+// LockSnapshot): it fails with a SnapshotLockedError instead.
+//
+// Values stored in S3 (see WithOverflow) are not deleted, as other items may share them: SweepOverflow deletes the
+// objects no item points to anymore, once they are more than an hour old.
+//
+// Cost: 1RU + 1WU per existing snapshot, plus one for the data written before any snapshots (+ 1RU per locked
+// snapshot)
+func (c *Library) PurgeItem(key map[string]*dynamodb.AttributeValue) (map[string]bool, error) {
+	return c.PurgeItemWithContext(aws.BackgroundContext(), key)
+}
+
+// PurgeItemWithContext is the same as PurgeItem with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) PurgeItemWithContext(
+	ctx aws.Context,
+	key map[string]*dynamodb.AttributeValue,
+) (map[string]bool, error) {
+	if _, ok := key[c.partitionKey]; !ok {
+		return nil, errors.New("missing partition key: " + c.partitionKey)
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// deleting a copy changes the partition key of the input in place: use one of our own
+	pk := *key[c.partitionKey]
+	input := &dynamodb.DeleteItemInput{
+		TableName:    aws.String(c.tableName),
+		Key:          c.primaryKey(key),
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	}
+	input.Key[c.partitionKey] = &pk
+
+	for _, id := range meta.chronologicalSnapshotIDs {
+		err = c.checkDeleteUnlocked(ctx, meta, "PurgeItem", c.primaryKey(key), id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	purged := make(map[string]bool, len(meta.chronologicalSnapshotIDs)+1)
+	for _, id := range append([]string{""}, meta.chronologicalSnapshotIDs...) {
+		name := Baseline
+		if id != "" {
+			name, err = meta.getSnapshotName(id)
+			if err != nil {
+				return purged, err
+			}
+		}
+
+		output, err := c.deleteItemWithSnapshotID(ctx, "PurgeItem", input, id)
+		if err != nil {
+			return purged, wrapError("failed to purge snapshot "+name, err)
+		}
+		purged[name] = output.Attributes != nil
+	}
+
+	return purged, nil
+}
@@ -0,0 +1,148 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_ListItemVersions(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		put := func(valueTag string) {
+			item := getAttributeValueForItem(schema, valueTag)
+			_, err := library.PutItem(&dynamodb.PutItemInput{TableName: aws.String(getTableName(schema)), Item: item})
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+
+		put("baseline")
+		library.Snapshot("1")
+		put("1")
+		library.Snapshot("2")
+		library.Snapshot("3")
+		put("3")
+
+		versions, err := library.ListItemVersions(getAttributeValueForKey(schema))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		expected := []struct{ snapshot, valueTag string }{{Baseline, "baseline"}, {"1", "1"}, {"3", "3"}}
+		if len(versions) != len(expected) {
+			t.Fatal("expected", len(expected), "versions, got", versions)
+		}
+		for i, v := range versions {
+			if v.Snapshot != expected[i].snapshot ||
+				aws.StringValue(v.Item[valueField].S) != fmtValueTag(expected[i].valueTag) {
+				t.Error("expected", expected[i], "at", i, "got", v.Snapshot, v.Item)
+			}
+			if aws.StringValue(getPartitionKeyValue(schema, v.Item)) !=
+				aws.StringValue(getPartitionKeyValue(schema, getAttributeValueForKey(schema))) {
+				t.Error("expected the partition key without the snapshot, got", v.Item)
+			}
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_GetItemFromAllSnapshots(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		library.Snapshot("1")
+		_, err := library.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      getAttributeValueForItem(schema, "1"),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		library.Snapshot("2")
+
+		outputs, err := library.GetItemFromAllSnapshots(&dynamodb.GetItemInput{Key: getAttributeValueForKey(schema)})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(outputs) != 3 {
+			t.Fatal("expected an output for each snapshot and the baseline, got", outputs)
+		}
+		if outputs[Baseline].Item != nil || outputs["2"].Item != nil {
+			t.Error("expected no item outside snapshot 1, got", outputs)
+		}
+		if aws.StringValue(outputs["1"].Item[valueField].S) != fmtValueTag("1") {
+			t.Error("expected", fmtValueTag("1"), "on snapshot 1, got", outputs["1"].Item)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_PurgeItem(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		put := func(valueTag string) {
+			item := getAttributeValueForItem(schema, valueTag)
+			_, err := library.PutItem(&dynamodb.PutItemInput{TableName: aws.String(getTableName(schema)), Item: item})
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+
+		put("baseline")
+		library.Snapshot("1")
+		library.Snapshot("2")
+		put("2")
+		// another key, which must be left alone
+		putItems(library, schema, 1, t)
+
+		key := getAttributeValueForKey(schema)
+		purged, err := library.PurgeItem(key)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		expected := map[string]bool{Baseline: true, "1": false, "2": true}
+		if !reflect.DeepEqual(purged, expected) {
+			t.Error("expected", expected, "got", purged)
+		}
+		if aws.StringValue(getPartitionKeyValue(schema, key)) != "1234" {
+			t.Error("expected the key to be left untouched, got", key)
+		}
+
+		versions, err := library.ListItemVersions(key)
+		if err != nil || len(versions) != 0 {
+			t.Error("expected no versions left, got", versions, err)
+		}
+		count, err := library.CountItems("2")
+		if err != nil || count != 1 {
+			t.Error("expected the other key to be left alone, got", count, err)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// SnapshotEvent is a change to the snapshots of a table, passed to the hooks registered with OnSnapshot, OnRollback,
+// and OnDestroy.
+type SnapshotEvent struct {
+	Table string
+	// the snapshot that was taken, rolled back to (Baseline for the data written before any snapshots), or destroyed
+	Snapshot string
+	// the change was made by another client, and noticed when the metadata was read
+	Remote bool
+}
+
+// SnapshotHook is called with every SnapshotEvent of the kind it was registered for.
+type SnapshotHook func(SnapshotEvent)
+
+// the hooks registered with a Library, and what the snapshots looked like the last time they were checked for changes
+type snapshotHooks struct {
+	mutex      sync.Mutex
+	onSnapshot []SnapshotHook
+	onRollback []SnapshotHook
+	onDestroy  []SnapshotHook
+	// the names of the snapshots and the active one as last seen; nothing has been seen yet unless seen is true
+	seen      bool
+	snapshots map[string]bool
+	current   string
+	// stops polling the metadata (see WithMetadataPolling)
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OnSnapshot registers fn to be called every time a snapshot is taken, by this Library or, once the change is
+// noticed, by any other client (see WithMetadataPolling). Hooks are called in the order they were registered, on the
+// goroutine that made or noticed the change, e.g., to invalidate caches, emit audit events, or trigger downstream
+// jobs.
+func (c *Library) OnSnapshot(fn SnapshotHook) {
+	c.hooks.mutex.Lock()
+	defer c.hooks.mutex.Unlock()
+
+	c.hooks.onSnapshot = append(c.hooks.onSnapshot, fn)
+}
+
+// OnRollback registers fn to be called every time the active snapshot changes other than by taking a new one, e.g.,
+// with Rollback, RunScheduledRollback, or a forced DestroySnapshot of the active snapshot. See OnSnapshot.
+func (c *Library) OnRollback(fn SnapshotHook) {
+	c.hooks.mutex.Lock()
+	defer c.hooks.mutex.Unlock()
+
+	c.hooks.onRollback = append(c.hooks.onRollback, fn)
+}
+
+// OnDestroy registers fn to be called every time a snapshot is destroyed, e.g., with DestroySnapshot or
+// CollectGarbage. See OnSnapshot.
+func (c *Library) OnDestroy(fn SnapshotHook) {
+	c.hooks.mutex.Lock()
+	defer c.hooks.mutex.Unlock()
+
+	c.hooks.onDestroy = append(c.hooks.onDestroy, fn)
+}
+
+// a hook along with the event to call it with
+type hookCall struct {
+	fn    SnapshotHook
+	event SnapshotEvent
+}
+
+// return the calls of the hooks in fns for snapshot
+func (h *snapshotHooks) calls(fns []SnapshotHook, table string, snapshot string, remote bool) []hookCall {
+	calls := make([]hookCall, 0, len(fns))
+	for _, fn := range fns {
+		calls = append(calls, hookCall{fn: fn, event: SnapshotEvent{Table: table, Snapshot: snapshot, Remote: remote}})
+	}
+
+	return calls
+}
+
+// call the hooks, with no locks held so that they can use the Library
+func runHooks(calls []hookCall) {
+	for _, call := range calls {
+		call.fn(call.event)
+	}
+}
+
+// record that this Library took snapshot, and call the hooks registered for it
+func (c *Library) notifySnapshot(snapshot string) {
+	c.hooks.mutex.Lock()
+	if c.hooks.seen {
+		c.hooks.snapshots[snapshot] = true
+		c.hooks.current = snapshot
+	}
+	calls := c.hooks.calls(c.hooks.onSnapshot, c.tableName, snapshot, false)
+	c.hooks.mutex.Unlock()
+
+	runHooks(calls)
+}
+
+// record that this Library made snapshot the active one, and call the hooks registered for it
+func (c *Library) notifyRollback(snapshot string) {
+	c.hooks.mutex.Lock()
+	if c.hooks.seen {
+		c.hooks.current = snapshot
+	}
+	calls := c.hooks.calls(c.hooks.onRollback, c.tableName, snapshot, false)
+	c.hooks.mutex.Unlock()
+
+	runHooks(calls)
+}
+
+// record that this Library destroyed snapshots, as recorded in meta, and call the hooks registered for them; the active
+// snapshot changes as well if it was destroyed
+func (c *Library) notifyDestroy(meta *config, snapshots []string) {
+	current, err := snapshotNameOrBaseline(meta, meta.getCurrentSnapshotID())
+
+	c.hooks.mutex.Lock()
+	calls := make([]hookCall, 0)
+	for _, snapshot := range snapshots {
+		calls = append(calls, c.hooks.calls(c.hooks.onDestroy, c.tableName, snapshot, false)...)
+		if c.hooks.seen {
+			delete(c.hooks.snapshots, snapshot)
+		}
+	}
+	if err == nil && c.hooks.seen && current != c.hooks.current {
+		c.hooks.current = current
+		calls = append(calls, c.hooks.calls(c.hooks.onRollback, c.tableName, current, false)...)
+	}
+	c.hooks.mutex.Unlock()
+
+	runHooks(calls)
+}
+
+// compare the metadata, read with a strongly consistent read, with what the snapshots looked like the last time, and
+// return the calls of the hooks registered for the changes made by other clients in the meantime, for the caller to
+// run with runHooks once it holds no locks
+func (c *Library) observeMeta(meta *config) []hookCall {
+	c.hooks.mutex.Lock()
+	defer c.hooks.mutex.Unlock()
+
+	if len(c.hooks.onSnapshot)+len(c.hooks.onRollback)+len(c.hooks.onDestroy) == 0 {
+		return nil
+	}
+
+	current, err := snapshotNameOrBaseline(meta, meta.getCurrentSnapshotID())
+	if err != nil {
+		return nil
+	}
+	snapshots := make(map[string]bool, len(meta.snapshots))
+	for name := range meta.snapshots {
+		snapshots[name] = true
+	}
+
+	calls := make([]hookCall, 0)
+	if c.hooks.seen {
+		for name := range c.hooks.snapshots {
+			if !snapshots[name] {
+				calls = append(calls, c.hooks.calls(c.hooks.onDestroy, c.tableName, name, true)...)
+			}
+		}
+		// oldest first
+		taken := make(map[string]bool, 0)
+		for i := len(meta.chronologicalSnapshotIDs) - 1; i >= 0; i-- {
+			name, err := meta.getSnapshotName(meta.chronologicalSnapshotIDs[i])
+			if err != nil || c.hooks.snapshots[name] {
+				continue
+			}
+			taken[name] = true
+			calls = append(calls, c.hooks.calls(c.hooks.onSnapshot, c.tableName, name, true)...)
+		}
+		// taking a snapshot makes it the active one, too
+		if current != c.hooks.current && !taken[current] {
+			calls = append(calls, c.hooks.calls(c.hooks.onRollback, c.tableName, current, true)...)
+		}
+	}
+	c.hooks.seen = true
+	c.hooks.snapshots = snapshots
+	c.hooks.current = current
+
+	return calls
+}
+
+// read the metadata every interval, until the Library is closed, so that the hooks are called for the changes made by
+// other clients even when the Library is not used
+func (c *Library) startMetadataPolling(interval time.Duration) {
+	c.hooks.done = make(chan struct{})
+	c.hooks.wg.Add(1)
+	go func() {
+		defer c.hooks.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.hooks.done:
+				return
+			case <-ticker.C:
+				// a failed read is just like no change: the next one catches up
+				c.fetchMeta(aws.BackgroundContext(), true)
+			}
+		}
+	}()
+}
+
+// stop polling the metadata, if it was
+func (c *Library) stopMetadataPolling() {
+	if c.hooks.done != nil {
+		close(c.hooks.done)
+		c.hooks.wg.Wait()
+		c.hooks.done = nil
+	}
+}
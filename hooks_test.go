@@ -0,0 +1,160 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_hooks(t *testing.T) {
+	storage := &metaRowStorage{}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+
+	events := make([]string, 0)
+	record := func(kind string) SnapshotHook {
+		return func(e SnapshotEvent) {
+			if e.Table != "movies" {
+				t.Error("expected an event for movies, got", e.Table)
+			}
+			event := kind + " " + e.Snapshot
+			if e.Remote {
+				event += " (remote)"
+			}
+			events = append(events, event)
+		}
+	}
+	library.OnSnapshot(record("snapshot"))
+	library.OnRollback(record("rollback"))
+	library.OnDestroy(record("destroy"))
+
+	// the metadata row with the given snapshots (name -> ID), most recent first, and the active one
+	setMeta := func(current string, snapshots ...string) {
+		names := make(map[string]*dynamodb.AttributeValue, 0)
+		ids := make([]*dynamodb.AttributeValue, 0)
+		for i := 0; i < len(snapshots); i += 2 {
+			names[snapshots[i]] = &dynamodb.AttributeValue{S: aws.String(snapshots[i+1])}
+			ids = append(ids, &dynamodb.AttributeValue{S: aws.String(snapshots[i+1])})
+		}
+		storage.item = map[string]*dynamodb.AttributeValue{
+			ddbSnapshotsField: {M: names},
+			ddbOrderedIDs:     {L: ids},
+			ddbLatestIDField:  {S: aws.String(snapshots[1])},
+			ddbCurrentIDField: {S: aws.String(current)},
+		}
+	}
+	expect := func(expected ...string) {
+		if _, err := library.fetchMeta(aws.BackgroundContext(), true); err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if len(expected) == 0 {
+			expected = []string{}
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Error("expected", expected, "got", events)
+		}
+		events = events[:0]
+	}
+
+	// nothing to compare the first read with
+	setMeta("02", "second", "02", "first", "01")
+	expect()
+
+	// changes made by other clients
+	setMeta("03", "third", "03", "second", "02", "first", "01")
+	expect("snapshot third (remote)")
+	setMeta("01", "third", "03", "second", "02", "first", "01")
+	expect("rollback first (remote)")
+	setMeta("01", "third", "03", "first", "01")
+	expect("destroy second (remote)")
+
+	// changes made by the Library itself are not reported again once read back
+	library.notifySnapshot("fourth")
+	setMeta("04", "fourth", "04", "third", "03", "first", "01")
+	expect("snapshot fourth")
+
+	// eventually consistent reads are not trusted
+	setMeta("01", "first", "01")
+	if _, err := library.fetchMeta(aws.BackgroundContext(), false); err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if len(events) != 0 {
+		t.Error("expected no events, got", events)
+	}
+}
+
+func TestLibrary_hooks_metadataCache(t *testing.T) {
+	storage := &metaRowStorage{}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N", metaCache: true}
+	library.clock = &fakeClock{}
+	setMeta := func(snapshots ...string) {
+		names := make(map[string]*dynamodb.AttributeValue, 0)
+		ids := make([]*dynamodb.AttributeValue, 0)
+		for i := 0; i < len(snapshots); i += 2 {
+			names[snapshots[i]] = &dynamodb.AttributeValue{S: aws.String(snapshots[i+1])}
+			ids = append(ids, &dynamodb.AttributeValue{S: aws.String(snapshots[i+1])})
+		}
+		storage.item = map[string]*dynamodb.AttributeValue{
+			ddbSnapshotsField: {M: names},
+			ddbOrderedIDs:     {L: ids},
+			ddbLatestIDField:  {S: aws.String(snapshots[1])},
+			ddbCurrentIDField: {S: aws.String(snapshots[1])},
+		}
+	}
+
+	// hooks called while filling the cache use it too
+	snapshots := make([]SnapshotInfo, 0)
+	library.OnSnapshot(func(e SnapshotEvent) {
+		library.Invalidate()
+		infos, err := library.ListSnapshots()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		snapshots = infos
+	})
+
+	setMeta("first", "01")
+	if _, err := library.loadMeta(aws.BackgroundContext()); err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	library.Invalidate()
+	setMeta("second", "02", "first", "01")
+	done := make(chan error)
+	go func() {
+		_, err := library.loadMeta(aws.BackgroundContext())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the hooks not to deadlock on the metadata cache")
+	}
+	if len(snapshots) != 2 {
+		t.Error("expected the hook to see 2 snapshots, got", snapshots)
+	}
+}
@@ -0,0 +1,483 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// attribute, added to every item when the snapshot index is enabled, that stores the ID of the snapshot the item
+	// was written to
+	snapshotAttribute = "ddblibrarian_snapshot"
+	// name of the global secondary index over snapshotAttribute
+	snapshotIndexName = "ddblibrarian-snapshot-index"
+	// value of snapshotAttribute for items written before any snapshots were taken (DynamoDB does not accept empty
+	// strings on index keys)
+	snapshotAttributeBaseline = "-"
+)
+
+var setClauseRegexp = regexp.MustCompile(`(?i)\bSET\s+`)
+var removeClauseRegexp = regexp.MustCompile(`(?i)\bREMOVE\s+`)
+
+// value of snapshotAttribute for a given snapshot ID
+func snapshotAttributeValue(snapshotID string) *dynamodb.AttributeValue {
+	if snapshotID == "" {
+		return &dynamodb.AttributeValue{S: aws.String(snapshotAttributeBaseline)}
+	}
+
+	return &dynamodb.AttributeValue{S: aws.String(snapshotID)}
+}
+
+// tag an item with the snapshot it is being written to (if the snapshot index, or the version attribute, is
+// enabled), compress its large attributes (see compression.go), and add its checksum (see integrity.go), returning a
+// function that restores the item to its original state
+func (c *Library) tagItem(item map[string]*dynamodb.AttributeValue, snapshotID string) func() {
+	restores := []func(){c.compressItem(item)}
+	if c.snapshotIndex {
+		original, ok := item[snapshotAttribute]
+		item[snapshotAttribute] = snapshotAttributeValue(snapshotID)
+		restores = append(restores, func() {
+			if ok {
+				item[snapshotAttribute] = original
+			} else {
+				delete(item, snapshotAttribute)
+			}
+		})
+	}
+	if c.versionAttribute {
+		original, ok := item[versionAttribute]
+		item[versionAttribute] = c.versionAttributeValue(snapshotID)
+		restores = append(restores, func() {
+			if ok {
+				item[versionAttribute] = original
+			} else {
+				delete(item, versionAttribute)
+			}
+		})
+	}
+	// computed last, over the item as it is stored
+	restores = append(restores, c.checksumItem(item))
+
+	return func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+}
+
+// return a copy of input that also tags the item with the snapshot it is being written to (if the snapshot index,
+// or the version attribute, is enabled) and drops its checksum (in integrity mode), which no longer matches the
+// updated item
+func (c *Library) tagUpdate(input *dynamodb.UpdateItemInput, snapshotID string) *dynamodb.UpdateItemInput {
+	if !c.snapshotIndex && !c.checksums && !c.versionAttribute {
+		return input
+	}
+
+	inputCopy := *input
+	// legacy parameter, cannot be mixed with expressions
+	if input.UpdateExpression == nil && input.AttributeUpdates != nil {
+		inputCopy.AttributeUpdates = make(map[string]*dynamodb.AttributeValueUpdate, len(input.AttributeUpdates)+3)
+		for k, v := range input.AttributeUpdates {
+			inputCopy.AttributeUpdates[k] = v
+		}
+		if c.snapshotIndex {
+			inputCopy.AttributeUpdates[snapshotAttribute] = &dynamodb.AttributeValueUpdate{
+				Action: aws.String("PUT"),
+				Value:  snapshotAttributeValue(snapshotID),
+			}
+		}
+		if c.versionAttribute {
+			inputCopy.AttributeUpdates[versionAttribute] = &dynamodb.AttributeValueUpdate{
+				Action: aws.String("PUT"),
+				Value:  c.versionAttributeValue(snapshotID),
+			}
+		}
+		if c.checksums {
+			inputCopy.AttributeUpdates[checksumAttribute] = &dynamodb.AttributeValueUpdate{
+				Action: aws.String("DELETE"),
+			}
+		}
+		return &inputCopy
+	}
+
+	inputCopy.ExpressionAttributeNames = make(map[string]*string, len(input.ExpressionAttributeNames)+3)
+	for k, v := range input.ExpressionAttributeNames {
+		inputCopy.ExpressionAttributeNames[k] = v
+	}
+	expr := aws.StringValue(input.UpdateExpression)
+
+	if c.snapshotIndex || c.versionAttribute {
+		inputCopy.ExpressionAttributeValues = make(
+			map[string]*dynamodb.AttributeValue,
+			len(input.ExpressionAttributeValues)+2,
+		)
+		for k, v := range input.ExpressionAttributeValues {
+			inputCopy.ExpressionAttributeValues[k] = v
+		}
+	}
+	if c.snapshotIndex {
+		inputCopy.ExpressionAttributeNames["#ddblibrarianSnapshot"] = aws.String(snapshotAttribute)
+		inputCopy.ExpressionAttributeValues[":ddblibrarianSnapshot"] = snapshotAttributeValue(snapshotID)
+
+		expr = addSetAction(expr, "#ddblibrarianSnapshot = :ddblibrarianSnapshot")
+	}
+	if c.versionAttribute {
+		inputCopy.ExpressionAttributeNames["#ddblibrarianVersion"] = aws.String(versionAttribute)
+		inputCopy.ExpressionAttributeValues[":ddblibrarianVersion"] = c.versionAttributeValue(snapshotID)
+
+		expr = addSetAction(expr, "#ddblibrarianVersion = :ddblibrarianVersion")
+	}
+	if c.checksums {
+		inputCopy.ExpressionAttributeNames["#ddblibrarianChecksum"] = aws.String(checksumAttribute)
+		expr = addRemoveAction(expr, "#ddblibrarianChecksum")
+	}
+	inputCopy.UpdateExpression = aws.String(expr)
+
+	return &inputCopy
+}
+
+// add an action to the SET clause of an update expression, creating the clause if necessary
+func addSetAction(expr string, action string) string {
+	loc := setClauseRegexp.FindStringIndex(expr)
+	if loc == nil {
+		if expr == "" {
+			return "SET " + action
+		}
+		return "SET " + action + " " + expr
+	}
+
+	return expr[:loc[1]] + action + ", " + expr[loc[1]:]
+}
+
+// add an action to the REMOVE clause of an update expression, creating the clause if necessary
+func addRemoveAction(expr string, action string) string {
+	loc := removeClauseRegexp.FindStringIndex(expr)
+	if loc == nil {
+		if expr == "" {
+			return "REMOVE " + action
+		}
+		return expr + " REMOVE " + action
+	}
+
+	return expr[:loc[1]] + action + ", " + expr[loc[1]:]
+}
+
+// turn an item read from the table, with the snapshot already removed from its partition key, back into what was
+// written: check its checksum (see integrity.go), fetch the attributes stored in S3 (see overflow.go), and untag it
+func (c *Library) readItem(ctx aws.Context, item map[string]*dynamodb.AttributeValue) error {
+	if err := c.verifyItem(item); err != nil {
+		return err
+	}
+	if err := c.loadOverflow(ctx, item); err != nil {
+		return err
+	}
+
+	return c.untagItem(item)
+}
+
+// remove all attributes reserved for internal use from an item read from the table, decompressing whatever was
+// compressed
+func (c *Library) untagItem(item map[string]*dynamodb.AttributeValue) error {
+	delete(item, snapshotAttribute)
+	delete(item, versionAttribute)
+	delete(item, checksumAttribute)
+
+	return decompressItem(item)
+}
+
+// how long ensureSnapshotIndex takes the snapshot index not being ready for granted before asking DynamoDB again
+const snapshotIndexCheckInterval = 30 * time.Second
+
+// make sure the snapshot index exists and is ready to be used, creating it if necessary; it is only ready once it is
+// active and BackfillSnapshotIndex has tagged every item, which is recorded in the metadata
+func (c *Library) ensureSnapshotIndex(ctx aws.Context) (bool, error) {
+	if !c.snapshotIndex {
+		return false, nil
+	}
+
+	c.snapshotIndexMutex.Lock()
+	defer c.snapshotIndexMutex.Unlock()
+	if c.snapshotIndexReady {
+		return true, nil
+	}
+	// scans fall back to the table meanwhile, without a DescribeTable call each
+	if !c.snapshotIndexChecked.IsZero() && c.clock.Now().Sub(c.snapshotIndexChecked) < snapshotIndexCheckInterval {
+		return false, nil
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return false, err
+	}
+	output, err := c.storage(ctx).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(c.tableName)})
+	if err != nil {
+		return false, err
+	}
+	c.snapshotIndexChecked = c.clock.Now()
+
+	for _, index := range output.Table.GlobalSecondaryIndexes {
+		if aws.StringValue(index.IndexName) == snapshotIndexName {
+			// items that are not tagged yet are missing from the index, however active it is
+			c.snapshotIndexReady = aws.StringValue(index.IndexStatus) == dynamodb.IndexStatusActive &&
+				!aws.BoolValue(index.Backfilling) && meta.snapshotIndexBackfilled
+			return c.snapshotIndexReady, nil
+		}
+	}
+
+	// the index does not exist yet
+	index := &dynamodb.CreateGlobalSecondaryIndexAction{
+		IndexName: aws.String(snapshotIndexName),
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String(snapshotAttribute), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+	}
+	// on-demand tables don't take a provisioned throughput
+	throughput := output.Table.ProvisionedThroughput
+	if throughput != nil && aws.Int64Value(throughput.ReadCapacityUnits) > 0 {
+		index.ProvisionedThroughput = &dynamodb.ProvisionedThroughput{
+			ReadCapacityUnits:  throughput.ReadCapacityUnits,
+			WriteCapacityUnits: throughput.WriteCapacityUnits,
+		}
+	}
+
+	_, err = c.storage(ctx).UpdateTable(&dynamodb.UpdateTableInput{
+		TableName: aws.String(c.tableName),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String(snapshotAttribute), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+		},
+		GlobalSecondaryIndexUpdates: []*dynamodb.GlobalSecondaryIndexUpdate{{Create: index}},
+	})
+
+	// the index is being created, scans will have to do for now
+	return false, err
+}
+
+// BackfillSnapshotIndex tags every item written before WithSnapshotIndex was enabled with the ID of the snapshot it
+// belongs to, as found in its partition key, so that the snapshot index covers the whole table; once it is done, which
+// is recorded in the metadata, reads use the index instead of scanning the table. It creates the index if it does not
+// exist yet, and returns the number of items tagged. Items that are already tagged, e.g., written while it runs, are
+// left as they are, so it is safe to run it more than once, or to keep writing to the table meanwhile. Nothing else
+// about the items changes, e.g., their version and checksum attributes (see WithVersionAttribute and WithChecksums),
+// which is why the items of locked snapshots are tagged too.
+//
+// Cost: 1 DescribeTable call + a full table scan + 1WU per item tagged + 1RU and 1WU to record it is done
+func (c *Library) BackfillSnapshotIndex() (int64, error) {
+	return c.BackfillSnapshotIndexWithContext(aws.BackgroundContext())
+}
+
+// BackfillSnapshotIndexWithContext is the same as BackfillSnapshotIndex with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) BackfillSnapshotIndexWithContext(ctx aws.Context) (int64, error) {
+	var tagged int64
+	err := c.runJob(ctx, "BackfillSnapshotIndex", "", nil, func(ctx aws.Context, reporter *operationReporter) error {
+		var err error
+		tagged, err = c.backfillSnapshotIndex(ctx, nil, reporter)
+		return err
+	})
+
+	return tagged, err
+}
+
+// StartBackfillSnapshotIndex is the same as BackfillSnapshotIndex, except that it runs in the background and returns
+// right away, with the Job to follow, pause, resume, or cancel it; Job.Wait returns the error BackfillSnapshotIndex
+// would have, and the number of items tagged is the job's Items.
+func (c *Library) StartBackfillSnapshotIndex() *Job {
+	return c.StartBackfillSnapshotIndexWithContext(aws.BackgroundContext())
+}
+
+// StartBackfillSnapshotIndexWithContext is the same as StartBackfillSnapshotIndex with the addition of the ability to
+// pass a context, which is passed on to every request made to the table.
+func (c *Library) StartBackfillSnapshotIndexWithContext(ctx aws.Context) *Job {
+	return c.startJob(ctx, "BackfillSnapshotIndex", "", nil, func(ctx aws.Context, reporter *operationReporter) error {
+		_, err := c.backfillSnapshotIndex(ctx, nil, reporter)
+		return err
+	})
+}
+
+// tag every item that is not tagged yet with its snapshot, carrying on from where resume left off, if not nil
+func (c *Library) backfillSnapshotIndex(
+	ctx aws.Context,
+	resume *ScanProgress,
+	reporter *operationReporter,
+) (int64, error) {
+	if !c.snapshotIndex {
+		return 0, errors.New("the snapshot index is not enabled (see WithSnapshotIndex)")
+	}
+	// the index is filled in as items are tagged, whether it is still being created or not
+	_, err := c.ensureSnapshotIndex(ctx)
+	if err != nil {
+		return 0, wrapError("failed to create the snapshot index", err)
+	}
+
+	var tagged int64
+	known, err := c.snapshotIDLookup(ctx)
+	if err != nil {
+		return 0, err
+	}
+	names := map[string]*string{"#pk": aws.String(c.partitionKey), "#snapshot": aws.String(snapshotAttribute)}
+	input := c.tableScanInput()
+	input.FilterExpression = joinFilters(aws.StringValue(input.FilterExpression), "attribute_not_exists(#snapshot)")
+	input.ExpressionAttributeNames = map[string]*string{"#snapshot": names["#snapshot"]}
+	if resume != nil {
+		input.ExclusiveStartKey = resume.LastKeys[0]
+	}
+	for {
+		if err := jobFromContext(ctx).wait(ctx); err != nil {
+			return tagged, err
+		}
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return tagged, err
+		}
+
+		for _, item := range out.Items {
+			pk := item[c.partitionKey]
+			value := aws.StringValue(pk.S)
+			if c.partitionKeyType == "N" {
+				value = aws.StringValue(pk.N)
+			}
+			id, _ := c.decodeKnownPartitionKey(known, value)
+
+			// only the index attribute is added, leaving the version and checksum attributes of an item that is not
+			// otherwise changed as they are, unless it has been tagged, or deleted, since it was scanned
+			updated, err := c.storage(ctx).UpdateItem(&dynamodb.UpdateItemInput{
+				TableName:                 aws.String(c.tableName),
+				Key:                       c.primaryKey(item),
+				UpdateExpression:          aws.String("SET #snapshot = :id"),
+				ConditionExpression:       aws.String("attribute_exists(#pk) AND attribute_not_exists(#snapshot)"),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":id": snapshotAttributeValue(id)},
+				ReturnConsumedCapacity:    aws.String(dynamodb.ReturnConsumedCapacityTotal),
+			})
+			if isConditionalCheckFailure(err) {
+				continue
+			}
+			var consumed float64
+			if err == nil && updated.ConsumedCapacity != nil {
+				consumed = aws.Float64Value(updated.ConsumedCapacity.CapacityUnits)
+			}
+			reporter.written(1, consumed, err)
+			if err != nil {
+				return tagged, wrapError("failed to tag item", err)
+			}
+			tagged++
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+		progress := newScanProgress(1)
+		progress.LastKeys[0] = out.LastEvaluatedKey
+		reporter.checkpoint(progress)
+	}
+
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return tagged, err
+	}
+	err = meta.setSnapshotIndexBackfilled()
+	if err != nil {
+		return tagged, wrapError("failed to record the backfill", err)
+	}
+	// check again on the next read rather than waiting for snapshotIndexCheckInterval
+	c.snapshotIndexMutex.Lock()
+	c.snapshotIndexChecked = time.Time{}
+	c.snapshotIndexMutex.Unlock()
+
+	return tagged, nil
+}
+
+// return true if a scan can be replaced by a query on the snapshot index
+func canQuerySnapshotIndex(input *dynamodb.ScanInput) bool {
+	return input.IndexName == nil &&
+		input.ScanFilter == nil &&
+		input.Segment == nil &&
+		input.TotalSegments == nil &&
+		!aws.BoolValue(input.ConsistentRead)
+}
+
+// read all items of a snapshot, as they are stored, by querying the snapshot index instead of scanning the whole table
+func (c *Library) querySnapshotIndex(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshotID string,
+) (*dynamodb.ScanOutput, error) {
+	query := &dynamodb.QueryInput{
+		TableName:                aws.String(c.tableName),
+		IndexName:                aws.String(snapshotIndexName),
+		AttributesToGet:          input.AttributesToGet,
+		ExclusiveStartKey:        input.ExclusiveStartKey,
+		ExpressionAttributeNames: make(map[string]*string, len(input.ExpressionAttributeNames)+1),
+		ExpressionAttributeValues: make(
+			map[string]*dynamodb.AttributeValue,
+			len(input.ExpressionAttributeValues)+1,
+		),
+		FilterExpression:       input.FilterExpression,
+		KeyConditionExpression: aws.String("#ddblibrarianSnapshot = :ddblibrarianSnapshot"),
+		Limit:                  input.Limit,
+		ProjectionExpression:   input.ProjectionExpression,
+		ReturnConsumedCapacity: input.ReturnConsumedCapacity,
+		Select:                 input.Select,
+	}
+	for k, v := range input.ExpressionAttributeNames {
+		query.ExpressionAttributeNames[k] = v
+	}
+	query.ExpressionAttributeNames["#ddblibrarianSnapshot"] = aws.String(snapshotAttribute)
+	// the values compared against the partition key still need the snapshot ID
+	placeholders := []string{legacyPartitionKeyPlaceholder}
+	values := input.ExpressionAttributeValues
+	if input.FilterExpression != nil {
+		placeholders = append(
+			placeholders,
+			partitionKeyPlaceholders(*input.FilterExpression, c.partitionKey, input.ExpressionAttributeNames)...,
+		)
+		var filter string
+		filter, values = isolatePlaceholders(*input.FilterExpression, placeholders, c.partitionKey,
+			input.ExpressionAttributeNames, values)
+		query.FilterExpression = aws.String(filter)
+	}
+	for k, v := range c.addSnapshotToValues(values, placeholders, snapshotID) {
+		query.ExpressionAttributeValues[k] = v
+	}
+	query.ExpressionAttributeValues[":ddblibrarianSnapshot"] = snapshotAttributeValue(snapshotID)
+
+	out, err := c.storage(ctx).Query(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dynamodb.ScanOutput{
+		ConsumedCapacity: out.ConsumedCapacity,
+		Count:            out.Count,
+		Items:            out.Items,
+		LastEvaluatedKey: out.LastEvaluatedKey,
+		ScannedCount:     out.ScannedCount,
+	}, nil
+}
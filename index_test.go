@@ -0,0 +1,240 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestAddSetAction(t *testing.T) {
+	cases := map[string]string{
+		"":                              "SET a = :a",
+		"SET b = :b":                    "SET a = :a, b = :b",
+		"set b = :b REMOVE c":           "set a = :a, b = :b REMOVE c",
+		"REMOVE c":                      "SET a = :a REMOVE c",
+		"ADD n :one SET #settings = :s": "ADD n :one SET a = :a, #settings = :s",
+	}
+
+	for expr, expected := range cases {
+		result := addSetAction(expr, "a = :a")
+		if result != expected {
+			t.Error("expression:", expr, "expected", expected, "got", result)
+		}
+	}
+}
+
+// indexRecordingStorage keeps the last scan and query made through it instead of sending them anywhere
+type indexRecordingStorage struct {
+	Storage
+	scan  *dynamodb.ScanInput
+	query *dynamodb.QueryInput
+}
+
+func (s *indexRecordingStorage) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	s.scan = input
+	return &dynamodb.ScanOutput{}, nil
+}
+
+func (s *indexRecordingStorage) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	s.query = input
+	return &dynamodb.QueryOutput{}, nil
+}
+
+func TestLibrary_snapshotIndexPagination(t *testing.T) {
+	library := &Library{
+		tableName:          "movies",
+		partitionKey:       "year",
+		partitionKeyType:   "S",
+		snapshotIndex:      true,
+		snapshotIndexReady: true,
+	}
+	tableKey := map[string]*dynamodb.AttributeValue{"year": {S: aws.String("1_1999")}}
+	indexKey := map[string]*dynamodb.AttributeValue{
+		"year":            {S: aws.String("1_1999")},
+		snapshotAttribute: {S: aws.String("1")},
+	}
+
+	cases := []struct {
+		startKey       map[string]*dynamodb.AttributeValue
+		consistentRead bool
+		query          bool
+	}{
+		// the first page is read from the index, now that it is ready
+		{nil, false, true},
+		// a scan that started before it was ready carries on scanning the table
+		{tableKey, false, false},
+		// and one that started on the index carries on querying it
+		{indexKey, false, true},
+		// which the table cannot be scanned from
+		{indexKey, true, false},
+	}
+	for i, c := range cases {
+		storage := &indexRecordingStorage{}
+		library.svc = storage
+		_, err := library.scanStoredWithSnapshotID(aws.BackgroundContext(), &dynamodb.ScanInput{
+			TableName:         aws.String("movies"),
+			ExclusiveStartKey: c.startKey,
+			ConsistentRead:    aws.Bool(c.consistentRead),
+		}, "1")
+
+		if c.consistentRead {
+			if _, ok := err.(*UnsupportedInputError); !ok {
+				t.Error(i, "expected an UnsupportedInputError, got", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(i, "expected no errors, got", err)
+		}
+		if c.query && (storage.query == nil || storage.scan != nil) {
+			t.Error(i, "expected the index to be queried, got", storage.scan)
+		}
+		if !c.query && (storage.scan == nil || storage.query != nil) {
+			t.Error(i, "expected the table to be scanned, got", storage.query)
+		}
+	}
+}
+
+func TestLibrary_BackfillSnapshotIndex(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// written before the index was enabled
+		nItems := 3
+		for i := 0; i < nItems; i++ {
+			if i > 0 {
+				library.Snapshot(strconv.Itoa(i))
+			}
+			library.PutItem(&dynamodb.PutItemInput{
+				TableName: aws.String(getTableName(schema)),
+				Item:      getAttributeValueForItem(schema, fmt.Sprintf("data_%d", i)),
+			})
+		}
+
+		_, err := library.BackfillSnapshotIndex()
+		if err == nil {
+			t.Error("expected an error without the snapshot index")
+		}
+
+		library.snapshotIndex = true
+		tagged, err := library.BackfillSnapshotIndex()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if tagged != int64(nItems) {
+			t.Error("expected", nItems, "items tagged, got", tagged)
+		}
+
+		// nothing left to do
+		job := library.StartBackfillSnapshotIndex()
+		if err := job.Wait(); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if items := job.Status().Items; items != 0 {
+			t.Error("expected no items tagged, got", items)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_SnapshotIndex(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		_, teardown := setupTest(schema, t)
+
+		library, err := NewWithOptions(
+			getTableName(schema),
+			partitionKey,
+			partitionKeyType[schema],
+			rangeKey[schema],
+			rangeKeyType[schema],
+			testSession(t),
+			WithSnapshotIndex(),
+		)
+		if err != nil {
+			t.Error(err)
+		}
+
+		nItems := 3
+		for i := 0; i < nItems; i++ {
+			err := library.Snapshot(strconv.Itoa(i))
+			if err != nil {
+				t.Error(err)
+			}
+			_, err = library.PutItem(&dynamodb.PutItemInput{
+				TableName: aws.String(getTableName(schema)),
+				Item:      getAttributeValueForItem(schema, fmt.Sprintf("data_%d", i)),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		// reads only use the index once every item is known to be tagged
+		_, err = library.BackfillSnapshotIndex()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		// the backfill creates the index, and reads fall back to scanning the table until it is active; then, the
+		// same results are expected from querying it
+		clock := &fakeClock{now: time.Now()}
+		library.clock = clock
+		for attempt := 0; attempt < 10; attempt++ {
+			count, err := library.CountItems("1")
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if count != 1 {
+				t.Error("expected 1 item, got", count)
+			}
+
+			out, err := library.ScanFromSnapshot(&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "1")
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			} else if len(out.Items) != 1 {
+				t.Error("expected 1 item, got", out.Items)
+			} else {
+				_, ok := out.Items[0][snapshotAttribute]
+				if ok {
+					t.Error("expected the snapshot attribute to be removed, got", out.Items[0])
+				}
+			}
+
+			if library.snapshotIndexReady {
+				break
+			}
+			time.Sleep(1000 * time.Millisecond)
+			clock.Advance(snapshotIndexCheckInterval)
+		}
+		if !library.snapshotIndexReady {
+			t.Error("expected the snapshot index to be ready")
+		}
+
+		teardown(schema, t)
+	}
+}
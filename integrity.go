@@ -0,0 +1,305 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// attribute, added to every item written in integrity mode (see WithChecksums), that holds a checksum of the
+	// item's content: "<algorithm>:<hex digest>"
+	checksumAttribute = "ddblibrarian_checksum"
+	checksumSHA256    = "sha256"
+)
+
+// ChecksumError is returned when an item read from the table does not match the checksum written with it, i.e., it
+// was corrupted or edited without going through the Library.
+type ChecksumError struct {
+	// primary key of the item, without the snapshot ID
+	Key map[string]*dynamodb.AttributeValue
+	// the item has no checksum at all, which is only an error with WithRequiredChecksums
+	Missing bool
+}
+
+func (e *ChecksumError) Error() string {
+	msg := "item does not match its checksum"
+	if e.Missing {
+		msg = "item has no checksum"
+	}
+	key, err := json.Marshal(toJSONItem(e.Key))
+	if err != nil {
+		return msg
+	}
+
+	return msg + ": " + string(key)
+}
+
+// ChecksumReport is the result of verifying the checksums of a snapshot's items (see VerifyChecksums).
+type ChecksumReport struct {
+	Snapshot string
+	// items whose checksum was verified, including the corrupt ones
+	Checked int64
+	// items without a checksum, e.g., written before integrity mode was enabled or changed by UpdateItem
+	Missing int64
+	// primary keys (without the snapshot ID) of the items that do not match their checksum
+	Corrupt []map[string]*dynamodb.AttributeValue
+}
+
+// add a checksum of the item's content (see itemChecksum) if integrity mode is enabled, returning a function that
+// restores the item to its original state
+func (c *Library) checksumItem(item map[string]*dynamodb.AttributeValue) func() {
+	if !c.checksums {
+		return func() {}
+	}
+
+	original, ok := item[checksumAttribute]
+	item[checksumAttribute] = &dynamodb.AttributeValue{S: aws.String(c.itemChecksum(item))}
+
+	return func() {
+		if ok {
+			item[checksumAttribute] = original
+		} else {
+			delete(item, checksumAttribute)
+		}
+	}
+}
+
+// make sure an item read from the table, as it is stored, matches its checksum (if integrity mode is enabled and
+// it has one, or has to have one with WithRequiredChecksums)
+func (c *Library) verifyItem(item map[string]*dynamodb.AttributeValue) error {
+	if !c.checksums {
+		return nil
+	}
+
+	v, ok := item[checksumAttribute]
+	if !ok && c.requireChecksums {
+		return &ChecksumError{Key: c.primaryKey(item), Missing: true}
+	}
+	if !ok {
+		return nil
+	}
+	if aws.StringValue(v.S) != c.itemChecksum(item) {
+		return &ChecksumError{Key: c.primaryKey(item)}
+	}
+
+	return nil
+}
+
+// updates drop the item's checksum (see tagUpdate), which WithRequiredChecksums would then refuse to read
+func (c *Library) checkUpdateChecksum(operation string) error {
+	if !c.requireChecksums {
+		return nil
+	}
+
+	return &UnsupportedInputError{
+		Operation: operation,
+		Feature:   "UpdateExpression",
+		Reason:    "it would drop the item's checksum, which WithRequiredChecksums requires",
+	}
+}
+
+// return the checksum of every attribute of an item, as it is stored, except for the partition key (which changes
+// with the snapshot) and the attributes reserved for the snapshot index and the checksum itself
+func (c *Library) itemChecksum(item map[string]*dynamodb.AttributeValue) string {
+	content := make(map[string]*dynamodb.AttributeValue, len(item))
+	for k, v := range item {
+		if k != c.partitionKey && k != checksumAttribute && k != snapshotAttribute {
+			content[k] = v
+		}
+	}
+
+	h := sha256.New()
+	hashAttributeValue(h, &dynamodb.AttributeValue{M: content})
+
+	return checksumSHA256 + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// write an unambiguous representation of av to h that does not depend on the order of maps and sets, or on how
+// numbers are written
+func hashAttributeValue(h hash.Hash, av *dynamodb.AttributeValue) {
+	switch {
+	case av.S != nil:
+		hashString(h, "S", *av.S)
+	case av.N != nil:
+		hashString(h, "N", canonicalNumber(*av.N))
+	case av.B != nil:
+		hashString(h, "B", string(av.B))
+	case av.BOOL != nil:
+		hashString(h, "BOOL", fmt.Sprint(*av.BOOL))
+	case av.NULL != nil:
+		hashString(h, "NULL", "")
+	case av.SS != nil:
+		hashSet(h, "SS", aws.StringValueSlice(av.SS), func(s string) string { return s })
+	case av.NS != nil:
+		hashSet(h, "NS", aws.StringValueSlice(av.NS), canonicalNumber)
+	case av.BS != nil:
+		set := make([]string, len(av.BS))
+		for i, b := range av.BS {
+			set[i] = string(b)
+		}
+		hashSet(h, "BS", set, func(s string) string { return s })
+	case av.L != nil:
+		hashString(h, "L", fmt.Sprint(len(av.L)))
+		for _, v := range av.L {
+			hashAttributeValue(h, v)
+		}
+	case av.M != nil:
+		keys := make([]string, 0, len(av.M))
+		for k := range av.M {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		hashString(h, "M", fmt.Sprint(len(keys)))
+		for _, k := range keys {
+			hashString(h, "K", k)
+			hashAttributeValue(h, av.M[k])
+		}
+	}
+}
+
+// write the type and a length-prefixed value to h
+func hashString(h hash.Hash, dataType string, value string) {
+	h.Write([]byte(dataType))
+	binary.Write(h, binary.BigEndian, uint64(len(value)))
+	h.Write([]byte(value))
+}
+
+// write the sorted elements of a set to h, after normalizing them with canonical
+func hashSet(h hash.Hash, dataType string, set []string, canonical func(string) string) {
+	elements := make([]string, len(set))
+	for i, v := range set {
+		elements[i] = canonical(v)
+	}
+	sort.Strings(elements)
+
+	hashString(h, dataType, fmt.Sprint(len(elements)))
+	for _, v := range elements {
+		hashString(h, "", v)
+	}
+}
+
+// return a representation of a number that is the same however it is written, e.g., "1.50" and "1.5"; numbers
+// DynamoDB cannot parse either are left as they are
+func canonicalNumber(n string) string {
+	// DynamoDB numbers have up to 38 significant digits, plenty of bits to tell any two of them apart
+	f, _, err := big.ParseFloat(n, 10, 256, big.ToNearestEven)
+	if err != nil {
+		return n
+	}
+
+	return f.Text('e', -1)
+}
+
+// VerifyChecksums reads every item written to snapshot (or to any snapshot, if it is empty) and checks it against
+// the checksum written with it in integrity mode (see WithChecksums), reporting the items that do not match it
+// instead of failing on the first one. Items without a checksum are only counted, unless WithRequiredChecksums is
+// set: they are then reported as corrupt too.
+//
+// Cost: a full table scan
+func (c *Library) VerifyChecksums(snapshot string) (*ChecksumReport, error) {
+	return c.VerifyChecksumsWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// VerifyChecksumsWithContext is the same as VerifyChecksums with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) VerifyChecksumsWithContext(ctx aws.Context, snapshot string) (*ChecksumReport, error) {
+	if !c.checksums {
+		return nil, errors.New("integrity mode is not enabled (see WithChecksums)")
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// an empty snapshot means all of them
+	targetID := ""
+	if snapshot != "" {
+		targetID, err = meta.getSnapshotID(snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ChecksumReport{
+		Snapshot: snapshot,
+		Corrupt:  make([]map[string]*dynamodb.AttributeValue, 0),
+	}
+	input := c.tableScanInput()
+	input.ConsistentRead = aws.Bool(c.consistentRead)
+	for {
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			pk := item[c.partitionKey]
+			value := aws.StringValue(pk.S)
+			if c.partitionKeyType == "N" {
+				value = aws.StringValue(pk.N)
+			}
+
+			id, key := c.decodePartitionKey(value)
+			if snapshot != "" && id != targetID {
+				continue
+			}
+			if c.partitionKeyType == "N" {
+				item[c.partitionKey] = &dynamodb.AttributeValue{N: aws.String(key)}
+			} else {
+				item[c.partitionKey] = &dynamodb.AttributeValue{S: aws.String(key)}
+			}
+
+			if _, ok := item[checksumAttribute]; !ok {
+				report.Missing++
+				if c.requireChecksums {
+					report.Corrupt = append(report.Corrupt, c.primaryKey(item))
+				}
+				continue
+			}
+			report.Checked++
+			err := c.verifyItem(item)
+			if checksumErr, ok := err.(*ChecksumError); ok {
+				report.Corrupt = append(report.Corrupt, checksumErr.Key)
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	return report, nil
+}
@@ -0,0 +1,184 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_checksumItem(t *testing.T) {
+	library := &Library{partitionKey: "year", checksums: true}
+	item := map[string]*dynamodb.AttributeValue{
+		"year":   {N: aws.String("1999")},
+		"title":  {S: aws.String("The Matrix")},
+		"rating": {N: aws.String("8.70")},
+		"cast":   {SS: aws.StringSlice([]string{"Keanu Reeves", "Laurence Fishburne"})},
+	}
+
+	restore := library.checksumItem(item)
+	if item[checksumAttribute] == nil {
+		t.Fatal("expected a checksum to be added")
+	}
+	if err := library.verifyItem(item); err != nil {
+		t.Error("expected the checksum to match, got", err)
+	}
+
+	// the partition key changes with the snapshot, sets are not ordered, and numbers can be written in many ways
+	same := map[string]*dynamodb.AttributeValue{
+		"year":            {N: aws.String("42.1999")},
+		"title":           {S: aws.String("The Matrix")},
+		"rating":          {N: aws.String("8.7")},
+		"cast":            {SS: aws.StringSlice([]string{"Laurence Fishburne", "Keanu Reeves"})},
+		checksumAttribute: item[checksumAttribute],
+	}
+	if err := library.verifyItem(same); err != nil {
+		t.Error("expected the checksum to match, got", err)
+	}
+
+	// an edit is caught
+	item["title"] = &dynamodb.AttributeValue{S: aws.String("The Matrix Reloaded")}
+	err := library.verifyItem(item)
+	if _, ok := err.(*ChecksumError); !ok {
+		t.Error("expected a *ChecksumError, got", err)
+	}
+
+	restore()
+	if _, ok := item[checksumAttribute]; ok {
+		t.Error("expected the checksum to be removed")
+	}
+	// items without a checksum are not verified...
+	if err := library.verifyItem(item); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	// ...unless they are required to have one
+	library.requireChecksums = true
+	err = library.verifyItem(item)
+	if checksumErr, ok := err.(*ChecksumError); !ok || !checksumErr.Missing {
+		t.Error("expected a *ChecksumError for a missing checksum, got", err)
+	}
+	if err := library.checkUpdateChecksum("UpdateItem"); err == nil {
+		t.Error("expected updates to be rejected when checksums are required")
+	}
+}
+
+func TestAddRemoveAction(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"", "REMOVE #c"},
+		{"SET a = :a", "SET a = :a REMOVE #c"},
+		{"SET a = :a remove b", "SET a = :a remove #c, b"},
+	}
+	for _, test := range tests {
+		if got := addRemoveAction(test.expr, "#c"); got != test.expected {
+			t.Error("expected", test.expected, "got", got)
+		}
+	}
+}
+
+func TestLibrary_VerifyChecksums(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		checked := newClient(schema, t, WithChecksums())
+
+		checked.Snapshot("1")
+		putItems(checked, schema, 5, t)
+		_, err := checked.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      getAttributeValueForItem(schema, "checked"),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		report, err := checked.VerifyChecksums("1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if report.Checked != 6 || report.Missing != 0 || len(report.Corrupt) != 0 {
+			t.Error("expected 6 valid items, got", report)
+		}
+
+		// edit an item by hand, bypassing the library
+		meta, _ := library.loadMeta(aws.BackgroundContext())
+		id, _ := meta.getSnapshotID("1")
+		key := getAttributeValueForKey(schema)
+		pk := *key[partitionKey]
+		library.addSnapshotToPartitionKey(id, &pk)
+		key[partitionKey] = &pk
+		_, err = testService(t).UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(getTableName(schema)),
+			Key:                       key,
+			UpdateExpression:          aws.String("SET #v = :v"),
+			ExpressionAttributeNames:  map[string]*string{"#v": aws.String(valueField)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("tampered")}},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = checked.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if _, ok := err.(*ChecksumError); !ok {
+			t.Error("expected a *ChecksumError, got", err)
+		}
+		// verification is opt-in
+		_, err = library.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		report, err = checked.VerifyChecksums("1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if len(report.Corrupt) != 1 {
+			t.Error("expected 1 corrupt item, got", report.Corrupt)
+		}
+
+		// updates drop the checksum
+		_, err = checked.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                 aws.String(getTableName(schema)),
+			Key:                       getAttributeValueForKey(schema),
+			UpdateExpression:          aws.String("SET #v = :v"),
+			ExpressionAttributeNames:  map[string]*string{"#v": aws.String(valueField)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("updated")}},
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		report, err = checked.VerifyChecksums("1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if report.Checked != 5 || report.Missing != 1 || len(report.Corrupt) != 0 {
+			t.Error("expected 5 valid items and 1 without a checksum, got", report)
+		}
+
+		teardown(schema, t)
+	}
+}
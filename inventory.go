@@ -0,0 +1,161 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"math"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+)
+
+// TableInventory summarizes the snapshots of a table, e.g., to keep track of every table of an account (see
+// InventoryTables).
+type TableInventory struct {
+	Table string
+	// whether the table has metadata, i.e., snapshots have been taken on it at some point
+	Managed   bool
+	Snapshots int
+	// when the oldest and the newest snapshots were taken; zero if there are none, or if they were taken before
+	// creation times were recorded
+	Oldest time.Time
+	Newest time.Time
+	// how many more snapshots can be taken before running out of IDs (see SetSnapshotIDLength)
+	IDsLeft int
+	// the MaxSnapshotAge of the table's policy, if any, and whether the table was stale as of the inventory (see
+	// IsStale)
+	MaxSnapshotAge time.Duration
+	Stale          bool
+	// why the inventory of the table could not be taken, e.g., because NewFromTable rejects its key schema; only
+	// Table is set if it is not nil (see InventoryTables)
+	Err error
+}
+
+// IsStale returns true if, as of now, the newest snapshot of a managed table is older than maxAge, or its age is not
+// known because there are no snapshots left or none of them has a creation time. It is always false if maxAge is 0.
+func (t *TableInventory) IsStale(now time.Time, maxAge time.Duration) bool {
+	if !t.Managed || maxAge == 0 {
+		return false
+	}
+
+	return t.Newest.IsZero() || now.Sub(t.Newest) > maxAge
+}
+
+// Inventory returns a summary of the table's snapshots: whether there are any, how many, how old, and how many more
+// can be taken. The table is flagged as stale if its snapshot policy sets a MaxSnapshotAge and the newest snapshot is
+// older than that, e.g., because the job that takes them stopped running.
+//
+// Cost: 1RU
+func (c *Library) Inventory() (*TableInventory, error) {
+	return c.InventoryWithContext(aws.BackgroundContext())
+}
+
+// InventoryWithContext is the same as Inventory with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) InventoryWithContext(ctx aws.Context) (*TableInventory, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	length := meta.snapshotIDLength
+	if length == 0 {
+		length = defaultSnapshotIDLength
+	}
+	inventory := &TableInventory{
+		Table:     c.tableName,
+		Managed:   meta.exists,
+		Snapshots: len(meta.snapshots),
+		IDsLeft:   int(math.Pow10(length)) - 1 - len(meta.snapshots),
+	}
+	for name, id := range meta.snapshots {
+		info, err := describeSnapshot(meta, name, aws.StringValue(id.S))
+		if err != nil {
+			return nil, err
+		}
+		if info.Created.IsZero() {
+			continue
+		}
+		if inventory.Oldest.IsZero() || info.Created.Before(inventory.Oldest) {
+			inventory.Oldest = info.Created
+		}
+		if info.Created.After(inventory.Newest) {
+			inventory.Newest = info.Created
+		}
+	}
+
+	policy, err := meta.getSnapshotPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy != nil {
+		inventory.MaxSnapshotAge = policy.MaxSnapshotAge
+		inventory.Stale = inventory.IsStale(c.clock.Now(), policy.MaxSnapshotAge)
+	}
+
+	return inventory, nil
+}
+
+// InventoryTables returns the Inventory of each of tables, in the same order, reading their key schema from the
+// tables themselves (see NewFromTable); opts apply to every table, e.g., WithStorage or WithMetadataTable. A table
+// whose inventory cannot be taken does not stop the others: its Err is set instead, so that one table ddblibrarian
+// cannot manage does not fail the inventory of a whole region. The error returned is only ever that of ctx.
+//
+// Cost: 1 DescribeTable call + 1RU per table
+func InventoryTables(tables []string, p client.ConfigProvider, opts ...Option) ([]*TableInventory, error) {
+	return InventoryTablesWithContext(aws.BackgroundContext(), tables, p, opts...)
+}
+
+// InventoryTablesWithContext is the same as InventoryTables with the addition of the ability to pass a context, which
+// is passed on to every request made to the tables.
+func InventoryTablesWithContext(
+	ctx aws.Context,
+	tables []string,
+	p client.ConfigProvider,
+	opts ...Option,
+) ([]*TableInventory, error) {
+	inventories := make([]*TableInventory, 0, len(tables))
+	for _, table := range tables {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		inventories = append(inventories, tableInventory(ctx, table, p, opts...))
+	}
+
+	return inventories, nil
+}
+
+// return the Inventory of table, or one with only its name and the reason it could not be taken
+func tableInventory(ctx aws.Context, table string, p client.ConfigProvider, opts ...Option) *TableInventory {
+	library, err := NewFromTable(table, p, opts...)
+	if err != nil {
+		return &TableInventory{Table: table, Err: err}
+	}
+	defer library.Close()
+
+	inventory, err := library.InventoryWithContext(ctx)
+	if err != nil {
+		return &TableInventory{Table: table, Err: err}
+	}
+
+	return inventory
+}
@@ -0,0 +1,135 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_Inventory(t *testing.T) {
+	storage := &metaRowStorage{}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+
+	// nothing there yet
+	inventory, err := library.Inventory()
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if inventory.Managed || inventory.Snapshots != 0 || inventory.IDsLeft != 99 {
+		t.Error("expected an unmanaged table with 99 IDs left, got", inventory)
+	}
+
+	oldest := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	newest := oldest.Add(time.Hour)
+	storage.item = map[string]*dynamodb.AttributeValue{
+		ddbSnapshotsField: {M: map[string]*dynamodb.AttributeValue{
+			"first":  {S: aws.String("1")},
+			"second": {S: aws.String("2")},
+			"third":  {S: aws.String("3")},
+		}},
+		ddbSnapshotInfoField: {M: map[string]*dynamodb.AttributeValue{
+			"first":  {M: map[string]*dynamodb.AttributeValue{snapshotInfoCreated: timeToAttributeValue(oldest)}},
+			"second": {M: map[string]*dynamodb.AttributeValue{snapshotInfoCreated: timeToAttributeValue(newest)}},
+		}},
+	}
+	inventory, err = library.Inventory()
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !inventory.Managed || inventory.Snapshots != 3 || inventory.IDsLeft != 96 {
+		t.Error("expected a managed table with 3 snapshots and 96 IDs left, got", inventory)
+	}
+	// the snapshot taken before creation times were recorded is left out
+	if !inventory.Oldest.Equal(oldest) || !inventory.Newest.Equal(newest) {
+		t.Error("expected the snapshots to have been taken between", oldest, "and", newest, "got", inventory)
+	}
+	if inventory.Stale {
+		t.Error("expected a table without a policy never to be stale")
+	}
+
+	// stale once the newest snapshot is older than the policy allows
+	clock := &fakeClock{now: newest.Add(30 * time.Minute)}
+	library.clock = clock
+	storage.item[ddbSnapshotPolicyField] = (&SnapshotPolicy{MaxSnapshotAge: time.Hour}).toAttributeValue()
+	for _, stale := range []bool{false, true} {
+		inventory, err = library.Inventory()
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if inventory.Stale != stale || inventory.MaxSnapshotAge != time.Hour {
+			t.Error("expected the table to be stale:", stale, "as of", clock.now, "got", inventory)
+		}
+		clock.Advance(time.Hour)
+	}
+}
+
+// a Storage that describes each table with its own key schema
+type schemaStorage struct {
+	metaRowStorage
+	partitionKeyTypes map[string]string
+}
+
+func (s *schemaStorage) DescribeTable(input *dynamodb.DescribeTableInput) (*dynamodb.DescribeTableOutput, error) {
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{{
+			AttributeName: aws.String("id"),
+			AttributeType: aws.String(s.partitionKeyTypes[aws.StringValue(input.TableName)]),
+		}},
+		KeySchema: []*dynamodb.KeySchemaElement{{
+			AttributeName: aws.String("id"),
+			KeyType:       aws.String(dynamodb.KeyTypeHash),
+		}},
+	}}, nil
+}
+
+func TestInventoryTables(t *testing.T) {
+	storage := &schemaStorage{partitionKeyTypes: map[string]string{"movies": "N", "blobs": "B", "books": "S"}}
+
+	// the table with a binary partition key does not stop the others
+	inventories, err := InventoryTables([]string{"movies", "blobs", "books"}, nil, WithStorage(storage))
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if len(inventories) != 3 {
+		t.Fatal("expected the inventory of 3 tables, got", len(inventories))
+	}
+	for i, table := range []string{"movies", "blobs", "books"} {
+		inventory := inventories[i]
+		if inventory.Table != table {
+			t.Error("expected the inventory of table", table, "got", inventory.Table)
+		}
+		if (inventory.Err != nil) != (table == "blobs") {
+			t.Error("expected only the inventory of table blobs to fail, got", inventory.Err, "for table", table)
+		}
+	}
+
+	// only a done context stops it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := InventoryTablesWithContext(ctx, []string{"movies"}, nil, WithStorage(storage)); err == nil {
+		t.Error("expected an error once the context is done")
+	}
+}
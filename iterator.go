@@ -0,0 +1,186 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// ScanPagesFromSnapshot reads snapshot one page at a time, as ScanFromSnapshot would, following LastEvaluatedKey
+// until the whole table has been read or fn returns false; fn is also told whether the page is the last one. Like
+// the ScanPages method of the DynamoDB client, it takes care of the pagination loop, and throttled requests are retried
+// with exponential backoff. The input itself is not modified, but its ExclusiveStartKey is honored, to resume a scan
+// from the LastEvaluatedKey of a page.
+//
+// Cost: a full table scan (unless the snapshot index is enabled)
+func (c *Library) ScanPagesFromSnapshot(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	fn func(page *dynamodb.ScanOutput, lastPage bool) bool,
+) error {
+	return c.ScanPagesFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot, fn)
+}
+
+// ScanPagesFromSnapshotWithContext is the same as ScanPagesFromSnapshot with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) ScanPagesFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	fn func(page *dynamodb.ScanOutput, lastPage bool) bool,
+) error {
+	it, err := c.ScanIteratorFromSnapshotWithContext(ctx, input, snapshot)
+	if err != nil {
+		return err
+	}
+
+	for {
+		page, err := it.nextPage()
+		if err != nil {
+			return err
+		}
+		if !fn(page, it.done) || it.done {
+			return nil
+		}
+	}
+}
+
+// ScanIterator reads the items of a snapshot one at a time, fetching the next page only once the items of the
+// previous one have been read (see ScanIteratorFromSnapshot):
+//
+//	it, err := library.ScanIteratorFromSnapshot(input, "snapshot")
+//	...
+//	for it.Next() {
+//		item := it.Item()
+//		...
+//	}
+//	if it.Err() != nil {
+//		...
+//	}
+//
+// It is not safe for concurrent use.
+type ScanIterator struct {
+	library *Library
+	ctx     aws.Context
+	// copy of the caller's input, with the key to start the next page from
+	input dynamodb.ScanInput
+	id    string
+	// of the snapshot being scanned, for page tokens (see snapshotGeneration)
+	generation string
+	// items of the current page not read yet
+	items []map[string]*dynamodb.AttributeValue
+	item  map[string]*dynamodb.AttributeValue
+	// LastEvaluatedKey of the current page
+	lastKey map[string]*dynamodb.AttributeValue
+	done    bool
+	err     error
+}
+
+// ScanIteratorFromSnapshot returns an iterator over the items of snapshot that match input, as ScanFromSnapshot
+// would return them, following LastEvaluatedKey until the whole table has been read. Throttled requests are retried
+// with exponential backoff. The input itself is not modified, but its ExclusiveStartKey is honored.
+//
+// Cost: a full table scan (unless the snapshot index is enabled), a page at a time
+func (c *Library) ScanIteratorFromSnapshot(input *dynamodb.ScanInput, snapshot string) (*ScanIterator, error) {
+	return c.ScanIteratorFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// ScanIteratorFromSnapshotWithContext is the same as ScanIteratorFromSnapshot with the addition of the ability to pass
+// a context, which is passed on to every request made to the table.
+func (c *Library) ScanIteratorFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+) (*ScanIterator, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := meta.getScanSnapshotID(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScanIterator{library: c, ctx: ctx, input: *input, id: id, generation: snapshotGeneration(meta, id)}, nil
+}
+
+// Next advances to the next item, reading the next page if needed, and returns false once there are no items left
+// or reading fails (see Err).
+func (it *ScanIterator) Next() bool {
+	for len(it.items) == 0 {
+		if it.done || it.err != nil {
+			it.item = nil
+			return false
+		}
+		page, err := it.nextPage()
+		if err != nil {
+			it.err = err
+			it.item = nil
+			return false
+		}
+		it.items = page.Items
+	}
+
+	it.item = it.items[0]
+	it.items = it.items[1:]
+
+	return true
+}
+
+// Item returns the current item, with the snapshot removed from the partition key.
+func (it *ScanIterator) Item() map[string]*dynamodb.AttributeValue {
+	return it.item
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *ScanIterator) Err() error {
+	return it.err
+}
+
+// LastEvaluatedKey returns the LastEvaluatedKey of the last page read, to resume the scan after it (in
+// ExclusiveStartKey) once all of its items have been processed; it is empty after the last page.
+func (it *ScanIterator) LastEvaluatedKey() map[string]*dynamodb.AttributeValue {
+	return it.lastKey
+}
+
+// read the next page of items
+func (it *ScanIterator) nextPage() (*dynamodb.ScanOutput, error) {
+	out, err := it.library.scanWithRetries(it.ctx, &it.input, it.id)
+	if err != nil {
+		return nil, err
+	}
+
+	it.lastKey = out.LastEvaluatedKey
+	if len(out.LastEvaluatedKey) == 0 {
+		it.done = true
+	} else {
+		it.input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+
+	return out, nil
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_ScanIteratorFromSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 5, t)
+		library.Snapshot("snap")
+		nItems := 12
+		putItems(library, schema, nItems, t)
+
+		// small pages, so that several of them are read
+		input := &dynamodb.ScanInput{TableName: aws.String(getTableName(schema)), Limit: aws.Int64(5)}
+		it, err := library.ScanIteratorFromSnapshot(input, "snap")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		seen := make(map[string]int, 0)
+		for it.Next() {
+			seen[*getPartitionKeyValue(schema, it.Item())]++
+		}
+		if it.Err() != nil {
+			t.Error("expected no errors, got", it.Err())
+		}
+		for i := 0; i < nItems; i++ {
+			if seen[strconv.Itoa(i)] != 1 {
+				t.Error("expected key", i, "exactly once, got", seen[strconv.Itoa(i)])
+			}
+		}
+		if len(it.LastEvaluatedKey()) != 0 || input.ExclusiveStartKey != nil {
+			t.Error("expected the scan to be over, and the input untouched")
+		}
+
+		_, err = library.ScanIteratorFromSnapshot(input, "does-not-exist")
+		if err == nil {
+			t.Error("expected error scanning a snapshot that does not exist")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ScanPagesFromSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		library.Snapshot("snap")
+		nItems := 12
+		putItems(library, schema, nItems, t)
+
+		input := &dynamodb.ScanInput{TableName: aws.String(getTableName(schema)), Limit: aws.Int64(5)}
+		items := 0
+		pages := 0
+		last := false
+		err := library.ScanPagesFromSnapshot(input, "snap", func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			items += len(page.Items)
+			pages++
+			last = lastPage
+			return true
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if items != nItems || pages < 3 || !last {
+			t.Error("expected", nItems, "items on at least 3 pages, got", items, "on", pages)
+		}
+
+		// stop after the first page
+		pages = 0
+		err = library.ScanPagesFromSnapshot(input, "snap", func(page *dynamodb.ScanOutput, lastPage bool) bool {
+			pages++
+			return false
+		})
+		if err != nil || pages != 1 {
+			t.Error("expected a single page, got", pages, err)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,372 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// JobState tells where a Job is at.
+type JobState string
+
+// The states a Job goes through: it runs, possibly paused along the way, until it succeeds, fails, or is cancelled.
+const (
+	JobRunning   JobState = "running"
+	JobPaused    JobState = "paused"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// JobStatus is a snapshot of how a Job is going (see Job.Status).
+type JobStatus struct {
+	// identifies the job, e.g., to resume it from another process (see ResumeJob)
+	ID string
+	// e.g., "Restore", "DestroySnapshot", "CollectGarbage", "DumpSnapshot", "LoadSnapshot", or "BackfillSnapshotIndex"
+	Operation string
+	// snapshot operated on, as passed by the caller; empty for operations on the whole table, e.g., CollectGarbage
+	Snapshot string
+	State    JobState
+	Started  time.Time
+	// when the job last made progress; the zero time if it has not yet
+	Updated time.Time
+	// when the job was over; the zero time while it runs
+	Finished time.Time
+	// number of items written, deleted, dumped, tagged, or converted so far
+	Items int64
+	// write capacity units consumed so far by the items written, or deleted
+	ConsumedCapacity float64
+	// how far the scan has gone, for a DumpSnapshot, a DestroySnapshot, a CollectGarbage, a BackfillSnapshotIndex, or a
+	// MigrateKeyEncoding; nil for other operations
+	Checkpoint *ScanProgress
+	// why the job failed, once it is over; nil if it succeeded, or is still running
+	Err error
+}
+
+// Job is a handle on a bulk operation, i.e., Restore, DestroySnapshot, CollectGarbage, DumpSnapshot, LoadSnapshot,
+// BackfillSnapshotIndex, or MigrateKeyEncoding, while it runs (see Library.Jobs). All of them read and write through
+// the same machinery, which checks on the job before every page scanned and every batch written: that is where a
+// paused job stops until it is resumed, and where a cancelled one gives up. Its methods are safe for concurrent use.
+type Job struct {
+	mutex  sync.Mutex
+	status JobStatus
+	// what it takes to resume the job, besides its operation and snapshot
+	params *jobParams
+	// where the job is saved (see WithPersistentJobs); nil if it is not
+	store *jobStore
+	// closed when the job is resumed; nil unless it is paused
+	resume chan struct{}
+	cancel context.CancelFunc
+	// closed once the job is over
+	done chan struct{}
+}
+
+// return the ID snapshot resolved to when the job first ran, if it was recorded (see Library.jobSnapshot)
+func (j *Job) snapshotID(snapshot string) (string, bool) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.params == nil {
+		return "", false
+	}
+	id, ok := j.params.snapshotIDs[snapshot]
+
+	return id, ok
+}
+
+// record the ID snapshot resolved to, saving the job right away if it is saved at all
+func (j *Job) setSnapshotID(snapshot string, id string) error {
+	j.mutex.Lock()
+	// the params are replaced, not changed, so that they can be read without holding the mutex for long
+	params := jobParams{}
+	if j.params != nil {
+		params = *j.params
+	}
+	ids := make(map[string]string, len(params.snapshotIDs)+1)
+	for k, v := range params.snapshotIDs {
+		ids[k] = v
+	}
+	ids[snapshot] = id
+	params.snapshotIDs = ids
+	j.params = &params
+	j.mutex.Unlock()
+
+	if j.store == nil {
+		return nil
+	}
+	return j.store.save(j)
+}
+
+// return what it takes to resume the job, as of now
+func (j *Job) savedParams() *jobParams {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	return j.params
+}
+
+// Status returns how the job is going.
+func (j *Job) Status() JobStatus {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	status := j.status
+	if status.Checkpoint != nil {
+		status.Checkpoint = status.Checkpoint.copy()
+	}
+
+	return status
+}
+
+// Pause stops the job before its next request to the table, until Resume is called; the requests already made, if
+// any, still finish. It does nothing if the job is not running.
+func (j *Job) Pause() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.status.State != JobRunning {
+		return
+	}
+	j.status.State = JobPaused
+	j.resume = make(chan struct{})
+}
+
+// Resume lets a paused job carry on. It does nothing if the job is not paused.
+func (j *Job) Resume() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.status.State != JobPaused {
+		return
+	}
+	j.status.State = JobRunning
+	close(j.resume)
+	j.resume = nil
+}
+
+// Cancel stops the job as soon as possible, paused or not: the operation fails with the context's error, leaving
+// the table as any other failure would (e.g., it is safe to run DestroySnapshot again). It does nothing if the job is
+// already over.
+func (j *Job) Cancel() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.status.State == JobRunning || j.status.State == JobPaused {
+		j.status.State = JobCancelled
+		j.cancel()
+	}
+}
+
+// Wait blocks until the job is over and returns the error it failed with, if any.
+func (j *Job) Wait() error {
+	<-j.done
+
+	return j.Status().Err
+}
+
+// Done returns a channel that is closed once the job is over.
+func (j *Job) Done() <-chan struct{} {
+	return j.done
+}
+
+// Jobs returns the bulk operations this Library is running, paused or not, in the order they were started.
+func (c *Library) Jobs() []*Job {
+	c.jobsMutex.Lock()
+	defer c.jobsMutex.Unlock()
+
+	jobs := make([]*Job, len(c.jobs))
+	copy(jobs, c.jobs)
+
+	return jobs
+}
+
+type jobContextKey struct{}
+
+// return the job running with ctx, if any
+func jobFromContext(ctx aws.Context) *Job {
+	job, _ := ctx.Value(jobContextKey{}).(*Job)
+	return job
+}
+
+// run a bulk operation as a Job (see newJob), returning once it is over
+func (c *Library) runJob(
+	ctx aws.Context,
+	operation string,
+	snapshot string,
+	params *jobParams,
+	fn func(ctx aws.Context, reporter *operationReporter) error,
+) error {
+	job, run := c.newJob(ctx, JobStatus{Operation: operation, Snapshot: snapshot}, params, fn)
+	run()
+
+	return job.Status().Err
+}
+
+// run a bulk operation as a Job (see newJob) in the background, returning right away
+func (c *Library) startJob(
+	ctx aws.Context,
+	operation string,
+	snapshot string,
+	params *jobParams,
+	fn func(ctx aws.Context, reporter *operationReporter) error,
+) *Job {
+	job, run := c.newJob(ctx, JobStatus{Operation: operation, Snapshot: snapshot}, params, fn)
+	go run()
+
+	return job
+}
+
+// return a Job for a bulk operation, already listed by Jobs, along with the function that runs it: fn is passed the
+// context every request should be made with (which the job can pause and cancel) and the reporter to record its
+// progress with.
+//
+// The job carries on from status, which only needs the operation and the snapshot for a new job; one with an ID is
+// being resumed (see ResumeJob), and is saved whether WithPersistentJobs is set or not.
+func (c *Library) newJob(
+	ctx aws.Context,
+	status JobStatus,
+	params *jobParams,
+	fn func(ctx aws.Context, reporter *operationReporter) error,
+) (*Job, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &Job{
+		status: status,
+		params: params,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	job.status.State = JobRunning
+	job.status.Finished = time.Time{}
+	job.status.Err = nil
+	reporter := c.newOperationReporter(status.Operation, status.Snapshot, job)
+	if status.ID == "" {
+		job.status.ID = newJobID(reporter.report.Started)
+		job.status.Started = reporter.report.Started
+	} else {
+		reporter.report.Items = status.Items
+		reporter.report.ConsumedCapacity = status.ConsumedCapacity
+		reporter.report.Checkpoint = status.Checkpoint
+	}
+	if c.persistJobs || status.ID != "" {
+		job.store = &jobStore{c: c, interval: c.jobSaveInterval}
+	}
+	c.jobsMutex.Lock()
+	c.jobs = append(c.jobs, job)
+	c.jobsMutex.Unlock()
+
+	return job, func() {
+		defer cancel()
+
+		// a job that cannot be found later on is not worth starting
+		err := job.store.start(job)
+		if err == nil {
+			err = fn(context.WithValue(ctx, jobContextKey{}, job), reporter)
+		}
+		reporter.done(err)
+
+		c.jobsMutex.Lock()
+		for i, j := range c.jobs {
+			if j == job {
+				c.jobs = append(c.jobs[:i], c.jobs[i+1:]...)
+				break
+			}
+		}
+		c.jobsMutex.Unlock()
+		job.finish(err, c.clock.Now())
+	}
+}
+
+// return a new ID for a job started at started: its time, to the millisecond, and a random suffix to tell apart the
+// jobs started at the same time
+func newJobID(started time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return started.UTC().Format("20060102T150405.000Z") + "-" + hex.EncodeToString(suffix)
+}
+
+// wait until the job is running, i.e., not paused, returning an error if it was cancelled (or ctx is done in the
+// meantime); a nil *Job is always running
+func (j *Job) wait(ctx aws.Context) error {
+	if j == nil {
+		return ctx.Err()
+	}
+
+	j.mutex.Lock()
+	resume := j.resume
+	j.mutex.Unlock()
+	if resume != nil {
+		select {
+		case <-resume:
+		case <-ctx.Done():
+		}
+	}
+
+	return ctx.Err()
+}
+
+// record the progress of the job, as reported so far at now
+func (j *Job) update(report *OperationReport, now time.Time) {
+	if j == nil {
+		return
+	}
+
+	j.mutex.Lock()
+	j.status.Updated = now
+	j.status.Items = report.Items
+	j.status.ConsumedCapacity = report.ConsumedCapacity
+	// the scan keeps updating its own
+	if report.Checkpoint != nil {
+		j.status.Checkpoint = report.Checkpoint.copy()
+	}
+	j.mutex.Unlock()
+
+	j.store.progress(j, now)
+}
+
+// record that the job was over at now, failing with err if not nil
+func (j *Job) finish(err error, now time.Time) {
+	j.mutex.Lock()
+	j.status.Finished = now
+	j.status.Err = err
+	switch {
+	case err == nil:
+		j.status.State = JobSucceeded
+	case j.status.State != JobCancelled:
+		j.status.State = JobFailed
+	}
+	// wake up anyone still waiting for it to be resumed
+	if j.resume != nil {
+		close(j.resume)
+		j.resume = nil
+	}
+	j.mutex.Unlock()
+
+	// save how it went before letting anyone know it is over
+	j.store.finish(j)
+	close(j.done)
+}
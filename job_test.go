@@ -0,0 +1,131 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_runJob(t *testing.T) {
+	library := &Library{clock: systemClock{}}
+
+	// a job that writes some items, and then carries on only while it is not paused
+	start := func() (*Job, chan struct{}, chan error) {
+		started := make(chan struct{})
+		proceed := make(chan struct{})
+		result := make(chan error, 1)
+		go func() {
+			result <- library.runJob(aws.BackgroundContext(), "Restore", "1", nil,
+				func(ctx aws.Context, reporter *operationReporter) error {
+					close(started)
+					<-proceed
+					reporter.written(10, 10, nil)
+					return jobFromContext(ctx).wait(ctx)
+				})
+		}()
+		<-started
+
+		jobs := library.Jobs()
+		if len(jobs) != 1 {
+			t.Fatal("expected a single job running, got", jobs)
+		}
+		return jobs[0], proceed, result
+	}
+
+	job, proceed, result := start()
+	job.Pause()
+	if s := job.Status(); s.State != JobPaused || s.Operation != "Restore" || s.Snapshot != "1" || s.Started.IsZero() {
+		t.Error("unexpected status of a paused job:", s)
+	}
+	close(proceed)
+	select {
+	case <-job.Done():
+		t.Error("expected a paused job to wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if s := job.Status(); s.Items != 10 || s.ConsumedCapacity != 10 {
+		t.Error("expected the progress of a paused job, got", s)
+	}
+	job.Resume()
+	if err := <-result; err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if err := job.Wait(); err != nil || job.Status().State != JobSucceeded {
+		t.Error("expected the job to succeed, got", job.Status())
+	}
+	if len(library.Jobs()) != 0 {
+		t.Error("expected no jobs running, got", library.Jobs())
+	}
+	// nothing to pause once it is over
+	job.Pause()
+	if job.Status().State != JobSucceeded {
+		t.Error("expected the job to stay over, got", job.Status())
+	}
+
+	// cancelling a paused job stops it right away
+	job, proceed, result = start()
+	job.Pause()
+	close(proceed)
+	job.Cancel()
+	if err := <-result; err != context.Canceled {
+		t.Error("expected the job to be cancelled, got", err)
+	}
+	if s := job.Status(); s.State != JobCancelled || s.Err != context.Canceled {
+		t.Error("unexpected status of a cancelled job:", s)
+	}
+}
+
+func TestLibrary_StartDestroySnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		library.Snapshot("1")
+		nItems := 30
+		putItems(library, schema, nItems, t)
+		library.Snapshot("2")
+
+		job := library.StartDestroySnapshot("1")
+		if err := job.Wait(); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		status := job.Status()
+		if status.State != JobSucceeded || status.Operation != "DestroySnapshot" || status.Items != int64(nItems) {
+			t.Error("unexpected status:", status)
+		}
+		out, _, err := library.ScanAllVersions(&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))})
+		if err != nil || len(out.Items) != 0 {
+			t.Error("expected every item destroyed, got", out, err)
+		}
+
+		// failures are reported by the job
+		job = library.StartDestroySnapshot("does-not-exist")
+		if err := job.Wait(); err == nil || job.Status().State != JobFailed {
+			t.Error("expected the job to fail, got", job.Status())
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,637 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// field of the metadata that holds the jobs saved with WithPersistentJobs: map job_id -> job
+const ddbJobsField = "jobs"
+
+// fields of a saved job
+const (
+	jobFieldOperation  = "operation"
+	jobFieldSnapshot   = "snapshot"
+	jobFieldState      = "state"
+	jobFieldStarted    = "started"
+	jobFieldUpdated    = "updated"
+	jobFieldFinished   = "finished"
+	jobFieldItems      = "items"
+	jobFieldCapacity   = "capacity"
+	jobFieldCheckpoint = "checkpoint"
+	jobFieldError      = "error"
+	jobFieldForce      = "force"
+	jobFieldKeep       = "keep"
+	jobFieldTenant     = "tenant"
+	// whether the keys are migrated with KeysWithoutTrailingZeros
+	jobFieldNoTrailingZeros = "no_trailing_zeros"
+	// map snapshot -> ID it resolved to, NULL for the baseline
+	jobFieldSnapshotIDs = "snapshot_ids"
+)
+
+// fields of a saved ScanProgress
+const (
+	scanProgressSegments = "segments"
+	scanProgressLastKeys = "last_keys"
+	scanProgressDone     = "done"
+)
+
+// how often a job is saved, at most, unless set by WithPersistentJobs
+const defaultJobSaveInterval = 10 * time.Second
+
+// number of jobs that are over to keep in the metadata, the most recent ones (see ListJobs)
+const jobHistoryLength = 20
+
+// what it takes to resume a job, besides its operation and snapshot (see ResumeJob)
+type jobParams struct {
+	// the snapshot is destroyed with ForceDestroy
+	force bool
+	// the keys are migrated with KeysWithoutTrailingZeros
+	noTrailingZeros bool
+	// the snapshots CollectGarbage was told to keep
+	keep []string
+	// the prefix of the partition keys of the tenant RestoreTenant and PurgeTenant are scoped to
+	tenant string
+	// the ID each snapshot the job operates on, e.g., "latest" or "current", resolved to when it first ran (see
+	// jobSnapshot)
+	snapshotIDs map[string]string
+}
+
+// saves a job in the table's metadata (see WithPersistentJobs); a nil *jobStore saves nothing.
+//
+// A job is saved when it starts, at most once every interval as it makes progress, and once it is over, making room
+// for it among the jobHistoryLength most recent jobs that are over.
+type jobStore struct {
+	c        *Library
+	interval time.Duration
+	// when the job was last saved
+	saved time.Time
+}
+
+// save a job that is about to start
+func (s *jobStore) start(job *Job) error {
+	if s == nil {
+		return nil
+	}
+
+	err := s.save(job)
+	if err != nil {
+		return wrapError("failed to save the job", err)
+	}
+	s.saved = s.c.clock.Now()
+
+	return nil
+}
+
+// save a job that made progress at now, if it has not been saved in a while; it is saved again next time if that
+// fails
+func (s *jobStore) progress(job *Job, now time.Time) {
+	if s == nil {
+		return
+	}
+	interval := s.interval
+	if interval == 0 {
+		interval = defaultJobSaveInterval
+	}
+	if now.Sub(s.saved) < interval {
+		return
+	}
+
+	if s.save(job) == nil {
+		s.saved = now
+	}
+}
+
+// save how a job that is over went, forgetting the oldest jobs that are over; there is no one left to tell about any
+// errors
+func (s *jobStore) finish(job *Job) {
+	if s == nil {
+		return
+	}
+
+	if s.save(job) != nil {
+		return
+	}
+	jobs, err := s.c.savedJobs(aws.BackgroundContext())
+	if err != nil {
+		return
+	}
+	s.c.removeJobs(expiredJobs(jobs, jobHistoryLength))
+}
+
+func (s *jobStore) save(job *Job) error {
+	status := job.Status()
+	return s.c.saveJob(status.ID, jobAttributeValue(&status, job.savedParams()))
+}
+
+// record job as the one with the given ID in the metadata
+func (c *Library) saveJob(id string, job *dynamodb.AttributeValue) error {
+	// outlive the job's context, which is cancelled along with it
+	svc := c.metaStorage(aws.BackgroundContext())
+	key := c.metaKey()
+
+	// a nested attribute can only be set if its parent exists, which may be created by someone else at any time
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := svc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName: aws.String(c.metaTableName()),
+			Key:       key,
+			ExpressionAttributeNames: map[string]*string{
+				"#jobs": aws.String(ddbJobsField),
+				"#id":   aws.String(id),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":job": job},
+			UpdateExpression:          aws.String("SET #jobs.#id=:job"),
+			ConditionExpression:       aws.String("attribute_exists(#jobs)"),
+		})
+		if !isConditionalCheckFailure(err) {
+			return err
+		}
+
+		_, err = svc.UpdateItem(&dynamodb.UpdateItemInput{
+			TableName:                aws.String(c.metaTableName()),
+			Key:                      key,
+			ExpressionAttributeNames: map[string]*string{"#jobs": aws.String(ddbJobsField)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":jobs": {M: map[string]*dynamodb.AttributeValue{id: job}},
+			},
+			UpdateExpression:    aws.String("SET #jobs=:jobs"),
+			ConditionExpression: aws.String("attribute_not_exists(#jobs)"),
+		})
+		if !isConditionalCheckFailure(err) {
+			return err
+		}
+	}
+
+	return errors.New("the jobs of the table keep changing")
+}
+
+// remove the jobs with the given IDs from the metadata, if they are there
+func (c *Library) removeJobs(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	key := c.metaKey()
+	names := map[string]*string{"#jobs": aws.String(ddbJobsField)}
+	paths := make([]string, 0, len(ids))
+	for i, id := range ids {
+		placeholder := fmt.Sprintf("#id%d", i)
+		names[placeholder] = aws.String(id)
+		paths = append(paths, "#jobs."+placeholder)
+	}
+	_, err := c.metaStorage(aws.BackgroundContext()).UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(c.metaTableName()),
+		Key:                      key,
+		ExpressionAttributeNames: names,
+		UpdateExpression:         aws.String("REMOVE " + strings.Join(paths, ", ")),
+		ConditionExpression:      aws.String("attribute_exists(#jobs)"),
+	})
+	if isConditionalCheckFailure(err) {
+		return nil
+	}
+
+	return err
+}
+
+// return the IDs of the jobs that are over, but for the keep most recent ones
+func expiredJobs(jobs []JobStatus, keep int) []string {
+	over := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		if job.State != JobRunning && job.State != JobPaused {
+			over = append(over, job)
+		}
+	}
+	if len(over) <= keep {
+		return nil
+	}
+
+	// most recent first
+	sort.SliceStable(over, func(i, j int) bool {
+		return over[i].Finished.After(over[j].Finished)
+	})
+	expired := make([]string, 0, len(over)-keep)
+	for _, job := range over[keep:] {
+		expired = append(expired, job.ID)
+	}
+
+	return expired
+}
+
+// return the jobs saved in the metadata, by ID
+func (c *Library) loadJobs(ctx aws.Context) (map[string]*dynamodb.AttributeValue, error) {
+	key := c.metaKey()
+	out, err := c.metaStorage(ctx).GetItem(&dynamodb.GetItemInput{
+		TableName:                aws.String(c.metaTableName()),
+		Key:                      key,
+		ProjectionExpression:     aws.String("#jobs"),
+		ExpressionAttributeNames: map[string]*string{"#jobs": aws.String(ddbJobsField)},
+		ConsistentRead:           aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, ok := out.Item[ddbJobsField]
+	if !ok {
+		return map[string]*dynamodb.AttributeValue{}, nil
+	}
+
+	return jobs.M, nil
+}
+
+// ListJobs returns the jobs saved by WithPersistentJobs, by any process, oldest first: those that are still running,
+// or paused, along with the most recent ones that are over, successful or not, and how they went. Jobs this Library
+// runs are only listed if it has WithPersistentJobs set.
+//
+// Cost: 1RU
+func (c *Library) ListJobs() ([]JobStatus, error) {
+	return c.ListJobsWithContext(aws.BackgroundContext())
+}
+
+// ListJobsWithContext is the same as ListJobs with the addition of the ability to pass a context, which is passed on
+// to every request made to the table.
+func (c *Library) ListJobsWithContext(ctx aws.Context) ([]JobStatus, error) {
+	return c.savedJobs(ctx)
+}
+
+// InFlightJobs returns the jobs saved by WithPersistentJobs, by any process, that have not succeeded (yet), oldest
+// first: they are either running, paused, or were interrupted by a failure or a cancellation, and can be resumed with
+// ResumeJob. The job a process was running when it crashed is still listed as running: how long ago it was Updated
+// tells it apart from one that is making progress.
+//
+// Cost: 1RU
+func (c *Library) InFlightJobs() ([]JobStatus, error) {
+	return c.InFlightJobsWithContext(aws.BackgroundContext())
+}
+
+// InFlightJobsWithContext is the same as InFlightJobs with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) InFlightJobsWithContext(ctx aws.Context) ([]JobStatus, error) {
+	saved, err := c.savedJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]JobStatus, 0, len(saved))
+	for _, job := range saved {
+		if job.State != JobSucceeded {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs, nil
+}
+
+// return the jobs saved in the metadata, oldest first
+func (c *Library) savedJobs(ctx aws.Context) ([]JobStatus, error) {
+	saved, err := c.loadJobs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]JobStatus, 0, len(saved))
+	for id, av := range saved {
+		status, _, err := jobFromAttributeValue(id, av)
+		if err != nil {
+			return nil, wrapError("failed to read job "+id, err)
+		}
+		jobs = append(jobs, *status)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].Started.Equal(jobs[j].Started) {
+			return jobs[i].Started.Before(jobs[j].Started)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	return jobs, nil
+}
+
+// ResumeJob carries on with the job with the given ID, as saved by WithPersistentJobs (see InFlightJobs), e.g., one
+// interrupted when the process running it crashed, returning once it is over. It runs as the same job, listed by Jobs
+// and saved along the way, whether this Library has WithPersistentJobs set or not.
+//
+// A DestroySnapshot, a BackfillSnapshotIndex, or a MigrateKeyEncoding, carries on from the last page of items it went
+// through. A Restore, or a CollectGarbage, runs again, which only writes, or deletes, what is left. Either way, the
+// snapshots it operates on are the ones they were when the job first ran, even if "latest" or "current" have moved on
+// since, and it fails if any of them has been destroyed. A DumpSnapshot or a LoadSnapshot cannot be resumed this way,
+// not having where to write, or read, the items: the Checkpoint of a DumpSnapshot can be passed on to
+// BulkOptions.Resume instead.
+//
+// It is up to the caller to make sure the job is not still running somewhere else.
+//
+// Cost: 1RU + the cost of the rest of the operation
+func (c *Library) ResumeJob(id string) error {
+	return c.ResumeJobWithContext(aws.BackgroundContext(), id)
+}
+
+// ResumeJobWithContext is the same as ResumeJob with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) ResumeJobWithContext(ctx aws.Context, id string) error {
+	for _, job := range c.Jobs() {
+		if job.Status().ID == id {
+			return errors.New("job is already running: " + id)
+		}
+	}
+
+	saved, err := c.loadJobs(ctx)
+	if err != nil {
+		return err
+	}
+	av, ok := saved[id]
+	if !ok {
+		return errors.New("job not found: " + id)
+	}
+	status, params, err := jobFromAttributeValue(id, av)
+	if err != nil {
+		return wrapError("failed to read job "+id, err)
+	}
+	if status.State == JobSucceeded {
+		return errors.New("job already succeeded: " + id)
+	}
+
+	var fn func(ctx aws.Context, reporter *operationReporter) error
+	switch status.Operation {
+	case "Restore":
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			return c.restore(ctx, status.Snapshot, "", reporter)
+		}
+	case "RestoreTenant":
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			return c.restoreTenant(ctx, status.Snapshot, params.tenant, reporter)
+		}
+	case "PurgeTenant":
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			return c.purgeTenant(ctx, params.tenant, status.Checkpoint, reporter)
+		}
+	case "DestroySnapshot":
+		options := &destroyOptions{force: params.force, resume: status.Checkpoint}
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			return c.destroySnapshot(ctx, status.Snapshot, options, reporter)
+		}
+	case "CollectGarbage":
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			_, err := c.collectGarbage(ctx, params.keep, reporter)
+			return err
+		}
+	case "BackfillSnapshotIndex":
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			_, err := c.backfillSnapshotIndex(ctx, status.Checkpoint, reporter)
+			return err
+		}
+	case "MigrateKeyEncoding":
+		options := &migrationOptions{noTrailingZeros: params.noTrailingZeros, resume: status.Checkpoint}
+		fn = func(ctx aws.Context, reporter *operationReporter) error {
+			_, err := c.migrateKeyEncoding(ctx, options, reporter)
+			return err
+		}
+	default:
+		return errors.New("cannot resume a " + status.Operation + " job: " + id)
+	}
+
+	job, run := c.newJob(ctx, *status, params, fn)
+	run()
+
+	return job.Status().Err
+}
+
+// resolve snapshot, as passed to the operation of the job running with ctx, if any, to the name of the snapshot it
+// resolved to when the job first ran, so that a resumed job operates on the same snapshots even if "latest" or
+// "current" have moved on since (see ResumeJob); the first time around, the ID it resolves to is recorded with the
+// job, and saved right away
+func (c *Library) jobSnapshot(ctx aws.Context, meta *config, snapshot string) (string, error) {
+	job := jobFromContext(ctx)
+	// the baseline does not move
+	if job == nil || snapshot == "" || snapshot == Baseline {
+		return snapshot, nil
+	}
+
+	if id, ok := job.snapshotID(snapshot); ok {
+		name, err := snapshotNameOrBaseline(meta, id)
+		if err != nil {
+			return "", wrapError("the snapshot '"+snapshot+"' the job started with no longer exists", err)
+		}
+		return name, nil
+	}
+
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return "", err
+	}
+	err = job.setSnapshotID(snapshot, id)
+	if err != nil {
+		return "", wrapError("failed to save the job", err)
+	}
+
+	return snapshot, nil
+}
+
+// return the attribute value a job is saved as
+func jobAttributeValue(status *JobStatus, params *jobParams) *dynamodb.AttributeValue {
+	job := map[string]*dynamodb.AttributeValue{
+		jobFieldOperation: {S: aws.String(status.Operation)},
+		jobFieldState:     {S: aws.String(string(status.State))},
+		jobFieldStarted:   {S: aws.String(status.Started.UTC().Format(time.RFC3339Nano))},
+		jobFieldItems:     {N: aws.String(strconv.FormatInt(status.Items, 10))},
+		jobFieldCapacity:  {N: aws.String(strconv.FormatFloat(status.ConsumedCapacity, 'f', -1, 64))},
+	}
+	// DynamoDB does not allow empty strings
+	if status.Snapshot != "" {
+		job[jobFieldSnapshot] = &dynamodb.AttributeValue{S: aws.String(status.Snapshot)}
+	}
+	if !status.Updated.IsZero() {
+		job[jobFieldUpdated] = &dynamodb.AttributeValue{S: aws.String(status.Updated.UTC().Format(time.RFC3339Nano))}
+	}
+	if !status.Finished.IsZero() {
+		job[jobFieldFinished] = &dynamodb.AttributeValue{S: aws.String(status.Finished.UTC().Format(time.RFC3339Nano))}
+	}
+	if status.Checkpoint != nil {
+		job[jobFieldCheckpoint] = status.Checkpoint.toAttributeValue()
+	}
+	if status.Err != nil {
+		job[jobFieldError] = &dynamodb.AttributeValue{S: aws.String(status.Err.Error())}
+	}
+	if params != nil && params.force {
+		job[jobFieldForce] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	if params != nil && params.noTrailingZeros {
+		job[jobFieldNoTrailingZeros] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	}
+	if params != nil && params.keep != nil {
+		keep := make([]*dynamodb.AttributeValue, 0, len(params.keep))
+		for _, snapshot := range params.keep {
+			keep = append(keep, &dynamodb.AttributeValue{S: aws.String(snapshot)})
+		}
+		job[jobFieldKeep] = &dynamodb.AttributeValue{L: keep}
+	}
+	if params != nil && params.tenant != "" {
+		job[jobFieldTenant] = &dynamodb.AttributeValue{S: aws.String(params.tenant)}
+	}
+	if params != nil && len(params.snapshotIDs) > 0 {
+		ids := make(map[string]*dynamodb.AttributeValue, len(params.snapshotIDs))
+		for snapshot, id := range params.snapshotIDs {
+			ids[snapshot] = parentAttributeValue(id)
+		}
+		job[jobFieldSnapshotIDs] = &dynamodb.AttributeValue{M: ids}
+	}
+
+	return &dynamodb.AttributeValue{M: job}
+}
+
+// return the job with the given ID saved as av (see jobAttributeValue)
+func jobFromAttributeValue(id string, av *dynamodb.AttributeValue) (*JobStatus, *jobParams, error) {
+	if av.M == nil || av.M[jobFieldOperation] == nil || av.M[jobFieldState] == nil || av.M[jobFieldStarted] == nil {
+		return nil, nil, errors.New("malformed job")
+	}
+	job := av.M
+
+	status := &JobStatus{
+		ID:        id,
+		Operation: aws.StringValue(job[jobFieldOperation].S),
+		State:     JobState(aws.StringValue(job[jobFieldState].S)),
+	}
+	if v, ok := job[jobFieldSnapshot]; ok {
+		status.Snapshot = aws.StringValue(v.S)
+	}
+	var err error
+	status.Started, err = time.Parse(time.RFC3339Nano, aws.StringValue(job[jobFieldStarted].S))
+	if err != nil {
+		return nil, nil, wrapError("malformed start time", err)
+	}
+	if v, ok := job[jobFieldUpdated]; ok {
+		status.Updated, err = time.Parse(time.RFC3339Nano, aws.StringValue(v.S))
+		if err != nil {
+			return nil, nil, wrapError("malformed update time", err)
+		}
+	}
+	if v, ok := job[jobFieldFinished]; ok {
+		status.Finished, err = time.Parse(time.RFC3339Nano, aws.StringValue(v.S))
+		if err != nil {
+			return nil, nil, wrapError("malformed finish time", err)
+		}
+	}
+	if v, ok := job[jobFieldItems]; ok {
+		status.Items, err = strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+		if err != nil {
+			return nil, nil, wrapError("malformed number of items", err)
+		}
+	}
+	if v, ok := job[jobFieldCapacity]; ok {
+		status.ConsumedCapacity, err = strconv.ParseFloat(aws.StringValue(v.N), 64)
+		if err != nil {
+			return nil, nil, wrapError("malformed consumed capacity", err)
+		}
+	}
+	if v, ok := job[jobFieldCheckpoint]; ok {
+		status.Checkpoint, err = scanProgressFromAttributeValue(v)
+		if err != nil {
+			return nil, nil, wrapError("malformed checkpoint", err)
+		}
+	}
+	if v, ok := job[jobFieldError]; ok {
+		status.Err = errors.New(aws.StringValue(v.S))
+	}
+
+	params := &jobParams{}
+	if v, ok := job[jobFieldForce]; ok {
+		params.force = aws.BoolValue(v.BOOL)
+	}
+	if v, ok := job[jobFieldNoTrailingZeros]; ok {
+		params.noTrailingZeros = aws.BoolValue(v.BOOL)
+	}
+	if v, ok := job[jobFieldKeep]; ok {
+		params.keep = make([]string, 0, len(v.L))
+		for _, snapshot := range v.L {
+			params.keep = append(params.keep, aws.StringValue(snapshot.S))
+		}
+	}
+	if v, ok := job[jobFieldTenant]; ok {
+		params.tenant = aws.StringValue(v.S)
+	}
+	if v, ok := job[jobFieldSnapshotIDs]; ok {
+		params.snapshotIDs = make(map[string]string, len(v.M))
+		for snapshot, id := range v.M {
+			params.snapshotIDs[snapshot] = aws.StringValue(id.S)
+		}
+	}
+
+	return status, params, nil
+}
+
+// return the attribute value the progress of a scan is saved as
+func (p *ScanProgress) toAttributeValue() *dynamodb.AttributeValue {
+	lastKeys := make(map[string]*dynamodb.AttributeValue, len(p.LastKeys))
+	for segment, key := range p.LastKeys {
+		lastKeys[strconv.Itoa(segment)] = &dynamodb.AttributeValue{M: key}
+	}
+	done := make(map[string]*dynamodb.AttributeValue, len(p.Done))
+	for segment, ok := range p.Done {
+		done[strconv.Itoa(segment)] = &dynamodb.AttributeValue{BOOL: aws.Bool(ok)}
+	}
+
+	return &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		scanProgressSegments: {N: aws.String(strconv.Itoa(p.Segments))},
+		scanProgressLastKeys: {M: lastKeys},
+		scanProgressDone:     {M: done},
+	}}
+}
+
+// return the progress of a scan saved as av (see ScanProgress.toAttributeValue)
+func scanProgressFromAttributeValue(av *dynamodb.AttributeValue) (*ScanProgress, error) {
+	if av.M == nil || av.M[scanProgressSegments] == nil {
+		return nil, errors.New("missing number of segments")
+	}
+
+	segments, err := strconv.Atoi(aws.StringValue(av.M[scanProgressSegments].N))
+	if err != nil {
+		return nil, err
+	}
+	progress := newScanProgress(segments)
+	if v, ok := av.M[scanProgressLastKeys]; ok {
+		for k, key := range v.M {
+			segment, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, err
+			}
+			progress.LastKeys[segment] = key.M
+		}
+	}
+	if v, ok := av.M[scanProgressDone]; ok {
+		for k, done := range v.M {
+			segment, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, err
+			}
+			progress.Done[segment] = aws.BoolValue(done.BOOL)
+		}
+	}
+
+	return progress, nil
+}
@@ -0,0 +1,172 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestJobAttributeValue(t *testing.T) {
+	progress := newScanProgress(2)
+	progress.LastKeys[1] = map[string]*dynamodb.AttributeValue{"year": {N: aws.String("1999")}}
+	progress.Done[0] = true
+
+	status := &JobStatus{
+		ID:               "20171010T101010.000Z-0a0b0c0d",
+		Operation:        "CollectGarbage",
+		State:            JobFailed,
+		Started:          time.Date(2017, 10, 10, 10, 10, 10, 0, time.UTC),
+		Updated:          time.Date(2017, 10, 10, 10, 20, 10, 0, time.UTC),
+		Finished:         time.Date(2017, 10, 10, 10, 20, 11, 0, time.UTC),
+		Items:            42,
+		ConsumedCapacity: 42.5,
+		Checkpoint:       progress,
+		Err:              errors.New("throttled"),
+	}
+	params := &jobParams{
+		force:           true,
+		noTrailingZeros: true,
+		keep:            []string{"a", "b"},
+		tenant:          "acme-",
+		snapshotIDs:     map[string]string{"latest": "3", "current": ""},
+	}
+
+	av := jobAttributeValue(status, params)
+	if _, ok := av.M[jobFieldSnapshot]; ok {
+		t.Error("expected no empty snapshot, got", av.M[jobFieldSnapshot])
+	}
+	loaded, loadedParams, err := jobFromAttributeValue(status.ID, av)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !reflect.DeepEqual(loaded, status) {
+		t.Error("expected", status, "got", loaded)
+	}
+	if !reflect.DeepEqual(loadedParams, params) {
+		t.Error("expected", params, "got", loadedParams)
+	}
+
+	_, _, err = jobFromAttributeValue("nope", &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}})
+	if err == nil {
+		t.Error("expected an error for a malformed job")
+	}
+}
+
+func TestExpiredJobs(t *testing.T) {
+	now := time.Now()
+	jobs := []JobStatus{
+		{ID: "a", State: JobSucceeded, Finished: now.Add(-3 * time.Minute)},
+		{ID: "b", State: JobRunning},
+		{ID: "c", State: JobFailed, Finished: now.Add(-time.Minute)},
+		{ID: "d", State: JobPaused},
+		{ID: "e", State: JobCancelled, Finished: now.Add(-2 * time.Minute)},
+	}
+
+	cases := map[int][]string{
+		0: {"c", "e", "a"},
+		1: {"e", "a"},
+		2: {"a"},
+		3: nil,
+		4: nil,
+	}
+	for keep, expected := range cases {
+		expired := expiredJobs(jobs, keep)
+		if !reflect.DeepEqual(expired, expected) {
+			t.Error("keeping", keep, "expected", expected, "got", expired)
+		}
+	}
+}
+
+func TestLibrary_ResumeJob(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		library.persistJobs = true
+
+		library.Snapshot("1")
+		nItems := 30
+		putItems(library, schema, nItems, t)
+		library.Snapshot("2")
+
+		// a job left behind by a process that crashed, started when "1" was the latest snapshot
+		crashed := &JobStatus{
+			ID:        "crashed",
+			Operation: "DestroySnapshot",
+			Snapshot:  "latest",
+			State:     JobRunning,
+			Started:   time.Now().UTC(),
+		}
+		byName, _, err := library.SnapshotIDMap()
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		params := &jobParams{force: true, snapshotIDs: map[string]string{"latest": byName["1"]}}
+		err = library.saveJob(crashed.ID, jobAttributeValue(crashed, params))
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		jobs, err := library.InFlightJobs()
+		if err != nil || len(jobs) != 1 || jobs[0].ID != crashed.ID || jobs[0].State != JobRunning {
+			t.Error("expected the crashed job in flight, got", jobs, err)
+		}
+
+		if err := library.ResumeJob(crashed.ID); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		out, _, err := library.ScanAllVersions(&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))})
+		if err != nil || len(out.Items) != 0 {
+			t.Error("expected every item destroyed, got", out, err)
+		}
+		byName, _, err = library.SnapshotIDMap()
+		if _, ok := byName["1"]; err != nil || ok || byName["2"] == "" {
+			t.Error("expected only the snapshot that was the latest destroyed, got", byName, err)
+		}
+		// succeeded, nothing left to resume
+		jobs, err = library.InFlightJobs()
+		if err != nil || len(jobs) != 0 {
+			t.Error("expected no jobs in flight, got", jobs, err)
+		}
+		jobs, err = library.ListJobs()
+		if err != nil || len(jobs) != 1 || jobs[0].State != JobSucceeded || jobs[0].Items != int64(nItems) ||
+			jobs[0].Finished.IsZero() {
+			t.Error("expected the job to be listed as succeeded, got", jobs, err)
+		}
+		if err := library.ResumeJob(crashed.ID); err == nil {
+			t.Error("expected an error resuming a job that is over")
+		}
+
+		// failures are saved
+		if err := library.DestroySnapshot("does-not-exist"); err == nil {
+			t.Error("expected an error destroying a snapshot that does not exist")
+		}
+		jobs, err = library.InFlightJobs()
+		if err != nil || len(jobs) != 1 || jobs[0].State != JobFailed || jobs[0].Err == nil {
+			t.Error("expected the failed job in flight, got", jobs, err)
+		}
+
+		teardown(schema, t)
+	}
+}
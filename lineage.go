@@ -0,0 +1,155 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// field of a snapshot's info that holds its lineage
+const snapshotInfoLineage = "lineage"
+
+// Lineage records where the data of a snapshot came from, e.g., when it was cloned from some other table.
+type Lineage struct {
+	SourceTable    string
+	SourceRegion   string
+	SourceSnapshot string
+	// when the data was copied
+	Timestamp time.Time
+	// number of items copied
+	Items int64
+	// name and version of the tool that copied the data
+	ToolVersion string
+}
+
+func (l *Lineage) toAttributeValue() *dynamodb.AttributeValue {
+	m := map[string]*dynamodb.AttributeValue{
+		"timestamp": {S: aws.String(l.Timestamp.UTC().Format(time.RFC3339))},
+		"items":     {N: aws.String(strconv.FormatInt(l.Items, 10))},
+	}
+
+	// DynamoDB does not support empty strings
+	optional := map[string]string{
+		"source_table":    l.SourceTable,
+		"source_region":   l.SourceRegion,
+		"source_snapshot": l.SourceSnapshot,
+		"tool_version":    l.ToolVersion,
+	}
+	for k, v := range optional {
+		if v != "" {
+			m[k] = &dynamodb.AttributeValue{S: aws.String(v)}
+		}
+	}
+
+	return &dynamodb.AttributeValue{M: m}
+}
+
+func lineageFromAttributeValue(av *dynamodb.AttributeValue) (*Lineage, error) {
+	// optional fields are simply missing
+	field := func(name string) string {
+		v, ok := av.M[name]
+		if !ok {
+			return ""
+		}
+		if v.N != nil {
+			return *v.N
+		}
+		return aws.StringValue(v.S)
+	}
+
+	l := &Lineage{
+		SourceTable:    field("source_table"),
+		SourceRegion:   field("source_region"),
+		SourceSnapshot: field("source_snapshot"),
+		ToolVersion:    field("tool_version"),
+	}
+
+	var err error
+	l.Timestamp, err = time.Parse(time.RFC3339, field("timestamp"))
+	if err != nil {
+		return nil, wrapError("invalid lineage timestamp", err)
+	}
+
+	l.Items, err = strconv.ParseInt(field("items"), 10, 64)
+	if err != nil {
+		return nil, wrapError("invalid lineage item count", err)
+	}
+
+	return l, nil
+}
+
+// SetSnapshotLineage records where the data of snapshot came from in the table's metadata, replacing any lineage
+// recorded before.
+//
+// Cost: 1RU + 1WU
+func (c *Library) SetSnapshotLineage(snapshot string, lineage *Lineage) error {
+	return c.SetSnapshotLineageWithContext(aws.BackgroundContext(), snapshot, lineage)
+}
+
+// SetSnapshotLineageWithContext is the same as SetSnapshotLineage with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) SetSnapshotLineageWithContext(ctx aws.Context, snapshot string, lineage *Lineage) error {
+	defer c.invalidateMeta()
+	return c.retryOnConflict(func() error {
+		meta, err := c.fetchMeta(ctx, true)
+		if err != nil {
+			return err
+		}
+
+		err = meta.setSnapshotInfo(snapshot, snapshotInfoLineage, lineage.toAttributeValue())
+		if isConditionalCheckFailure(err) {
+			return c.concurrentMetadataChange(ctx, "SetSnapshotLineage", meta)
+		}
+
+		return err
+	})
+}
+
+// SnapshotLineage returns the lineage recorded for snapshot, or nil if there is none.
+//
+// Cost: 1RU
+func (c *Library) SnapshotLineage(snapshot string) (*Lineage, error) {
+	return c.SnapshotLineageWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// SnapshotLineageWithContext is the same as SnapshotLineage with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) SnapshotLineageWithContext(ctx aws.Context, snapshot string) (*Lineage, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := meta.getSnapshotID(snapshot); err != nil {
+		return nil, err
+	}
+
+	av := meta.getSnapshotInfo(snapshot, snapshotInfoLineage)
+	if av == nil {
+		return nil, nil
+	}
+
+	return lineageFromAttributeValue(av)
+}
@@ -0,0 +1,79 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLibrary_SnapshotLineage(t *testing.T) {
+	lineage := &Lineage{
+		SourceTable:  "movies",
+		SourceRegion: "eu-west-1",
+		Timestamp:    time.Date(2017, 10, 1, 12, 0, 0, 0, time.UTC),
+		Items:        42,
+		ToolVersion:  "ddblibrarian-import dev",
+	}
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		err := library.SetSnapshotLineage("nope", lineage)
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+
+		for _, s := range []string{"snap1", "snap2"} {
+			err = library.Snapshot(s)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		// nothing recorded yet
+		l, err := library.SnapshotLineage("snap1")
+		if err != nil || l != nil {
+			t.Error("expected no lineage, got", l, err)
+		}
+
+		// the first one creates the map of snapshot info, the second one adds to it
+		for _, s := range []string{"snap1", "snap2"} {
+			err = library.SetSnapshotLineage(s, lineage)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+
+		for _, s := range []string{"snap1", "snap2"} {
+			l, err = library.SnapshotLineage(s)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if !reflect.DeepEqual(l, lineage) {
+				t.Error("expected", lineage, "got", l)
+			}
+		}
+
+		teardown(schema, t)
+	}
+}
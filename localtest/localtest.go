@@ -0,0 +1,149 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+// Package localtest spreads tests that run against DynamoDB Local over a pool of instances, e.g., the ones a CI job
+// starts: each test is assigned one of them by name, and runs in parallel with the tests assigned to the others, while
+// those assigned to the same one, which may well create the same tables, take turns.
+//
+// The pool can also be split across processes that run at the same time, each one only running the tests assigned to
+// its own instance.
+package localtest
+
+import (
+	"errors"
+	"hash/fnv"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+const (
+	// DefaultEndpoint is where DynamoDB Local listens unless configured otherwise.
+	DefaultEndpoint = "http://localhost:8000"
+	// EndpointsVariable is the environment variable that lists the endpoints of the pool (see FromEnv).
+	EndpointsVariable = "DDBLIBRARIAN_ENDPOINTS"
+	// ShardVariable is the environment variable that selects the instance of the pool to run tests on (see FromEnv).
+	ShardVariable = "DDBLIBRARIAN_SHARD"
+)
+
+// Pool is a set of DynamoDB Local instances to run tests against.
+type Pool struct {
+	instances []*instance
+	// position of the only instance tests are run on, or -1 to run them on all of them
+	shard int
+	// the instance each test running holds, by name
+	held sync.Map
+}
+
+// an instance of DynamoDB Local, which a single test uses at a time
+type instance struct {
+	endpoint string
+	session  *session.Session
+	mutex    sync.Mutex
+}
+
+// NewPool returns a pool of the instances at endpoints, reached with sessions in region. If shard is not negative,
+// it is the (0-based) position of the only instance tests are run on: the tests assigned to the others are skipped.
+func NewPool(endpoints []string, region string, shard int) (*Pool, error) {
+	if len(endpoints) == 0 {
+		return nil, errors.New("no endpoints")
+	}
+	if shard >= len(endpoints) {
+		return nil, errors.New("no endpoint at position " + strconv.Itoa(shard))
+	}
+
+	p := &Pool{instances: make([]*instance, 0, len(endpoints)), shard: shard}
+	for _, endpoint := range endpoints {
+		endpoint = strings.TrimSpace(endpoint)
+		s, err := session.NewSession(&aws.Config{
+			Region:     aws.String(region),
+			Endpoint:   aws.String(endpoint),
+			MaxRetries: aws.Int(1),
+		})
+		if err != nil {
+			return nil, err
+		}
+		p.instances = append(p.instances, &instance{endpoint: endpoint, session: s})
+	}
+
+	return p, nil
+}
+
+// FromEnv returns the pool of the instances DDBLIBRARIAN_ENDPOINTS lists, separated by commas, or of DefaultEndpoint
+// alone, reached with sessions in region. DDBLIBRARIAN_SHARD, if set, is the position of the only instance tests are
+// run on (see NewPool).
+func FromEnv(region string) (*Pool, error) {
+	endpoints := []string{DefaultEndpoint}
+	if list := os.Getenv(EndpointsVariable); list != "" {
+		endpoints = strings.Split(list, ",")
+	}
+	shard := -1
+	if value := os.Getenv(ShardVariable); value != "" {
+		var err error
+		shard, err = strconv.Atoi(value)
+		if err != nil || shard < 0 {
+			return nil, errors.New("invalid " + ShardVariable + ": " + value)
+		}
+	}
+
+	return NewPool(endpoints, region, shard)
+}
+
+// Session returns a session for the instance t is assigned to, by name, once no other test is using it. t is marked
+// as a parallel test (see testing.T.Parallel) and holds on to the instance until it is done; further calls from t
+// return the same session right away. If the pool only runs tests on another instance, t is skipped.
+func (p *Pool) Session(t *testing.T) *session.Session {
+	if held, ok := p.held.Load(t.Name()); ok {
+		return held.(*instance).session
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(t.Name()))
+	i := int(h.Sum32() % uint32(len(p.instances)))
+	if p.shard >= 0 && p.shard != i {
+		t.Skip("assigned to endpoint", i)
+	}
+
+	t.Parallel()
+	instance := p.instances[i]
+	instance.mutex.Lock()
+	p.held.Store(t.Name(), instance)
+	t.Cleanup(func() {
+		p.held.Delete(t.Name())
+		instance.mutex.Unlock()
+	})
+
+	return instance.session
+}
+
+// Endpoint returns the endpoint of the instance the pool runs tests on, if it only runs them on one, or of the first
+// one otherwise, for code that cannot be assigned an instance by name, e.g., examples.
+func (p *Pool) Endpoint() string {
+	if p.shard >= 0 {
+		return p.instances[p.shard].endpoint
+	}
+
+	return p.instances[0].endpoint
+}
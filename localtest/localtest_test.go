@@ -0,0 +1,85 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package localtest
+
+import (
+	"testing"
+)
+
+func TestNewPool(t *testing.T) {
+	if _, err := NewPool(nil, "local", -1); err == nil {
+		t.Error("expected an error without endpoints")
+	}
+	if _, err := NewPool([]string{DefaultEndpoint}, "local", 1); err == nil {
+		t.Error("expected an error for a shard with no endpoint")
+	}
+
+	p, err := NewPool([]string{"http://ddb-0:8000", " http://ddb-1:8000"}, "local", -1)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if p.Endpoint() != "http://ddb-0:8000" {
+		t.Error("expected the first endpoint, got", p.Endpoint())
+	}
+	p, err = NewPool([]string{"http://ddb-0:8000", " http://ddb-1:8000"}, "local", 1)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if p.Endpoint() != "http://ddb-1:8000" {
+		t.Error("expected the endpoint of the shard, got", p.Endpoint())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	p, err := FromEnv("local")
+	if err != nil || p.Endpoint() != DefaultEndpoint {
+		t.Error("expected the default endpoint, got", p, err)
+	}
+
+	t.Setenv(EndpointsVariable, "http://ddb-0:8000,http://ddb-1:8000")
+	t.Setenv(ShardVariable, "1")
+	p, err = FromEnv("local")
+	if err != nil || p.Endpoint() != "http://ddb-1:8000" {
+		t.Error("expected the endpoint of the shard, got", p, err)
+	}
+
+	t.Setenv(ShardVariable, "first")
+	if _, err := FromEnv("local"); err == nil {
+		t.Error("expected an error for an invalid shard")
+	}
+}
+
+func TestPool_Session(t *testing.T) {
+	p, err := NewPool([]string{"http://ddb-0:8000", "http://ddb-1:8000"}, "local", -1)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+
+	// the test holds on to its instance until it is done
+	s := p.Session(t)
+	if p.Session(t) != s {
+		t.Error("expected the same session on every call")
+	}
+	held, ok := p.held.Load(t.Name())
+	if !ok || held.(*instance).session != s {
+		t.Error("expected the instance to be held")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// field of a snapshot's info that tells whether it is locked
+const snapshotInfoLocked = "locked"
+
+// LockSnapshot makes snapshot read-only, e.g., to keep a golden baseline from being changed by accident: writes that
+// would change it, be it because it is the current snapshot after a rollback to it, or because they name it
+// explicitly, fail with a SnapshotLockedError; so does PurgeItem, if the snapshot holds a copy of the item. Reads,
+// rollbacks to it, destroying it, and PurgeTenant are not affected, and neither are BackfillSnapshotIndex and
+// MigrateKeyEncoding, which change how the items are stored, not what the snapshot holds.
+//
+// Clients that cache the table's metadata (see WithMetadataCache) learn about the lock the next time they load it.
+//
+// Cost: 1RU + 1WU
+func (c *Library) LockSnapshot(snapshot string) error {
+	return c.LockSnapshotWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// LockSnapshotWithContext is the same as LockSnapshot with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) LockSnapshotWithContext(ctx aws.Context, snapshot string) error {
+	return c.setSnapshotLock(ctx, snapshot, true)
+}
+
+// UnlockSnapshot allows snapshot to be written to again (see LockSnapshot).
+//
+// Cost: 1RU + 1WU
+func (c *Library) UnlockSnapshot(snapshot string) error {
+	return c.UnlockSnapshotWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// UnlockSnapshotWithContext is the same as UnlockSnapshot with the addition of the ability to pass a context, which
+// is passed on to every request made to the table.
+func (c *Library) UnlockSnapshotWithContext(ctx aws.Context, snapshot string) error {
+	return c.setSnapshotLock(ctx, snapshot, false)
+}
+
+func (c *Library) setSnapshotLock(ctx aws.Context, snapshot string, locked bool) error {
+	defer c.invalidateMeta()
+	return c.retryOnConflict(func() error {
+		meta, err := c.fetchMeta(ctx, true)
+		if err != nil {
+			return err
+		}
+
+		err = meta.setSnapshotInfo(snapshot, snapshotInfoLocked, &dynamodb.AttributeValue{BOOL: aws.Bool(locked)})
+		if isConditionalCheckFailure(err) {
+			return c.concurrentMetadataChange(ctx, "LockSnapshot", meta)
+		}
+
+		return err
+	})
+}
+
+// return true if the snapshot with the given name is locked (see LockSnapshot)
+func (s *config) isSnapshotLocked(snapshot string) bool {
+	av := s.getSnapshotInfo(snapshot, snapshotInfoLocked)
+	return av != nil && aws.BoolValue(av.BOOL)
+}
+
+// return an error if operation cannot write to the snapshot with the given ID because it is locked; the data written
+// before any snapshots were taken cannot be locked
+func (s *config) checkUnlocked(operation string, id string) error {
+	name, err := s.getSnapshotName(id)
+	if err != nil {
+		return err
+	}
+	if s.isSnapshotLocked(name) {
+		return &SnapshotLockedError{Operation: operation, Snapshot: name}
+	}
+
+	return nil
+}
+
+// getWritableSnapshotID is the same as getSnapshotID, for a snapshot operation is about to write to, which must not
+// be locked
+func (s *config) getWritableSnapshotID(operation string, snapshot string) (string, error) {
+	id, err := s.getSnapshotID(snapshot)
+	if err != nil {
+		return "", err
+	}
+
+	return id, s.checkUnlocked(operation, id)
+}
+
+// return an error if the item with the given key, with no snapshot, exists in the snapshot with the given ID and that
+// snapshot is locked, i.e., if operation would change it by deleting the item
+func (c *Library) checkDeleteUnlocked(
+	ctx aws.Context,
+	meta *config,
+	operation string,
+	key map[string]*dynamodb.AttributeValue,
+	id string,
+) error {
+	err := meta.checkUnlocked(operation, id)
+	if err == nil {
+		return nil
+	}
+
+	input := &dynamodb.GetItemInput{TableName: aws.String(c.tableName), Key: key, ConsistentRead: aws.Bool(true)}
+	output, getErr := c.getItemWithSnapshotID(ctx, input, id)
+	if getErr != nil {
+		return getErr
+	}
+	if output.Item == nil {
+		return nil
+	}
+
+	return err
+}
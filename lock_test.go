@@ -0,0 +1,132 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_lockedSnapshots(t *testing.T) {
+	// golden is locked and current after a rollback to it; nothing is ever written to the fake
+	storage := &metaRowStorage{item: map[string]*dynamodb.AttributeValue{
+		ddbSnapshotsField: {M: map[string]*dynamodb.AttributeValue{
+			"golden": {S: aws.String("1")},
+			"later":  {S: aws.String("2")},
+		}},
+		ddbOrderedIDs:     {L: []*dynamodb.AttributeValue{{S: aws.String("2")}, {S: aws.String("1")}}},
+		ddbLatestIDField:  {S: aws.String("2")},
+		ddbCurrentIDField: {S: aws.String("1")},
+		ddbSnapshotInfoField: {M: map[string]*dynamodb.AttributeValue{
+			"golden": {M: map[string]*dynamodb.AttributeValue{snapshotInfoLocked: {BOOL: aws.Bool(true)}}},
+		}},
+	}}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+	item := map[string]*dynamodb.AttributeValue{"year": {N: aws.String("2017")}}
+
+	_, err := library.PutItem(&dynamodb.PutItemInput{TableName: aws.String("movies"), Item: item})
+	if !errors.Is(err, ErrSnapshotLocked) {
+		t.Error("expected writes to the current snapshot to be refused, got", err)
+	}
+	var locked *SnapshotLockedError
+	if !errors.As(err, &locked) || locked.Snapshot != "golden" || locked.Operation != "PutItem" {
+		t.Error("expected PutItem to be refused for golden, got", err)
+	}
+	_, err = library.DeleteItem(&dynamodb.DeleteItemInput{TableName: aws.String("movies"), Key: item})
+	if !errors.Is(err, ErrSnapshotLocked) {
+		t.Error("expected deletes from the current snapshot to be refused, got", err)
+	}
+	err = library.PutItemsToSnapshot([]map[string]*dynamodb.AttributeValue{item}, "golden")
+	if !errors.Is(err, ErrSnapshotLocked) {
+		t.Error("expected writes naming the snapshot to be refused, got", err)
+	}
+	_, err = library.PurgeItem(item)
+	if !errors.Is(err, ErrSnapshotLocked) {
+		t.Error("expected purging a copy from the snapshot to be refused, got", err)
+	}
+
+	info, err := library.DescribeSnapshot("golden")
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !info.Locked || !info.Current {
+		t.Error("expected golden to be locked and current, got", info)
+	}
+	info, err = library.DescribeSnapshot("later")
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if info.Locked {
+		t.Error("expected later not to be locked")
+	}
+}
+
+// a Storage whose metadata row changes between reads, as if another client changed it
+type racingMetaStorage struct {
+	metaRowStorage
+	updates []*dynamodb.UpdateItemInput
+}
+
+func (s *racingMetaStorage) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	s.updates = append(s.updates, input)
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func TestLibrary_setSnapshotLock(t *testing.T) {
+	storage := &racingMetaStorage{metaRowStorage: metaRowStorage{item: map[string]*dynamodb.AttributeValue{
+		ddbSnapshotsField: {M: map[string]*dynamodb.AttributeValue{"golden": {S: aws.String("1")}}},
+		ddbOrderedIDs:     {L: []*dynamodb.AttributeValue{{S: aws.String("1")}}},
+		ddbLatestIDField:  {S: aws.String("1")},
+		ddbCurrentIDField: {S: aws.String("1")},
+		ddbSnapshotInfoField: {M: map[string]*dynamodb.AttributeValue{
+			"golden": {M: map[string]*dynamodb.AttributeValue{snapshotInfoDescription: {S: aws.String("v1")}}},
+		}},
+	}}}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+
+	// only the lock is set, so the description someone else may have changed meanwhile is left as it is
+	if err := library.LockSnapshot("golden"); err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	update := storage.updates[0]
+	if aws.StringValue(update.UpdateExpression) != "SET #info.#snapshot.#field=:value" ||
+		aws.StringValue(update.ExpressionAttributeNames["#field"]) != snapshotInfoLocked ||
+		!strings.Contains(aws.StringValue(update.ConditionExpression), "attribute_not_exists(#info.#snapshot.#field)") {
+		t.Error("expected the lock alone to be set, if it was not yet, got", update)
+	}
+
+	// and only if it is still what was read
+	golden := storage.item[ddbSnapshotInfoField].M["golden"]
+	golden.M[snapshotInfoLocked] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+	if err := library.UnlockSnapshot("golden"); err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	update = storage.updates[1]
+	if aws.StringValue(update.ConditionExpression) != "#info.#snapshot.#field = :previous" ||
+		!aws.BoolValue(update.ExpressionAttributeValues[":previous"].BOOL) ||
+		aws.BoolValue(update.ExpressionAttributeValues[":value"].BOOL) {
+		t.Error("expected the lock to be cleared only if it is still set, got", update)
+	}
+}
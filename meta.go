@@ -25,6 +25,8 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -47,8 +49,31 @@ const (
 	// snapshot to read/write from/to -- usually the most recent one
 	// but will change after a rollback
 	ddbCurrentIDField = "current_snapshot"
-	// number of digits to use for snapshot IDs
-	snapshotIDLength = 2
+	// how snapshot IDs are added to partition keys (see encoding.go)
+	ddbKeyEncodingField = "key_encoding"
+	// encoding the table is being migrated to, while MigrateKeyEncoding runs
+	ddbKeyEncodingMigrationField = "key_encoding_migration"
+	// set once BackfillSnapshotIndex has tagged every item, after which reads may use the snapshot index
+	ddbSnapshotIndexBackfilledField = "snapshot_index_backfilled"
+	// map snapshot_name -> map of extra information about the snapshot (e.g., lineage)
+	ddbSnapshotInfoField = "snapshot_info"
+	// map client_id -> snapshot_id clients with that ID are pinned to (see PinClient)
+	ddbBrowsePinsField = "browse_pins"
+	// rollback to run at some point in the future (see ScheduleRollback)
+	ddbScheduledRollbackField = "scheduled_rollback"
+	// rules every client enforces on snapshots (see SetSnapshotPolicy)
+	ddbSnapshotPolicyField = "snapshot_policy"
+	// maximum number of digits of snapshot IDs, if not the default (see SetSnapshotIDLength)
+	ddbSnapshotIDLengthField = "snapshot_id_length"
+	// how snapshot IDs are added to string partition keys (see WithKeyCodec)
+	ddbKeyCodecField = "key_codec"
+	// set of the IDs of destroyed snapshots whose items may still be on the table, which are not reused until they are
+	// all deleted (see DestroySnapshot)
+	ddbDestroyingIDsField = "destroying_ids"
+	// metadata table the metadata was moved to, the only field of the row left in its place (see MoveMetadataToTable)
+	ddbMetadataTableField = "metadata_table"
+	// maximum number of digits of snapshot IDs of tables that do not record any other
+	defaultSnapshotIDLength = 2
 )
 
 // just to make it nicer for other packages to call this one
@@ -59,8 +84,29 @@ const (
 	snapshotCurrent = "current"
 )
 
+// Baseline refers to the data written before any snapshots were taken, wherever a snapshot name is expected. Unlike
+// an empty snapshot, which some operations (e.g., ScanFromSnapshot) take to mean every snapshot, it always refers to
+// that data alone.
+const Baseline = "@baseline"
+
+// internal ID the scan operations use to read the items of every snapshot, which is never a valid snapshot ID
+const allSnapshotsID = "*"
+
+// fields of a scheduled rollback: the snapshot to roll back to and when
+const (
+	scheduledRollbackSnapshot = "snapshot"
+	scheduledRollbackAt       = "at"
+)
+
+// field of a snapshot's info that holds the ID of the snapshot it branches off, if it was not taken on top of the
+// latest one
+const snapshotInfoParent = "parent"
+
+// field of a snapshot's info that holds the free-text description it was taken with, if any
+const snapshotInfoDescription = "description"
+
 type config struct {
-	svc                      *dynamodb.DynamoDB
+	svc                      Storage
 	tableName                string
 	partitionKey             string
 	partitionKeyType         string
@@ -71,18 +117,36 @@ type config struct {
 	chronologicalSnapshotIDs []string
 	currentSnapshotID        string
 	latestSnapshotID         string
+	keyEncoding              string
+	keyEncodingMigration     string
+	snapshotIndexBackfilled  bool
+	destroyingIDs            map[string]bool
+	snapshotIDLength         int
+	keyCodec                 KeyCodec
+	hasKeyCodec              bool
+	snapshotInfo             map[string]*dynamodb.AttributeValue
+	hasSnapshotInfo          bool
+	browsePins               map[string]*dynamodb.AttributeValue
+	hasBrowsePins            bool
+	scheduledRollback        *dynamodb.AttributeValue
+	snapshotPolicy           *dynamodb.AttributeValue
+	consistentRead           bool
+	// the table has metadata, i.e., snapshots have been taken on it at some point
+	exists bool
 }
 
 // newMeta creates a new instance for querying and managing snapshot-related metadata.
 // It caches data locally. If consistency is important, create one instance per operation instead of trying to reuse
-// it for long periods of time.
+// it for long periods of time. The metadata is read with a strongly consistent read iff consistentRead is true.
 func newMeta(
-	svc *dynamodb.DynamoDB,
+	svc Storage,
 	tableName string,
+	metaPrimaryKey map[string]*dynamodb.AttributeValue,
 	partitionKey string,
 	partitionKeyType string,
 	rangeKey string,
 	rangeKeyType string,
+	consistentRead bool,
 ) (*config, error) {
 	data := &config{
 		svc:                      svc,
@@ -91,27 +155,47 @@ func newMeta(
 		partitionKeyType:         partitionKeyType,
 		rangeKey:                 rangeKey,
 		rangeKeyType:             rangeKeyType,
-		metaPrimaryKey:           getMetaPrimaryKey(partitionKey, partitionKeyType, rangeKey, rangeKeyType),
+		metaPrimaryKey:           metaPrimaryKey,
 		snapshots:                make(map[string]*dynamodb.AttributeValue, 0),
 		chronologicalSnapshotIDs: make([]string, 0),
+		keyEncoding:              keyEncodingLegacy,
+		snapshotIDLength:         defaultSnapshotIDLength,
+		snapshotInfo:             make(map[string]*dynamodb.AttributeValue, 0),
+		browsePins:               make(map[string]*dynamodb.AttributeValue, 0),
+		consistentRead:           consistentRead,
 	}
 
 	// store local copies of the snapshot_name -> snapshot_id map and the chronologically sorted list of snapshot IDs
 	err := data.cacheAllMetadata()
 	if err != nil {
-		return nil, errors.New("failed to cache metadata: " + err.Error())
+		return nil, wrapError("failed to cache metadata", err)
 	}
 
 	return data, nil
 }
 
-func (s *config) snapshot(snapshot string) (string, error) {
+// snapshot records a new snapshot, taken at created, and makes it the current one. Unless allowBranch is true, the
+// current snapshot must be the latest one; otherwise, the new snapshot branches off the current one, which is
+// recorded as its parent. With keepCurrent, the current snapshot is left as it was, as if rolled back to in the same
+// update, and the new snapshot is taken whatever the current one is.
+// take a new snapshot, recording details (e.g., its description) along with when it was taken
+func (s *config) snapshot(
+	snapshot string,
+	created time.Time,
+	details map[string]*dynamodb.AttributeValue,
+	allowBranch bool,
+	keepCurrent bool,
+) (string, error) {
 	_, ok := s.snapshots[snapshot]
 	if ok {
-		return "", errors.New("snapshot already exists: " + snapshot)
+		return "", &SnapshotExistsError{Snapshot: snapshot}
+	}
+	if snapshot == Baseline {
+		return "", errors.New("reserved snapshot name: " + snapshot)
 	}
 
-	if s.currentSnapshotID != s.latestSnapshotID {
+	branch := s.currentSnapshotID != s.latestSnapshotID
+	if branch && !allowBranch && !keepCurrent {
 		return "", errors.New(fmt.Sprintf(
 			"current snapshot (%s) does match latest (%s)",
 			s.currentSnapshotID,
@@ -120,8 +204,11 @@ func (s *config) snapshot(snapshot string) (string, error) {
 	}
 
 	newID, err := s.getNextAvailableID()
+	if _, ok := err.(*SnapshotLimitError); ok {
+		return "", err
+	}
 	if err != nil {
-		return "", errors.New("failed to get a snapshot ID:" + err.Error())
+		return "", wrapError("failed to get a snapshot ID", err)
 	}
 
 	// update the snapshot_name --> snapshotID map with the new entry
@@ -156,6 +243,10 @@ func (s *config) snapshot(snapshot string) (string, error) {
 			`SET #snapshots=:snapshots, #latestID=:latestID, #currentID=:latestID, #orderedIDs=:orderedIDs`,
 		),
 	}
+	// the current snapshot is kept by leaving it alone, which the condition below makes sure of
+	if keepCurrent {
+		item.UpdateExpression = aws.String(`SET #snapshots=:snapshots, #latestID=:latestID, #orderedIDs=:orderedIDs`)
+	}
 
 	// use a conditional update to avoid race conditions update the metadata iff the the latest snapshotID has not
 	// changed, i.e., there were no other snapshots were taken concurrently
@@ -164,28 +255,108 @@ func (s *config) snapshot(snapshot string) (string, error) {
 			S: aws.String(s.latestSnapshotID)}
 		item.ConditionExpression = aws.String("#latestID=:previousLatestID")
 	} else {
-		item.ConditionExpression = aws.String("attribute_not_exists(#latestID)")
+		// nor was the metadata moved to a table of its own meanwhile (see MoveMetadataToTable)
+		item.ExpressionAttributeNames["#metadataTable"] = aws.String(ddbMetadataTableField)
+		item.ConditionExpression = aws.String(
+			"attribute_not_exists(#latestID) AND attribute_not_exists(#metadataTable)",
+		)
+	}
+
+	// a branch also depends on the current snapshot not changing concurrently (e.g., another rollback), and so does
+	// keeping it
+	if branch || keepCurrent {
+		if s.currentSnapshotID != "" {
+			item.ExpressionAttributeValues[":previousCurrentID"] = &dynamodb.AttributeValue{
+				S: aws.String(s.currentSnapshotID)}
+			*item.ConditionExpression += " AND #currentID=:previousCurrentID"
+		} else {
+			*item.ConditionExpression += " AND attribute_not_exists(#currentID)"
+		}
+	}
+
+	// record when the snapshot was taken (and what it branches off) in the same update; a nested attribute can only
+	// be set if its parent exists
+	info := map[string]*dynamodb.AttributeValue{snapshotInfoCreated: timeToAttributeValue(created)}
+	if branch {
+		info[snapshotInfoParent] = parentAttributeValue(s.currentSnapshotID)
+	}
+	for k, v := range details {
+		info[k] = v
+	}
+	item.ExpressionAttributeNames["#info"] = aws.String(ddbSnapshotInfoField)
+	if s.hasSnapshotInfo {
+		item.ExpressionAttributeNames["#snapshot"] = aws.String(snapshot)
+		item.ExpressionAttributeValues[":info"] = &dynamodb.AttributeValue{M: info}
+		*item.UpdateExpression += ", #info.#snapshot=:info"
+		*item.ConditionExpression += " AND attribute_exists(#info)"
+	} else {
+		item.ExpressionAttributeValues[":info"] = &dynamodb.AttributeValue{
+			M: map[string]*dynamodb.AttributeValue{snapshot: {M: info}},
+		}
+		*item.UpdateExpression += ", #info=:info"
+		*item.ConditionExpression += " AND attribute_not_exists(#info)"
+	}
+
+	// numeric partition keys are encoded in a way that keeps their order, and the range each snapshot takes, from the
+	// start: the encoding is recorded along with the first snapshot, before any keys include a snapshot ID
+	encoding := s.keyEncoding
+	if s.partitionKeyType == "N" && s.latestSnapshotID == "" && s.keyEncoding == keyEncodingLegacy {
+		encoding = keyEncodingPadded
+		item.ExpressionAttributeNames["#encoding"] = aws.String(ddbKeyEncodingField)
+		item.ExpressionAttributeValues[":encoding"] = &dynamodb.AttributeValue{S: aws.String(encoding)}
+		*item.UpdateExpression += ", #encoding=:encoding"
+	}
+	// so is the key codec of string partition keys, so that clients configured with another one fail instead of
+	// misreading the keys (see Library.checkKeyCodec)
+	if s.partitionKeyType == "S" && !s.hasKeyCodec {
+		item.ExpressionAttributeNames["#codec"] = aws.String(ddbKeyCodecField)
+		item.ExpressionAttributeValues[":codec"] = s.keyCodec.toAttributeValue()
+		*item.UpdateExpression += ", #codec=:codec"
 	}
 
 	_, err = s.svc.UpdateItem(item)
-	return newID, err
+	if err != nil {
+		return "", err
+	}
+
+	s.keyEncoding = encoding
+	s.hasKeyCodec = s.hasKeyCodec || s.partitionKeyType == "S"
+	s.snapshotInfo[snapshot] = &dynamodb.AttributeValue{M: info}
+	s.hasSnapshotInfo = true
+
+	return newID, nil
 }
 
 func (s *config) rollback(snapshot string) (string, error) {
+	item, id, err := s.rollbackUpdate(snapshot)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.svc.UpdateItem(item)
+
+	return id, err
+}
+
+// return the update that makes snapshot the current one, and its ID
+func (s *config) rollbackUpdate(snapshot string) (*dynamodb.UpdateItemInput, string, error) {
 	var item *dynamodb.UpdateItemInput
 	var id string
 	var err error
 
+	if snapshot == Baseline {
+		snapshot = ""
+	}
 	_, ok := s.snapshots[snapshot]
 	if !ok && snapshot != "" {
-		return "", errors.New(fmt.Sprintf("snapshot '%s' does not exist", snapshot))
+		return nil, "", &SnapshotNotFoundError{Snapshot: snapshot}
 	}
 
 	// DynamoDB does not support empty strings so rolling back to "" == before any snapshots => remove the key
 	if snapshot != "" {
 		id, err = s.getSnapshotID(snapshot)
 		if err != nil {
-			return "", err
+			return nil, "", err
 		}
 
 		item = &dynamodb.UpdateItemInput{
@@ -218,9 +389,359 @@ func (s *config) rollback(snapshot string) (string, error) {
 		item.ConditionExpression = aws.String("attribute_not_exists(#currentID)")
 	}
 
+	return item, id, nil
+}
+
+// getScheduledRollback returns the snapshot to roll back to, and when, if a rollback was scheduled
+func (s *config) getScheduledRollback() (string, time.Time, bool, error) {
+	if s.scheduledRollback == nil {
+		return "", time.Time{}, false, nil
+	}
+
+	at, err := timeFromAttributeValue(s.scheduledRollback.M[scheduledRollbackAt])
+	if err != nil {
+		return "", time.Time{}, false, err
+	}
+	// DynamoDB does not support empty strings, the snapshot is not set when rolling back to before any snapshots
+	snapshot := aws.StringValue(s.scheduledRollback.M[scheduledRollbackSnapshot].S)
+
+	return snapshot, at, true, nil
+}
+
+// setScheduledRollback records a rollback to snapshot, to run at the given time, replacing any other one
+func (s *config) setScheduledRollback(snapshot string, at time.Time) error {
+	if snapshot == Baseline {
+		snapshot = ""
+	}
+	_, ok := s.snapshots[snapshot]
+	if !ok && snapshot != "" {
+		return &SnapshotNotFoundError{Snapshot: snapshot}
+	}
+
+	scheduled := &dynamodb.AttributeValue{
+		M: map[string]*dynamodb.AttributeValue{scheduledRollbackAt: timeToAttributeValue(at)},
+	}
+	if snapshot != "" {
+		scheduled.M[scheduledRollbackSnapshot] = &dynamodb.AttributeValue{S: aws.String(snapshot)}
+	}
+
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       s.metaPrimaryKey,
+		ExpressionAttributeNames:  map[string]*string{"#scheduled": aws.String(ddbScheduledRollbackField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":scheduled": scheduled},
+		UpdateExpression:          aws.String("SET #scheduled=:scheduled"),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.scheduledRollback = scheduled
+	return nil
+}
+
+// removeScheduledRollback drops the scheduled rollback, if any
+func (s *config) removeScheduledRollback() error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.tableName),
+		Key:                      s.metaPrimaryKey,
+		ExpressionAttributeNames: map[string]*string{"#scheduled": aws.String(ddbScheduledRollbackField)},
+		UpdateExpression:         aws.String("REMOVE #scheduled"),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.scheduledRollback = nil
+	return nil
+}
+
+// setSnapshotPolicy records the snapshot policy, replacing any other one, or drops it if policy is nil
+func (s *config) setSnapshotPolicy(policy *dynamodb.AttributeValue) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.tableName),
+		Key:                      s.metaPrimaryKey,
+		ExpressionAttributeNames: map[string]*string{"#policy": aws.String(ddbSnapshotPolicyField)},
+		UpdateExpression:         aws.String("REMOVE #policy"),
+	}
+	if policy != nil {
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":policy": policy}
+		input.UpdateExpression = aws.String("SET #policy=:policy")
+	}
+
+	_, err := s.svc.UpdateItem(input)
+	if err != nil {
+		return err
+	}
+
+	s.snapshotPolicy = policy
+	return nil
+}
+
+// record the maximum number of digits of snapshot IDs, which can only grow: the update fails if another client
+// recorded a longer one concurrently
+func (s *config) setSnapshotIDLength(length int) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                aws.String(s.tableName),
+		Key:                      s.metaPrimaryKey,
+		ExpressionAttributeNames: map[string]*string{"#length": aws.String(ddbSnapshotIDLengthField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":length": {N: aws.String(strconv.Itoa(length))},
+		},
+		UpdateExpression:    aws.String("SET #length=:length"),
+		ConditionExpression: aws.String("attribute_not_exists(#length) OR #length <= :length"),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.snapshotIDLength = length
+	return nil
+}
+
+// runScheduledRollback rolls back to the scheduled snapshot and drops the schedule, all at once; the update fails if
+// the schedule changed (or was run by someone else) concurrently
+func (s *config) runScheduledRollback() (string, error) {
+	snapshot, at, ok, err := s.getScheduledRollback()
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", errors.New("no rollback is scheduled")
+	}
+
+	item, id, err := s.rollbackUpdate(snapshot)
+	if err != nil {
+		return "", err
+	}
+
+	item.ExpressionAttributeNames["#scheduled"] = aws.String(ddbScheduledRollbackField)
+	item.ExpressionAttributeNames["#at"] = aws.String(scheduledRollbackAt)
+	if item.ExpressionAttributeValues == nil {
+		item.ExpressionAttributeValues = make(map[string]*dynamodb.AttributeValue, 0)
+	}
+	item.ExpressionAttributeValues[":scheduledAt"] = timeToAttributeValue(at)
+	if strings.HasPrefix(*item.UpdateExpression, "REMOVE ") {
+		*item.UpdateExpression += ", #scheduled"
+	} else {
+		*item.UpdateExpression += " REMOVE #scheduled"
+	}
+	*item.ConditionExpression += " AND #scheduled.#at=:scheduledAt"
+
 	_, err = s.svc.UpdateItem(item)
+	if err != nil {
+		return "", err
+	}
 
-	return id, err
+	s.currentSnapshotID = id
+	s.scheduledRollback = nil
+	return id, nil
+}
+
+// destroySnapshots removes the given snapshots from the metadata. Unless force is true, neither the latest nor the
+// current snapshot can be removed; otherwise, the latest becomes the most recent snapshot left and the current one
+// the closest ancestor left, i.e., the snapshot reads would have fallen back to. Snapshots taken on top of a removed
+// one are recorded as branching off its closest ancestor left. The update fails if either the latest or the current
+// snapshot changed concurrently.
+func (s *config) destroySnapshots(snapshots []string, force bool) error {
+	latestID := s.latestSnapshotID
+	currentID := s.getCurrentSnapshotID()
+	destroyed := make(map[string]bool, len(snapshots))
+	for _, snapshot := range snapshots {
+		id, ok := s.snapshots[snapshot]
+		if !ok {
+			return &SnapshotNotFoundError{Snapshot: snapshot}
+		}
+		if !force && (*id.S == latestID || *id.S == currentID) {
+			return errors.New(fmt.Sprintf("snapshot '%s' is the latest or the current one", snapshot))
+		}
+		destroyed[*id.S] = true
+	}
+
+	// the closest ancestor of a snapshot that is not being removed
+	parents := s.parentIDs()
+	survivor := func(id string) string {
+		for destroyed[id] {
+			id = parents[id]
+		}
+		return id
+	}
+
+	remaining := make(map[string]*dynamodb.AttributeValue, len(s.snapshots))
+	names := make(map[string]string, len(s.snapshots))
+	for name, id := range s.snapshots {
+		if !destroyed[*id.S] {
+			remaining[name] = id
+			names[*id.S] = name
+		}
+	}
+	remainingIDs := make([]string, 0, len(s.chronologicalSnapshotIDs))
+	ids := []*dynamodb.AttributeValue{}
+	for _, id := range s.chronologicalSnapshotIDs {
+		if !destroyed[id] {
+			remainingIDs = append(remainingIDs, id)
+			ids = append(ids, &dynamodb.AttributeValue{S: aws.String(id)})
+		}
+	}
+
+	item := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       s.metaPrimaryKey,
+		ExpressionAttributeNames: map[string]*string{
+			"#snapshots":  aws.String(ddbSnapshotsField),
+			"#latestID":   aws.String(ddbLatestIDField),
+			"#currentID":  aws.String(ddbCurrentIDField),
+			"#orderedIDs": aws.String(ddbOrderedIDs),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":snapshots":        {M: remaining},
+			":orderedIDs":       {L: ids},
+			":previousLatestID": {S: aws.String(s.latestSnapshotID)},
+		},
+		ConditionExpression: aws.String("#latestID=:previousLatestID"),
+	}
+	sets := []string{"#snapshots=:snapshots", "#orderedIDs=:orderedIDs"}
+	removals := make([]string, 0)
+
+	// the current snapshot is not set if we rolled back to the data written before any snapshots
+	if s.currentSnapshotID != "" {
+		item.ExpressionAttributeValues[":previousCurrentID"] = &dynamodb.AttributeValue{
+			S: aws.String(s.currentSnapshotID)}
+		*item.ConditionExpression += " AND #currentID=:previousCurrentID"
+	} else {
+		*item.ConditionExpression += " AND attribute_not_exists(#currentID)"
+	}
+
+	// move the latest and current snapshots off the removed ones
+	newLatestID := latestID
+	if destroyed[latestID] {
+		newLatestID = ""
+		if len(remainingIDs) > 0 {
+			newLatestID = remainingIDs[0]
+		}
+	}
+	newCurrentID := survivor(currentID)
+	if newLatestID != latestID {
+		if newLatestID != "" {
+			item.ExpressionAttributeValues[":latestID"] = &dynamodb.AttributeValue{S: aws.String(newLatestID)}
+			sets = append(sets, "#latestID=:latestID")
+		} else {
+			removals = append(removals, "#latestID")
+		}
+	}
+	if newCurrentID != currentID {
+		if newCurrentID != "" {
+			item.ExpressionAttributeValues[":currentID"] = &dynamodb.AttributeValue{S: aws.String(newCurrentID)}
+			sets = append(sets, "#currentID=:currentID")
+		} else {
+			removals = append(removals, "#currentID")
+		}
+	}
+
+	// drop whatever was recorded about the destroyed snapshots
+	usesInfo := false
+	for i, snapshot := range snapshots {
+		if _, ok := s.snapshotInfo[snapshot]; !ok {
+			continue
+		}
+		name := fmt.Sprintf("#snapshot%d", i)
+		item.ExpressionAttributeNames[name] = aws.String(snapshot)
+		removals = append(removals, "#info."+name)
+		usesInfo = true
+	}
+	// and make the snapshots taken on top of them fall back to their closest ancestor left, unless they already do
+	reparented := make(map[string]*dynamodb.AttributeValue, 0)
+	branched := s.snapshotParents()
+	for i, id := range remainingIDs {
+		if !destroyed[parents[id]] {
+			continue
+		}
+		next := ""
+		if i+1 < len(remainingIDs) {
+			next = remainingIDs[i+1]
+		}
+		_, isBranch := branched[id]
+		parentID := survivor(parents[id])
+		if !isBranch && parentID == next {
+			continue
+		}
+
+		info := make(map[string]*dynamodb.AttributeValue, 0)
+		if current, ok := s.snapshotInfo[names[id]]; ok {
+			for k, v := range current.M {
+				info[k] = v
+			}
+		}
+		info[snapshotInfoParent] = parentAttributeValue(parentID)
+		reparented[names[id]] = &dynamodb.AttributeValue{M: info}
+
+		name := fmt.Sprintf("#reparented%d", len(reparented))
+		value := fmt.Sprintf(":reparented%d", len(reparented))
+		item.ExpressionAttributeNames[name] = aws.String(names[id])
+		item.ExpressionAttributeValues[value] = reparented[names[id]]
+		sets = append(sets, "#info."+name+"="+value)
+		usesInfo = true
+	}
+	if usesInfo {
+		item.ExpressionAttributeNames["#info"] = aws.String(ddbSnapshotInfoField)
+	}
+	// as well as the pins to them, which would otherwise refer to whatever snapshot reuses the ID
+	unpinned := make([]string, 0)
+	for clientID, id := range s.browsePins {
+		if !destroyed[aws.StringValue(id.S)] {
+			continue
+		}
+		name := fmt.Sprintf("#client%d", len(unpinned))
+		item.ExpressionAttributeNames[name] = aws.String(clientID)
+		removals = append(removals, "#pins."+name)
+		unpinned = append(unpinned, clientID)
+	}
+	if len(unpinned) > 0 {
+		item.ExpressionAttributeNames["#pins"] = aws.String(ddbBrowsePinsField)
+	}
+
+	// their IDs are not reused until all of their items have been deleted (see forgetDestroyedIDs)
+	tombstones := make([]*string, 0, len(destroyed))
+	for id := range destroyed {
+		tombstones = append(tombstones, aws.String(id))
+	}
+	item.ExpressionAttributeNames["#destroying"] = aws.String(ddbDestroyingIDsField)
+	item.ExpressionAttributeValues[":destroying"] = &dynamodb.AttributeValue{SS: tombstones}
+
+	item.UpdateExpression = aws.String("SET " + strings.Join(sets, ", "))
+	if len(removals) > 0 {
+		*item.UpdateExpression += " REMOVE " + strings.Join(removals, ", ")
+	}
+	*item.UpdateExpression += " ADD #destroying :destroying"
+
+	_, err := s.svc.UpdateItem(item)
+	if err != nil {
+		return err
+	}
+
+	if s.destroyingIDs == nil {
+		s.destroyingIDs = make(map[string]bool, len(destroyed))
+	}
+	for id := range destroyed {
+		s.destroyingIDs[id] = true
+	}
+	s.snapshots = remaining
+	s.chronologicalSnapshotIDs = remainingIDs
+	s.latestSnapshotID = newLatestID
+	if newCurrentID != currentID {
+		s.currentSnapshotID = newCurrentID
+	}
+	for _, snapshot := range snapshots {
+		delete(s.snapshotInfo, snapshot)
+	}
+	for name, info := range reparented {
+		s.snapshotInfo[name] = info
+	}
+	for _, clientID := range unpinned {
+		delete(s.browsePins, clientID)
+	}
+
+	return nil
 }
 
 // listSnapshots returns all existing snapshots
@@ -228,10 +749,32 @@ func (s *config) listSnapshots() []string {
 	return s.chronologicalSnapshotIDs
 }
 
+// snapshotIDMap returns the ID of every existing snapshot, by name
+func (s *config) snapshotIDMap() map[string]string {
+	ids := make(map[string]string, len(s.snapshots))
+	for name, id := range s.snapshots {
+		ids[name] = aws.StringValue(id.S)
+	}
+
+	return ids
+}
+
+// return the set of IDs of every existing snapshot, and of the destroyed ones whose items may still be on the table
+func (s *config) snapshotIDSet() map[string]bool {
+	ids := make(map[string]bool, len(s.chronologicalSnapshotIDs)+len(s.destroyingIDs))
+	for _, id := range s.chronologicalSnapshotIDs {
+		ids[id] = true
+	}
+	for id := range s.destroyingIDs {
+		ids[id] = true
+	}
+
+	return ids
+}
+
 // return all snapshot IDs, chronologically sorted, starting with `first`
 func (s *config) GetChronologicalSnapshotIDs(first string) []string {
 	var ids []string = make([]string, 0)
-	var i int
 
 	// special cases
 	switch first {
@@ -246,26 +789,82 @@ func (s *config) GetChronologicalSnapshotIDs(first string) []string {
 	}
 
 	// skip all IDs until `first`
-	for i = 0; i < len(s.chronologicalSnapshotIDs); i++ {
-		if s.chronologicalSnapshotIDs[i] == first {
-			break
-		}
+	positions := make(map[string]int, len(s.chronologicalSnapshotIDs))
+	for j, id := range s.chronologicalSnapshotIDs {
+		positions[id] = j
+	}
+	i, ok := positions[first]
+	if !ok {
+		return ids
 	}
 
-	// collect all remaining IDs
+	// collect all remaining IDs, jumping straight to the parent of snapshots that branch off an older one
+	parents := s.snapshotParents()
 	for i < len(s.chronologicalSnapshotIDs) {
-		ids = append(ids, s.chronologicalSnapshotIDs[i])
-		i++
+		id := s.chronologicalSnapshotIDs[i]
+		ids = append(ids, id)
+
+		parent, branched := parents[id]
+		if !branched {
+			i++
+			continue
+		}
+		if i, ok = positions[parent]; !ok {
+			// branched off the data written before any snapshots
+			break
+		}
 	}
 
 	return ids
 }
 
+// snapshotParents maps the ID of every snapshot that branches off another one (see snapshot) to the ID of its
+// parent, which is empty for the data written before any snapshots
+func (s *config) snapshotParents() map[string]string {
+	parents := make(map[string]string, 0)
+	for name, id := range s.snapshots {
+		av := s.getSnapshotInfo(name, snapshotInfoParent)
+		if av != nil {
+			parents[aws.StringValue(id.S)] = aws.StringValue(av.S)
+		}
+	}
+
+	return parents
+}
+
+// parentIDs maps the ID of every snapshot to the ID of the one it was taken on top of: the one before it, or the
+// one it branches off; the data written before any snapshots is the empty ID
+func (s *config) parentIDs() map[string]string {
+	parents := s.snapshotParents()
+	for i, id := range s.chronologicalSnapshotIDs {
+		if _, branched := parents[id]; branched {
+			continue
+		}
+		if i+1 < len(s.chronologicalSnapshotIDs) {
+			parents[id] = s.chronologicalSnapshotIDs[i+1]
+		} else {
+			parents[id] = ""
+		}
+	}
+
+	return parents
+}
+
+// value of a snapshot's parent, as recorded in its info; DynamoDB does not support empty strings, so the data
+// written before any snapshots is NULL
+func parentAttributeValue(parentID string) *dynamodb.AttributeValue {
+	if parentID == "" {
+		return &dynamodb.AttributeValue{NULL: aws.Bool(true)}
+	}
+
+	return &dynamodb.AttributeValue{S: aws.String(parentID)}
+}
+
 // getSnapshotID returns the internal ID mapped to the given snapshot
 func (s *config) getSnapshotID(snapshot string) (string, error) {
 	// special cases
 	switch snapshot {
-	case "":
+	case "", Baseline:
 		// empty string means no snapshot (before any were created), the corresponding ID is also an empty string
 		return "", nil
 	case snapshotLatest:
@@ -280,7 +879,32 @@ func (s *config) getSnapshotID(snapshot string) (string, error) {
 		return *id.S, nil
 	}
 
-	return "", errors.New("snapshot '" + snapshot + "' does not exist")
+	return "", &SnapshotNotFoundError{Snapshot: snapshot}
+}
+
+// getScanSnapshotID returns the ID of the snapshot a scan should read, where an empty snapshot means all of them
+func (s *config) getScanSnapshotID(snapshot string) (string, error) {
+	if snapshot == "" {
+		return allSnapshotsID, nil
+	}
+
+	return s.getSnapshotID(snapshot)
+}
+
+// getSnapshotName returns the name of the snapshot mapped to the given internal ID
+func (s *config) getSnapshotName(id string) (string, error) {
+	// empty string means no snapshot (before any were created), just like the name
+	if id == "" {
+		return "", nil
+	}
+
+	for name, v := range s.snapshots {
+		if *v.S == id {
+			return name, nil
+		}
+	}
+
+	return "", &SnapshotNotFoundError{ID: id}
 }
 
 // getCurrentSnapshotID returns the ID of the snapshot currently set as active
@@ -300,13 +924,21 @@ func (s *config) getCurrentSnapshotID() string {
 
 func (s *config) cacheAllMetadata() error {
 	result, err := s.svc.GetItem(&dynamodb.GetItemInput{
-		TableName: aws.String(s.tableName),
-		Key:       s.metaPrimaryKey,
+		TableName:      aws.String(s.tableName),
+		Key:            s.metaPrimaryKey,
+		ConsistentRead: aws.Bool(s.consistentRead),
 	})
 	if err != nil {
 		return err
 	}
 
+	// the metadata is somewhere else: reading on would find no snapshots at all
+	if table, ok := result.Item[ddbMetadataTableField]; ok {
+		return errors.New(fmt.Sprintf("the metadata of table %s was moved to table %s (see WithMetadataTable)",
+			s.tableName, aws.StringValue(table.S)))
+	}
+	s.exists = len(result.Item) > 0
+
 	// snapshot_name -> snapshot
 	snapshots, ok := result.Item[ddbSnapshotsField]
 	if ok {
@@ -333,16 +965,343 @@ func (s *config) cacheAllMetadata() error {
 		s.latestSnapshotID = *latest.S
 	}
 
+	// key encoding; tables that predate it use the legacy one
+	encoding, ok := result.Item[ddbKeyEncodingField]
+	if ok {
+		s.keyEncoding = *encoding.S
+	}
+	migration, ok := result.Item[ddbKeyEncodingMigrationField]
+	if ok {
+		s.keyEncodingMigration = *migration.S
+	}
+
+	// destroyed snapshots whose items may not have been deleted yet
+	destroying, ok := result.Item[ddbDestroyingIDsField]
+	if ok {
+		s.destroyingIDs = make(map[string]bool, len(destroying.SS))
+		for _, id := range destroying.SS {
+			s.destroyingIDs[*id] = true
+		}
+	}
+
+	// whether every item is in the snapshot index
+	backfilled, ok := result.Item[ddbSnapshotIndexBackfilledField]
+	if ok {
+		s.snapshotIndexBackfilled = aws.BoolValue(backfilled.BOOL)
+	}
+
+	// key codec; tables that predate it may use any one
+	codec, ok := result.Item[ddbKeyCodecField]
+	if ok {
+		s.keyCodec, err = keyCodecFromAttributeValue(codec)
+		if err != nil {
+			return wrapError("invalid key codec", err)
+		}
+		s.hasKeyCodec = true
+	}
+
+	// snapshot ID length; tables that predate it use the default one
+	length, ok := result.Item[ddbSnapshotIDLengthField]
+	if ok {
+		s.snapshotIDLength, err = strconv.Atoi(*length.N)
+		if err != nil {
+			return wrapError("invalid snapshot ID length", err)
+		}
+	}
+
+	// snapshot_name -> extra information
+	info, ok := result.Item[ddbSnapshotInfoField]
+	if ok {
+		s.snapshotInfo = info.M
+		s.hasSnapshotInfo = true
+	}
+
+	// client_id -> snapshot
+	pins, ok := result.Item[ddbBrowsePinsField]
+	if ok {
+		s.browsePins = pins.M
+		s.hasBrowsePins = true
+	}
+
+	// pending rollback, if any
+	scheduled, ok := result.Item[ddbScheduledRollbackField]
+	if ok {
+		s.scheduledRollback = scheduled
+	}
+
+	// snapshot policy, if any
+	policy, ok := result.Item[ddbSnapshotPolicyField]
+	if ok {
+		s.snapshotPolicy = policy
+	}
+
+	return nil
+}
+
+// record the encoding used to add snapshot IDs to partition keys, which ends the migration to it, if any
+func (s *config) setKeyEncoding(encoding string) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       s.metaPrimaryKey,
+		ExpressionAttributeNames: map[string]*string{
+			"#encoding":  aws.String(ddbKeyEncodingField),
+			"#migration": aws.String(ddbKeyEncodingMigrationField),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":encoding": {S: aws.String(encoding)}},
+		UpdateExpression:          aws.String("SET #encoding=:encoding REMOVE #migration"),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.keyEncoding = encoding
+	s.keyEncodingMigration = ""
+	return nil
+}
+
+// record that the table is being migrated to another encoding, so that every client reads keys in both meanwhile
+func (s *config) startKeyEncodingMigration(encoding string) error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       s.metaPrimaryKey,
+		ExpressionAttributeNames:  map[string]*string{"#migration": aws.String(ddbKeyEncodingMigrationField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":migration": {S: aws.String(encoding)}},
+		UpdateExpression:          aws.String("SET #migration=:migration"),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.keyEncodingMigration = encoding
 	return nil
 }
 
-// find and return the first available ID (integer not yet assigned to some snapshot)
+// record that every item has been tagged with its snapshot, so that every client can read from the snapshot index
+func (s *config) setSnapshotIndexBackfilled() error {
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       s.metaPrimaryKey,
+		ExpressionAttributeNames:  map[string]*string{"#backfilled": aws.String(ddbSnapshotIndexBackfilledField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":backfilled": {BOOL: aws.Bool(true)}},
+		UpdateExpression:          aws.String("SET #backfilled=:backfilled"),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.snapshotIndexBackfilled = true
+	return nil
+}
+
+// getSnapshotInfo returns the value of field on the extra information recorded for snapshot, or nil if there is none
+func (s *config) getSnapshotInfo(snapshot string, field string) *dynamodb.AttributeValue {
+	info, ok := s.snapshotInfo[snapshot]
+	if !ok {
+		return nil
+	}
+
+	return info.M[field]
+}
+
+// setSnapshotInfo records value as field of the extra information about snapshot, only if the field still holds what
+// it did when the metadata was read, and leaving every other field as it is, whoever changed it since
+func (s *config) setSnapshotInfo(snapshot string, field string, value *dynamodb.AttributeValue) error {
+	var item *dynamodb.UpdateItemInput
+
+	_, ok := s.snapshots[snapshot]
+	if !ok {
+		return &SnapshotNotFoundError{Snapshot: snapshot}
+	}
+
+	info := make(map[string]*dynamodb.AttributeValue, 0)
+	current, recorded := s.snapshotInfo[snapshot]
+	if recorded {
+		for k, v := range current.M {
+			info[k] = v
+		}
+	}
+	previous := info[field]
+	info[field] = value
+
+	// a nested attribute can only be set if its parent exists
+	switch {
+	case recorded:
+		item = &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       s.metaPrimaryKey,
+			ExpressionAttributeNames: map[string]*string{
+				"#info":     aws.String(ddbSnapshotInfoField),
+				"#snapshot": aws.String(snapshot),
+				"#field":    aws.String(field),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":value": value},
+			UpdateExpression:          aws.String("SET #info.#snapshot.#field=:value"),
+			ConditionExpression: aws.String(
+				"attribute_exists(#info.#snapshot) AND attribute_not_exists(#info.#snapshot.#field)",
+			),
+		}
+		if previous != nil {
+			item.ExpressionAttributeValues[":previous"] = previous
+			item.ConditionExpression = aws.String("#info.#snapshot.#field = :previous")
+		}
+	case s.hasSnapshotInfo:
+		item = &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       s.metaPrimaryKey,
+			ExpressionAttributeNames: map[string]*string{
+				"#info":     aws.String(ddbSnapshotInfoField),
+				"#snapshot": aws.String(snapshot),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":info": {M: info}},
+			UpdateExpression:          aws.String("SET #info.#snapshot=:info"),
+			ConditionExpression:       aws.String("attribute_exists(#info) AND attribute_not_exists(#info.#snapshot)"),
+		}
+	default:
+		item = &dynamodb.UpdateItemInput{
+			TableName:                aws.String(s.tableName),
+			Key:                      s.metaPrimaryKey,
+			ExpressionAttributeNames: map[string]*string{"#info": aws.String(ddbSnapshotInfoField)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":info": {M: map[string]*dynamodb.AttributeValue{snapshot: {M: info}}},
+			},
+			UpdateExpression:    aws.String("SET #info=:info"),
+			ConditionExpression: aws.String("attribute_not_exists(#info)"),
+		}
+	}
+
+	_, err := s.svc.UpdateItem(item)
+	if err != nil {
+		return err
+	}
+
+	s.snapshotInfo[snapshot] = &dynamodb.AttributeValue{M: info}
+	s.hasSnapshotInfo = true
+
+	return nil
+}
+
+// getBrowsePin returns the ID of the snapshot clients with clientID are pinned to, if any; pins to snapshots that no
+// longer exist are ignored
+func (s *config) getBrowsePin(clientID string) (string, bool) {
+	pin, ok := s.browsePins[clientID]
+	if !ok || pin.S == nil {
+		return "", false
+	}
+
+	id := *pin.S
+	if id == "" {
+		return id, true
+	}
+	for _, v := range s.snapshots {
+		if *v.S == id {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// setBrowsePin pins clients with clientID to the snapshot with the given ID
+func (s *config) setBrowsePin(clientID string, id string) error {
+	var item *dynamodb.UpdateItemInput
+
+	// a nested attribute can only be set if its parent exists
+	if s.hasBrowsePins {
+		item = &dynamodb.UpdateItemInput{
+			TableName: aws.String(s.tableName),
+			Key:       s.metaPrimaryKey,
+			ExpressionAttributeNames: map[string]*string{
+				"#pins":   aws.String(ddbBrowsePinsField),
+				"#client": aws.String(clientID),
+			},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":id": {S: aws.String(id)}},
+			UpdateExpression:          aws.String("SET #pins.#client=:id"),
+			ConditionExpression:       aws.String("attribute_exists(#pins)"),
+		}
+	} else {
+		item = &dynamodb.UpdateItemInput{
+			TableName:                aws.String(s.tableName),
+			Key:                      s.metaPrimaryKey,
+			ExpressionAttributeNames: map[string]*string{"#pins": aws.String(ddbBrowsePinsField)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pins": {M: map[string]*dynamodb.AttributeValue{clientID: {S: aws.String(id)}}},
+			},
+			UpdateExpression:    aws.String("SET #pins=:pins"),
+			ConditionExpression: aws.String("attribute_not_exists(#pins)"),
+		}
+	}
+
+	_, err := s.svc.UpdateItem(item)
+	if err != nil {
+		return err
+	}
+
+	s.browsePins[clientID] = &dynamodb.AttributeValue{S: aws.String(id)}
+	s.hasBrowsePins = true
+
+	return nil
+}
+
+// removeBrowsePin unpins clients with clientID, if they were pinned to any snapshot
+func (s *config) removeBrowsePin(clientID string) error {
+	if _, ok := s.browsePins[clientID]; !ok {
+		return nil
+	}
+
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.tableName),
+		Key:       s.metaPrimaryKey,
+		ExpressionAttributeNames: map[string]*string{
+			"#pins":   aws.String(ddbBrowsePinsField),
+			"#client": aws.String(clientID),
+		},
+		UpdateExpression: aws.String("REMOVE #pins.#client"),
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(s.browsePins, clientID)
+
+	return nil
+}
+
+// record that all items of the given destroyed snapshots (by ID) have been deleted, which makes their IDs available
+// again
+func (s *config) forgetDestroyedIDs(ids []string) error {
+	tombstones := make([]*string, 0, len(ids))
+	for _, id := range ids {
+		tombstones = append(tombstones, aws.String(id))
+	}
+	_, err := s.svc.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.tableName),
+		Key:                       s.metaPrimaryKey,
+		ExpressionAttributeNames:  map[string]*string{"#destroying": aws.String(ddbDestroyingIDsField)},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":destroying": {SS: tombstones}},
+		UpdateExpression:          aws.String("DELETE #destroying :destroying"),
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		delete(s.destroyingIDs, id)
+	}
+	return nil
+}
+
+// find and return the first available ID (integer not yet assigned to some snapshot, nor to a destroyed one whose
+// items may still be on the table)
 func (s *config) getNextAvailableID() (string, error) {
 	var i int64
 	var free bool
 
-	for i = 1; i < int64(math.Pow10(snapshotIDLength)); i++ {
-		free = true
+	length := s.snapshotIDLength
+	if length == 0 {
+		length = defaultSnapshotIDLength
+	}
+	for i = 1; i < int64(math.Pow10(length)); i++ {
+		free = !s.destroyingIDs[strconv.FormatInt(i, 10)]
 		for _, v := range s.snapshots {
 			id, err := strconv.ParseInt(*v.S, 10, 64)
 			if err != nil {
@@ -358,7 +1317,7 @@ func (s *config) getNextAvailableID() (string, error) {
 		}
 	}
 
-	return "", errors.New("no IDs left")
+	return "", &SnapshotLimitError{Limit: int(math.Pow10(length)) - 1, IDLength: length}
 }
 
 // return the primary key we need to use when querying the table for meta-data
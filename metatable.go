@@ -0,0 +1,201 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// partition key (a string) of the table that stores the metadata of managed tables (see WithMetadataTable), whose
+// value is the name of the managed table
+const metaTableKey = "table"
+
+// return the table the metadata is stored in: the managed table itself, unless there's a dedicated one
+func (c *Library) metaTableName() string {
+	if c.metaTable != "" {
+		return c.metaTable
+	}
+
+	return c.tableName
+}
+
+// return the primary key of the row the metadata is stored in
+func (c *Library) metaKey() map[string]*dynamodb.AttributeValue {
+	if c.metaTable != "" {
+		return map[string]*dynamodb.AttributeValue{metaTableKey: {S: aws.String(c.tableName)}}
+	}
+
+	return getMetaPrimaryKey(c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+}
+
+// return true if key, as stored in the managed table (i.e., with the snapshot in the partition key), is the primary key
+// of the metadata row, or of the one left in its place once the metadata is moved to a table of its own (see
+// MoveMetadataToTable); no read returns the metadata row, whatever the key it is asked for, and no write changes it
+// (see checkNotMetaRow)
+func (c *Library) isMetaRowKey(key map[string]*dynamodb.AttributeValue) bool {
+	for name, v := range getMetaPrimaryKey(c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType) {
+		if !c.isMetaRowValue(key[name], v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// refuse a write of operation to key, as stored in the managed table, if it is the primary key of the metadata row
+// (see isMetaRowKey): only the Library itself writes to that row
+func (c *Library) checkNotMetaRow(operation string, key map[string]*dynamodb.AttributeValue) error {
+	if !c.isMetaRowKey(key) {
+		return nil
+	}
+
+	return &UnsupportedInputError{
+		Operation: operation,
+		Feature:   "Key",
+		Reason:    "it is the primary key of the row the table's metadata is stored in",
+	}
+}
+
+// return true if pk, as stored in the managed table, is the partition key of the metadata row (see isMetaRowKey), a
+// partition no query reads from
+func (c *Library) isMetaRowPartition(pk *dynamodb.AttributeValue) bool {
+	return c.isMetaRowValue(pk, c.metaPartitionKeyValue())
+}
+
+func (c *Library) isMetaRowValue(v *dynamodb.AttributeValue, meta *dynamodb.AttributeValue) bool {
+	if v == nil {
+		return false
+	}
+
+	return aws.StringValue(v.S) == aws.StringValue(meta.S) && aws.StringValue(v.N) == aws.StringValue(meta.N)
+}
+
+// MoveMetadataToTable moves the metadata of a table that used to keep it in a row of its own (i.e., created without
+// WithMetadataTable) to the dedicated metadata table the Library is configured with. The row is put in the metadata
+// table and replaced, in the managed one, by a row that only records where the metadata went, in a single
+// transaction, which fails if the metadata table already holds metadata for this table. If the row changes in the
+// meantime, e.g., because another client takes a snapshot, it is read and moved again. There's nothing to do if the
+// managed table has no metadata row, or if it was already moved to the same metadata table.
+//
+// Clients that still expect the metadata in the managed table fail to read it afterwards, rather than finding no
+// snapshots at all, until they are configured with WithMetadataTable as well; no reads return the row left behind.
+//
+// Cost: 1RU + 4WU (for every time the row changes meanwhile)
+func (c *Library) MoveMetadataToTable() error {
+	return c.MoveMetadataToTableWithContext(aws.BackgroundContext())
+}
+
+// MoveMetadataToTableWithContext is the same as MoveMetadataToTable with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) MoveMetadataToTableWithContext(ctx aws.Context) error {
+	if c.metaTable == "" {
+		return errors.New("no metadata table configured (see WithMetadataTable)")
+	}
+
+	for {
+		moved, err := c.moveMetadataToTable(ctx)
+		if err != nil {
+			return err
+		}
+		if moved {
+			c.invalidateMeta()
+			return nil
+		}
+	}
+}
+
+// move the metadata row to the metadata table, as MoveMetadataToTable does, returning false if the row changed since
+// it was read, and nothing was moved
+func (c *Library) moveMetadataToTable(ctx aws.Context) (bool, error) {
+	key := getMetaPrimaryKey(c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	out, err := c.metaStorage(ctx).GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(c.tableName),
+		Key:            key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, wrapError("failed to read the metadata", err)
+	}
+	if len(out.Item) == 0 {
+		return true, nil
+	}
+	if table, ok := out.Item[ddbMetadataTableField]; ok {
+		if aws.StringValue(table.S) == c.metaTable {
+			return true, nil
+		}
+		return false, errors.New("the metadata of table " + c.tableName + " was already moved to table " +
+			aws.StringValue(table.S))
+	}
+
+	item := make(map[string]*dynamodb.AttributeValue, len(out.Item))
+	for k, v := range out.Item {
+		if _, ok := key[k]; !ok {
+			item[k] = v
+		}
+	}
+	item[metaTableKey] = &dynamodb.AttributeValue{S: aws.String(c.tableName)}
+
+	// a snapshot, or a rollback, made after the row was read must not be lost
+	condition, names, values := c.unchangedItemCondition(out.Item)
+	_, err = c.metaStorage(ctx).TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: []*dynamodb.TransactWriteItem{
+			{Put: &dynamodb.Put{
+				TableName:                aws.String(c.metaTable),
+				Item:                     item,
+				ConditionExpression:      aws.String("attribute_not_exists(#table)"),
+				ExpressionAttributeNames: map[string]*string{"#table": aws.String(metaTableKey)},
+			}},
+			{Put: &dynamodb.Put{
+				TableName:                 aws.String(c.tableName),
+				Item:                      c.movedMetaRow(),
+				ConditionExpression:       aws.String(condition),
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+			}},
+		},
+	})
+	if isConditionalTransactionFailure(err) {
+		canceled := err.(*dynamodb.TransactionCanceledException)
+		if len(canceled.CancellationReasons) > 0 &&
+			aws.StringValue(canceled.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return false, errors.New("metadata table " + c.metaTable + " already holds the metadata of table " +
+				c.tableName)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, wrapError("failed to move the metadata", err)
+	}
+
+	return true, nil
+}
+
+// return the row left in the managed table in place of the metadata row once the metadata is moved to the metadata
+// table, which tells clients that still look for it there where it went
+func (c *Library) movedMetaRow() map[string]*dynamodb.AttributeValue {
+	item := getMetaPrimaryKey(c.partitionKey, c.partitionKeyType, c.rangeKey, c.rangeKeyType)
+	item[ddbMetadataTableField] = &dynamodb.AttributeValue{S: aws.String(c.metaTable)}
+
+	return item
+}
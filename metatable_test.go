@@ -0,0 +1,319 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_metaTable(t *testing.T) {
+	library := &Library{tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+	if library.metaTableName() != "movies" {
+		t.Error("expected the metadata in the managed table, got", library.metaTableName())
+	}
+	if library.tableScanInput().FilterExpression == nil {
+		t.Error("expected scans to filter out the metadata row")
+	}
+
+	WithMetadataTable("librarian")(library)
+	if library.metaTableName() != "librarian" {
+		t.Error("expected the metadata in the metadata table, got", library.metaTableName())
+	}
+	expected := map[string]*dynamodb.AttributeValue{metaTableKey: {S: aws.String("movies")}}
+	if !reflect.DeepEqual(library.metaKey(), expected) {
+		t.Error("expected the metadata to be keyed by table name, got", library.metaKey())
+	}
+	// the row left behind by MoveMetadataToTable is filtered out instead
+	if library.tableScanInput().FilterExpression == nil {
+		t.Error("expected scans to filter out the metadata row")
+	}
+	if !library.isMetaKey(expected) {
+		t.Error("expected the metadata key to be recognized")
+	}
+	if library.isMetaKey(map[string]*dynamodb.AttributeValue{metaTableKey: {S: aws.String("series")}}) {
+		t.Error("expected the metadata of other tables to be ignored")
+	}
+}
+
+func TestLibrary_isMetaRowKey(t *testing.T) {
+	library := &Library{tableName: "movies", partitionKey: "year", partitionKeyType: "N", rangeKey: "title",
+		rangeKeyType: "S"}
+	if !library.isMetaRowKey(library.metaKey()) {
+		t.Error("expected the key of the metadata row to be recognized")
+	}
+	if !library.isMetaRowPartition(library.metaKey()["year"]) {
+		t.Error("expected the partition of the metadata row to be recognized")
+	}
+	for _, key := range []map[string]*dynamodb.AttributeValue{
+		{"year": {N: aws.String(ddbPartitionKey)}, "title": {S: aws.String("The Big New Movie")}},
+		{"year": {N: aws.String("1" + ddbPartitionKey)}, "title": {S: aws.String(ddbRangeKey)}},
+		{"year": {N: aws.String(ddbPartitionKey)}},
+		{},
+	} {
+		if library.isMetaRowKey(key) {
+			t.Error("expected", key, "not to be the key of the metadata row")
+		}
+		if err := library.checkNotMetaRow("PutItem", key); err != nil {
+			t.Error("expected", key, "to be writable, got", err)
+		}
+	}
+	var unsupported *UnsupportedInputError
+	if err := library.checkNotMetaRow("PutItem", library.metaKey()); !errors.As(err, &unsupported) {
+		t.Error("expected an UnsupportedInputError writing to the metadata row, got", err)
+	}
+
+	// the row left behind by MoveMetadataToTable is never read either
+	WithMetadataTable("librarian")(library)
+	if !library.isMetaRowKey(getMetaPrimaryKey("year", "N", "title", "S")) {
+		t.Error("expected the key of the metadata row to be recognized with a metadata table")
+	}
+}
+
+func TestLibrary_metaRowIsNeverRead(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		// the metadata row is written along with the first snapshot
+		if err := library.Snapshot("1"); err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		_, err := library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: getAttributeValueForItem(schema, "")})
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		metaKey := library.metaKey()
+
+		for _, snapshot := range []string{"1", Baseline} {
+			out, err := library.GetItemFromSnapshot(&dynamodb.GetItemInput{TableName: table, Key: metaKey}, snapshot)
+			if err != nil || out.Item != nil {
+				t.Error("expected no item from GetItem, got", out, err)
+			}
+
+			keys := []map[string]*dynamodb.AttributeValue{metaKey, getAttributeValueForKey(schema)}
+			batch, err := library.BatchGetItemFromSnapshot(&dynamodb.BatchGetItemInput{
+				RequestItems: map[string]*dynamodb.KeysAndAttributes{*table: {Keys: keys}},
+			}, snapshot)
+			if err != nil || len(batch.Responses[*table]) > 1 {
+				t.Error("expected the metadata row not to be read by BatchGetItem, got", batch, err)
+			}
+
+			query, err := library.QueryFromSnapshot(&dynamodb.QueryInput{
+				TableName:                 table,
+				KeyConditionExpression:    aws.String("#pk = :pk"),
+				ExpressionAttributeNames:  map[string]*string{"#pk": aws.String(partitionKey)},
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": metaKey[partitionKey]},
+			}, snapshot)
+			if err != nil || len(query.Items) != 0 {
+				t.Error("expected no items from Query, got", query, err)
+			}
+		}
+
+		out, err := library.GetItem(&dynamodb.GetItemInput{TableName: table, Key: metaKey})
+		if err != nil || out.Item != nil {
+			t.Error("expected no item from GetItem on the active snapshot, got", out, err)
+		}
+		items, err := library.GetItems([]map[string]*dynamodb.AttributeValue{metaKey}, "")
+		if err != nil || len(items) != 1 || items[0] != nil {
+			t.Error("expected no item from GetItems, got", items, err)
+		}
+		all, _, err := library.ScanAllVersions(&dynamodb.ScanInput{TableName: table})
+		if err != nil || len(all.Items) != 1 {
+			t.Error("expected only the item written from ScanAllVersions, got", all, err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_metaRowIsNeverWritten(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		if err := library.Snapshot("1"); err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		metaKey := library.metaKey()
+		metaItem := getAttributeValueForItem(schema, "")
+		for k, v := range metaKey {
+			metaItem[k] = v
+		}
+
+		if _, err := library.PurgeItem(metaKey); err == nil {
+			t.Error("expected an error purging the metadata row")
+		}
+		_, err := library.DeleteItemFromSnapshot(&dynamodb.DeleteItemInput{TableName: table, Key: metaKey}, Baseline)
+		if err == nil {
+			t.Error("expected an error deleting the metadata row")
+		}
+		if err := library.PutItemsToSnapshot([]map[string]*dynamodb.AttributeValue{metaItem}, Baseline); err == nil {
+			t.Error("expected an error overwriting the metadata row")
+		}
+		err = library.BatchWriteItemToSnapshots(map[string][]*dynamodb.WriteRequest{
+			Baseline: {{DeleteRequest: &dynamodb.DeleteRequest{Key: metaKey}}},
+		})
+		if err == nil {
+			t.Error("expected an error deleting the metadata row in a batch")
+		}
+		_, err = library.TransactWriteItemsFromSnapshot(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{{Put: &dynamodb.Put{TableName: table, Item: metaItem}}},
+		}, Baseline)
+		if err == nil {
+			t.Error("expected an error overwriting the metadata row in a transaction")
+		}
+
+		// the metadata is left as it was
+		if err := library.Snapshot("2"); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		snapshots, err := library.ListSnapshots()
+		if err != nil || len(snapshots) != 2 {
+			t.Error("expected both snapshots, got", snapshots, err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestJoinFilters(t *testing.T) {
+	if joinFilters("", "") != nil {
+		t.Error("expected no filter")
+	}
+	if f := aws.StringValue(joinFilters("a = :a", "")); f != "a = :a" {
+		t.Error("expected a single filter as it is, got", f)
+	}
+	if f := aws.StringValue(joinFilters("a = :a OR c = :c", "", "b = :b")); f != "(a = :a OR c = :c) AND (b = :b)" {
+		t.Error("expected both filters, got", f)
+	}
+}
+
+// metaRowStorage holds the metadata row of a table and records the transactions made through it; if changed is set,
+// the first transaction fails as if the row had been changed to it after being read
+type metaRowStorage struct {
+	Storage
+	item         map[string]*dynamodb.AttributeValue
+	changed      map[string]*dynamodb.AttributeValue
+	transactions []*dynamodb.TransactWriteItemsInput
+}
+
+func (s *metaRowStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: s.item}, nil
+}
+
+func (s *metaRowStorage) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	s.transactions = append(s.transactions, input)
+	if s.changed != nil {
+		s.item, s.changed = s.changed, nil
+		return nil, &dynamodb.TransactionCanceledException{CancellationReasons: []*dynamodb.CancellationReason{
+			{Code: aws.String("None")},
+			{Code: aws.String("ConditionalCheckFailed")},
+		}}
+	}
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+func TestLibrary_MoveMetadataToTable(t *testing.T) {
+	storage := &metaRowStorage{}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+
+	// there must be somewhere to move it to
+	if err := library.MoveMetadataToTable(); err == nil {
+		t.Error("expected an error without a metadata table")
+	}
+
+	// nothing to move
+	WithMetadataTable("librarian")(library)
+	if err := library.MoveMetadataToTable(); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if len(storage.transactions) != 0 {
+		t.Error("expected nothing to be written, got", storage.transactions)
+	}
+
+	storage.item = getMetaPrimaryKey("year", "N", "", "")
+	storage.item[ddbCurrentIDField] = &dynamodb.AttributeValue{S: aws.String("01")}
+	if err := library.MoveMetadataToTable(); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if len(storage.transactions) != 1 {
+		t.Fatal("expected a single transaction, got", storage.transactions)
+	}
+	items := storage.transactions[0].TransactItems
+	expected := map[string]*dynamodb.AttributeValue{
+		metaTableKey:      {S: aws.String("movies")},
+		ddbCurrentIDField: {S: aws.String("01")},
+	}
+	if !reflect.DeepEqual(items[0].Put.Item, expected) || aws.StringValue(items[0].Put.TableName) != "librarian" {
+		t.Error("expected the metadata to be put in the metadata table, got", items[0].Put)
+	}
+	moved := getMetaPrimaryKey("year", "N", "", "")
+	moved[ddbMetadataTableField] = &dynamodb.AttributeValue{S: aws.String("librarian")}
+	if !reflect.DeepEqual(items[1].Put.Item, moved) || aws.StringValue(items[1].Put.TableName) != "movies" {
+		t.Error("expected the metadata row to record where it went, got", items[1].Put)
+	}
+
+	// clients that still look for it in the managed table find where it went
+	storage.item = moved
+	_, err := newMeta(storage, "movies", getMetaPrimaryKey("year", "N", "", ""), "year", "N", "", "", true)
+	if err == nil || !strings.Contains(err.Error(), "librarian") {
+		t.Error("expected the metadata table to be pointed at, got", err)
+	}
+
+	// and moving it again has nothing to do, unless it is to somewhere else
+	if err := library.MoveMetadataToTable(); err != nil || len(storage.transactions) != 1 {
+		t.Error("expected nothing to be written, got", err, storage.transactions)
+	}
+	WithMetadataTable("archive")(library)
+	if err := library.MoveMetadataToTable(); err == nil {
+		t.Error("expected an error moving it to another metadata table")
+	}
+
+	// a snapshot taken after the row was read is moved along with the rest
+	storage.item = getMetaPrimaryKey("year", "N", "", "")
+	storage.item[ddbCurrentIDField] = &dynamodb.AttributeValue{S: aws.String("01")}
+	storage.changed = getMetaPrimaryKey("year", "N", "", "")
+	storage.changed[ddbCurrentIDField] = &dynamodb.AttributeValue{S: aws.String("02")}
+	storage.transactions = nil
+	if err := library.MoveMetadataToTable(); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if len(storage.transactions) != 2 {
+		t.Fatal("expected the metadata to be moved again, got", storage.transactions)
+	}
+	for i, id := range []string{"01", "02"} {
+		items := storage.transactions[i].TransactItems
+		if v := items[1].Put.ExpressionAttributeValues[":attribute0"]; aws.StringValue(v.S) != id {
+			t.Error("expected the row to be replaced only if the current ID is still", id, "got", items[1].Put)
+		}
+		if aws.StringValue(items[0].Put.Item[ddbCurrentIDField].S) != id {
+			t.Error("expected the current ID", id, "to be moved, got", items[0].Put.Item)
+		}
+	}
+}
@@ -0,0 +1,666 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Option configures optional behavior of a Library instance. See NewWithOptions.
+type Option func(*Library)
+
+// WithAWSConfig provides additional configuration details for the DynamoDB client.
+func WithAWSConfig(cfg ...*aws.Config) Option {
+	return func(c *Library) {
+		c.awsConfig = append(c.awsConfig, cfg...)
+	}
+}
+
+// WithStorage makes the Library read and write the table through s instead of a DynamoDB client created from the
+// session, e.g., to run against a compatible backend or an in-memory engine in tests. Any additional AWS
+// configuration (WithAWSConfig) is then only used to follow the table's stream (see WithStreamInvalidation).
+func WithStorage(s Storage) Option {
+	return func(c *Library) {
+		c.svc = s
+	}
+}
+
+// WithSnapshotIndex makes the Library tag every item it writes with the ID of the snapshot it belongs to and
+// maintain a global secondary index over it. Reading all items of a snapshot (ScanFromSnapshot, CountItems) then
+// becomes a Query on the index instead of a full table scan.
+//
+// The index is created the first time it is needed, but reads keep scanning the table until it is active and
+// BackfillSnapshotIndex has tagged the items written before it was enabled, which would otherwise be missing from it.
+// Every page of a scan is read the same way as its first one.
+func WithSnapshotIndex() Option {
+	return func(c *Library) {
+		c.snapshotIndex = true
+	}
+}
+
+// WithMetadataCache makes the Library keep the table's metadata (existing snapshots, which one is active, etc.) in
+// memory instead of reading it on every call, saving 1RU per call. Changes made by the Library itself are picked
+// up right away, but changes made by other clients (e.g., a new snapshot or a rollback) are not: use
+// WithMetadataCacheTTL to read it again every so often, or WithStreamInvalidation to keep multiple clients consistent.
+func WithMetadataCache() Option {
+	return func(c *Library) {
+		c.metaCache = true
+	}
+}
+
+// WithMetadataCacheTTL caches the table's metadata, just like WithMetadataCache, for at most ttl, after which it is
+// read again: changes made by other clients are picked up within ttl. Invalidate drops the cache right away.
+func WithMetadataCacheTTL(ttl time.Duration) Option {
+	return func(c *Library) {
+		c.metaCache = true
+		c.metaTTL = ttl
+	}
+}
+
+// WithConsistentMetadata makes the Library read the table's metadata with strongly consistent reads, whatever the
+// consistency of the reads of the items (see WithConsistentReads), so that snapshots and rollbacks made by other
+// clients are seen by the very next call. The cache (see WithMetadataCache) is always filled this way.
+//
+// Overhead: 1RU per call, instead of 0.5RU
+func WithConsistentMetadata() Option {
+	return func(c *Library) {
+		c.consistentMeta = true
+	}
+}
+
+// WithMetadataTable stores the table's metadata in table, keyed by the name of the managed table, instead of a row of
+// the managed table itself, which every scan has to filter out. The same metadata table can be shared by any number of
+// managed tables; it must already exist, with a string partition key named "table" and no range key. Tables that
+// already have snapshots can be switched over with MoveMetadataToTable.
+//
+// With WithStreamInvalidation, it is the stream of the metadata table that is followed.
+func WithMetadataTable(table string) Option {
+	return func(c *Library) {
+		c.metaTable = table
+	}
+}
+
+// WithReadFailover makes reads (GetItem, BatchGetItem, Query, and Scan, including those of the table's metadata) fail
+// over to secondary, a client of another region of a global table, once the region of the table fails to serve
+// policy.Threshold reads in a row, e.g., with a 5xx status or no response at all; writes keep going to the table's
+// region. Every policy.CheckInterval, the table is described in its region, and reads go back to it as soon as it is
+// active again. ReadsFailedOver tells which region reads are made in.
+//
+// Replication between regions is asynchronous: the secondary region may not have the latest writes, or the latest
+// changes to the metadata, e.g., a snapshot just taken. Only reads use the metadata read there, which is never
+// cached; writes, and every other operation, always read it from the table's region.
+//
+// Overhead: 1 DescribeTable call every policy.CheckInterval while failed over
+func WithReadFailover(secondary Storage, policy FailoverPolicy) Option {
+	return func(c *Library) {
+		c.failover = &readFailover{secondary: secondary, policy: policy}
+	}
+}
+
+// WithStreamInvalidation caches the table's metadata, just like WithMetadataCache, and follows the table's DynamoDB
+// stream in the background to drop the cache as soon as the metadata is changed by any client. Streams must be
+// enabled on the table (any view type will do). Every shard is read until it is caught up once a second, which takes
+// longer, and uses more of the stream's read capacity, the busier the table is: with WithMetadataTable, only the
+// metadata table's stream is followed. Call Close to stop following the stream.
+func WithStreamInvalidation() Option {
+	return func(c *Library) {
+		c.metaCache = true
+		c.streamInvalidation = true
+	}
+}
+
+// WithMaxConcurrency sets the maximum number of requests a single operation makes in parallel, to trade throughput
+// for load on the table in one place. It applies to the snapshots probed by GetItem (one at a time by default), the
+// segments of bulk scans (all of them at once by default, see BulkOptions), and the batches written by bulk writes
+// (one at a time by default).
+func WithMaxConcurrency(n int) Option {
+	return func(c *Library) {
+		c.maxConcurrency = n
+	}
+}
+
+// WithConsistentReads makes strongly consistent reads the default for every read the Library makes, including the
+// metadata and every snapshot probed by GetItem and BatchGetItem. Callers can still ask for eventually consistent
+// reads by setting ConsistentRead to false. Scans are never answered from the snapshot index (see
+// WithSnapshotIndex) when strongly consistent, as global secondary indexes do not support it.
+//
+// Without it, the consistency of a read is that of the caller's ConsistentRead, which also applies to the metadata
+// and every other request the operation makes.
+func WithConsistentReads() Option {
+	return func(c *Library) {
+		c.consistentRead = true
+	}
+}
+
+// WithCompression makes the Library gzip (or compress with another codec, see WithCompressionCodec) the string and
+// binary attributes named by attributes whose values are at least threshold bytes long, if that makes them any
+// smaller, when writing items. Compressed values are stored as binary attributes and listed, along with their codec
+// and a digest of the compressed value, in a reserved attribute so that they are decompressed when read back, by any
+// client; reading a listed value that fails to decompress is an error. This saves storage (and write capacity) when
+// keeping multiple versions of large items.
+//
+// The primary key cannot be compressed. UpdateItem does not compress the values it writes, which are read back as
+// written since they do not match the digest of the values they replace, and conditions, filters, and projections on
+// compressed attributes see the compressed values (projections must also include ddblibrarian_compressed for them to be
+// decompressed).
+func WithCompression(threshold int, attributes ...string) Option {
+	return func(c *Library) {
+		c.compressionThreshold = threshold
+		c.compressedAttributes = make(map[string]bool, len(attributes))
+		for _, a := range attributes {
+			c.compressedAttributes[a] = true
+		}
+	}
+}
+
+// WithCompressionCodec makes the Library compress attributes (see WithCompression) with codec instead of gzip. Any
+// client decompresses values written with either codec, whichever it is configured with.
+func WithCompressionCodec(codec CompressionCodec) Option {
+	return func(c *Library) {
+		c.compressionCodec = codec
+	}
+}
+
+// WithOverflow makes the Library store the string and binary attributes named by attributes (or any of them, if none
+// are named) whose values are at least threshold bytes long in S3, under prefix in bucket, and keep a pointer to the
+// object on the table instead. This leaves room, on items close to DynamoDB's 400KB limit, for the attributes the
+// Library reserves (e.g., checksums and version stamps). The pointers are listed in a reserved attribute so that the
+// values are fetched back whenever items are read, by any client with an AWS session and the same bucket and prefix:
+// gets, queries, scans, merged views, diffs, and exports see items as they were written. Only objects under prefix in
+// bucket whose content matches their name are read, and writes that set the reserved attribute are refused, so that
+// no writer can make readers fetch other objects; clients without WithOverflow fail to read overflowed items.
+//
+// Objects are named after their content, so all versions of an item that share a value share the object too. Writes
+// never delete them, not even PurgeItem, as other snapshots may still point to them: SweepOverflow deletes the ones no
+// item points to anymore. The primary key cannot overflow. UpdateItem does not move the values it writes to S3, and
+// conditions, filters, and projections on overflowed attributes see the pointers (projections must also include
+// ddblibrarian_overflow for them to be followed).
+func WithOverflow(bucket string, prefix string, threshold int, attributes ...string) Option {
+	return func(c *Library) {
+		c.overflow = &overflowConfig{
+			bucket:     bucket,
+			prefix:     prefix,
+			threshold:  threshold,
+			attributes: make(map[string]bool, len(attributes)),
+		}
+		for _, a := range attributes {
+			c.overflow.attributes[a] = true
+		}
+	}
+}
+
+// WithChecksums enables integrity mode: the Library writes a checksum of each item's content, in a reserved
+// attribute, with every version it writes and verifies it whenever it reads the item back, returning a
+// *ChecksumError if they do not match, e.g., because the item was edited by hand. VerifyChecksums checks a whole
+// snapshot at once.
+//
+// UpdateItem cannot tell what the updated item looks like, so it drops the item's checksum instead. Items without a
+// checksum are not verified (see WithRequiredChecksums).
+func WithChecksums() Option {
+	return func(c *Library) {
+		c.checksums = true
+	}
+}
+
+// WithRequiredChecksums enables integrity mode (see WithChecksums) and makes it strict: items without a checksum fail
+// to be read with a *ChecksumError too, instead of not being verified, and updates, which would drop the checksum,
+// are rejected with an *UnsupportedInputError. Only use it once every item has been written with a checksum.
+func WithRequiredChecksums() Option {
+	return func(c *Library) {
+		c.checksums = true
+		c.requireChecksums = true
+	}
+}
+
+// WithClock makes the Library tell the time with clock instead of the system's wall clock, e.g., to control time
+// deterministically in tests or when replaying past operations.
+func WithClock(clock Clock) Option {
+	return func(c *Library) {
+		c.clock = clock
+	}
+}
+
+// WithClientID identifies the Library as one of a group of clients (e.g., a fleet of workers running the same code)
+// that can be pinned to a snapshot all at once, by anyone, with PinClient. While pinned, and not browsing some other
+// snapshot itself (see Browse), the Library reads from the snapshot the group is pinned to, just as if it was browsing
+// it, instead of the active one.
+func WithClientID(id string) Option {
+	return func(c *Library) {
+		c.clientID = id
+	}
+}
+
+// WithConflictRetry makes Snapshot and Rollback try once more, after reading the table's metadata again, when another
+// client changes it first; they fail with a *ConcurrentMetadataChangeError otherwise. The retry checks every
+// precondition again, e.g., a snapshot that now has to branch off the active one still fails unless allowed to (see
+// RequireActiveEqualsLatest), while a rollback simply takes effect after the concurrent change.
+func WithConflictRetry() Option {
+	return func(c *Library) {
+		c.conflictRetry = true
+	}
+}
+
+// WithStrictMode makes the Library inspect every input for features it cannot handle faithfully and reject them with
+// an *UnsupportedInputError instead of passing them through as they are: conditions and filters that do anything with
+// the partition key other than checking whether it exists or comparing it against a value (which gets the snapshot
+// added to it), e.g., contains or size, and the legacy ScanFilter parameter on the partition key. The DynamoDB client
+// returned by Client also rejects PartiQL statements and TransactGetItems on the managed table, which would otherwise
+// go straight to DynamoDB.
+func WithStrictMode() Option {
+	return func(c *Library) {
+		c.strict = true
+	}
+}
+
+// Timeouts bounds how long a Library waits on the table, whether or not a context is passed to it. A zero duration
+// means no timeout.
+type Timeouts struct {
+	// each request that reads, or changes, the table's metadata
+	Metadata time.Duration
+	// each request that reads, or writes, items
+	Operation time.Duration
+	// each parallel scan (e.g., ScanAllFromSnapshot, ParallelScanFromSnapshot, or DumpSnapshot) and each batch write
+	// (e.g., PutItems or LoadSnapshot) as a whole; operations that write in rounds, like Restore or DestroySnapshot,
+	// get a deadline for each round, and scans that read one page at a time, like ScanMerged, are only bounded by
+	// the Operation timeout of each request
+	Bulk time.Duration
+}
+
+// WithTimeouts makes the Library give up on requests, parallel scans, and batch writes that take longer than timeouts
+// allow, so that an unresponsive endpoint cannot stall a request indefinitely. They are not a deadline on whole
+// operations: one that makes many requests can take as long as all of them together; pass a context with a deadline
+// to bound that. Timeouts apply on top of the context passed to the *WithContext methods, if any, which still takes
+// precedence when its deadline is earlier. Storage backends that do not implement ContextStorage cannot interrupt a
+// request: the Metadata and Operation timeouts do not apply to them, and the Bulk timeout is only checked before each
+// request is made.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(c *Library) {
+		c.timeouts = timeouts
+	}
+}
+
+// WithCapacityCheck makes Restore and DestroySnapshot estimate, before writing anything, how long writing, or
+// deleting, all of their items would take at the table's provisioned write capacity, and fail with a *CapacityError
+// when it would take longer than limit, i.e., when they would obviously overwhelm the table. If warn is not nil, it is
+// called with the error instead, and the operation goes ahead. Tables in on-demand mode are never checked.
+func WithCapacityCheck(limit time.Duration, warn func(*CapacityError)) Option {
+	return func(c *Library) {
+		c.capacityLimit = limit
+		c.capacityWarn = warn
+	}
+}
+
+// WithOperationReports makes Restore, DestroySnapshot, CollectGarbage, DumpSnapshot, and LoadSnapshot call fn with
+// an *OperationReport once they are over, whether they succeeded or not: how many items they processed, the capacity
+// they consumed, and the keys of the items they failed to write.
+func WithOperationReports(fn ReportFunc) Option {
+	return func(c *Library) {
+		c.reportFunc = fn
+	}
+}
+
+// WithMetadataPolling makes the Library read the table's metadata every interval, until it is closed, so that the
+// hooks registered with OnSnapshot, OnRollback, and OnDestroy are called for the changes made by other clients even
+// when the Library is not used otherwise. Without it, they are noticed whenever the Library reads the metadata with a
+// strongly consistent read, e.g., before taking a snapshot, or with WithConsistentMetadata.
+//
+// Every read costs 1RU.
+func WithMetadataPolling(interval time.Duration) Option {
+	return func(c *Library) {
+		c.metaPolling = interval
+	}
+}
+
+// WithPersistentJobs saves the state of every bulk operation run as a Job (see Library.Jobs) in the table's metadata:
+// when it starts, at most once every interval as it makes progress (every 10 seconds if interval is 0), and once it
+// is over. Any process can then list the jobs (see ListJobs) and resume one that was interrupted, e.g., by a crash or
+// a redeployment, where it stopped (see InFlightJobs and ResumeJob). Only the 20 most recent jobs that are over are
+// kept.
+//
+// Every save costs 1WU (and 1RU once the job is over), and the jobs saved add to the size of the metadata read by
+// every other call.
+func WithPersistentJobs(interval time.Duration) Option {
+	return func(c *Library) {
+		c.persistJobs = true
+		c.jobSaveInterval = interval
+	}
+}
+
+// WithVersionAttribute stamps every item written with a reserved attribute, ddblibrarian_version, holding the name of
+// the snapshot it was written to (or "@baseline", see Baseline), when, according to the Library's Clock, as an RFC 3339
+// timestamp, and a random token unique to the write (see PutItemIfUnchangedSince). It lets consumers of the raw table,
+// e.g., DynamoDB exports to S3 or streams, tell where each item comes from without decoding the snapshot ID in its
+// partition key. The attribute is removed from the items the Library returns.
+func WithVersionAttribute() Option {
+	return func(c *Library) {
+		c.versionAttribute = true
+	}
+}
+
+// ShardFunc returns the shard suffix of a partition key, as passed by the caller, e.g., a hash of the key modulo the
+// number of shards. It must always return the same suffix for the same key, which must not include the delimiter.
+type ShardFunc func(key string) string
+
+// WithWriteSharding makes the Library manage write sharding on tables with a string partition key: every key is
+// stored as "<key><delimiter><shard(key)>" (and, within a snapshot, "<snapshot ID>.<key><delimiter><shard(key)>").
+// Callers only ever use, and get back, the key without the suffix.
+//
+// Tables that already shard their keys must use the same delimiter and function they have been using so far.
+func WithWriteSharding(delimiter string, shard ShardFunc) Option {
+	return func(c *Library) {
+		c.shardDelimiter = delimiter
+		c.shard = shard
+	}
+}
+
+// KeyCodec describes how snapshot IDs are added to string partition keys. The zero value is the default encoding,
+// "<snapshot ID>.<key>", which tables written before KeyCodec existed use.
+type KeyCodec struct {
+	// separates the snapshot ID from the key, "." if empty; it must never be part of a key
+	Delimiter string
+	// zero-pad snapshot IDs to this many digits, e.g., "0007.<key>", so that keys sort by snapshot
+	IDWidth int
+	// add the snapshot ID after the key, "<key>.<snapshot ID>", so that keys sort the same way within and across
+	// snapshots; DynamoDB can only look for it with contains, which requires IDWidth to be set
+	Suffix bool
+}
+
+// WithKeyCodec changes how snapshot IDs are added to string partition keys, e.g., to use a delimiter that keys
+// cannot include. Keys written before any snapshot was taken are not affected.
+//
+// All clients of a table must use the same codec, which cannot be changed once items have been written to snapshots:
+// the codec is recorded in the table's metadata along with the first snapshot, and clients configured with another
+// one fail to read the metadata. IDWidth must also be at least as wide as the table's snapshot IDs, 2 digits unless
+// SetSnapshotIDLength allows for more.
+func WithKeyCodec(codec KeyCodec) Option {
+	return func(c *Library) {
+		c.codec = codec
+	}
+}
+
+// KeyEncodingOrder is the order in which a Library in compatibility mode (see WithKeyEncodingCompatibility) looks for
+// an item in the two key encodings of a table that is being migrated.
+type KeyEncodingOrder int
+
+const (
+	// look in the encoding being migrated to first, which saves a read once most items have been converted
+	NewEncodingFirst KeyEncodingOrder = iota
+	// look in the encoding being migrated from first, which saves a read while most items have not
+	OldEncodingFirst
+)
+
+// WithKeyEncodingCompatibility lets clients keep writing to a table while MigrateKeyEncoding runs. As long as the
+// migration is in progress, items are written with the new encoding, and their copy in the old one, if any, is
+// removed; items are read from either, in the given order. Nothing changes once the migration is over.
+//
+// Without it, clients write with the old encoding until the migration is over, which it has to convert again.
+//
+// Overhead, while the migration is in progress: 1RU per item written by PutItem, UpdateItem, DeleteItem, or a
+// transaction, plus 4WU for each one not converted yet; 1WU per item written in a batch
+func WithKeyEncodingCompatibility(order KeyEncodingOrder) Option {
+	return func(c *Library) {
+		c.keyCompatibility = true
+		c.keyOrder = order
+	}
+}
+
+// SnapshotOption sets a precondition for taking a snapshot, or something to record about it. See Snapshot.
+type SnapshotOption func(*snapshotOptions)
+
+type snapshotOptions struct {
+	requireActiveEqualsLatest bool
+	requireTableActive        bool
+	description               string
+	tenant                    string
+	// leave the current snapshot as it is (see ImportSnapshot)
+	keepCurrent bool
+	// branch off the data written before any snapshots (see ImportSnapshot)
+	offBaseline bool
+}
+
+func newSnapshotOptions(opts []SnapshotOption) *snapshotOptions {
+	o := &snapshotOptions{requireActiveEqualsLatest: true}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// RequireActiveEqualsLatest sets whether the active snapshot must be the latest one, i.e., no rollback can be in
+// effect, to take a snapshot. It does by default. Otherwise, a snapshot taken while rolled back to an older one
+// branches off it: reading from the new snapshot falls back to the one it branches off, and its ancestors, instead of
+// the snapshots taken after it.
+func RequireActiveEqualsLatest(require bool) SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.requireActiveEqualsLatest = require
+	}
+}
+
+// RequireTableActive only takes a snapshot if the table is ACTIVE, e.g., not being updated or restored.
+func RequireTableActive() SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.requireTableActive = true
+	}
+}
+
+// return what to record about the snapshot along with when it was taken
+func (o *snapshotOptions) details() map[string]*dynamodb.AttributeValue {
+	details := make(map[string]*dynamodb.AttributeValue, 0)
+	// DynamoDB does not support empty strings
+	if o.description != "" {
+		details[snapshotInfoDescription] = &dynamodb.AttributeValue{S: aws.String(o.description)}
+	}
+	if o.tenant != "" {
+		details[snapshotInfoTenant] = &dynamodb.AttributeValue{S: aws.String(o.tenant)}
+	}
+	// recorded over whatever the snapshot would otherwise branch off
+	if o.offBaseline {
+		details[snapshotInfoParent] = parentAttributeValue("")
+	}
+
+	return details
+}
+
+// SnapshotDescription records a free-text description of the snapshot, e.g., why it was taken, along with it (see
+// DescribeSnapshot).
+func SnapshotDescription(description string) SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.description = description
+	}
+}
+
+// SnapshotTenant records that the snapshot is taken for the tenant whose partition keys start with prefix: restoring
+// it (see Restore) only restores that tenant's items, leaving every other tenant's as they are; it cannot be rolled
+// back to (see Rollback). Like any other snapshot, it keeps a copy of every item written while it is the current one.
+// Only tables with a string partition key can be scoped to tenants.
+func SnapshotTenant(prefix string) SnapshotOption {
+	return func(o *snapshotOptions) {
+		o.tenant = prefix
+	}
+}
+
+// DestroyOption changes how a snapshot is destroyed. See DestroySnapshot.
+type DestroyOption func(*destroyOptions)
+
+type destroyOptions struct {
+	force bool
+	// where to carry on deleting the items of the snapshot from (see ResumeJob)
+	resume   *ScanProgress
+	progress ProgressFunc
+}
+
+func newDestroyOptions(opts []DestroyOption) *destroyOptions {
+	o := &destroyOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// ForceDestroy allows destroying the active snapshot, or the latest one.
+func ForceDestroy() DestroyOption {
+	return func(o *destroyOptions) {
+		o.force = true
+	}
+}
+
+// DestroyProgress calls fn after each page of items is deleted, with the number of items deleted so far, the write
+// capacity consumed, and an estimate of the total (see Progress).
+func DestroyProgress(fn ProgressFunc) DestroyOption {
+	return func(o *destroyOptions) {
+		o.progress = fn
+	}
+}
+
+// RestoreOption changes how a snapshot is restored. See Restore.
+type RestoreOption func(*restoreOptions)
+
+type restoreOptions struct {
+	progress ProgressFunc
+}
+
+func newRestoreOptions(opts []RestoreOption) *restoreOptions {
+	o := &restoreOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// RestoreProgress calls fn as the items are copied and deleted, with the number of items written so far, the total,
+// and the write capacity consumed (see Progress).
+func RestoreProgress(fn ProgressFunc) RestoreOption {
+	return func(o *restoreOptions) {
+		o.progress = fn
+	}
+}
+
+// DiffOption changes how snapshots are compared. See DiffSnapshots.
+type DiffOption func(*diffOptions)
+
+type diffOptions struct {
+	keysOnly bool
+}
+
+func newDiffOptions(opts []DiffOption) *diffOptions {
+	o := &diffOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// DiffKeysOnly only reports which keys were added and removed, without comparing the attributes of the items found in
+// both snapshots.
+func DiffKeysOnly() DiffOption {
+	return func(o *diffOptions) {
+		o.keysOnly = true
+	}
+}
+
+// ExportOption changes how snapshots are exported. See ExportSnapshot.
+type ExportOption func(*exportOptions)
+
+type exportOptions struct {
+	parts int
+}
+
+func newExportOptions(opts []ExportOption) *exportOptions {
+	o := &exportOptions{parts: 4}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// ExportParts sets the number of objects an export is split into, all written in parallel (4 by default). Values
+// below 1 are ignored.
+func ExportParts(n int) ExportOption {
+	return func(o *exportOptions) {
+		if n > 0 {
+			o.parts = n
+		}
+	}
+}
+
+// CopyOption changes where a snapshot is copied to. See CopySnapshotTo.
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	snapshot        string
+	snapshotOptions []SnapshotOption
+}
+
+func newCopyOptions(opts []CopyOption) *copyOptions {
+	o := &copyOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// CopyIntoSnapshot copies into the snapshot with the given name on the destination, rather than into its active one.
+// If there is no such snapshot yet, it is taken, and becomes the active one, as Snapshot would with opts; a copy that
+// is resumed thus carries on writing to the snapshot taken the first time.
+func CopyIntoSnapshot(snapshot string, opts ...SnapshotOption) CopyOption {
+	return func(o *copyOptions) {
+		o.snapshot = snapshot
+		o.snapshotOptions = opts
+	}
+}
+
+// MigrationOption changes how MigrateKeyEncoding converts the keys of a table.
+type MigrationOption func(*migrationOptions)
+
+type migrationOptions struct {
+	noTrailingZeros bool
+	// where a resumed migration carries on from
+	resume *ScanProgress
+}
+
+func newMigrationOptions(opts []MigrationOption) *migrationOptions {
+	o := &migrationOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// KeysWithoutTrailingZeros tells MigrateKeyEncoding that no key written to a snapshot in the legacy encoding ends in 0
+// (e.g., 10, or 2000), so that every item is moved to the key it is stored with. Items written with such keys would
+// otherwise be moved to the wrong key, e.g., 1 instead of 10, where GetItem no longer finds them and where they may
+// take the place of another item. Items written with key 0 are stored just like items written with no snapshot, which
+// the migration leaves alone.
+func KeysWithoutTrailingZeros() MigrationOption {
+	return func(o *migrationOptions) {
+		o.noTrailingZeros = true
+	}
+}
@@ -0,0 +1,372 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// attribute, added to items with attributes stored in S3, that maps the name of each of them to its original type,
+// "S" or "B"; the attributes themselves hold the location of the object, s3://bucket/key
+const overflowAttribute = "ddblibrarian_overflow"
+
+// how recently an object must have been stored for SweepOverflow to leave it alone, whether any item points to it or
+// not: values are stored in S3 before the items that point to them are written
+const overflowSweepGrace = time.Hour
+
+// the subset of s3.S3 used to delete the objects no item points to anymore
+type objectSweeper interface {
+	ListObjectsV2PagesWithContext(
+		ctx aws.Context,
+		input *s3.ListObjectsV2Input,
+		fn func(*s3.ListObjectsV2Output, bool) bool,
+		opts ...request.Option,
+	) error
+	DeleteObjectWithContext(
+		ctx aws.Context,
+		input *s3.DeleteObjectInput,
+		opts ...request.Option,
+	) (*s3.DeleteObjectOutput, error)
+}
+
+// replaced in tests
+var newObjectSweeper = func(p client.ConfigProvider) objectSweeper {
+	return s3.New(p)
+}
+
+// where, and which, attributes are stored in S3 (see WithOverflow)
+type overflowConfig struct {
+	bucket    string
+	prefix    string
+	threshold int
+	// empty means any attribute but the primary key
+	attributes map[string]bool
+	uploader   objectUploader
+	reader     objectReader
+	sweeper    objectSweeper
+}
+
+// store the attributes of an item that are too large (see WithOverflow) in S3, replacing them with pointers, and
+// return a function that restores the item to its original state. Items written by operation must not list pointers
+// of their own, whether the Library stores attributes in S3 or not: readers would fetch whatever objects they named.
+func (c *Library) overflowItem(
+	ctx aws.Context,
+	operation string,
+	item map[string]*dynamodb.AttributeValue,
+) (func(), error) {
+	if _, ok := item[overflowAttribute]; ok {
+		return nil, &UnsupportedInputError{
+			Operation: operation,
+			Feature:   overflowAttribute,
+			Reason:    "the attribute is reserved for the values the Library stores in S3",
+		}
+	}
+	if c.overflow == nil {
+		return func() {}, nil
+	}
+
+	marker := make(map[string]*dynamodb.AttributeValue, 0)
+	originals := make(map[string]*dynamodb.AttributeValue, 0)
+	restore := func() {
+		for name, v := range originals {
+			item[name] = v
+		}
+		delete(item, overflowAttribute)
+	}
+
+	for name, v := range item {
+		if name == c.partitionKey || name == c.rangeKey {
+			continue
+		}
+		if len(c.overflow.attributes) > 0 && !c.overflow.attributes[name] {
+			continue
+		}
+
+		var raw []byte
+		var dataType string
+		switch {
+		case v.S != nil:
+			raw, dataType = []byte(*v.S), "S"
+		case v.B != nil:
+			raw, dataType = v.B, "B"
+		default:
+			continue
+		}
+		if len(raw) < c.overflow.threshold {
+			continue
+		}
+
+		location, err := c.uploadOverflow(ctx, raw)
+		if err != nil {
+			restore()
+			return nil, wrapError("failed to store attribute "+name+" in S3", err)
+		}
+		originals[name] = v
+		item[name] = &dynamodb.AttributeValue{S: aws.String(location)}
+		marker[name] = &dynamodb.AttributeValue{S: aws.String(dataType)}
+	}
+	if len(marker) == 0 {
+		return func() {}, nil
+	}
+	item[overflowAttribute] = &dynamodb.AttributeValue{M: marker}
+
+	return restore, nil
+}
+
+// refuse an update by operation that sets, or removes, the attribute listing the pointers to S3 (see overflowItem)
+func checkOverflowUpdate(
+	operation string,
+	expression *string,
+	names map[string]*string,
+	updates map[string]*dynamodb.AttributeValueUpdate,
+) error {
+	_, updated := updates[overflowAttribute]
+	for _, name := range names {
+		updated = updated || aws.StringValue(name) == overflowAttribute
+	}
+	if updated || strings.Contains(aws.StringValue(expression), overflowAttribute) {
+		return &UnsupportedInputError{
+			Operation: operation,
+			Feature:   overflowAttribute,
+			Reason:    "the attribute is reserved for the values the Library stores in S3",
+		}
+	}
+
+	return nil
+}
+
+// return the key of the object a value is stored in: named after its content, under the table's prefix
+func (c *Library) overflowKey(sum string) string {
+	return path.Join(c.overflow.prefix, c.tableName, sum)
+}
+
+// store a value in S3, named after its content, and return its location
+func (c *Library) uploadOverflow(ctx aws.Context, raw []byte) (string, error) {
+	sum := sha256.Sum256(raw)
+	key := c.overflowKey(hex.EncodeToString(sum[:]))
+
+	_, err := c.overflow.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(c.overflow.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(raw),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return s3Scheme + c.overflow.bucket + "/" + key, nil
+}
+
+// fetch the attributes listed by the overflow marker of an item read from the table, if it has one, from S3;
+// attributes that have since been overwritten (e.g., by UpdateItem, which does not overflow) are left as they are.
+// Only objects the Library would have stored the value in are read (see downloadOverflow).
+func (c *Library) loadOverflow(ctx aws.Context, item map[string]*dynamodb.AttributeValue) error {
+	marker, ok := item[overflowAttribute]
+	if !ok {
+		return nil
+	}
+	delete(item, overflowAttribute)
+
+	for name, dataType := range marker.M {
+		v, ok := item[name]
+		if !ok || v.S == nil || !strings.HasPrefix(*v.S, s3Scheme) {
+			continue
+		}
+
+		raw, err := c.downloadOverflow(ctx, *v.S)
+		if err != nil {
+			return wrapError("failed to read attribute "+name+" from S3", err)
+		}
+		if aws.StringValue(dataType.S) == "S" {
+			item[name] = &dynamodb.AttributeValue{S: aws.String(string(raw))}
+		} else {
+			item[name] = &dynamodb.AttributeValue{B: raw}
+		}
+	}
+
+	return nil
+}
+
+// read the value stored at location, s3://bucket/key, which must be an object named after its content in the bucket
+// and under the prefix the Library stores values in (see WithOverflow), and hold that very content
+func (c *Library) downloadOverflow(ctx aws.Context, location string) ([]byte, error) {
+	if c.overflow == nil {
+		return nil, errors.New("values stored in S3 can only be read with WithOverflow")
+	}
+	bucket, key, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+	sum := path.Base(key)
+	if bucket != c.overflow.bucket || key != c.overflowKey(sum) || !isSHA256(sum) {
+		return nil, errors.New("not an object the values of this table are stored in: " + location)
+	}
+
+	var reader objectReader
+	switch {
+	case c.overflow.reader != nil:
+		reader = c.overflow.reader
+	case c.provider != nil:
+		reader = newObjectReader(c.provider)
+	default:
+		return nil, errors.New("cannot read from S3 without an AWS session")
+	}
+
+	body, err := getObject(ctx, reader, bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if actual := sha256.Sum256(raw); hex.EncodeToString(actual[:]) != sum {
+		return nil, errors.New("the content of the object does not match its name: " + location)
+	}
+
+	return raw, nil
+}
+
+// return true if s is a SHA-256 sum as objects are named after (see uploadOverflow)
+func isSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size && hex.EncodeToString(b) == s
+}
+
+// SweepOverflow deletes the objects WithOverflow stored values of the table in that no item points to anymore, e.g.,
+// once the snapshots they were written to are destroyed (see DestroySnapshot, Prune, and CollectGarbage), or the
+// items are purged (see PurgeItem), and returns the number of objects deleted. Objects stored within the last hour are
+// left for the next sweep, as the items that point to them may not have been written yet.
+//
+// Every version of every item is read, to find the objects still pointed to, before any is deleted; only their
+// locations are kept in memory.
+//
+// Cost: a full table scan + 1 S3 list request per 1000 objects + 1 S3 delete request per object deleted
+func (c *Library) SweepOverflow() (int64, error) {
+	return c.SweepOverflowWithContext(aws.BackgroundContext())
+}
+
+// SweepOverflowWithContext is the same as SweepOverflow with the addition of the ability to pass a context, which is
+// passed on to every request made to the table and to S3.
+func (c *Library) SweepOverflowWithContext(ctx aws.Context) (int64, error) {
+	if c.overflow == nil || c.overflow.sweeper == nil {
+		return 0, errors.New("values stored in S3 can only be swept with WithOverflow")
+	}
+	// objects stored after the table has been scanned may be pointed to by items the scan did not see
+	before := c.clock.Now().Add(-overflowSweepGrace)
+
+	referenced, err := c.referencedOverflow(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var stale []string
+	err = c.overflow.sweeper.ListObjectsV2PagesWithContext(
+		ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(c.overflow.bucket),
+			Prefix: aws.String(c.overflowKey("") + "/"),
+		},
+		func(page *s3.ListObjectsV2Output, last bool) bool {
+			for _, object := range page.Contents {
+				key := aws.StringValue(object.Key)
+				// only objects the Library would have stored a value in
+				if key != c.overflowKey(path.Base(key)) || !isSHA256(path.Base(key)) {
+					continue
+				}
+				if referenced[key] || object.LastModified == nil || !object.LastModified.Before(before) {
+					continue
+				}
+				stale = append(stale, key)
+			}
+			return true
+		},
+	)
+	if err != nil {
+		return 0, wrapError("failed to list the objects in S3", err)
+	}
+
+	var deleted int64
+	for _, key := range stale {
+		_, err := c.overflow.sweeper.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(c.overflow.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return deleted, wrapError("failed to delete "+key, err)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// return the keys of the objects in S3 that any version of any item points to
+func (c *Library) referencedOverflow(ctx aws.Context) (map[string]bool, error) {
+	referenced := make(map[string]bool, 0)
+
+	input := c.tableScanInput()
+	input.ConsistentRead = aws.Bool(true)
+	for {
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			marker, ok := item[overflowAttribute]
+			if !ok {
+				continue
+			}
+			for name := range marker.M {
+				v, ok := item[name]
+				if !ok || v.S == nil || !strings.HasPrefix(*v.S, s3Scheme) {
+					continue
+				}
+				bucket, key, err := parseS3Location(*v.S)
+				if err == nil && bucket == c.overflow.bucket {
+					referenced[key] = true
+				}
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return referenced, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,327 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_overflowItem(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	c := &Library{
+		tableName:    "movies",
+		partitionKey: "year",
+		rangeKey:     "title",
+		overflow: &overflowConfig{
+			bucket:     "large",
+			prefix:     "items",
+			threshold:  10,
+			attributes: map[string]bool{},
+			uploader:   fake,
+			reader:     fake,
+		},
+	}
+	ctx := aws.BackgroundContext()
+	copyItem := func(item map[string]*dynamodb.AttributeValue) map[string]*dynamodb.AttributeValue {
+		itemCopy := make(map[string]*dynamodb.AttributeValue, len(item))
+		for k, v := range item {
+			itemCopy[k] = v
+		}
+		return itemCopy
+	}
+
+	original := map[string]*dynamodb.AttributeValue{
+		"year":   {N: aws.String("2017")},
+		"title":  {S: aws.String(strings.Repeat("a very long title ", 10))},
+		"plot":   {S: aws.String(strings.Repeat("plot ", 100))},
+		"poster": {B: []byte(strings.Repeat("x", 100))},
+		"rating": {N: aws.String("1234567890123")},
+		"tag":    {S: aws.String("short")},
+	}
+	item := copyItem(original)
+
+	restore, err := c.overflowItem(ctx, "PutItem", item)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	marker := item[overflowAttribute]
+	if marker == nil || len(marker.M) != 2 || aws.StringValue(marker.M["plot"].S) != "S" ||
+		aws.StringValue(marker.M["poster"].S) != "B" {
+		t.Error("expected plot and poster to overflow, got", marker)
+	}
+	if !strings.HasPrefix(aws.StringValue(item["plot"].S), "s3://large/items/movies/") {
+		t.Error("unexpected pointer", item["plot"])
+	}
+	if item["title"] != original["title"] || item["rating"] != original["rating"] || item["tag"] != original["tag"] {
+		t.Error("expected the primary key, numbers, and short values to stay on the table")
+	}
+	if len(fake.objects) != 2 {
+		t.Error("expected 2 objects, got", len(fake.objects))
+	}
+
+	stored := copyItem(item)
+	restore()
+	if !reflect.DeepEqual(item, original) {
+		t.Error("expected the item to be restored, got", item)
+	}
+
+	// fetched back when read
+	err = c.loadOverflow(ctx, stored)
+	if err != nil || !reflect.DeepEqual(stored, original) {
+		t.Error("expected", original, "got", stored, err)
+	}
+
+	// values overwritten since, e.g., by UpdateItem, are left as they are
+	item = copyItem(original)
+	_, _ = c.overflowItem(ctx, "PutItem", item)
+	item["plot"] = &dynamodb.AttributeValue{S: aws.String("rewritten")}
+	err = c.loadOverflow(ctx, item)
+	if err != nil || aws.StringValue(item["plot"].S) != "rewritten" || item["poster"].B == nil {
+		t.Error("expected only the poster to be fetched, got", item, err)
+	}
+
+	// only the attributes named
+	c.overflow.attributes = map[string]bool{"poster": true}
+	item = copyItem(original)
+	_, _ = c.overflowItem(ctx, "PutItem", item)
+	if len(item[overflowAttribute].M) != 1 || item["plot"] != original["plot"] {
+		t.Error("expected only the poster to overflow, got", item)
+	}
+
+	// nothing changes if the upload fails
+	fake.fail = errors.New("access denied")
+	item = copyItem(original)
+	_, err = c.overflowItem(ctx, "PutItem", item)
+	if err == nil || !reflect.DeepEqual(item, original) {
+		t.Error("expected an error and the item untouched, got", item, err)
+	}
+	fake.fail = nil
+
+	// missing objects are errors, rather than pointers passed off as values
+	item = copyItem(original)
+	_, _ = c.overflowItem(ctx, "PutItem", item)
+	fake.objects = make(map[string][]byte)
+	err = c.loadOverflow(ctx, item)
+	if err == nil {
+		t.Error("expected an error for a missing object")
+	}
+
+	// writers cannot list pointers of their own, with or without WithOverflow
+	item = copyItem(original)
+	item[overflowAttribute] = &dynamodb.AttributeValue{
+		M: map[string]*dynamodb.AttributeValue{"tag": {S: aws.String("S")}},
+	}
+	var unsupported *UnsupportedInputError
+	if _, err := c.overflowItem(ctx, "PutItem", item); !errors.As(err, &unsupported) {
+		t.Error("expected an UnsupportedInputError for a pointer written by the caller, got", err)
+	}
+	if _, err := (&Library{}).overflowItem(ctx, "PutItem", item); !errors.As(err, &unsupported) {
+		t.Error("expected an UnsupportedInputError without WithOverflow, got", err)
+	}
+	names := map[string]*string{"#o": aws.String(overflowAttribute)}
+	if err := checkOverflowUpdate("UpdateItem", aws.String("REMOVE #o"), names, nil); err == nil {
+		t.Error("expected an error updating the pointers")
+	}
+	if err := checkOverflowUpdate("UpdateItem", aws.String("SET tag = :tag"), nil, nil); err != nil {
+		t.Error("expected no errors, got", err)
+	}
+}
+
+func TestLibrary_downloadOverflow(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	c := &Library{
+		tableName: "movies",
+		overflow:  &overflowConfig{bucket: "large", prefix: "items", uploader: fake, reader: fake},
+	}
+	ctx := aws.BackgroundContext()
+
+	location, err := c.uploadOverflow(ctx, []byte("the plot"))
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if raw, err := c.downloadOverflow(ctx, location); err != nil || string(raw) != "the plot" {
+		t.Error("expected the value back, got", string(raw), err)
+	}
+
+	// only objects named after their content, in the bucket and under the prefix values are stored in, are read
+	sum := strings.TrimPrefix(location, "s3://large/items/movies/")
+	fake.objects["secrets/items/movies/"+sum] = []byte("the plot")
+	fake.objects["large/elsewhere/"+sum] = []byte("the plot")
+	fake.objects["large/items/movies/passwords"] = []byte("the plot")
+	for _, other := range []string{
+		"s3://secrets/items/movies/" + sum,
+		"s3://large/elsewhere/" + sum,
+		"s3://large/items/movies/passwords",
+		"s3://large/items/movies/../movies/" + sum,
+	} {
+		if _, err := c.downloadOverflow(ctx, other); err == nil {
+			t.Error("expected an error reading", other)
+		}
+	}
+	fake.objects["large/items/movies/"+sum] = []byte("another plot")
+	if _, err := c.downloadOverflow(ctx, location); err == nil {
+		t.Error("expected an error for an object that does not match its name")
+	}
+
+	// nor are pointers followed without WithOverflow
+	if _, err := (&Library{tableName: "movies"}).downloadOverflow(ctx, location); err == nil {
+		t.Error("expected an error without WithOverflow")
+	}
+}
+
+func TestLibrary_WithOverflow(t *testing.T) {
+	_, restore := useFakeS3(t)
+	defer restore()
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		overflowing := newClient(schema, t, WithOverflow("large", "items", 1024, valueField))
+
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		item := getAttributeValueForItem(schema, "")
+		item[valueField] = &dynamodb.AttributeValue{S: aws.String(strings.Repeat("x", 4096))}
+		_, err = overflowing.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      item,
+		})
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+
+		// only a pointer is stored on the table
+		meta, _ := library.loadMeta(aws.BackgroundContext())
+		id, _ := meta.getSnapshotID("snap")
+		out, err := testService(t).GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       library.keyWithSnapshot(getAttributeValueForKey(schema), id),
+		})
+		if err != nil || !strings.HasPrefix(aws.StringValue(out.Item[valueField].S), s3Scheme) {
+			t.Error("expected a pointer to S3, got", out.Item, err)
+		}
+
+		// clients configured alike read the item as it was written, others cannot follow the pointer
+		got, err := overflowing.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err != nil || !reflect.DeepEqual(got.Item, item) {
+			t.Error("expected", item, "got", got, err)
+		}
+		_, err = library.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err == nil {
+			t.Error("expected an error reading the item without WithOverflow")
+		}
+		items, err := overflowing.ScanAllFromSnapshot(
+			&dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}, "snap", nil)
+		if err != nil || len(items) != 1 || !reflect.DeepEqual(items[0], item) {
+			t.Error("expected", item, "got", items, err)
+		}
+		merged, err := overflowing.ScanMerged("snap")
+		if err != nil || len(merged) != 1 || !reflect.DeepEqual(merged[0], item) {
+			t.Error("expected", item, "got", merged, err)
+		}
+		diff, err := overflowing.DiffSnapshots(Baseline, "snap")
+		if err != nil || len(diff.Added) != 1 || !reflect.DeepEqual(diff.Added[0], item) {
+			t.Error("expected", item, "to be added, got", diff, err)
+		}
+
+		// copies made on restore keep pointing to the same object
+		err = library.Snapshot("later")
+		if err != nil {
+			t.Error(err)
+		}
+		err = library.Restore("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		got, err = overflowing.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err != nil || !reflect.DeepEqual(got.Item, item) {
+			t.Error("expected", item, "got", got, err)
+		}
+
+		_, err = NewWithOptions(getTableName(schema), partitionKey, partitionKeyType[schema], rangeKey[schema],
+			rangeKeyType[schema], testSession(t), WithOverflow("large", "", 1024, partitionKey))
+		if err == nil {
+			t.Error("expected an error when the primary key can overflow")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_SweepOverflow(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte), modified: make(map[string]time.Time)}
+	clock := &fakeClock{now: time.Now()}
+	c := &Library{
+		tableName:    "movies",
+		partitionKey: "year",
+		clock:        clock,
+		overflow:     &overflowConfig{bucket: "large", prefix: "items", uploader: fake, reader: fake, sweeper: fake},
+	}
+	ctx := aws.BackgroundContext()
+
+	kept, _ := c.uploadOverflow(ctx, []byte("still pointed to"))
+	stale, _ := c.uploadOverflow(ctx, []byte("no longer pointed to"))
+	recent, _ := c.uploadOverflow(ctx, []byte("not pointed to yet"))
+	fake.modified[strings.TrimPrefix(recent, "s3://")] = clock.now.Add(-time.Minute)
+	fake.objects["large/items/movies/notes"] = []byte("not a value")
+	fake.objects["large/items/shows/"+strings.TrimPrefix(stale, "s3://large/items/movies/")] = []byte("another table")
+	c.svc = &legacyItemsStorage{items: []map[string]*dynamodb.AttributeValue{
+		{"year": {N: aws.String("1.2017")}, "title": {S: aws.String("no values in S3")}},
+		{
+			"year":            {N: aws.String("2.2017")},
+			"plot":            {S: aws.String(kept)},
+			overflowAttribute: {M: map[string]*dynamodb.AttributeValue{"plot": {S: aws.String("S")}}},
+		},
+	}}
+
+	deleted, err := c.SweepOverflow()
+	if err != nil || deleted != 1 {
+		t.Error("expected a single object to be deleted, got", deleted, err)
+	}
+	if _, ok := fake.objects[strings.TrimPrefix(stale, "s3://")]; ok {
+		t.Error("expected the object no item points to to be deleted")
+	}
+	if len(fake.objects) != 4 {
+		t.Error("expected every other object to be kept, got", len(fake.objects))
+	}
+
+	// nor is there anything to sweep without WithOverflow
+	if _, err := (&Library{tableName: "movies"}).SweepOverflow(); err == nil {
+		t.Error("expected an error without WithOverflow")
+	}
+}
@@ -0,0 +1,217 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// what a page token stands for: where to resume a scan of a snapshot of a table
+type pageToken struct {
+	Table    string `json:"t"`
+	Snapshot string `json:"s"`
+	// which of the snapshots that had that ID it is (see snapshotGeneration)
+	Generation string                         `json:"g,omitempty"`
+	Key        map[string]*jsonAttributeValue `json:"k"`
+}
+
+// ScanPageFromSnapshot reads a single page of the items of snapshot that match input, as ScanFromSnapshot would,
+// starting after token, or from the beginning if token is empty, and returns it along with the token of the next
+// page, which is empty after the last one.
+//
+// Unlike LastEvaluatedKey, which ScanPageFromSnapshot leaves out of the output, tokens hold the key the scan stopped
+// at without the snapshot added to its partition key, so they can be stored and passed back later to resume the scan.
+// They are neither encrypted nor signed, only base64-encoded: anyone holding a token can read the key, the table's
+// name, and the snapshot's ID in it, and forge another one, so tokens handed out to the clients of an API should be
+// encrypted by the API. A token can only resume a scan of the snapshot, and table, it was returned for, and no longer
+// does once the snapshot is destroyed, even if its ID is reused; input must not set ExclusiveStartKey.
+//
+// Overhead: 1RU
+func (c *Library) ScanPageFromSnapshot(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	token string,
+) (*dynamodb.ScanOutput, string, error) {
+	return c.ScanPageFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot, token)
+}
+
+// ScanPageFromSnapshotWithContext is the same as ScanPageFromSnapshot with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) ScanPageFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	token string,
+) (*dynamodb.ScanOutput, string, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(input.ExclusiveStartKey) > 0 {
+		return nil, "", errors.New("ExclusiveStartKey cannot be used along with a page token")
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := meta.getScanSnapshotID(snapshot)
+	if err != nil {
+		return nil, "", err
+	}
+
+	generation := snapshotGeneration(meta, id)
+	inputCopy := *input
+	inputCopy.ExclusiveStartKey, err = c.decodePageToken(token, id, generation)
+	if err != nil {
+		return nil, "", err
+	}
+
+	out, err := c.scanWithSnapshotID(ctx, &inputCopy, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	next, err := c.encodePageToken(out.LastEvaluatedKey, id, generation)
+	if err != nil {
+		return nil, "", err
+	}
+	out.LastEvaluatedKey = nil
+
+	return out, next, nil
+}
+
+// ScanIteratorFromPageToken is the same as ScanIteratorFromSnapshot, starting after the page token (see
+// ScanPageFromSnapshot), e.g., as returned by the PageToken of another iterator, or from the beginning if token is
+// empty; input must not set ExclusiveStartKey.
+//
+// Cost: a full table scan (unless the snapshot index is enabled), a page at a time
+func (c *Library) ScanIteratorFromPageToken(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	token string,
+) (*ScanIterator, error) {
+	return c.ScanIteratorFromPageTokenWithContext(aws.BackgroundContext(), input, snapshot, token)
+}
+
+// ScanIteratorFromPageTokenWithContext is the same as ScanIteratorFromPageToken with the addition of the ability to
+// pass a context, which is passed on to every request made to the table.
+func (c *Library) ScanIteratorFromPageTokenWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	token string,
+) (*ScanIterator, error) {
+	if len(input.ExclusiveStartKey) > 0 {
+		return nil, errors.New("ExclusiveStartKey cannot be used along with a page token")
+	}
+
+	it, err := c.ScanIteratorFromSnapshotWithContext(ctx, input, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	it.input.ExclusiveStartKey, err = c.decodePageToken(token, it.id, it.generation)
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// PageToken returns the page token of the page after the last one read (see ScanPageFromSnapshot), to resume the
+// scan after it once all of its items have been processed; it is empty after the last page.
+func (it *ScanIterator) PageToken() (string, error) {
+	return it.library.encodePageToken(it.lastKey, it.id, it.generation)
+}
+
+// return what tells the snapshot with the given ID apart from the ones that had the same ID before it was taken, or
+// will after it is destroyed (see getNextAvailableID): its name and when it was taken, if that was recorded
+func snapshotGeneration(meta *config, id string) string {
+	name, err := meta.getSnapshotName(id)
+	if err != nil || name == "" {
+		return ""
+	}
+
+	created := meta.getSnapshotInfo(name, snapshotInfoCreated)
+	if created == nil {
+		return name
+	}
+
+	return name + "@" + aws.StringValue(created.S)
+}
+
+// return the token that resumes a scan of the snapshot with the given ID and generation (see snapshotGeneration)
+// after lastKey, or an empty one if there is nothing left to read
+func (c *Library) encodePageToken(
+	lastKey map[string]*dynamodb.AttributeValue,
+	id string,
+	generation string,
+) (string, error) {
+	if len(lastKey) == 0 {
+		return "", nil
+	}
+
+	b, err := json.Marshal(&pageToken{
+		Table:      c.tableName,
+		Snapshot:   id,
+		Generation: generation,
+		Key:        toJSONItem(lastKey),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// return the ExclusiveStartKey token stands for, which must have been returned for a scan of the snapshot with the
+// given ID and generation, or nil if token is empty
+func (c *Library) decodePageToken(
+	token string,
+	id string,
+	generation string,
+) (map[string]*dynamodb.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, wrapError("invalid page token", err)
+	}
+	decoded := &pageToken{}
+	err = json.Unmarshal(b, decoded)
+	if err != nil {
+		return nil, wrapError("invalid page token", err)
+	}
+	if decoded.Table != c.tableName || decoded.Snapshot != id || decoded.Generation != generation ||
+		len(decoded.Key) == 0 {
+		return nil, errors.New("the page token was not returned for a scan of this snapshot")
+	}
+
+	return fromJSONItem(decoded.Key), nil
+}
@@ -0,0 +1,164 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_pageTokens(t *testing.T) {
+	library := &Library{tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+	key := map[string]*dynamodb.AttributeValue{
+		"year":  {N: aws.String("3.2017")},
+		"title": {S: aws.String("The Big New Movie")},
+	}
+
+	token, err := library.encodePageToken(key, "3", "snap@2017")
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if strings.Contains(token, "2017") || strings.Contains(token, "=") {
+		t.Error("expected an opaque, URL safe token, got", token)
+	}
+	decoded, err := library.decodePageToken(token, "3", "snap@2017")
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if !reflect.DeepEqual(decoded, key) {
+		t.Error("expected", key, "got", decoded)
+	}
+
+	// nothing left to read, or nothing read yet
+	if token, err := library.encodePageToken(nil, "3", "snap@2017"); token != "" || err != nil {
+		t.Error("expected an empty token after the last page, got", token, err)
+	}
+	if key, err := library.decodePageToken("", "3", "snap@2017"); key != nil || err != nil {
+		t.Error("expected no key for an empty token, got", key, err)
+	}
+
+	// tokens only resume the scan they were returned for
+	if _, err := library.decodePageToken(token, "4", "snap@2017"); err == nil {
+		t.Error("expected error resuming a scan of another snapshot")
+	}
+	if _, err := library.decodePageToken(token, "3", "snap@2018"); err == nil {
+		t.Error("expected error resuming a scan of a snapshot that reused the ID")
+	}
+	other := &Library{tableName: "series", partitionKey: "year", partitionKeyType: "N"}
+	if _, err := other.decodePageToken(token, "3", "snap@2017"); err == nil {
+		t.Error("expected error resuming a scan of another table")
+	}
+	for _, invalid := range []string{"not a token", "bm90IGpzb24"} {
+		if _, err := library.decodePageToken(invalid, "3", "snap@2017"); err == nil {
+			t.Error("expected error decoding", invalid)
+		}
+	}
+}
+
+func TestSnapshotGeneration(t *testing.T) {
+	created := time.Date(2017, 10, 10, 10, 10, 10, 0, time.UTC)
+	meta := &config{
+		snapshots: map[string]*dynamodb.AttributeValue{
+			"old": {S: aws.String("1")},
+			"new": {S: aws.String("2")},
+		},
+		snapshotInfo: map[string]*dynamodb.AttributeValue{
+			"new": {M: map[string]*dynamodb.AttributeValue{snapshotInfoCreated: timeToAttributeValue(created)}},
+		},
+	}
+
+	for id, expected := range map[string]string{
+		"1":            "old",
+		"2":            "new@2017-10-10T10:10:10Z",
+		"":             "",
+		allSnapshotsID: "",
+	} {
+		if generation := snapshotGeneration(meta, id); generation != expected {
+			t.Error("expected", expected, "for", id, "got", generation)
+		}
+	}
+}
+
+func TestLibrary_ScanPageFromSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 5, t)
+		library.Snapshot("snap")
+		nItems := 12
+		putItems(library, schema, nItems, t)
+
+		// small pages, so that several of them are read, each from a token only
+		input := &dynamodb.ScanInput{TableName: aws.String(getTableName(schema)), Limit: aws.Int64(5)}
+		seen := make(map[string]int, 0)
+		token := ""
+		for {
+			page, next, err := library.ScanPageFromSnapshot(input, "snap", token)
+			if err != nil {
+				t.Fatal("expected no errors, got", err)
+			}
+			if page.LastEvaluatedKey != nil {
+				t.Error("expected no LastEvaluatedKey, got", page.LastEvaluatedKey)
+			}
+			for _, item := range page.Items {
+				seen[*getPartitionKeyValue(schema, item)]++
+			}
+			if next == "" {
+				break
+			}
+			token = next
+		}
+		for i := 0; i < nItems; i++ {
+			if seen[strconv.Itoa(i)] != 1 {
+				t.Error("expected key", i, "exactly once, got", seen[strconv.Itoa(i)])
+			}
+		}
+
+		// the iterator picks up where a page left off
+		first, token, err := library.ScanPageFromSnapshot(input, "snap", "")
+		if err != nil || token == "" {
+			t.Fatal("expected a token for the next page, got", token, err)
+		}
+		it, err := library.ScanIteratorFromPageToken(input, "snap", token)
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		n := 0
+		for it.Next() {
+			n++
+		}
+		if it.Err() != nil || n != nItems-len(first.Items) {
+			t.Error("expected", nItems-len(first.Items), "items after the first page, got", n, it.Err())
+		}
+
+		if _, _, err := library.ScanPageFromSnapshot(input, Baseline, token); err == nil {
+			t.Error("expected error resuming the scan of another snapshot")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,121 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// PinClient pins all clients created with the given client ID (see WithClientID) to snapshot: unless browsing some
+// other snapshot themselves, they read from it just as if they had called Browse. The pin is recorded in the
+// table's metadata, so it applies to every client with that ID, including the ones already running, until
+// UnpinClient is called; clients that cache the metadata (see WithMetadataCache) only see it once their cache is
+// dropped.
+//
+// Unlike Browse, this does not affect the client making the call, unless it shares the same client ID. Snapshots
+// clients are pinned to are never collected as garbage (see CollectGarbage).
+//
+// Cost: 1RU + 1WU
+func (c *Library) PinClient(clientID string, snapshot string) error {
+	return c.PinClientWithContext(aws.BackgroundContext(), clientID, snapshot)
+}
+
+// PinClientWithContext is the same as PinClient with the addition of the ability to pass a context, which is passed on
+// to every request made to the table.
+func (c *Library) PinClientWithContext(ctx aws.Context, clientID string, snapshot string) error {
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return err
+	}
+
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return meta.setBrowsePin(clientID, id)
+}
+
+// UnpinClient reverts PinClient: clients with the given client ID go back to reading from the active snapshot.
+//
+// Cost: 1RU + 1WU
+func (c *Library) UnpinClient(clientID string) error {
+	return c.UnpinClientWithContext(aws.BackgroundContext(), clientID)
+}
+
+// UnpinClientWithContext is the same as UnpinClient with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) UnpinClientWithContext(ctx aws.Context, clientID string) error {
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return err
+	}
+
+	return meta.removeBrowsePin(clientID)
+}
+
+// ClientPins returns the name of the snapshot each client ID is pinned to (see PinClient).
+//
+// Cost: 1RU
+func (c *Library) ClientPins() (map[string]string, error) {
+	return c.ClientPinsWithContext(aws.BackgroundContext())
+}
+
+// ClientPinsWithContext is the same as ClientPins with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) ClientPinsWithContext(ctx aws.Context) (map[string]string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make(map[string]string, len(meta.browsePins))
+	for clientID := range meta.browsePins {
+		id, ok := meta.getBrowsePin(clientID)
+		if !ok {
+			continue
+		}
+		name, err := meta.getSnapshotName(id)
+		if err != nil {
+			return nil, err
+		}
+		pins[clientID] = name
+	}
+
+	return pins, nil
+}
+
+// return the ID of the snapshot to read from: the one being browsed, if any, or the one this client is pinned to, or
+// the active one as set in the table's metadata
+func (c *Library) activeSnapshotID(meta *config) string {
+	if c.isBrowsing() {
+		return c.currentSnapshot
+	}
+	if c.clientID != "" {
+		if id, ok := meta.getBrowsePin(c.clientID); ok {
+			return id
+		}
+	}
+
+	return meta.getCurrentSnapshotID()
+}
@@ -0,0 +1,89 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_PinClient(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+		worker := newClient(schema, t, WithClientID("workers"))
+		other := newClient(schema, t, WithClientID("others"))
+
+		// one version of the item in each snapshot
+		for _, s := range []string{"first", "second"} {
+			library.Snapshot(s)
+			library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: getAttributeValueForItem(schema, s)})
+		}
+
+		get := func(c *Library) string {
+			out, err := c.GetItem(&dynamodb.GetItemInput{TableName: table, Key: getAttributeValueForKey(schema)})
+			if err != nil || out.Item == nil {
+				t.Error("expected no errors, got", err)
+				return ""
+			}
+			return *out.Item[valueField].S
+		}
+
+		err := library.PinClient("workers", "first")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		pins, err := library.ClientPins()
+		if err != nil || len(pins) != 1 || pins["workers"] != "first" {
+			t.Error("expected workers to be pinned to first, got", pins, err)
+		}
+		if v := get(worker); v != fmtValueTag("first") {
+			t.Error("expected the pinned client to read the first snapshot, got", v)
+		}
+		if v := get(other); v != fmtValueTag("second") {
+			t.Error("expected other clients to read the active snapshot, got", v)
+		}
+
+		// browsing takes precedence over the pin
+		worker.Browse("second")
+		if v := get(worker); v != fmtValueTag("second") {
+			t.Error("expected the browsed snapshot, got", v)
+		}
+		worker.StopBrowsing()
+
+		err = library.UnpinClient("workers")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if v := get(worker); v != fmtValueTag("second") {
+			t.Error("expected the unpinned client to read the active snapshot, got", v)
+		}
+
+		err = library.PinClient("workers", "nope")
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+
+		teardown(schema, t)
+	}
+}
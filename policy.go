@@ -0,0 +1,313 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SnapshotPolicy holds rules on snapshots that every Library using the table enforces (see SetSnapshotPolicy). The
+// rules are checked by each client before it makes any changes, not by DynamoDB: they keep well-behaved clients in
+// line, but do not replace IAM policies.
+type SnapshotPolicy struct {
+	// maximum number of snapshots; Snapshot fails once there are that many. 0 means no limit.
+	MaxSnapshots int
+	// regular expression the names of new snapshots must match in full, e.g., `\d{4}-\d{2}-\d{2}`. Empty means any
+	// name.
+	NamePattern string
+	// how long snapshots are kept, at least: DestroySnapshot fails on younger ones, and CollectGarbage leaves them
+	// for a later run. Snapshots taken before creation times were recorded are never retained. 0 means no retention.
+	Retention time.Duration
+	// client IDs (see WithClientID) allowed to Rollback, ScheduleRollback, and Restore. Empty means any client.
+	RollbackClients []string
+	// how old the newest snapshot can get before the table is reported as stale (see TableInventory), e.g., to notice
+	// when scheduled snapshots stop being taken. 0 means never.
+	MaxSnapshotAge time.Duration
+	// number of most recent snapshots Prune always keeps. 0 means Prune does not keep snapshots by number.
+	KeepLast int
+	// how old snapshots can get before Prune destroys them, unless KeepLast keeps them; it cannot be shorter than
+	// Retention. 0 means Prune destroys snapshots by number only. Prune destroys nothing if both are 0.
+	PruneAfter time.Duration
+}
+
+func (p *SnapshotPolicy) toAttributeValue() *dynamodb.AttributeValue {
+	m := map[string]*dynamodb.AttributeValue{
+		"max_snapshots": {N: aws.String(strconv.Itoa(p.MaxSnapshots))},
+		"retention":     {S: aws.String(p.Retention.String())},
+	}
+	if p.MaxSnapshotAge > 0 {
+		m["max_snapshot_age"] = &dynamodb.AttributeValue{S: aws.String(p.MaxSnapshotAge.String())}
+	}
+	if p.KeepLast > 0 {
+		m["keep_last"] = &dynamodb.AttributeValue{N: aws.String(strconv.Itoa(p.KeepLast))}
+	}
+	if p.PruneAfter > 0 {
+		m["prune_after"] = &dynamodb.AttributeValue{S: aws.String(p.PruneAfter.String())}
+	}
+
+	// DynamoDB does not support empty strings, nor empty sets
+	if p.NamePattern != "" {
+		m["name_pattern"] = &dynamodb.AttributeValue{S: aws.String(p.NamePattern)}
+	}
+	if len(p.RollbackClients) > 0 {
+		m["rollback_clients"] = &dynamodb.AttributeValue{SS: aws.StringSlice(p.RollbackClients)}
+	}
+
+	return &dynamodb.AttributeValue{M: m}
+}
+
+func snapshotPolicyFromAttributeValue(av *dynamodb.AttributeValue) (*SnapshotPolicy, error) {
+	// optional fields are simply missing
+	field := func(name string) string {
+		v, ok := av.M[name]
+		if !ok {
+			return ""
+		}
+		if v.N != nil {
+			return *v.N
+		}
+		return aws.StringValue(v.S)
+	}
+
+	p := &SnapshotPolicy{
+		NamePattern:     field("name_pattern"),
+		RollbackClients: make([]string, 0),
+	}
+	if clients, ok := av.M["rollback_clients"]; ok {
+		p.RollbackClients = aws.StringValueSlice(clients.SS)
+	}
+
+	var err error
+	p.MaxSnapshots, err = strconv.Atoi(field("max_snapshots"))
+	if err != nil {
+		return nil, wrapError("invalid maximum number of snapshots", err)
+	}
+	p.Retention, err = time.ParseDuration(field("retention"))
+	if err != nil {
+		return nil, wrapError("invalid retention", err)
+	}
+	// policies recorded before it was introduced have no maximum snapshot age
+	if age := field("max_snapshot_age"); age != "" {
+		p.MaxSnapshotAge, err = time.ParseDuration(age)
+		if err != nil {
+			return nil, wrapError("invalid maximum snapshot age", err)
+		}
+	}
+	// nor anything to prune
+	if keepLast := field("keep_last"); keepLast != "" {
+		p.KeepLast, err = strconv.Atoi(keepLast)
+		if err != nil {
+			return nil, wrapError("invalid number of snapshots to keep", err)
+		}
+	}
+	if pruneAfter := field("prune_after"); pruneAfter != "" {
+		p.PruneAfter, err = time.ParseDuration(pruneAfter)
+		if err != nil {
+			return nil, wrapError("invalid age to prune snapshots after", err)
+		}
+	}
+
+	return p, nil
+}
+
+// make sure the policy can be enforced
+func (p *SnapshotPolicy) validate() error {
+	if p.MaxSnapshots < 0 {
+		return errors.New("the maximum number of snapshots cannot be negative")
+	}
+	if p.Retention < 0 {
+		return errors.New("the retention cannot be negative")
+	}
+	if p.MaxSnapshotAge < 0 {
+		return errors.New("the maximum snapshot age cannot be negative")
+	}
+	if p.KeepLast < 0 {
+		return errors.New("the number of snapshots to keep cannot be negative")
+	}
+	if p.PruneAfter < 0 {
+		return errors.New("the age to prune snapshots after cannot be negative")
+	}
+	if p.PruneAfter > 0 && p.PruneAfter < p.Retention {
+		return errors.New("snapshots cannot be pruned before the end of their retention")
+	}
+	if _, err := p.namePattern(); err != nil {
+		return wrapError("invalid name pattern", err)
+	}
+	// they are stored as a string set
+	seen := make(map[string]bool, len(p.RollbackClients))
+	for _, clientID := range p.RollbackClients {
+		if clientID == "" || seen[clientID] {
+			return errors.New("client IDs allowed to roll back must be non-empty and distinct")
+		}
+		seen[clientID] = true
+	}
+
+	return nil
+}
+
+// return the name pattern, anchored to match whole names, or nil if there is none
+func (p *SnapshotPolicy) namePattern() (*regexp.Regexp, error) {
+	if p.NamePattern == "" {
+		return nil, nil
+	}
+
+	return regexp.Compile("^(?:" + p.NamePattern + ")$")
+}
+
+// SetSnapshotPolicy records policy in the table's metadata, replacing any policy recorded before, for every Library
+// using the table to enforce; a nil policy drops it. Clients that cache the metadata (see WithMetadataCache) only see
+// it once their cache is dropped. Snapshots that predate the policy are left as they are.
+//
+// Cost: 1RU + 1WU
+func (c *Library) SetSnapshotPolicy(policy *SnapshotPolicy) error {
+	return c.SetSnapshotPolicyWithContext(aws.BackgroundContext(), policy)
+}
+
+// SetSnapshotPolicyWithContext is the same as SetSnapshotPolicy with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) SetSnapshotPolicyWithContext(ctx aws.Context, policy *SnapshotPolicy) error {
+	var av *dynamodb.AttributeValue
+	if policy != nil {
+		if err := policy.validate(); err != nil {
+			return err
+		}
+		av = policy.toAttributeValue()
+	}
+
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return err
+	}
+
+	return meta.setSnapshotPolicy(av)
+}
+
+// SnapshotPolicy returns the policy recorded in the table's metadata, or nil if there is none.
+//
+// Cost: 1RU
+func (c *Library) SnapshotPolicy() (*SnapshotPolicy, error) {
+	return c.SnapshotPolicyWithContext(aws.BackgroundContext())
+}
+
+// SnapshotPolicyWithContext is the same as SnapshotPolicy with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) SnapshotPolicyWithContext(ctx aws.Context) (*SnapshotPolicy, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return meta.getSnapshotPolicy()
+}
+
+// return the snapshot policy, or nil if there is none
+func (s *config) getSnapshotPolicy() (*SnapshotPolicy, error) {
+	if s.snapshotPolicy == nil {
+		return nil, nil
+	}
+
+	return snapshotPolicyFromAttributeValue(s.snapshotPolicy)
+}
+
+// make sure the policy allows taking a new snapshot with the given name
+func (c *Library) checkSnapshotPolicy(meta *config, snapshot string) error {
+	policy, err := meta.getSnapshotPolicy()
+	if err != nil || policy == nil {
+		return err
+	}
+
+	if policy.MaxSnapshots > 0 && len(meta.snapshots) >= policy.MaxSnapshots {
+		return &PolicyViolationError{
+			Operation: "Snapshot",
+			Rule:      "MaxSnapshots",
+			Reason:    fmt.Sprintf("there are %d snapshots already, out of %d", len(meta.snapshots), policy.MaxSnapshots),
+		}
+	}
+
+	pattern, err := policy.namePattern()
+	if err != nil {
+		return err
+	}
+	if pattern != nil && !pattern.MatchString(snapshot) {
+		return &PolicyViolationError{
+			Operation: "Snapshot",
+			Rule:      "NamePattern",
+			Reason:    fmt.Sprintf("'%s' does not match %s", snapshot, policy.NamePattern),
+		}
+	}
+
+	return nil
+}
+
+// make sure the policy allows this client to change the data clients see to an older snapshot's
+func (c *Library) checkRollbackPolicy(meta *config, operation string) error {
+	policy, err := meta.getSnapshotPolicy()
+	if err != nil || policy == nil || len(policy.RollbackClients) == 0 {
+		return err
+	}
+
+	for _, clientID := range policy.RollbackClients {
+		if clientID == c.clientID {
+			return nil
+		}
+	}
+
+	return &PolicyViolationError{
+		Operation: operation,
+		Rule:      "RollbackClients",
+		Reason:    fmt.Sprintf("client '%s' is not allowed to roll back", c.clientID),
+	}
+}
+
+// return the PolicyViolationError for destroying snapshot, if the policy still retains it, or nil
+func (c *Library) checkRetentionPolicy(meta *config, operation string, snapshot string) error {
+	policy, err := meta.getSnapshotPolicy()
+	if err != nil || policy == nil || policy.Retention == 0 {
+		return err
+	}
+
+	av := meta.getSnapshotInfo(snapshot, snapshotInfoCreated)
+	if av == nil {
+		return nil
+	}
+	created, err := timeFromAttributeValue(av)
+	if err != nil {
+		return err
+	}
+
+	if age := c.clock.Now().Sub(created); age < policy.Retention {
+		return &PolicyViolationError{
+			Operation: operation,
+			Rule:      "Retention",
+			Reason:    fmt.Sprintf("snapshot '%s' is retained for %s, it was taken %s ago", snapshot, policy.Retention, age),
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSnapshotPolicy_toAttributeValue(t *testing.T) {
+	policies := []*SnapshotPolicy{
+		{RollbackClients: []string{}},
+		{MaxSnapshots: 30, NamePattern: `\d{4}-\d{2}-\d{2}`, Retention: 72 * time.Hour, RollbackClients: []string{"ops"}},
+		{RollbackClients: []string{}, MaxSnapshotAge: 26 * time.Hour},
+	}
+	for _, policy := range policies {
+		decoded, err := snapshotPolicyFromAttributeValue(policy.toAttributeValue())
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if !reflect.DeepEqual(decoded, policy) {
+			t.Error("expected", policy, "got", decoded)
+		}
+	}
+
+	invalid := []*SnapshotPolicy{
+		{MaxSnapshots: -1},
+		{Retention: -time.Hour},
+		{MaxSnapshotAge: -time.Hour},
+		{NamePattern: "("},
+		{RollbackClients: []string{"ops", "ops"}},
+	}
+	for _, policy := range invalid {
+		if err := policy.validate(); err == nil {
+			t.Error("expected an error validating", policy)
+		}
+	}
+}
+
+func TestLibrary_SetSnapshotPolicy(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)}
+		admin := newClient(schema, t, WithClock(clock), WithClientID("admin"))
+
+		policy := &SnapshotPolicy{
+			MaxSnapshots:    2,
+			NamePattern:     `\d+`,
+			Retention:       time.Hour,
+			RollbackClients: []string{"admin"},
+		}
+		err := library.SetSnapshotPolicy(policy)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		stored, err := library.SnapshotPolicy()
+		if err != nil || !reflect.DeepEqual(stored, policy) {
+			t.Error("expected", policy, "got", stored, err)
+		}
+
+		violates := func(err error, rule string) {
+			if e, ok := err.(*PolicyViolationError); !ok || e.Rule != rule {
+				t.Error("expected a", rule, "policy violation, got", err)
+			}
+		}
+		violates(admin.Snapshot("first"), "NamePattern")
+		for _, snapshot := range []string{"1", "2"} {
+			if err := admin.Snapshot(snapshot); err != nil {
+				t.Error("expected no errors, got", err)
+			}
+		}
+		violates(admin.Snapshot("3"), "MaxSnapshots")
+
+		// only the admin may roll back
+		violates(library.Rollback("1"), "RollbackClients")
+		if err := admin.Rollback("1"); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		// snapshot 2 is retained for an hour
+		violates(admin.DestroySnapshot("2", ForceDestroy()), "Retention")
+		clock.Advance(time.Hour)
+		if err := admin.DestroySnapshot("2", ForceDestroy()); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		// dropping the policy lifts every rule
+		err = library.SetSnapshotPolicy(nil)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if err := library.Snapshot("third"); err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Progress describes how far a long-running operation has gone, e.g., to render a progress bar or to let a job
+// scheduler know the operation is still alive.
+type Progress struct {
+	// number of items processed so far
+	Items int64
+	// approximate number of items the operation will process, based on the table's item count (which DynamoDB only
+	// updates every six hours or so, and includes all snapshots) unless the operation knows better (e.g., Restore);
+	// 0 if unknown
+	TotalEstimate int64
+	// capacity units consumed so far
+	ConsumedCapacity float64
+	// primary key of the last item processed, if known
+	LastKey map[string]*dynamodb.AttributeValue
+}
+
+// ProgressFunc is called by long-running operations every time they make some progress (see BulkOptions).
+type ProgressFunc func(progress Progress)
+
+// keeps track of the progress of an operation and reports it; not safe for concurrent use, a nil *progressTracker
+// does nothing
+type progressTracker struct {
+	fn       ProgressFunc
+	progress Progress
+}
+
+// return a tracker reporting to fn, or nil if there is nothing to report to; the table's item count is used as the
+// estimate iff estimate is true
+func (c *Library) newProgressTracker(ctx aws.Context, fn ProgressFunc, estimate bool) *progressTracker {
+	if fn == nil {
+		return nil
+	}
+
+	t := &progressTracker{fn: fn}
+	if estimate {
+		// it's only an estimate, don't fail the operation because of it
+		out, err := c.storage(ctx).DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(c.tableName)})
+		if err == nil {
+			t.progress.TotalEstimate = aws.Int64Value(out.Table.ItemCount)
+		}
+	}
+
+	return t
+}
+
+// record that items more items have been processed, at the cost of capacity units, and report it
+func (t *progressTracker) add(items int64, capacity float64, lastKey map[string]*dynamodb.AttributeValue) {
+	if t == nil {
+		return
+	}
+
+	t.progress.Items += items
+	t.progress.ConsumedCapacity += capacity
+	if lastKey != nil {
+		t.progress.LastKey = lastKey
+	}
+	t.fn(t.progress)
+}
+
+// set the number of items the operation is going to process, once it is known for sure
+func (t *progressTracker) setTotal(items int64) {
+	if t == nil {
+		return
+	}
+
+	t.progress.TotalEstimate = items
+}
+
+// return the capacity units consumed on the managed table according to a list of ConsumedCapacity
+func (c *Library) consumedCapacity(consumed []*dynamodb.ConsumedCapacity) float64 {
+	var units float64
+
+	for _, cc := range consumed {
+		if cc != nil && aws.StringValue(cc.TableName) == c.tableName {
+			units += aws.Float64Value(cc.CapacityUnits)
+		}
+	}
+
+	return units
+}
@@ -0,0 +1,81 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestProgressTracker(t *testing.T) {
+	// nothing to report to
+	var nothing *progressTracker
+	nothing.add(1, 1, nil)
+
+	reports := make([]Progress, 0)
+	tracker := &progressTracker{fn: func(p Progress) { reports = append(reports, p) }}
+	key := map[string]*dynamodb.AttributeValue{"year": {N: aws.String("1999")}}
+	tracker.add(25, 12.5, key)
+	tracker.add(3, 1.5, nil)
+
+	if len(reports) != 2 {
+		t.Fatal("expected 2 reports, got", len(reports))
+	}
+	last := reports[1]
+	if last.Items != 28 || last.ConsumedCapacity != 14 || aws.StringValue(last.LastKey["year"].N) != "1999" {
+		t.Error("expected 28 items, 14 units, and the last known key, got", last)
+	}
+}
+
+func TestLibrary_BulkProgress(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		library.Snapshot("snap")
+		nItems := 10
+		putItems(library, schema, nItems, t)
+
+		var last Progress
+		calls := 0
+		opts := &BulkOptions{
+			Segments: 2,
+			Progress: func(p Progress) {
+				calls++
+				last = p
+			},
+		}
+		_, err := library.ScanAllFromSnapshot(
+			&dynamodb.ScanInput{TableName: aws.String(getTableName(schema)), Limit: aws.Int64(3)},
+			"snap",
+			opts,
+		)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if calls == 0 || last.Items != int64(nItems) || last.ConsumedCapacity <= 0 {
+			t.Error("expected progress to be reported for", nItems, "items, got", calls, "calls and", last)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,256 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Query wraps the Query API operation for Amazon DynamoDB
+// (https://docs.aws.amazon.com/sdk-for-go/api/service/dynamodb/#DynamoDB.Query).
+//
+// It finds the items of the active snapshot with the partition key selected by the key condition, optionally
+// narrowed down by the range key. See QueryFromSnapshot.
+//
+// Overhead: 1RU
+func (c *Library) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return c.QueryWithContext(aws.BackgroundContext(), input)
+}
+
+// QueryWithContext is the same as Query with the addition of the ability to pass a context, which is passed on to every
+// request made to the table.
+func (c *Library) QueryWithContext(ctx aws.Context, input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
+	}
+
+	// default to fetching data from the active/current snapshot (could be latest, a rollback, or a pin)
+	currentSnapshotID := c.activeSnapshotID(meta)
+
+	return c.queryWithSnapshotID(ctx, input, currentSnapshotID)
+}
+
+// QueryFromSnapshot finds the items written to the specified snapshot with the partition key selected by the key
+// condition, optionally narrowed down by the range key. Like ScanFromSnapshot, and unlike GetItem, it does not fall
+// back to older snapshots. An empty snapshot refers to the data written before any snapshots were taken.
+//
+// The key condition must compare the partition key for equality, either directly or through an alias defined in
+// ExpressionAttributeNames (or with EQ in the legacy KeyConditions); the value it is compared against has the
+// snapshot added to it, and so do the values compared against the partition key in FilterExpression (see
+// ScanFromSnapshot). Queries on a global secondary index keyed on other attributes filter the items of the snapshot
+// instead, like a scan.
+//
+// The partition key of the items returned no longer includes the snapshot. LastEvaluatedKey is returned as is, to be
+// passed back in ExclusiveStartKey. While a numeric table is being migrated to another key encoding (see
+// MigrateKeyEncoding), the partition is queried in both: the page that exhausts the first one also has the first page
+// of the other, and may thus evaluate up to twice Limit items.
+//
+// Overhead: 1RU
+func (c *Library) QueryFromSnapshot(input *dynamodb.QueryInput, snapshot string) (*dynamodb.QueryOutput, error) {
+	return c.QueryFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// QueryFromSnapshotWithContext is the same as QueryFromSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) QueryFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.QueryInput,
+	snapshot string,
+) (*dynamodb.QueryOutput, error) {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.queryWithSnapshotID(ctx, input, id)
+}
+
+func (c *Library) queryWithSnapshotID(
+	ctx aws.Context,
+	input *dynamodb.QueryInput,
+	id string,
+) (*dynamodb.QueryOutput, error) {
+	err := c.checkFilter("Query", input.FilterExpression, input.ExpressionAttributeNames, input.QueryFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	// don't destroy the user provided input
+	inputCopy := *input
+	// secondary indexes don't support strongly consistent reads, only use the default on the table itself
+	if input.IndexName == nil {
+		inputCopy.ConsistentRead = aws.Bool(c.isConsistentRead(input.ConsistentRead))
+	}
+
+	values := input.ExpressionAttributeValues
+	keyCondition := aws.StringValue(input.KeyConditionExpression)
+	// the values compared against the partition key get the snapshot added to them, so any other use of their
+	// placeholders is switched to a copy of the value first
+	placeholders := partitionKeyPlaceholders(keyCondition, c.partitionKey, input.ExpressionAttributeNames)
+	if input.FilterExpression != nil {
+		placeholders = append(placeholders, partitionKeyPlaceholders(*input.FilterExpression, c.partitionKey,
+			input.ExpressionAttributeNames)...)
+	}
+	if keyCondition != "" {
+		keyCondition, values = isolatePlaceholders(keyCondition, placeholders, c.partitionKey,
+			input.ExpressionAttributeNames, values)
+		inputCopy.KeyConditionExpression = aws.String(keyCondition)
+	}
+	if input.FilterExpression != nil {
+		var filter string
+		filter, values = isolatePlaceholders(*input.FilterExpression, placeholders, c.partitionKey,
+			input.ExpressionAttributeNames, values)
+		inputCopy.FilterExpression = aws.String(filter)
+	}
+
+	// the same placeholder may be used by the key condition and the filter: add the snapshot to it only once
+	rewritten := make(map[string]bool, 0)
+	// the items written before any snapshots can only be told apart once read
+	filterBaseline := false
+	// partition key value queried, with the snapshot, if the key condition selects one
+	var queried *dynamodb.AttributeValue
+	switch {
+	case keyCondition != "" && referencesAttribute(keyCondition, c.partitionKey, input.ExpressionAttributeNames):
+		var err error
+		values, err = c.rewriteKeyCondition(keyCondition, input.ExpressionAttributeNames, values, id)
+		if err != nil {
+			return nil, err
+		}
+		placeholder, _ := keyConditionPartitionKeyPlaceholder(keyCondition, c.partitionKey,
+			input.ExpressionAttributeNames)
+		rewritten[placeholder] = true
+		queried = values[placeholder]
+	case input.KeyConditions[c.partitionKey] != nil:
+		condition := input.KeyConditions[c.partitionKey]
+		if aws.StringValue(condition.ComparisonOperator) != dynamodb.ComparisonOperatorEq ||
+			len(condition.AttributeValueList) != 1 {
+			return nil, errors.New("only equality conditions are supported on the partition key: " + c.partitionKey)
+		}
+		pk := *condition.AttributeValueList[0]
+		c.addSnapshotToPartitionKey(id, &pk)
+		queried = &pk
+
+		inputCopy.KeyConditions = make(map[string]*dynamodb.Condition, len(input.KeyConditions))
+		for k, v := range input.KeyConditions {
+			inputCopy.KeyConditions[k] = v
+		}
+		inputCopy.KeyConditions[c.partitionKey] = &dynamodb.Condition{
+			ComparisonOperator: condition.ComparisonOperator,
+			AttributeValueList: []*dynamodb.AttributeValue{&pk},
+		}
+	case input.IndexName != nil:
+		// a global secondary index keyed on other attributes: filter the items of the snapshot, just like a scan
+		values = c.addSnapshotToValues(values, nil, id)
+		metaFilter := c.metaRowFilter(values)
+		snapshotFilter := ""
+		if id != "" {
+			var err error
+			snapshotFilter, err = c.snapshotKeyFilter(id, values)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			filterBaseline = true
+		}
+		inputCopy.FilterExpression = joinFilters(
+			aws.StringValue(inputCopy.FilterExpression),
+			metaFilter,
+			snapshotFilter,
+		)
+	default:
+		return nil, errors.New("key condition does not include an equality condition on the partition key: " +
+			c.partitionKey)
+	}
+
+	// add the snapshot ID to every value compared against the partition key in the filter
+	if input.FilterExpression != nil {
+		if c.shard != nil || c.codec.Suffix {
+			err := checkShardedFilter(*input.FilterExpression, c.partitionKey, input.ExpressionAttributeNames)
+			if err != nil {
+				return nil, err
+			}
+		}
+		filterPlaceholders := make([]string, 0)
+		for _, p := range partitionKeyPlaceholders(*input.FilterExpression, c.partitionKey,
+			input.ExpressionAttributeNames) {
+			if !rewritten[p] {
+				filterPlaceholders = append(filterPlaceholders, p)
+			}
+		}
+		values = c.addSnapshotToValues(values, filterPlaceholders, id)
+	}
+	if len(values) > 0 {
+		inputCopy.ExpressionAttributeValues = values
+	}
+
+	// the partition of the metadata row is reserved for it, and a filter cannot refer to the key attributes to leave
+	// it out, so there is nothing to read
+	if queried != nil && c.isMetaRowPartition(queried) {
+		return &dynamodb.QueryOutput{
+			Count:        aws.Int64(0),
+			Items:        []map[string]*dynamodb.AttributeValue{},
+			ScannedCount: aws.Int64(0),
+		}, nil
+	}
+	// while the table is being migrated to another encoding, the items may be stored with either one
+	var partitions []string
+	if queried != nil && queried.N != nil {
+		_, key := c.decodePartitionKey(*queried.N)
+		partitions = c.migrationPartitionKeys(id, key)
+	}
+	out, err := c.queryPartitions(ctx, &inputCopy, queried, partitions)
+	if err != nil {
+		return nil, err
+	}
+
+	if filterBaseline && out.Items != nil {
+		out.Items = c.baselineItems(out.Items)
+		out.Count = aws.Int64(int64(len(out.Items)))
+	}
+
+	for _, item := range out.Items {
+		c.removeSnapshotFromPartitionKey(item[c.partitionKey])
+		if err := c.readItem(ctx, item); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
@@ -0,0 +1,153 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_Query(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		// one version of the item before the snapshot, another one after it
+		for i, value := range []string{"before", "after"} {
+			_, err := library.PutItem(&dynamodb.PutItemInput{
+				TableName: table,
+				Item:      getAttributeValueForItem(schema, value),
+			})
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if i == 0 {
+				library.Snapshot("1")
+			}
+		}
+
+		pk := getAttributeValueForKey(schema)[partitionKey]
+		input := &dynamodb.QueryInput{
+			TableName:                 table,
+			KeyConditionExpression:    aws.String("#pk = :pk"),
+			ExpressionAttributeNames:  map[string]*string{"#pk": aws.String(partitionKey)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":pk": pk},
+		}
+		for snapshot, expected := range map[string]string{"": "before", "1": "after"} {
+			out, err := library.QueryFromSnapshot(input, snapshot)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+				continue
+			}
+			if len(out.Items) != 1 {
+				t.Error("expected 1 item in snapshot", snapshot, "got", len(out.Items))
+				continue
+			}
+			if *out.Items[0][valueField].S != fmtValueTag(expected) {
+				t.Error("expected", fmtValueTag(expected), "got", *out.Items[0][valueField].S)
+			}
+			if *getPartitionKeyValue(schema, out.Items[0]) != *getPartitionKeyValue(schema, getAttributeValueForKey(schema)) {
+				t.Error("expected the snapshot to be removed from the partition key, got", out.Items[0][partitionKey])
+			}
+		}
+
+		// the caller's values are left untouched
+		if !reflect.DeepEqual(input.ExpressionAttributeValues[":pk"], getAttributeValueForKey(schema)[partitionKey]) {
+			t.Error("expected the input not to change, got", input.ExpressionAttributeValues[":pk"])
+		}
+
+		// Query reads from the active snapshot
+		out, err := library.Query(input)
+		if err != nil || len(out.Items) != 1 || *out.Items[0][valueField].S != fmtValueTag("after") {
+			t.Error("expected the item from the active snapshot, got", out, err)
+		}
+
+		// the key condition must select a partition
+		_, err = library.Query(&dynamodb.QueryInput{TableName: table})
+		if err == nil {
+			t.Error("expected an error for a query without a key condition")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestReferencesAttribute(t *testing.T) {
+	names := map[string]*string{"#pk": aws.String("partition_key")}
+
+	for expr, expected := range map[string]bool{
+		"partition_key = :pk":                      true,
+		"#pk = :pk AND range_key > :rk":            true,
+		"range_key = :rk":                          false,
+		"partition_key_2 = :pk":                    false,
+		"#other = :pk":                             false,
+		"begins_with(range_key, :a) AND #pk = :pk": true,
+	} {
+		if referencesAttribute(expr, "partition_key", names) != expected {
+			t.Error("expected", expected, "for", expr)
+		}
+	}
+}
+
+// queryRecordingStorage keeps the last query made through it instead of sending it anywhere
+type queryRecordingStorage struct {
+	Storage
+	query *dynamodb.QueryInput
+}
+
+func (s *queryRecordingStorage) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	s.query = input
+	return &dynamodb.QueryOutput{}, nil
+}
+
+func TestLibrary_queryWithSnapshotID_index(t *testing.T) {
+	storage := &queryRecordingStorage{}
+	library := &Library{
+		tableName:        "movies",
+		partitionKey:     "year",
+		partitionKeyType: "S",
+		svc:              storage,
+	}
+
+	// a filter with OR must not take the snapshot filter along with it
+	_, err := library.queryWithSnapshotID(aws.BackgroundContext(), &dynamodb.QueryInput{
+		TableName:              aws.String("movies"),
+		IndexName:              aws.String("title-index"),
+		KeyConditionExpression: aws.String("title = :title"),
+		FilterExpression:       aws.String("rating > :rating OR genre = :genre"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":title":  {S: aws.String("The Matrix")},
+			":rating": {N: aws.String("8")},
+			":genre":  {S: aws.String("sci-fi")},
+		},
+	}, "1")
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	filter := aws.StringValue(storage.query.FilterExpression)
+	if !strings.HasPrefix(filter, "(rating > :rating OR genre = :genre) AND (") {
+		t.Error("expected the filter to be kept in parentheses, got", filter)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+// Package ratelimit limits the capacity units consumed by bulk operations so that they don't starve live traffic.
+//
+// A single Limiter can be shared by any number of goroutines (e.g., all segments of a parallel scan) to enforce one
+// limit for all of them.
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket: capacity units are added at a fixed rate, up to one second's worth, and every request
+// consumes the units DynamoDB reports it used. Since the cost of a request is only known after it completes, the
+// bucket can go negative, in which case Wait blocks until the debt is paid off.
+//
+// A nil *Limiter imposes no limits.
+type Limiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	available float64
+	last      time.Time
+	// replaceable for testing
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// New returns a Limiter that allows an average of rate capacity units per second.
+func New(rate float64) *Limiter {
+	return &Limiter{
+		rate:      rate,
+		available: rate,
+		last:      time.Now(),
+		now:       time.Now,
+		sleep:     time.Sleep,
+	}
+}
+
+// add the units accrued since the last refill
+func (l *Limiter) refill() {
+	now := l.now()
+	l.available += now.Sub(l.last).Seconds() * l.rate
+	if l.available > l.rate {
+		l.available = l.rate
+	}
+	l.last = now
+}
+
+// Wait blocks until there are capacity units available.
+func (l *Limiter) Wait() {
+	if l == nil {
+		return
+	}
+
+	for {
+		l.mutex.Lock()
+		l.refill()
+		available := l.available
+		l.mutex.Unlock()
+
+		if available > 0 {
+			return
+		}
+		// sleep just enough to be back in the positive
+		l.sleep(time.Duration((-available/l.rate)*float64(time.Second)) + time.Millisecond)
+	}
+}
+
+// Consume records the capacity units used by a request.
+func (l *Limiter) Consume(units float64) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.refill()
+	l.available -= units
+}
@@ -0,0 +1,65 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	// a fake clock that only moves when we sleep
+	now := time.Now()
+	var slept time.Duration
+	l := New(10)
+	l.last = now
+	l.now = func() time.Time { return now }
+	l.sleep = func(d time.Duration) {
+		slept += d
+		now = now.Add(d)
+	}
+
+	// one second's worth of capacity is available right away
+	l.Wait()
+	l.Consume(10)
+	if slept != 0 {
+		t.Error("expected no waiting, slept", slept)
+	}
+
+	// 25 more units take 2.5 seconds to pay off
+	l.Consume(25)
+	l.Wait()
+	if slept < 2500*time.Millisecond || slept > 2510*time.Millisecond {
+		t.Error("expected to wait about 2.5 seconds, slept", slept)
+	}
+
+	// never more than one second's worth
+	now = now.Add(time.Hour)
+	l.refill()
+	if l.available != 10 {
+		t.Error("expected 10 units available, got", l.available)
+	}
+
+	// no limits
+	var unlimited *Limiter
+	unlimited.Consume(1000)
+	unlimited.Wait()
+}
@@ -0,0 +1,137 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// OperationReport describes how a bulk operation went, once it is over, e.g., to keep an audit trail of every restore
+// and every snapshot destroyed (see WithOperationReports).
+type OperationReport struct {
+	// e.g., "Restore", "DestroySnapshot", "CollectGarbage", "DumpSnapshot", or "LoadSnapshot"
+	Operation string
+	// snapshot operated on, as passed by the caller; empty for CollectGarbage
+	Snapshot string
+	Started  time.Time
+	Duration time.Duration
+	// number of items written, deleted, or dumped
+	Items int64
+	// write capacity units consumed by the items written, or deleted
+	ConsumedCapacity float64
+	// keys of the items that could not be written, or deleted, without the snapshot
+	FailedKeys []map[string]*dynamodb.AttributeValue
+	// how far the scan went (for a DumpSnapshot, as last reported to BulkOptions.OnProgress), to resume a
+	// DumpSnapshot or a DestroySnapshot that failed; nil for operations that do not scan the table page by page
+	Checkpoint *ScanProgress
+	// why the operation failed; empty if it succeeded
+	Error string
+}
+
+// ReportFunc is called with the report of every bulk operation once it is over, whether it succeeded or not (see
+// WithOperationReports).
+type ReportFunc func(report *OperationReport)
+
+// keeps track of a bulk operation to report it once it is over, and to its Job while it runs; a nil
+// *operationReporter does nothing
+type operationReporter struct {
+	fn     ReportFunc
+	clock  Clock
+	job    *Job
+	report OperationReport
+	// reports the items written, or deleted, as they go (see RestoreProgress and DestroyProgress); nil if not needed
+	progress *progressTracker
+}
+
+// return a reporter for an operation starting now, run as job (if not nil)
+func (c *Library) newOperationReporter(operation string, snapshot string, job *Job) *operationReporter {
+	return &operationReporter{
+		fn:     c.reportFunc,
+		clock:  c.clock,
+		job:    job,
+		report: OperationReport{Operation: operation, Snapshot: snapshot, Started: c.clock.Now()},
+	}
+}
+
+// record the outcome of writing requests (see writeRequests), at the cost of capacity units
+func (r *operationReporter) written(requests int, capacity float64, err error) {
+	if r == nil {
+		return
+	}
+
+	r.report.ConsumedCapacity += capacity
+	var items int64
+	failure, ok := err.(*batchWriteError)
+	switch {
+	case ok:
+		items = int64(failure.written)
+		r.report.FailedKeys = append(r.report.FailedKeys, failure.keys...)
+	case err == nil:
+		items = int64(requests)
+	}
+	r.report.Items += items
+	r.job.update(&r.report, r.clock.Now())
+	r.progress.add(items, capacity, nil)
+}
+
+// record the number of items the operation is going to write, or delete, once it is known
+func (r *operationReporter) expect(items int64) {
+	if r == nil {
+		return
+	}
+
+	r.progress.setTotal(items)
+}
+
+// record that n more items have been read
+func (r *operationReporter) read(n int64) {
+	if r == nil {
+		return
+	}
+
+	r.report.Items += n
+	r.job.update(&r.report, r.clock.Now())
+}
+
+// record how far a scan has gone
+func (r *operationReporter) checkpoint(progress *ScanProgress) {
+	if r == nil {
+		return
+	}
+
+	r.report.Checkpoint = progress
+	r.job.update(&r.report, r.clock.Now())
+}
+
+// report the operation, which is over, with the error it failed with, if any
+func (r *operationReporter) done(err error) {
+	if r == nil || r.fn == nil {
+		return
+	}
+
+	r.report.Duration = r.clock.Now().Sub(r.report.Started)
+	if err != nil {
+		r.report.Error = err.Error()
+	}
+	r.fn(&r.report)
+}
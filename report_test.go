@@ -0,0 +1,94 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_WithOperationReports(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		reports := make([]*OperationReport, 0)
+		reporting := newClient(schema, t, WithOperationReports(func(report *OperationReport) {
+			reports = append(reports, report)
+		}))
+
+		library.Snapshot("1")
+		putItems(library, schema, 5, t)
+		library.Snapshot("2")
+
+		err := reporting.DestroySnapshot("1")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		err = reporting.DestroySnapshot("does-not-exist")
+		if err == nil {
+			t.Error("expected error destroying a snapshot that does not exist")
+		}
+
+		if len(reports) != 2 {
+			t.Fatal("expected 2 reports, got", reports)
+		}
+		if reports[0].Operation != "DestroySnapshot" || reports[0].Snapshot != "1" || reports[0].Items != 5 ||
+			reports[0].Error != "" || len(reports[0].FailedKeys) != 0 || reports[0].Started.IsZero() {
+			t.Error("unexpected report:", reports[0])
+		}
+		if reports[1].Snapshot != "does-not-exist" || reports[1].Items != 0 || reports[1].Error != err.Error() {
+			t.Error("unexpected report:", reports[1])
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestOperationReporter_written(t *testing.T) {
+	var reported *OperationReport
+	library := &Library{clock: systemClock{}, reportFunc: func(report *OperationReport) { reported = report }}
+	reporter := library.newOperationReporter("Restore", "1", nil)
+
+	reporter.written(25, 25, nil)
+	key := map[string]*dynamodb.AttributeValue{"pk": {S: aws.String("a")}}
+	reporter.written(50, 30, &batchWriteError{
+		err:     errors.New("boom"),
+		written: 25,
+		keys:    []map[string]*dynamodb.AttributeValue{key},
+	})
+	reporter.done(errors.New("boom"))
+
+	if reported == nil {
+		t.Fatal("expected a report")
+	}
+	if reported.Items != 50 || reported.ConsumedCapacity != 55 || len(reported.FailedKeys) != 1 ||
+		reported.Error != "boom" {
+		t.Error("unexpected report:", reported)
+	}
+
+	// nothing to report to
+	var nothing *operationReporter
+	nothing.written(1, 1, nil)
+	nothing.done(nil)
+}
@@ -0,0 +1,224 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// PrunableSnapshots returns the snapshots, most recent first, that Prune would destroy: the ones the snapshot policy
+// no longer keeps according to its KeepLast and PruneAfter (see SnapshotPolicy), except for the latest and the current
+// ones, the ones its Retention still retains, locked ones (see LockSnapshot), and the ones a locked snapshot falls
+// back to. Snapshots taken before creation times were recorded only count against KeepLast. With neither KeepLast nor
+// PruneAfter, there are none.
+//
+// Cost: 1RU
+func (c *Library) PrunableSnapshots() ([]string, error) {
+	return c.PrunableSnapshotsWithContext(aws.BackgroundContext())
+}
+
+// PrunableSnapshotsWithContext is the same as PrunableSnapshots with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) PrunableSnapshotsWithContext(ctx aws.Context) ([]string, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.prunableSnapshots(meta)
+}
+
+// Prune destroys the snapshots the snapshot policy no longer keeps (see PrunableSnapshots), one at a time, and returns
+// their names. What the other snapshots see does not change: before a snapshot is destroyed, its items the snapshots
+// taken on top of it would still fall back to are copied into each of them, unless they have a version of their own,
+// e.g., written meanwhile. If pruning one fails, the ones before it stay destroyed, and it is safe to call it again.
+//
+// Cost: 1RU + for each snapshot destroyed, a full table scan + 1WU per item copied + the cost of DestroySnapshot
+func (c *Library) Prune() ([]string, error) {
+	return c.PruneWithContext(aws.BackgroundContext())
+}
+
+// PruneWithContext is the same as Prune with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) PruneWithContext(ctx aws.Context) ([]string, error) {
+	meta, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	prunable, err := c.prunableSnapshots(meta)
+	if err != nil {
+		return nil, err
+	}
+
+	destroyed := make([]string, 0, len(prunable))
+	for _, snapshot := range prunable {
+		err := c.copyForward(ctx, snapshot)
+		if err != nil {
+			return destroyed, wrapError("failed to copy the items of snapshot '"+snapshot+"'", err)
+		}
+		err = c.DestroySnapshotWithContext(ctx, snapshot)
+		if err != nil {
+			return destroyed, wrapError("failed to destroy snapshot '"+snapshot+"'", err)
+		}
+		destroyed = append(destroyed, snapshot)
+	}
+
+	return destroyed, nil
+}
+
+// return the names of the snapshots, most recent first, the snapshot policy no longer keeps and that can be destroyed
+func (c *Library) prunableSnapshots(meta *config) ([]string, error) {
+	policy, err := meta.getSnapshotPolicy()
+	if err != nil || policy == nil || (policy.KeepLast == 0 && policy.PruneAfter == 0) {
+		return []string{}, err
+	}
+
+	now := c.clock.Now()
+	prunable := make([]string, 0)
+	for i, id := range meta.chronologicalSnapshotIDs {
+		if i < policy.KeepLast || id == meta.latestSnapshotID || id == meta.getCurrentSnapshotID() {
+			continue
+		}
+		name, err := meta.getSnapshotName(id)
+		if err != nil {
+			return nil, err
+		}
+		if meta.isSnapshotLocked(name) || meta.hasLockedChild(id) {
+			continue
+		}
+		if policy.PruneAfter > 0 {
+			av := meta.getSnapshotInfo(name, snapshotInfoCreated)
+			if av == nil {
+				continue
+			}
+			created, err := timeFromAttributeValue(av)
+			if err != nil {
+				return nil, err
+			}
+			if now.Sub(created) <= policy.PruneAfter {
+				continue
+			}
+		}
+		// leave the snapshots the snapshot policy still retains for a later run
+		err = c.checkRetentionPolicy(meta, "Prune", name)
+		if _, retained := err.(*PolicyViolationError); retained {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		prunable = append(prunable, name)
+	}
+
+	return prunable, nil
+}
+
+// copy the items of snapshot that the snapshots taken right on top of it would still fall back to into each of them,
+// unless it has a version of its own, so that destroying snapshot changes nothing they see; the copies are only written
+// if nothing was written to their keys meanwhile, which would be newer
+func (c *Library) copyForward(ctx aws.Context, snapshot string) error {
+	meta, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return err
+	}
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return err
+	}
+	children := meta.childSnapshotIDs(id)
+	if len(children) == 0 {
+		return nil
+	}
+
+	relevant := map[string]bool{id: true}
+	for _, child := range children {
+		if err := meta.checkUnlocked("Prune", child); err != nil {
+			return err
+		}
+		relevant[child] = true
+	}
+	versions, err := c.scanVersions(ctx, relevant)
+	if err != nil {
+		return err
+	}
+
+	// always write the same keys in the same order
+	keys := make([]string, 0, len(versions))
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		item, ok := versions[k][id]
+		if !ok {
+			continue
+		}
+		for _, child := range children {
+			if _, ok := versions[k][child]; ok {
+				continue
+			}
+			itemCopy := c.keyWithSnapshot(item, child)
+			c.tagItem(itemCopy, child)
+			_, err := c.storage(ctx).PutItem(&dynamodb.PutItemInput{
+				TableName:                aws.String(c.tableName),
+				Item:                     itemCopy,
+				ConditionExpression:      aws.String("attribute_not_exists(#pk)"),
+				ExpressionAttributeNames: map[string]*string{"#pk": aws.String(c.partitionKey)},
+			})
+			if err != nil && !isConditionalCheckFailure(err) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// return the IDs of the snapshots that fall back to the one with the given ID first
+func (s *config) childSnapshotIDs(id string) []string {
+	children := make([]string, 0)
+	for _, other := range s.chronologicalSnapshotIDs {
+		chain := s.GetChronologicalSnapshotIDs(other)
+		if len(chain) > 1 && chain[1] == id {
+			children = append(children, other)
+		}
+	}
+
+	return children
+}
+
+// return true if a locked snapshot falls back to the one with the given ID first, and would thus have to be written
+// to for it to be destroyed without changing what it sees
+func (s *config) hasLockedChild(id string) bool {
+	for _, child := range s.childSnapshotIDs(id) {
+		name, err := s.getSnapshotName(child)
+		if err == nil && s.isSnapshotLocked(name) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_prunableSnapshots(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2017, 10, 1, 0, 0, 0, 0, time.UTC)}
+	storage := &metaRowStorage{}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N", clock: clock}
+
+	// one snapshot a day, the most recent one taken a day ago; "s2" is locked, "s1" predates creation times, and is
+	// never pruned since its items would have to be copied into "s2"
+	names := map[string]*dynamodb.AttributeValue{}
+	ids := []*dynamodb.AttributeValue{}
+	info := map[string]*dynamodb.AttributeValue{}
+	for i := 6; i > 0; i-- {
+		name, id := "s"+string(rune('0'+i)), string(rune('0'+i))
+		names[name] = &dynamodb.AttributeValue{S: aws.String(id)}
+		ids = append(ids, &dynamodb.AttributeValue{S: aws.String(id)})
+		details := map[string]*dynamodb.AttributeValue{}
+		if i > 1 {
+			details[snapshotInfoCreated] = timeToAttributeValue(clock.now.Add(-time.Duration(7-i) * 24 * time.Hour))
+		}
+		if i == 2 {
+			details[snapshotInfoLocked] = &dynamodb.AttributeValue{BOOL: aws.Bool(true)}
+		}
+		info[name] = &dynamodb.AttributeValue{M: details}
+	}
+	storage.item = map[string]*dynamodb.AttributeValue{
+		ddbSnapshotsField:    {M: names},
+		ddbOrderedIDs:        {L: ids},
+		ddbLatestIDField:     {S: aws.String("6")},
+		ddbCurrentIDField:    {S: aws.String("5")},
+		ddbSnapshotInfoField: {M: info},
+	}
+
+	for _, test := range []struct {
+		policy   *SnapshotPolicy
+		prunable []string
+	}{
+		{nil, []string{}},
+		{&SnapshotPolicy{MaxSnapshots: 10}, []string{}},
+		{&SnapshotPolicy{KeepLast: 3}, []string{"s3"}},
+		{&SnapshotPolicy{PruneAfter: 60 * time.Hour}, []string{"s4", "s3"}},
+		{&SnapshotPolicy{KeepLast: 4, PruneAfter: 60 * time.Hour}, []string{}},
+		{&SnapshotPolicy{KeepLast: 1}, []string{"s4", "s3"}},
+		// still retained
+		{&SnapshotPolicy{KeepLast: 1, Retention: 80 * time.Hour}, []string{"s3"}},
+	} {
+		delete(storage.item, ddbSnapshotPolicyField)
+		if test.policy != nil {
+			storage.item[ddbSnapshotPolicyField] = test.policy.toAttributeValue()
+		}
+		prunable, err := library.PrunableSnapshots()
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if !reflect.DeepEqual(prunable, test.prunable) {
+			t.Error("expected", test.prunable, "prunable with", test.policy, "got", prunable)
+		}
+		if test.policy == nil {
+			continue
+		}
+		policy, err := library.SnapshotPolicy()
+		if err != nil || policy.KeepLast != test.policy.KeepLast || policy.PruneAfter != test.policy.PruneAfter {
+			t.Error("expected", test.policy, "got", policy, err)
+		}
+	}
+}
+
+func TestLibrary_Prune(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// the same items written to every snapshot, and one written to each snapshot alone
+		snapshotItem := func(i int, valueTag string) map[string]*dynamodb.AttributeValue {
+			item := getAttributeValueForItem(schema, valueTag)
+			if partitionKeyType[schema] == "S" {
+				item[partitionKey].SetS(strconv.Itoa(100 + i))
+			} else {
+				item[partitionKey].SetN(strconv.Itoa(100 + i))
+			}
+			return item
+		}
+		for i, snapshot := range []string{"a", "b", "c", "d"} {
+			if err := library.Snapshot(snapshot); err != nil {
+				t.Fatal("expected no errors, got", err)
+			}
+			putItems(library, schema, 3, t)
+			_, err := library.PutItem(&dynamodb.PutItemInput{Item: snapshotItem(i, snapshot)})
+			if err != nil {
+				t.Fatal("expected no errors, got", err)
+			}
+		}
+
+		if err := library.SetSnapshotPolicy(&SnapshotPolicy{KeepLast: -1}); err == nil {
+			t.Error("expected error keeping a negative number of snapshots")
+		}
+		if err := library.SetSnapshotPolicy(&SnapshotPolicy{KeepLast: 2}); err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		pruned, err := library.Prune()
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if !reflect.DeepEqual(pruned, []string{"b", "a"}) {
+			t.Error("expected b and a to be pruned, got", pruned)
+		}
+		snapshots, err := library.ListSnapshots()
+		if err != nil || len(snapshots) != 2 {
+			t.Error("expected 2 snapshots left, got", snapshots, err)
+		}
+
+		// the items last written while a and b were current are still there, as they were
+		for i, snapshot := range []string{"a", "b", "c", "d"} {
+			item := snapshotItem(i, snapshot)
+			key := map[string]*dynamodb.AttributeValue{partitionKey: item[partitionKey]}
+			if rk, ok := item[rangeKey[schema]]; ok {
+				key[rangeKey[schema]] = rk
+			}
+			out, err := library.GetItem(&dynamodb.GetItemInput{Key: key})
+			if err != nil || out.Item == nil || aws.StringValue(out.Item[valueField].S) != fmtValueTag(snapshot) {
+				t.Error("expected the item written to", snapshot, "to be found, got", out, err)
+			}
+		}
+
+		// nothing left to prune, and nothing to prune without KeepLast or PruneAfter
+		if pruned, err := library.Prune(); err != nil || len(pruned) != 0 {
+			t.Error("expected nothing to prune, got", pruned, err)
+		}
+		if err := library.SetSnapshotPolicy(&SnapshotPolicy{}); err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if prunable, err := library.PrunableSnapshots(); err != nil || len(prunable) != 0 {
+			t.Error("expected nothing to prune, got", prunable, err)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+// a Storage that holds the metadata row and a few items, and records the items put
+type prunedStorage struct {
+	metaRowStorage
+	items []map[string]*dynamodb.AttributeValue
+	puts  []*dynamodb.PutItemInput
+}
+
+func (s *prunedStorage) Scan(input *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+	return &dynamodb.ScanOutput{Items: s.items}, nil
+}
+
+func (s *prunedStorage) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	s.puts = append(s.puts, input)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func TestLibrary_copyForward(t *testing.T) {
+	item := func(pk string) map[string]*dynamodb.AttributeValue {
+		return map[string]*dynamodb.AttributeValue{"title": {S: aws.String(pk)}}
+	}
+	storage := &prunedStorage{
+		metaRowStorage: metaRowStorage{item: map[string]*dynamodb.AttributeValue{
+			ddbSnapshotsField: {M: map[string]*dynamodb.AttributeValue{
+				"s1": {S: aws.String("1")},
+				"s2": {S: aws.String("2")},
+				"s3": {S: aws.String("3")},
+			}},
+			ddbOrderedIDs: {L: []*dynamodb.AttributeValue{
+				{S: aws.String("3")}, {S: aws.String("2")}, {S: aws.String("1")},
+			}},
+			ddbLatestIDField:  {S: aws.String("3")},
+			ddbCurrentIDField: {S: aws.String("3")},
+		}},
+		// a is only in s1, b was written to s2 again, and c only to s3
+		items: []map[string]*dynamodb.AttributeValue{item("1.a"), item("1.b"), item("2.b"), item("3.c")},
+	}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "title", partitionKeyType: "S"}
+
+	// s2 falls back to s1, so a is copied into it, but not b
+	if err := library.copyForward(aws.BackgroundContext(), "s1"); err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	if len(storage.puts) != 1 || aws.StringValue(storage.puts[0].Item["title"].S) != "2.a" ||
+		aws.StringValue(storage.puts[0].ConditionExpression) != "attribute_not_exists(#pk)" {
+		t.Error("expected a to be copied into s2 only if nothing was written meanwhile, got", storage.puts)
+	}
+
+	// nothing falls back to the latest snapshot
+	storage.puts = nil
+	if err := library.copyForward(aws.BackgroundContext(), "s3"); err != nil || len(storage.puts) != 0 {
+		t.Error("expected nothing to be copied, got", storage.puts, err)
+	}
+}
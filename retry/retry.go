@@ -0,0 +1,151 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+// Package retry retries requests to DynamoDB that fail because they are throttled, waiting exponentially longer
+// between attempts, with some jitter so that concurrent clients do not all come back at the same time.
+//
+// The Library uses DefaultPolicy for the requests it retries itself, e.g., the batches of bulk operations; callers
+// can use the same policies around their own calls.
+package retry
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Jitter tells how much of each wait is random.
+type Jitter int
+
+const (
+	// wait exactly the backoff
+	NoJitter Jitter = iota
+	// wait anything between half the backoff and the whole of it
+	EqualJitter
+	// wait anything between nothing and the whole backoff
+	FullJitter
+)
+
+// Policy describes how to retry a request. The wait before the nth retry is Base * 2^(n-1), up to Max, with some
+// jitter.
+type Policy struct {
+	// maximum number of retries after the first attempt
+	MaxRetries int
+	// wait before the first retry
+	Base time.Duration
+	// longest wait between two attempts; 0 means no limit
+	Max    time.Duration
+	Jitter Jitter
+	// tells which errors are worth retrying; IsThrottling if nil
+	Retryable func(error) bool
+	// called before waiting to retry, e.g., to log it
+	OnRetry func(retry int, wait time.Duration, err error)
+}
+
+// DefaultPolicy returns a policy that retries throttled requests up to 8 times, for up to about 25 seconds in total;
+// each call returns a new copy, which the caller is free to change.
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxRetries: 8,
+		Base:       100 * time.Millisecond,
+		Jitter:     EqualJitter,
+	}
+}
+
+// replaceable for testing
+var random = rand.Float64
+
+// Delay returns how long to wait before the nth retry, starting from 1.
+func (p Policy) Delay(retry int) time.Duration {
+	if retry < 1 {
+		return 0
+	}
+
+	wait := p.Base
+	for i := 1; i < retry && (p.Max == 0 || wait < p.Max); i++ {
+		wait *= 2
+	}
+	if p.Max > 0 && wait > p.Max {
+		wait = p.Max
+	}
+
+	switch p.Jitter {
+	case EqualJitter:
+		return wait/2 + time.Duration(random()*float64(wait/2))
+	case FullJitter:
+		return time.Duration(random() * float64(wait))
+	}
+
+	return wait
+}
+
+// Do calls fn until it succeeds, fails with an error that is not worth retrying, or has been retried MaxRetries
+// times, and returns its last error.
+func (p Policy) Do(fn func() error) error {
+	return p.DoWithContext(aws.BackgroundContext(), fn)
+}
+
+// DoWithContext is the same as Do with the addition of the ability to pass a context, which stops waiting to retry,
+// and returns its error, as soon as it is done.
+func (p Policy) DoWithContext(ctx aws.Context, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsThrottling
+	}
+
+	for retry := 0; ; retry++ {
+		err := fn()
+		if err == nil || retry >= p.MaxRetries || !retryable(err) {
+			return err
+		}
+
+		wait := p.Delay(retry + 1)
+		if p.OnRetry != nil {
+			p.OnRetry(retry+1, wait, err)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// IsThrottling returns true if err, or any error it wraps, means DynamoDB is asking to slow down.
+func IsThrottling(err error) bool {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
+		return false
+	}
+
+	switch aerr.Code() {
+	case dynamodb.ErrCodeProvisionedThroughputExceededException, dynamodb.ErrCodeRequestLimitExceeded,
+		"ThrottlingException":
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,152 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestPolicy_Delay(t *testing.T) {
+	p := Policy{Base: 100 * time.Millisecond, Max: time.Second}
+	for retry, expected := range map[int]time.Duration{
+		0: 0,
+		1: 100 * time.Millisecond,
+		2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond,
+		// capped
+		5:  time.Second,
+		50: time.Second,
+	} {
+		if wait := p.Delay(retry); wait != expected {
+			t.Error("expected", expected, "before retry", retry, "got", wait)
+		}
+	}
+
+	// make the jitter predictable
+	defer func(r func() float64) { random = r }(random)
+	random = func() float64 { return 1 }
+	p.Jitter = EqualJitter
+	if wait := p.Delay(2); wait != 200*time.Millisecond {
+		t.Error("expected 200ms, got", wait)
+	}
+	random = func() float64 { return 0 }
+	if wait := p.Delay(2); wait != 100*time.Millisecond {
+		t.Error("expected half the backoff, got", wait)
+	}
+	p.Jitter = FullJitter
+	if wait := p.Delay(2); wait != 0 {
+		t.Error("expected no wait, got", wait)
+	}
+}
+
+func TestPolicy_Do(t *testing.T) {
+	throttled := awserr.New(dynamodb.ErrCodeProvisionedThroughputExceededException, "slow down", nil)
+	retries := make([]int, 0)
+	p := Policy{
+		MaxRetries: 3,
+		Base:       time.Millisecond,
+		OnRetry:    func(retry int, _ time.Duration, _ error) { retries = append(retries, retry) },
+	}
+
+	// throttled until there are no retries left
+	calls := 0
+	err := p.Do(func() error {
+		calls++
+		return throttled
+	})
+	if err != throttled || calls != 4 || len(retries) != 3 {
+		t.Error("expected 4 calls and the throttling error, got", calls, err)
+	}
+
+	// throttled once
+	calls = 0
+	err = p.Do(func() error {
+		calls++
+		if calls == 1 {
+			return throttled
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Error("expected to succeed on the second call, got", calls, err)
+	}
+
+	// other errors are not worth retrying
+	calls = 0
+	failure := errors.New("validation error")
+	err = p.Do(func() error {
+		calls++
+		return failure
+	})
+	if err != failure || calls != 1 {
+		t.Error("expected a single call, got", calls, err)
+	}
+
+	// unless the policy says so
+	p.Retryable = func(err error) bool { return err == failure }
+	calls = 0
+	err = p.Do(func() error {
+		calls++
+		return failure
+	})
+	if err != failure || calls != 4 {
+		t.Error("expected 4 calls, got", calls, err)
+	}
+
+	// waiting stops with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	p = Policy{MaxRetries: 3, Base: time.Hour}
+	err = p.DoWithContext(ctx, func() error { return throttled })
+	if err != context.Canceled {
+		t.Error("expected the context's error, got", err)
+	}
+}
+
+func TestIsThrottling(t *testing.T) {
+	for _, code := range []string{
+		dynamodb.ErrCodeProvisionedThroughputExceededException,
+		dynamodb.ErrCodeRequestLimitExceeded,
+		"ThrottlingException",
+	} {
+		err := awserr.New(code, "slow down", nil)
+		if !IsThrottling(err) {
+			t.Error("expected", code, "to be throttling")
+		}
+		if !IsThrottling(fmt.Errorf("failed to scan: %w", err)) {
+			t.Error("expected a wrapped", code, "to be throttling")
+		}
+	}
+
+	if IsThrottling(awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "", nil)) {
+		t.Error("expected a failed condition not to be throttling")
+	}
+	if IsThrottling(errors.New("slow down")) || IsThrottling(nil) {
+		t.Error("expected errors other than DynamoDB's not to be throttling")
+	}
+}
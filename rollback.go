@@ -0,0 +1,613 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// maximum number of affected keys included in a RollbackPlan
+const rollbackPlanSampleSize = 10
+
+// RollbackPlan describes how rolling back to some snapshot would change the data clients see, without changing
+// anything.
+type RollbackPlan struct {
+	// the snapshot the plan is for
+	Snapshot string
+	// number of keys whose visible value would change, including keys that would appear or disappear
+	ChangedKeys int64
+	// primary key (with no snapshot) of some of the keys that would change
+	Sample []map[string]*dynamodb.AttributeValue
+}
+
+// PlanRollback computes the effect of calling Rollback(snapshot): the number of keys for which GetItem would return
+// a different value, or no value at all, once snapshot is the active one. The table is not modified.
+//
+// Items are not kept in memory while the plan is computed, only a checksum of the version of each key visible before
+// and after the rollback.
+//
+// Cost: 1RU + a full table scan
+func (c *Library) PlanRollback(snapshot string) (*RollbackPlan, error) {
+	return c.PlanRollbackWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// PlanRollbackWithContext is the same as PlanRollback with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) PlanRollbackWithContext(ctx aws.Context, snapshot string) (*RollbackPlan, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	targetID, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	currentID := meta.getCurrentSnapshotID()
+
+	plan := &RollbackPlan{
+		Snapshot: snapshot,
+		Sample:   make([]map[string]*dynamodb.AttributeValue, 0),
+	}
+	if targetID == currentID {
+		return plan, nil
+	}
+
+	// the snapshots GetItem goes through before and after the rollback
+	current := append(meta.GetChronologicalSnapshotIDs(currentID), "")
+	target := append(meta.GetChronologicalSnapshotIDs(targetID), "")
+	relevant := make(map[string]bool, 0)
+	for _, id := range append(current, target...) {
+		relevant[id] = true
+	}
+
+	// key -> the version visible through each chain, as far as the scan went
+	visible := make(map[string]*visibleChecksums, 0)
+	chains := [2][]string{current, target}
+	err = c.scanVersionsFunc(ctx, relevant, func(k string, id string, item map[string]*dynamodb.AttributeValue) error {
+		v, ok := visible[k]
+		if !ok {
+			v = &visibleChecksums{rank: [2]int{-1, -1}}
+			visible[k] = v
+		}
+		for i, chain := range chains {
+			for rank, chainID := range chain {
+				if chainID == id && (v.rank[i] < 0 || rank < v.rank[i]) {
+					v.rank[i] = rank
+					v.checksum[i] = c.itemChecksum(item)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0)
+	for k, v := range visible {
+		if v.checksum[0] != v.checksum[1] {
+			changed = append(changed, k)
+		}
+	}
+	// always return the same sample for the same data
+	sort.Strings(changed)
+
+	plan.ChangedKeys = int64(len(changed))
+	for i := 0; i < len(changed) && i < rollbackPlanSampleSize; i++ {
+		key, err := keyFromString(changed[i])
+		if err != nil {
+			return nil, err
+		}
+		plan.Sample = append(plan.Sample, key)
+	}
+
+	return plan, nil
+}
+
+// the versions of a key visible through two chains of snapshots, by their position in each chain (-1 if none was
+// found) and their checksum (see itemChecksum)
+type visibleChecksums struct {
+	rank     [2]int
+	checksum [2]string
+}
+
+// Restore makes the data the active snapshot shows the same as snapshot shows, by physically copying every item
+// visible from snapshot (as GetItem would find it) into the snapshot that is being written to, and deleting from it
+// the items snapshot does not have. Unlike Rollback, which only changes the active snapshot, the items written after
+// snapshot are no longer visible, and subsequent writes build on the restored data. Restoring a snapshot taken for a
+// tenant (see SnapshotTenant) only restores that tenant's items, as RestoreTenant does.
+//
+// If the snapshot being written to would still fall back to snapshots that snapshot does not (e.g., the ones taken
+// after it), it is recorded as taken on top of snapshot (see SnapshotParent); restoring a snapshot taken after the one
+// being written to, on a different branch, is not supported. All versions of the items involved are kept in memory
+// while the table is scanned. Items are written before the metadata is updated, so it is safe to call it again if it
+// fails.
+//
+// With WithCapacityCheck, it fails with a *CapacityError before writing anything if copying and deleting the items
+// would obviously overwhelm the table. With RestoreProgress, progress is reported as the items are written.
+//
+// Cost: 1RU + a full table scan + 1WU per item copied or deleted (+ 1WU if the lineage changes) (+ 1 DescribeTable
+// call with WithCapacityCheck)
+func (c *Library) Restore(snapshot string, opts ...RestoreOption) error {
+	return c.RestoreWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// RestoreWithContext is the same as Restore with the addition of the ability to pass a context, which is passed on to
+// every request made to the table.
+func (c *Library) RestoreWithContext(ctx aws.Context, snapshot string, opts ...RestoreOption) error {
+	options := newRestoreOptions(opts)
+	return c.runJob(ctx, "Restore", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		reporter.progress = c.newProgressTracker(ctx, options.progress, false)
+		return c.restore(ctx, snapshot, "", reporter)
+	})
+}
+
+// StartRestore is the same as Restore, except that it runs in the background and returns right away, with the Job to
+// follow, pause, resume, or cancel it; Job.Wait returns the error Restore would have.
+func (c *Library) StartRestore(snapshot string, opts ...RestoreOption) *Job {
+	return c.StartRestoreWithContext(aws.BackgroundContext(), snapshot, opts...)
+}
+
+// StartRestoreWithContext is the same as StartRestore with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) StartRestoreWithContext(ctx aws.Context, snapshot string, opts ...RestoreOption) *Job {
+	options := newRestoreOptions(opts)
+	return c.startJob(ctx, "Restore", snapshot, nil, func(ctx aws.Context, reporter *operationReporter) error {
+		reporter.progress = c.newProgressTracker(ctx, options.progress, false)
+		return c.restore(ctx, snapshot, "", reporter)
+	})
+}
+
+// restore snapshot (see Restore), only the items of the tenant with the given prefix if not empty (see RestoreTenant)
+func (c *Library) restore(ctx aws.Context, snapshot string, tenant string, reporter *operationReporter) error {
+	meta, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer c.invalidateMeta()
+
+	err = c.checkRollbackPolicy(meta, "Restore")
+	if err != nil {
+		return err
+	}
+
+	snapshot, err = c.jobSnapshot(ctx, meta, snapshot)
+	if err != nil {
+		return err
+	}
+	targetID, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return err
+	}
+	current, err := c.jobSnapshot(ctx, meta, snapshotCurrent)
+	if err != nil {
+		return err
+	}
+	destID, err := meta.getWritableSnapshotID("Restore", current)
+	if err != nil {
+		return err
+	}
+	if targetID == destID {
+		return nil
+	}
+
+	// a snapshot taken for a tenant only restores that tenant's items
+	recorded := ""
+	if targetID != "" {
+		name, err := meta.getSnapshotName(targetID)
+		if err != nil {
+			return err
+		}
+		recorded = meta.getSnapshotTenant(name)
+	}
+	if tenant == "" {
+		tenant = recorded
+	} else if !strings.HasPrefix(tenant, recorded) {
+		return errors.New(fmt.Sprintf("snapshot '%s' was taken for tenant '%s', not '%s'", snapshot, recorded, tenant))
+	}
+
+	target := append(meta.GetChronologicalSnapshotIDs(targetID), "")
+	inTarget := make(map[string]bool, len(target))
+	for _, id := range target {
+		inTarget[id] = true
+	}
+
+	// snapshots the destination would keep falling back to, but the target does not see
+	reparent := false
+	dest := append(meta.GetChronologicalSnapshotIDs(destID), "")
+	for _, id := range dest[1:] {
+		if !inTarget[id] {
+			reparent = true
+			break
+		}
+	}
+	if reparent && !olderSnapshot(meta.chronologicalSnapshotIDs, targetID, destID) {
+		return errors.New(fmt.Sprintf("cannot restore '%s' on top of a snapshot taken before it", snapshot))
+	}
+
+	relevant := map[string]bool{destID: true}
+	for _, id := range target {
+		relevant[id] = true
+	}
+	// a tenant is restored without changing the lineage, which other tenants depend on
+	if tenant != "" {
+		for _, id := range dest {
+			relevant[id] = true
+		}
+	}
+	versions, err := c.scanVersions(ctx, relevant)
+	if err != nil {
+		return err
+	}
+
+	// always write the same keys in the same order
+	keys := make([]string, 0, len(versions))
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	requests := make([]*dynamodb.WriteRequest, 0)
+	for _, k := range keys {
+		if tenant != "" {
+			requests = append(requests, c.tenantRestoreRequests(versions[k], target, dest, tenant)...)
+			continue
+		}
+
+		item := visibleVersion(versions[k], target)
+		written, inDest := versions[k][destID]
+		switch {
+		case item == nil && inDest:
+			requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
+				Key: c.keyWithSnapshot(c.primaryKey(written), destID),
+			}})
+		case item != nil && !(inDest && reflect.DeepEqual(item, written)):
+			itemCopy := c.keyWithSnapshot(item, destID)
+			c.tagItem(itemCopy, destID)
+			requests = append(requests, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{Item: itemCopy}})
+		}
+	}
+	// a tenant's items may be deleted from the snapshots the one being written to falls back to, too; a baseline key
+	// may look like it starts with a snapshot ID
+	inDest := make(map[string]bool, len(dest))
+	for _, id := range dest {
+		inDest[id] = true
+	}
+	for _, r := range requests {
+		if tenant == "" || r.DeleteRequest == nil {
+			continue
+		}
+		id, _ := c.decodeKnownPartitionKey(
+			func(id string) bool { return inDest[id] },
+			aws.StringValue(r.DeleteRequest.Key[c.partitionKey].S),
+		)
+		if err := meta.checkUnlocked("Restore", id); err != nil {
+			return err
+		}
+	}
+	err = c.checkCapacity(ctx, "Restore", int64(len(requests)))
+	if err != nil {
+		return err
+	}
+	// write a few batches at a time, to report progress as it goes
+	reporter.expect(int64(len(requests)))
+	chunk := maxBatchWriteSize * c.concurrency()
+	for start := 0; start < len(requests); start += chunk {
+		end := start + chunk
+		if end > len(requests) {
+			end = len(requests)
+		}
+		consumed, err := c.writeRequests(ctx, requests[start:end])
+		reporter.written(end-start, consumed, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !reparent || tenant != "" {
+		return nil
+	}
+	name, err := meta.getSnapshotName(destID)
+	if err != nil {
+		return err
+	}
+
+	err = meta.setSnapshotInfo(name, snapshotInfoParent, parentAttributeValue(targetID))
+	if isConditionalCheckFailure(err) {
+		return c.concurrentMetadataChange(ctx, "Restore", meta)
+	}
+
+	return err
+}
+
+// return true if the snapshot with ID older was taken before the one with ID newer, given the IDs of all snapshots
+// from the most recent one; the data written before any snapshots is older than every snapshot
+func olderSnapshot(chronologicalIDs []string, older string, newer string) bool {
+	if older == "" {
+		return newer != ""
+	}
+	for _, id := range chronologicalIDs {
+		switch id {
+		case newer:
+			return true
+		case older:
+			return false
+		}
+	}
+
+	return false
+}
+
+// scan the whole table and return every version of every item written to one of the relevant snapshots, by key
+// (see keyString) and snapshot ID, without the snapshot in the partition key; attributes stored in S3 (see
+// WithOverflow) are left as pointers, so that copies of the items point to the same objects
+func (c *Library) scanVersions(
+	ctx aws.Context,
+	relevant map[string]bool,
+) (map[string]map[string]map[string]*dynamodb.AttributeValue, error) {
+	// key -> snapshot ID -> item
+	versions := make(map[string]map[string]map[string]*dynamodb.AttributeValue, 0)
+	err := c.scanVersionsFunc(ctx, relevant, func(k string, id string, item map[string]*dynamodb.AttributeValue) error {
+		if _, ok := versions[k]; !ok {
+			versions[k] = make(map[string]map[string]*dynamodb.AttributeValue, 0)
+		}
+		versions[k][id] = item
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// scan the whole table just like scanVersions, but call fn with each version as it is found, along with its key (see
+// keyString) and snapshot ID, instead of keeping them all in memory; it stops at the first error fn returns
+func (c *Library) scanVersionsFunc(
+	ctx aws.Context,
+	relevant map[string]bool,
+	fn func(key string, id string, item map[string]*dynamodb.AttributeValue) error,
+) error {
+	known, err := c.snapshotIDLookup(ctx)
+	if err != nil {
+		return err
+	}
+	input := c.tableScanInput()
+	input.ConsistentRead = aws.Bool(c.consistentRead)
+	for {
+		if err := jobFromContext(ctx).wait(ctx); err != nil {
+			return err
+		}
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range out.Items {
+			pk := item[c.partitionKey]
+			value := aws.StringValue(pk.S)
+			if c.partitionKeyType == "N" {
+				value = aws.StringValue(pk.N)
+			}
+
+			id, key := c.decodeKnownPartitionKey(known, value)
+			if !relevant[id] {
+				continue
+			}
+			if c.partitionKeyType == "N" {
+				item[c.partitionKey] = &dynamodb.AttributeValue{N: aws.String(key)}
+			} else {
+				item[c.partitionKey] = &dynamodb.AttributeValue{S: aws.String(key)}
+			}
+			if err := c.verifyItem(item); err != nil {
+				return err
+			}
+			if err := c.untagItem(item); err != nil {
+				return err
+			}
+
+			k, err := c.keyString(item)
+			if err != nil {
+				return err
+			}
+			if err := fn(k, id, item); err != nil {
+				return err
+			}
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// return the version of an item GetItem finds when going through the snapshots in chain, or nil if there is none
+func visibleVersion(
+	versions map[string]map[string]*dynamodb.AttributeValue,
+	chain []string,
+) map[string]*dynamodb.AttributeValue {
+	for _, id := range chain {
+		item, ok := versions[id]
+		if ok {
+			return item
+		}
+	}
+
+	return nil
+}
+
+// return a string that uniquely identifies the primary key of an item
+func (c *Library) keyString(item map[string]*dynamodb.AttributeValue) (string, error) {
+	key, err := json.Marshal(toJSONItem(c.primaryKey(item)))
+	if err != nil {
+		return "", wrapError("failed to encode key", err)
+	}
+
+	return string(key), nil
+}
+
+// return the primary key identified by a string returned by keyString
+func keyFromString(s string) (map[string]*dynamodb.AttributeValue, error) {
+	key := make(map[string]*jsonAttributeValue, 0)
+	err := json.Unmarshal([]byte(s), &key)
+	if err != nil {
+		return nil, wrapError("failed to decode key", err)
+	}
+
+	return fromJSONItem(key), nil
+}
+
+// ScheduledRollback is a rollback recorded in the table's metadata to run at some point in the future (see
+// ScheduleRollback).
+type ScheduledRollback struct {
+	// the snapshot to roll back to
+	Snapshot string
+	// when to roll back, according to the Clock of the Library that runs it
+	At time.Time
+}
+
+// ScheduleRollback records a rollback to snapshot, to run at the given time by any Library that calls
+// RunScheduledRollback from then on (e.g., ddblibrarian-client -run-scheduled-rollbacks), replacing any other
+// rollback scheduled before. Nothing changes until then: the snapshot is still checked to exist when the rollback
+// runs, and it is not collected as garbage in the meantime (see CollectGarbage). As with Rollback, the snapshot cannot
+// have been taken for a tenant.
+//
+// Cost: 1RU + 1WU
+func (c *Library) ScheduleRollback(snapshot string, at time.Time) error {
+	return c.ScheduleRollbackWithContext(aws.BackgroundContext(), snapshot, at)
+}
+
+// ScheduleRollbackWithContext is the same as ScheduleRollback with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) ScheduleRollbackWithContext(ctx aws.Context, snapshot string, at time.Time) error {
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return err
+	}
+
+	err = c.checkRollbackPolicy(meta, "ScheduleRollback")
+	if err != nil {
+		return err
+	}
+	err = checkRollbackTenant(meta, snapshot)
+	if err != nil {
+		return err
+	}
+
+	return meta.setScheduledRollback(snapshot, at)
+}
+
+// CancelScheduledRollback drops the scheduled rollback, if any.
+//
+// Cost: 1WU
+func (c *Library) CancelScheduledRollback() error {
+	return c.CancelScheduledRollbackWithContext(aws.BackgroundContext())
+}
+
+// CancelScheduledRollbackWithContext is the same as CancelScheduledRollback with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) CancelScheduledRollbackWithContext(ctx aws.Context) error {
+	meta, err := c.fetchMeta(ctx, true)
+	defer c.invalidateMeta()
+	if err != nil {
+		return err
+	}
+
+	return meta.removeScheduledRollback()
+}
+
+// GetScheduledRollback returns the scheduled rollback, or nil if there is none.
+//
+// Cost: 1RU
+func (c *Library) GetScheduledRollback() (*ScheduledRollback, error) {
+	return c.GetScheduledRollbackWithContext(aws.BackgroundContext())
+}
+
+// GetScheduledRollbackWithContext is the same as GetScheduledRollback with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) GetScheduledRollbackWithContext(ctx aws.Context) (*ScheduledRollback, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, at, ok, err := meta.getScheduledRollback()
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return &ScheduledRollback{Snapshot: snapshot, At: at}, nil
+}
+
+// RunScheduledRollback runs the scheduled rollback if it is due, according to the Library's Clock, and returns it;
+// it returns nil if there is no rollback to run yet. The rollback and the removal of the schedule happen at once, so
+// multiple clients can call it periodically (e.g., every minute) without rolling back twice: all but one of them
+// fail.
+//
+// Cost: 1RU (+ 1WU when rolling back)
+func (c *Library) RunScheduledRollback() (*ScheduledRollback, error) {
+	return c.RunScheduledRollbackWithContext(aws.BackgroundContext())
+}
+
+// RunScheduledRollbackWithContext is the same as RunScheduledRollback with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) RunScheduledRollbackWithContext(ctx aws.Context) (*ScheduledRollback, error) {
+	meta, err := c.fetchMeta(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, at, ok, err := meta.getScheduledRollback()
+	if err != nil || !ok || c.clock.Now().Before(at) {
+		return nil, err
+	}
+	// the name may have been given to a snapshot taken for a tenant since
+	if err := checkRollbackTenant(meta, snapshot); err != nil {
+		return nil, err
+	}
+
+	defer c.invalidateMeta()
+	id, err := meta.runScheduledRollback()
+	if err != nil {
+		return nil, wrapError("failed to roll back to snapshot '"+snapshot+"'", err)
+	}
+
+	// if we were browsing some snapshot, we're not anymore
+	c.StopBrowsing()
+
+	if name, err := snapshotNameOrBaseline(meta, id); err == nil {
+		c.notifyRollback(name)
+	}
+
+	return &ScheduledRollback{Snapshot: snapshot, At: at}, nil
+}
@@ -0,0 +1,310 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_keyFromString(t *testing.T) {
+	library := &Library{partitionKey: "id", rangeKey: "sort"}
+	item := map[string]*dynamodb.AttributeValue{
+		"id":    {N: aws.String("10")},
+		"sort":  {B: []byte("b")},
+		"value": {S: aws.String("v")},
+	}
+
+	s, err := library.keyString(item)
+	if err != nil {
+		t.Fatal("expected no errors, got", err)
+	}
+	key, err := keyFromString(s)
+	if err != nil || !reflect.DeepEqual(key, library.primaryKey(item)) {
+		t.Error("expected the primary key of the item, got", key, err)
+	}
+
+	_, err = keyFromString("nope")
+	if err == nil {
+		t.Error("expected an error for a string not returned by keyString")
+	}
+}
+
+func TestLibrary_PlanRollback(t *testing.T) {
+	// write the item with key i, tagged with valueTag, to the active snapshot
+	put := func(library *Library, schema int, i int, valueTag string) {
+		item := getAttributeValueForItem(schema, valueTag)
+		if partitionKeyType[schema] == "S" {
+			item[partitionKey].SetS(strconv.Itoa(i))
+		} else {
+			item[partitionKey].SetN(strconv.Itoa(i))
+		}
+		_, err := library.PutItem(&dynamodb.PutItemInput{TableName: aws.String(getTableName(schema)), Item: item})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		_, err := library.PlanRollback("nope")
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+
+		// 10 items before any snapshots; on a snapshot, 3 of them are left as they were, 4 are changed, and 2 new
+		// ones are added
+		putItems(library, schema, 10, t)
+		err = library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		for i := 0; i < 3; i++ {
+			put(library, schema, i, "")
+		}
+		for i := 3; i < 7; i++ {
+			put(library, schema, i, "snap")
+		}
+		put(library, schema, 100, "snap")
+		put(library, schema, 101, "snap")
+
+		// rolling back to the active snapshot changes nothing
+		plan, err := library.PlanRollback("snap")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if plan.ChangedKeys != 0 || len(plan.Sample) != 0 {
+			t.Error("expected no changes, got", plan)
+		}
+
+		plan, err = library.PlanRollback("")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if plan.ChangedKeys != 6 || len(plan.Sample) != 6 {
+			t.Error("expected 6 changed keys, got", plan.ChangedKeys, plan.Sample)
+		}
+		for _, key := range plan.Sample {
+			k, _ := strconv.Atoi(*getPartitionKeyValue(schema, key))
+			if k < 3 || (k > 6 && k < 100) {
+				t.Error("unexpected key on the sample:", k)
+			}
+		}
+
+		// the table is left untouched
+		plan, _ = library.PlanRollback("snap")
+		if plan.ChangedKeys != 0 {
+			t.Error("expected the active snapshot not to change, got", plan.ChangedKeys, "changes")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_Restore(t *testing.T) {
+	key := func(schema int, i int) map[string]*dynamodb.AttributeValue {
+		k := getAttributeValueForKey(schema)
+		if partitionKeyType[schema] == "S" {
+			k[partitionKey].SetS(strconv.Itoa(i))
+		} else {
+			k[partitionKey].SetN(strconv.Itoa(i))
+		}
+		return k
+	}
+	put := func(library *Library, schema int, i int, valueTag string) {
+		item := key(schema, i)
+		item[valueField] = &dynamodb.AttributeValue{S: aws.String(fmtValueTag(valueTag))}
+		_, err := library.PutItem(&dynamodb.PutItemInput{TableName: aws.String(getTableName(schema)), Item: item})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	// expect the item with key i to be tagged with valueTag, or not to exist if valueTag is nil
+	expect := func(library *Library, schema int, i int, valueTag *string) {
+		out, err := library.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       key(schema, i),
+		})
+		switch {
+		case err != nil:
+			t.Error("expected no errors, got", err)
+		case valueTag == nil && out.Item != nil:
+			t.Error("expected item", i, "not to exist, got", out.Item)
+		case valueTag != nil && (out.Item == nil || aws.StringValue(out.Item[valueField].S) != fmtValueTag(*valueTag)):
+			t.Error("expected item", i, "tagged with", *valueTag, "got", out.Item)
+		}
+	}
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		err := library.Restore("nope")
+		if err == nil {
+			t.Error("expected an error for a snapshot that does not exist")
+		}
+
+		putItems(library, schema, 5, t)
+		library.Snapshot("a")
+		put(library, schema, 0, "a")
+		put(library, schema, 100, "a")
+		library.Snapshot("b")
+		put(library, schema, 0, "b")
+		put(library, schema, 1, "b")
+		put(library, schema, 101, "b")
+
+		// b keeps falling back to a, but no longer shows what was written to it
+		var progress Progress
+		err = library.Restore("a", RestoreProgress(func(p Progress) { progress = p }))
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if progress.Items == 0 || progress.Items != progress.TotalEstimate {
+			t.Error("expected every item written to be reported, got", progress)
+		}
+		expect(library, schema, 0, aws.String("a"))
+		expect(library, schema, 1, aws.String(""))
+		expect(library, schema, 100, aws.String("a"))
+		expect(library, schema, 101, nil)
+		if parent, _ := library.SnapshotParent("b"); parent != "a" {
+			t.Error("expected b to be taken on top of a, got", parent)
+		}
+
+		// subsequent writes build on the restored data
+		put(library, schema, 2, "b")
+		expect(library, schema, 2, aws.String("b"))
+		expect(library, schema, 0, aws.String("a"))
+
+		// c can only show the data written before any snapshots if it no longer falls back to a or b
+		library.Snapshot("c")
+		put(library, schema, 102, "c")
+		err = library.Restore("")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		for i := 0; i < 5; i++ {
+			expect(library, schema, i, aws.String(""))
+		}
+		expect(library, schema, 100, nil)
+		expect(library, schema, 102, nil)
+		if parent, _ := library.SnapshotParent("c"); parent != "" {
+			t.Error("expected c to be taken on top of the data written before any snapshots, got", parent)
+		}
+
+		// nothing to do
+		err = library.Restore("c")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		expect(library, schema, 0, aws.String(""))
+
+		teardown(schema, t)
+	}
+}
+
+func TestOlderSnapshot(t *testing.T) {
+	ids := []string{"3", "2", "1"}
+	tests := []struct {
+		older string
+		newer string
+		want  bool
+	}{
+		{"1", "3", true},
+		{"3", "1", false},
+		{"", "1", true},
+		{"1", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := olderSnapshot(ids, tt.older, tt.newer); got != tt.want {
+			t.Error("olderSnapshot(", tt.older, tt.newer, ") =", got, "expected", tt.want)
+		}
+	}
+}
+
+func TestLibrary_ScheduleRollback(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		_, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)}
+		library := newClient(schema, t, WithClock(clock))
+
+		library.Snapshot("1")
+		library.Snapshot("2")
+
+		err := library.ScheduleRollback("nope", clock.Now())
+		if err == nil {
+			t.Error("expected an error scheduling a rollback to a snapshot that does not exist")
+		}
+
+		at := clock.Now().Add(time.Hour)
+		err = library.ScheduleRollback("1", at)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		scheduled, err := library.GetScheduledRollback()
+		if err != nil || scheduled == nil || scheduled.Snapshot != "1" || !scheduled.At.Equal(at) {
+			t.Error("expected a rollback to 1 at", at, "got", scheduled, err)
+		}
+
+		// not due yet
+		ran, err := library.RunScheduledRollback()
+		if err != nil || ran != nil {
+			t.Error("expected nothing to run, got", ran, err)
+		}
+		ids, _, _ := library.SnapshotIDMap()
+		meta, _ := library.loadMeta(aws.BackgroundContext())
+		if meta.getCurrentSnapshotID() != ids["2"] {
+			t.Error("expected the active snapshot to still be 2, got", meta.getCurrentSnapshotID())
+		}
+
+		clock.Advance(time.Hour)
+		ran, err = library.RunScheduledRollback()
+		if err != nil || ran == nil || ran.Snapshot != "1" {
+			t.Error("expected the rollback to 1 to run, got", ran, err)
+		}
+		meta, _ = library.loadMeta(aws.BackgroundContext())
+		if meta.getCurrentSnapshotID() != ids["1"] {
+			t.Error("expected the active snapshot to be 1, got", meta.getCurrentSnapshotID())
+		}
+		scheduled, err = library.GetScheduledRollback()
+		if err != nil || scheduled != nil {
+			t.Error("expected no scheduled rollback after running it, got", scheduled, err)
+		}
+
+		// cancelled rollbacks never run
+		library.ScheduleRollback("2", clock.Now())
+		err = library.CancelScheduledRollback()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		ran, err = library.RunScheduledRollback()
+		if err != nil || ran != nil {
+			t.Error("expected nothing to run, got", ran, err)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,504 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/marcoalmeida/ddblibrarian/ratelimit"
+	"github.com/marcoalmeida/ddblibrarian/retry"
+)
+
+// BulkOptions configures operations that read, or write, every item of a snapshot. A nil *BulkOptions means using
+// the default for every option.
+type BulkOptions struct {
+	// Number of segments the table is split into for a parallel scan, each one read by its own goroutine.
+	// Defaults to 1, i.e., a sequential scan.
+	Segments int
+	// Limits the read capacity consumed by all segments together. The same Limiter can be shared by several
+	// operations, even on different tables, to enforce a single limit. Defaults to nil, i.e., no limits.
+	ReadLimiter *ratelimit.Limiter
+	// Limits the write capacity consumed on the destination table by CopySnapshotTo; other operations ignore it.
+	// Defaults to nil, i.e., no limits.
+	WriteLimiter *ratelimit.Limiter
+	// Where to resume a scan that was interrupted, as last reported to OnProgress. Must have been created with the
+	// same number of segments. Defaults to nil, i.e., reading the whole table.
+	Resume *ScanProgress
+	// Called after each page of items is processed with how far each segment has gone, e.g., to save checkpoints.
+	// Calls never overlap with each other or with the processing of items. Returning an error stops the scan.
+	OnProgress func(progress *ScanProgress) error
+	// Called after each page of items is processed (or each batch written) with the number of items processed so
+	// far, an estimate of the total, and the capacity consumed. Calls never overlap. Defaults to nil, i.e., not
+	// reporting progress.
+	Progress ProgressFunc
+}
+
+// ScanProgress records how far each segment of a bulk scan has gone, so that an interrupted scan can be resumed
+// without reading the same items again.
+type ScanProgress struct {
+	Segments int
+	// LastEvaluatedKey of the last page processed by each segment that is not done yet
+	LastKeys map[int]map[string]*dynamodb.AttributeValue
+	// segments that have been read in full
+	Done map[int]bool
+}
+
+func newScanProgress(segments int) *ScanProgress {
+	return &ScanProgress{
+		Segments: segments,
+		LastKeys: make(map[int]map[string]*dynamodb.AttributeValue, 0),
+		Done:     make(map[int]bool, 0),
+	}
+}
+
+// return a copy of the progress, which the caller can keep while the scan goes on
+func (p *ScanProgress) copy() *ScanProgress {
+	progress := newScanProgress(p.Segments)
+	for k, v := range p.LastKeys {
+		progress.LastKeys[k] = v
+	}
+	for k, v := range p.Done {
+		progress.Done[k] = v
+	}
+
+	return progress
+}
+
+func (o *BulkOptions) readLimiter() *ratelimit.Limiter {
+	if o == nil {
+		return nil
+	}
+
+	return o.ReadLimiter
+}
+
+func (o *BulkOptions) writeLimiter() *ratelimit.Limiter {
+	if o == nil {
+		return nil
+	}
+
+	return o.WriteLimiter
+}
+
+// return where each segment starts from
+func (o *BulkOptions) progress() (*ScanProgress, error) {
+	progress := newScanProgress(o.segments())
+	if o == nil || o.Resume == nil {
+		return progress, nil
+	}
+
+	if o.Resume.Segments != progress.Segments {
+		return nil, errors.New("cannot resume a scan of " + strconv.Itoa(o.Resume.Segments) + " segments with " +
+			strconv.Itoa(progress.Segments))
+	}
+	// keep the caller's copy untouched
+	return o.Resume.copy(), nil
+}
+
+func (o *BulkOptions) onProgress(progress *ScanProgress) error {
+	if o == nil || o.OnProgress == nil {
+		return nil
+	}
+
+	return o.OnProgress(progress)
+}
+
+func (o *BulkOptions) progressFunc() ProgressFunc {
+	if o == nil {
+		return nil
+	}
+
+	return o.Progress
+}
+
+func (o *BulkOptions) segments() int {
+	if o == nil || o.Segments < 1 {
+		return 1
+	}
+
+	return o.Segments
+}
+
+// ScanAllFromSnapshot reads every item of snapshot that matches input, following LastEvaluatedKey until the
+// whole table has been read, and returns them all at once (with the snapshot removed from the partition key).
+//
+// The table can be read by multiple goroutines in parallel (see BulkOptions). Throttled requests are retried with
+// exponential backoff. As with ScanFromSnapshot, an empty snapshot means items from all snapshots, and Baseline the
+// items written before any snapshots.
+//
+// Cost: a full table scan (unless the snapshot index is enabled)
+func (c *Library) ScanAllFromSnapshot(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	opts *BulkOptions,
+) ([]map[string]*dynamodb.AttributeValue, error) {
+	return c.ScanAllFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot, opts)
+}
+
+// ScanAllFromSnapshotWithContext is the same as ScanAllFromSnapshot with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) ScanAllFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	opts *BulkOptions,
+) ([]map[string]*dynamodb.AttributeValue, error) {
+	items := make([]map[string]*dynamodb.AttributeValue, 0)
+
+	collect := func(page []map[string]*dynamodb.AttributeValue) error {
+		items = append(items, page...)
+		return nil
+	}
+	err := c.ScanAllFromSnapshotFuncWithContext(ctx, input, snapshot, opts, collect)
+
+	return items, err
+}
+
+// ScanMerged returns the logical view of the table as of snapshot (or the active snapshot, if empty): exactly one item
+// per primary key, the version GetItem would return, i.e., the one written to the most recent snapshot, among
+// snapshot and the ones it falls back to, that has the key. Keys that were never written to any of them are left
+// out. Items are returned in the order of their primary keys (as JSON), with the snapshot removed from the partition
+// key.
+//
+// Every version of every item involved is kept in memory while the table is scanned.
+//
+// Cost: a full table scan
+func (c *Library) ScanMerged(snapshot string) ([]map[string]*dynamodb.AttributeValue, error) {
+	return c.ScanMergedWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// ScanMergedWithContext is the same as ScanMerged with the addition of the ability to pass a context, which is passed
+// on to every request made to the table.
+func (c *Library) ScanMergedWithContext(
+	ctx aws.Context,
+	snapshot string,
+) ([]map[string]*dynamodb.AttributeValue, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	startFrom := c.activeSnapshotID(meta)
+	if snapshot != "" {
+		startFrom, err = meta.getSnapshotID(snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// maybe the items were created before any snapshots were created
+	chain := append(meta.GetChronologicalSnapshotIDs(startFrom), "")
+	relevant := make(map[string]bool, len(chain))
+	for _, id := range chain {
+		relevant[id] = true
+	}
+
+	versions, err := c.scanVersions(ctx, relevant)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(versions))
+	for k := range versions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	items := make([]map[string]*dynamodb.AttributeValue, 0, len(keys))
+	for _, k := range keys {
+		item := visibleVersion(versions[k], chain)
+		// scanVersions leaves the values stored in S3 as pointers
+		if err := c.loadOverflow(ctx, item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// ScanFromSnapshotAs is the same as ScanFromSnapshot, but also unmarshals the items read (with the snapshot removed
+// from the partition key) into out, which must be a pointer to a slice, e.g., of structs (see
+// https://docs.aws.amazon.com/sdk-for-go/api/service/dynamodb/dynamodbattribute/). The contents of out are replaced
+// by the items of a single page: pass the LastEvaluatedKey of the output back in ExclusiveStartKey to read the next
+// one.
+//
+// Overhead: 1RU
+func (c *Library) ScanFromSnapshotAs(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	out interface{},
+) (*dynamodb.ScanOutput, error) {
+	return c.ScanFromSnapshotAsWithContext(aws.BackgroundContext(), input, snapshot, out)
+}
+
+// ScanFromSnapshotAsWithContext is the same as ScanFromSnapshotAs with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) ScanFromSnapshotAsWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	out interface{},
+) (*dynamodb.ScanOutput, error) {
+	output, err := c.ScanFromSnapshotWithContext(ctx, input, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(output.Items, out)
+	if err != nil {
+		return nil, wrapError("failed to unmarshal items", err)
+	}
+
+	return output, nil
+}
+
+// ScanAllFromSnapshotFunc is the streaming version of ScanAllFromSnapshot: instead of collecting all items in
+// memory, fn is called with each page of items as soon as it is read. Calls to fn never overlap, so it does not
+// need to be safe for concurrent use. Returning an error from fn stops the scan.
+func (c *Library) ScanAllFromSnapshotFunc(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	opts *BulkOptions,
+	fn func(items []map[string]*dynamodb.AttributeValue) error,
+) error {
+	return c.ScanAllFromSnapshotFuncWithContext(aws.BackgroundContext(), input, snapshot, opts, fn)
+}
+
+// ScanAllFromSnapshotFuncWithContext is the same as ScanAllFromSnapshotFunc with the addition of the ability to pass a
+// context, which is passed on to every request made to the table.
+func (c *Library) ScanAllFromSnapshotFuncWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	opts *BulkOptions,
+	fn func(items []map[string]*dynamodb.AttributeValue) error,
+) error {
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return err
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return err
+	}
+
+	id, err := meta.getScanSnapshotID(snapshot)
+	if err != nil {
+		return err
+	}
+
+	return c.scanSegments(ctx, input, id, opts, func(segment int, out *dynamodb.ScanOutput) error {
+		return fn(out.Items)
+	})
+}
+
+// ParallelScanFromSnapshot reads every item of snapshot that matches input with a parallel scan of totalSegments
+// segments (see https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/Scan.html#Scan.ParallelScan), each
+// one read by its own goroutine, up to WithMaxConcurrency at a time. fn is called with each page of items as soon
+// as it is read, along with the segment it belongs to; calls to fn never overlap, so it does not need to be safe for
+// concurrent use. Returning an error from fn stops the scan.
+//
+// Segments never overlap, and throttled requests are retried with exponential backoff before their page is passed
+// on, so every item is passed to fn exactly once. As with ScanFromSnapshot, an empty snapshot means items from all
+// snapshots, and Baseline the items written before any snapshots. See ScanAllFromSnapshotFunc to also limit the read
+// capacity consumed, or resume a scan that was interrupted.
+//
+// Cost: a full table scan (unless the snapshot index is enabled)
+func (c *Library) ParallelScanFromSnapshot(
+	input *dynamodb.ScanInput,
+	snapshot string,
+	totalSegments int,
+	fn func(segment int, items []map[string]*dynamodb.AttributeValue) error,
+) error {
+	return c.ParallelScanFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot, totalSegments, fn)
+}
+
+// ParallelScanFromSnapshotWithContext is the same as ParallelScanFromSnapshot with the addition of the ability to
+// pass a context, which is passed on to every request made to the table.
+func (c *Library) ParallelScanFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshot string,
+	totalSegments int,
+	fn func(segment int, items []map[string]*dynamodb.AttributeValue) error,
+) error {
+	if totalSegments < 1 {
+		return errors.New("expected at least 1 segment, got " + strconv.Itoa(totalSegments))
+	}
+	if input.Segment != nil || input.TotalSegments != nil {
+		return &UnsupportedInputError{
+			Operation: "ParallelScanFromSnapshot",
+			Feature:   "Segment",
+			Reason:    "segments are assigned from totalSegments",
+		}
+	}
+
+	err := c.resolveTable(&input.TableName)
+	if err != nil {
+		return err
+	}
+
+	meta, err := c.loadMetaWithConsistency(ctx, c.isConsistentRead(input.ConsistentRead))
+	if err != nil {
+		return err
+	}
+
+	id, err := meta.getScanSnapshotID(snapshot)
+	if err != nil {
+		return err
+	}
+
+	opts := &BulkOptions{Segments: totalSegments}
+	return c.scanSegments(ctx, input, id, opts, func(segment int, out *dynamodb.ScanOutput) error {
+		return fn(segment, out.Items)
+	})
+}
+
+// scan all segments of the table in parallel, calling fn (never concurrently) for every page read
+func (c *Library) scanSegments(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshotID string,
+	opts *BulkOptions,
+	fn func(segment int, out *dynamodb.ScanOutput) error,
+) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+
+	ctx, cancel := c.bulkContext(ctx)
+	defer cancel()
+
+	segments := opts.segments()
+	limiter := opts.readLimiter()
+	progress, err := opts.progress()
+	if err != nil {
+		return err
+	}
+	tracker := c.newProgressTracker(ctx, opts.progressFunc(), true)
+	// limit how many segments are read at the same time (see WithMaxConcurrency)
+	slots := make(chan struct{}, c.bulkConcurrency(segments))
+	// tell all workers to stop as soon as one of them fails
+	failed := func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr != nil
+	}
+
+	for segment := 0; segment < segments; segment++ {
+		if progress.Done[segment] {
+			continue
+		}
+
+		wg.Add(1)
+		go func(segment int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			segmentInput := *input
+			if segments > 1 {
+				segmentInput.Segment = aws.Int64(int64(segment))
+				segmentInput.TotalSegments = aws.Int64(int64(segments))
+			}
+			if limiter != nil || tracker != nil {
+				segmentInput.ReturnConsumedCapacity = aws.String(dynamodb.ReturnConsumedCapacityTotal)
+			}
+			if key, ok := progress.LastKeys[segment]; ok {
+				segmentInput.ExclusiveStartKey = key
+			}
+
+			for !failed() {
+				limiter.Wait()
+				out, err := c.scanWithRetries(ctx, &segmentInput, snapshotID)
+				if err == nil && out.ConsumedCapacity != nil {
+					limiter.Consume(aws.Float64Value(out.ConsumedCapacity.CapacityUnits))
+				}
+				mutex.Lock()
+				if err == nil && firstErr == nil {
+					err = fn(segment, out)
+				}
+				if err == nil && firstErr == nil && tracker != nil {
+					var lastKey map[string]*dynamodb.AttributeValue
+					if len(out.Items) > 0 {
+						lastKey = c.primaryKey(out.Items[len(out.Items)-1])
+					}
+					var capacity float64
+					if out.ConsumedCapacity != nil {
+						capacity = aws.Float64Value(out.ConsumedCapacity.CapacityUnits)
+					}
+					tracker.add(aws.Int64Value(out.Count), capacity, lastKey)
+				}
+				if err == nil && firstErr == nil {
+					if len(out.LastEvaluatedKey) == 0 {
+						progress.Done[segment] = true
+						delete(progress.LastKeys, segment)
+					} else {
+						progress.LastKeys[segment] = out.LastEvaluatedKey
+					}
+					err = opts.onProgress(progress)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+
+				if err != nil || len(out.LastEvaluatedKey) == 0 {
+					return
+				}
+				segmentInput.ExclusiveStartKey = out.LastEvaluatedKey
+			}
+		}(segment)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// read one page of a snapshot, retrying with exponential backoff if throttled
+func (c *Library) scanWithRetries(
+	ctx aws.Context,
+	input *dynamodb.ScanInput,
+	snapshotID string,
+) (*dynamodb.ScanOutput, error) {
+	// hold on while the job is paused (see Job)
+	if err := jobFromContext(ctx).wait(ctx); err != nil {
+		return nil, err
+	}
+
+	var out *dynamodb.ScanOutput
+	err := retry.DefaultPolicy().DoWithContext(ctx, func() error {
+		var err error
+		out, err = c.scanWithSnapshotID(ctx, input, snapshotID)
+		return err
+	})
+
+	return out, err
+}
@@ -0,0 +1,436 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// write nItems items, each with a different partition key, to the active snapshot
+func putItems(library *Library, schema int, nItems int, t *testing.T) {
+	for i := 0; i < nItems; i++ {
+		item := getAttributeValueForItem(schema, "")
+		if partitionKeyType[schema] == "S" {
+			item[partitionKey].SetS(strconv.Itoa(i))
+		} else {
+			item[partitionKey].SetN(strconv.Itoa(i))
+		}
+
+		_, err := library.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      item,
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLibrary_ScanAllFromSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// a few items before any snapshots, and a few more on a snapshot
+		putItems(library, schema, 5, t)
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		nItems := 20
+		putItems(library, schema, nItems, t)
+
+		// small pages on several segments
+		input := &dynamodb.ScanInput{
+			TableName: aws.String(getTableName(schema)),
+			Limit:     aws.Int64(2),
+		}
+		items, err := library.ScanAllFromSnapshot(input, "snap", &BulkOptions{Segments: 4})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(items) != nItems {
+			t.Error("expected", nItems, "items, got", len(items))
+		}
+
+		// every key, exactly once, without the snapshot
+		seen := make(map[string]bool, 0)
+		for _, item := range items {
+			seen[*getPartitionKeyValue(schema, item)] = true
+		}
+		for i := 0; i < nItems; i++ {
+			if !seen[strconv.Itoa(i)] {
+				t.Error("missing key", i)
+			}
+		}
+
+		// the input is not modified
+		if input.Segment != nil || input.ExclusiveStartKey != nil {
+			t.Error("expected the input to be left untouched, got", input)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ParallelScanFromSnapshot(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 5, t)
+		library.Snapshot("snap")
+		nItems := 30
+		putItems(library, schema, nItems, t)
+
+		totalSegments := 4
+		seen := make(map[string]int, 0)
+		input := &dynamodb.ScanInput{TableName: aws.String(getTableName(schema)), Limit: aws.Int64(3)}
+		err := library.ParallelScanFromSnapshot(input, "snap", totalSegments,
+			func(segment int, items []map[string]*dynamodb.AttributeValue) error {
+				if segment < 0 || segment >= totalSegments {
+					t.Error("unexpected segment", segment)
+				}
+				for _, item := range items {
+					seen[*getPartitionKeyValue(schema, item)]++
+				}
+				return nil
+			})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		for i := 0; i < nItems; i++ {
+			if seen[strconv.Itoa(i)] != 1 {
+				t.Error("expected key", i, "exactly once, got", seen[strconv.Itoa(i)])
+			}
+		}
+		if len(seen) != nItems {
+			t.Error("expected", nItems, "keys, got", len(seen))
+		}
+		if input.Segment != nil || input.ExclusiveStartKey != nil {
+			t.Error("expected the input to be left untouched, got", input)
+		}
+
+		// errors returned by fn stop the scan
+		stop := errors.New("stop")
+		err = library.ParallelScanFromSnapshot(input, "snap", totalSegments,
+			func(segment int, items []map[string]*dynamodb.AttributeValue) error {
+				return stop
+			})
+		if err != stop {
+			t.Error("expected the error returned by fn, got", err)
+		}
+
+		err = library.ParallelScanFromSnapshot(input, "snap", 0,
+			func(segment int, items []map[string]*dynamodb.AttributeValue) error { return nil })
+		if err == nil {
+			t.Error("expected error scanning without segments")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ScanMerged(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		put := func(pk string, valueTag string) {
+			item := getAttributeValueForItem(schema, valueTag)
+			if partitionKeyType[schema] == "S" {
+				item[partitionKey].SetS(pk)
+			} else {
+				item[partitionKey].SetN(pk)
+			}
+			_, err := library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: item})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+
+		// keys 0-4 on the baseline, 0-1 again on the first snapshot, and 0 again on the second one
+		putItems(library, schema, 5, t)
+		library.Snapshot("first")
+		put("0", "first")
+		put("1", "first")
+		library.Snapshot("second")
+		put("0", "second")
+
+		check := func(snapshot string, expected map[string]string) {
+			items, err := library.ScanMerged(snapshot)
+			if err != nil {
+				t.Error("expected no errors, got", err)
+			}
+			if len(items) != len(expected) {
+				t.Error("expected", len(expected), "items as of", snapshot, "got", len(items))
+			}
+			for _, item := range items {
+				pk := *getPartitionKeyValue(schema, item)
+				if v := aws.StringValue(item[valueField].S); v != expected[pk] {
+					t.Error("expected", expected[pk], "for key", pk, "as of", snapshot, "got", v)
+				}
+			}
+		}
+		check("", map[string]string{
+			"0": fmtValueTag("second"),
+			"1": fmtValueTag("first"),
+			"2": fmtValueTag(""),
+			"3": fmtValueTag(""),
+			"4": fmtValueTag(""),
+		})
+		check("first", map[string]string{
+			"0": fmtValueTag("first"),
+			"1": fmtValueTag("first"),
+			"2": fmtValueTag(""),
+			"3": fmtValueTag(""),
+			"4": fmtValueTag(""),
+		})
+
+		_, err := library.ScanMerged("does-not-exist")
+		if err == nil {
+			t.Error("expected error scanning a snapshot that does not exist")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ScanFromSnapshotAs(t *testing.T) {
+	type item struct {
+		Value string `dynamodbav:"value"`
+	}
+
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 5, t)
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		nItems := 3
+		putItems(library, schema, nItems, t)
+
+		input := &dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}
+		var items []item
+		out, err := library.ScanFromSnapshotAs(input, "snap", &items)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(items) != nItems || out == nil || len(out.Items) != nItems {
+			t.Error("expected", nItems, "items, got", items)
+		}
+		for _, i := range items {
+			if i.Value != fmtValueTag("") {
+				t.Error("expected", fmtValueTag(""), "got", i.Value)
+			}
+		}
+
+		// not a pointer to a slice
+		_, err = library.ScanFromSnapshotAs(input, "snap", items)
+		if err == nil {
+			t.Error("expected an error unmarshaling into a slice that is not a pointer")
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ScanFromBaseline(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		err := library.Snapshot(Baseline)
+		if err == nil {
+			t.Error("expected an error taking a snapshot with a reserved name")
+		}
+
+		nBaseline := 5
+		putItems(library, schema, nBaseline, t)
+		err = library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		nSnapshot := 3
+		putItems(library, schema, nSnapshot, t)
+
+		input := &dynamodb.ScanInput{TableName: aws.String(getTableName(schema))}
+		out, err := library.ScanFromBaseline(input)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(out.Items) != nBaseline || aws.Int64Value(out.Count) != int64(nBaseline) {
+			t.Error("expected", nBaseline, "items, got", out.Items)
+		}
+		// an empty snapshot still means all of them
+		out, err = library.ScanFromSnapshot(input, "")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(out.Items) != nBaseline+nSnapshot {
+			t.Error("expected", nBaseline+nSnapshot, "items, got", out.Items)
+		}
+
+		count, err := library.CountItems(Baseline)
+		if err != nil || count != int64(nBaseline) {
+			t.Error("expected", nBaseline, "items, got", count, err)
+		}
+		count, err = library.CountItems("")
+		if err != nil || count != int64(nBaseline+nSnapshot) {
+			t.Error("expected", nBaseline+nSnapshot, "items, got", count, err)
+		}
+
+		// every other operation takes it to mean the same data
+		err = library.Rollback(Baseline)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		out, err = library.Scan(input)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(out.Items) != nBaseline {
+			t.Error("expected", nBaseline, "items on the active snapshot, got", out.Items)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ScanAllVersions(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// the same keys on the baseline and on two snapshots
+		nItems := 4
+		putItems(library, schema, nItems, t)
+		for _, snapshot := range []string{"1", "2"} {
+			err := library.Snapshot(snapshot)
+			if err != nil {
+				t.Error(err)
+			}
+			putItems(library, schema, nItems, t)
+		}
+
+		// no matter which one is active
+		library.Rollback("1")
+		out, itemVersions, err := library.ScanAllVersions(&dynamodb.ScanInput{})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if len(out.Items) != 3*nItems || len(itemVersions) != len(out.Items) {
+			t.Error("expected", 3*nItems, "versions, got", len(out.Items), len(itemVersions))
+		}
+		versions := make(map[string]int, 0)
+		for _, item := range out.Items {
+			versions[*getPartitionKeyValue(schema, item)]++
+		}
+		for i := 0; i < nItems; i++ {
+			if versions[strconv.Itoa(i)] != 3 {
+				t.Error("expected 3 versions of key", i, "got", versions[strconv.Itoa(i)])
+			}
+		}
+		// each with the snapshot it was written to
+		snapshots := make(map[string]int, 0)
+		for _, version := range itemVersions {
+			snapshots[version.Snapshot]++
+		}
+		for _, snapshot := range []string{Baseline, "1", "2"} {
+			if snapshots[snapshot] != nItems {
+				t.Error("expected", nItems, "versions written to", snapshot, "got", snapshots[snapshot])
+			}
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_ScanAllFromSnapshotResume(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		err := library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+		nItems := 20
+		putItems(library, schema, nItems, t)
+
+		input := &dynamodb.ScanInput{
+			TableName: aws.String(getTableName(schema)),
+			Limit:     aws.Int64(3),
+		}
+		seen := make(map[string]int, 0)
+		collect := func(items []map[string]*dynamodb.AttributeValue) error {
+			for _, item := range items {
+				seen[*getPartitionKeyValue(schema, item)]++
+			}
+			return nil
+		}
+
+		// interrupt the scan after a couple of pages
+		var checkpoint *ScanProgress
+		pages := 0
+		interrupted := errors.New("interrupted")
+		opts := &BulkOptions{
+			Segments: 2,
+			OnProgress: func(progress *ScanProgress) error {
+				pages++
+				if pages == 2 {
+					checkpoint = progress
+					return interrupted
+				}
+				return nil
+			},
+		}
+		err = library.ScanAllFromSnapshotFunc(input, "snap", opts, collect)
+		if err != interrupted {
+			t.Error("expected the scan to be interrupted, got", err)
+		}
+
+		// resuming with a different number of segments is not possible
+		_, err = library.ScanAllFromSnapshot(input, "snap", &BulkOptions{Segments: 3, Resume: checkpoint})
+		if err == nil {
+			t.Error("expected an error when resuming with a different number of segments")
+		}
+
+		err = library.ScanAllFromSnapshotFunc(input, "snap", &BulkOptions{Segments: 2, Resume: checkpoint}, collect)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+
+		// every item was read exactly once
+		if len(seen) != nItems {
+			t.Error("expected", nItems, "items, got", len(seen))
+		}
+		for k, n := range seen {
+			if n != 1 {
+				t.Error("expected key", k, "to be read once, got", n)
+			}
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,236 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// SnapshotStats is how much of the table a snapshot takes: only the items written to it, not the ones it falls back
+// to, i.e., roughly what destroying it would free.
+type SnapshotStats struct {
+	// the name of the snapshot, or Baseline for the data written before any snapshots were taken
+	Snapshot string
+	Items    int64
+	// approximate size of the items, in bytes, as DynamoDB computes it for storage, including the attributes reserved
+	// by the Library and the snapshot ID in the partition key
+	Bytes int64
+}
+
+// SnapshotStats returns how many items were written to snapshot, and their approximate size. Baseline refers to the
+// data written before any snapshots were taken.
+//
+// Cost: a full table scan, or a query on the snapshot index if it is enabled (see WithSnapshotIndex)
+func (c *Library) SnapshotStats(snapshot string) (*SnapshotStats, error) {
+	return c.SnapshotStatsWithContext(aws.BackgroundContext(), snapshot)
+}
+
+// SnapshotStatsWithContext is the same as SnapshotStats with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) SnapshotStatsWithContext(ctx aws.Context, snapshot string) (*SnapshotStats, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := meta.getSnapshotID(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	name := snapshot
+	if id == "" {
+		name = Baseline
+	}
+
+	// only the snapshot's own items are read, as they are stored
+	stats := &SnapshotStats{Snapshot: name}
+	input := &dynamodb.ScanInput{TableName: aws.String(c.tableName)}
+	for {
+		out, err := c.scanStoredWithSnapshotID(ctx, input, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			stats.Items++
+			stats.Bytes += itemSize(item)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return stats, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// TableStats returns what SnapshotStats does for every snapshot, most recent first, followed by Baseline, all with a
+// single scan of the table. Items left behind by snapshots that no longer exist (see CollectGarbage) are not counted.
+//
+// Cost: a full table scan
+func (c *Library) TableStats() ([]SnapshotStats, error) {
+	return c.TableStatsWithContext(aws.BackgroundContext())
+}
+
+// TableStatsWithContext is the same as TableStats with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) TableStatsWithContext(ctx aws.Context) ([]SnapshotStats, error) {
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := append(meta.listSnapshots(), "")
+	names := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if id == "" {
+			names[id] = Baseline
+			continue
+		}
+		names[id], err = meta.getSnapshotName(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats, err := c.scanStats(ctx, names)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make([]SnapshotStats, 0, len(ids))
+	for _, id := range ids {
+		all = append(all, *stats[id])
+	}
+
+	return all, nil
+}
+
+// scan the whole table, as it is stored, and return the stats of the snapshots with the given IDs, mapped to their
+// names, all at once
+func (c *Library) scanStats(ctx aws.Context, names map[string]string) (map[string]*SnapshotStats, error) {
+	stats := make(map[string]*SnapshotStats, len(names))
+	for id, name := range names {
+		stats[id] = &SnapshotStats{Snapshot: name}
+	}
+
+	known, err := c.snapshotIDLookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	input := c.tableScanInput()
+	input.ConsistentRead = aws.Bool(c.consistentRead)
+	for {
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range out.Items {
+			pk := item[c.partitionKey]
+			value := aws.StringValue(pk.S)
+			if c.partitionKeyType == "N" {
+				value = aws.StringValue(pk.N)
+			}
+
+			id, _ := c.decodeKnownPartitionKey(known, value)
+			s, ok := stats[id]
+			if !ok {
+				continue
+			}
+			s.Items++
+			s.Bytes += itemSize(item)
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return stats, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// return the approximate size of an item as DynamoDB computes it for storage and capacity units, i.e., the length of
+// the name of each attribute plus the size of its value
+// (https://docs.aws.amazon.com/amazondynamodb/latest/developerguide/CapacityUnitCalculations.html)
+func itemSize(item map[string]*dynamodb.AttributeValue) int64 {
+	var size int64
+	for name, v := range item {
+		size += int64(len(name)) + attributeValueSize(v)
+	}
+
+	return size
+}
+
+func attributeValueSize(v *dynamodb.AttributeValue) int64 {
+	var size int64
+
+	switch {
+	case v == nil:
+	case v.S != nil:
+		size = int64(len(*v.S))
+	case v.N != nil:
+		size = numberSize(*v.N)
+	case v.B != nil:
+		size = int64(len(v.B))
+	case v.BOOL != nil, v.NULL != nil:
+		size = 1
+	case v.SS != nil:
+		for _, s := range v.SS {
+			size += int64(len(aws.StringValue(s)))
+		}
+	case v.NS != nil:
+		for _, n := range v.NS {
+			size += numberSize(aws.StringValue(n))
+		}
+	case v.BS != nil:
+		for _, b := range v.BS {
+			size += int64(len(b))
+		}
+	case v.L != nil:
+		// 3 bytes for the list, plus 1 for each element
+		size = 3
+		for _, e := range v.L {
+			size += 1 + attributeValueSize(e)
+		}
+	case v.M != nil:
+		// same as lists, plus the names of the attributes
+		size = 3
+		for name, e := range v.M {
+			size += 1 + int64(len(name)) + attributeValueSize(e)
+		}
+	}
+
+	return size
+}
+
+// numbers take 1 byte for every 2 significant digits, plus 1
+func numberSize(n string) int64 {
+	var digits int64
+	for _, r := range n {
+		if r == 'e' || r == 'E' {
+			break
+		}
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+
+	return (digits+1)/2 + 1
+}
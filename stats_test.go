@@ -0,0 +1,118 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestItemSize(t *testing.T) {
+	tests := []struct {
+		item map[string]*dynamodb.AttributeValue
+		size int64
+	}{
+		{map[string]*dynamodb.AttributeValue{}, 0},
+		{map[string]*dynamodb.AttributeValue{"title": {S: aws.String("Skyfall")}}, 5 + 7},
+		{map[string]*dynamodb.AttributeValue{"year": {N: aws.String("2012")}}, 4 + 3},
+		{map[string]*dynamodb.AttributeValue{"rating": {N: aws.String("-7.85")}}, 6 + 3},
+		{map[string]*dynamodb.AttributeValue{"big": {N: aws.String("1.5E+10")}}, 3 + 2},
+		{map[string]*dynamodb.AttributeValue{"poster": {B: []byte{1, 2, 3}}}, 6 + 3},
+		{
+			map[string]*dynamodb.AttributeValue{"seen": {BOOL: aws.Bool(true)}, "x": {NULL: aws.Bool(true)}},
+			4 + 1 + 1 + 1,
+		},
+		{map[string]*dynamodb.AttributeValue{"tags": {SS: []*string{aws.String("a"), aws.String("bc")}}}, 4 + 3},
+		{
+			map[string]*dynamodb.AttributeValue{"cast": {L: []*dynamodb.AttributeValue{
+				{S: aws.String("Daniel")},
+				{M: map[string]*dynamodb.AttributeValue{"role": {S: aws.String("Bond")}}},
+			}}},
+			// name + list overhead + (1 + 6) + (1 + map overhead + 1 + 4 + 4)
+			4 + 3 + 7 + 1 + 3 + 1 + 4 + 4,
+		},
+	}
+
+	for _, test := range tests {
+		if size := itemSize(test.item); size != test.size {
+			t.Error("expected", test.size, "bytes for", test.item, "got", size)
+		}
+	}
+}
+
+func TestLibrary_SnapshotStats(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		putItems(library, schema, 3, t)
+		err := library.Snapshot("s1")
+		if err != nil {
+			t.Error(err)
+		}
+		putItems(library, schema, 5, t)
+		err = library.Snapshot("s2")
+		if err != nil {
+			t.Error(err)
+		}
+
+		stats, err := library.SnapshotStats("s1")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		if stats.Snapshot != "s1" || stats.Items != 5 || stats.Bytes <= 0 {
+			t.Error("unexpected stats", stats)
+		}
+
+		// the baseline is listed last, and s2 has nothing of its own yet
+		all, err := library.TableStats()
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		expected := []struct {
+			snapshot string
+			items    int64
+		}{{"s2", 0}, {"s1", 5}, {Baseline, 3}}
+		if len(all) != len(expected) {
+			t.Fatal("expected", len(expected), "snapshots, got", all)
+		}
+		for i, e := range expected {
+			if all[i].Snapshot != e.snapshot || all[i].Items != e.items {
+				t.Error("expected", e, "got", all[i])
+			}
+		}
+		if all[1].Bytes != stats.Bytes {
+			t.Error("expected the same size for s1, got", all[1].Bytes, stats.Bytes)
+		}
+		baseline, err := library.SnapshotStats(Baseline)
+		if err != nil || baseline.Items != 3 || baseline.Bytes != all[2].Bytes {
+			t.Error("expected the same stats for the baseline, got", baseline, all[2], err)
+		}
+
+		_, err = library.SnapshotStats("nope")
+		if _, ok := err.(*SnapshotNotFoundError); !ok {
+			t.Error("expected a *SnapshotNotFoundError, got", err)
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// countingStorage counts the reads and writes made through it
+type countingStorage struct {
+	Storage
+	mutex  sync.Mutex
+	reads  int
+	writes int
+}
+
+func (s *countingStorage) count(counter *int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	*counter++
+}
+
+func (s *countingStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	s.count(&s.reads)
+	return s.Storage.GetItem(input)
+}
+
+func (s *countingStorage) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	s.count(&s.writes)
+	return s.Storage.PutItem(input)
+}
+
+func (s *countingStorage) UpdateItem(input *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+	s.count(&s.writes)
+	return s.Storage.UpdateItem(input)
+}
+
+func TestLibrary_WithStorage(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		storage := &countingStorage{Storage: library.svc}
+		counted := newClient(schema, t, WithStorage(storage))
+
+		err := counted.Snapshot("storage")
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		_, err = counted.PutItem(&dynamodb.PutItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Item:      getAttributeValueForItem(schema, "storage"),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if storage.reads == 0 || storage.writes == 0 {
+			t.Error("expected reads and writes to go through the storage, got", storage.reads, storage.writes)
+		}
+
+		// the data is in the table, as seen by a Library using the DynamoDB client
+		out, err := library.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(getTableName(schema)),
+			Key:       getAttributeValueForKey(schema),
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if out.Item == nil || *out.Item[valueField].S != "storage" {
+			t.Error("expected the item written through the storage, got", out.Item)
+		}
+
+		// derived instances share the storage
+		other, err := counted.WithTable(
+			getTableName(schema),
+			partitionKey,
+			partitionKeyType[schema],
+			rangeKey[schema],
+			rangeKeyType[schema],
+		)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if other.svc != Storage(storage) {
+			t.Error("expected the storage to be shared")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,268 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// how often the table's stream is polled for changes to the metadata
+const streamPollInterval = time.Second
+
+// maximum number of records a single GetRecords call returns; a shard that returns this many is read again right
+// away, as it may have more
+const streamRecordsLimit = 1000
+
+// the DynamoDB Streams calls the streamListener makes
+type streamReader interface {
+	DescribeStream(*dynamodbstreams.DescribeStreamInput) (*dynamodbstreams.DescribeStreamOutput, error)
+	GetShardIterator(*dynamodbstreams.GetShardIteratorInput) (*dynamodbstreams.GetShardIteratorOutput, error)
+	GetRecords(*dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error)
+}
+
+// streamListener follows the table's stream in the background and invalidates the cached metadata whenever the
+// metadata row changes, e.g., because another client took a snapshot or rolled back
+type streamListener struct {
+	svc        streamReader
+	streamArn  string
+	invalidate func()
+	isMeta     func(keys map[string]*dynamodb.AttributeValue) bool
+	// shard ID -> iterator of the shards being followed
+	iterators map[string]*string
+	// shards that have already been read to the end, or that were closed before the listener started
+	closed map[string]bool
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// find the stream of the table the metadata is stored in and start following it
+func (c *Library) startStreamListener(p client.ConfigProvider) error {
+	out, err := c.svc.DescribeTable(&dynamodb.DescribeTableInput{TableName: aws.String(c.metaTableName())})
+	if err != nil {
+		return err
+	}
+	if out.Table.StreamSpecification == nil || !aws.BoolValue(out.Table.StreamSpecification.StreamEnabled) ||
+		out.Table.LatestStreamArn == nil {
+		return errors.New("streams are not enabled on table " + c.metaTableName())
+	}
+
+	l := &streamListener{
+		svc:        dynamodbstreams.New(p, c.awsConfig...),
+		streamArn:  *out.Table.LatestStreamArn,
+		invalidate: c.invalidateMeta,
+		isMeta:     c.isMetaKey,
+		done:       make(chan struct{}),
+	}
+	// only changes from now on matter: the metadata has not been cached yet
+	err = l.reset(dynamodbstreams.ShardIteratorTypeLatest)
+	if err != nil {
+		return err
+	}
+
+	c.listener = l
+	l.wg.Add(1)
+	go l.run()
+
+	return nil
+}
+
+// return true if keys is the primary key of the metadata row
+func (c *Library) isMetaKey(keys map[string]*dynamodb.AttributeValue) bool {
+	if c.metaTable != "" {
+		table, ok := keys[metaTableKey]
+		return ok && aws.StringValue(table.S) == c.tableName
+	}
+
+	pk, ok := keys[c.partitionKey]
+	if !ok {
+		return false
+	}
+
+	return aws.StringValue(pk.S) == ddbPartitionKey || aws.StringValue(pk.N) == ddbPartitionKey
+}
+
+// start following all open shards from scratch, at iteratorType
+func (l *streamListener) reset(iteratorType string) error {
+	l.iterators = make(map[string]*string, 0)
+	l.closed = make(map[string]bool, 0)
+
+	shards, err := l.listShards()
+	if err != nil {
+		return err
+	}
+	// shards that have an ending sequence number will not get any new records
+	for _, shard := range shards {
+		if shard.SequenceNumberRange != nil && shard.SequenceNumberRange.EndingSequenceNumber != nil {
+			l.closed[aws.StringValue(shard.ShardId)] = true
+		}
+	}
+
+	return l.followShards(shards, iteratorType)
+}
+
+// start following the shards we're not following yet, from the beginning; this includes the ones that were opened and
+// closed since the last poll, which still hold records we have not seen
+func (l *streamListener) discoverShards() error {
+	shards, err := l.listShards()
+	if err != nil {
+		return err
+	}
+
+	return l.followShards(shards, dynamodbstreams.ShardIteratorTypeTrimHorizon)
+}
+
+// return every shard of the stream
+func (l *streamListener) listShards() ([]*dynamodbstreams.Shard, error) {
+	shards := make([]*dynamodbstreams.Shard, 0)
+
+	input := &dynamodbstreams.DescribeStreamInput{StreamArn: aws.String(l.streamArn)}
+	for {
+		out, err := l.svc.DescribeStream(input)
+		if err != nil {
+			return nil, err
+		}
+		shards = append(shards, out.StreamDescription.Shards...)
+
+		if out.StreamDescription.LastEvaluatedShardId == nil {
+			return shards, nil
+		}
+		input.ExclusiveStartShardId = out.StreamDescription.LastEvaluatedShardId
+	}
+}
+
+// start following, at iteratorType, the shards of the list that are neither followed nor read yet; a shard is only
+// followed once its parent has been read to the end (or is no longer in the stream), so that records are seen in order
+func (l *streamListener) followShards(shards []*dynamodbstreams.Shard, iteratorType string) error {
+	listed := make(map[string]bool, len(shards))
+	for _, shard := range shards {
+		listed[aws.StringValue(shard.ShardId)] = true
+	}
+
+	for _, shard := range shards {
+		id := aws.StringValue(shard.ShardId)
+		_, following := l.iterators[id]
+		if following || l.closed[id] {
+			continue
+		}
+		parent := aws.StringValue(shard.ParentShardId)
+		if parent != "" && listed[parent] && !l.closed[parent] {
+			continue
+		}
+
+		it, err := l.svc.GetShardIterator(&dynamodbstreams.GetShardIteratorInput{
+			StreamArn:         aws.String(l.streamArn),
+			ShardId:           shard.ShardId,
+			ShardIteratorType: aws.String(iteratorType),
+		})
+		if err != nil {
+			return err
+		}
+		l.iterators[id] = it.ShardIterator
+	}
+
+	return nil
+}
+
+// read the new records of every shard, invalidating the cache if any of them is for the metadata row; each shard is
+// read until it is caught up, so that a busy table does not leave the listener further behind on every poll
+func (l *streamListener) poll() error {
+	for id := range l.iterators {
+		err := l.drainShard(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	// new shards only hold records written after the ones we've already seen: read them from the beginning
+	return l.discoverShards()
+}
+
+// read the records of a shard until it returns less than a full page, or it is closed
+func (l *streamListener) drainShard(id string) error {
+	for {
+		out, err := l.svc.GetRecords(&dynamodbstreams.GetRecordsInput{
+			ShardIterator: l.iterators[id],
+			Limit:         aws.Int64(streamRecordsLimit),
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, r := range out.Records {
+			if r.Dynamodb != nil && l.isMeta(r.Dynamodb.Keys) {
+				l.invalidate()
+				break
+			}
+		}
+
+		if out.NextShardIterator == nil {
+			// the shard was closed, its children are picked up by discoverShards
+			delete(l.iterators, id)
+			l.closed[id] = true
+			return nil
+		}
+		l.iterators[id] = out.NextShardIterator
+
+		if len(out.Records) < streamRecordsLimit {
+			return nil
+		}
+		// stop has been called, there is no point in catching up
+		select {
+		case <-l.done:
+			return nil
+		default:
+		}
+	}
+}
+
+func (l *streamListener) run() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			err := l.poll()
+			if err != nil {
+				// we may have missed some changes (e.g., expired iterators): don't trust the cache and start over
+				l.invalidate()
+				// if this fails too, the next poll starts over again
+				l.reset(dynamodbstreams.ShardIteratorTypeLatest)
+			}
+		}
+	}
+}
+
+func (l *streamListener) stop() {
+	close(l.done)
+	l.wg.Wait()
+}
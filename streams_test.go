@@ -0,0 +1,340 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodbstreams"
+)
+
+// another client for the table of schema, configured with opts
+func newClient(schema int, t *testing.T, opts ...Option) *Library {
+	client, err := NewWithOptions(
+		getTableName(schema),
+		partitionKey,
+		partitionKeyType[schema],
+		rangeKey[schema],
+		rangeKeyType[schema],
+		testSession(t),
+		opts...,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func TestLibrary_MetadataCache(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		cached := newClient(schema, t, WithMetadataCache())
+
+		// cache the metadata...
+		snapshots, _ := cached.ListSnapshots()
+		if len(snapshots) != 0 {
+			t.Error("expected no snapshots, got", snapshots)
+		}
+		// ...which does not see changes made by other clients...
+		err := library.Snapshot("snap1")
+		if err != nil {
+			t.Error(err)
+		}
+		snapshots, _ = cached.ListSnapshots()
+		if len(snapshots) != 0 {
+			t.Error("expected the cached metadata, got", snapshots)
+		}
+		// ...but does see its own
+		err = cached.Snapshot("snap2")
+		if err != nil {
+			t.Error(err)
+		}
+		snapshots, _ = cached.ListSnapshots()
+		if len(snapshots) != 2 {
+			t.Error("expected 2 snapshots, got", snapshots)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_MetadataCacheTTL(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Now()}
+		cached := newClient(schema, t, WithMetadataCacheTTL(time.Minute), WithClock(clock))
+
+		// cache the metadata, which does not see changes made by other clients...
+		snapshots, _ := cached.ListSnapshots()
+		if len(snapshots) != 0 {
+			t.Error("expected no snapshots, got", snapshots)
+		}
+		err := library.Snapshot("snap1")
+		if err != nil {
+			t.Error(err)
+		}
+		clock.Advance(time.Minute - time.Second)
+		snapshots, _ = cached.ListSnapshots()
+		if len(snapshots) != 0 {
+			t.Error("expected the cached metadata, got", snapshots)
+		}
+		// ...until it expires...
+		clock.Advance(time.Second)
+		snapshots, _ = cached.ListSnapshots()
+		if len(snapshots) != 1 {
+			t.Error("expected 1 snapshot, got", snapshots)
+		}
+		// ...or is invalidated
+		err = library.Snapshot("snap2")
+		if err != nil {
+			t.Error(err)
+		}
+		cached.Invalidate()
+		snapshots, _ = cached.ListSnapshots()
+		if len(snapshots) != 2 {
+			t.Error("expected 2 snapshots, got", snapshots)
+		}
+
+		teardown(schema, t)
+	}
+}
+
+// consistencyStorage remembers the consistency of the reads made through it, finding nothing
+type consistencyStorage struct {
+	Storage
+	consistent []bool
+}
+
+func (s *consistencyStorage) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	s.consistent = append(s.consistent, aws.BoolValue(input.ConsistentRead))
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func TestLibrary_consistentMetadata(t *testing.T) {
+	storage := &consistencyStorage{}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "year", partitionKeyType: "N"}
+
+	// the metadata is read as consistently as the items by default...
+	_, err := library.loadMetaWithConsistency(aws.BackgroundContext(), false)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	// ...and always consistently with WithConsistentMetadata
+	WithConsistentMetadata()(library)
+	_, err = library.loadMetaWithConsistency(aws.BackgroundContext(), false)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if len(storage.consistent) != 2 || storage.consistent[0] || !storage.consistent[1] {
+		t.Error("expected an eventually consistent read, then a strongly consistent one, got", storage.consistent)
+	}
+}
+
+func TestLibrary_StreamInvalidation(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+
+		// streams are required
+		_, err := NewWithOptions(
+			getTableName(schema),
+			partitionKey,
+			partitionKeyType[schema],
+			rangeKey[schema],
+			rangeKeyType[schema],
+			testSession(t),
+			WithStreamInvalidation(),
+		)
+		if err == nil {
+			t.Error("expected an error on a table without streams")
+		}
+
+		_, err = testService(t).UpdateTable(&dynamodb.UpdateTableInput{
+			TableName: aws.String(getTableName(schema)),
+			StreamSpecification: &dynamodb.StreamSpecification{
+				StreamEnabled:  aws.Bool(true),
+				StreamViewType: aws.String(dynamodb.StreamViewTypeKeysOnly),
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cached := newClient(schema, t, WithStreamInvalidation())
+		cached.ListSnapshots()
+
+		err = library.Snapshot("snap")
+		if err != nil {
+			t.Error(err)
+		}
+
+		// the change should be picked up within a few polls
+		var snapshots []SnapshotInfo
+		for i := 0; i < 10 && len(snapshots) == 0; i++ {
+			time.Sleep(streamPollInterval)
+			snapshots, _ = cached.ListSnapshots()
+		}
+		if len(snapshots) != 1 {
+			t.Error("expected the snapshot taken by another client, got", snapshots)
+		}
+
+		cached.Close()
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_isMetaKey(t *testing.T) {
+	library := &Library{partitionKey: "id"}
+
+	if !library.isMetaKey(map[string]*dynamodb.AttributeValue{"id": {N: aws.String(ddbPartitionKey)}}) {
+		t.Error("expected the metadata row to be recognized")
+	}
+	if !library.isMetaKey(map[string]*dynamodb.AttributeValue{"id": {S: aws.String(ddbPartitionKey)}}) {
+		t.Error("expected the metadata row to be recognized")
+	}
+	if library.isMetaKey(map[string]*dynamodb.AttributeValue{"id": {S: aws.String("1")}}) {
+		t.Error("expected a regular item not to be recognized as metadata")
+	}
+	if library.isMetaKey(map[string]*dynamodb.AttributeValue{}) {
+		t.Error("expected an empty key not to be recognized as metadata")
+	}
+}
+
+// a stream whose shard iterators are the IDs of their shards, and which returns the records of a shard a page at a time
+type fakeStream struct {
+	shards  []*dynamodbstreams.Shard
+	records map[string][]*dynamodbstreams.Record
+}
+
+func (f *fakeStream) DescribeStream(
+	*dynamodbstreams.DescribeStreamInput,
+) (*dynamodbstreams.DescribeStreamOutput, error) {
+	return &dynamodbstreams.DescribeStreamOutput{
+		StreamDescription: &dynamodbstreams.StreamDescription{Shards: f.shards},
+	}, nil
+}
+
+func (f *fakeStream) GetShardIterator(
+	input *dynamodbstreams.GetShardIteratorInput,
+) (*dynamodbstreams.GetShardIteratorOutput, error) {
+	return &dynamodbstreams.GetShardIteratorOutput{ShardIterator: input.ShardId}, nil
+}
+
+func (f *fakeStream) GetRecords(input *dynamodbstreams.GetRecordsInput) (*dynamodbstreams.GetRecordsOutput, error) {
+	id := aws.StringValue(input.ShardIterator)
+	records := f.records[id]
+	if input.Limit != nil && int64(len(records)) > *input.Limit {
+		f.records[id] = records[*input.Limit:]
+		records = records[:*input.Limit]
+	} else {
+		delete(f.records, id)
+	}
+	out := &dynamodbstreams.GetRecordsOutput{Records: records, NextShardIterator: input.ShardIterator}
+	for _, shard := range f.shards {
+		if aws.StringValue(shard.ShardId) == id && shard.SequenceNumberRange.EndingSequenceNumber != nil &&
+			len(f.records[id]) == 0 {
+			out.NextShardIterator = nil
+		}
+	}
+
+	return out, nil
+}
+
+// add a shard to the stream, closed if it has an ending sequence number
+func (f *fakeStream) add(id string, parent string, closed bool) *dynamodbstreams.Shard {
+	shard := &dynamodbstreams.Shard{
+		ShardId:             aws.String(id),
+		SequenceNumberRange: &dynamodbstreams.SequenceNumberRange{},
+	}
+	if parent != "" {
+		shard.ParentShardId = aws.String(parent)
+	}
+	if closed {
+		shard.SequenceNumberRange.EndingSequenceNumber = aws.String("1")
+	}
+	f.shards = append(f.shards, shard)
+
+	return shard
+}
+
+func TestStreamListener_poll(t *testing.T) {
+	library := &Library{partitionKey: "id"}
+	stream := &fakeStream{records: make(map[string][]*dynamodbstreams.Record)}
+	invalidated := 0
+	l := &streamListener{svc: stream, invalidate: func() { invalidated++ }, isMeta: library.isMetaKey}
+
+	stream.add("old", "", true)
+	open := stream.add("open", "old", false)
+	err := l.reset(dynamodbstreams.ShardIteratorTypeLatest)
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if _, ok := l.iterators["old"]; ok || len(l.iterators) != 1 {
+		t.Error("expected to only follow the open shard, got", l.iterators)
+	}
+
+	// the shard is split twice between two polls: the first child is opened and closed right away, with the change
+	// to the metadata row, and only the second one is still open
+	open.SequenceNumberRange.EndingSequenceNumber = aws.String("1")
+	stream.add("short-lived", "open", true)
+	stream.add("child", "short-lived", false)
+	stream.records["short-lived"] = []*dynamodbstreams.Record{{
+		Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys: map[string]*dynamodb.AttributeValue{"id": {S: aws.String(ddbPartitionKey)}},
+		},
+	}}
+
+	// each child is only followed once its parent has been read to the end
+	for poll := 1; poll <= 3; poll++ {
+		err = l.poll()
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		_, following := l.iterators["child"]
+		if following != (poll >= 2) {
+			t.Error("unexpected shards being followed after poll", poll, "got", l.iterators)
+		}
+	}
+	if invalidated != 1 {
+		t.Error("expected the change in the short-lived shard to invalidate the cache once, got", invalidated)
+	}
+
+	// a shard that is more than a page behind is read until it is caught up, in a single poll
+	backlog := make([]*dynamodbstreams.Record, streamRecordsLimit+1)
+	for i := range backlog {
+		backlog[i] = &dynamodbstreams.Record{Dynamodb: &dynamodbstreams.StreamRecord{
+			Keys: map[string]*dynamodb.AttributeValue{"id": {S: aws.String(strconv.Itoa(i))}},
+		}}
+	}
+	backlog[streamRecordsLimit].Dynamodb.Keys["id"] = &dynamodb.AttributeValue{S: aws.String(ddbPartitionKey)}
+	stream.records["child"] = backlog
+	err = l.poll()
+	if err != nil {
+		t.Error("expected no errors, got", err)
+	}
+	if invalidated != 2 || len(stream.records["child"]) != 0 {
+		t.Error("expected the whole backlog to be read, got", invalidated, len(stream.records["child"]))
+	}
+}
@@ -0,0 +1,117 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// in strict mode, make sure a condition only checks whether the partition key exists or compares it against values
+// (which have the snapshot added to them, just like those of the legacy Expected parameter)
+func (c *Library) checkCondition(operation string, condition *string, names map[string]*string) error {
+	if !c.strict {
+		return nil
+	}
+
+	if condition != nil && hasUnsupportedReference(*condition, c.partitionKey, names, true) {
+		return &UnsupportedInputError{
+			Operation: operation,
+			Feature:   "ConditionExpression",
+			Reason:    "the partition key (" + c.partitionKey + ") can only be compared against values",
+		}
+	}
+
+	return nil
+}
+
+// in strict mode, make sure a filter only compares the partition key against values (which have the snapshot added
+// to them) or checks whether it exists
+func (c *Library) checkFilter(
+	operation string,
+	filter *string,
+	names map[string]*string,
+	legacyFilter map[string]*dynamodb.Condition,
+) error {
+	if !c.strict {
+		return nil
+	}
+
+	if filter != nil && hasUnsupportedReference(*filter, c.partitionKey, names, true) {
+		return &UnsupportedInputError{
+			Operation: operation,
+			Feature:   "FilterExpression",
+			Reason:    "the partition key (" + c.partitionKey + ") can only be compared against values",
+		}
+	}
+	if legacyFilter[c.partitionKey] != nil {
+		return &UnsupportedInputError{
+			Operation: operation,
+			Feature:   "ScanFilter",
+			Reason:    "the snapshot is not added to the values the partition key (" + c.partitionKey + ") is compared against",
+		}
+	}
+
+	return nil
+}
+
+// in strict mode, make sure none of the writes of a transaction uses an unsupported condition
+func (c *Library) checkTransactItem(item *dynamodb.TransactWriteItem) error {
+	const operation = "TransactWriteItems"
+
+	switch {
+	case item.ConditionCheck != nil:
+		check := item.ConditionCheck
+		return c.checkCondition(operation, check.ConditionExpression, check.ExpressionAttributeNames)
+	case item.Delete != nil:
+		del := item.Delete
+		return c.checkCondition(operation, del.ConditionExpression, del.ExpressionAttributeNames)
+	case item.Put != nil:
+		put := item.Put
+		return c.checkCondition(operation, put.ConditionExpression, put.ExpressionAttributeNames)
+	case item.Update != nil:
+		update := item.Update
+		return c.checkCondition(operation, update.ConditionExpression, update.ExpressionAttributeNames)
+	}
+
+	return nil
+}
+
+// return true if a PartiQL statement refers to the managed table (or one of its indexes), either as a plain or a
+// quoted identifier
+func (c *Library) isManagedStatement(statement *string) bool {
+	// string literals are quoted with single quotes and may contain anything, including the table's name
+	parts := strings.Split(aws.StringValue(statement), "'")
+	for i := 0; i < len(parts); i += 2 {
+		for _, token := range tokenizeExpression(parts[i]) {
+			if token == c.tableName || strings.HasPrefix(token, c.tableName+".") {
+				return true
+			}
+		}
+		if strings.Contains(parts[i], `"`+c.tableName+`"`) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,100 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_checkCondition(t *testing.T) {
+	c := &Library{tableName: "movies", partitionKey: "year", strict: true}
+
+	err := c.checkCondition("PutItem", aws.String("attribute_not_exists(year)"), nil)
+	if err != nil {
+		t.Error("expected no error, got", err)
+	}
+
+	// the values compared against the partition key have the snapshot added to them
+	err = c.checkCondition("PutItem", aws.String("year = :y OR year IN (:a, :b)"), nil)
+	if err != nil {
+		t.Error("expected no error, got", err)
+	}
+
+	err = c.checkCondition("PutItem", aws.String("contains(year, :y)"), nil)
+	if e, ok := err.(*UnsupportedInputError); !ok || e.Operation != "PutItem" || e.Feature != "ConditionExpression" {
+		t.Error("expected an *UnsupportedInputError for ConditionExpression, got", err)
+	}
+
+	// nothing is checked unless in strict mode
+	c.strict = false
+	err = c.checkCondition("PutItem", aws.String("contains(year, :y)"), nil)
+	if err != nil {
+		t.Error("expected no error outside strict mode, got", err)
+	}
+}
+
+func TestLibrary_checkFilter(t *testing.T) {
+	c := &Library{tableName: "movies", partitionKey: "year", strict: true}
+
+	err := c.checkFilter("Scan", aws.String("year > :y AND title = :t"), nil, nil)
+	if err != nil {
+		t.Error("expected no error, got", err)
+	}
+
+	err = c.checkFilter("Scan", aws.String("contains(year, :y)"), nil, nil)
+	if e, ok := err.(*UnsupportedInputError); !ok || e.Feature != "FilterExpression" {
+		t.Error("expected an *UnsupportedInputError for FilterExpression, got", err)
+	}
+
+	legacy := map[string]*dynamodb.Condition{
+		"year": {ComparisonOperator: aws.String(dynamodb.ComparisonOperatorEq)},
+	}
+	err = c.checkFilter("Scan", nil, nil, legacy)
+	if e, ok := err.(*UnsupportedInputError); !ok || e.Feature != "ScanFilter" {
+		t.Error("expected an *UnsupportedInputError for ScanFilter, got", err)
+	}
+}
+
+func TestLibrary_isManagedStatement(t *testing.T) {
+	c := &Library{tableName: "movies"}
+
+	cases := []struct {
+		statement string
+		expected  bool
+	}{
+		{"SELECT * FROM movies WHERE year = ?", true},
+		{`SELECT * FROM "movies" WHERE year = ?`, true},
+		{`SELECT * FROM "movies"."by-title"`, true},
+		{"SELECT * FROM movies.byTitle", true},
+		{"SELECT * FROM movies_archive", false},
+		{"UPDATE shows SET title = 'movies'", false},
+	}
+
+	for _, tc := range cases {
+		managed := c.isManagedStatement(aws.String(tc.statement))
+		if managed != tc.expected {
+			t.Error("statement:", tc.statement, "expected", tc.expected, "got", managed)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// field of a snapshot's info that holds the prefix of the partition keys of the tenant it was taken for, if any
+const snapshotInfoTenant = "tenant"
+
+// RestoreTenant is the same as Restore, except that only the items of the tenant whose partition keys start with
+// prefix are restored, leaving every other tenant's as they are. It is how a single tenant is rolled back: Rollback
+// changes the active snapshot, and thus the data clients see, for every key. If snapshot was taken for a tenant (see
+// SnapshotTenant), prefix must be within it.
+//
+// Since the lineage of the snapshot being written to is left as it is, the tenant's items that snapshot does not
+// have, but the snapshot being written to would still fall back to, are deleted from every snapshot they would be
+// found in. Only tables with a string partition key can be scoped to tenants.
+//
+// Cost: 1RU + a full table scan + 1WU per item copied or deleted (+ 1 DescribeTable call with WithCapacityCheck)
+func (c *Library) RestoreTenant(snapshot string, prefix string) error {
+	return c.RestoreTenantWithContext(aws.BackgroundContext(), snapshot, prefix)
+}
+
+// RestoreTenantWithContext is the same as RestoreTenant with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) RestoreTenantWithContext(ctx aws.Context, snapshot string, prefix string) error {
+	params := &jobParams{tenant: prefix}
+	return c.runJob(ctx, "RestoreTenant", snapshot, params, func(ctx aws.Context, reporter *operationReporter) error {
+		return c.restoreTenant(ctx, snapshot, prefix, reporter)
+	})
+}
+
+func (c *Library) restoreTenant(ctx aws.Context, snapshot string, prefix string, reporter *operationReporter) error {
+	if err := c.checkTenant(prefix); err != nil {
+		return err
+	}
+
+	return c.restore(ctx, snapshot, prefix, reporter)
+}
+
+// PurgeTenant deletes every item of the tenant whose partition keys start with prefix from every snapshot, e.g., once
+// the tenant is gone, leaving every other tenant's items as they are. Snapshots themselves are not destroyed. Only
+// tables with a string partition key can be scoped to tenants.
+//
+// Cost: a full table scan + 1WU per item deleted
+func (c *Library) PurgeTenant(prefix string) error {
+	return c.PurgeTenantWithContext(aws.BackgroundContext(), prefix)
+}
+
+// PurgeTenantWithContext is the same as PurgeTenant with the addition of the ability to pass a context, which is
+// passed on to every request made to the table.
+func (c *Library) PurgeTenantWithContext(ctx aws.Context, prefix string) error {
+	params := &jobParams{tenant: prefix}
+	return c.runJob(ctx, "PurgeTenant", "", params, func(ctx aws.Context, reporter *operationReporter) error {
+		return c.purgeTenant(ctx, prefix, nil, reporter)
+	})
+}
+
+// delete the items of the tenant from every snapshot, carrying on from resume, if not nil, as last reported to the
+// checkpoints of reporter
+func (c *Library) purgeTenant(
+	ctx aws.Context,
+	prefix string,
+	resume *ScanProgress,
+	reporter *operationReporter,
+) error {
+	if err := c.checkTenant(prefix); err != nil {
+		return err
+	}
+
+	known, err := c.snapshotIDLookup(ctx)
+	if err != nil {
+		return err
+	}
+	input := c.tableScanInput()
+	if resume != nil {
+		input.ExclusiveStartKey = resume.LastKeys[0]
+	}
+	for {
+		if err := jobFromContext(ctx).wait(ctx); err != nil {
+			return err
+		}
+		out, err := c.storage(ctx).Scan(input)
+		if err != nil {
+			return err
+		}
+
+		requests := make([]*dynamodb.WriteRequest, 0)
+		for _, item := range out.Items {
+			_, key := c.decodeKnownPartitionKey(known, aws.StringValue(item[c.partitionKey].S))
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			requests = append(requests, &dynamodb.WriteRequest{
+				DeleteRequest: &dynamodb.DeleteRequest{Key: c.primaryKey(item)},
+			})
+		}
+
+		consumed, err := c.writeRequests(ctx, requests)
+		reporter.written(len(requests), consumed, err)
+		if err != nil {
+			return err
+		}
+
+		if len(out.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+		progress := newScanProgress(1)
+		progress.LastKeys[0] = out.LastEvaluatedKey
+		reporter.checkpoint(progress)
+	}
+}
+
+// make sure the table can be scoped to the tenant with the given prefix
+func (c *Library) checkTenant(prefix string) error {
+	if c.partitionKeyType != "S" {
+		return errors.New("only tables with a string partition key can be scoped to tenants")
+	}
+	if prefix == "" {
+		return errors.New("the tenant's partition key prefix cannot be empty")
+	}
+
+	return nil
+}
+
+// return the tenant the snapshot was taken for, if any (see SnapshotTenant)
+func (s *config) getSnapshotTenant(snapshot string) string {
+	av := s.getSnapshotInfo(snapshot, snapshotInfoTenant)
+	if av == nil {
+		return ""
+	}
+
+	return aws.StringValue(av.S)
+}
+
+// make sure snapshot was not taken for a tenant, since rolling back to it would roll back every tenant
+func checkRollbackTenant(meta *config, snapshot string) error {
+	tenant := meta.getSnapshotTenant(snapshot)
+	if tenant == "" {
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf(
+		"snapshot '%s' was taken for tenant '%s' and cannot be rolled back to: restore it instead",
+		snapshot,
+		tenant,
+	))
+}
+
+// return true if item, with no snapshot in its partition key, belongs to the tenant with the given prefix
+func (c *Library) inTenant(item map[string]*dynamodb.AttributeValue, prefix string) bool {
+	return strings.HasPrefix(aws.StringValue(item[c.partitionKey].S), prefix)
+}
+
+// return the requests that make the versions of an item, as seen from the snapshot being written to (the first one
+// of dest, followed by the ones it falls back to), the same as seen from target, if it belongs to the tenant with the
+// given prefix
+func (c *Library) tenantRestoreRequests(
+	versions map[string]map[string]*dynamodb.AttributeValue,
+	target []string,
+	dest []string,
+	prefix string,
+) []*dynamodb.WriteRequest {
+	var key map[string]*dynamodb.AttributeValue
+	for _, version := range versions {
+		key = c.primaryKey(version)
+		break
+	}
+	if !c.inTenant(key, prefix) {
+		return nil
+	}
+
+	item := visibleVersion(versions, target)
+	if reflect.DeepEqual(item, visibleVersion(versions, dest)) {
+		return nil
+	}
+	if item != nil {
+		itemCopy := c.keyWithSnapshot(item, dest[0])
+		c.tagItem(itemCopy, dest[0])
+		return []*dynamodb.WriteRequest{{PutRequest: &dynamodb.PutRequest{Item: itemCopy}}}
+	}
+
+	// target does not see any of them, so deleting it from the snapshot being written to is not enough
+	requests := make([]*dynamodb.WriteRequest, 0)
+	for _, id := range dest {
+		if version, ok := versions[id]; ok {
+			requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
+				Key: c.keyWithSnapshot(c.primaryKey(version), id),
+			}})
+		}
+	}
+
+	return requests
+}
@@ -0,0 +1,146 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_RestoreTenant(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		if partitionKeyType[schema] != "S" {
+			err := library.Snapshot("tenant", SnapshotTenant("a-"))
+			if err == nil {
+				t.Error("expected an error scoping a numeric partition key to a tenant")
+			}
+			teardown(schema, t)
+			continue
+		}
+
+		put := func(pk string, valueTag string) {
+			item := getAttributeValueForItem(schema, valueTag)
+			item[partitionKey].SetS(pk)
+			_, err := library.PutItem(&dynamodb.PutItemInput{TableName: table, Item: item})
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		check := func(expected map[string]string) {
+			for pk, valueTag := range expected {
+				key := getAttributeValueForKey(schema)
+				key[partitionKey].SetS(pk)
+				out, err := library.GetItem(&dynamodb.GetItemInput{TableName: table, Key: key})
+				if err != nil {
+					t.Fatal("expected no errors, got", err)
+				}
+				switch {
+				case valueTag == "-" && out.Item != nil:
+					t.Error("expected no item for key", pk, "got", out.Item)
+				case valueTag != "-" && out.Item == nil:
+					t.Error("expected an item for key", pk)
+				case valueTag != "-" && aws.StringValue(out.Item[valueField].S) != fmtValueTag(valueTag):
+					t.Error("expected", fmtValueTag(valueTag), "for key", pk, "got", out.Item[valueField])
+				}
+			}
+		}
+
+		// tenants a- and b-, with a snapshot taken for a- only
+		put("a-1", "")
+		put("a-2", "")
+		put("b-1", "")
+		err := library.Snapshot("a", SnapshotTenant("a-"))
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		info, err := library.DescribeSnapshot("a")
+		if err != nil || info.Tenant != "a-" {
+			t.Error("expected a snapshot taken for tenant a-, got", info, err)
+		}
+		put("a-1", "a")
+		put("b-1", "a")
+		library.Snapshot("b")
+		put("a-3", "b")
+		library.Snapshot("c")
+		put("a-2", "c")
+		put("b-1", "c")
+
+		err = library.RestoreTenant("a", "b-")
+		if err == nil {
+			t.Error("expected an error restoring another tenant")
+		}
+
+		// only a- is restored, including the item added to b, which c keeps falling back to
+		err = library.Restore("a")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		check(map[string]string{"a-1": "a", "a-2": "", "a-3": "-", "b-1": "c"})
+
+		err = library.PurgeTenant("b-")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		check(map[string]string{"a-1": "", "b-1": "-"})
+
+		// rolling back to a snapshot taken for a tenant would roll back every tenant
+		if err := library.Rollback("a"); err == nil {
+			t.Error("expected an error rolling back to a snapshot taken for a tenant")
+		}
+		if err := library.ScheduleRollback("a", time.Now()); err == nil {
+			t.Error("expected an error scheduling a rollback to a snapshot taken for a tenant")
+		}
+		err = library.Rollback("b")
+		if err != nil {
+			t.Fatal("expected no errors, got", err)
+		}
+		check(map[string]string{"b-1": "-"})
+
+		teardown(schema, t)
+	}
+}
+
+func TestLibrary_Rollback_tenant(t *testing.T) {
+	storage := &metaRowStorage{item: map[string]*dynamodb.AttributeValue{
+		ddbSnapshotsField: {M: map[string]*dynamodb.AttributeValue{"a": {S: aws.String("1")}}},
+		ddbSnapshotInfoField: {M: map[string]*dynamodb.AttributeValue{
+			"a": {M: map[string]*dynamodb.AttributeValue{snapshotInfoTenant: {S: aws.String("a-")}}},
+		}},
+	}}
+	library := &Library{svc: storage, tableName: "movies", partitionKey: "name", partitionKeyType: "S"}
+
+	// neither right away, nor later on, since it would roll back every tenant
+	if err := library.Rollback("a"); err == nil {
+		t.Error("expected an error rolling back to a snapshot taken for a tenant")
+	}
+	if err := library.ScheduleRollback("a", time.Now()); err == nil {
+		t.Error("expected an error scheduling a rollback to a snapshot taken for a tenant")
+	}
+	if len(storage.transactions) != 0 {
+		t.Error("expected the metadata to be left as it is, got", storage.transactions)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// TransactWriteItems wraps the TransactWriteItems API operation for Amazon DynamoDB
+// (https://docs.aws.amazon.com/sdk-for-go/api/service/dynamodb/#DynamoDB.TransactWriteItems).
+//
+// It writes all of the items of the transaction to the active snapshot, or none at all. See
+// TransactWriteItemsFromSnapshot.
+//
+// Overhead: 1RU
+func (c *Library) TransactWriteItems(
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	return c.TransactWriteItemsWithContext(aws.BackgroundContext(), input)
+}
+
+// TransactWriteItemsWithContext is the same as TransactWriteItems with the addition of the ability to pass a context,
+// which is passed on to every request made to the table.
+func (c *Library) TransactWriteItemsWithContext(
+	ctx aws.Context,
+	input *dynamodb.TransactWriteItemsInput,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	return c.TransactWriteItemsFromSnapshotWithContext(ctx, input, snapshotCurrent)
+}
+
+// TransactWriteItemsFromSnapshot writes all of the items of the transaction to the specified snapshot, or none at
+// all. The snapshot is added to the partition key of every ConditionCheck, Delete, Put, and Update, which must all
+// refer to the managed table; the caller's input is left untouched.
+//
+// Like UpdateItem, the operations only ever see the items written to the snapshot: a ConditionCheck, for example,
+// does not look for the item in older snapshots.
+//
+// Overhead: 1RU
+func (c *Library) TransactWriteItemsFromSnapshot(
+	input *dynamodb.TransactWriteItemsInput,
+	snapshot string,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	return c.TransactWriteItemsFromSnapshotWithContext(aws.BackgroundContext(), input, snapshot)
+}
+
+// TransactWriteItemsFromSnapshotWithContext is the same as TransactWriteItemsFromSnapshot with the addition of the
+// ability to pass a context, which is passed on to every request made to the table.
+func (c *Library) TransactWriteItemsFromSnapshotWithContext(
+	ctx aws.Context,
+	input *dynamodb.TransactWriteItemsInput,
+	snapshot string,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	for _, item := range input.TransactItems {
+		err := c.checkTransactItem(item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	meta, err := c.loadMeta(ctx)
+	if err != nil {
+		return nil, wrapError("failed to create snapshots client", err)
+	}
+
+	snapshotID, err := meta.getWritableSnapshotID("TransactWriteItems", snapshot)
+	if err != nil {
+		return nil, wrapError("failed to get snapshot ID", err)
+	}
+
+	inputCopy := *input
+	inputCopy.TransactItems = make([]*dynamodb.TransactWriteItem, 0, len(input.TransactItems))
+	for _, item := range input.TransactItems {
+		itemCopy, err := c.addSnapshotToTransactItem(ctx, item, snapshotID)
+		if err != nil {
+			return nil, err
+		}
+		inputCopy.TransactItems = append(inputCopy.TransactItems, itemCopy)
+	}
+
+	// if the table is being migrated, the items may not have been converted yet, and the transaction has to see them
+	keys := make([]map[string]*dynamodb.AttributeValue, 0, len(inputCopy.TransactItems))
+	for _, item := range inputCopy.TransactItems {
+		switch {
+		case item.ConditionCheck != nil:
+			keys = append(keys, item.ConditionCheck.Key)
+		case item.Delete != nil:
+			keys = append(keys, item.Delete.Key)
+		case item.Put != nil:
+			keys = append(keys, item.Put.Item)
+		case item.Update != nil:
+			keys = append(keys, item.Update.Key)
+		}
+	}
+	for _, key := range keys {
+		if err := c.checkNotMetaRow("TransactWriteItems", key); err != nil {
+			return nil, err
+		}
+	}
+	err = c.convertOldEncodingCopies(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := c.storage(ctx).TransactWriteItems(&inputCopy)
+	if err != nil {
+		c.normalizeConditionFailure(err)
+		return nil, err
+	}
+
+	for _, metrics := range output.ItemCollectionMetrics[c.tableName] {
+		c.removeSnapshotFromKey(metrics.ItemCollectionKey)
+	}
+
+	return output, nil
+}
+
+// return a copy of a write of a transaction with the snapshot added to the partition key (and the item tagged, see
+// tagItem), making sure it refers to the managed table
+func (c *Library) addSnapshotToTransactItem(
+	ctx aws.Context,
+	item *dynamodb.TransactWriteItem,
+	snapshotID string,
+) (*dynamodb.TransactWriteItem, error) {
+	itemCopy := &dynamodb.TransactWriteItem{}
+
+	switch {
+	case item.ConditionCheck != nil:
+		check := *item.ConditionCheck
+		if err := c.resolveTable(&check.TableName); err != nil {
+			return nil, err
+		}
+		check.Key = c.keyWithSnapshot(check.Key, snapshotID)
+		check.ConditionExpression, _, check.ExpressionAttributeValues = c.rewriteCondition(check.ConditionExpression,
+			nil, check.ExpressionAttributeNames, check.ExpressionAttributeValues, snapshotID)
+		itemCopy.ConditionCheck = &check
+	case item.Delete != nil:
+		del := *item.Delete
+		if err := c.resolveTable(&del.TableName); err != nil {
+			return nil, err
+		}
+		del.Key = c.keyWithSnapshot(del.Key, snapshotID)
+		del.ConditionExpression, _, del.ExpressionAttributeValues = c.rewriteCondition(del.ConditionExpression, nil,
+			del.ExpressionAttributeNames, del.ExpressionAttributeValues, snapshotID)
+		itemCopy.Delete = &del
+	case item.Put != nil:
+		put := *item.Put
+		if err := c.resolveTable(&put.TableName); err != nil {
+			return nil, err
+		}
+		put.Item = c.keyWithSnapshot(put.Item, snapshotID)
+		if _, err := c.overflowItem(ctx, "TransactWriteItems", put.Item); err != nil {
+			return nil, err
+		}
+		c.tagItem(put.Item, snapshotID)
+		put.ConditionExpression, _, put.ExpressionAttributeValues = c.rewriteCondition(put.ConditionExpression, nil,
+			put.ExpressionAttributeNames, put.ExpressionAttributeValues, snapshotID)
+		itemCopy.Put = &put
+	case item.Update != nil:
+		update := *item.Update
+		if err := c.resolveTable(&update.TableName); err != nil {
+			return nil, err
+		}
+		if err := c.checkUpdateChecksum("TransactWriteItems"); err != nil {
+			return nil, err
+		}
+		err := checkOverflowUpdate("TransactWriteItems", update.UpdateExpression, update.ExpressionAttributeNames, nil)
+		if err != nil {
+			return nil, err
+		}
+		update.ConditionExpression, update.UpdateExpression, update.ExpressionAttributeValues = c.rewriteCondition(
+			update.ConditionExpression, update.UpdateExpression, update.ExpressionAttributeNames,
+			update.ExpressionAttributeValues, snapshotID)
+		// tag the update just like UpdateItem does
+		tagged := c.tagUpdate(&dynamodb.UpdateItemInput{
+			UpdateExpression:          update.UpdateExpression,
+			ExpressionAttributeNames:  update.ExpressionAttributeNames,
+			ExpressionAttributeValues: update.ExpressionAttributeValues,
+		}, snapshotID)
+		update.UpdateExpression = tagged.UpdateExpression
+		update.ExpressionAttributeNames = tagged.ExpressionAttributeNames
+		update.ExpressionAttributeValues = tagged.ExpressionAttributeValues
+		update.Key = c.keyWithSnapshot(update.Key, snapshotID)
+		itemCopy.Update = &update
+	default:
+		return nil, errors.New("empty transaction item")
+	}
+
+	return itemCopy, nil
+}
+
+// return a copy of a key (or item) with the snapshot added to the partition key
+func (c *Library) keyWithSnapshot(
+	key map[string]*dynamodb.AttributeValue,
+	snapshotID string,
+) map[string]*dynamodb.AttributeValue {
+	keyCopy := make(map[string]*dynamodb.AttributeValue, len(key))
+	for k, v := range key {
+		keyCopy[k] = v
+	}
+
+	if pk, ok := key[c.partitionKey]; ok && pk != nil {
+		pkCopy := *pk
+		c.addSnapshotToPartitionKey(snapshotID, &pkCopy)
+		keyCopy[c.partitionKey] = &pkCopy
+	}
+
+	return keyCopy
+}
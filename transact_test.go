@@ -0,0 +1,73 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_TransactWriteItems(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		table := aws.String(getTableName(schema))
+
+		library.Snapshot("1")
+
+		input := &dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Put: &dynamodb.Put{TableName: table, Item: getAttributeValueForItem(schema, "transaction")}},
+			},
+		}
+		_, err := library.TransactWriteItems(input)
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		if !reflect.DeepEqual(input.TransactItems[0].Put.Item, getAttributeValueForItem(schema, "transaction")) {
+			t.Error("expected the input not to change, got", input.TransactItems[0].Put.Item)
+		}
+
+		// the item only exists in the active snapshot
+		out, err := library.ScanFromSnapshot(&dynamodb.ScanInput{TableName: table}, "1")
+		if err != nil || len(out.Items) != 1 {
+			t.Error("expected 1 item in snapshot 1, got", out, err)
+		}
+		out, err = library.ScanFromSnapshot(&dynamodb.ScanInput{TableName: table}, "")
+		if err != nil || len(out.Items) != 0 {
+			t.Error("expected no items before the snapshot, got", out, err)
+		}
+
+		// every write must refer to the managed table
+		_, err = library.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+			TransactItems: []*dynamodb.TransactWriteItem{
+				{Delete: &dynamodb.Delete{TableName: aws.String("other"), Key: getAttributeValueForKey(schema)}},
+			},
+		})
+		if err == nil {
+			t.Error("expected an error for a transaction on another table")
+		}
+
+		teardown(schema, t)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// attribute, added to every item written when the version attribute is enabled, that stores the name of the
+	// snapshot it was written to, when, and a token unique to the write
+	versionAttribute = "ddblibrarian_version"
+	// fields of versionAttribute
+	versionAttributeSnapshot  = "snapshot"
+	versionAttributeWrittenAt = "written_at"
+	versionAttributeToken     = "token"
+)
+
+// remember the name of every snapshot, by ID, to stamp items with (see WithVersionAttribute); every write reads the
+// metadata first, so the snapshot it writes to is always known
+func (c *Library) rememberSnapshotNames(meta *config) {
+	names := make(map[string]string, len(meta.snapshots))
+	for name, id := range meta.snapshotIDMap() {
+		names[id] = name
+	}
+
+	c.namesMutex.Lock()
+	defer c.namesMutex.Unlock()
+	c.snapshotNames = names
+}
+
+// value of versionAttribute for an item being written to the snapshot with the given ID now: the snapshot's name
+// (Baseline before any snapshots were taken, or the ID if the name is not known), the time, as RFC 3339, and a random
+// token that compare-and-swap relies on (see PutItemIfUnchangedSince), since two writes may well happen at the same
+// time according to their clocks
+func (c *Library) versionAttributeValue(snapshotID string) *dynamodb.AttributeValue {
+	name := Baseline
+	if snapshotID != "" {
+		c.namesMutex.Lock()
+		name = c.snapshotNames[snapshotID]
+		c.namesMutex.Unlock()
+		if name == "" {
+			name = snapshotID
+		}
+	}
+
+	return &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{
+		versionAttributeSnapshot:  {S: aws.String(name)},
+		versionAttributeWrittenAt: timeToAttributeValue(c.clock.Now()),
+		versionAttributeToken:     {S: aws.String(newVersionToken())},
+	}}
+}
+
+// return a new token to tell apart the versions of an item
+func newVersionToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+
+	return hex.EncodeToString(token)
+}
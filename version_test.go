@@ -0,0 +1,95 @@
+/*
+	Copyright (C) 2017  Marco Almeida <marcoafalmeida@gmail.com>
+
+	This file is part of ddblibrarian.
+
+	ddblibrarian is free software; you can redistribute it and/or modify
+	it under the terms of the GNU General Public License as published by
+	the Free Software Foundation; either version 2 of the License, or
+	(at your option) any later version.
+
+	ddblibrarian is distributed in the hope that it will be useful,
+	but WITHOUT ANY WARRANTY; without even the implied warranty of
+	MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+	GNU General Public License for more details.
+
+	You should have received a copy of the GNU General Public License along
+	with this program; if not, write to the Free Software Foundation, Inc.,
+	51 Franklin Street, Fifth Floor, Boston, MA 02110-1301 USA.
+*/
+
+package ddblibrarian
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestLibrary_WithVersionAttribute(t *testing.T) {
+	for _, schema := range possibleSchemas {
+		library, teardown := setupTest(schema, t)
+		clock := &fakeClock{now: time.Date(2017, 11, 5, 10, 30, 0, 0, time.UTC)}
+		stamping := newClient(schema, t, WithVersionAttribute(), WithClock(clock))
+
+		// read the item as it is stored, from the raw table
+		stored := func(snapshot string) map[string]*dynamodb.AttributeValue {
+			meta, _ := library.loadMeta(aws.BackgroundContext())
+			id, _ := meta.getSnapshotID(snapshot)
+			key := getAttributeValueForKey(schema)
+			pk := *key[partitionKey]
+			library.addSnapshotToPartitionKey(id, &pk)
+			key[partitionKey] = &pk
+			out, err := testService(t).GetItem(&dynamodb.GetItemInput{
+				TableName: aws.String(getTableName(schema)),
+				Key:       key,
+			})
+			if err != nil {
+				t.Error(err)
+			}
+			return out.Item
+		}
+		checkVersion := func(item map[string]*dynamodb.AttributeValue, snapshot string) {
+			version, ok := item[versionAttribute]
+			if !ok {
+				t.Fatal("expected a version attribute, got", item)
+			}
+			written, err := timeFromAttributeValue(version.M[versionAttributeWrittenAt])
+			if aws.StringValue(version.M[versionAttributeSnapshot].S) != snapshot || err != nil ||
+				!written.Equal(clock.Now()) {
+				t.Error("expected snapshot", snapshot, "written at", clock.Now(), "got", version, err)
+			}
+		}
+
+		_, err := stamping.PutItem(&dynamodb.PutItemInput{Item: getAttributeValueForItem(schema, "baseline")})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		checkVersion(stored(Baseline), Baseline)
+
+		stamping.Snapshot("1")
+		clock.Advance(time.Minute)
+		_, err = stamping.UpdateItem(&dynamodb.UpdateItemInput{
+			Key:                       getAttributeValueForKey(schema),
+			UpdateExpression:          aws.String("SET #v = :v"),
+			ExpressionAttributeNames:  map[string]*string{"#v": aws.String(valueField)},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{":v": {S: aws.String("updated")}},
+		})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		}
+		checkVersion(stored("1"), "1")
+
+		// not visible through the library
+		out, err := stamping.GetItem(&dynamodb.GetItemInput{Key: getAttributeValueForKey(schema)})
+		if err != nil {
+			t.Error("expected no errors, got", err)
+		} else if _, ok := out.Item[versionAttribute]; ok {
+			t.Error("expected no version attribute, got", out.Item)
+		}
+
+		teardown(schema, t)
+	}
+}